@@ -6,6 +6,12 @@ import type {
   Application,
   CreateApplicationRequest,
   UpdateApplicationRequest,
+  ClientSecret,
+  RotateClientSecretRequest,
+  Provider,
+  ProviderRequest,
+  LdapTestResult,
+  LdapSyncResult,
   Token,
   RevokeTokenRequest,
   RevokeUserTokensRequest,
@@ -53,6 +59,11 @@ export const adminApi = {
     return response.data
   },
 
+  async resetUserMfa(id: number) {
+    const response = await apiClient.post<void>(`/admin/users/${id}/mfa/reset`)
+    return response.data
+  },
+
   async getApplications() {
     const response = await apiClient.get<Application[]>('/admin/applications')
     return response.data
@@ -78,6 +89,54 @@ export const adminApi = {
     return response.data
   },
 
+  async getClientSecrets(owner: string, name: string) {
+    const response = await apiClient.get<ClientSecret[]>(`/admin/applications/${owner}/${name}/secrets`)
+    return response.data
+  },
+
+  async rotateClientSecret(owner: string, name: string, data: RotateClientSecretRequest) {
+    const response = await apiClient.post<{ secret: ClientSecret; clientSecret: string }>(
+      `/admin/applications/${owner}/${name}/secrets`,
+      data
+    )
+    return response.data
+  },
+
+  async revokeClientSecret(owner: string, name: string, secret: string) {
+    const response = await apiClient.post<void>(`/admin/applications/${owner}/${name}/secrets/${secret}/revoke`)
+    return response.data
+  },
+
+  async getProviders() {
+    const response = await apiClient.get<Provider[]>('/admin/providers')
+    return response.data
+  },
+
+  async createProvider(data: ProviderRequest) {
+    const response = await apiClient.post<Provider>('/admin/providers', data)
+    return response.data
+  },
+
+  async updateProvider(owner: string, name: string, data: ProviderRequest) {
+    const response = await apiClient.post<Provider>(`/admin/providers/${owner}/${name}/update`, data)
+    return response.data
+  },
+
+  async deleteProvider(owner: string, name: string) {
+    const response = await apiClient.post<void>(`/admin/providers/${owner}/${name}/delete`)
+    return response.data
+  },
+
+  async testLdapProvider(owner: string, name: string) {
+    const response = await apiClient.post<LdapTestResult>(`/admin/providers/${owner}/${name}/test`)
+    return response.data
+  },
+
+  async syncLdapProvider(owner: string, name: string) {
+    const response = await apiClient.post<LdapSyncResult>(`/admin/providers/${owner}/${name}/sync`)
+    return response.data
+  },
+
   async getTokens() {
     const response = await apiClient.get<Token[]>('/admin/tokens')
     return response.data
@@ -1,12 +1,29 @@
 import { apiClient } from './client'
-import type { LoginResponse, UserInfoResponse, ApiResponse } from './types'
+import type { LoginResponse, UserInfoResponse, ApiResponse, WebauthnCredential, UserIdentity, SamlMessage, AccountDeletionStatus, UserSession } from './types'
 
 export const authApi = {
-  async login(data: { email: string; password: string; captchaToken?: string }) {
+  async login(data: { identifier: string; password: string; captchaToken?: string }) {
     const response = await apiClient.post<LoginResponse>('/auth/login', data)
     return response.data.data || response.data
   },
 
+  // 登录第二步：使用 MFA 票据和 TOTP 验证码或恢复码换取令牌
+  async verifyMfa(data: { mfaTicket: string; code?: string; recoveryCode?: string }) {
+    const response = await apiClient.post<LoginResponse>('/auth/mfa/verify', data)
+    return response.data.data || response.data
+  },
+
+  // 通行密钥登录：不带参数使用可发现凭据，带 mfaTicket 时作为第二步验证
+  async beginWebauthnLogin(data: { email?: string; mfaTicket?: string } = {}) {
+    const response = await apiClient.post<ApiResponse<{ sessionId: string; publicKey: any }>>('/auth/webauthn/login/begin', data)
+    return response.data
+  },
+
+  async finishWebauthnLogin(data: { sessionId: string; credential: any }) {
+    const response = await apiClient.post<LoginResponse>('/auth/webauthn/login/finish', data)
+    return response.data.data || response.data
+  },
+
   async getUserInfo(): Promise<UserInfoResponse> {
     // 注意：/api/userinfo 端点直接返回用户信息对象，不使用 ApiResponse 包装
     // 这符合 OIDC UserInfo 端点标准
@@ -14,21 +31,61 @@ export const authApi = {
     return response.data
   },
 
-  async register(data: { email: string; password: string; username?: string; verificationCode: string }) {
+  async register(data: { email?: string; phone?: string; password: string; username?: string; verificationCode: string }) {
     const response = await apiClient.post<ApiResponse<void>>('/auth/register', data)
     return response.data
   },
 
-  async sendVerificationCode(email: string, purpose: 'register' | 'reset_password', captchaToken: string) {
+  async sendVerificationCode(email: string, purpose: 'register' | 'reset_password' | 'login', captchaToken: string, clientId?: string) {
     const response = await apiClient.post<ApiResponse<{ message: string; code?: string }>>('/auth/send-code', {
       email,
       purpose,
-      captchaToken
+      captchaToken,
+      clientId
+    })
+    return response.data
+  },
+
+  // 短信验证码：phone 可带国家码（如 +86），不带时使用服务端默认国家码
+  async sendSmsCode(phone: string, purpose: 'register' | 'reset_password' | 'login', captchaToken: string, clientId?: string) {
+    const response = await apiClient.post<ApiResponse<{ message: string }>>('/auth/send-code', {
+      phone,
+      purpose,
+      captchaToken,
+      clientId
     })
     return response.data
   },
 
-  async resetPassword(data: { email: string; verificationCode: string; newPassword: string }) {
+  // 验证码登录：email + code、phone + code 或邮件中一键登录链接的 loginToken
+  async loginByCode(data: { email?: string; phone?: string; code?: string; loginToken?: string; clientId?: string; captchaToken?: string }) {
+    const response = await apiClient.post<LoginResponse>('/auth/login-by-code', data)
+    return response.data.data || response.data
+  },
+
+  // 第三方登录：登录按钮列表，以及用回调中的一次性票据换取令牌
+  async getLoginProviders() {
+    const response = await apiClient.get<ApiResponse<Array<{ name: string; displayName: string; type: string }>>>('/auth/providers')
+    return response.data
+  },
+
+  async finishProviderLogin(ticket: string) {
+    const response = await apiClient.post<LoginResponse>('/auth/provider/finish', { ticket })
+    return response.data.data || response.data
+  },
+
+  // SAML：为当前用户签发发送给服务提供商的响应
+  async completeSamlSso(data: { samlRequest?: string; relayState?: string; entityId?: string }) {
+    const response = await apiClient.post<ApiResponse<SamlMessage>>('/saml/sso/complete', data)
+    return response.data
+  },
+
+  async completeSamlSlo(data: { samlRequest: string; binding: string; relayState?: string }) {
+    const response = await apiClient.post<ApiResponse<SamlMessage & { signedOut: boolean }>>('/saml/slo/complete', data)
+    return response.data
+  },
+
+  async resetPassword(data: { email?: string; phone?: string; code: string; newPassword: string }) {
     const response = await apiClient.post<ApiResponse<{ message: string }>>('/auth/reset-password', data)
     return response.data
   },
@@ -56,7 +113,14 @@ export const authApi = {
     return response.data
   },
 
-  async updateProfile(data: { userId: string | number; username: string; qq: string; avatar: string }) {
+  async updateProfile(data: {
+    userId: string | number
+    username: string
+    qq: string
+    avatar: string
+    password?: string
+    oldPassword?: string
+  }) {
     const response = await apiClient.post<ApiResponse<{ message: string; user: any }>>('/auth/update-profile', data)
     return response.data
   },
@@ -95,6 +159,150 @@ export const authApi = {
     return response.data
   },
 
+  // 两步验证（TOTP）
+  async getMfaStatus() {
+    const response = await apiClient.get<ApiResponse<{ totpEnabled: boolean; recoveryCodesRemaining: number; webauthnCredentials: number }>>('/user/mfa')
+    return response.data
+  },
+
+  async setupTotp() {
+    const response = await apiClient.post<ApiResponse<{ secret: string; provisioningUri: string }>>('/user/mfa/totp/setup')
+    return response.data
+  },
+
+  async confirmTotp(code: string) {
+    const response = await apiClient.post<ApiResponse<{ message: string; recoveryCodes: string[] }>>('/user/mfa/totp/confirm', { code })
+    return response.data
+  },
+
+  async disableTotp(data: { code?: string; recoveryCode?: string }) {
+    const response = await apiClient.post<ApiResponse<{ message: string }>>('/user/mfa/totp/disable', data)
+    return response.data
+  },
+
+  async regenerateRecoveryCodes(code: string) {
+    const response = await apiClient.post<ApiResponse<{ recoveryCodes: string[] }>>('/user/mfa/recovery-codes', { code })
+    return response.data
+  },
+
+  // 通行密钥（WebAuthn）
+  async beginWebauthnRegistration() {
+    const response = await apiClient.post<ApiResponse<{ sessionId: string; publicKey: any }>>('/auth/webauthn/register/begin')
+    return response.data
+  },
+
+  async finishWebauthnRegistration(data: { sessionId: string; displayName?: string; credential: any }) {
+    const response = await apiClient.post<ApiResponse<WebauthnCredential>>('/auth/webauthn/register/finish', data)
+    return response.data
+  },
+
+  async getWebauthnCredentials() {
+    const response = await apiClient.get<ApiResponse<WebauthnCredential[]>>('/user/webauthn/credentials')
+    return response.data
+  },
+
+  async revokeWebauthnCredential(name: string) {
+    const response = await apiClient.post<ApiResponse<{ message: string }>>(`/user/webauthn/credentials/${name}/revoke`)
+    return response.data
+  },
+
+  // 手机号绑定
+  async sendPhoneBindCode(phone: string) {
+    const response = await apiClient.post<ApiResponse<{ message: string }>>('/user/phone/send-code', { phone })
+    return response.data
+  },
+
+  async verifyPhone(data: { phone: string; code: string }) {
+    const response = await apiClient.post<ApiResponse<{ message: string; phone: string; phoneVerified: boolean }>>('/user/phone/verify', data)
+    return response.data
+  },
+
+  async removePhone() {
+    const response = await apiClient.post<ApiResponse<{ message: string }>>('/user/phone/remove')
+    return response.data
+  },
+
+  // 更换邮箱：验证码发往新邮箱，确认后旧邮箱收到撤销链接
+  async sendEmailChangeCode(email: string) {
+    const response = await apiClient.post<ApiResponse<{ message: string }>>('/user/email/send-code', { email })
+    return response.data
+  },
+
+  async verifyEmailChange(data: { email: string; code: string }) {
+    const response = await apiClient.post<ApiResponse<{ message: string; email: string; emailVerified: boolean }>>('/user/email/verify', data)
+    return response.data
+  },
+
+  async revertEmailChange(token: string) {
+    const response = await apiClient.post<ApiResponse<{ message: string; email: string }>>('/auth/email/revert', { token })
+    return response.data
+  },
+
+  // 个人数据导出：返回文件内容，由调用方保存
+  async exportAccount(format: 'json' | 'zip') {
+    const response = await apiClient.getRaw<Blob>('/user/export', { params: { format }, responseType: 'blob' })
+    return response.data
+  },
+
+  // 账号注销
+  async getAccountDeletion() {
+    const response = await apiClient.get<ApiResponse<AccountDeletionStatus>>('/user/delete')
+    return response.data
+  },
+
+  async sendDeleteAccountCode() {
+    const response = await apiClient.post<ApiResponse<{ message: string }>>('/user/delete/send-code')
+    return response.data
+  },
+
+  async deleteAccount(data: { password?: string; code?: string; totpCode?: string; recoveryCode?: string }) {
+    const response = await apiClient.post<ApiResponse<{ message: string; deletionScheduledTime: string }>>('/user/delete', data)
+    return response.data
+  },
+
+  async cancelAccountDeletion() {
+    const response = await apiClient.post<ApiResponse<{ message: string }>>('/user/delete/cancel')
+    return response.data
+  },
+
+  // 登录设备管理
+  async getSessions() {
+    const response = await apiClient.get<ApiResponse<UserSession[]>>('/user/sessions')
+    return response.data
+  },
+
+  async revokeSession(name: string) {
+    const response = await apiClient.post<ApiResponse<{ message: string; current: boolean }>>(`/user/sessions/${name}/revoke`)
+    return response.data
+  },
+
+  async revokeAllSessions(data: { exceptCurrent?: boolean } = {}) {
+    const response = await apiClient.post<ApiResponse<{ message: string; count: number }>>('/user/sessions/revoke-all', data)
+    return response.data
+  },
+
+  // 退出登录：登出当前会话并撤销通过该会话签发的令牌
+  async logout() {
+    const response = await apiClient.post<ApiResponse<{ message: string }>>('/auth/logout', undefined, { skipAuthRedirect: true } as any)
+    return response.data
+  },
+
+  // 第三方账号绑定
+  async getUserIdentities() {
+    const response = await apiClient.get<ApiResponse<UserIdentity[]>>('/user/identities')
+    return response.data
+  },
+
+  async linkProvider(provider: string) {
+    const response = await apiClient.post<ApiResponse<{ url: string }>>(`/user/identities/${provider}/link`)
+    return response.data
+  },
+
+  async unlinkIdentity(name: string) {
+    const response = await apiClient.post<ApiResponse<{ message: string }>>(`/user/identities/${name}/unlink`)
+    return response.data
+  },
+
   async getUserApplications() {
     const response = await apiClient.get<ApiResponse<Array<{
       owner: string
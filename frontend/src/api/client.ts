@@ -56,6 +56,10 @@ export class ApiClient {
           
           switch (status) {
             case 401:
+              // 退出登录时会话可能已被登出，由调用方清除本地状态
+              if ((error.config as any)?.skipAuthRedirect) {
+                break
+              }
               storage.clear()
               window.location.href = '/login'
               break
@@ -3,12 +3,16 @@ export interface User {
   owner: string
   username: string
   email: string
+  emailVerified?: boolean
+  phone?: string
+  phoneVerified?: boolean
   qq?: string
   avatar?: string
   isRealName?: boolean
   isAdmin?: boolean
   isForbidden?: boolean
   isDeleted?: boolean
+  totpEnabled?: boolean
   createdTime: string
   updatedTime: string
   type?: string
@@ -46,12 +50,33 @@ export interface Application {
   grantTypes: string[]
   tags?: string[]
   clientId: string
-  clientSecret?: string
+  clientSecret?: string // 仅在创建时返回一次
   redirectUris: string[]
   tokenFormat?: string
   expireInHours?: number
   refreshExpireInHours?: number
   scopes: string[]
+  category?: string // OAuth 或 SAML
+  samlEntityId?: string
+  samlAcsUrl?: string
+  samlSloUrl?: string
+  samlNameIdFormat?: string
+  samlAttributes?: Record<string, string>
+}
+
+export interface ClientSecret {
+  owner: string
+  name: string
+  createdTime: string
+  application: string
+  hint: string
+  expiresAt: number
+  isRevoked: boolean
+}
+
+export interface RotateClientSecretRequest {
+  expiresInHours?: number
+  previousExpiresInHours?: number
 }
 
 export interface CreateApplicationRequest {
@@ -62,6 +87,13 @@ export interface CreateApplicationRequest {
   displayName?: string
   logo?: string
   organization?: string
+  enableCodeSignin?: boolean
+  category?: string
+  samlEntityId?: string
+  samlAcsUrl?: string
+  samlSloUrl?: string
+  samlNameIdFormat?: string
+  samlAttributes?: Record<string, string>
 }
 
 export interface UpdateApplicationRequest {
@@ -72,6 +104,13 @@ export interface UpdateApplicationRequest {
   displayName?: string
   logo?: string
   organization?: string
+  enableCodeSignin?: boolean
+  category?: string
+  samlEntityId?: string
+  samlAcsUrl?: string
+  samlSloUrl?: string
+  samlNameIdFormat?: string
+  samlAttributes?: Record<string, string>
 }
 
 export interface Token {
@@ -81,9 +120,9 @@ export interface Token {
   application: string
   organization: string
   user: string
-  code: string
-  accessToken: string
+  accessToken: string // 掩码后的令牌标识
   refreshToken: string
+  jti: string
   expiresIn: number
   scope: string
   tokenType: string
@@ -151,9 +190,124 @@ export interface CreateRoleRequest {
   organization?: string
 }
 
-export interface LoginRequest {
+export interface WebauthnCredential {
+  owner: string
+  name: string
+  createdTime: string
+  displayName: string
+  credentialId: string
+  transports: string[]
+  isDiscoverable: boolean
+  backupEligible: boolean
+  lastUsedTime: string
+}
+
+export interface Provider {
+  owner: string
+  name: string
+  createdTime: string
+  displayName: string
+  category: string
+  type: string
+  clientId: string
+  authUrl?: string
+  tokenUrl?: string
+  userInfoUrl?: string
+  scopes?: string
+  userMapping?: Record<string, string>
+  isEnabled: boolean
+  issuer?: string
+  organization?: string
+  emailLinking?: string
+  hostUrl?: string
+  ldapBaseDn?: string
+  ldapUserFilter?: string
+  ldapBindDnTemplate?: string
+  ldapStartTls?: boolean
+  ldapGroupAttribute?: string
+  ldapGroupRoles?: Record<string, string>
+  ldapSyncInterval?: number
+  ldapLastSyncTime?: string
+}
+
+export interface ProviderRequest {
+  name: string
+  displayName?: string
+  type: string
+  clientId: string
+  clientSecret?: string // 更新时留空表示不修改
+  authUrl?: string
+  tokenUrl?: string
+  userInfoUrl?: string
+  scopes?: string
+  userMapping?: Record<string, string>
+  isEnabled?: boolean
+  category?: string // OAuth、OIDC 或 LDAP
+  issuer?: string // OIDC 提供商只需填写 issuer，端点通过 discovery 获取
+  organization?: string
+  emailLinking?: string // reject、link 或 ignore
+  // LDAP 提供商：clientId 和 clientSecret 为服务账号的 DN 和密码
+  hostUrl?: string // ldap:// 或 ldaps:// 服务器地址
+  ldapBaseDn?: string
+  ldapUserFilter?: string // %s 为登录邮箱，默认 (mail=%s)
+  ldapBindDnTemplate?: string // 设置后用户直接绑定，如 uid=%s,ou=people,dc=example,dc=com
+  ldapStartTls?: boolean
+  ldapGroupAttribute?: string // 默认 memberOf
+  ldapGroupRoles?: Record<string, string> // 组 DN -> user 或 admin
+  ldapSyncInterval?: number // 自动同步间隔（分钟），0 表示不自动同步
+}
+
+export interface LdapTestResult {
+  users: string[]
+}
+
+export interface LdapSyncResult {
+  created: number
+  updated: number
+  disabled: number
+}
+
+export interface UserIdentity {
+  owner: string
+  name: string
+  createdTime: string
+  provider: string
+  subject: string
   username: string
+  email: string
+  avatar: string
+  lastUsedTime: string
+}
+
+export interface AccountDeletionStatus {
+  scheduled: boolean
+  deletionScheduledTime: string
+  gracePeriodDays: number
+  codeTarget: string
+  hasPassword: boolean
+  totpEnabled: boolean
+}
+
+export interface UserSession {
+  name: string
+  device: string
+  userAgent: string
+  ip: string
+  createdTime: string
+  lastSeenTime: string
+  applications: Array<{
+    owner: string
+    name: string
+    displayName: string
+    logo: string
+  }>
+  current: boolean
+}
+
+export interface LoginRequest {
+  identifier: string
   password: string
+  captchaToken?: string
 }
 
 export interface LoginResponse {
@@ -186,6 +340,9 @@ export interface UserInfoResponse {
   preferred_username?: string
   given_name?: string
   email?: string
+  email_verified?: boolean
+  phone_number?: string
+  phone_number_verified?: boolean
   picture?: string
   avatar?: string
   qq?: string
@@ -215,7 +372,22 @@ export interface ApiResponse<T> {
   data2?: T
 }
 
+// 密码策略违规项，注册、重置和修改密码失败时在 data 中返回
+export interface PasswordViolation {
+  code: 'too_short' | 'too_long' | 'missing_class' | 'user_attribute' | 'reused' | 'breached' | string
+  message: string
+  param?: string
+}
+
 export interface ApiError {
   status: string
   msg: string
 }
+
+// SAML 消息：POST 绑定时由浏览器以表单提交 samlResponse 和 relayState 到 url，Redirect 绑定时直接跳转 url
+export interface SamlMessage {
+  binding: string
+  url: string
+  samlResponse?: string
+  relayState?: string
+}
@@ -31,6 +31,18 @@ const routes: RouteRecordRaw[] = [
     component: () => import('@/views/auth/AuthorizeView.vue'),
     meta: { requiresAuth: true }
   },
+  {
+    path: '/saml/sso',
+    name: 'SamlSso',
+    component: () => import('@/views/auth/SamlSsoView.vue'),
+    meta: { requiresAuth: false }
+  },
+  {
+    path: '/saml/logout',
+    name: 'SamlLogout',
+    component: () => import('@/views/auth/SamlLogoutView.vue'),
+    meta: { requiresAuth: false }
+  },
   {
     path: '/console',
     name: 'Console',
@@ -85,6 +97,11 @@ const routes: RouteRecordRaw[] = [
         path: 'tokens',
         name: 'TokenManagement',
         component: () => import('@/views/admin/TokensView.vue')
+      },
+      {
+        path: 'providers',
+        name: 'ProviderManagement',
+        component: () => import('@/views/admin/ProvidersView.vue')
       }
     ]
   },
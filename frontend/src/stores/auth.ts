@@ -2,9 +2,11 @@ import { defineStore } from 'pinia'
 import { ref, computed } from 'vue'
 import { authApi } from '@/api/auth'
 import { storage } from '@/utils/storage'
+import { getPasskeyAssertion } from '@/utils/webauthn'
 
 interface LoginRequest {
-  email: string
+  // 邮箱、用户名或手机号，可用类型由组织配置决定
+  identifier: string
   password: string
   captchaToken?: string
 }
@@ -30,6 +32,43 @@ export const useAuthStore = defineStore('auth', () => {
     return userInfo.value.isAdmin || false
   })
 
+  // 保存登录返回的令牌和用户信息
+  function applyLoginData(loginData: any) {
+    // 检查是否有 access_token
+    if (!loginData || !loginData.access_token) {
+      throw new Error('登录失败：未收到访问令牌')
+    }
+
+    accessToken.value = loginData.access_token
+    storage.setAccessToken(loginData.access_token)
+
+    if (loginData.refresh_token) {
+      refreshToken.value = loginData.refresh_token
+      storage.setRefreshToken(loginData.refresh_token)
+    }
+
+    if (loginData.user) {
+      userInfo.value = {
+        id: String(loginData.user.id),
+        email: loginData.user.email,
+        username: loginData.user.username,
+        isAdmin: loginData.user.isAdmin,
+        isRealName: loginData.user.isRealName,
+        qq: loginData.user.qq,
+        avatar: loginData.user.avatar
+      }
+      storage.setUserInfo(userInfo.value)
+    }
+  }
+
+  function clearSession() {
+    accessToken.value = null
+    refreshToken.value = null
+    userInfo.value = null
+    storage.clear()
+  }
+
+  // 登录；启用两步验证的账户返回 { mfaRequired, mfaTicket }，需再调用 verifyMfa
   async function login(data: LoginRequest) {
     try {
       const apiResponse = await authApi.login(data)
@@ -40,51 +79,76 @@ export const useAuthStore = defineStore('auth', () => {
       } else {
         loginData = apiResponse
       }
-      
-      // 检查是否有 access_token
-      if (!loginData || !loginData.access_token) {
-        throw new Error('登录失败：未收到访问令牌')
-      }
-      
-      accessToken.value = loginData.access_token
-      storage.setAccessToken(loginData.access_token)
-      
-      if (loginData.refresh_token) {
-        refreshToken.value = loginData.refresh_token
-        storage.setRefreshToken(loginData.refresh_token)
-      }
-      
-      if (loginData.user) {
-        userInfo.value = {
-          id: String(loginData.user.id),
-          email: loginData.user.email,
-          username: loginData.user.username,
-          isAdmin: loginData.user.isAdmin,
-          isRealName: loginData.user.isRealName,
-          qq: loginData.user.qq,
-          avatar: loginData.user.avatar
-        }
-        storage.setUserInfo(userInfo.value)
+
+      if (loginData?.mfaRequired) {
+        return loginData
       }
-      
+
+      applyLoginData(loginData)
       return loginData
     } catch (error: any) {
       // 清理可能的残留数据
-      accessToken.value = null
-      refreshToken.value = null
-      userInfo.value = null
-      storage.clear()
-      
+      clearSession()
+
       // 重新抛出错误，让调用者处理
       throw error
     }
   }
 
+  // 邮箱验证码或一键登录链接登录，启用两步验证的账户同样返回 { mfaRequired, mfaTicket }
+  async function loginByCode(data: { email?: string; phone?: string; code?: string; loginToken?: string; clientId?: string; captchaToken?: string }) {
+    const apiResponse: any = await authApi.loginByCode(data)
+    const loginData = apiResponse?.data || apiResponse
+    if (loginData?.mfaRequired) {
+      return loginData
+    }
+
+    applyLoginData(loginData)
+    return loginData
+  }
+
+  // 第三方登录回调后用一次性票据换取令牌，启用两步验证的账户返回 { mfaRequired, mfaTicket }
+  async function loginByProvider(ticket: string) {
+    const apiResponse: any = await authApi.finishProviderLogin(ticket)
+    const loginData = apiResponse?.data || apiResponse
+    if (loginData?.mfaRequired) {
+      return loginData
+    }
+
+    applyLoginData(loginData)
+    return loginData
+  }
+
+    async function verifyMfa(data: { mfaTicket: string; code?: string; recoveryCode?: string }) {
+    const apiResponse: any = await authApi.verifyMfa(data)
+    const loginData = apiResponse?.data || apiResponse
+    applyLoginData(loginData)
+    return loginData
+  }
+
+  // 通行密钥登录；传入 mfaTicket 时作为密码之后的第二步验证
+  async function loginWithPasskey(mfaTicket?: string) {
+    const begin: any = await authApi.beginWebauthnLogin(mfaTicket ? { mfaTicket } : {})
+    if (begin?.status !== 'ok' || !begin.data) {
+      throw new Error(begin?.msg || '创建通行密钥登录请求失败')
+    }
+    const credential = await getPasskeyAssertion(begin.data.publicKey)
+    const apiResponse: any = await authApi.finishWebauthnLogin({ sessionId: begin.data.sessionId, credential })
+    const loginData = apiResponse?.data || apiResponse
+    applyLoginData(loginData)
+    return loginData
+  }
+
   async function logout() {
-    accessToken.value = null
-    refreshToken.value = null
-    userInfo.value = null
-    storage.clear()
+    // 令牌可能已失效，服务端登出失败时仍清除本地会话
+    if (accessToken.value) {
+      try {
+        await authApi.logout()
+      } catch {
+        // ignore
+      }
+    }
+    clearSession()
   }
 
   async function fetchUserInfo() {
@@ -126,6 +190,10 @@ export const useAuthStore = defineStore('auth', () => {
     isAuthenticated,
     isAdmin,
     login,
+    verifyMfa,
+    loginByCode,
+    loginByProvider,
+    loginWithPasskey,
     logout,
     fetchUserInfo,
     setTokens
@@ -0,0 +1,39 @@
+import type { PasswordViolation } from '@/api/types'
+
+const CHAR_CLASS_LABELS: Record<string, string> = {
+  lower: '小写字母',
+  upper: '大写字母',
+  digit: '数字',
+  symbol: '符号'
+}
+
+const ATTRIBUTE_LABELS: Record<string, string> = {
+  username: '用户名',
+  email: '邮箱',
+  phone: '手机号'
+}
+
+// 将后端返回的密码策略违规列表转换为提示文本，不是违规列表时返回 undefined
+export function formatPasswordViolations(data: unknown): string | undefined {
+  if (!Array.isArray(data) || data.length === 0) return undefined
+
+  const messages = (data as PasswordViolation[]).map((violation) => {
+    switch (violation.code) {
+      case 'too_short':
+        return `密码至少 ${violation.param} 个字符`
+      case 'too_long':
+        return `密码不能超过 ${violation.param} 个字节`
+      case 'missing_class':
+        return `密码需包含${CHAR_CLASS_LABELS[violation.param || ''] || violation.param}`
+      case 'user_attribute':
+        return `密码不能包含${ATTRIBUTE_LABELS[violation.param || ''] || violation.param}`
+      case 'reused':
+        return `不能使用最近 ${violation.param} 次用过的密码`
+      case 'breached':
+        return '该密码已出现在泄露的密码库中，请更换'
+      default:
+        return violation.message
+    }
+  })
+  return messages.join('；')
+}
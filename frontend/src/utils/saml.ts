@@ -0,0 +1,32 @@
+import type { SamlMessage } from '@/api/types'
+
+const SAML_BINDING_POST = 'urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST'
+
+// 将签名的 SAML 消息交给服务提供商：POST 绑定自动提交表单，Redirect 绑定直接跳转
+export function submitSamlMessage(message: SamlMessage) {
+  if (message.binding !== SAML_BINDING_POST) {
+    window.location.href = message.url
+    return
+  }
+
+  const form = document.createElement('form')
+  form.method = 'POST'
+  form.action = message.url
+  form.style.display = 'none'
+
+  const fields: Record<string, string | undefined> = {
+    SAMLResponse: message.samlResponse,
+    RelayState: message.relayState
+  }
+  for (const [name, value] of Object.entries(fields)) {
+    if (!value) continue
+    const input = document.createElement('input')
+    input.type = 'hidden'
+    input.name = name
+    input.value = value
+    form.appendChild(input)
+  }
+
+  document.body.appendChild(form)
+  form.submit()
+}
@@ -0,0 +1,86 @@
+// WebAuthn 工具：服务端以 base64url 传递二进制字段，调用浏览器 API 前后需要转换
+
+function base64urlToBuffer(value: string): ArrayBuffer {
+  const base64 = value.replace(/-/g, '+').replace(/_/g, '/')
+  const padded = base64 + '='.repeat((4 - (base64.length % 4)) % 4)
+  const binary = atob(padded)
+  const bytes = new Uint8Array(binary.length)
+  for (let i = 0; i < binary.length; i++) {
+    bytes[i] = binary.charCodeAt(i)
+  }
+  return bytes.buffer
+}
+
+function bufferToBase64url(buffer: ArrayBuffer | null): string {
+  if (!buffer) return ''
+  const bytes = new Uint8Array(buffer)
+  let binary = ''
+  for (let i = 0; i < bytes.length; i++) {
+    binary += String.fromCharCode(bytes[i])
+  }
+  return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+}
+
+function toDescriptors(list: any[] | undefined): PublicKeyCredentialDescriptor[] {
+  return (list || []).map((item) => ({
+    type: 'public-key',
+    id: base64urlToBuffer(item.id),
+    transports: item.transports
+  }))
+}
+
+export function isWebauthnSupported(): boolean {
+  return typeof window !== 'undefined' && !!window.PublicKeyCredential && !!navigator.credentials
+}
+
+// 调用 navigator.credentials.create() 并序列化注册结果
+export async function createPasskey(options: any) {
+  const publicKey: PublicKeyCredentialCreationOptions = {
+    ...options,
+    challenge: base64urlToBuffer(options.challenge),
+    user: { ...options.user, id: base64urlToBuffer(options.user.id) },
+    excludeCredentials: toDescriptors(options.excludeCredentials)
+  }
+
+  const credential = (await navigator.credentials.create({ publicKey })) as PublicKeyCredential | null
+  if (!credential) {
+    throw new Error('未创建通行密钥')
+  }
+  const response = credential.response as AuthenticatorAttestationResponse
+  return {
+    id: credential.id,
+    rawId: bufferToBase64url(credential.rawId),
+    type: credential.type,
+    response: {
+      clientDataJSON: bufferToBase64url(response.clientDataJSON),
+      attestationObject: bufferToBase64url(response.attestationObject),
+      transports: typeof response.getTransports === 'function' ? response.getTransports() : []
+    }
+  }
+}
+
+// 调用 navigator.credentials.get() 并序列化断言结果
+export async function getPasskeyAssertion(options: any) {
+  const publicKey: PublicKeyCredentialRequestOptions = {
+    ...options,
+    challenge: base64urlToBuffer(options.challenge),
+    allowCredentials: toDescriptors(options.allowCredentials)
+  }
+
+  const credential = (await navigator.credentials.get({ publicKey })) as PublicKeyCredential | null
+  if (!credential) {
+    throw new Error('未选择通行密钥')
+  }
+  const response = credential.response as AuthenticatorAssertionResponse
+  return {
+    id: credential.id,
+    rawId: bufferToBase64url(credential.rawId),
+    type: credential.type,
+    response: {
+      clientDataJSON: bufferToBase64url(response.clientDataJSON),
+      authenticatorData: bufferToBase64url(response.authenticatorData),
+      signature: bufferToBase64url(response.signature),
+      userHandle: bufferToBase64url(response.userHandle)
+    }
+  }
+}
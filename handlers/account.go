@@ -0,0 +1,187 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oauth-server/oauth-server/services"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+// HandleExportAccount 导出当前用户的个人数据
+// format=zip 时返回按类别拆分的 ZIP 压缩包，否则返回单个 JSON 文件；不包含密码哈希、令牌和实名原文
+func HandleExportAccount() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		export, err := services.BuildAccountExport(user)
+		if err != nil {
+			log.Printf("[Account] Failed to export user %d: %v", user.Id, err)
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("导出数据失败"))
+		}
+
+		filename := fmt.Sprintf("account-%d-%s", user.Id, time.Now().Format("20060102"))
+		switch ctx.Query("format", "json") {
+		case "json":
+			ctx.Attachment(filename + ".json")
+			return ctx.JSON(export)
+		case "zip":
+			var buf bytes.Buffer
+			if err := services.WriteAccountExportZip(&buf, export); err != nil {
+				log.Printf("[Account] Failed to write export archive of user %d: %v", user.Id, err)
+				return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("导出数据失败"))
+			}
+			ctx.Attachment(filename + ".zip")
+			return ctx.Send(buf.Bytes())
+		default:
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("format 仅支持 json 或 zip"))
+		}
+	}
+}
+
+// HandleGetAccountDeletion 获取当前用户的注销状态
+func HandleGetAccountDeletion() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"scheduled":             user.DeletionScheduledTime != "",
+			"deletionScheduledTime": user.DeletionScheduledTime,
+			"gracePeriodDays":       int(services.AccountDeletionGracePeriod().Hours() / 24),
+			"codeTarget":            services.DeleteAccountCodeTarget(user),
+			"hasPassword":           user.Password != "",
+			"totpEnabled":           user.TotpEnabled,
+		}))
+	}
+}
+
+// HandleSendDeleteAccountCode 向账号的邮箱（没有邮箱时为手机号）发送注销确认验证码
+func HandleSendDeleteAccountCode() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		target := services.DeleteAccountCodeTarget(user)
+		if target == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("账号未绑定邮箱或手机号，请使用密码确认"))
+		}
+		if ok, err := checkResendCooldown(ctx, target, services.PurposeDeleteAccount); !ok {
+			return err
+		}
+
+		code, err := services.SendDeleteAccountCode(user)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("发送验证码失败"))
+		}
+		if code != "" {
+			// 开发环境下记录验证码
+			log.Printf("Verification code sent to %s: %s", target, code)
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]string{
+			"message": "验证码已发送",
+		}))
+	}
+}
+
+// HandleDeleteAccount 重新验证身份后申请注销账号
+// 冷静期内账号可正常使用并可撤销，期满后后台任务撤销全部令牌并清除个人数据（含加密的实名信息）
+func HandleDeleteAccount() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		var req types.DeleteAccountRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		if user.IsAdmin {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("不能注销管理员账户"))
+		}
+		if user.DeletionScheduledTime != "" {
+			return ctx.Status(fiber.StatusConflict).JSON(types.ErrorResponse("已申请注销，请勿重复提交"))
+		}
+
+		// 密码和第二因素错误与登录共用按用户 ID 计数的账户锁定
+		account := services.UserThrottleAccount(user.GetId())
+		if allowed, err := checkMfaAttempt(ctx, account); !allowed {
+			return err
+		}
+
+		err = services.ReauthenticateUser(user, req.Password, req.Code, req.TotpCode, req.RecoveryCode)
+		switch {
+		case err == nil:
+			recordBruteForceSuccess(services.ThrottleScopePassword, account)
+		case errors.Is(err, services.ErrInvalidCredentials),
+			errors.Is(err, services.ErrMfaCodeInvalid),
+			errors.Is(err, services.ErrMfaRecoveryNotValid):
+			recordBruteForceFailure(ctx, services.ThrottleScopePassword, account)
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrReauthRequired):
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponseWithData("请验证身份后再注销账号", map[string]bool{
+					"totpRequired": user.TotpEnabled,
+				}))
+			case errors.Is(err, services.ErrInvalidCredentials):
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("密码错误"))
+			case errors.Is(err, services.ErrVerificationCodeNotFound),
+				errors.Is(err, services.ErrVerificationCodeInvalid),
+				errors.Is(err, services.ErrVerificationCodeTooManyAttempts):
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码无效或已过期"))
+			case errors.Is(err, services.ErrMfaCodeInvalid), errors.Is(err, services.ErrMfaRecoveryNotValid):
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(mfaErrorMessage(err)))
+			}
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("验证身份失败"))
+		}
+
+		purgeTime, err := services.ScheduleAccountDeletion(user)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("申请注销失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"message":               "已申请注销，冷静期结束后账号数据将被永久删除",
+			"deletionScheduledTime": purgeTime.Format(time.RFC3339),
+		}))
+	}
+}
+
+// HandleCancelAccountDeletion 在冷静期内撤销注销申请
+func HandleCancelAccountDeletion() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		if err := services.CancelAccountDeletion(user); err != nil {
+			if errors.Is(err, services.ErrAccountDeletionNotScheduled) {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("未申请注销"))
+			}
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("撤销注销失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]string{
+			"message": "已撤销注销申请",
+		}))
+	}
+}
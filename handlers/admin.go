@@ -4,6 +4,7 @@
 package handlers
 
 import (
+	"fmt"
 	"strconv"
 	"time"
 
@@ -11,7 +12,6 @@ import (
 	"github.com/oauth-server/oauth-server/models"
 	"github.com/oauth-server/oauth-server/services"
 	"github.com/oauth-server/oauth-server/types"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // HandleGetUsers 获取用户列表（需要管理员权限）
@@ -41,14 +41,16 @@ func HandleGetUsers() fiber.Handler {
 		userList := make([]types.UserInfo, 0, len(users))
 		for _, user := range users {
 			userList = append(userList, types.UserInfo{
-				ID:          user.Id,
-				Email:       user.Email,
-				Username:    user.Username,
-				IsAdmin:     user.IsAdmin,
-				IsRealName:  user.IsRealName,
-				IsForbidden: user.IsForbidden,
-				QQ:          user.QQ,
-				Avatar:      user.Avatar,
+				ID:            user.Id,
+				Email:         user.Email,
+				EmailVerified: user.EmailVerified,
+				Username:      user.Username,
+				IsAdmin:       user.IsAdmin,
+				IsRealName:    user.IsRealName,
+				IsForbidden:   user.IsForbidden,
+				QQ:            user.QQ,
+				Avatar:        user.Avatar,
+				Phone:         user.Phone,
 			})
 		}
 
@@ -83,14 +85,16 @@ func HandleGetUser() fiber.Handler {
 
 		// 构造响应数据
 		userInfo := types.UserInfo{
-			ID:          user.Id,
-			Email:       user.Email,
-			Username:    user.Username,
-			IsAdmin:     user.IsAdmin,
-			IsRealName:  user.IsRealName,
-			IsForbidden: user.IsForbidden,
-			QQ:          user.QQ,
-			Avatar:      user.Avatar,
+			ID:            user.Id,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			Username:      user.Username,
+			IsAdmin:       user.IsAdmin,
+			IsRealName:    user.IsRealName,
+			IsForbidden:   user.IsForbidden,
+			QQ:            user.QQ,
+			Avatar:        user.Avatar,
+			Phone:         user.Phone,
 		}
 
 		return ctx.JSON(types.SuccessResponse(userInfo))
@@ -116,10 +120,13 @@ func HandleCreateUser() fiber.Handler {
 		if len(req.Username) < 3 || len(req.Username) > 50 {
 			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("用户名长度必须在3-50个字符之间"))
 		}
+		if ok, err := checkUsernameAvailable(ctx, "built-in", req.Username, 0); !ok {
+			return err
+		}
 
-		// 验证密码长度
-		if len(req.Password) < 6 {
-			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("密码长度至少为6个字符"))
+		// 验证密码长度，组织策略的其他规则在设置密码时检查
+		if err := services.CheckPasswordBaseline(req.Password); err != nil {
+			return passwordErrorResponse(ctx, err, fiber.StatusBadRequest, err.Error())
 		}
 
 		// 检查邮箱是否已存在（排除已删除的用户）
@@ -131,12 +138,6 @@ func HandleCreateUser() fiber.Handler {
 			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("邮箱已存在"))
 		}
 
-		// 哈希密码
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-		if err != nil {
-			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("密码加密失败"))
-		}
-
 		// 创建用户
 		now := time.Now().Format("2006-01-02T15:04:05Z07:00")
 		user := &models.User{
@@ -145,7 +146,6 @@ func HandleCreateUser() fiber.Handler {
 			UpdatedTime: now,
 			Username:    req.Username,
 			Email:       req.Email,
-			Password:    string(hashedPassword),
 			QQ:          req.QQ,
 			Avatar:      req.Avatar,
 			IsAdmin:     false,
@@ -154,6 +154,11 @@ func HandleCreateUser() fiber.Handler {
 			IsRealName:  false,
 		}
 
+		// 按组织配置的算法哈希密码
+		if err := services.SetUserPassword(user, req.Password); err != nil {
+			return passwordErrorResponse(ctx, err, fiber.StatusInternalServerError, "密码加密失败")
+		}
+
 		// 保存到数据库
 		_, err = models.AddUser(user)
 		if err != nil {
@@ -162,14 +167,16 @@ func HandleCreateUser() fiber.Handler {
 
 		// 返回用户信息
 		userInfo := types.UserInfo{
-			ID:          user.Id,
-			Email:       user.Email,
-			Username:    user.Username,
-			IsAdmin:     user.IsAdmin,
-			IsRealName:  user.IsRealName,
-			IsForbidden: user.IsForbidden,
-			QQ:          user.QQ,
-			Avatar:      user.Avatar,
+			ID:            user.Id,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			Username:      user.Username,
+			IsAdmin:       user.IsAdmin,
+			IsRealName:    user.IsRealName,
+			IsForbidden:   user.IsForbidden,
+			QQ:            user.QQ,
+			Avatar:        user.Avatar,
+			Phone:         user.Phone,
 		}
 
 		return ctx.JSON(types.SuccessResponse(userInfo))
@@ -212,9 +219,15 @@ func HandleUpdateUser() fiber.Handler {
 			if len(req.Username) < 3 || len(req.Username) > 50 {
 				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("用户名长度必须在3-50个字符之间"))
 			}
+			if ok, err := checkUsernameAvailable(ctx, user.Owner, req.Username, user.Id); !ok {
+				return err
+			}
 			user.Username = req.Username
 		}
-		if req.Email != "" {
+		if req.Email != "" && req.Email != user.Email {
+			if !services.ValidateEmail(req.Email) {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("邮箱格式无效"))
+			}
 			// 检查新邮箱是否已被其他用户使用（排除已删除的用户）
 			existingUser, err := models.GetUserByEmail(req.Email)
 			if err != nil {
@@ -224,6 +237,8 @@ func HandleUpdateUser() fiber.Handler {
 				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("邮箱已被其他用户使用"))
 			}
 			user.Email = req.Email
+			// 管理员设置的邮箱未经用户验证，需用户通过更换邮箱流程重新确认
+			user.EmailVerified = false
 		}
 		if req.QQ != "" {
 			user.QQ = req.QQ
@@ -243,14 +258,16 @@ func HandleUpdateUser() fiber.Handler {
 
 		// 返回更新后的用户信息
 		userInfo := types.UserInfo{
-			ID:          user.Id,
-			Email:       user.Email,
-			Username:    user.Username,
-			IsAdmin:     user.IsAdmin,
-			IsRealName:  user.IsRealName,
-			IsForbidden: user.IsForbidden,
-			QQ:          user.QQ,
-			Avatar:      user.Avatar,
+			ID:            user.Id,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			Username:      user.Username,
+			IsAdmin:       user.IsAdmin,
+			IsRealName:    user.IsRealName,
+			IsForbidden:   user.IsForbidden,
+			QQ:            user.QQ,
+			Avatar:        user.Avatar,
+			Phone:         user.Phone,
 		}
 
 		return ctx.JSON(types.SuccessResponse(userInfo))
@@ -399,6 +416,27 @@ func HandleCreateApplication() fiber.Handler {
 			RefreshExpireInHours: 720, // 30 days
 			EnablePassword:       true,
 			EnableSignUp:         true,
+			RefreshTokenPolicy:   req.RefreshTokenPolicy,
+		}
+
+		applyRefreshRequest(application, &req)
+		if req.EnableCodeSignin != nil {
+			application.EnableCodeSignin = *req.EnableCodeSignin
+		}
+		applyJoseRequest(application, &req)
+		applySamlRequest(application, &req)
+
+		// 验证 SAML 服务提供商配置
+		if msg := validateSamlApplication(application); msg != "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(msg))
+		}
+
+		// 验证 Refresh Token 策略和签名/加密配置
+		if err := services.ValidateRefreshTokenPolicy(application); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(err.Error()))
+		}
+		if err := services.ValidateApplicationJoseSettings(application); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(err.Error()))
 		}
 
 		// 保存到数据库
@@ -457,6 +495,28 @@ func HandleUpdateApplication() fiber.Handler {
 		if len(req.Scopes) > 0 {
 			application.Scopes = req.Scopes
 		}
+		if req.RefreshTokenPolicy != "" {
+			application.RefreshTokenPolicy = req.RefreshTokenPolicy
+		}
+		applyRefreshRequest(application, &req)
+		if req.EnableCodeSignin != nil {
+			application.EnableCodeSignin = *req.EnableCodeSignin
+		}
+		applyJoseRequest(application, &req)
+		applySamlRequest(application, &req)
+
+		// 验证 SAML 服务提供商配置
+		if msg := validateSamlApplication(application); msg != "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(msg))
+		}
+
+		// 验证 Refresh Token 策略和签名/加密配置
+		if err := services.ValidateRefreshTokenPolicy(application); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(err.Error()))
+		}
+		if err := services.ValidateApplicationJoseSettings(application); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(err.Error()))
+		}
 
 		// 保存到数据库
 		_, err = models.UpdateApplication(owner, name, application)
@@ -468,6 +528,40 @@ func HandleUpdateApplication() fiber.Handler {
 	}
 }
 
+// applyRefreshRequest 将请求中的 Refresh Token 有效期配置写入应用，未设置的字段保持不变
+func applyRefreshRequest(application *models.Application, req *types.CreateApplicationRequest) {
+	if req.RefreshIdleHours != nil {
+		application.RefreshIdleHours = *req.RefreshIdleHours
+	}
+	if req.RefreshAbsoluteHours != nil {
+		application.RefreshAbsoluteHours = *req.RefreshAbsoluteHours
+	}
+	if req.RefreshReuseGraceSeconds != nil {
+		application.RefreshReuseGraceSeconds = *req.RefreshReuseGraceSeconds
+	}
+}
+
+// applyJoseRequest 将请求中的签名/加密配置写入应用，未设置的字段保持不变，空字符串清除该配置
+func applyJoseRequest(application *models.Application, req *types.CreateApplicationRequest) {
+	for _, field := range []struct {
+		value  *string
+		target *string
+	}{
+		{req.Jwks, &application.Jwks},
+		{req.JwksUri, &application.JwksUri},
+		{req.IdTokenSignedResponseAlg, &application.IdTokenSignedResponseAlg},
+		{req.IdTokenEncryptedResponseAlg, &application.IdTokenEncryptedResponseAlg},
+		{req.IdTokenEncryptedResponseEnc, &application.IdTokenEncryptedResponseEnc},
+		{req.UserinfoSignedResponseAlg, &application.UserinfoSignedResponseAlg},
+		{req.UserinfoEncryptedResponseAlg, &application.UserinfoEncryptedResponseAlg},
+		{req.UserinfoEncryptedResponseEnc, &application.UserinfoEncryptedResponseEnc},
+	} {
+		if field.value != nil {
+			*field.target = *field.value
+		}
+	}
+}
+
 // HandleDeleteApplication 删除应用（需要管理员权限）
 // Requirements: 8.8
 func HandleDeleteApplication() fiber.Handler {
@@ -526,19 +620,23 @@ func HandleGetTokens() fiber.Handler {
 			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取Token列表失败"))
 		}
 
-		// 构造响应数据（不返回实际的 token 值）
+		// 构造响应数据（只返回掩码后的令牌标识）
 		tokenList := make([]map[string]interface{}, 0, len(tokens))
 		for _, token := range tokens {
 			tokenList = append(tokenList, map[string]interface{}{
-				"owner":       token.Owner,
-				"name":        token.Name,
-				"createdTime": token.CreatedTime,
-				"application": token.Application,
-				"user":        token.User,
-				"expiresAt":   token.ExpiresAt,
-				"scope":       token.Scope,
-				"tokenType":   token.TokenType,
-				"isRevoked":   token.IsRevoked(),
+				"owner":        token.Owner,
+				"name":         token.Name,
+				"createdTime":  token.CreatedTime,
+				"application":  token.Application,
+				"user":         token.User,
+				"accessToken":  token.MaskedAccessToken(),
+				"refreshToken": token.MaskedRefreshToken(),
+				"jti":          token.Jti,
+				"expiresIn":    token.ExpiresIn,
+				"expiresAt":    token.ExpiresAt,
+				"scope":        token.Scope,
+				"tokenType":    token.TokenType,
+				"isRevoked":    token.IsRevoked(),
 			})
 		}
 
@@ -798,3 +896,166 @@ func HandleUnbanUser() fiber.Handler {
 		}))
 	}
 }
+
+// HandleUnlockUser 解除用户因登录失败次数过多造成的锁定（需要管理员权限）
+// 清除邮箱、用户名和手机号对应的密码和验证码失败计数，不影响来源 IP 的限流
+func HandleUnlockUser() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		id, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的用户ID"))
+		}
+
+		user, err := models.GetUserById(id)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取用户信息失败"))
+		}
+		if user == nil || user.IsDeleted {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("用户不存在"))
+		}
+
+		if err := services.UnlockAccount(services.UserThrottleAccount(user.GetId()), user.Email, user.Username, user.Phone); err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("解除锁定失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"message": "用户已解除锁定",
+			"userId":  id,
+		}))
+	}
+}
+
+// HandleUpdatePasswordType 设置组织的密码哈希算法（需要管理员权限）
+// 已有用户的哈希在下次登录成功后升级为新算法
+func HandleUpdatePasswordType() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		owner := ctx.Params("owner")
+		name := ctx.Params("name")
+		if owner == "" || name == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("owner 和 name 参数不能为空"))
+		}
+
+		var req types.UpdatePasswordTypeRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		if !services.IsValidPasswordType(req.PasswordType) {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("不支持的 passwordType: " + req.PasswordType))
+		}
+
+		organization, err := models.GetOrganization(owner, name)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取组织信息失败"))
+		}
+		if organization == nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("组织不存在"))
+		}
+
+		organization.PasswordType = req.PasswordType
+		if req.PasswordSalt != nil {
+			organization.PasswordSalt = *req.PasswordSalt
+		}
+
+		_, err = models.UpdateOrganization(owner, name, organization)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("更新组织失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(organization))
+	}
+}
+
+// HandleUpdatePasswordPolicy 设置组织的密码策略（需要管理员权限）
+// 新策略在下次设置密码时生效，密码有效期在登录时检查
+func HandleUpdatePasswordPolicy() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		owner := ctx.Params("owner")
+		name := ctx.Params("name")
+		if owner == "" || name == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("owner 和 name 参数不能为空"))
+		}
+
+		var req types.UpdatePasswordPolicyRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		if req.PasswordMinLength < 0 || req.PasswordMinLength > services.PasswordMaxLength {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(fmt.Sprintf("passwordMinLength 必须在 0-%d 之间", services.PasswordMaxLength)))
+		}
+		for _, class := range req.PasswordCharClasses {
+			if !services.IsValidPasswordClass(class) {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("不支持的字符类别: " + class))
+			}
+		}
+		if req.PasswordHistorySize < 0 || req.PasswordHistorySize > 24 {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("passwordHistorySize 必须在 0-24 之间"))
+		}
+		if req.PasswordMaxAgeDays < 0 {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("passwordMaxAgeDays 不能为负数"))
+		}
+
+		organization, err := models.GetOrganization(owner, name)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取组织信息失败"))
+		}
+		if organization == nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("组织不存在"))
+		}
+
+		organization.PasswordMinLength = req.PasswordMinLength
+		organization.PasswordCharClasses = req.PasswordCharClasses
+		organization.PasswordForbidUserAttributes = req.PasswordForbidUserAttributes
+		organization.PasswordHistorySize = req.PasswordHistorySize
+		organization.PasswordMaxAgeDays = req.PasswordMaxAgeDays
+		organization.PasswordCheckBreached = req.PasswordCheckBreached
+
+		_, err = models.UpdateOrganization(owner, name, organization)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("更新组织失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(organization))
+	}
+}
+
+// HandleUpdateSigninIdentifiers 设置组织密码登录可用的账号类型（需要管理员权限）
+// 邮箱和手机号全局唯一，用户名在组织内唯一
+func HandleUpdateSigninIdentifiers() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		owner := ctx.Params("owner")
+		name := ctx.Params("name")
+		if owner == "" || name == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("owner 和 name 参数不能为空"))
+		}
+
+		var req types.UpdateSigninIdentifiersRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		for _, identifier := range req.SigninIdentifiers {
+			if !services.IsValidSigninIdentifier(identifier) {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("不支持的账号类型: " + identifier))
+			}
+		}
+
+		organization, err := models.GetOrganization(owner, name)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取组织信息失败"))
+		}
+		if organization == nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("组织不存在"))
+		}
+
+		organization.SigninIdentifiers = req.SigninIdentifiers
+
+		_, err = models.UpdateOrganization(owner, name, organization)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("更新组织失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(organization))
+	}
+}
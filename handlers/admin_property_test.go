@@ -12,6 +12,7 @@ import (
 	"github.com/leanovate/gopter/gen"
 	"github.com/leanovate/gopter/prop"
 	"github.com/oauth-server/oauth-server/models"
+	"github.com/oauth-server/oauth-server/types"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -19,6 +20,7 @@ import (
 // Property 7: 管理员权限检查
 // Property 10: 用户数据完整性
 // Property 11: 应用配置有效性
+// Property 16: Client Secret 轮换
 
 // Property 7: 管理员权限检查
 // 验证管理员端点只允许管理员访问
@@ -288,6 +290,117 @@ func TestProperty_ApplicationConfigValidity(t *testing.T) {
 	properties.TestingRun(t)
 }
 
+// Property 16: Client Secret 轮换
+// 验证密钥以哈希存储，多个有效密钥均可认证，撤销或过期的密钥不能认证
+// **Validates: Requirement 8.7**
+func TestProperty_ClientSecretRotation(t *testing.T) {
+	if err := models.InitDB(); err != nil {
+		t.Skip("Database not available for property testing")
+	}
+
+	parameters := gopter.DefaultTestParameters()
+	parameters.MinSuccessfulTests = 10
+	properties := gopter.NewProperties(parameters)
+
+	properties.Property("Active secrets authenticate and inactive secrets do not", prop.ForAll(
+		func(name string) bool {
+			app := &models.Application{
+				Owner:        "test-owner",
+				Name:         "secret-" + name,
+				ClientId:     models.GenerateClientId(),
+				ClientSecret: models.GenerateClientSecret(),
+			}
+			if _, err := models.AddApplication(app); err != nil {
+				return true
+			}
+			defer models.DeleteApplication(app.Owner, app.Name)
+
+			stored, err := models.GetApplication(app.Owner, app.Name)
+			if err != nil || stored == nil || stored.ClientSecret != "" {
+				return false
+			}
+
+			// 签发第二个密钥，两个密钥同时有效
+			second := models.GenerateClientSecret()
+			secondSecret, err := models.AddClientSecret(stored, second, 0)
+			if err != nil {
+				return false
+			}
+			for _, secret := range []string{app.ClientSecret, second} {
+				if valid, err := models.VerifyClientSecret(stored, secret); err != nil || !valid {
+					return false
+				}
+			}
+
+			// 撤销第二个密钥
+			secondSecret.IsRevoked = true
+			if _, err = models.UpdateClientSecret(secondSecret.Owner, secondSecret.Name, secondSecret); err != nil {
+				return false
+			}
+			if valid, _ := models.VerifyClientSecret(stored, second); valid {
+				return false
+			}
+
+			// 已过期的密钥不能认证
+			expired := models.GenerateClientSecret()
+			if _, err = models.AddClientSecret(stored, expired, time.Now().Add(-time.Minute).Unix()); err != nil {
+				return false
+			}
+			if valid, _ := models.VerifyClientSecret(stored, expired); valid {
+				return false
+			}
+
+			valid, err := models.VerifyClientSecret(stored, "wrong-secret")
+			return err == nil && !valid
+		},
+		gen.AlphaString().SuchThat(func(s string) bool { return len(s) > 3 }),
+	))
+
+	properties.TestingRun(t)
+}
+
+// TestApplyJoseRequest 测试更新应用时可以清除签名/加密配置，未设置的字段保持不变
+func TestApplyJoseRequest(t *testing.T) {
+	application := &models.Application{
+		JwksUri:                     "https://client.example.com/jwks",
+		IdTokenSignedResponseAlg:    "RS256",
+		IdTokenEncryptedResponseAlg: "RSA-OAEP",
+		IdTokenEncryptedResponseEnc: "A256GCM",
+	}
+	empty := ""
+	jwks := `{"keys":[]}`
+	applyJoseRequest(application, &types.CreateApplicationRequest{
+		Jwks:                        &jwks,
+		JwksUri:                     &empty,
+		IdTokenEncryptedResponseAlg: &empty,
+		IdTokenEncryptedResponseEnc: &empty,
+	})
+
+	if application.Jwks != jwks || application.JwksUri != "" {
+		t.Errorf("Expected jwks to replace jwks_uri, got %q and %q", application.Jwks, application.JwksUri)
+	}
+	if application.IdTokenEncryptedResponseAlg != "" || application.IdTokenEncryptedResponseEnc != "" {
+		t.Errorf("Expected ID token encryption to be cleared, got %q/%q", application.IdTokenEncryptedResponseAlg, application.IdTokenEncryptedResponseEnc)
+	}
+	if application.IdTokenSignedResponseAlg != "RS256" {
+		t.Errorf("Expected unset fields to be kept, got %q", application.IdTokenSignedResponseAlg)
+	}
+}
+
+// TestApplyRefreshRequest 测试更新应用时可以将 Refresh Token 有效期设为 0，未设置的字段保持不变
+func TestApplyRefreshRequest(t *testing.T) {
+	application := &models.Application{RefreshIdleHours: 24, RefreshAbsoluteHours: 48, RefreshReuseGraceSeconds: 10}
+	zero := 0.0
+	applyRefreshRequest(application, &types.CreateApplicationRequest{RefreshAbsoluteHours: &zero})
+
+	if application.RefreshAbsoluteHours != 0 {
+		t.Errorf("Expected the absolute lifetime cap to be removed, got %v", application.RefreshAbsoluteHours)
+	}
+	if application.RefreshIdleHours != 24 || application.RefreshReuseGraceSeconds != 10 {
+		t.Errorf("Expected unset fields to be kept, got %v/%v", application.RefreshIdleHours, application.RefreshReuseGraceSeconds)
+	}
+}
+
 // Helper function to check if a string contains a substring
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || len(substr) == 0 ||
@@ -4,9 +4,12 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/oauth-server/oauth-server/models"
@@ -24,67 +27,146 @@ func HandleLogin() fiber.Handler {
 			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
 		}
 
-		// 验证参数（email, password 非空）
-		if req.Email == "" || req.Password == "" {
-			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("邮箱和密码不能为空"))
+		// 验证参数（账号, password 非空）
+		identifier := strings.TrimSpace(req.Identifier)
+		if identifier == "" {
+			identifier = strings.TrimSpace(req.Email)
+		}
+		if identifier == "" || req.Password == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("账号和密码不能为空"))
+		}
+
+		// 账户锁定和 IP 限流检查，失败次数过多时要求人机验证
+		// 已存在的用户按用户 ID 计数，邮箱、手机号和用户名共用同一失败次数
+		account, err := services.ConsoleLoginThrottleAccount(identifier)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("检查登录限制失败"))
+		}
+		if ok, err := checkBruteForce(ctx, services.ThrottleScopePassword, account, req.CaptchaToken); !ok {
+			return err
 		}
 
 		// 验证验证码（如果启用）
-		if req.CaptchaToken != "" {
-			valid, err := services.VerifyCaptcha(req.CaptchaToken)
-			if err != nil {
-				return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("验证码验证失败"))
-			}
-			if !valid {
-				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码无效"))
-			}
+		if ok, err := checkLoginCaptcha(ctx, req.CaptchaToken); !ok {
+			return err
 		}
 
-		// 调用 AuthService.Login()
-		user, err := services.LoginUser(req.Email, req.Password)
+		// 调用 AuthService.Login()，账号不存在和密码错误返回相同的错误
+		user, err := services.LoginUser(identifier, req.Password)
+		if errors.Is(err, services.ErrInvalidCredentials) {
+			data := recordBruteForceFailure(ctx, services.ThrottleScopePassword, account)
+			return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponseWithData(err.Error(), data))
+		}
+		if errors.Is(err, services.ErrPasswordExpired) {
+			return ctx.Status(fiber.StatusForbidden).JSON(types.ErrorResponseWithData("密码已过期，请重置密码", map[string]string{
+				"reason": "password_expired",
+			}))
+		}
 		if err != nil {
 			return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse(err.Error()))
 		}
-
-		// 获取默认应用以生成 token
-		// 使用内置应用 "admin/app-built-in"
-		application, err := models.GetApplication("admin", "app-built-in")
+		// 已启用多因素认证的用户需要先完成第二步验证，此时只返回 MFA 票据
+		// 失败计数在第二步验证通过后才清除，避免持有密码即可无限次尝试验证码
+		methods, err := services.SecondFactorMethods(user)
 		if err != nil {
-			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取应用信息失败"))
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取用户信息失败"))
 		}
-		if application == nil {
-			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("默认应用不存在"))
+		if len(methods) > 0 {
+			ticket, err := services.GenerateMfaTicket(user, []string{services.AmrPassword})
+			if err != nil {
+				return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("生成 MFA 票据失败"))
+			}
+			return ctx.JSON(types.SuccessResponse(types.MfaChallengeResponse{
+				MfaRequired: true,
+				MfaTicket:   ticket,
+				Methods:     methods,
+			}))
 		}
 
-		// 生成 JWT tokens
-		accessToken, refreshToken, _, err := services.GenerateJwtToken(application, user, "openid profile email", "", "")
-		if err != nil {
-			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("生成令牌失败"))
-		}
-
-		// 构造 LoginResponse
-		loginResp := types.LoginResponse{
-			AccessToken:  accessToken,
-			RefreshToken: refreshToken,
-			ExpiresIn:    int(application.ExpireInHours * 3600),
-			TokenType:    "Bearer",
-			User: types.UserInfo{
-				ID:          user.Id,
-				Email:       user.Email,
-				Username:    user.Username,
-				IsAdmin:     user.IsAdmin,
-				IsRealName:  user.IsRealName,
-				IsForbidden: user.IsForbidden,
-				QQ:          user.QQ,
-				Avatar:      user.Avatar,
-			},
-		}
-
-		// 返回 LoginResponse
-		return ctx.JSON(types.SuccessResponse(loginResp))
+		recordBruteForceSuccess(services.ThrottleScopePassword, account)
+		return issueLoginTokens(ctx, user, []string{services.AmrPassword})
 	}
 }
 
+// checkUsernameAvailable 检查用户名在组织内未被其他用户使用（不区分大小写），失败时写入响应
+func checkUsernameAvailable(ctx *fiber.Ctx, owner, username string, userId int64) (bool, error) {
+	err := services.CheckUsernameAvailable(owner, username, userId)
+	if errors.Is(err, services.ErrUsernameTaken) {
+		return false, ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("用户名已被使用"))
+	}
+	if err != nil {
+		return false, ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("检查用户名失败"))
+	}
+	return true, nil
+}
+
+// checkLoginCaptcha 校验登录类请求携带的人机验证令牌（如果提供），失败时写入响应
+// 密码登录和验证码登录共用此检查
+func checkLoginCaptcha(ctx *fiber.Ctx, captchaToken string) (bool, error) {
+	if captchaToken == "" {
+		return true, nil
+	}
+
+	valid, err := services.VerifyCaptcha(captchaToken)
+	if err != nil {
+		return false, ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("验证码验证失败"))
+	}
+	if !valid {
+		return false, ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码无效"))
+	}
+	return true, nil
+}
+
+// issueLoginTokens 为完成登录的用户签发内置应用的令牌
+// amr 记录本次登录使用的认证方式
+func issueLoginTokens(ctx *fiber.Ctx, user *models.User, amr []string) error {
+	// 获取默认应用以生成 token
+	// 使用内置应用 "admin/app-built-in"
+	application, err := models.GetApplication("admin", "app-built-in")
+	if err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取应用信息失败"))
+	}
+	if application == nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("默认应用不存在"))
+	}
+
+	// 每次登录创建一个会话，用户可在“登录设备”中查看和登出
+	session, err := services.StartSession(user, application, amr, ctx.IP(), ctx.Get(fiber.HeaderUserAgent))
+	if err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("创建会话失败"))
+	}
+
+	// 生成 JWT tokens，sid 声明指向会话
+	accessToken, refreshToken, _, err := services.GenerateSessionJwtToken(application, user, "openid profile email phone", amr, session.Name)
+	if err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("生成令牌失败"))
+	}
+	services.RecordLogin(user, application.Name, amr, ctx.IP(), ctx.Get(fiber.HeaderUserAgent))
+
+	// 构造 LoginResponse
+	loginResp := types.LoginResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(application.ExpireInHours * 3600),
+		TokenType:    "Bearer",
+		User: types.UserInfo{
+			ID:            user.Id,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			Username:      user.Username,
+			IsAdmin:       user.IsAdmin,
+			IsRealName:    user.IsRealName,
+			IsForbidden:   user.IsForbidden,
+			QQ:            user.QQ,
+			Avatar:        user.Avatar,
+			Phone:         user.Phone,
+		},
+	}
+
+	// 返回 LoginResponse
+	return ctx.JSON(types.SuccessResponse(loginResp))
+}
+
 // HandleRegister 处理用户注册请求
 // Requirements: 3.4, 3.5
 func HandleRegister() fiber.Handler {
@@ -96,8 +178,8 @@ func HandleRegister() fiber.Handler {
 		}
 
 		// 验证参数
-		if req.Username == "" || req.Email == "" || req.Password == "" || req.VerificationCode == "" {
-			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("用户名、邮箱、密码和验证码不能为空"))
+		if req.Username == "" || (req.Email == "" && req.Phone == "") || req.Password == "" || req.VerificationCode == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("用户名、邮箱或手机号、密码和验证码不能为空"))
 		}
 
 		// 验证用户名长度
@@ -105,33 +187,67 @@ func HandleRegister() fiber.Handler {
 			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("用户名长度必须在3-50个字符之间"))
 		}
 
-		// 验证密码长度
-		if len(req.Password) < 6 {
-			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("密码长度至少为6个字符"))
+		// 在消耗验证码前检查用户名是否已被使用
+		if ok, err := checkUsernameAvailable(ctx, "built-in", req.Username, 0); !ok {
+			return err
 		}
 
-		// 验证邮箱验证码
-		valid, err := services.VerifyCode(req.Email, req.VerificationCode, "register")
-		if err != nil || !valid {
-			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码无效或已过期"))
+		// 验证密码长度
+		if err := services.CheckPasswordBaseline(req.Password); err != nil {
+			return passwordErrorResponse(ctx, err, fiber.StatusBadRequest, err.Error())
 		}
 
-		// 注册用户
-		user, err := services.RegisterUser(req.Email, req.Password, req.Username)
-		if err != nil {
-			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(err.Error()))
+		// 填写手机号时使用短信验证码注册，否则使用邮箱验证码
+		var user *models.User
+		if req.Phone != "" {
+			phone, err := services.NormalizePhone(req.Phone)
+			if err != nil {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("手机号格式无效"))
+			}
+			candidate := &models.User{Owner: "built-in", Username: req.Username, Phone: phone}
+			if err := services.ValidateUserPassword(candidate, req.Password); err != nil {
+				return passwordErrorResponse(ctx, err, fiber.StatusInternalServerError, "检查密码策略失败")
+			}
+			valid, err := services.VerifyCode(phone, req.VerificationCode, "register")
+			if err != nil || !valid {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码无效或已过期"))
+			}
+			user, err = services.RegisterUserByPhone(phone, req.Password, req.Username)
+			if err != nil {
+				return passwordErrorResponse(ctx, err, fiber.StatusBadRequest, err.Error())
+			}
+		} else {
+			// 在消耗验证码前检查密码策略
+			candidate := &models.User{Owner: "built-in", Username: req.Username, Email: req.Email}
+			if err := services.ValidateUserPassword(candidate, req.Password); err != nil {
+				return passwordErrorResponse(ctx, err, fiber.StatusInternalServerError, "检查密码策略失败")
+			}
+
+			// 验证邮箱验证码
+			valid, err := services.VerifyCode(req.Email, req.VerificationCode, "register")
+			if err != nil || !valid {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码无效或已过期"))
+			}
+
+			// 注册用户
+			user, err = services.RegisterUser(req.Email, req.Password, req.Username)
+			if err != nil {
+				return passwordErrorResponse(ctx, err, fiber.StatusBadRequest, err.Error())
+			}
 		}
 
 		// 返回用户信息
 		userInfo := types.UserInfo{
-			ID:          user.Id,
-			Email:       user.Email,
-			Username:    user.Username,
-			IsAdmin:     user.IsAdmin,
-			IsRealName:  user.IsRealName,
-			IsForbidden: user.IsForbidden,
-			QQ:          user.QQ,
-			Avatar:      user.Avatar,
+			ID:            user.Id,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			Username:      user.Username,
+			IsAdmin:       user.IsAdmin,
+			IsRealName:    user.IsRealName,
+			IsForbidden:   user.IsForbidden,
+			QQ:            user.QQ,
+			Avatar:        user.Avatar,
+			Phone:         user.Phone,
 		}
 
 		return ctx.JSON(types.SuccessResponse(userInfo))
@@ -141,8 +257,10 @@ func HandleRegister() fiber.Handler {
 // SendVerificationCodeRequest 发送验证码请求
 type SendVerificationCodeRequest struct {
 	Email        string `json:"email"`
-	Purpose      string `json:"purpose"`      // "register" or "reset_password"
-	CaptchaToken string `json:"captchaToken"` // 可选的验证码
+	Phone        string `json:"phone,omitempty"`    // 填写手机号时通过短信发送，与邮箱二选一
+	Purpose      string `json:"purpose"`            // "register"、"reset_password" 或 "login"
+	CaptchaToken string `json:"captchaToken"`       // 可选的验证码
+	ClientId     string `json:"clientId,omitempty"` // 验证码登录的应用，为空时使用内置应用
 }
 
 // HandleSendVerificationCode 处理发送验证码请求
@@ -156,14 +274,28 @@ func HandleSendVerificationCode() fiber.Handler {
 		}
 
 		// 验证参数
-		if req.Email == "" {
-			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("邮箱不能为空"))
+		if req.Email == "" && req.Phone == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("邮箱或手机号不能为空"))
 		}
 
-		if req.Purpose != "register" && req.Purpose != "reset_password" {
+		if req.Purpose != "register" && req.Purpose != "reset_password" && req.Purpose != services.PurposeLogin {
 			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的验证码用途"))
 		}
 
+		// 按目标地址、来源 IP 和网段限制发送频率
+		target := req.Email
+		if req.Phone != "" {
+			target = req.Phone
+		}
+		retryAfter, err := services.CheckCodeRequest(target, ctx.IP())
+		if err != nil {
+			log.Printf("[Security] Failed to check verification code limits: %v", err)
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("检查发送频率失败"))
+		}
+		if retryAfter > 0 {
+			return tooManyAttemptsResponse(ctx, services.ThrottleReasonIpThrottled, retryAfter)
+		}
+
 		// 验证 Captcha（如果启用）
 		if req.CaptchaToken != "" {
 			valid, err := services.VerifyCaptcha(req.CaptchaToken)
@@ -172,6 +304,18 @@ func HandleSendVerificationCode() fiber.Handler {
 			}
 		}
 
+		if req.Phone != "" {
+			return sendSmsCode(ctx, req.Phone, req.Purpose, req.ClientId)
+		}
+
+		if req.Purpose == services.PurposeLogin {
+			return sendLoginCode(ctx, req.Email, req.ClientId)
+		}
+
+		if ok, err := checkResendCooldown(ctx, req.Email, req.Purpose); !ok {
+			return err
+		}
+
 		// 异步发送验证码邮件（不阻塞请求）
 		go func() {
 			code, err := services.SendVerificationEmail(req.Email, req.Purpose)
@@ -192,9 +336,11 @@ func HandleSendVerificationCode() fiber.Handler {
 
 // ResetPasswordRequest 重置密码请求
 type ResetPasswordRequest struct {
-	Email       string `json:"email"`
-	Code        string `json:"code"`
-	NewPassword string `json:"newPassword"`
+	Email        string `json:"email"`
+	Phone        string `json:"phone,omitempty"` // 通过短信验证码重置时填写，与邮箱二选一
+	Code         string `json:"code"`
+	NewPassword  string `json:"newPassword"`
+	CaptchaToken string `json:"captchaToken,omitempty"` // 验证码多次输错后需要的人机验证
 }
 
 // HandleResetPassword 处理重置密码请求
@@ -208,25 +354,76 @@ func HandleResetPassword() fiber.Handler {
 		}
 
 		// 验证参数
-		if req.Email == "" || req.Code == "" || req.NewPassword == "" {
+		if (req.Email == "" && req.Phone == "") || req.Code == "" || req.NewPassword == "" {
 			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("邮箱、验证码和新密码不能为空"))
 		}
 
 		// 验证密码长度
-		if len(req.NewPassword) < 6 {
-			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("密码长度至少为6个字符"))
+		if err := services.CheckPasswordBaseline(req.NewPassword); err != nil {
+			return passwordErrorResponse(ctx, err, fiber.StatusBadRequest, err.Error())
+		}
+
+		// 使用短信验证码重置
+		if req.Phone != "" {
+			phone, err := services.NormalizePhone(req.Phone)
+			if err != nil {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("手机号格式无效"))
+			}
+			// 在消耗验证码前只检查与用户无关的密码规则，是否与历史密码或个人信息重复在验证码通过后检查
+			account, err := models.GetUserByPhone(phone)
+			if err == nil && account != nil {
+				err = services.ValidatePasswordRules(account, req.NewPassword)
+			}
+			if err != nil {
+				return passwordErrorResponse(ctx, err, fiber.StatusInternalServerError, "检查密码策略失败")
+			}
+			if ok, err := checkBruteForce(ctx, services.ThrottleScopeCode, phone, req.CaptchaToken); !ok {
+				return err
+			}
+			if ok, err := checkLoginCaptcha(ctx, req.CaptchaToken); !ok {
+				return err
+			}
+			valid, err := services.VerifyCode(phone, req.Code, "reset_password")
+			if err != nil || !valid {
+				data := recordBruteForceFailure(ctx, services.ThrottleScopeCode, phone)
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponseWithData("验证码无效或已过期", data))
+			}
+			recordBruteForceSuccess(services.ThrottleScopeCode, phone)
+			if err := services.ResetPasswordByPhone(phone, req.NewPassword); err != nil {
+				return passwordErrorResponse(ctx, err, fiber.StatusBadRequest, err.Error())
+			}
+			return ctx.JSON(types.SuccessResponse(map[string]string{
+				"message": "密码重置成功",
+			}))
 		}
 
-		// 验证验证码
+		// 在消耗验证码前只检查与用户无关的密码规则，是否与历史密码或个人信息重复在验证码通过后检查
+		account, err := models.GetUserByEmail(req.Email)
+		if err == nil && account != nil {
+			err = services.ValidatePasswordRules(account, req.NewPassword)
+		}
+		if err != nil {
+			return passwordErrorResponse(ctx, err, fiber.StatusInternalServerError, "检查密码策略失败")
+		}
+
+		// 验证验证码，猜测验证码与猜测密码一样计入失败次数
+		if ok, err := checkBruteForce(ctx, services.ThrottleScopeCode, req.Email, req.CaptchaToken); !ok {
+			return err
+		}
+		if ok, err := checkLoginCaptcha(ctx, req.CaptchaToken); !ok {
+			return err
+		}
 		valid, err := services.VerifyCode(req.Email, req.Code, "reset_password")
 		if err != nil || !valid {
-			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码无效或已过期"))
+			data := recordBruteForceFailure(ctx, services.ThrottleScopeCode, req.Email)
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponseWithData("验证码无效或已过期", data))
 		}
+		recordBruteForceSuccess(services.ThrottleScopeCode, req.Email)
 
 		// 重置密码
 		err = services.ResetPassword(req.Email, req.NewPassword)
 		if err != nil {
-			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(err.Error()))
+			return passwordErrorResponse(ctx, err, fiber.StatusBadRequest, err.Error())
 		}
 
 		// 返回成功
@@ -236,11 +433,22 @@ func HandleResetPassword() fiber.Handler {
 	}
 }
 
+// passwordErrorResponse 密码不符合组织策略时返回 400 和结构化的违规列表，其他错误按给定状态码和消息返回
+func passwordErrorResponse(ctx *fiber.Ctx, err error, status int, msg string) error {
+	var policyErr *services.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponseWithData("密码不符合安全策略", policyErr.Violations))
+	}
+	return ctx.Status(status).JSON(types.ErrorResponse(msg))
+}
+
 // UpdateProfileRequest 更新个人资料请求
 type UpdateProfileRequest struct {
-	Username string `json:"username,omitempty"`
-	QQ       string `json:"qq,omitempty"`
-	Avatar   string `json:"avatar,omitempty"`
+	Username    string `json:"username,omitempty"`
+	QQ          string `json:"qq,omitempty"`
+	Avatar      string `json:"avatar,omitempty"`
+	Password    string `json:"password,omitempty"`    // 新密码，为空表示不修改
+	OldPassword string `json:"oldPassword,omitempty"` // 已设置密码时需提供当前密码
 }
 
 // HandleUpdateProfile 处理更新个人资料请求
@@ -276,6 +484,9 @@ func HandleUpdateProfile() fiber.Handler {
 
 		// 更新用户信息
 		if req.Username != "" {
+			if ok, err := checkUsernameAvailable(ctx, user.Owner, req.Username, user.Id); !ok {
+				return err
+			}
 			user.Username = req.Username
 		}
 		if req.QQ != "" {
@@ -285,6 +496,26 @@ func HandleUpdateProfile() fiber.Handler {
 			user.Avatar = req.Avatar
 		}
 
+		// 修改密码需要验证当前密码，通过第三方登录创建、尚未设置密码的账户除外
+		if req.Password != "" {
+			if err := services.CheckPasswordBaseline(req.Password); err != nil {
+				return passwordErrorResponse(ctx, err, fiber.StatusBadRequest, err.Error())
+			}
+			if user.Password != "" {
+				valid, err := services.VerifyUserPassword(user, req.OldPassword)
+				if err != nil {
+					return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("验证密码失败"))
+				}
+				if !valid {
+					return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("当前密码错误"))
+				}
+			}
+			if err := services.SetUserPassword(user, req.Password); err != nil {
+				return passwordErrorResponse(ctx, err, fiber.StatusInternalServerError, "密码加密失败")
+			}
+			user.UpdatedTime = time.Now().Format(time.RFC3339)
+		}
+
 		// 调用 AuthService.UpdateProfile()
 		_, err = models.UpdateUser(userIDInt, user)
 		if err != nil {
@@ -293,14 +524,16 @@ func HandleUpdateProfile() fiber.Handler {
 
 		// 返回更新后的用户信息
 		userInfo := types.UserInfo{
-			ID:          user.Id,
-			Email:       user.Email,
-			Username:    user.Username,
-			IsAdmin:     user.IsAdmin,
-			IsRealName:  user.IsRealName,
-			IsForbidden: user.IsForbidden,
-			QQ:          user.QQ,
-			Avatar:      user.Avatar,
+			ID:            user.Id,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			Username:      user.Username,
+			IsAdmin:       user.IsAdmin,
+			IsRealName:    user.IsRealName,
+			IsForbidden:   user.IsForbidden,
+			QQ:            user.QQ,
+			Avatar:        user.Avatar,
+			Phone:         user.Phone,
 		}
 
 		return ctx.JSON(types.SuccessResponse(userInfo))
@@ -359,6 +592,7 @@ func HandleAuthorize() fiber.Handler {
 		nonce := ctx.Query("nonce")
 		codeChallenge := ctx.Query("code_challenge")
 		resource := ctx.Query("resource")
+		claims := ctx.Query("claims")
 
 		// 验证 client_id 和 redirect_uri
 		if clientID == "" {
@@ -377,14 +611,21 @@ func HandleAuthorize() fiber.Handler {
 			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(msg))
 		}
 
+		// 验证 claims 参数（OIDC Core §5.5）
+		claimsRequest, err := services.ParseClaimsRequest(claims)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(err.Error()))
+		}
+
 		// 处理 GET 请求（显示授权页面信息）
 		if ctx.Method() == "GET" {
-			// 返回授权页面所需信息
+			// 返回授权页面所需信息，包括单独请求的声明
 			authInfo := map[string]interface{}{
-				"clientId":    clientID,
-				"redirectUri": redirectURI,
-				"scope":       scope,
-				"state":       state,
+				"clientId":        clientID,
+				"redirectUri":     redirectURI,
+				"scope":           scope,
+				"state":           state,
+				"requestedClaims": claimsRequest.RequestedClaims(),
 				"application": map[string]interface{}{
 					"name":         application.Name,
 					"displayName":  application.DisplayName,
@@ -398,7 +639,11 @@ func HandleAuthorize() fiber.Handler {
 		// 处理 POST 请求（用户同意授权）
 		if ctx.Method() == "POST" {
 			// 生成授权码
-			codeResp, err := services.GetOAuthCode(userID, clientID, responseType, redirectURI, scope, state, nonce, codeChallenge, resource)
+			// 授权码记录当前会话使用的认证方式（amr）
+			// 授权码挂在当前控制台会话下，会话登出时一并撤销
+			amr, _ := ctx.Locals("amr").([]string)
+			sessionID, _ := ctx.Locals("sessionID").(string)
+			codeResp, err := services.GetOAuthCode(userID, clientID, responseType, redirectURI, scope, state, nonce, codeChallenge, resource, claims, amr, sessionID)
 			if err != nil {
 				return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("生成授权码失败"))
 			}
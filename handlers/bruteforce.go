@@ -0,0 +1,86 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oauth-server/oauth-server/services"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+// checkBruteForce 在校验凭据前检查账户锁定和来源 IP 限流，失败时写入响应
+// 超限返回 429 和 Retry-After；近期失败次数过多且启用了人机验证时，未携带验证码返回 400 和 captchaRequired
+func checkBruteForce(ctx *fiber.Ctx, scope, account, captchaToken string) (bool, error) {
+	decision, err := services.CheckLoginAttempt(scope, account, ctx.IP())
+	if err != nil {
+		log.Printf("[Security] Failed to check brute-force limits: %v", err)
+		return false, ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("检查登录限制失败"))
+	}
+	if !decision.Allowed() {
+		return false, tooManyAttemptsResponse(ctx, decision.Reason, decision.RetryAfter)
+	}
+	if decision.CaptchaRequired && services.IsCaptchaEnabled() && captchaToken == "" {
+		return false, ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponseWithData("请完成人机验证", map[string]bool{
+			"captchaRequired": true,
+		}))
+	}
+	return true, nil
+}
+
+// recordBruteForceFailure 记录一次凭据错误，返回下一次尝试是否需要人机验证，供失败响应的 data 使用
+func recordBruteForceFailure(ctx *fiber.Ctx, scope, account string) map[string]bool {
+	decision, err := services.RecordLoginFailure(scope, account, ctx.IP())
+	if err != nil {
+		log.Printf("[Security] Failed to record failed %s attempt: %v", scope, err)
+		return nil
+	}
+	return map[string]bool{
+		"captchaRequired": decision.CaptchaRequired && services.IsCaptchaEnabled(),
+	}
+}
+
+// recordBruteForceSuccess 凭据正确后清除账户的失败计数
+func recordBruteForceSuccess(scope, account string) {
+	if err := services.RecordLoginSuccess(scope, account); err != nil {
+		log.Printf("[Security] Failed to reset failed %s attempts: %v", scope, err)
+	}
+}
+
+// checkResendCooldown 检查同一目标和用途的验证码重发冷却，冷却中返回 429
+// 无论是否实际发送都应调用，避免响应暴露账号是否存在
+func checkResendCooldown(ctx *fiber.Ctx, target, purpose string) (bool, error) {
+	retryAfter, err := services.StartVerificationCodeCooldown(target, purpose)
+	if err != nil {
+		log.Printf("[Security] Failed to check verification code cooldown: %v", err)
+		return false, ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("检查发送频率失败"))
+	}
+	if retryAfter > 0 {
+		return false, tooManyAttemptsResponse(ctx, services.ThrottleReasonResendCooldown, retryAfter)
+	}
+	return true, nil
+}
+
+// tooManyAttemptsResponse 返回 429，Retry-After 以秒为单位向上取整
+func tooManyAttemptsResponse(ctx *fiber.Ctx, reason string, retryAfter time.Duration) error {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+
+	msg := "请求过于频繁，请稍后再试"
+	switch reason {
+	case services.ThrottleReasonAccountLocked:
+		msg = "登录失败次数过多，账户已暂时锁定，请稍后再试"
+	case services.ThrottleReasonResendCooldown:
+		msg = fmt.Sprintf("验证码发送过于频繁，请 %d 秒后再试", seconds)
+	}
+	return ctx.Status(fiber.StatusTooManyRequests).JSON(types.ErrorResponseWithData(msg, map[string]interface{}{
+		"reason":     reason,
+		"retryAfter": seconds,
+	}))
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package handlers
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oauth-server/oauth-server/models"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+// HandleGetClientSecrets 获取应用的 Client Secret 列表（需要管理员权限）
+// 只返回提示信息，不返回密钥明文
+// Requirements: 8.7
+func HandleGetClientSecrets() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		owner := ctx.Params("owner")
+		name := ctx.Params("name")
+
+		if owner == "" || name == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("owner 和 name 参数不能为空"))
+		}
+
+		secrets, err := models.GetClientSecrets(owner, name)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取Client Secret列表失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(secrets))
+	}
+}
+
+// HandleRotateClientSecret 为应用签发新的 Client Secret（需要管理员权限）
+// 旧密钥可设置过期时间以便平滑切换，新密钥明文只在创建时返回一次
+// Requirements: 8.7
+func HandleRotateClientSecret() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		owner := ctx.Params("owner")
+		name := ctx.Params("name")
+
+		if owner == "" || name == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("owner 和 name 参数不能为空"))
+		}
+
+		var req types.RotateClientSecretRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+		if req.ExpiresInHours < 0 || (req.PreviousExpiresInHours != nil && *req.PreviousExpiresInHours < 0) {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("过期时间不能为负数"))
+		}
+
+		application, err := models.GetApplication(owner, name)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取应用信息失败"))
+		}
+		if application == nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("应用不存在"))
+		}
+		if application.TokenEndpointAuthMethod == "none" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("公开客户端不使用Client Secret"))
+		}
+
+		now := time.Now()
+
+		// 为现有密钥设置过期时间，未指定时保持不变
+		if req.PreviousExpiresInHours != nil {
+			previousExpiresAt := now.Add(time.Duration(*req.PreviousExpiresInHours * float64(time.Hour))).Unix()
+			secrets, err := models.GetActiveClientSecrets(owner, name)
+			if err != nil {
+				return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取Client Secret列表失败"))
+			}
+			for _, secret := range secrets {
+				if secret.ExpiresAt == 0 || secret.ExpiresAt > previousExpiresAt {
+					secret.ExpiresAt = previousExpiresAt
+					if _, err = models.UpdateClientSecret(secret.Owner, secret.Name, secret); err != nil {
+						return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("更新Client Secret失败"))
+					}
+				}
+			}
+		}
+
+		expiresAt := int64(0)
+		if req.ExpiresInHours > 0 {
+			expiresAt = now.Add(time.Duration(req.ExpiresInHours * float64(time.Hour))).Unix()
+		}
+
+		plainSecret := models.GenerateClientSecret()
+		secret, err := models.AddClientSecret(application, plainSecret, expiresAt)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("创建Client Secret失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"secret":       secret,
+			"clientSecret": plainSecret,
+		}))
+	}
+}
+
+// HandleRevokeClientSecret 撤销应用的指定 Client Secret（需要管理员权限）
+// Requirements: 8.7
+func HandleRevokeClientSecret() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		owner := ctx.Params("owner")
+		name := ctx.Params("name")
+		secretName := ctx.Params("secret")
+
+		if owner == "" || name == "" || secretName == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("owner、name 和 secret 参数不能为空"))
+		}
+
+		secret, err := models.GetClientSecret(owner, secretName)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取Client Secret失败"))
+		}
+		if secret == nil || secret.Application != name {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("Client Secret不存在"))
+		}
+
+		secret.IsRevoked = true
+		_, err = models.UpdateClientSecret(owner, secretName, secret)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("撤销Client Secret失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]string{
+			"message": "Client Secret已撤销",
+		}))
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package handlers
+
+import (
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oauth-server/oauth-server/models"
+	"github.com/oauth-server/oauth-server/services"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+// codeSigninApplication 获取验证码登录所属的应用，clientId 为空时使用内置应用
+// 应用未启用验证码登录时写入响应并返回 nil
+func codeSigninApplication(ctx *fiber.Ctx, clientId string) (*models.Application, error) {
+	var application *models.Application
+	var err error
+	if clientId == "" {
+		application, err = models.GetApplication("admin", "app-built-in")
+	} else {
+		application, err = models.GetApplicationByClientId(clientId)
+	}
+	if err != nil {
+		return nil, ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取应用信息失败"))
+	}
+	if application == nil {
+		return nil, ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("应用不存在"))
+	}
+	if !application.EnableCodeSignin {
+		return nil, ctx.Status(fiber.StatusForbidden).JSON(types.ErrorResponse("该应用未启用验证码登录"))
+	}
+	return application, nil
+}
+
+// sendLoginCode 发送登录验证码和一键登录链接
+// 无论邮箱是否已注册都返回相同的响应，避免暴露账号是否存在
+func sendLoginCode(ctx *fiber.Ctx, email, clientId string) error {
+	if application, err := codeSigninApplication(ctx, clientId); application == nil {
+		return err
+	}
+
+	if ok, err := checkResendCooldown(ctx, email, services.PurposeLogin); !ok {
+		return err
+	}
+
+	user, err := models.GetUserByEmail(email)
+	if err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取用户信息失败"))
+	}
+
+	if user != nil && !user.IsDeleted && !user.IsForbidden {
+		// 异步发送验证码邮件（不阻塞请求）
+		go func() {
+			code, err := services.SendLoginEmail(user, clientId)
+			if err != nil {
+				log.Printf("Failed to send login email to %s: %v", user.Email, err)
+			} else if code != "" {
+				// 开发环境下记录验证码
+				log.Printf("Login code sent to %s: %s", user.Email, code)
+			}
+		}()
+	}
+
+	return ctx.JSON(types.SuccessResponse(map[string]string{
+		"message": "如果该邮箱已注册，验证码和登录链接已发送，请查收邮件",
+	}))
+}
+
+// HandleLoginByCode 使用邮箱验证码、短信验证码或一键登录链接登录
+// 先调用 /api/auth/send-code（purpose 为 login）获取验证码，应用需启用验证码登录
+func HandleLoginByCode() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		var req types.CodeLoginRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		if req.LoginToken == "" && ((req.Email == "" && req.Phone == "") || req.Code == "") {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("邮箱或手机号和验证码不能为空"))
+		}
+
+		// 一键登录链接自带邮箱和应用，验证后链接与验证码一并失效
+		email, clientId := req.Email, req.ClientId
+		if req.LoginToken != "" {
+			claims, err := services.ParseLoginLink(req.LoginToken)
+			if err != nil {
+				return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse("登录链接无效或已过期"))
+			}
+			email, clientId = claims.Email, claims.ClientId
+		}
+
+		// 短信验证码以 E.164 手机号为键
+		phone := ""
+		if req.LoginToken == "" && req.Phone != "" {
+			normalized, err := services.NormalizePhone(req.Phone)
+			if err != nil {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("手机号格式无效"))
+			}
+			phone = normalized
+		}
+
+		// 与密码登录相同的锁定、限流和人机验证检查，登录链接之外的验证码错误计入失败次数
+		account := email
+		if phone != "" {
+			account = phone
+		}
+		if ok, err := checkBruteForce(ctx, services.ThrottleScopeCode, account, req.CaptchaToken); !ok {
+			return err
+		}
+		if ok, err := checkLoginCaptcha(ctx, req.CaptchaToken); !ok {
+			return err
+		}
+
+		if application, err := codeSigninApplication(ctx, clientId); application == nil {
+			return err
+		}
+
+		amr := []string{services.AmrEmail}
+		if phone != "" {
+			valid, err := services.VerifyCode(phone, req.Code, services.PurposeLogin)
+			if err != nil || !valid {
+				data := recordBruteForceFailure(ctx, services.ThrottleScopeCode, phone)
+				return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponseWithData("验证码无效或已过期", data))
+			}
+			amr = []string{services.AmrSms}
+		} else if req.LoginToken != "" {
+			if _, err := services.RedeemLoginLink(req.LoginToken); err != nil {
+				return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse("登录链接无效或已过期"))
+			}
+		} else {
+			valid, err := services.VerifyCode(email, req.Code, services.PurposeLogin)
+			if err != nil || !valid {
+				data := recordBruteForceFailure(ctx, services.ThrottleScopeCode, email)
+				return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponseWithData("验证码无效或已过期", data))
+			}
+		}
+		recordBruteForceSuccess(services.ThrottleScopeCode, account)
+
+		var user *models.User
+		var err error
+		if phone != "" {
+			user, err = models.GetUserByPhone(phone)
+		} else {
+			user, err = models.GetUserByEmail(email)
+		}
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取用户信息失败"))
+		}
+		if user == nil || user.IsDeleted {
+			return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse("验证码无效或已过期"))
+		}
+		if user.IsForbidden {
+			return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse("账号已被禁用"))
+		}
+
+		// 验证码只证明持有邮箱或手机号，启用了两步验证的用户仍需完成第二步
+		methods, err := services.SecondFactorMethods(user)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取用户信息失败"))
+		}
+		if len(methods) > 0 {
+			ticket, err := services.GenerateMfaTicket(user, amr)
+			if err != nil {
+				return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("生成 MFA 票据失败"))
+			}
+			return ctx.JSON(types.SuccessResponse(types.MfaChallengeResponse{
+				MfaRequired: true,
+				MfaTicket:   ticket,
+				Methods:     methods,
+			}))
+		}
+
+		return issueLoginTokens(ctx, user, amr)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package handlers
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oauth-server/oauth-server/models"
+	"github.com/oauth-server/oauth-server/services"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+// HandleGetInitialAccessTokens 获取初始访问令牌列表（需要管理员权限）
+// Requirements: 7.4
+func HandleGetInitialAccessTokens() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		tokens, err := models.GetInitialAccessTokens(ctx.Query("owner", ""))
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取初始访问令牌列表失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(tokens))
+	}
+}
+
+// HandleCreateInitialAccessToken 创建初始访问令牌（需要管理员权限）
+// 令牌明文只在创建时返回一次
+// Requirements: 7.4
+func HandleCreateInitialAccessToken() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		var req types.CreateInitialAccessTokenRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		if req.Organization == "" {
+			req.Organization = services.DcrOrganizationName
+		}
+		if req.ExpiresInHours < 0 || req.MaxUses < 0 {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("expiresInHours 和 maxUses 不能为负数"))
+		}
+
+		organization, err := models.GetOrganization(services.DcrOrganizationOwner, req.Organization)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取组织信息失败"))
+		}
+		if organization == nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("组织不存在"))
+		}
+
+		plainToken := models.GenerateClientSecret()
+		token := &models.InitialAccessToken{
+			Owner:        services.DcrOrganizationOwner,
+			Name:         models.GenerateClientId(),
+			CreatedTime:  models.GetCurrentTime(),
+			Organization: organization.Name,
+			Description:  req.Description,
+			MaxUses:      req.MaxUses,
+		}
+		if req.ExpiresInHours > 0 {
+			token.ExpiresAt = time.Now().Add(time.Duration(req.ExpiresInHours * float64(time.Hour))).Unix()
+		}
+		token.SetToken(plainToken)
+
+		_, err = models.AddInitialAccessToken(token)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("创建初始访问令牌失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"token":              token,
+			"initialAccessToken": plainToken,
+		}))
+	}
+}
+
+// HandleRevokeInitialAccessToken 撤销初始访问令牌（需要管理员权限）
+// Requirements: 7.4
+func HandleRevokeInitialAccessToken() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		owner := ctx.Params("owner")
+		name := ctx.Params("name")
+
+		if owner == "" || name == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("owner 和 name 参数不能为空"))
+		}
+
+		token, err := models.GetInitialAccessToken(owner, name)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取初始访问令牌失败"))
+		}
+		if token == nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("初始访问令牌不存在"))
+		}
+
+		token.IsRevoked = true
+		_, err = models.UpdateInitialAccessToken(owner, name, token)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("撤销初始访问令牌失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]string{
+			"message": "初始访问令牌已撤销",
+		}))
+	}
+}
+
+// HandleApproveApplication 批准待审核的动态注册客户端（需要管理员权限）
+// Requirements: 7.4
+func HandleApproveApplication() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		owner := ctx.Params("owner")
+		name := ctx.Params("name")
+
+		if owner == "" || name == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("owner 和 name 参数不能为空"))
+		}
+
+		application, err := models.GetApplication(owner, name)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取应用信息失败"))
+		}
+		if application == nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("应用不存在"))
+		}
+		if !application.IsPending() {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("应用不在待审核状态"))
+		}
+
+		application.RegistrationStatus = models.RegistrationStatusApproved
+		_, err = models.UpdateApplication(owner, name, application)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("批准应用失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(application))
+	}
+}
+
+// HandleUpdateDcrPolicy 更新组织的动态客户端注册策略（需要管理员权限）
+// Requirements: 7.4
+func HandleUpdateDcrPolicy() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		owner := ctx.Params("owner")
+		name := ctx.Params("name")
+
+		if owner == "" || name == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("owner 和 name 参数不能为空"))
+		}
+
+		var req types.UpdateDcrPolicyRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		if !models.IsValidDcrPolicy(req.DcrPolicy) {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("不支持的 dcrPolicy: " + req.DcrPolicy))
+		}
+
+		organization, err := models.GetOrganization(owner, name)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取组织信息失败"))
+		}
+		if organization == nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("组织不存在"))
+		}
+
+		organization.DcrPolicy = req.DcrPolicy
+		if req.DcrRequireSoftwareStatement != nil {
+			organization.DcrRequireSoftwareStatement = *req.DcrRequireSoftwareStatement
+		}
+		if req.DcrSoftwareStatementJwks != nil {
+			if *req.DcrSoftwareStatementJwks != "" {
+				var keySet services.JsonWebKeySet
+				if err := json.Unmarshal([]byte(*req.DcrSoftwareStatementJwks), &keySet); err != nil {
+					return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("dcrSoftwareStatementJwks 不是有效的 JWK Set"))
+				}
+			}
+			organization.DcrSoftwareStatementJwks = *req.DcrSoftwareStatementJwks
+		}
+
+		_, err = models.UpdateOrganization(owner, name, organization)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("更新组织失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(organization))
+	}
+}
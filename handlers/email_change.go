@@ -0,0 +1,119 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package handlers
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oauth-server/oauth-server/services"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+// emailChangeErrorResponse 将新邮箱校验失败的原因转换为响应
+func emailChangeErrorResponse(ctx *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, services.ErrEmailTaken):
+		return ctx.Status(fiber.StatusConflict).JSON(types.ErrorResponse("该邮箱已被其他账号使用"))
+	case errors.Is(err, services.ErrEmailUnchanged):
+		return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("新邮箱与当前邮箱相同"))
+	case errors.Is(err, services.ErrVerificationCodeNotFound),
+		errors.Is(err, services.ErrVerificationCodeInvalid),
+		errors.Is(err, services.ErrVerificationCodeTooManyAttempts):
+		return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码无效或已过期"))
+	case errors.Is(err, services.ErrEmailInvalid):
+		return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("邮箱格式无效"))
+	}
+	return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("更换邮箱失败"))
+}
+
+// HandleSendEmailChangeCode 向新邮箱发送验证码，确认前不修改当前邮箱
+func HandleSendEmailChangeCode() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		var req types.EmailChangeRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+		email := strings.TrimSpace(req.Email)
+
+		if ok, err := checkResendCooldown(ctx, email, services.PurposeChangeEmail); !ok {
+			return err
+		}
+
+		code, err := services.SendEmailChangeCode(user, email)
+		if err != nil {
+			return emailChangeErrorResponse(ctx, err)
+		}
+		if code != "" {
+			// 开发环境下记录验证码
+			log.Printf("Verification code sent to %s: %s", email, code)
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]string{
+			"message": "验证码已发送，请查收新邮箱",
+		}))
+	}
+}
+
+// HandleVerifyEmailChange 使用新邮箱收到的验证码完成更换，并通知旧邮箱
+func HandleVerifyEmailChange() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		var req types.EmailChangeRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+		if req.Code == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码不能为空"))
+		}
+
+		if err := services.ConfirmEmailChange(user, strings.TrimSpace(req.Email), req.Code); err != nil {
+			return emailChangeErrorResponse(ctx, err)
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"message":       "邮箱更换成功",
+			"email":         user.Email,
+			"emailVerified": user.EmailVerified,
+		}))
+	}
+}
+
+// HandleRevertEmailChange 使用旧邮箱收到的链接撤销邮箱更换，并使账号的所有令牌失效
+// 无需登录，链接本身即为凭据
+func HandleRevertEmailChange() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		var req types.EmailRevertRequest
+		if err := ctx.BodyParser(&req); err != nil || req.Token == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		user, err := services.RevertEmailChange(req.Token)
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrEmailRevertInvalid):
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("链接无效、已过期或已使用"))
+			case errors.Is(err, services.ErrEmailTaken):
+				return ctx.Status(fiber.StatusConflict).JSON(types.ErrorResponse("原邮箱已被其他账号使用，请联系管理员"))
+			}
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("恢复邮箱失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]string{
+			"message": "已恢复原邮箱，请尽快修改密码",
+			"email":   user.Email,
+		}))
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oauth-server/oauth-server/models"
+	"github.com/oauth-server/oauth-server/services"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+// mfaErrorMessage 将多因素认证错误转换为提示信息
+func mfaErrorMessage(err error) string {
+	switch err {
+	case services.ErrMfaTicketInvalid:
+		return "MFA 票据无效或已过期，请重新登录"
+	case services.ErrMfaTicketUsedUp:
+		return "验证失败次数过多或票据已使用，请重新登录"
+	case services.ErrMfaCodeInvalid:
+		return "验证码无效"
+	case services.ErrMfaRecoveryNotValid:
+		return "恢复码无效或已使用"
+	case services.ErrMfaAlreadyEnabled:
+		return "已启用两步验证"
+	case services.ErrMfaNotEnabled:
+		return "未启用两步验证"
+	case services.ErrMfaSetupNotStarted:
+		return "请先开始绑定验证器"
+	default:
+		return "两步验证失败"
+	}
+}
+
+// currentMfaUser 获取当前登录的用户
+func currentMfaUser(ctx *fiber.Ctx) (*models.User, error) {
+	userID, ok := ctx.Locals("userID").(string)
+	if !ok || userID == "" {
+		return nil, ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse("未授权"))
+	}
+
+	userIDInt, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return nil, ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的用户ID"))
+	}
+
+	user, err := models.GetUserById(userIDInt)
+	if err != nil {
+		return nil, ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取用户信息失败"))
+	}
+	if user == nil || user.IsDeleted {
+		return nil, ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("用户不存在"))
+	}
+	return user, nil
+}
+
+// checkMfaAttempt 检查按用户 ID 计数的账户锁定，重新校验密码或第二因素的接口与密码登录共用同一计数
+func checkMfaAttempt(ctx *fiber.Ctx, account string) (bool, error) {
+	decision, err := services.CheckLoginAttempt(services.ThrottleScopePassword, account, ctx.IP())
+	if err != nil {
+		return false, ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("检查登录限制失败"))
+	}
+	if !decision.Allowed() {
+		return false, tooManyAttemptsResponse(ctx, decision.Reason, decision.RetryAfter)
+	}
+	return true, nil
+}
+
+// recordMfaAttempt 根据第二因素的校验结果记录失败或清除失败计数
+func recordMfaAttempt(ctx *fiber.Ctx, account string, err error) {
+	switch err {
+	case nil:
+		recordBruteForceSuccess(services.ThrottleScopePassword, account)
+	case services.ErrMfaCodeInvalid, services.ErrMfaRecoveryNotValid:
+		recordBruteForceFailure(ctx, services.ThrottleScopePassword, account)
+	}
+}
+
+// HandleMfaVerify 处理登录第二步验证，使用 MFA 票据和 TOTP 验证码或恢复码换取令牌
+func HandleMfaVerify() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		var req types.MfaVerifyRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		if req.MfaTicket == "" || (req.Code == "" && req.RecoveryCode == "") {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("MFA 票据和验证码不能为空"))
+		}
+
+		// 第二步验证与密码共用按用户 ID 计数的账户锁定，每次密码登录签发新票据也无法绕过
+		claims, err := services.ParseMfaTicket(req.MfaTicket)
+		if err != nil {
+			return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse(mfaErrorMessage(err)))
+		}
+		account := services.UserThrottleAccount(claims.Id)
+		if allowed, err := checkMfaAttempt(ctx, account); !allowed {
+			return err
+		}
+
+		user, amr, err := services.CompleteMfaLogin(req.MfaTicket, req.Code, req.RecoveryCode)
+		recordMfaAttempt(ctx, account, err)
+		if err != nil {
+			return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse(mfaErrorMessage(err)))
+		}
+
+		return issueLoginTokens(ctx, user, amr)
+	}
+}
+
+// HandleGetMfaStatus 获取当前用户的两步验证状态
+func HandleGetMfaStatus() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		webauthnCredentials, err := models.CountUserWebauthnCredentials(user.Id)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取用户信息失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"totpEnabled":            user.TotpEnabled,
+			"recoveryCodesRemaining": len(user.RecoveryCodes),
+			"webauthnCredentials":    webauthnCredentials,
+		}))
+	}
+}
+
+// HandleSetupTotp 开始绑定 TOTP 验证器，返回密钥和用于生成二维码的 otpauth URI
+func HandleSetupTotp() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		secret, uri, err := services.SetupTotp(user)
+		if err == services.ErrMfaAlreadyEnabled {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(mfaErrorMessage(err)))
+		}
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("生成 TOTP 密钥失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"secret":          secret,
+			"provisioningUri": uri,
+		}))
+	}
+}
+
+// HandleConfirmTotp 校验验证器生成的验证码并启用两步验证，恢复码仅在此时返回一次
+func HandleConfirmTotp() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		var req types.TotpCodeRequest
+		if err := ctx.BodyParser(&req); err != nil || req.Code == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码不能为空"))
+		}
+
+		codes, err := services.ConfirmTotp(user, req.Code)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(mfaErrorMessage(err)))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"message":       "两步验证已启用",
+			"recoveryCodes": codes,
+		}))
+	}
+}
+
+// HandleDisableTotp 使用 TOTP 验证码或恢复码关闭两步验证
+func HandleDisableTotp() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		var req types.TotpCodeRequest
+		if err := ctx.BodyParser(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码不能为空"))
+		}
+
+		account := services.UserThrottleAccount(user.GetId())
+		if allowed, err := checkMfaAttempt(ctx, account); !allowed {
+			return err
+		}
+
+		err = services.DisableTotp(user, req.Code, req.RecoveryCode)
+		recordMfaAttempt(ctx, account, err)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(mfaErrorMessage(err)))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"message": "两步验证已关闭",
+		}))
+	}
+}
+
+// HandleRegenerateRecoveryCodes 使用 TOTP 验证码重新生成恢复码，旧的恢复码全部失效
+func HandleRegenerateRecoveryCodes() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		var req types.TotpCodeRequest
+		if err := ctx.BodyParser(&req); err != nil || req.Code == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码不能为空"))
+		}
+
+		account := services.UserThrottleAccount(user.GetId())
+		if allowed, err := checkMfaAttempt(ctx, account); !allowed {
+			return err
+		}
+
+		codes, err := services.RegenerateRecoveryCodes(user, req.Code)
+		recordMfaAttempt(ctx, account, err)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(mfaErrorMessage(err)))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"recoveryCodes": codes,
+		}))
+	}
+}
+
+// HandleAdminResetMfa 重置用户的两步验证（需要管理员权限），用于用户丢失验证器和恢复码的情况
+func HandleAdminResetMfa() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		idStr := ctx.Params("id")
+		if idStr == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("用户ID不能为空"))
+		}
+
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的用户ID"))
+		}
+
+		user, err := models.GetUserById(id)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取用户信息失败"))
+		}
+		if user == nil || user.IsDeleted {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("用户不存在"))
+		}
+
+		if err := services.ResetMfa(user); err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("重置两步验证失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"message": "两步验证已重置",
+			"userId":  id,
+		}))
+	}
+}
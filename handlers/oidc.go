@@ -8,6 +8,8 @@ import (
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oauth-server/oauth-server/models"
 	"github.com/oauth-server/oauth-server/services"
 	"github.com/oauth-server/oauth-server/types"
 )
@@ -18,15 +20,7 @@ import (
 func HandleDiscovery() fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
 		// 获取服务器的 origin（issuer）
-		origin := os.Getenv("ORIGIN")
-		if origin == "" {
-			// 从请求中构建 origin
-			scheme := "http"
-			if ctx.Protocol() == "https" {
-				scheme = "https"
-			}
-			origin = scheme + "://" + ctx.Hostname()
-		}
+		origin := requestOrigin(ctx)
 
 		// 构造 OIDC Discovery 响应
 		discovery := map[string]interface{}{
@@ -45,8 +39,15 @@ func HandleDiscovery() fiber.Handler {
 			"id_token_signing_alg_values_supported": []string{"HS256", "RS256"},
 			"scopes_supported":                      []string{"openid", "profile", "email", "address", "phone", "offline_access"},
 			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
-			"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "name", "email", "picture", "preferred_username", "email_verified", "updated_at"},
+			"claims_supported":                      services.SupportedClaims,
+			"claims_parameter_supported":            true,
 			"code_challenge_methods_supported":      []string{"S256", "plain"},
+
+			"userinfo_signing_alg_values_supported":    services.SupportedSigningAlgs,
+			"id_token_encryption_alg_values_supported": services.SupportedJweAlgs,
+			"id_token_encryption_enc_values_supported": services.SupportedJweEncs,
+			"userinfo_encryption_alg_values_supported": services.SupportedJweAlgs,
+			"userinfo_encryption_enc_values_supported": services.SupportedJweEncs,
 		}
 
 		return ctx.JSON(discovery)
@@ -104,38 +105,41 @@ func HandleUserInfo() fiber.Handler {
 			return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse("令牌声明无效"))
 		}
 
-		// 构造用户信息响应（基于 scope）
-		userInfo := map[string]interface{}{
-			"sub": user.GetId(),
+		// 授权时通过 claims 参数单独请求的声明
+		claimsRequest, err := services.GetGrantClaimsRequest(token)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取授权信息失败"))
 		}
 
-		// 检查 scope 并添加相应的声明
-		scopes := claims.Scope
+		// 构造用户信息响应（基于 scope 和 claims 请求）
+		userInfo := services.BuildUserInfo(user, claims.Scope, claimsRequest)
 
-		// Profile scope - 包含头像
-		if containsScope(scopes, "profile") || containsScope(scopes, "openid") {
-			if user.Avatar != "" {
-				userInfo["picture"] = user.Avatar
+		// 客户端注册了 userinfo 签名/加密算法时，返回 application/jwt
+		if len(claims.Aud) > 0 {
+			application, err := models.GetApplicationByClientId(claims.Aud[0])
+			if err != nil {
+				return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取应用信息失败"))
+			}
+			if application != nil && (application.UserinfoSignedResponseAlg != "" || application.UserinfoEncryptedResponseAlg != "") {
+				userInfo["iss"] = claims.Iss
+				userInfo["aud"] = application.ClientId
+
+				encoded, err := services.EncodeClientResponse(
+					application,
+					jwt.MapClaims(userInfo),
+					application.UserinfoSignedResponseAlg,
+					application.UserinfoEncryptedResponseAlg,
+					application.UserinfoEncryptedResponseEnc,
+				)
+				if err != nil {
+					return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("生成用户信息响应失败"))
+				}
+
+				ctx.Set(fiber.HeaderContentType, "application/jwt")
+				return ctx.SendString(encoded)
 			}
 		}
 
-		// Email scope - 包含邮箱信息
-		if containsScope(scopes, "email") || containsScope(scopes, "openid") {
-			userInfo["email"] = user.Email
-		}
-
-		// 添加自定义声明（始终包含）
-		userInfo["id"] = user.Id
-		userInfo["username"] = user.Username
-		if user.QQ != "" {
-			userInfo["qq"] = user.QQ
-		}
-		if user.Avatar != "" {
-			userInfo["avatar"] = user.Avatar
-		}
-		userInfo["is_real_name"] = user.IsRealName
-		userInfo["is_admin"] = user.IsAdmin
-
 		// 直接返回用户信息，不使用 ApiResponse 包装
 		// 符合 OIDC UserInfo 端点标准
 		return ctx.JSON(userInfo)
@@ -143,103 +147,157 @@ func HandleUserInfo() fiber.Handler {
 }
 
 // HandleOidcRegister 处理 OIDC 动态客户端注册
-// 解析客户端注册请求，创建新的 OIDC 客户端应用
+// 按组织的 DcrPolicy 校验初始访问令牌和软件声明，创建新的 OIDC 客户端应用
 // Requirements: 7.4
 func HandleOidcRegister() fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
-		// 解析注册请求
-		var req struct {
-			ClientName              string   `json:"client_name"`
-			RedirectUris            []string `json:"redirect_uris"`
-			GrantTypes              []string `json:"grant_types"`
-			ResponseTypes           []string `json:"response_types"`
-			Scope                   string   `json:"scope"`
-			TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
-			LogoUri                 string   `json:"logo_uri"`
-			Contacts                []string `json:"contacts"`
+		var metadata services.ClientMetadata
+		if err := ctx.BodyParser(&metadata); err != nil {
+			return registrationError(ctx, &services.TokenError{
+				Error:            services.InvalidClientMetadata,
+				ErrorDescription: "无效的请求数据",
+			})
 		}
 
-		if err := ctx.BodyParser(&req); err != nil {
-			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		registration, tokenError, err := services.RegisterOidcClient(&metadata, bearerToken(ctx))
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("创建客户端失败: " + err.Error()))
 		}
-
-		// 验证必需字段
-		if req.ClientName == "" {
-			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("client_name 是必需的"))
+		if tokenError != nil {
+			return registrationError(ctx, tokenError)
 		}
 
-		if len(req.RedirectUris) == 0 {
-			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("redirect_uris 是必需的"))
-		}
+		application := registration.Application
+		response := services.ClientInformationResponse(
+			application,
+			registration.ClientSecret,
+			registration.RegistrationAccessToken,
+			registrationClientUri(ctx, application.ClientId),
+		)
+
+		return ctx.Status(fiber.StatusCreated).JSON(response)
+	}
+}
 
-		// 设置默认值
-		if len(req.GrantTypes) == 0 {
-			req.GrantTypes = []string{"authorization_code"}
+// HandleGetRegisteredClient 读取已注册客户端的配置 (RFC 7592 §2.1)
+// Requirements: 7.4
+func HandleGetRegisteredClient() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		application, tokenError, err := services.GetRegisteredClient(ctx.Params("clientId"), bearerToken(ctx))
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取客户端信息失败"))
+		}
+		if tokenError != nil {
+			return registrationError(ctx, tokenError)
 		}
 
-		if len(req.ResponseTypes) == 0 {
-			req.ResponseTypes = []string{"code"}
+		// client_secret 仅以哈希存储，只在注册时返回一次
+		ctx.Set("Cache-Control", "no-store")
+		return ctx.JSON(services.ClientInformationResponse(
+			application,
+			"",
+			"",
+			registrationClientUri(ctx, application.ClientId),
+		))
+	}
+}
+
+// HandleUpdateRegisteredClient 更新已注册客户端的配置 (RFC 7592 §2.2)
+// Requirements: 7.4
+func HandleUpdateRegisteredClient() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		application, tokenError, err := services.GetRegisteredClient(ctx.Params("clientId"), bearerToken(ctx))
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取客户端信息失败"))
+		}
+		if tokenError != nil {
+			return registrationError(ctx, tokenError)
 		}
 
-		if req.Scope == "" {
-			req.Scope = "openid profile email"
+		var metadata services.ClientMetadata
+		if err := ctx.BodyParser(&metadata); err != nil {
+			return registrationError(ctx, &services.TokenError{
+				Error:            services.InvalidClientMetadata,
+				ErrorDescription: "无效的请求数据",
+			})
 		}
 
-		if req.TokenEndpointAuthMethod == "" {
-			req.TokenEndpointAuthMethod = "client_secret_basic"
+		tokenError, err = services.UpdateRegisteredClient(application, &metadata)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("更新客户端失败"))
+		}
+		if tokenError != nil {
+			return registrationError(ctx, tokenError)
 		}
 
-		// 调用服务层创建 OIDC 客户端
-		clientId, clientSecret, err := services.CreateOidcClient(
-			req.ClientName,
-			req.RedirectUris,
-			req.GrantTypes,
-			req.ResponseTypes,
-			req.Scope,
-			req.TokenEndpointAuthMethod,
-			req.LogoUri,
-		)
+		// client_secret 仅以哈希存储，只在注册时返回一次
+		ctx.Set("Cache-Control", "no-store")
+		return ctx.JSON(services.ClientInformationResponse(
+			application,
+			"",
+			"",
+			registrationClientUri(ctx, application.ClientId),
+		))
+	}
+}
 
+// HandleDeleteRegisteredClient 注销已注册的客户端 (RFC 7592 §2.3)
+// Requirements: 7.4
+func HandleDeleteRegisteredClient() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		application, tokenError, err := services.GetRegisteredClient(ctx.Params("clientId"), bearerToken(ctx))
 		if err != nil {
-			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("创建客户端失败: " + err.Error()))
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取客户端信息失败"))
 		}
-
-		// 构造响应
-		response := map[string]interface{}{
-			"client_id":                  clientId,
-			"client_secret":              clientSecret,
-			"client_name":                req.ClientName,
-			"redirect_uris":              req.RedirectUris,
-			"grant_types":                req.GrantTypes,
-			"response_types":             req.ResponseTypes,
-			"scope":                      req.Scope,
-			"token_endpoint_auth_method": req.TokenEndpointAuthMethod,
-			"client_id_issued_at":        services.GetCurrentTimestamp(),
-			"client_secret_expires_at":   0, // 不过期
+		if tokenError != nil {
+			return registrationError(ctx, tokenError)
 		}
 
-		if req.LogoUri != "" {
-			response["logo_uri"] = req.LogoUri
+		if err := services.DeleteRegisteredClient(application); err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("删除客户端失败"))
 		}
 
-		if len(req.Contacts) > 0 {
-			response["contacts"] = req.Contacts
-		}
+		return ctx.SendStatus(fiber.StatusNoContent)
+	}
+}
 
-		return ctx.Status(fiber.StatusCreated).JSON(response)
+// registrationError 按 RFC 7591 §3.2.2 返回注册错误
+func registrationError(ctx *fiber.Ctx, tokenError *services.TokenError) error {
+	statusCode := fiber.StatusBadRequest
+	switch tokenError.Error {
+	case services.InvalidToken:
+		statusCode = fiber.StatusUnauthorized
+		ctx.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	case services.AccessDenied:
+		statusCode = fiber.StatusForbidden
 	}
+	return ctx.Status(statusCode).JSON(tokenError)
 }
 
-// containsScope 检查 scope 字符串中是否包含指定的 scope
-func containsScope(scopes, scope string) bool {
-	if scopes == "" {
-		return false
+// bearerToken 从 Authorization 头提取 Bearer token
+func bearerToken(ctx *fiber.Ctx) string {
+	authHeader := ctx.Get("Authorization")
+	if len(authHeader) > 7 && strings.EqualFold(authHeader[:7], "Bearer ") {
+		return strings.TrimSpace(authHeader[7:])
 	}
-	scopeList := strings.Split(scopes, " ")
-	for _, s := range scopeList {
-		if s == scope {
-			return true
+	return ""
+}
+
+// requestOrigin 获取服务器的 origin（issuer）
+func requestOrigin(ctx *fiber.Ctx) string {
+	origin := os.Getenv("ORIGIN")
+	if origin == "" {
+		// 从请求中构建 origin
+		scheme := "http"
+		if ctx.Protocol() == "https" {
+			scheme = "https"
 		}
+		origin = scheme + "://" + ctx.Hostname()
 	}
-	return false
+	return origin
+}
+
+// registrationClientUri 返回客户端配置端点地址 (RFC 7592 §3)
+func registrationClientUri(ctx *fiber.Ctx, clientId string) string {
+	return requestOrigin(ctx) + "/api/oauth/register/" + clientId
 }
@@ -0,0 +1,163 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package handlers
+
+import (
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oauth-server/oauth-server/models"
+	"github.com/oauth-server/oauth-server/services"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+// sendSmsCode 发送短信验证码
+// 登录和重置密码只向已验证的手机号发送，注册只向未被使用的手机号发送，响应始终相同
+func sendSmsCode(ctx *fiber.Ctx, rawPhone, purpose, clientId string) error {
+	phone, err := services.NormalizePhone(rawPhone)
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("手机号格式无效"))
+	}
+
+	if purpose == services.PurposeLogin {
+		if application, err := codeSigninApplication(ctx, clientId); application == nil {
+			return err
+		}
+	}
+
+	if ok, err := checkResendCooldown(ctx, phone, purpose); !ok {
+		return err
+	}
+
+	user, err := models.GetUserByPhone(phone)
+	if err != nil {
+		return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取用户信息失败"))
+	}
+
+	send := user == nil
+	if purpose != "register" {
+		send = user != nil && !user.IsDeleted && !user.IsForbidden
+	}
+
+	if send {
+		// 异步发送短信（不阻塞请求）
+		go func() {
+			code, err := services.SendSmsVerificationCode(phone, purpose)
+			if err != nil {
+				log.Printf("Failed to send verification sms to %s: %v", phone, err)
+			} else if code != "" {
+				// 开发环境下记录验证码
+				log.Printf("Verification code sent to %s: %s", phone, code)
+			}
+		}()
+	}
+
+	return ctx.JSON(types.SuccessResponse(map[string]string{
+		"message": "验证码已发送，请查收短信",
+	}))
+}
+
+// HandleSendPhoneBindCode 向待绑定的手机号发送验证码
+func HandleSendPhoneBindCode() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		var req types.PhoneBindRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		phone, err := services.NormalizePhone(req.Phone)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("手机号格式无效"))
+		}
+
+		existing, err := models.GetUserByPhone(phone)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取用户信息失败"))
+		}
+		if existing != nil {
+			return ctx.Status(fiber.StatusConflict).JSON(types.ErrorResponse("该手机号已绑定其他账号"))
+		}
+
+		if ok, err := checkResendCooldown(ctx, phone, services.PurposeBindPhone); !ok {
+			return err
+		}
+
+		code, err := services.SendSmsVerificationCode(phone, services.PurposeBindPhone)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("发送短信失败"))
+		}
+		if code != "" {
+			// 开发环境下记录验证码
+			log.Printf("Verification code sent to %s: %s", phone, code)
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]string{
+			"message": "验证码已发送，请查收短信",
+		}))
+	}
+}
+
+// HandleVerifyPhone 使用短信验证码绑定或更换手机号
+func HandleVerifyPhone() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		var req types.PhoneBindRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		phone, err := services.NormalizePhone(req.Phone)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("手机号格式无效"))
+		}
+		if req.Code == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码不能为空"))
+		}
+
+		valid, err := services.VerifyCode(phone, req.Code, services.PurposeBindPhone)
+		if err != nil || !valid {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("验证码无效或已过期"))
+		}
+
+		if err := services.SetUserPhone(user, phone); err != nil {
+			return ctx.Status(fiber.StatusConflict).JSON(types.ErrorResponse("该手机号已绑定其他账号"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"message":       "手机号绑定成功",
+			"phone":         user.Phone,
+			"phoneVerified": user.PhoneVerified,
+		}))
+	}
+}
+
+// HandleRemovePhone 解绑手机号，没有邮箱的账号不能解绑
+func HandleRemovePhone() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		if user.Phone == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("尚未绑定手机号"))
+		}
+		if err := services.RemoveUserPhone(user); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("账号未绑定邮箱，不能解绑手机号"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]string{
+			"message": "手机号已解绑",
+		}))
+	}
+}
@@ -0,0 +1,539 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oauth-server/oauth-server/models"
+	"github.com/oauth-server/oauth-server/services"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+// providerErrorMessage 将第三方登录错误转换为提示信息
+func providerErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, services.ErrProviderNotConfigured):
+		return "登录提供商配置不完整"
+	case errors.Is(err, services.ErrProviderStateInvalid):
+		return "登录状态无效或已过期，请重新登录"
+	case errors.Is(err, services.ErrProviderUserInvalid):
+		return "未能从登录提供商获取用户信息"
+	case errors.Is(err, services.ErrProviderSignupDisabled):
+		return "未开放注册，该第三方账号尚未绑定本站账号"
+	case errors.Is(err, services.ErrProviderEmailTaken):
+		return "该邮箱已注册，请先登录后在个人资料中绑定该第三方账号"
+	case errors.Is(err, services.ErrIdTokenInvalid):
+		return "登录提供商返回的身份令牌无效"
+	case errors.Is(err, services.ErrProviderIdentityLinked):
+		return "该第三方账号已绑定其他用户"
+	default:
+		return "第三方登录失败，请稍后重试"
+	}
+}
+
+// loginProviderCategories 可用于登录的提供商类别
+var loginProviderCategories = []string{models.ProviderCategoryOAuth, models.ProviderCategoryOidc}
+
+func isLoginProviderCategory(category string) bool {
+	return category == models.ProviderCategoryOAuth || category == models.ProviderCategoryOidc
+}
+
+// loginProvider 获取已启用的 OAuth 或 OIDC 登录提供商，不存在或未启用时返回 nil
+func loginProvider(name string) (*models.Provider, error) {
+	provider, err := models.GetProvider("admin", name)
+	if err != nil || provider == nil {
+		return nil, err
+	}
+	if !provider.IsEnabled || !isLoginProviderCategory(provider.Category) {
+		return nil, nil
+	}
+	return provider, nil
+}
+
+// redirectProviderError 回到前端页面并通过 provider_error 参数显示错误
+func redirectProviderError(ctx *fiber.Ctx, path, message string) error {
+	return ctx.Redirect(services.ProviderFrontendUrl(path, url.Values{"provider_error": {message}}), fiber.StatusFound)
+}
+
+// HandleGetLoginProviders 获取登录页显示的第三方登录方式
+func HandleGetLoginProviders() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		providers, err := models.GetEnabledProviders("admin", loginProviderCategories...)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取登录方式失败"))
+		}
+
+		result := make([]map[string]string, 0, len(providers))
+		for _, provider := range providers {
+			result = append(result, map[string]string{
+				"name":        provider.Name,
+				"displayName": provider.DisplayName,
+				"type":        provider.Type,
+			})
+		}
+
+		return ctx.JSON(types.SuccessResponse(result))
+	}
+}
+
+// HandleProviderLogin 跳转到第三方登录页面
+func HandleProviderLogin() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		provider, err := loginProvider(ctx.Params("name"))
+		if err != nil {
+			return redirectProviderError(ctx, "/login", "获取登录提供商失败")
+		}
+		if provider == nil {
+			return redirectProviderError(ctx, "/login", "登录方式不存在或未启用")
+		}
+
+		authUrl, err := services.BeginProviderLogin(provider, 0)
+		if err != nil {
+			return redirectProviderError(ctx, "/login", providerErrorMessage(err))
+		}
+
+		return ctx.Redirect(authUrl, fiber.StatusFound)
+	}
+}
+
+// HandleProviderCallback 处理第三方登录回调
+// 登录成功时带一次性票据回到前端登录页，绑定账号时回到个人资料页
+func HandleProviderCallback() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		provider, err := loginProvider(ctx.Params("name"))
+		if err != nil || provider == nil {
+			return redirectProviderError(ctx, "/login", "登录方式不存在或未启用")
+		}
+
+		// 用户在第三方页面拒绝授权
+		if ctx.Query("error") != "" {
+			return redirectProviderError(ctx, "/login", "已取消第三方登录")
+		}
+
+		user, link, err := services.FinishProviderLogin(provider, ctx.Query("state"), ctx.Query("code"))
+		page := "/login"
+		if link {
+			page = "/console/profile"
+		}
+		if err != nil {
+			log.Printf("Provider %s sign-in failed: %v", provider.Name, err)
+			return redirectProviderError(ctx, page, providerErrorMessage(err))
+		}
+
+		if link {
+			return ctx.Redirect(services.ProviderFrontendUrl(page, url.Values{"provider_linked": {provider.Name}}), fiber.StatusFound)
+		}
+
+		if user.IsDeleted {
+			return redirectProviderError(ctx, page, "账号不存在")
+		}
+		if user.IsForbidden {
+			return redirectProviderError(ctx, page, "账号已被禁用")
+		}
+
+		ticket, err := services.CreateProviderLoginTicket(user, provider)
+		if err != nil {
+			return redirectProviderError(ctx, page, "第三方登录失败，请稍后重试")
+		}
+		return ctx.Redirect(services.ProviderFrontendUrl(page, url.Values{"provider_ticket": {ticket}}), fiber.StatusFound)
+	}
+}
+
+// HandleProviderLoginFinish 使用第三方登录回调得到的一次性票据换取令牌
+func HandleProviderLoginFinish() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		var req types.ProviderLoginRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		user, err := services.RedeemProviderLoginTicket(req.Ticket)
+		if err != nil {
+			return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse("登录状态无效或已过期，请重新登录"))
+		}
+		if user.IsDeleted {
+			return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse("账号不存在"))
+		}
+		if user.IsForbidden {
+			return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse("账号已被禁用"))
+		}
+
+		// 第三方登录只证明持有第三方账号，启用了两步验证的用户仍需完成第二步
+		methods, err := services.SecondFactorMethods(user)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取用户信息失败"))
+		}
+		if len(methods) > 0 {
+			ticket, err := services.GenerateMfaTicket(user, []string{services.AmrFederated})
+			if err != nil {
+				return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("生成 MFA 票据失败"))
+			}
+			return ctx.JSON(types.SuccessResponse(types.MfaChallengeResponse{
+				MfaRequired: true,
+				MfaTicket:   ticket,
+				Methods:     methods,
+			}))
+		}
+
+		return issueLoginTokens(ctx, user, []string{services.AmrFederated})
+	}
+}
+
+// HandleGetUserIdentities 获取当前用户绑定的第三方账号
+func HandleGetUserIdentities() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		identities, err := models.GetUserIdentities(user.Id)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取第三方账号失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(identities))
+	}
+}
+
+// HandleLinkProvider 开始绑定第三方账号，返回第三方登录页面地址
+func HandleLinkProvider() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		provider, err := loginProvider(ctx.Params("provider"))
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取登录提供商失败"))
+		}
+		if provider == nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("登录方式不存在或未启用"))
+		}
+
+		authUrl, err := services.BeginProviderLogin(provider, user.Id)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(providerErrorMessage(err)))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]string{
+			"url": authUrl,
+		}))
+	}
+}
+
+// HandleUnlinkIdentity 解绑第三方账号，账号需保留其他登录方式
+func HandleUnlinkIdentity() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		identity, err := models.GetUserIdentity(user.Owner, ctx.Params("name"))
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取第三方账号失败"))
+		}
+		if identity == nil || identity.UserId != user.Id {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("第三方账号不存在"))
+		}
+
+		// 没有密码、邮箱、手机号和其他第三方账号时解绑会导致无法登录
+		if user.Password == "" && user.Email == "" && !user.PhoneVerified {
+			identities, err := models.GetUserIdentities(user.Id)
+			if err != nil {
+				return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取第三方账号失败"))
+			}
+			if len(identities) <= 1 {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("这是账号唯一的登录方式，请先绑定邮箱或手机号"))
+			}
+		}
+
+		if _, err := models.DeleteUserIdentity(identity.Owner, identity.Name); err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("解绑失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]string{
+			"message": "第三方账号已解绑",
+		}))
+	}
+}
+
+// HandleGetProviders 获取登录提供商列表（需要管理员权限），不返回 Client Secret
+func HandleGetProviders() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		providers, err := models.GetProviders(ctx.Query("owner", ""))
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取登录提供商失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(providers))
+	}
+}
+
+// validateProviderRequest 校验登录提供商的类别、Issuer、LDAP 设置、组织和邮箱关联规则，返回错误提示
+func validateProviderRequest(req *types.ProviderRequest) string {
+	if req.Category != "" && !isLoginProviderCategory(req.Category) && req.Category != models.ProviderCategoryLdap {
+		return "不支持的提供商类别"
+	}
+	if req.Category == models.ProviderCategoryLdap {
+		if msg := validateLdapProviderRequest(req); msg != "" {
+			return msg
+		}
+	} else if req.ClientId == "" {
+		return "Client ID 不能为空"
+	}
+	if req.Category == models.ProviderCategoryOidc {
+		issuer, err := url.Parse(strings.TrimSpace(req.Issuer))
+		if err != nil || (issuer.Scheme != "https" && issuer.Scheme != "http") || issuer.Host == "" {
+			return "OIDC 提供商需要填写有效的 Issuer"
+		}
+	}
+	switch req.EmailLinking {
+	case "", models.ProviderEmailLinkingReject, models.ProviderEmailLinkingLink, models.ProviderEmailLinkingIgnore:
+	default:
+		return "不支持的邮箱关联规则"
+	}
+	if req.Organization != "" {
+		organization, err := models.GetOrganization("admin", req.Organization)
+		if err != nil || organization == nil {
+			return "组织不存在"
+		}
+	}
+	return ""
+}
+
+// validateLdapProviderRequest 校验 LDAP 服务器地址、搜索设置和组角色映射
+func validateLdapProviderRequest(req *types.ProviderRequest) string {
+	serverUrl, err := url.Parse(strings.TrimSpace(req.HostUrl))
+	if err != nil || (serverUrl.Scheme != "ldap" && serverUrl.Scheme != "ldaps") || serverUrl.Host == "" {
+		return "LDAP 提供商需要填写 ldap:// 或 ldaps:// 服务器地址"
+	}
+	if req.LdapBaseDn == "" && req.LdapBindDnTemplate == "" {
+		return "LDAP 提供商需要填写 Base DN 或绑定 DN 模板"
+	}
+	if req.LdapBindDnTemplate != "" && !strings.Contains(req.LdapBindDnTemplate, "%s") {
+		return "绑定 DN 模板需要包含 %s"
+	}
+	if req.LdapUserFilter != "" && !strings.Contains(req.LdapUserFilter, "%s") {
+		return "用户过滤器需要包含 %s"
+	}
+	for group, role := range req.LdapGroupRoles {
+		if group == "" || (role != models.LdapRoleUser && role != models.LdapRoleAdmin) {
+			return "组角色只能是 user 或 admin"
+		}
+	}
+	if req.LdapSyncInterval < 0 {
+		return "同步间隔不能为负数"
+	}
+	return ""
+}
+
+// applyProviderRequest 将请求写入登录提供商，Client Secret 加密存储
+func applyProviderRequest(provider *models.Provider, req *types.ProviderRequest) error {
+	provider.DisplayName = req.DisplayName
+	provider.Type = req.Type
+	provider.ClientId = req.ClientId
+	provider.AuthUrl = strings.TrimSpace(req.AuthUrl)
+	provider.TokenUrl = strings.TrimSpace(req.TokenUrl)
+	provider.UserInfoUrl = strings.TrimSpace(req.UserInfoUrl)
+	provider.Scopes = req.Scopes
+	provider.UserMapping = req.UserMapping
+	provider.Issuer = strings.TrimSpace(req.Issuer)
+	provider.Organization = req.Organization
+	provider.EmailLinking = req.EmailLinking
+	provider.HostUrl = strings.TrimSpace(req.HostUrl)
+	provider.LdapBaseDn = strings.TrimSpace(req.LdapBaseDn)
+	provider.LdapUserFilter = strings.TrimSpace(req.LdapUserFilter)
+	provider.LdapBindDnTemplate = strings.TrimSpace(req.LdapBindDnTemplate)
+	provider.LdapStartTls = req.LdapStartTls
+	provider.LdapGroupAttribute = strings.TrimSpace(req.LdapGroupAttribute)
+	provider.LdapGroupRoles = req.LdapGroupRoles
+	provider.LdapSyncInterval = req.LdapSyncInterval
+	if req.Category != "" {
+		provider.Category = req.Category
+	}
+	if req.IsEnabled != nil {
+		provider.IsEnabled = *req.IsEnabled
+	}
+
+	if req.ClientSecret != "" {
+		encrypted, err := services.EncryptData(req.ClientSecret)
+		if err != nil {
+			return err
+		}
+		provider.ClientSecret = encrypted
+	}
+	return nil
+}
+
+// HandleCreateProvider 创建登录提供商（需要管理员权限）
+func HandleCreateProvider() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		var req types.ProviderRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+		if req.Category == models.ProviderCategoryLdap && req.Type == "" {
+			req.Type = models.ProviderCategoryLdap
+		}
+		if req.Name == "" || req.Type == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("名称和类型不能为空"))
+		}
+		if msg := validateProviderRequest(&req); msg != "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(msg))
+		}
+
+		existing, err := models.GetProvider("admin", req.Name)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取登录提供商失败"))
+		}
+		if existing != nil {
+			return ctx.Status(fiber.StatusConflict).JSON(types.ErrorResponse("登录提供商已存在"))
+		}
+
+		provider := &models.Provider{
+			Owner:       "admin",
+			Name:        req.Name,
+			CreatedTime: models.GetCurrentTime(),
+			Category:    models.ProviderCategoryOAuth,
+			IsEnabled:   true,
+		}
+		if err := applyProviderRequest(provider, &req); err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("加密 Client Secret 失败"))
+		}
+		if provider.DisplayName == "" {
+			provider.DisplayName = provider.Name
+		}
+
+		if _, err := models.AddProvider(provider); err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("创建登录提供商失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(provider))
+	}
+}
+
+// HandleUpdateProvider 更新登录提供商（需要管理员权限），Client Secret 留空时保持不变
+func HandleUpdateProvider() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		owner := ctx.Params("owner")
+		name := ctx.Params("name")
+
+		provider, err := models.GetProvider(owner, name)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取登录提供商失败"))
+		}
+		if provider == nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("登录提供商不存在"))
+		}
+
+		var req types.ProviderRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+		if req.Category == "" {
+			req.Category = provider.Category
+		}
+		if req.Category == models.ProviderCategoryLdap && req.Type == "" {
+			req.Type = models.ProviderCategoryLdap
+		}
+		if req.Type == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("类型不能为空"))
+		}
+		if msg := validateProviderRequest(&req); msg != "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(msg))
+		}
+
+		if err := applyProviderRequest(provider, &req); err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("加密 Client Secret 失败"))
+		}
+
+		if _, err := models.UpdateProvider(owner, name, provider); err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("更新登录提供商失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(provider))
+	}
+}
+
+// ldapProvider 获取 LDAP 提供商，不存在时返回错误提示
+func ldapProvider(ctx *fiber.Ctx) (*models.Provider, error) {
+	provider, err := models.GetProvider(ctx.Params("owner"), ctx.Params("name"))
+	if err != nil {
+		return nil, ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取登录提供商失败"))
+	}
+	if provider == nil || provider.Category != models.ProviderCategoryLdap {
+		return nil, ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("LDAP 提供商不存在"))
+	}
+	return provider, nil
+}
+
+// HandleTestLdapProvider 测试 LDAP 连接和服务账号绑定并列出部分用户（需要管理员权限），
+// 失败时返回目录服务器的错误信息便于排查
+func HandleTestLdapProvider() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		provider, err := ldapProvider(ctx)
+		if provider == nil {
+			return err
+		}
+
+		result, err := services.TestLdapConnection(provider)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadGateway).JSON(types.ErrorResponse("LDAP 连接失败：" + err.Error()))
+		}
+
+		return ctx.JSON(types.SuccessResponse(result))
+	}
+}
+
+// HandleSyncLdapProvider 立即将 LDAP 目录同步到本地用户（需要管理员权限）
+func HandleSyncLdapProvider() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		provider, err := ldapProvider(ctx)
+		if provider == nil {
+			return err
+		}
+
+		result, err := services.SyncLdapProvider(provider)
+		if errors.Is(err, services.ErrLdapEmptyDirectory) {
+			return ctx.Status(fiber.StatusConflict).JSON(types.ErrorResponse("目录中没有找到任何用户，已跳过同步以免停用全部账号"))
+		}
+		if err != nil {
+			return ctx.Status(fiber.StatusBadGateway).JSON(types.ErrorResponse("LDAP 同步失败：" + err.Error()))
+		}
+
+		return ctx.JSON(types.SuccessResponse(result))
+	}
+}
+
+// HandleDeleteProvider 删除登录提供商（需要管理员权限）
+func HandleDeleteProvider() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		owner := ctx.Params("owner")
+		name := ctx.Params("name")
+
+		provider, err := models.GetProvider(owner, name)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取登录提供商失败"))
+		}
+		if provider == nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("登录提供商不存在"))
+		}
+
+		if _, err := models.DeleteProvider(owner, name); err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("删除登录提供商失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]string{
+			"message": "登录提供商已删除",
+		}))
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oauth-server/oauth-server/models"
+	"github.com/oauth-server/oauth-server/services"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+// samlErrorMessage 将 SAML 错误转换为提示信息
+func samlErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, services.ErrSamlUnknownSp):
+		return "SAML 服务提供商未注册"
+	case errors.Is(err, services.ErrSamlAcsUrlMismatch):
+		return "断言接收地址与登记的不一致"
+	case errors.Is(err, services.ErrSamlSloNotConfigured):
+		return "该服务提供商未配置单点登出地址"
+	case errors.Is(err, services.ErrSamlRequestInvalid):
+		return "SAML 请求无效"
+	default:
+		return "SAML 处理失败，请稍后重试"
+	}
+}
+
+// samlBindingParams 读取 SAML 消息：HTTP-Redirect 绑定在查询参数中且经过压缩，HTTP-POST 绑定在表单中
+func samlBindingParams(ctx *fiber.Ctx) (data []byte, binding, relayState string, err error) {
+	binding = services.SamlBindingRedirect
+	encoded := ctx.Query("SAMLRequest")
+	relayState = ctx.Query("RelayState")
+	if ctx.Method() == fiber.MethodPost {
+		binding = services.SamlBindingPost
+		encoded = ctx.FormValue("SAMLRequest")
+		relayState = ctx.FormValue("RelayState")
+	}
+	if encoded == "" {
+		return nil, binding, relayState, services.ErrSamlRequestInvalid
+	}
+
+	data, err = services.DecodeSamlMessage(encoded, binding == services.SamlBindingRedirect)
+	return data, binding, relayState, err
+}
+
+// redirectSamlPage 带上压缩编码的请求跳转到前端 SAML 页面，由前端确认登录状态后继续
+func redirectSamlPage(ctx *fiber.Ctx, path string, data []byte, query url.Values) error {
+	encoded, err := services.EncodeSamlRedirectMessage(data)
+	if err != nil {
+		return redirectProviderError(ctx, path, "SAML 处理失败，请稍后重试")
+	}
+	query.Set("SAMLRequest", encoded)
+	return ctx.Redirect(services.ProviderFrontendUrl(path, query), fiber.StatusFound)
+}
+
+// HandleSamlMetadata 返回签名的 IdP 元数据
+func HandleSamlMetadata() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		metadata, err := services.BuildSamlMetadata()
+		if err != nil {
+			log.Printf("Failed to build SAML metadata: %v", err)
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("生成元数据失败"))
+		}
+
+		ctx.Set(fiber.HeaderContentType, "application/samlmetadata+xml")
+		return ctx.SendString(metadata)
+	}
+}
+
+// HandleSamlSso 接收服务提供商的登录请求（HTTP-Redirect 和 HTTP-POST 绑定）
+// 验证后跳转到前端 /saml/sso 页面，用户复用已有登录会话或先登录
+func HandleSamlSso() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		data, _, relayState, err := samlBindingParams(ctx)
+		if err != nil {
+			return redirectProviderError(ctx, "/saml/sso", samlErrorMessage(err))
+		}
+
+		request, err := services.ParseSamlAuthnRequest(data)
+		if err != nil {
+			log.Printf("Rejected SAML AuthnRequest: %v", err)
+			return redirectProviderError(ctx, "/saml/sso", samlErrorMessage(err))
+		}
+
+		query := url.Values{"app": {request.Application.DisplayName}}
+		if relayState != "" {
+			query.Set("RelayState", relayState)
+		}
+		if request.ForceAuthn {
+			query.Set("ForceAuthn", "true")
+		}
+		return redirectSamlPage(ctx, "/saml/sso", data, query)
+	}
+}
+
+// HandleSamlSsoComplete 为当前登录用户签发 SAML 响应，由前端以表单提交到服务提供商
+func HandleSamlSsoComplete() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+		if user.IsForbidden {
+			return ctx.Status(fiber.StatusForbidden).JSON(types.ErrorResponse("账号已被禁用"))
+		}
+
+		var req types.SamlSsoRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		var request *services.SamlAuthnRequest
+		if req.SAMLRequest != "" {
+			data, err := services.DecodeSamlMessage(req.SAMLRequest, true)
+			if err == nil {
+				request, err = services.ParseSamlAuthnRequest(data)
+			}
+			if err != nil {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(samlErrorMessage(err)))
+			}
+		} else if req.EntityId != "" {
+			// IdP 发起的登录
+			request, err = services.NewSamlIdpInitiatedRequest(req.EntityId)
+			if err != nil {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(samlErrorMessage(err)))
+			}
+		} else {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("samlRequest 和 entityId 不能同时为空"))
+		}
+
+		message, err := services.BuildSamlResponse(request, user, req.RelayState)
+		if err != nil {
+			log.Printf("Failed to build SAML response: %v", err)
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("生成 SAML 响应失败"))
+		}
+		sessionID, _ := ctx.Locals("sessionID").(string)
+		services.AttachSessionApplication(user.Owner, sessionID, request.Application.GetId())
+
+		return ctx.JSON(types.SuccessResponse(message))
+	}
+}
+
+// HandleSamlSlo 接收服务提供商的单点登出请求（HTTP-Redirect 和 HTTP-POST 绑定）
+// 验证后跳转到前端 /saml/logout 页面，前端清除登录状态后获取注销响应
+func HandleSamlSlo() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		data, binding, relayState, err := samlBindingParams(ctx)
+		if err == nil {
+			_, err = services.ParseSamlLogoutRequest(data, binding)
+		}
+		if err != nil {
+			log.Printf("Rejected SAML LogoutRequest: %v", err)
+			return redirectProviderError(ctx, "/saml/logout", samlErrorMessage(err))
+		}
+
+		query := url.Values{"binding": {binding}}
+		if relayState != "" {
+			query.Set("RelayState", relayState)
+		}
+		return redirectSamlPage(ctx, "/saml/logout", data, query)
+	}
+}
+
+// HandleSamlSloComplete 登出当前浏览器通过该服务提供商登录的会话并签发注销响应
+// 认证可选：携带的令牌属于 NameID 对应的用户时才登出其会话，前端据 signedOut 清除本地登录状态
+func HandleSamlSloComplete() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		var req types.SamlSloRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		data, err := services.DecodeSamlMessage(req.SAMLRequest, true)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(samlErrorMessage(err)))
+		}
+		request, err := services.ParseSamlLogoutRequest(data, req.Binding)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(samlErrorMessage(err)))
+		}
+
+		// 注销请求没有签名，只登出发起请求的浏览器自己的会话，且要求该会话的用户与 NameID 一致
+		userID, _ := ctx.Locals("userID").(string)
+		userIDInt, _ := strconv.ParseInt(userID, 10, 64)
+		sessionID, _ := ctx.Locals("sessionID").(string)
+		signedOut, err := services.SignOutSamlSession(request, userIDInt, sessionID)
+		if err != nil {
+			log.Printf("Failed to sign out session %s for %s: %v", sessionID, request.Application.GetId(), err)
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("登出会话失败"))
+		}
+
+		message, err := services.BuildSamlLogoutResponse(request, req.RelayState)
+		if err != nil {
+			log.Printf("Failed to build SAML logout response: %v", err)
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("生成注销响应失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(struct {
+			*services.SamlMessage
+			SignedOut bool `json:"signedOut"`
+		}{message, signedOut}))
+	}
+}
+
+// applySamlRequest 将请求中的 SAML 配置写入应用
+func applySamlRequest(application *models.Application, req *types.CreateApplicationRequest) {
+	if req.Category != "" {
+		application.Category = req.Category
+	}
+	if req.SamlEntityId != "" {
+		application.SamlEntityId = req.SamlEntityId
+	}
+	if req.SamlAcsUrl != "" {
+		application.SamlAcsUrl = req.SamlAcsUrl
+	}
+	if req.SamlSloUrl != nil {
+		application.SamlSloUrl = *req.SamlSloUrl
+	}
+	if req.SamlNameIdFormat != "" {
+		application.SamlNameIdFormat = req.SamlNameIdFormat
+	}
+	if req.SamlAttributes != nil {
+		application.SamlAttributes = req.SamlAttributes
+	}
+}
+
+// validateSamlApplication 验证 SAML 服务提供商配置，返回错误提示，合法时返回空字符串
+func validateSamlApplication(application *models.Application) string {
+	if application.Category != "" && application.Category != models.ApplicationCategoryOAuth && !application.IsSaml() {
+		return "不支持的应用类别"
+	}
+	if !application.IsSaml() {
+		return ""
+	}
+
+	if application.SamlEntityId == "" {
+		return "SAML 实体 ID 不能为空"
+	}
+	existing, err := models.GetApplicationBySamlEntityId(application.SamlEntityId)
+	if err != nil {
+		return "检查 SAML 实体 ID 失败"
+	}
+	if existing != nil && (existing.Owner != application.Owner || existing.Name != application.Name) {
+		return "SAML 实体 ID 已被其他应用使用"
+	}
+
+	if !isHttpUrl(application.SamlAcsUrl) {
+		return "断言接收地址（ACS URL）必须是 http(s) 地址"
+	}
+	if application.SamlSloUrl != "" && !isHttpUrl(application.SamlSloUrl) {
+		return "单点登出地址必须是 http(s) 地址"
+	}
+	if application.SamlNameIdFormat != "" && !isSupportedValue(services.SupportedSamlNameIdFormats, application.SamlNameIdFormat) {
+		return "不支持的 NameID 格式"
+	}
+	for name, field := range application.SamlAttributes {
+		if name == "" || !isSupportedValue(services.SupportedSamlUserFields, field) {
+			return "不支持的 SAML 属性映射：" + name
+		}
+	}
+	return ""
+}
+
+func isHttpUrl(value string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+func isSupportedValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
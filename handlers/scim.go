@@ -0,0 +1,735 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/oauth-server/oauth-server/models"
+	"github.com/oauth-server/oauth-server/services"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+const scimContentType = "application/scim+json; charset=utf-8"
+
+// scimJson 以 application/scim+json 返回 SCIM 响应
+func scimJson(ctx *fiber.Ctx, status int, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return scimError(ctx, err)
+	}
+	ctx.Set(fiber.HeaderContentType, scimContentType)
+	return ctx.Status(status).Send(data)
+}
+
+// scimError 返回 SCIM 错误响应，非 SCIM 错误按服务器内部错误处理
+func scimError(ctx *fiber.Ctx, err error) error {
+	var scimErr *services.ScimError
+	if errors.As(err, &scimErr) {
+		return scimJson(ctx, scimErr.Status, types.NewScimErrorResponse(scimErr.Status, scimErr.ScimType, scimErr.Detail))
+	}
+	log.Printf("[SCIM] Request failed: %v", err)
+	return scimJson(ctx, fiber.StatusInternalServerError, types.NewScimErrorResponse(fiber.StatusInternalServerError, "", "internal server error"))
+}
+
+func scimNotFound(ctx *fiber.Ctx, resourceType, id string) error {
+	return scimError(ctx, services.NewScimError(fiber.StatusNotFound, "", "%s %s not found", resourceType, id))
+}
+
+// scimResource 返回单个资源，并通过 ETag 头返回版本
+func scimResource(ctx *fiber.Ctx, status int, resource map[string]interface{}) error {
+	ctx.Set(fiber.HeaderETag, services.ScimVersion(resource))
+	if status == fiber.StatusCreated {
+		meta, _ := resource["meta"].(map[string]interface{})
+		if location, ok := meta["location"].(string); ok {
+			ctx.Set(fiber.HeaderLocation, location)
+		}
+	}
+	return scimJson(ctx, status, services.ProjectScimResource(resource, ctx.Query("attributes"), ctx.Query("excludedAttributes")))
+}
+
+// sameScimVersion 比较两个 ETag，忽略弱校验前缀 W/
+func sameScimVersion(a, b string) bool {
+	return strings.TrimPrefix(strings.TrimSpace(a), "W/") == strings.TrimPrefix(strings.TrimSpace(b), "W/")
+}
+
+// scimPreconditionFailed 检查 If-Match 请求头，资源已被修改时返回 true
+func scimPreconditionFailed(ctx *fiber.Ctx, resource map[string]interface{}) bool {
+	ifMatch := ctx.Get(fiber.HeaderIfMatch)
+	if ifMatch == "" || strings.TrimSpace(ifMatch) == "*" {
+		return false
+	}
+	for _, version := range strings.Split(ifMatch, ",") {
+		if sameScimVersion(version, services.ScimVersion(resource)) {
+			return false
+		}
+	}
+	return true
+}
+
+// scimNotModified 检查 If-None-Match 请求头，资源未修改时返回 true
+func scimNotModified(ctx *fiber.Ctx, resource map[string]interface{}) bool {
+	for _, version := range strings.Split(ctx.Get(fiber.HeaderIfNoneMatch), ",") {
+		if strings.TrimSpace(version) == "*" || sameScimVersion(version, services.ScimVersion(resource)) {
+			return true
+		}
+	}
+	return false
+}
+
+func scimPreconditionError(ctx *fiber.Ctx) error {
+	return scimError(ctx, services.NewScimError(fiber.StatusPreconditionFailed, "", "the resource has been modified"))
+}
+
+// scimBody 解析 SCIM 请求体（Content-Type 为 application/scim+json，BodyParser 不支持）
+func scimBody(ctx *fiber.Ctx, body interface{}) error {
+	if err := json.Unmarshal(ctx.Body(), body); err != nil {
+		return services.NewScimError(fiber.StatusBadRequest, services.ScimTypeInvalidSyntax, "invalid JSON body")
+	}
+	return nil
+}
+
+// scimList 过滤并分页返回资源列表
+func scimList(ctx *fiber.Ctx, resources []map[string]interface{}) error {
+	matched, err := services.FilterScimResources(resources, ctx.Query("filter"))
+	if err != nil {
+		return scimError(ctx, err)
+	}
+
+	startIndex := ctx.QueryInt("startIndex", 1)
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	count := ctx.QueryInt("count", services.ScimDefaultCount)
+	if count > services.ScimMaxResults {
+		count = services.ScimMaxResults
+	}
+
+	page := services.PageScimResources(matched, startIndex, count)
+	for i, resource := range page {
+		page[i] = services.ProjectScimResource(resource, ctx.Query("attributes"), ctx.Query("excludedAttributes"))
+	}
+	return scimJson(ctx, fiber.StatusOK, types.ScimListResponse{
+		Schemas:      []string{types.ScimSchemaListResponse},
+		TotalResults: len(matched),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	})
+}
+
+// scimOrganization 获取 SCIM 令牌所属的组织
+func scimOrganization(ctx *fiber.Ctx) string {
+	organization, _ := ctx.Locals("scimOrganization").(string)
+	return organization
+}
+
+// scimPasswordType 获取令牌所属组织配置的密码哈希算法
+func scimPasswordType(ctx *fiber.Ctx) (string, error) {
+	organization, err := models.GetOrganization("admin", scimOrganization(ctx))
+	if err != nil {
+		return "", err
+	}
+	return services.OrganizationPasswordType(organization), nil
+}
+
+// scimDirectory 加载组织中未删除的用户（按 ID 排序，保证分页稳定）和全部用户组，另返回以 ID 为键的用户表
+func scimDirectory(organization string) (map[string]*models.User, []*models.User, []*models.Group, error) {
+	users, err := models.GetUsers(organization)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	groups, err := models.GetGroups(organization)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	active := []*models.User{}
+	byId := map[string]*models.User{}
+	for _, user := range users {
+		if !user.IsDeleted {
+			active = append(active, user)
+			byId[user.GetId()] = user
+		}
+	}
+	return byId, active, groups, nil
+}
+
+// scimUser 获取组织中未删除的用户，不存在时返回 nil
+func scimUser(organization, id string) (*models.User, error) {
+	userId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	user, err := models.GetUserById(userId)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	if user.Owner != organization || user.IsDeleted {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// checkScimUserUnique 检查 userName 在组织内唯一、邮箱全局唯一
+func checkScimUserUnique(user *models.User) error {
+	err := services.CheckUsernameAvailable(user.Owner, user.Username, user.Id)
+	if errors.Is(err, services.ErrUsernameTaken) {
+		return services.NewScimError(fiber.StatusConflict, services.ScimTypeUniqueness, "userName %q is already taken", user.Username)
+	}
+	if err != nil {
+		return err
+	}
+
+	if user.Email != "" {
+		existing, err := models.GetUserByEmail(user.Email)
+		if err != nil {
+			return err
+		}
+		if existing != nil && existing.Id != user.Id {
+			return services.NewScimError(fiber.StatusConflict, services.ScimTypeUniqueness, "email %q is already taken", user.Email)
+		}
+	}
+	return nil
+}
+
+// HandleScimServiceProviderConfig 返回 SCIM 服务能力说明
+func HandleScimServiceProviderConfig() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		return scimJson(ctx, fiber.StatusOK, services.ScimServiceProviderConfig())
+	}
+}
+
+// HandleScimSchemas 返回支持的资源 schema 列表，或按 :id 返回单个 schema
+func HandleScimSchemas() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		return scimDiscovery(ctx, services.ScimSchemas(), "Schema")
+	}
+}
+
+// HandleScimResourceTypes 返回支持的资源类型列表，或按 :id 返回单个资源类型
+func HandleScimResourceTypes() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		return scimDiscovery(ctx, services.ScimResourceTypes(), "ResourceType")
+	}
+}
+
+func scimDiscovery(ctx *fiber.Ctx, resources []map[string]interface{}, resourceType string) error {
+	id := ctx.Params("id")
+	if id == "" {
+		return scimJson(ctx, fiber.StatusOK, types.ScimListResponse{
+			Schemas:      []string{types.ScimSchemaListResponse},
+			TotalResults: len(resources),
+			StartIndex:   1,
+			ItemsPerPage: len(resources),
+			Resources:    resources,
+		})
+	}
+	for _, resource := range resources {
+		if resource["id"] == id {
+			return scimJson(ctx, fiber.StatusOK, resource)
+		}
+	}
+	return scimNotFound(ctx, resourceType, id)
+}
+
+// HandleScimGetUsers 查询组织中的用户，支持 filter、startIndex 和 count
+func HandleScimGetUsers() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		_, users, groups, err := scimDirectory(scimOrganization(ctx))
+		if err != nil {
+			return scimError(ctx, err)
+		}
+
+		resources := make([]map[string]interface{}, 0, len(users))
+		for _, user := range users {
+			resources = append(resources, services.ScimUserResource(user, groups))
+		}
+		return scimList(ctx, resources)
+	}
+}
+
+// HandleScimGetUser 获取单个用户，If-None-Match 与当前版本一致时返回 304
+func HandleScimGetUser() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		organization := scimOrganization(ctx)
+		user, err := scimUser(organization, ctx.Params("id"))
+		if err != nil {
+			return scimError(ctx, err)
+		}
+		if user == nil {
+			return scimNotFound(ctx, "User", ctx.Params("id"))
+		}
+		groups, err := models.GetGroups(organization)
+		if err != nil {
+			return scimError(ctx, err)
+		}
+
+		resource := services.ScimUserResource(user, groups)
+		if scimNotModified(ctx, resource) {
+			ctx.Set(fiber.HeaderETag, services.ScimVersion(resource))
+			return ctx.SendStatus(fiber.StatusNotModified)
+		}
+		return scimResource(ctx, fiber.StatusOK, resource)
+	}
+}
+
+// HandleScimCreateUser 在令牌所属组织中创建用户
+func HandleScimCreateUser() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		var body map[string]interface{}
+		if err := scimBody(ctx, &body); err != nil {
+			return scimError(ctx, err)
+		}
+
+		now := time.Now().Format(time.RFC3339)
+		user := &models.User{
+			Owner:       scimOrganization(ctx),
+			CreatedTime: now,
+			UpdatedTime: now,
+			Type:        "normal-user",
+		}
+		passwordType, err := scimPasswordType(ctx)
+		if err != nil {
+			return scimError(ctx, err)
+		}
+		if err := services.ApplyScimUser(user, body, passwordType); err != nil {
+			return scimError(ctx, err)
+		}
+		if err := checkScimUserUnique(user); err != nil {
+			return scimError(ctx, err)
+		}
+		if _, err := models.AddUser(user); err != nil {
+			return scimError(ctx, err)
+		}
+
+		return scimResource(ctx, fiber.StatusCreated, services.ScimUserResource(user, nil))
+	}
+}
+
+// saveScimUser 校验唯一性后保存用户，并返回新的资源表示；本次停用的账号会撤销所有令牌并登出所有会话
+func saveScimUser(ctx *fiber.Ctx, user *models.User, groups []*models.Group, wasForbidden bool) error {
+	if err := checkScimUserUnique(user); err != nil {
+		return scimError(ctx, err)
+	}
+	user.UpdatedTime = time.Now().Format(time.RFC3339)
+	if _, err := models.UpdateUser(user.Id, user); err != nil {
+		return scimError(ctx, err)
+	}
+	if user.IsForbidden && !wasForbidden {
+		if err := services.SignOutUser(user); err != nil {
+			return scimError(ctx, err)
+		}
+	}
+	return scimResource(ctx, fiber.StatusOK, services.ScimUserResource(user, groups))
+}
+
+// HandleScimReplaceUser 整体替换用户属性（PUT），active 为 false 时停用账号
+func HandleScimReplaceUser() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		organization := scimOrganization(ctx)
+		user, err := scimUser(organization, ctx.Params("id"))
+		if err != nil {
+			return scimError(ctx, err)
+		}
+		if user == nil {
+			return scimNotFound(ctx, "User", ctx.Params("id"))
+		}
+		groups, err := models.GetGroups(organization)
+		if err != nil {
+			return scimError(ctx, err)
+		}
+		if scimPreconditionFailed(ctx, services.ScimUserResource(user, groups)) {
+			return scimPreconditionError(ctx)
+		}
+
+		var body map[string]interface{}
+		if err := scimBody(ctx, &body); err != nil {
+			return scimError(ctx, err)
+		}
+		passwordType, err := scimPasswordType(ctx)
+		if err != nil {
+			return scimError(ctx, err)
+		}
+		wasForbidden := user.IsForbidden
+		if err := services.ApplyScimUser(user, body, passwordType); err != nil {
+			return scimError(ctx, err)
+		}
+		return saveScimUser(ctx, user, groups, wasForbidden)
+	}
+}
+
+// HandleScimPatchUser 按 PATCH 操作修改用户
+func HandleScimPatchUser() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		organization := scimOrganization(ctx)
+		user, err := scimUser(organization, ctx.Params("id"))
+		if err != nil {
+			return scimError(ctx, err)
+		}
+		if user == nil {
+			return scimNotFound(ctx, "User", ctx.Params("id"))
+		}
+		groups, err := models.GetGroups(organization)
+		if err != nil {
+			return scimError(ctx, err)
+		}
+
+		resource := services.ScimUserResource(user, groups)
+		if scimPreconditionFailed(ctx, resource) {
+			return scimPreconditionError(ctx)
+		}
+		if err := applyScimPatchRequest(ctx, resource); err != nil {
+			return scimError(ctx, err)
+		}
+		passwordType, err := scimPasswordType(ctx)
+		if err != nil {
+			return scimError(ctx, err)
+		}
+		wasForbidden := user.IsForbidden
+		if err := services.ApplyScimUser(user, resource, passwordType); err != nil {
+			return scimError(ctx, err)
+		}
+		return saveScimUser(ctx, user, groups, wasForbidden)
+	}
+}
+
+// applyScimPatchRequest 解析 PATCH 请求并依次应用到资源表示
+func applyScimPatchRequest(ctx *fiber.Ctx, resource map[string]interface{}) error {
+	var req types.ScimPatchRequest
+	if err := scimBody(ctx, &req); err != nil {
+		return err
+	}
+	if len(req.Operations) == 0 {
+		return services.NewScimError(fiber.StatusBadRequest, services.ScimTypeInvalidSyntax, "no operations")
+	}
+	for _, operation := range req.Operations {
+		if err := services.ApplyScimPatch(resource, operation.Op, operation.Path, operation.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleScimDeleteUser 删除用户：标记为已删除并停用，撤销所有令牌并登出所有会话，同时移出所有用户组
+func HandleScimDeleteUser() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		organization := scimOrganization(ctx)
+		user, err := scimUser(organization, ctx.Params("id"))
+		if err != nil {
+			return scimError(ctx, err)
+		}
+		if user == nil {
+			return scimNotFound(ctx, "User", ctx.Params("id"))
+		}
+		groups, err := models.GetGroups(organization)
+		if err != nil {
+			return scimError(ctx, err)
+		}
+		if scimPreconditionFailed(ctx, services.ScimUserResource(user, groups)) {
+			return scimPreconditionError(ctx)
+		}
+
+		user.IsDeleted = true
+		user.IsForbidden = true
+		user.UpdatedTime = time.Now().Format(time.RFC3339)
+		if _, err := models.UpdateUser(user.Id, user); err != nil {
+			return scimError(ctx, err)
+		}
+		if err := services.SignOutUser(user); err != nil {
+			return scimError(ctx, err)
+		}
+
+		for _, group := range groups {
+			if !group.HasMember(user.GetId()) {
+				continue
+			}
+			members := []string{}
+			for _, member := range group.Members {
+				if member != user.GetId() {
+					members = append(members, member)
+				}
+			}
+			group.Members = members
+			group.UpdatedTime = user.UpdatedTime
+			if _, err := models.UpdateGroup(group.Owner, group.Name, group); err != nil {
+				return scimError(ctx, err)
+			}
+		}
+
+		return ctx.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// HandleScimGetGroups 查询组织中的用户组，支持 filter、startIndex 和 count
+func HandleScimGetGroups() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		users, _, groups, err := scimDirectory(scimOrganization(ctx))
+		if err != nil {
+			return scimError(ctx, err)
+		}
+
+		resources := make([]map[string]interface{}, 0, len(groups))
+		for _, group := range groups {
+			resources = append(resources, services.ScimGroupResource(group, users))
+		}
+		return scimList(ctx, resources)
+	}
+}
+
+// scimGroup 加载组织的用户和指定用户组，用户组不存在时返回 nil
+func scimGroup(organization, id string) (*models.Group, map[string]*models.User, error) {
+	group, err := models.GetGroup(organization, id)
+	if err != nil || group == nil {
+		return nil, nil, err
+	}
+	users, _, _, err := scimDirectory(organization)
+	return group, users, err
+}
+
+// HandleScimGetGroup 获取单个用户组，If-None-Match 与当前版本一致时返回 304
+func HandleScimGetGroup() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		group, users, err := scimGroup(scimOrganization(ctx), ctx.Params("id"))
+		if err != nil {
+			return scimError(ctx, err)
+		}
+		if group == nil {
+			return scimNotFound(ctx, "Group", ctx.Params("id"))
+		}
+
+		resource := services.ScimGroupResource(group, users)
+		if scimNotModified(ctx, resource) {
+			ctx.Set(fiber.HeaderETag, services.ScimVersion(resource))
+			return ctx.SendStatus(fiber.StatusNotModified)
+		}
+		return scimResource(ctx, fiber.StatusOK, resource)
+	}
+}
+
+// HandleScimCreateGroup 在令牌所属组织中创建用户组，displayName 在组织内唯一
+func HandleScimCreateGroup() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		organization := scimOrganization(ctx)
+		var body map[string]interface{}
+		if err := scimBody(ctx, &body); err != nil {
+			return scimError(ctx, err)
+		}
+
+		users, _, groups, err := scimDirectory(organization)
+		if err != nil {
+			return scimError(ctx, err)
+		}
+
+		now := time.Now().Format(time.RFC3339)
+		group := &models.Group{
+			Owner:       organization,
+			Name:        uuid.NewString(),
+			CreatedTime: now,
+			UpdatedTime: now,
+		}
+		if err := services.ApplyScimGroup(group, body, users); err != nil {
+			return scimError(ctx, err)
+		}
+		if err := checkScimGroupUnique(group, groups); err != nil {
+			return scimError(ctx, err)
+		}
+		if _, err := models.AddGroup(group); err != nil {
+			return scimError(ctx, err)
+		}
+
+		return scimResource(ctx, fiber.StatusCreated, services.ScimGroupResource(group, users))
+	}
+}
+
+func checkScimGroupUnique(group *models.Group, groups []*models.Group) error {
+	for _, other := range groups {
+		if other.Name != group.Name && strings.EqualFold(other.DisplayName, group.DisplayName) {
+			return services.NewScimError(fiber.StatusConflict, services.ScimTypeUniqueness, "displayName %q is already taken", group.DisplayName)
+		}
+	}
+	return nil
+}
+
+// saveScimGroup 校验唯一性后保存用户组，并返回新的资源表示
+func saveScimGroup(ctx *fiber.Ctx, group *models.Group, users map[string]*models.User) error {
+	groups, err := models.GetGroups(group.Owner)
+	if err != nil {
+		return scimError(ctx, err)
+	}
+	if err := checkScimGroupUnique(group, groups); err != nil {
+		return scimError(ctx, err)
+	}
+	group.UpdatedTime = time.Now().Format(time.RFC3339)
+	if _, err := models.UpdateGroup(group.Owner, group.Name, group); err != nil {
+		return scimError(ctx, err)
+	}
+	return scimResource(ctx, fiber.StatusOK, services.ScimGroupResource(group, users))
+}
+
+// HandleScimReplaceGroup 整体替换用户组（PUT），包括成员列表
+func HandleScimReplaceGroup() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		group, users, err := scimGroup(scimOrganization(ctx), ctx.Params("id"))
+		if err != nil {
+			return scimError(ctx, err)
+		}
+		if group == nil {
+			return scimNotFound(ctx, "Group", ctx.Params("id"))
+		}
+		if scimPreconditionFailed(ctx, services.ScimGroupResource(group, users)) {
+			return scimPreconditionError(ctx)
+		}
+
+		var body map[string]interface{}
+		if err := scimBody(ctx, &body); err != nil {
+			return scimError(ctx, err)
+		}
+		if err := services.ApplyScimGroup(group, body, users); err != nil {
+			return scimError(ctx, err)
+		}
+		return saveScimGroup(ctx, group, users)
+	}
+}
+
+// HandleScimPatchGroup 按 PATCH 操作修改用户组，常用于增删成员
+func HandleScimPatchGroup() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		group, users, err := scimGroup(scimOrganization(ctx), ctx.Params("id"))
+		if err != nil {
+			return scimError(ctx, err)
+		}
+		if group == nil {
+			return scimNotFound(ctx, "Group", ctx.Params("id"))
+		}
+
+		resource := services.ScimGroupResource(group, users)
+		if scimPreconditionFailed(ctx, resource) {
+			return scimPreconditionError(ctx)
+		}
+		if err := applyScimPatchRequest(ctx, resource); err != nil {
+			return scimError(ctx, err)
+		}
+		if err := services.ApplyScimGroup(group, resource, users); err != nil {
+			return scimError(ctx, err)
+		}
+		return saveScimGroup(ctx, group, users)
+	}
+}
+
+// HandleScimDeleteGroup 删除用户组，不影响成员账号
+func HandleScimDeleteGroup() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		group, users, err := scimGroup(scimOrganization(ctx), ctx.Params("id"))
+		if err != nil {
+			return scimError(ctx, err)
+		}
+		if group == nil {
+			return scimNotFound(ctx, "Group", ctx.Params("id"))
+		}
+		if scimPreconditionFailed(ctx, services.ScimGroupResource(group, users)) {
+			return scimPreconditionError(ctx)
+		}
+
+		if _, err := models.DeleteGroup(group.Owner, group.Name); err != nil {
+			return scimError(ctx, err)
+		}
+		return ctx.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// HandleGetScimTokens 获取 SCIM 令牌列表（需要管理员权限）
+func HandleGetScimTokens() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		tokens, err := models.GetScimTokens(ctx.Query("owner", ""))
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取 SCIM 令牌列表失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(tokens))
+	}
+}
+
+// HandleCreateScimToken 为组织创建 SCIM 令牌（需要管理员权限）
+// 令牌明文只在创建时返回一次
+func HandleCreateScimToken() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		var req types.CreateScimTokenRequest
+		if err := ctx.BodyParser(&req); err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		if req.Organization == "" {
+			req.Organization = "built-in"
+		}
+		if req.ExpiresInHours < 0 {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("expiresInHours 不能为负数"))
+		}
+
+		organization, err := models.GetOrganization("admin", req.Organization)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取组织信息失败"))
+		}
+		if organization == nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("组织不存在"))
+		}
+
+		plainToken := models.GenerateClientSecret()
+		token := &models.ScimToken{
+			Owner:        "admin",
+			Name:         models.GenerateClientId(),
+			CreatedTime:  models.GetCurrentTime(),
+			Organization: organization.Name,
+			Description:  req.Description,
+		}
+		if req.ExpiresInHours > 0 {
+			token.ExpiresAt = time.Now().Add(time.Duration(req.ExpiresInHours * float64(time.Hour))).Unix()
+		}
+		token.SetToken(plainToken)
+
+		if _, err := models.AddScimToken(token); err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("创建 SCIM 令牌失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"token":     token,
+			"scimToken": plainToken,
+			"baseUrl":   services.ScimUrl(""),
+		}))
+	}
+}
+
+// HandleRevokeScimToken 撤销 SCIM 令牌（需要管理员权限）
+func HandleRevokeScimToken() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		owner := ctx.Params("owner")
+		name := ctx.Params("name")
+
+		token, err := models.GetScimToken(owner, name)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取 SCIM 令牌失败"))
+		}
+		if token == nil {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("SCIM 令牌不存在"))
+		}
+
+		token.IsRevoked = true
+		if _, err := models.UpdateScimToken(owner, name, token); err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("撤销 SCIM 令牌失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]string{
+			"message": "SCIM 令牌已撤销",
+		}))
+	}
+}
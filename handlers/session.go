@@ -0,0 +1,152 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package handlers
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oauth-server/oauth-server/models"
+	"github.com/oauth-server/oauth-server/services"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+// HandleGetSessions 获取当前用户已登录的设备列表，以及每个会话中登录过的应用
+func HandleGetSessions() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		sessions, err := services.GetUserSessions(user)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取登录设备失败"))
+		}
+
+		currentSession, _ := ctx.Locals("sessionID").(string)
+		applications := map[string]map[string]interface{}{}
+		sessionList := make([]map[string]interface{}, 0, len(sessions))
+		for _, session := range sessions {
+			appList := make([]map[string]interface{}, 0, len(session.Applications))
+			for _, appId := range session.Applications {
+				appInfo, exists := applications[appId]
+				if !exists {
+					owner, name, _ := strings.Cut(appId, "/")
+					appInfo = map[string]interface{}{
+						"owner":       owner,
+						"name":        name,
+						"displayName": name,
+						"logo":        "",
+					}
+					app, _ := models.GetApplication(owner, name)
+					if app != nil {
+						if app.DisplayName != "" {
+							appInfo["displayName"] = app.DisplayName
+						}
+						appInfo["logo"] = app.Logo
+					}
+					applications[appId] = appInfo
+				}
+				appList = append(appList, appInfo)
+			}
+
+			sessionList = append(sessionList, map[string]interface{}{
+				"name":         session.Name,
+				"device":       session.Device,
+				"userAgent":    session.UserAgent,
+				"ip":           session.Ip,
+				"createdTime":  session.CreatedTime,
+				"lastSeenTime": session.LastSeenTime,
+				"applications": appList,
+				"current":      session.Name == currentSession,
+			})
+		}
+
+		return ctx.JSON(types.SuccessResponse(sessionList))
+	}
+}
+
+// HandleRevokeSession 登出当前用户的一个会话，同时撤销通过该会话签发的令牌
+func HandleRevokeSession() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		name := ctx.Params("name")
+		if err := services.SignOutSession(user, name); err != nil {
+			if errors.Is(err, services.ErrSessionNotFound) {
+				return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("会话不存在"))
+			}
+			log.Printf("[Session] Failed to sign out session %s/%s: %v", user.Owner, name, err)
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("登出会话失败"))
+		}
+
+		currentSession, _ := ctx.Locals("sessionID").(string)
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"message": "已登出",
+			"current": name == currentSession,
+		}))
+	}
+}
+
+// HandleRevokeAllSessions 退出当前用户的所有设备，exceptCurrent 为 true 时保留当前会话
+func HandleRevokeAllSessions() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		var req types.RevokeAllSessionsRequest
+		if len(ctx.Body()) > 0 {
+			if err := ctx.BodyParser(&req); err != nil {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+			}
+		}
+
+		keep := ""
+		if req.ExceptCurrent {
+			keep, _ = ctx.Locals("sessionID").(string)
+		}
+
+		count, err := services.SignOutAllSessions(user, keep)
+		if err != nil {
+			log.Printf("[Session] Failed to sign out sessions of user %d: %v", user.Id, err)
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("退出所有设备失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"message": "已退出所有设备",
+			"count":   count,
+		}))
+	}
+}
+
+// HandleLogout 退出登录，登出当前会话并撤销通过该会话签发的令牌
+func HandleLogout() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		// 旧版控制台令牌没有会话，由前端清除令牌即可
+		sessionID, _ := ctx.Locals("sessionID").(string)
+		if sessionID != "" {
+			if err := services.SignOutSession(user, sessionID); err != nil && !errors.Is(err, services.ErrSessionNotFound) {
+				log.Printf("[Session] Failed to sign out session %s/%s: %v", user.Owner, sessionID, err)
+				return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("退出登录失败"))
+			}
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"message": "已退出登录",
+		}))
+	}
+}
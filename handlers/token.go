@@ -45,6 +45,9 @@ func HandleToken() fiber.Handler {
 				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("refresh_token 不能为空"))
 			}
 		case "password":
+			if req.Username == "" {
+				req.Username = req.Identifier
+			}
 			if req.Username == "" || req.Password == "" || req.ClientId == "" {
 				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("username、password 和 client_id 不能为空"))
 			}
@@ -52,6 +55,24 @@ func HandleToken() fiber.Handler {
 			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("不支持的 grant_type"))
 		}
 
+		// 密码模式没有人机验证步骤，仅执行账户锁定和 IP 限流
+		// 已存在的用户按用户 ID 计数，与控制台登录共用同一失败次数
+		account := ""
+		if req.GrantType == "password" {
+			var err error
+			account, err = services.PasswordGrantThrottleAccount(req.ClientId, req.Username)
+			if err != nil {
+				return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("检查登录限制失败"))
+			}
+			decision, err := services.CheckLoginAttempt(services.ThrottleScopePassword, account, ctx.IP())
+			if err != nil {
+				return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("检查登录限制失败"))
+			}
+			if !decision.Allowed() {
+				return tooManyAttemptsResponse(ctx, decision.Reason, decision.RetryAfter)
+			}
+		}
+
 		// 调用 OAuth 服务获取 token
 		result, err := services.GetOAuthToken(
 			req.GrantType,
@@ -72,6 +93,9 @@ func HandleToken() fiber.Handler {
 
 		// 检查是否返回了 TokenError
 		if tokenError, ok := result.(*services.TokenError); ok {
+			if req.GrantType == "password" && tokenError.ErrorDescription == services.InvalidCredentialsDescription {
+				recordBruteForceFailure(ctx, services.ThrottleScopePassword, account)
+			}
 			// 根据错误类型返回适当的 HTTP 状态码
 			statusCode := fiber.StatusBadRequest
 			switch tokenError.Error {
@@ -91,6 +115,10 @@ func HandleToken() fiber.Handler {
 			})
 		}
 
+		if req.GrantType == "password" {
+			recordBruteForceSuccess(services.ThrottleScopePassword, account)
+		}
+
 		// 返回成功的 TokenResponse
 		return ctx.JSON(result)
 	}
@@ -108,7 +136,7 @@ func HandleIntrospect() fiber.Handler {
 		}
 
 		// 解析和验证 token
-		claims, err := services.ParseJwtToken(token)
+		claims, err := services.ParseGrantJwtToken(token)
 		if err != nil {
 			// Token 无效，返回 active: false
 			return ctx.JSON(map[string]interface{}{
@@ -116,6 +144,17 @@ func HandleIntrospect() fiber.Handler {
 			})
 		}
 
+		// 已撤销（包括登出签发该令牌的会话）或已删除的 token 同样无效
+		revoked, err := services.IsGrantTokenRevoked(token, claims.TokenUse)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("查询令牌失败"))
+		}
+		if revoked {
+			return ctx.JSON(map[string]interface{}{
+				"active": false,
+			})
+		}
+
 		// 返回 token 元数据
 		return ctx.JSON(map[string]interface{}{
 			"active":     true,
@@ -145,7 +184,7 @@ func HandleRevoke() fiber.Handler {
 		tokenTypeHint := ctx.FormValue("token_type_hint")
 
 		// 解析 token 以获取信息
-		claims, err := services.ParseJwtToken(token)
+		claims, err := services.ParseGrantJwtToken(token)
 		if err != nil {
 			// RFC 7009: 即使 token 无效也返回成功
 			return ctx.JSON(types.SuccessResponse(map[string]interface{}{
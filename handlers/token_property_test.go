@@ -5,6 +5,7 @@ package handlers
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,6 +22,7 @@ import (
 // Property 12: 访问令牌过期
 // Property 13: 刷新令牌过期
 // Property 14: 令牌撤销生效
+// Property 15: 令牌仅以哈希形式存储
 
 // Property 8: OAuth 授权码唯一性
 // 验证授权码只能被成功使用一次
@@ -97,6 +99,78 @@ func TestProperty_OAuthAuthorizationCodeUniqueness(t *testing.T) {
 	properties.TestingRun(t)
 }
 
+// Property 8: OAuth 授权码唯一性（并发兑换）
+// 验证并发兑换授权码时只有一个请求成功，重放授权码会撤销由其签发的全部令牌
+// **Validates: Requirement 5.5**
+func TestProperty_OAuthAuthorizationCodeConcurrentRedemption(t *testing.T) {
+	if err := models.InitDB(); err != nil {
+		t.Skip("Database not available for property testing")
+	}
+
+	parameters := gopter.DefaultTestParameters()
+	parameters.MinSuccessfulTests = 10
+	properties := gopter.NewProperties(parameters)
+
+	properties.Property("Concurrent redemptions succeed exactly once and replay revokes the family", prop.ForAll(
+		func(code string, workers int) bool {
+			if code == "" {
+				return true
+			}
+
+			family := "family-" + code
+			token := &models.Token{
+				Owner:        "test-owner",
+				Name:         fmt.Sprintf("test-redeem-%s", code),
+				Code:         code,
+				AccessToken:  "test-access-token-" + code,
+				CodeIsUsed:   false,
+				CodeExpireIn: time.Now().Add(10 * time.Minute).Unix(),
+				ExpiresIn:    3600,
+				TokenType:    "Bearer",
+				TokenFamily:  family,
+			}
+			if _, err := models.AddToken(token); err != nil {
+				return true
+			}
+			defer models.DeleteToken(token.Owner, token.Name)
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			redeemed := 0
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ok, err := models.RedeemTokenCode(code)
+					if err == nil && ok {
+						mu.Lock()
+						redeemed++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if redeemed != 1 {
+				return false
+			}
+
+			// 重放授权码
+			application := &models.Application{Name: "test-app"}
+			_, tokenError, err := services.GetAuthorizationCodeToken(application, "", code, "", "")
+			if err != nil || tokenError == nil || tokenError.Error != services.InvalidGrant {
+				return false
+			}
+
+			revoked, err := models.GetToken(token.Owner, token.Name)
+			return err == nil && revoked != nil && revoked.IsRevoked()
+		},
+		gen.AlphaString().SuchThat(func(s string) bool { return len(s) > 5 }),
+		gen.IntRange(2, 8),
+	))
+
+	properties.TestingRun(t)
+}
+
 // Property 9: OAuth 授权码过期
 // 验证授权码在 10 分钟后过期
 // **Validates: Requirement 5.6**
@@ -366,6 +440,55 @@ func TestProperty_TokenRevocationEffective(t *testing.T) {
 	properties.TestingRun(t)
 }
 
+// Property 15: 令牌仅以哈希形式存储
+// 验证数据库中不保存令牌明文，且仍可通过哈希查找
+// **Validates: Requirement 6.4**
+func TestProperty_TokenStoredByHashOnly(t *testing.T) {
+	if err := models.InitDB(); err != nil {
+		t.Skip("Database not available for property testing")
+	}
+
+	parameters := gopter.DefaultTestParameters()
+	parameters.MinSuccessfulTests = 20
+	properties := gopter.NewProperties(parameters)
+
+	properties.Property("Stored token has no plaintext and is found by hash", prop.ForAll(
+		func(tokenStr string) bool {
+			if tokenStr == "" {
+				return true
+			}
+
+			token := &models.Token{
+				Owner:        "test-owner",
+				Name:         fmt.Sprintf("test-hashed-%s", tokenStr),
+				AccessToken:  "test-access-hashed-" + tokenStr,
+				RefreshToken: "test-refresh-hashed-" + tokenStr,
+				ExpiresIn:    3600,
+				TokenType:    "Bearer",
+			}
+			if _, err := models.AddToken(token); err != nil {
+				return true
+			}
+			defer models.DeleteToken(token.Owner, token.Name)
+
+			stored, err := models.GetTokenByAccessToken(token.AccessToken)
+			if err != nil || stored == nil {
+				return false
+			}
+			byRefresh, err := models.GetTokenByRefreshToken(token.RefreshToken)
+			if err != nil || byRefresh == nil || byRefresh.Name != token.Name {
+				return false
+			}
+
+			return stored.AccessToken == "" && stored.RefreshToken == "" &&
+				stored.MaskedAccessToken() != "" && stored.MaskedAccessToken() != stored.AccessTokenHash
+		},
+		gen.AlphaString().SuchThat(func(s string) bool { return len(s) > 5 }),
+	))
+
+	properties.TestingRun(t)
+}
+
 // Property: 令牌过期时间一致性
 // 验证 ExpiresAt 时间戳与 ExpiresIn 秒数一致
 func TestProperty_TokenExpirationConsistency(t *testing.T) {
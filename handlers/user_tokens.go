@@ -85,6 +85,7 @@ func HandleGetUserTokens() fiber.Handler {
 
 			tokenList = append(tokenList, map[string]interface{}{
 				"name":            token.Name,
+				"accessToken":     token.MaskedAccessToken(),
 				"createdTime":     token.CreatedTime,
 				"application":     token.Application,
 				"applicationName": appDisplayName,
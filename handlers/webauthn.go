@@ -0,0 +1,186 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package handlers
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oauth-server/oauth-server/models"
+	"github.com/oauth-server/oauth-server/services"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+// webauthnErrorMessage 将 WebAuthn 错误转换为提示信息
+func webauthnErrorMessage(err error) string {
+	switch err {
+	case services.ErrWebauthnSessionInvalid:
+		return "通行密钥验证已过期，请重试"
+	case services.ErrWebauthnCredentialInvalid:
+		return "通行密钥验证失败"
+	case services.ErrWebauthnCredentialExists:
+		return "该通行密钥已注册"
+	case services.ErrWebauthnCredentialUnknown:
+		return "通行密钥未注册"
+	case services.ErrWebauthnCounterRegressed:
+		return "通行密钥签名计数异常，可能已被复制，请联系管理员"
+	case services.ErrMfaTicketInvalid, services.ErrMfaTicketUsedUp:
+		return mfaErrorMessage(err)
+	default:
+		return "通行密钥验证失败"
+	}
+}
+
+// HandleWebauthnRegisterBegin 开始注册通行密钥，返回 navigator.credentials.create() 的参数
+func HandleWebauthnRegisterBegin() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		sessionId, options, err := services.BeginWebauthnRegistration(user)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("创建通行密钥注册请求失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"sessionId": sessionId,
+			"publicKey": options,
+		}))
+	}
+}
+
+// HandleWebauthnRegisterFinish 校验认证器返回的注册结果并保存通行密钥
+func HandleWebauthnRegisterFinish() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		var req services.WebauthnRegistrationRequest
+		if err := ctx.BodyParser(&req); err != nil || req.SessionId == "" {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		credential, err := services.FinishWebauthnRegistration(user, &req)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse(webauthnErrorMessage(err)))
+		}
+
+		return ctx.JSON(types.SuccessResponse(credential))
+	}
+}
+
+// HandleWebauthnLoginBegin 开始通行密钥登录
+// 不带参数时使用可发现凭据无密码登录；带 email 时限定该用户的凭据；带 mfaTicket 时作为密码之后的第二步验证
+func HandleWebauthnLoginBegin() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		var req services.WebauthnLoginRequest
+		if len(ctx.Body()) > 0 {
+			if err := ctx.BodyParser(&req); err != nil {
+				return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+			}
+		}
+
+		var sessionId string
+		var options *services.PublicKeyCredentialRequestOptions
+		var err error
+		if req.MfaTicket != "" {
+			sessionId, options, err = services.BeginWebauthnMfaLogin(req.MfaTicket)
+			if err == services.ErrMfaTicketInvalid || err == services.ErrMfaTicketUsedUp {
+				return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse(mfaErrorMessage(err)))
+			}
+		} else {
+			// 邮箱不存在时按可发现凭据处理，不暴露账号是否存在
+			var user *models.User
+			if email := strings.TrimSpace(req.Email); email != "" {
+				user, err = models.GetUserByEmail(email)
+				if err != nil {
+					return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取用户信息失败"))
+				}
+				if user != nil && user.IsDeleted {
+					user = nil
+				}
+			}
+			sessionId, options, err = services.BeginWebauthnLogin(user)
+		}
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("创建通行密钥登录请求失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"sessionId": sessionId,
+			"publicKey": options,
+		}))
+	}
+}
+
+// HandleWebauthnLoginFinish 校验通行密钥签名并签发令牌
+func HandleWebauthnLoginFinish() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		var req services.WebauthnLoginRequest
+		if err := ctx.BodyParser(&req); err != nil || req.SessionId == "" || req.Credential == nil {
+			return ctx.Status(fiber.StatusBadRequest).JSON(types.ErrorResponse("无效的请求数据"))
+		}
+
+		user, amr, err := services.FinishWebauthnLogin(&req)
+		if err != nil {
+			return ctx.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse(webauthnErrorMessage(err)))
+		}
+
+		// 通行密钥作为密码后的第二步验证时，整个登录完成才清除密码失败计数
+		if slices.Contains(amr, services.AmrPassword) {
+			recordBruteForceSuccess(services.ThrottleScopePassword, services.UserThrottleAccount(user.GetId()))
+		}
+
+		return issueLoginTokens(ctx, user, amr)
+	}
+}
+
+// HandleGetWebauthnCredentials 获取当前用户的通行密钥列表
+func HandleGetWebauthnCredentials() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		credentials, err := models.GetUserWebauthnCredentials(user.Id)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取通行密钥失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(credentials))
+	}
+}
+
+// HandleRevokeWebauthnCredential 删除当前用户的一个通行密钥
+func HandleRevokeWebauthnCredential() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := currentMfaUser(ctx)
+		if user == nil {
+			return err
+		}
+
+		name := ctx.Params("name")
+		credential, err := models.GetWebauthnCredential(user.Owner, name)
+		if err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("获取通行密钥失败"))
+		}
+		if credential == nil || credential.UserId != user.Id {
+			return ctx.Status(fiber.StatusNotFound).JSON(types.ErrorResponse("通行密钥不存在"))
+		}
+
+		if _, err := models.DeleteWebauthnCredential(credential.Owner, credential.Name); err != nil {
+			return ctx.Status(fiber.StatusInternalServerError).JSON(types.ErrorResponse("删除通行密钥失败"))
+		}
+
+		return ctx.JSON(types.SuccessResponse(map[string]interface{}{
+			"message": "通行密钥已删除",
+		}))
+	}
+}
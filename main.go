@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -71,6 +72,12 @@ func main() {
 		return
 	}
 
+	// 启动 LDAP 目录定时同步
+	services.StartLdapSync()
+
+	// 启动注销账号的定时清除
+	services.StartAccountPurge()
+
 	// 步骤 4: 创建 Fiber 应用实例
 	app := fiber.New(fiber.Config{
 		// 服务器配置
@@ -78,6 +85,12 @@ func main() {
 		WriteTimeout: getEnvDuration("WRITE_TIMEOUT", 10*time.Second),
 		BodyLimit:    getEnvInt("BODY_LIMIT", 4*1024*1024), // 4MB
 
+		// 反向代理后从指定请求头读取客户端 IP，登录限流和账户锁定依赖真实 IP
+		// 配置 TRUSTED_PROXIES 时只信任来自这些代理的请求头
+		ProxyHeader:             os.Getenv("PROXY_HEADER"),
+		EnableTrustedProxyCheck: os.Getenv("TRUSTED_PROXIES") != "",
+		TrustedProxies:          splitEnvList("TRUSTED_PROXIES"),
+
 		// 自定义错误处理器
 		ErrorHandler: customErrorHandler,
 
@@ -172,6 +185,17 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// splitEnvList 读取逗号分隔的环境变量，忽略空项
+func splitEnvList(key string) []string {
+	values := []string{}
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
 // getEnvInt 获取整数类型的环境变量
 func getEnvInt(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
@@ -15,39 +15,77 @@ import (
 // 验证 Authorization 头中的 Bearer token，并将用户信息存储到 ctx.Locals
 func JWTAuthMiddleware() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		// 提取 Authorization 头
-		authHeader := c.Get("Authorization")
-		if authHeader == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse("缺少认证令牌"))
+		claims, status, msg := authenticateJWT(c)
+		if claims == nil {
+			return c.Status(status).JSON(types.ErrorResponse(msg))
 		}
 
-		// 解析 Bearer token
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			return c.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse("无效的认证格式"))
-		}
+		// 存储用户信息到上下文
+		setAuthLocals(c, claims)
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+		// 继续处理请求
+		return c.Next()
+	}
+}
 
-		// 验证 JWT 并获取用户信息
-		claims, err := services.ParseJwtToken(tokenString)
-		if err != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(types.ErrorResponse("令牌验证失败"))
+// OptionalJWTAuthMiddleware 返回一个可选的 JWT 认证中间件
+// 令牌有效时与 JWTAuthMiddleware 一样存储用户信息，没有令牌或令牌无效时不拒绝请求，也不设置用户信息
+func OptionalJWTAuthMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if claims, _, _ := authenticateJWT(c); claims != nil {
+			setAuthLocals(c, claims)
 		}
+		return c.Next()
+	}
+}
 
-		// 检查令牌是否过期（ParseJwtToken 已经验证了过期时间）
-		// 这里不需要额外检查，因为 jwt.Parse 会自动验证 exp claim
+// authenticateJWT 验证 Authorization 头中的 Bearer token，失败时返回 nil 及应返回的状态码和错误信息
+func authenticateJWT(c *fiber.Ctx) (*services.Claims, int, string) {
+	// 提取 Authorization 头
+	authHeader := c.Get("Authorization")
+	if authHeader == "" {
+		return nil, fiber.StatusUnauthorized, "缺少认证令牌"
+	}
 
-		// 存储用户信息到上下文
-		c.Locals("userID", claims.Id)
-		c.Locals("email", claims.Email)
-		c.Locals("username", claims.Username)
-		c.Locals("isAdmin", claims.IsAdmin)
-		c.Locals("isRealName", claims.IsRealName)
-		c.Locals("owner", claims.Owner)
+	// 解析 Bearer token
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return nil, fiber.StatusUnauthorized, "无效的认证格式"
+	}
 
-		// 继续处理请求
-		return c.Next()
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+
+	// 验证 JWT 并获取用户信息
+	claims, err := services.ParseJwtToken(tokenString)
+	if err != nil {
+		return nil, fiber.StatusUnauthorized, "令牌验证失败"
+	}
+
+	// 检查令牌是否过期（ParseJwtToken 已经验证了过期时间）
+	// 这里不需要额外检查，因为 jwt.Parse 会自动验证 exp claim
+
+	// 控制台令牌带有会话 ID（sid），会话登出后令牌随即失效
+	if claims.SessionId != "" {
+		active, err := services.CheckSession(claims.Owner, claims.SessionId, c.IP())
+		if err != nil {
+			return nil, fiber.StatusInternalServerError, "检查会话失败"
+		}
+		if !active {
+			return nil, fiber.StatusUnauthorized, "会话已登出"
+		}
 	}
+	return claims, 0, ""
+}
+
+// setAuthLocals 将令牌中的用户信息存储到上下文
+func setAuthLocals(c *fiber.Ctx, claims *services.Claims) {
+	c.Locals("userID", claims.Id)
+	c.Locals("email", claims.Email)
+	c.Locals("username", claims.Username)
+	c.Locals("isAdmin", claims.IsAdmin)
+	c.Locals("isRealName", claims.IsRealName)
+	c.Locals("owner", claims.Owner)
+	c.Locals("amr", claims.Amr)
+	c.Locals("sessionID", claims.SessionId)
 }
 
 // AdminAuthMiddleware 返回一个管理员权限验证中间件
@@ -79,3 +117,28 @@ func RealNameAuthMiddleware() fiber.Handler {
 		return c.Next()
 	}
 }
+
+// ScimAuthMiddleware 返回一个 SCIM 令牌认证中间件
+// 验证 Authorization 头中的 SCIM 令牌，并将令牌所属组织存储到 ctx.Locals("scimOrganization")
+// 错误按 SCIM 格式返回
+func ScimAuthMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tokenString, ok := strings.CutPrefix(c.Get("Authorization"), "Bearer ")
+		if !ok || tokenString == "" {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="scim"`)
+			return c.Status(fiber.StatusUnauthorized).JSON(types.NewScimErrorResponse(fiber.StatusUnauthorized, "", "missing bearer token"))
+		}
+
+		organization, err := services.AuthenticateScimToken(tokenString)
+		if err == services.ErrScimTokenInvalid {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="scim", error="invalid_token"`)
+			return c.Status(fiber.StatusUnauthorized).JSON(types.NewScimErrorResponse(fiber.StatusUnauthorized, "", err.Error()))
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(types.NewScimErrorResponse(fiber.StatusInternalServerError, "", "failed to check the token"))
+		}
+
+		c.Locals("scimOrganization", organization)
+		return c.Next()
+	}
+}
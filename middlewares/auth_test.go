@@ -12,6 +12,7 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/oauth-server/oauth-server/models"
 	"github.com/oauth-server/oauth-server/services"
 	"github.com/oauth-server/oauth-server/types"
 )
@@ -35,6 +36,7 @@ func generateTestToken(userID string, email string, isAdmin bool, isRealName boo
 		Email:      email,
 		IsRealName: isRealName,
 		IsAdmin:    isAdmin,
+		TokenUse:   "access",
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expireTime),
 			IssuedAt:  jwt.NewNumericDate(now),
@@ -227,6 +229,68 @@ func TestJWTAuthMiddleware_InvalidToken(t *testing.T) {
 	}
 }
 
+func TestJWTAuthMiddleware_IDToken(t *testing.T) {
+	app := fiber.New()
+	app.Use(JWTAuthMiddleware())
+	app.Get("/protected", func(c *fiber.Ctx) error {
+		return c.SendString("OK")
+	})
+
+	// ID Token 与访问令牌使用相同的密钥签名，但不能作为访问令牌使用
+	user := &models.User{Id: 123, Owner: "test-owner", Username: "testuser", IsAdmin: true}
+	application := &models.Application{ClientId: "test-client-id", ExpireInHours: 1}
+	idToken, err := services.GenerateIDToken(application, user, "", nil, "", nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ID token: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/protected", nil)
+	req.Header.Set("Authorization", "Bearer "+idToken)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 401 {
+		t.Errorf("Expected status 401, got %d", resp.StatusCode)
+	}
+}
+
+// TestOptionalJWTAuthMiddleware 测试可选认证在没有或携带无效令牌时放行请求但不设置用户信息
+func TestOptionalJWTAuthMiddleware(t *testing.T) {
+	app := fiber.New()
+	app.Use(OptionalJWTAuthMiddleware())
+	app.Get("/optional", func(c *fiber.Ctx) error {
+		userID, _ := c.Locals("userID").(string)
+		return c.SendString(userID)
+	})
+
+	for _, tt := range []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{"No token", "", ""},
+		{"Invalid token", "Bearer invalid.token.here", ""},
+		{"Valid token", "Bearer " + generateTestToken("123", "test@example.com", false, false, false), "123"},
+	} {
+		req := httptest.NewRequest("GET", "/optional", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("%s: failed to send request: %v", tt.name, err)
+		}
+		body := make([]byte, 16)
+		n, _ := resp.Body.Read(body)
+		if resp.StatusCode != fiber.StatusOK || string(body[:n]) != tt.expected {
+			t.Errorf("%s: expected 200 with user %q, got %d with %q", tt.name, tt.expected, resp.StatusCode, body[:n])
+		}
+	}
+}
+
 func TestAdminAuthMiddleware_AdminUser(t *testing.T) {
 	// 创建 Fiber 应用
 	app := fiber.New()
@@ -449,3 +513,40 @@ func TestMiddlewareChain(t *testing.T) {
 		})
 	}
 }
+
+func TestScimAuthMiddleware_MissingToken(t *testing.T) {
+	app := fiber.New()
+	app.Use(ScimAuthMiddleware())
+	app.Get("/scim/v2/Users", func(c *fiber.Ctx) error {
+		return c.SendString("OK")
+	})
+
+	for _, header := range []string{"", "Basic dXNlcjpwYXNz", "Bearer "} {
+		req := httptest.NewRequest("GET", "/scim/v2/Users", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		// 缺少令牌时不查询数据库，直接返回 SCIM 格式的 401
+		if resp.StatusCode != 401 {
+			t.Errorf("%q: expected status 401, got %d", header, resp.StatusCode)
+		}
+		if resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%q: expected a WWW-Authenticate header", header)
+		}
+
+		var scimResp types.ScimErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&scimResp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if scimResp.Status != "401" || len(scimResp.Schemas) != 1 || scimResp.Schemas[0] != types.ScimSchemaError {
+			t.Errorf("%q: unexpected response %+v", header, scimResp)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package middlewares
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/oauth-server/oauth-server/services"
+	"github.com/oauth-server/oauth-server/types"
+)
+
+// 限流计数的维度
+const (
+	RateLimitByIP     = "ip"        // 客户端 IP
+	RateLimitByUser   = "user"      // 登录用户，需在 JWTAuthMiddleware 之后使用，未登录时按 IP
+	RateLimitByClient = "client_id" // 通过 client_secret 认证的 OAuth 客户端，未认证时按 IP
+	RateLimitByRoute  = "route"     // 路由模板，所有客户端共享同一额度
+)
+
+// RateLimitPolicy 令牌桶限流策略
+// 每个键的桶容量为 Limit，每个 Period 匀速补满，允许短时突发但限制平均速率
+type RateLimitPolicy struct {
+	Name   string        // 策略名称，不同策略的计数互不影响，也用于环境变量覆盖
+	Limit  int           // 桶容量
+	Period time.Duration // 补满整个桶的时间
+	KeyBy  string        // 计数维度，默认按 IP
+}
+
+// String 返回 RateLimit-Policy 响应头的值，如 "30;w=60"
+func (p RateLimitPolicy) String() string {
+	return fmt.Sprintf("%d;w=%d", p.Limit, int(p.Period.Seconds()))
+}
+
+// RateLimitMiddleware 返回一个按策略限流的中间件
+// 响应携带 RateLimit-Limit、RateLimit-Remaining、RateLimit-Reset 和 RateLimit-Policy 头，超限时返回 429 和 Retry-After
+// 环境变量 RATE_LIMIT_<NAME>（如 RATE_LIMIT_TOKEN=120/1m）可覆盖策略，值为 off 时停用；RATE_LIMIT_ENABLED=false 停用全部限流
+func RateLimitMiddleware(policy RateLimitPolicy) fiber.Handler {
+	policy = applyRateLimitOverride(policy)
+	if !rateLimitEnabled() || policy.Limit <= 0 || policy.Period <= 0 {
+		return func(c *fiber.Ctx) error {
+			return c.Next()
+		}
+	}
+
+	return func(c *fiber.Ctx) error {
+		key := fmt.Sprintf("%s:%s", policy.Name, rateLimitKey(c, policy.KeyBy))
+		result, err := services.TakeRateLimitToken(key, policy.Limit, policy.Period)
+		if err != nil {
+			// 限流存储异常时放行，避免影响正常请求
+			log.Printf("[RateLimit] Failed to check rate limit %s: %v", policy.Name, err)
+			return c.Next()
+		}
+
+		c.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		c.Set("RateLimit-Policy", policy.String())
+
+		if !result.Allowed {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			return c.Status(fiber.StatusTooManyRequests).JSON(types.ErrorResponse("请求过于频繁，请稍后再试"))
+		}
+		return c.Next()
+	}
+}
+
+// authenticateRateLimitClient 校验按客户端计数时请求携带的客户端凭据
+var authenticateRateLimitClient = services.AuthenticateClient
+
+// rateLimitKey 返回请求在给定维度下的计数键
+func rateLimitKey(c *fiber.Ctx, keyBy string) string {
+	switch keyBy {
+	case RateLimitByUser:
+		if userID, ok := c.Locals("userID").(string); ok && userID != "" {
+			return "user:" + userID
+		}
+	case RateLimitByClient:
+		// 未认证的请求可以随意填写 client_id：按它计数既能换用新的 client_id 绕过限流，
+		// 也能冒用他人的 client_id 耗尽其额度，因此只有凭据正确时才按客户端计数
+		if clientId, clientSecret := requestClientCredentials(c); clientId != "" && clientSecret != "" {
+			ok, err := authenticateRateLimitClient(clientId, clientSecret)
+			if err != nil {
+				log.Printf("[RateLimit] Failed to authenticate client %s: %v", clientId, err)
+			}
+			if ok {
+				return "client:" + clientId
+			}
+		}
+	case RateLimitByRoute:
+		return "route:" + c.Method() + " " + c.Route().Path
+	}
+	return "ip:" + c.IP()
+}
+
+// requestClientCredentials 从 HTTP Basic 认证、表单或 JSON 请求体中读取 client_id 和 client_secret
+func requestClientCredentials(c *fiber.Ctx) (string, string) {
+	if clientId, clientSecret, ok := basicAuthCredentials(c); ok {
+		return clientId, clientSecret
+	}
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		var body struct {
+			ClientId     string `json:"client_id"`
+			ClientSecret string `json:"client_secret"`
+		}
+		if json.Unmarshal(c.Body(), &body) == nil {
+			return body.ClientId, body.ClientSecret
+		}
+		return "", ""
+	}
+	return c.FormValue("client_id"), c.FormValue("client_secret")
+}
+
+// basicAuthCredentials 解析 Authorization 头中的 HTTP Basic 认证
+func basicAuthCredentials(c *fiber.Ctx) (string, string, bool) {
+	encoded, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	return username, password, ok && username != ""
+}
+
+// rateLimitEnabled 检查是否启用限流，默认启用
+func rateLimitEnabled() bool {
+	return strings.ToLower(os.Getenv("RATE_LIMIT_ENABLED")) != "false"
+}
+
+// applyRateLimitOverride 使用环境变量 RATE_LIMIT_<NAME> 覆盖策略的额度，格式为 "次数/时长"
+func applyRateLimitOverride(policy RateLimitPolicy) RateLimitPolicy {
+	name := "RATE_LIMIT_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(policy.Name))
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return policy
+	}
+	if strings.EqualFold(value, "off") {
+		policy.Limit = 0
+		return policy
+	}
+
+	limitText, periodText, found := strings.Cut(value, "/")
+	limit, err := strconv.Atoi(strings.TrimSpace(limitText))
+	if !found || err != nil || limit <= 0 {
+		log.Printf("[RateLimit] Ignoring invalid %s=%q", name, value)
+		return policy
+	}
+	period, err := time.ParseDuration(strings.TrimSpace(periodText))
+	if err != nil || period <= 0 {
+		log.Printf("[RateLimit] Ignoring invalid %s=%q", name, value)
+		return policy
+	}
+	policy.Limit, policy.Period = limit, period
+	return policy
+}
+
+// ceilSeconds 将时长向上取整为秒
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,157 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package middlewares
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRateLimitMiddleware_Headers(t *testing.T) {
+	app := fiber.New()
+	app.Get("/limited", RateLimitMiddleware(RateLimitPolicy{Name: "test-headers", Limit: 2, Period: time.Minute}), func(c *fiber.Ctx) error {
+		return c.SendString("OK")
+	})
+
+	for i, expected := range []struct {
+		status    int
+		remaining string
+	}{
+		{fiber.StatusOK, "1"},
+		{fiber.StatusOK, "0"},
+		{fiber.StatusTooManyRequests, "0"},
+	} {
+		resp, err := app.Test(httptest.NewRequest("GET", "/limited", nil))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if resp.StatusCode != expected.status {
+			t.Errorf("Request %d: expected status %d, got %d", i+1, expected.status, resp.StatusCode)
+		}
+		if remaining := resp.Header.Get("RateLimit-Remaining"); remaining != expected.remaining {
+			t.Errorf("Request %d: expected RateLimit-Remaining %s, got %s", i+1, expected.remaining, remaining)
+		}
+		if limit := resp.Header.Get("RateLimit-Limit"); limit != "2" {
+			t.Errorf("Request %d: expected RateLimit-Limit 2, got %s", i+1, limit)
+		}
+		if policy := resp.Header.Get("RateLimit-Policy"); policy != "2;w=60" {
+			t.Errorf("Request %d: expected RateLimit-Policy 2;w=60, got %s", i+1, policy)
+		}
+		retryAfter := resp.Header.Get("Retry-After")
+		if (expected.status == fiber.StatusTooManyRequests) != (retryAfter != "") {
+			t.Errorf("Request %d: unexpected Retry-After %q", i+1, retryAfter)
+		}
+		if expected.status == fiber.StatusTooManyRequests && retryAfter != "30" {
+			t.Errorf("Expected a token every 30s, got Retry-After %s", retryAfter)
+		}
+	}
+}
+
+// stubRateLimitClients 让按客户端计数的限流只接受给定的客户端凭据
+func stubRateLimitClients(t *testing.T, secrets map[string]string) {
+	original := authenticateRateLimitClient
+	authenticateRateLimitClient = func(clientId, clientSecret string) (bool, error) {
+		return secrets[clientId] != "" && secrets[clientId] == clientSecret, nil
+	}
+	t.Cleanup(func() { authenticateRateLimitClient = original })
+}
+
+// newClientRateLimitApp 创建按客户端计数的测试应用，来源 IP 取自 X-Real-IP
+func newClientRateLimitApp(t *testing.T, name string) func(body, contentType, authorization, ip string) int {
+	app := fiber.New(fiber.Config{ProxyHeader: "X-Real-IP"})
+	app.Post("/token", RateLimitMiddleware(RateLimitPolicy{Name: name, Limit: 1, Period: time.Minute, KeyBy: RateLimitByClient}), func(c *fiber.Ctx) error {
+		return c.SendString("OK")
+	})
+
+	return func(body, contentType, authorization, ip string) int {
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Real-IP", ip)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+}
+
+func TestRateLimitMiddleware_ClientKey(t *testing.T) {
+	stubRateLimitClients(t, map[string]string{"app-a": "secret-a", "app-b": "secret-b"})
+	send := newClientRateLimitApp(t, "test-client")
+
+	if status := send("client_id=app-a&client_secret=secret-a", fiber.MIMEApplicationForm, "", "192.0.2.1"); status != fiber.StatusOK {
+		t.Errorf("Expected the first request of app-a to pass, got %d", status)
+	}
+	if status := send(`{"client_id":"app-a","client_secret":"secret-a"}`, fiber.MIMEApplicationJSON, "", "192.0.2.2"); status != fiber.StatusTooManyRequests {
+		t.Errorf("Expected app-a to be limited across body formats and addresses, got %d", status)
+	}
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("app-b:secret-b"))
+	if status := send("grant_type=client_credentials", fiber.MIMEApplicationForm, basic, "192.0.2.1"); status != fiber.StatusOK {
+		t.Errorf("Expected app-b to have its own bucket, got %d", status)
+	}
+}
+
+func TestRateLimitMiddleware_ClientKeyBypass(t *testing.T) {
+	stubRateLimitClients(t, map[string]string{})
+	send := newClientRateLimitApp(t, "test-client-bypass")
+
+	// 每次换用新的 client_id 不能获得新的额度
+	if status := send("client_id=random-1", fiber.MIMEApplicationForm, "", "192.0.2.10"); status != fiber.StatusOK {
+		t.Errorf("Expected the first request to pass, got %d", status)
+	}
+	if status := send("client_id=random-2&client_secret=guess", fiber.MIMEApplicationForm, "", "192.0.2.10"); status != fiber.StatusTooManyRequests {
+		t.Errorf("Expected unauthenticated requests to share the address bucket, got %d", status)
+	}
+}
+
+func TestRateLimitMiddleware_ClientKeyStarvation(t *testing.T) {
+	stubRateLimitClients(t, map[string]string{"victim": "secret"})
+	send := newClientRateLimitApp(t, "test-client-starvation")
+
+	// 冒用他人的 client_id 只会耗尽攻击者自己地址的额度
+	send("client_id=victim", fiber.MIMEApplicationForm, "", "198.51.100.66")
+	if status := send("client_id=victim&client_secret=wrong", fiber.MIMEApplicationForm, "", "198.51.100.66"); status != fiber.StatusTooManyRequests {
+		t.Errorf("Expected the attacker to be limited, got %d", status)
+	}
+	if status := send("client_id=victim&client_secret=secret", fiber.MIMEApplicationForm, "", "198.51.100.66"); status != fiber.StatusOK {
+		t.Errorf("Expected the authenticated client to keep its own bucket, got %d", status)
+	}
+	if status := send("client_id=victim", fiber.MIMEApplicationForm, "", "203.0.113.5"); status != fiber.StatusOK {
+		t.Errorf("Expected public requests of the client from other addresses to pass, got %d", status)
+	}
+}
+
+func TestRateLimitMiddleware_Override(t *testing.T) {
+	t.Setenv("RATE_LIMIT_TEST_OVERRIDE", "off")
+	app := fiber.New()
+	app.Get("/open", RateLimitMiddleware(RateLimitPolicy{Name: "test-override", Limit: 1, Period: time.Minute}), func(c *fiber.Ctx) error {
+		return c.SendString("OK")
+	})
+	for i := 0; i < 3; i++ {
+		resp, _ := app.Test(httptest.NewRequest("GET", "/open", nil))
+		if resp.StatusCode != fiber.StatusOK || resp.Header.Get("RateLimit-Limit") != "" {
+			t.Errorf("Expected a disabled policy to pass without headers, got %d", resp.StatusCode)
+		}
+	}
+
+	t.Setenv("RATE_LIMIT_TEST_OVERRIDE", "5/10s")
+	policy := applyRateLimitOverride(RateLimitPolicy{Name: "test-override", Limit: 1, Period: time.Minute})
+	if policy.Limit != 5 || policy.Period != 10*time.Second {
+		t.Errorf("Unexpected policy: %+v", policy)
+	}
+
+	t.Setenv("RATE_LIMIT_TEST_OVERRIDE", "lots")
+	policy = applyRateLimitOverride(RateLimitPolicy{Name: "test-override", Limit: 1, Period: time.Minute})
+	if policy.Limit != 1 || policy.Period != time.Minute {
+		t.Errorf("Expected an invalid override to be ignored, got %+v", policy)
+	}
+}
@@ -4,6 +4,7 @@
 package models
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"regexp"
 	"strings"
@@ -27,18 +28,92 @@ type Application struct {
 	Tags             []string `xorm:"text json" json:"tags"`
 
 	ClientId             string   `xorm:"varchar(100)" json:"clientId"`
-	ClientSecret         string   `xorm:"varchar(100)" json:"clientSecret"`
+	ClientSecret         string   `xorm:"-" json:"clientSecret,omitempty"` // Plaintext of a new secret, only returned once
 	RedirectUris         []string `xorm:"text json" json:"redirectUris"`
 	TokenFormat          string   `xorm:"varchar(100)" json:"tokenFormat"`
 	ExpireInHours        float64  `json:"expireInHours"`
 	RefreshExpireInHours float64  `json:"refreshExpireInHours"`
 	Scopes               []string `xorm:"text json" json:"scopes"`
+
+	// Refresh token policy: when refresh tokens are issued and how long a token family lives
+	RefreshTokenPolicy       string  `xorm:"varchar(20)" json:"refreshTokenPolicy"`
+	RefreshIdleHours         float64 `json:"refreshIdleHours"`         // sliding lifetime, 0 uses RefreshExpireInHours
+	RefreshAbsoluteHours     float64 `json:"refreshAbsoluteHours"`     // cap from the first issuance, 0 means no cap
+	RefreshReuseGraceSeconds int     `json:"refreshReuseGraceSeconds"` // 0 disables the reuse grace window
+
+	// OIDC response signing / encryption (OpenID Connect Registration 1.0 §2)
+	Jwks                         string `xorm:"text" json:"jwks"`
+	JwksUri                      string `xorm:"varchar(200)" json:"jwksUri"`
+	IdTokenSignedResponseAlg     string `xorm:"varchar(20)" json:"idTokenSignedResponseAlg"`
+	IdTokenEncryptedResponseAlg  string `xorm:"varchar(20)" json:"idTokenEncryptedResponseAlg"`
+	IdTokenEncryptedResponseEnc  string `xorm:"varchar(20)" json:"idTokenEncryptedResponseEnc"`
+	UserinfoSignedResponseAlg    string `xorm:"varchar(20)" json:"userinfoSignedResponseAlg"`
+	UserinfoEncryptedResponseAlg string `xorm:"varchar(20)" json:"userinfoEncryptedResponseAlg"`
+	UserinfoEncryptedResponseEnc string `xorm:"varchar(20)" json:"userinfoEncryptedResponseEnc"`
+
+	// Dynamic client registration (RFC 7591 / RFC 7592)
+	ResponseTypes               []string `xorm:"text json" json:"responseTypes"`
+	TokenEndpointAuthMethod     string   `xorm:"varchar(50)" json:"tokenEndpointAuthMethod"`
+	Contacts                    []string `xorm:"text json" json:"contacts"`
+	SoftwareId                  string   `xorm:"varchar(100)" json:"softwareId"`
+	SoftwareVersion             string   `xorm:"varchar(100)" json:"softwareVersion"`
+	RegistrationAccessTokenHash string   `xorm:"varchar(100) index" json:"-"`
+	RegistrationStatus          string   `xorm:"varchar(20)" json:"registrationStatus"`
+
+	// SAML 2.0 service provider settings, used when Category is SAML
+	Category         string            `xorm:"varchar(20)" json:"category"` // OAuth（默认）或 SAML
+	SamlEntityId     string            `xorm:"varchar(200) index" json:"samlEntityId"`
+	SamlAcsUrl       string            `xorm:"varchar(200)" json:"samlAcsUrl"`
+	SamlSloUrl       string            `xorm:"varchar(200)" json:"samlSloUrl"`
+	SamlNameIdFormat string            `xorm:"varchar(100)" json:"samlNameIdFormat"`
+	SamlAttributes   map[string]string `xorm:"text json" json:"samlAttributes"` // SAML 属性名 -> 用户字段
 }
 
+const (
+	RegistrationStatusPending  = "pending"
+	RegistrationStatusApproved = "approved"
+)
+
+// Application categories. An empty category is an OAuth 2.0 / OIDC client.
+const (
+	ApplicationCategoryOAuth = "OAuth"
+	ApplicationCategorySaml  = "SAML"
+)
+
+// Refresh token policies. An empty policy behaves as offline_access.
+const (
+	RefreshTokenPolicyOfflineAccess = "offline_access"
+	RefreshTokenPolicyAlways        = "always"
+	RefreshTokenPolicyNever         = "never"
+)
+
 func (a *Application) GetId() string {
 	return fmt.Sprintf("%s/%s", a.Owner, a.Name)
 }
 
+// IsSaml reports whether the application is a SAML service provider rather than an OAuth client
+func (a *Application) IsSaml() bool {
+	return a.Category == ApplicationCategorySaml
+}
+
+// IsPending reports whether a dynamically registered client still awaits admin approval
+func (a *Application) IsPending() bool {
+	return a.RegistrationStatus == RegistrationStatusPending
+}
+
+// SetRegistrationAccessToken stores the hash of a registration access token (RFC 7592 §1)
+func (a *Application) SetRegistrationAccessToken(token string) {
+	a.RegistrationAccessTokenHash = getTokenHash(token)
+}
+
+// CheckRegistrationAccessToken compares a presented registration access token with the stored hash
+func (a *Application) CheckRegistrationAccessToken(token string) bool {
+	if a.RegistrationAccessTokenHash == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(a.RegistrationAccessTokenHash), []byte(getTokenHash(token))) == 1
+}
+
 func (a *Application) IsRedirectUriValid(redirectUri string) bool {
 	if redirectUri == "" {
 		return false
@@ -112,12 +187,31 @@ func GetApplicationByClientId(clientId string) (*Application, error) {
 	return nil, nil
 }
 
+// GetApplicationBySamlEntityId returns the SAML service provider with the entity ID
+func GetApplicationBySamlEntityId(entityId string) (*Application, error) {
+	if entityId == "" {
+		return nil, nil
+	}
+
+	app := Application{Category: ApplicationCategorySaml, SamlEntityId: entityId}
+	existed, err := engine.Get(&app)
+	if err != nil {
+		return nil, err
+	}
+
+	if existed {
+		return &app, nil
+	}
+	return nil, nil
+}
+
 func AddApplication(app *Application) (bool, error) {
 	// Set defaults for required fields
 	if app.ClientId == "" {
 		app.ClientId = GenerateClientId()
 	}
-	if app.ClientSecret == "" {
+	// Public clients (token_endpoint_auth_method "none") do not get a secret
+	if app.ClientSecret == "" && app.TokenEndpointAuthMethod != "none" {
 		app.ClientSecret = GenerateClientSecret()
 	}
 	if app.ExpireInHours == 0 {
@@ -134,6 +228,12 @@ func AddApplication(app *Application) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+
+	if app.ClientSecret != "" {
+		if _, err = AddClientSecret(app, app.ClientSecret, 0); err != nil {
+			return false, err
+		}
+	}
 	return affected != 0, nil
 }
 
@@ -150,6 +250,10 @@ func DeleteApplication(owner, name string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+
+	if err = DeleteClientSecrets(owner, name); err != nil {
+		return false, err
+	}
 	return affected != 0, nil
 }
 
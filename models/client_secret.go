@@ -0,0 +1,207 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package models
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ClientSecret is one of the secrets of a confidential client.
+// Only the hash of the secret is stored; the plaintext is shown once when it is created.
+// A client may hold several active secrets so they can be rotated without downtime.
+type ClientSecret struct {
+	Owner       string `xorm:"varchar(100) notnull pk" json:"owner"`
+	Name        string `xorm:"varchar(100) notnull pk" json:"name"`
+	CreatedTime string `xorm:"varchar(100)" json:"createdTime"`
+
+	Application string `xorm:"varchar(100) index" json:"application"`
+	SecretHash  string `xorm:"varchar(100) unique" json:"-"`
+	Hint        string `xorm:"varchar(20)" json:"hint"` // Last characters of the secret, for display
+	ExpiresAt   int64  `json:"expiresAt"`               // 0 means no expiration
+	IsRevoked   bool   `json:"isRevoked"`
+}
+
+func (s *ClientSecret) GetId() string {
+	return fmt.Sprintf("%s/%s", s.Owner, s.Name)
+}
+
+// IsActive checks revocation and expiration
+func (s *ClientSecret) IsActive() bool {
+	if s.IsRevoked {
+		return false
+	}
+	return s.ExpiresAt == 0 || time.Now().Unix() <= s.ExpiresAt
+}
+
+// secretHint returns the last characters of a secret so admins can tell secrets apart
+func secretHint(secret string) string {
+	if len(secret) < 8 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
+// AddClientSecret stores the hash of a new secret for an application
+func AddClientSecret(application *Application, secret string, expiresAt int64) (*ClientSecret, error) {
+	clientSecret := &ClientSecret{
+		Owner:       application.Owner,
+		Name:        fmt.Sprintf("secret_%s", GenerateRandomString(16)),
+		CreatedTime: GetCurrentTime(),
+		Application: application.Name,
+		SecretHash:  getTokenHash(secret),
+		Hint:        secretHint(secret),
+		ExpiresAt:   expiresAt,
+	}
+
+	if _, err := engine.Insert(clientSecret); err != nil {
+		return nil, err
+	}
+	return clientSecret, nil
+}
+
+func GetClientSecret(owner, name string) (*ClientSecret, error) {
+	if owner == "" || name == "" {
+		return nil, nil
+	}
+
+	clientSecret := ClientSecret{Owner: owner, Name: name}
+	existed, err := engine.Get(&clientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	if existed {
+		return &clientSecret, nil
+	}
+	return nil, nil
+}
+
+// GetClientSecrets returns all secrets of an application, newest first
+func GetClientSecrets(owner, application string) ([]*ClientSecret, error) {
+	secrets := []*ClientSecret{}
+	err := engine.Where("owner = ? AND application = ?", owner, application).Desc("created_time").Find(&secrets)
+	if err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// GetActiveClientSecrets returns the secrets of an application that can authenticate the client
+func GetActiveClientSecrets(owner, application string) ([]*ClientSecret, error) {
+	secrets, err := GetClientSecrets(owner, application)
+	if err != nil {
+		return nil, err
+	}
+
+	active := []*ClientSecret{}
+	for _, secret := range secrets {
+		if secret.IsActive() {
+			active = append(active, secret)
+		}
+	}
+	return active, nil
+}
+
+func UpdateClientSecret(owner, name string, clientSecret *ClientSecret) (bool, error) {
+	affected, err := engine.Where("owner = ? AND name = ?", owner, name).AllCols().Update(clientSecret)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// DeleteClientSecrets removes all secrets of an application
+func DeleteClientSecrets(owner, application string) error {
+	_, err := engine.Where("owner = ? AND application = ?", owner, application).Delete(&ClientSecret{})
+	return err
+}
+
+// HasClientSecret reports whether an application has an active secret, i.e. is a confidential client
+func HasClientSecret(application *Application) (bool, error) {
+	secrets, err := GetActiveClientSecrets(application.Owner, application.Name)
+	if err != nil {
+		return false, err
+	}
+	return len(secrets) > 0, nil
+}
+
+// VerifyClientSecret checks a presented secret against every active secret of an application.
+// Hashes are compared in constant time and all secrets are checked to avoid leaking which one matched.
+func VerifyClientSecret(application *Application, secret string) (bool, error) {
+	if secret == "" {
+		return false, nil
+	}
+
+	secrets, err := GetActiveClientSecrets(application.Owner, application.Name)
+	if err != nil {
+		return false, err
+	}
+
+	hash := []byte(getTokenHash(secret))
+	matched := 0
+	for _, clientSecret := range secrets {
+		matched |= subtle.ConstantTimeCompare(hash, []byte(clientSecret.SecretHash))
+	}
+	return matched == 1, nil
+}
+
+// migrateClientSecretPlaintext is a one-time migration for databases created before client
+// secrets were hashed. It moves each plaintext secret to a ClientSecret row and drops the column.
+func migrateClientSecretPlaintext() error {
+	tables, err := engine.DBMetas()
+	if err != nil {
+		return err
+	}
+
+	hasPlaintext := false
+	for _, table := range tables {
+		if table.Name == "application" && table.GetColumn("client_secret") != nil {
+			hasPlaintext = true
+		}
+	}
+	if !hasPlaintext {
+		return nil
+	}
+
+	session := engine.NewSession()
+	defer session.Close()
+	if err = session.Begin(); err != nil {
+		return err
+	}
+
+	rows, err := session.QueryString(`SELECT owner, name, client_secret FROM "application"`)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		secret := row["client_secret"]
+		if secret == "" {
+			continue
+		}
+		_, err = session.Insert(&ClientSecret{
+			Owner:       row["owner"],
+			Name:        fmt.Sprintf("secret_%s", GenerateRandomString(16)),
+			CreatedTime: GetCurrentTime(),
+			Application: row["name"],
+			SecretHash:  getTokenHash(secret),
+			Hint:        secretHint(secret),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err = session.Exec(`ALTER TABLE "application" DROP COLUMN client_secret`); err != nil {
+		return err
+	}
+
+	if err = session.Commit(); err != nil {
+		return err
+	}
+	log.Printf("[DB] Migrated %d plaintext client secrets", len(rows))
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package models
+
+import (
+	"fmt"
+)
+
+// Group is a named set of users of one organization, managed through SCIM
+type Group struct {
+	Owner       string `xorm:"varchar(100) notnull pk" json:"owner"` // 所属组织
+	Name        string `xorm:"varchar(100) notnull pk" json:"name"`  // 同时作为 SCIM id
+	CreatedTime string `xorm:"varchar(100)" json:"createdTime"`
+	UpdatedTime string `xorm:"varchar(100)" json:"updatedTime"`
+
+	DisplayName string   `xorm:"varchar(100)" json:"displayName"`
+	ExternalId  string   `xorm:"varchar(100)" json:"externalId"` // 上游系统（如 HR 系统）中的标识
+	Members     []string `xorm:"text json" json:"members"`       // 成员用户 ID
+}
+
+func (g *Group) GetId() string {
+	return fmt.Sprintf("%s/%s", g.Owner, g.Name)
+}
+
+// HasMember checks whether the user with the given ID belongs to the group
+func (g *Group) HasMember(userId string) bool {
+	for _, member := range g.Members {
+		if member == userId {
+			return true
+		}
+	}
+	return false
+}
+
+func GetGroup(owner, name string) (*Group, error) {
+	if owner == "" || name == "" {
+		return nil, nil
+	}
+
+	group := Group{Owner: owner, Name: name}
+	existed, err := engine.Get(&group)
+	if err != nil {
+		return nil, err
+	}
+
+	if existed {
+		return &group, nil
+	}
+	return nil, nil
+}
+
+func GetGroups(owner string) ([]*Group, error) {
+	groups := []*Group{}
+	err := engine.Where("owner = ?", owner).Asc("created_time").Find(&groups)
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func AddGroup(group *Group) (bool, error) {
+	affected, err := engine.Insert(group)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+func UpdateGroup(owner, name string, group *Group) (bool, error) {
+	affected, err := engine.Where("owner = ? AND name = ?", owner, name).AllCols().Update(group)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+func DeleteGroup(owner, name string) (bool, error) {
+	affected, err := engine.Where("owner = ? AND name = ?", owner, name).Delete(&Group{})
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
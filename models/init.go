@@ -59,13 +59,50 @@ func InitDB() error {
 }
 
 func InitTables() error {
-	return engine.Sync2(
+	// Duplicates have to be resolved before Sync2 creates the unique username, email and phone indexes
+	if err := migrateDuplicateUsernames(); err != nil {
+		return err
+	}
+	// Existing users only get email_verified backfilled once, when the column is added
+	backfillEmail, err := emailVerifiedMissing()
+	if err != nil {
+		return err
+	}
+	if err = ensureUserContactIndexes(); err != nil {
+		return err
+	}
+
+	err = engine.Sync2(
 		new(User),
 		new(Application),
 		new(Token),
 		new(Organization),
 		new(Provider),
+		new(InitialAccessToken),
+		new(ClientSecret),
+		new(WebauthnCredential),
+		new(UserIdentity),
+		new(Group),
+		new(ScimToken),
+		new(LoginRecord),
+		new(Session),
 	)
+	if err != nil {
+		return err
+	}
+
+	if err = ensureUserContactIndexes(); err != nil {
+		return err
+	}
+	if backfillEmail {
+		if err = backfillEmailVerified(); err != nil {
+			return err
+		}
+	}
+	if err = migrateClientSecretPlaintext(); err != nil {
+		return err
+	}
+	return migrateTokenPlaintext()
 }
 
 func InitData() error {
@@ -77,6 +114,7 @@ func InitData() error {
 		DisplayName:  "Built-in Organization",
 		PasswordType: "bcrypt",
 		EnableSignUp: true,
+		DcrPolicy:    DcrPolicyTokenRequired,
 	}
 
 	exists, err := engine.Get(&Organization{Owner: "admin", Name: "built-in"})
@@ -128,7 +166,7 @@ func InitData() error {
 		return err
 	}
 	if !exists {
-		_, err = engine.Insert(app)
+		_, err = AddApplication(app)
 		if err != nil {
 			return err
 		}
@@ -184,13 +222,14 @@ func createDefaultAdmin() error {
 	}
 
 	admin := &User{
-		Owner:       "built-in",
-		CreatedTime: time.Now().Format(time.RFC3339),
-		Type:        "normal-user",
-		Password:    hashedPassword,
-		Username:    adminUsername,
-		Email:       adminEmail,
-		IsAdmin:     true,
+		Owner:        "built-in",
+		CreatedTime:  time.Now().Format(time.RFC3339),
+		Type:         "normal-user",
+		Password:     hashedPassword,
+		PasswordType: "bcrypt",
+		Username:     adminUsername,
+		Email:        adminEmail,
+		IsAdmin:      true,
 	}
 
 	_, err = engine.Insert(admin)
@@ -0,0 +1,124 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// InitialAccessToken authorizes calls to the client registration endpoint (RFC 7591 §3).
+// Only the hash of the token is stored.
+type InitialAccessToken struct {
+	Owner       string `xorm:"varchar(100) notnull pk" json:"owner"`
+	Name        string `xorm:"varchar(100) notnull pk" json:"name"`
+	CreatedTime string `xorm:"varchar(100)" json:"createdTime"`
+
+	Organization string `xorm:"varchar(100)" json:"organization"`
+	Description  string `xorm:"varchar(200)" json:"description"`
+	TokenHash    string `xorm:"varchar(100) unique" json:"-"`
+	ExpiresAt    int64  `json:"expiresAt"` // 0 means no expiration
+	MaxUses      int    `json:"maxUses"`   // 0 means unlimited
+	UsedCount    int    `json:"usedCount"`
+	IsRevoked    bool   `json:"isRevoked"`
+}
+
+func (t *InitialAccessToken) GetId() string {
+	return fmt.Sprintf("%s/%s", t.Owner, t.Name)
+}
+
+// SetToken stores the hash of the plaintext token
+func (t *InitialAccessToken) SetToken(token string) {
+	t.TokenHash = getTokenHash(token)
+}
+
+// IsUsable checks revocation, expiration and remaining uses
+func (t *InitialAccessToken) IsUsable() bool {
+	if t.IsRevoked {
+		return false
+	}
+	if t.ExpiresAt != 0 && time.Now().Unix() > t.ExpiresAt {
+		return false
+	}
+	return t.MaxUses == 0 || t.UsedCount < t.MaxUses
+}
+
+func GetInitialAccessToken(owner, name string) (*InitialAccessToken, error) {
+	if owner == "" || name == "" {
+		return nil, nil
+	}
+
+	token := InitialAccessToken{Owner: owner, Name: name}
+	existed, err := engine.Get(&token)
+	if err != nil {
+		return nil, err
+	}
+
+	if existed {
+		return &token, nil
+	}
+	return nil, nil
+}
+
+// GetInitialAccessTokenByToken looks up an initial access token by its plaintext value
+func GetInitialAccessTokenByToken(token string) (*InitialAccessToken, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	iat := InitialAccessToken{}
+	existed, err := engine.Where("token_hash = ?", getTokenHash(token)).Get(&iat)
+	if err != nil {
+		return nil, err
+	}
+
+	if existed {
+		return &iat, nil
+	}
+	return nil, nil
+}
+
+func GetInitialAccessTokens(owner string) ([]*InitialAccessToken, error) {
+	tokens := []*InitialAccessToken{}
+	session := engine.Desc("created_time")
+	if owner != "" {
+		session = session.Where("owner = ?", owner)
+	}
+	err := session.Find(&tokens)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func AddInitialAccessToken(token *InitialAccessToken) (bool, error) {
+	affected, err := engine.Insert(token)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+func UpdateInitialAccessToken(owner, name string, token *InitialAccessToken) (bool, error) {
+	affected, err := engine.Where("owner = ? AND name = ?", owner, name).AllCols().Update(token)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// ConsumeInitialAccessToken atomically records one use of a token.
+// It returns false if the token was revoked, expired or used up in the meantime.
+func ConsumeInitialAccessToken(token *InitialAccessToken) (bool, error) {
+	affected, err := engine.
+		Where("owner = ? AND name = ? AND is_revoked = ?", token.Owner, token.Name, false).
+		And("(expires_at = 0 OR expires_at >= ?)", time.Now().Unix()).
+		And("(max_uses = 0 OR used_count < max_uses)").
+		Incr("used_count").
+		Update(&InitialAccessToken{})
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
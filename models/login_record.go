@@ -0,0 +1,49 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package models
+
+import (
+	"fmt"
+)
+
+// LoginRecord is one successful sign-in of a user, kept as the account's login history
+type LoginRecord struct {
+	Owner       string `xorm:"varchar(100) notnull pk" json:"owner"`
+	Name        string `xorm:"varchar(100) notnull pk" json:"name"`
+	CreatedTime string `xorm:"varchar(100) index" json:"createdTime"`
+
+	UserId      int64    `xorm:"index" json:"userId"`
+	Application string   `xorm:"varchar(100)" json:"application"`
+	Amr         []string `xorm:"text json" json:"amr"` // Authentication methods used (RFC 8176)
+	Ip          string   `xorm:"varchar(100)" json:"ip"`
+	UserAgent   string   `xorm:"varchar(500)" json:"userAgent"`
+}
+
+func (r *LoginRecord) GetId() string {
+	return fmt.Sprintf("%s/%s", r.Owner, r.Name)
+}
+
+func AddLoginRecord(record *LoginRecord) (bool, error) {
+	affected, err := engine.Insert(record)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// GetUserLoginRecords returns the latest sign-ins of a user, newest first
+func GetUserLoginRecords(userId int64, limit int) ([]*LoginRecord, error) {
+	records := []*LoginRecord{}
+	err := engine.Where("user_id = ?", userId).Desc("created_time").Limit(limit).Find(&records)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// DeleteUserLoginRecords removes the login history of a user
+func DeleteUserLoginRecords(userId int64) error {
+	_, err := engine.Where("user_id = ?", userId).Delete(&LoginRecord{})
+	return err
+}
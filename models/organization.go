@@ -18,6 +18,39 @@ type Organization struct {
 	DefaultAvatar string `xorm:"varchar(200)" json:"defaultAvatar"`
 	EnableSignUp  bool   `json:"enableSignUp"`
 	DcrPolicy     string `xorm:"varchar(100)" json:"dcrPolicy"` // Dynamic Client Registration policy
+
+	// Trusted issuer keys (JWK Set) for signed software statements (RFC 7591 §2.3)
+	DcrSoftwareStatementJwks    string `xorm:"text" json:"dcrSoftwareStatementJwks"`
+	DcrRequireSoftwareStatement bool   `json:"dcrRequireSoftwareStatement"`
+
+	// Password policy, checked whenever a password is set
+	PasswordMinLength            int      `json:"passwordMinLength"`                    // 0 uses the default minimum
+	PasswordCharClasses          []string `xorm:"text json" json:"passwordCharClasses"` // Required classes: lower, upper, digit, symbol
+	PasswordForbidUserAttributes bool     `json:"passwordForbidUserAttributes"`         // Reject passwords containing the username, email or phone
+	PasswordHistorySize          int      `json:"passwordHistorySize"`                  // Number of recent passwords that cannot be reused
+	PasswordMaxAgeDays           int      `json:"passwordMaxAgeDays"`                   // 0 means passwords do not expire
+	PasswordCheckBreached        bool     `json:"passwordCheckBreached"`                // Reject passwords found in the local breached password list
+
+	// Identifiers accepted in the login field of password sign-in: email, username, phone.
+	// Empty accepts all three.
+	SigninIdentifiers []string `xorm:"text json" json:"signinIdentifiers"`
+}
+
+// Dynamic Client Registration policies. An empty policy behaves as open.
+const (
+	DcrPolicyOpen          = "open"
+	DcrPolicyTokenRequired = "token-required"
+	DcrPolicyAdminApproval = "admin-approval"
+	DcrPolicyClosed        = "closed"
+)
+
+// IsValidDcrPolicy checks whether a policy value is known
+func IsValidDcrPolicy(policy string) bool {
+	switch policy {
+	case "", DcrPolicyOpen, DcrPolicyTokenRequired, DcrPolicyAdminApproval, DcrPolicyClosed:
+		return true
+	}
+	return false
 }
 
 func (o *Organization) GetId() string {
@@ -3,6 +3,28 @@
 
 package models
 
+const (
+	// ProviderCategoryOAuth is the category of upstream OAuth 2.0 login providers
+	ProviderCategoryOAuth = "OAuth"
+	// ProviderCategoryOidc is the category of OpenID Connect providers configured by issuer URL
+	ProviderCategoryOidc = "OIDC"
+	// ProviderCategoryLdap is the category of LDAP directories that check passwords and provision users
+	ProviderCategoryLdap = "LDAP"
+)
+
+// Roles that LDAP group membership maps to
+const (
+	LdapRoleUser  = "user"  // Members may sign in
+	LdapRoleAdmin = "admin" // Members may sign in and are administrators
+)
+
+// Rules for a sign-in whose verified upstream email belongs to an existing account
+const (
+	ProviderEmailLinkingReject = "reject" // Ask the user to sign in and link the provider first (default)
+	ProviderEmailLinkingLink   = "link"   // Link the upstream account to the existing account
+	ProviderEmailLinkingIgnore = "ignore" // Create a separate account without the email
+)
+
 type Provider struct {
 	Owner       string `xorm:"varchar(100) notnull pk" json:"owner"`
 	Name        string `xorm:"varchar(100) notnull pk" json:"name"`
@@ -13,11 +35,31 @@ type Provider struct {
 	Type         string `xorm:"varchar(100)" json:"type"`     // GitHub, Google, etc.
 	SubType      string `xorm:"varchar(100)" json:"subType"`
 	ClientId     string `xorm:"varchar(200)" json:"clientId"`
-	ClientSecret string `xorm:"varchar(200)" json:"clientSecret"`
+	ClientSecret string `xorm:"text" json:"-"` // 加密存储，不返回给前端
 	HostUrl      string `xorm:"varchar(200)" json:"hostUrl"`
 	AuthUrl      string `xorm:"varchar(200)" json:"authUrl"`
 	TokenUrl     string `xorm:"varchar(200)" json:"tokenUrl"`
 	UserInfoUrl  string `xorm:"varchar(200)" json:"userInfoUrl"`
+
+	// Upstream login settings; empty values fall back to the preset of the provider type
+	Scopes      string            `xorm:"varchar(500)" json:"scopes"`
+	UserMapping map[string]string `xorm:"text json" json:"userMapping"` // 本地属性 -> 上游 userinfo 字段（支持 a.b 路径）
+	IsEnabled   bool              `json:"isEnabled"`
+
+	// OIDC discovery and just-in-time provisioning
+	Issuer       string `xorm:"varchar(200)" json:"issuer"`       // OIDC 提供商的 issuer，端点通过 discovery 获取
+	Organization string `xorm:"varchar(100)" json:"organization"` // 新用户所属组织，默认 built-in
+	EmailLinking string `xorm:"varchar(100)" json:"emailLinking"` // reject、link 或 ignore
+
+	// LDAP directory; HostUrl is the server URL, ClientId and ClientSecret the service account
+	LdapBaseDn         string            `xorm:"varchar(200)" json:"ldapBaseDn"`
+	LdapUserFilter     string            `xorm:"varchar(500)" json:"ldapUserFilter"`     // 查找用户的过滤器，%s 为登录名，默认 (mail=%s)
+	LdapBindDnTemplate string            `xorm:"varchar(200)" json:"ldapBindDnTemplate"` // 如 uid=%s,ou=people,dc=example,dc=com，设置后直接绑定而不先搜索
+	LdapStartTls       bool              `json:"ldapStartTls"`
+	LdapGroupAttribute string            `xorm:"varchar(100)" json:"ldapGroupAttribute"` // 用户条目中列出所属组的属性，默认 memberOf
+	LdapGroupRoles     map[string]string `xorm:"text json" json:"ldapGroupRoles"`        // 组 DN -> user 或 admin
+	LdapSyncInterval   int               `json:"ldapSyncInterval"`                       // 自动同步间隔（分钟），0 表示不自动同步
+	LdapLastSyncTime   string            `xorm:"varchar(100)" json:"ldapLastSyncTime"`
 }
 
 func GetProvider(owner, name string) (*Provider, error) {
@@ -37,6 +79,28 @@ func GetProvider(owner, name string) (*Provider, error) {
 	return nil, nil
 }
 
+func GetProviders(owner string) ([]*Provider, error) {
+	providers := []*Provider{}
+	session := engine.Asc("created_time")
+	if owner != "" {
+		session = session.Where("owner = ?", owner)
+	}
+	if err := session.Find(&providers); err != nil {
+		return nil, err
+	}
+	return providers, nil
+}
+
+// GetEnabledProviders returns the enabled providers of the given categories, shown on the login page
+func GetEnabledProviders(owner string, categories ...string) ([]*Provider, error) {
+	providers := []*Provider{}
+	err := engine.Where("owner = ? AND is_enabled = ?", owner, true).In("category", categories).Asc("created_time").Find(&providers)
+	if err != nil {
+		return nil, err
+	}
+	return providers, nil
+}
+
 func AddProvider(provider *Provider) (bool, error) {
 	affected, err := engine.Insert(provider)
 	if err != nil {
@@ -44,3 +108,28 @@ func AddProvider(provider *Provider) (bool, error) {
 	}
 	return affected != 0, nil
 }
+
+func UpdateProvider(owner, name string, provider *Provider) (bool, error) {
+	affected, err := engine.Where("owner = ? AND name = ?", owner, name).AllCols().Update(provider)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// UpdateProviderSyncTime records the time of the last directory sync
+func UpdateProviderSyncTime(provider *Provider) (bool, error) {
+	affected, err := engine.Where("owner = ? AND name = ?", provider.Owner, provider.Name).Cols("ldap_last_sync_time").Update(provider)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+func DeleteProvider(owner, name string) (bool, error) {
+	affected, err := engine.Delete(&Provider{Owner: owner, Name: name})
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
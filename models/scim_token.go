@@ -0,0 +1,104 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// ScimToken authorizes a provisioning client to manage the users and groups of one organization
+// through the SCIM endpoints. Only the hash of the token is stored.
+type ScimToken struct {
+	Owner       string `xorm:"varchar(100) notnull pk" json:"owner"`
+	Name        string `xorm:"varchar(100) notnull pk" json:"name"`
+	CreatedTime string `xorm:"varchar(100)" json:"createdTime"`
+
+	Organization string `xorm:"varchar(100)" json:"organization"`
+	Description  string `xorm:"varchar(200)" json:"description"`
+	TokenHash    string `xorm:"varchar(100) unique" json:"-"`
+	ExpiresAt    int64  `json:"expiresAt"` // 0 means no expiration
+	IsRevoked    bool   `json:"isRevoked"`
+}
+
+func (t *ScimToken) GetId() string {
+	return fmt.Sprintf("%s/%s", t.Owner, t.Name)
+}
+
+// SetToken stores the hash of the plaintext token
+func (t *ScimToken) SetToken(token string) {
+	t.TokenHash = getTokenHash(token)
+}
+
+// IsUsable checks revocation and expiration
+func (t *ScimToken) IsUsable() bool {
+	if t.IsRevoked {
+		return false
+	}
+	return t.ExpiresAt == 0 || time.Now().Unix() <= t.ExpiresAt
+}
+
+func GetScimToken(owner, name string) (*ScimToken, error) {
+	if owner == "" || name == "" {
+		return nil, nil
+	}
+
+	token := ScimToken{Owner: owner, Name: name}
+	existed, err := engine.Get(&token)
+	if err != nil {
+		return nil, err
+	}
+
+	if existed {
+		return &token, nil
+	}
+	return nil, nil
+}
+
+// GetScimTokenByToken looks up a SCIM token by its plaintext value
+func GetScimTokenByToken(token string) (*ScimToken, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	scimToken := ScimToken{}
+	existed, err := engine.Where("token_hash = ?", getTokenHash(token)).Get(&scimToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if existed {
+		return &scimToken, nil
+	}
+	return nil, nil
+}
+
+func GetScimTokens(owner string) ([]*ScimToken, error) {
+	tokens := []*ScimToken{}
+	session := engine.Desc("created_time")
+	if owner != "" {
+		session = session.Where("owner = ?", owner)
+	}
+	err := session.Find(&tokens)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func AddScimToken(token *ScimToken) (bool, error) {
+	affected, err := engine.Insert(token)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+func UpdateScimToken(owner, name string, token *ScimToken) (bool, error) {
+	affected, err := engine.Where("owner = ? AND name = ?", owner, name).AllCols().Update(token)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package models
+
+import (
+	"fmt"
+)
+
+// Session is a sign-in to the console from one browser or device. Its name is carried as the sid
+// claim of the console token, and OAuth grants and SAML responses issued through it are attached,
+// so signing a session out ends all of them.
+type Session struct {
+	Owner       string `xorm:"varchar(100) notnull pk" json:"owner"`
+	Name        string `xorm:"varchar(100) notnull pk" json:"name"`
+	CreatedTime string `xorm:"varchar(100)" json:"createdTime"` // First seen
+
+	UserId       int64    `xorm:"index" json:"userId"`
+	Device       string   `xorm:"varchar(200)" json:"device"` // Browser and operating system parsed from the User-Agent
+	UserAgent    string   `xorm:"varchar(500)" json:"userAgent"`
+	Ip           string   `xorm:"varchar(100)" json:"ip"` // Address of the latest request
+	LastSeenTime string   `xorm:"varchar(100)" json:"lastSeenTime"`
+	ExpiresAt    int64    `json:"expiresAt"`                             // Expiry of the console token
+	Amr          []string `xorm:"text json" json:"amr"`                  // Authentication methods of the sign-in (RFC 8176)
+	Applications []string `xorm:"text json" json:"applications"`         // Owner/name IDs of the applications signed in to through the session
+	RevokedTime  string   `xorm:"varchar(100) index" json:"revokedTime"` // Empty while the session is signed in
+}
+
+func (s *Session) GetId() string {
+	return fmt.Sprintf("%s/%s", s.Owner, s.Name)
+}
+
+func AddSession(session *Session) (bool, error) {
+	affected, err := engine.Insert(session)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+func GetSession(owner, name string) (*Session, error) {
+	if owner == "" || name == "" {
+		return nil, nil
+	}
+
+	session := Session{Owner: owner, Name: name}
+	existed, err := engine.Get(&session)
+	if err != nil {
+		return nil, err
+	}
+
+	if existed {
+		return &session, nil
+	}
+	return nil, nil
+}
+
+// GetUserSessions returns the sessions of a user that have not been signed out, most recently used first
+func GetUserSessions(userId int64) ([]*Session, error) {
+	sessions := []*Session{}
+	err := engine.Where("user_id = ? AND revoked_time = ''", userId).Desc("last_seen_time").Find(&sessions)
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// UpdateSessionActivity updates only the last seen columns of a session
+func UpdateSessionActivity(session *Session) (bool, error) {
+	affected, err := engine.Where("owner = ? AND name = ?", session.Owner, session.Name).Cols("ip", "last_seen_time").Update(session)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// UpdateSessionApplications updates only the applications of a session
+func UpdateSessionApplications(session *Session) (bool, error) {
+	affected, err := engine.Where("owner = ? AND name = ?", session.Owner, session.Name).Cols("applications").Update(session)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// RevokeSession marks a session as signed out, unless it already is
+func RevokeSession(session *Session) (bool, error) {
+	affected, err := engine.Where("owner = ? AND name = ? AND revoked_time = ''", session.Owner, session.Name).Cols("revoked_time").Update(session)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"log"
 	"time"
 )
 
@@ -19,24 +20,36 @@ type Token struct {
 	Organization string `xorm:"varchar(100)" json:"organization"`
 	User         string `xorm:"varchar(100)" json:"user"`
 
-	Code             string `xorm:"varchar(100) index" json:"code"`
-	AccessToken      string `xorm:"mediumtext" json:"accessToken"`
-	RefreshToken     string `xorm:"mediumtext" json:"refreshToken"`
-	AccessTokenHash  string `xorm:"varchar(100) index" json:"accessTokenHash"`
-	RefreshTokenHash string `xorm:"varchar(100) index" json:"refreshTokenHash"`
-	ExpiresIn        int    `json:"expiresIn"`        // Token有效期长度（秒）
-	ExpiresAt        int64  `json:"expiresAt"`        // Access Token过期时间戳
-	RefreshExpiresAt int64  `json:"refreshExpiresAt"` // Refresh Token过期时间戳
-	Scope            string `xorm:"varchar(100)" json:"scope"`
-	TokenType        string `xorm:"varchar(100)" json:"tokenType"`
-	CodeChallenge    string `xorm:"varchar(100)" json:"codeChallenge"`
-	CodeIsUsed       bool   `json:"codeIsUsed"`
-	CodeExpireIn     int64  `json:"codeExpireIn"`
-	Resource         string `xorm:"varchar(255)" json:"resource"`
+	Code             string   `xorm:"varchar(100) index" json:"code"`
+	AccessToken      string   `xorm:"-" json:"-"` // Plaintext is only held in memory when issued, never persisted
+	RefreshToken     string   `xorm:"-" json:"-"`
+	AccessTokenHash  string   `xorm:"varchar(100) index" json:"accessTokenHash"`
+	RefreshTokenHash string   `xorm:"varchar(100) index" json:"refreshTokenHash"`
+	Jti              string   `xorm:"varchar(100) index" json:"jti"` // Access token JWT ID
+	Nonce            string   `xorm:"varchar(255)" json:"-"`         // OIDC nonce from the authorization request
+	ExpiresIn        int      `json:"expiresIn"`                     // Token有效期长度（秒）
+	ExpiresAt        int64    `json:"expiresAt"`                     // Access Token过期时间戳
+	RefreshExpiresAt int64    `json:"refreshExpiresAt"`              // Refresh Token过期时间戳
+	Scope            string   `xorm:"varchar(100)" json:"scope"`
+	TokenType        string   `xorm:"varchar(100)" json:"tokenType"`
+	CodeChallenge    string   `xorm:"varchar(100)" json:"codeChallenge"`
+	CodeIsUsed       bool     `json:"codeIsUsed"`
+	CodeExpireIn     int64    `json:"codeExpireIn"`
+	Resource         string   `xorm:"varchar(255)" json:"resource"`
+	Claims           string   `xorm:"text" json:"claims"`   // OIDC claims request parameter (JSON)
+	Amr              []string `xorm:"text json" json:"amr"` // Authentication methods used when the grant was issued (RFC 8176)
 
 	// OAuth 2.1 security enhancements
 	RefreshTokenUsed bool   `json:"refreshTokenUsed"`
 	TokenFamily      string `xorm:"varchar(100) index" json:"tokenFamily"`
+
+	// Refresh token rotation
+	RefreshAbsoluteExpiresAt int64  `json:"refreshAbsoluteExpiresAt"`        // Token family absolute expiry, 0 means no cap
+	RefreshedTo              string `xorm:"varchar(100)" json:"refreshedTo"` // Successor token name
+	RefreshedAt              int64  `json:"refreshedAt"`
+
+	// Console session the grant was issued through, revoked when the session is signed out
+	Session string `xorm:"varchar(100) index" json:"session"`
 }
 
 func (t *Token) GetId() string {
@@ -61,6 +74,24 @@ func (t *Token) PopulateHashes() {
 	}
 }
 
+// MaskTokenHash returns a short identifier for a token hash that is safe to display
+func MaskTokenHash(hash string) string {
+	if len(hash) < 12 {
+		return ""
+	}
+	return hash[:6] + "****" + hash[len(hash)-4:]
+}
+
+// MaskedAccessToken returns the display identifier of the access token
+func (t *Token) MaskedAccessToken() string {
+	return MaskTokenHash(t.AccessTokenHash)
+}
+
+// MaskedRefreshToken returns the display identifier of the refresh token
+func (t *Token) MaskedRefreshToken() string {
+	return MaskTokenHash(t.RefreshTokenHash)
+}
+
 func GetToken(owner, name string) (*Token, error) {
 	if owner == "" || name == "" {
 		return nil, nil
@@ -145,6 +176,38 @@ func UpdateTokenByCode(code string, token *Token) (bool, error) {
 	return affected != 0, nil
 }
 
+// SetTokenCredentials stores the hashes and lifetimes of tokens minted for an existing grant.
+// Revocation (expires_in) is left untouched so a concurrent revoke is never undone.
+func SetTokenCredentials(token *Token) (bool, error) {
+	token.PopulateHashes()
+
+	affected, err := engine.
+		Where("owner = ? AND name = ?", token.Owner, token.Name).
+		Cols("access_token_hash", "refresh_token_hash", "jti", "expires_at", "refresh_expires_at", "refresh_absolute_expires_at").
+		Update(token)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// RedeemTokenCode atomically marks an authorization code as used.
+// It returns false if the code was already redeemed, so concurrent redemptions cannot both succeed.
+func RedeemTokenCode(code string) (bool, error) {
+	if code == "" {
+		return false, nil
+	}
+
+	affected, err := engine.
+		Where("code = ? AND code_is_used = ?", code, false).
+		Cols("code_is_used").
+		Update(&Token{CodeIsUsed: true})
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
 func DeleteToken(owner, name string) (bool, error) {
 	affected, err := engine.Delete(&Token{Owner: owner, Name: name})
 	if err != nil {
@@ -177,6 +240,59 @@ func RevokeTokenFamily(tokenFamily string) error {
 	return err
 }
 
+// RevokeSessionTokens revokes every token family with a grant issued through a console session
+func RevokeSessionTokens(session string) error {
+	if session == "" {
+		return nil
+	}
+
+	_, err := engine.Where(`token_family IN (SELECT token_family FROM "token" WHERE session = ? AND token_family <> '')`, session).Cols("expires_in").Update(&Token{ExpiresIn: 0})
+	return err
+}
+
+// MarkRefreshTokenUsed atomically marks a refresh token as rotated to a successor.
+// It returns false if another request rotated the token first.
+func MarkRefreshTokenUsed(owner, name, successor string, refreshedAt int64) (bool, error) {
+	affected, err := engine.
+		Where("owner = ? AND name = ? AND refresh_token_used = ?", owner, name, false).
+		Cols("refresh_token_used", "refreshed_to", "refreshed_at").
+		Update(&Token{RefreshTokenUsed: true, RefreshedTo: successor, RefreshedAt: refreshedAt})
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// RevokeApplicationTokens revokes all tokens issued to an application
+func RevokeApplicationTokens(application string) error {
+	if application == "" {
+		return nil
+	}
+
+	_, err := engine.Where("application = ?", application).Cols("expires_in").Update(&Token{ExpiresIn: 0})
+	return err
+}
+
+// RevokeUserTokens revokes all tokens issued to a user
+func RevokeUserTokens(user string) error {
+	if user == "" {
+		return nil
+	}
+
+	_, err := engine.Where(`"user" = ?`, user).Cols("expires_in").Update(&Token{ExpiresIn: 0})
+	return err
+}
+
+// GetUserTokens returns the tokens issued to a user, newest first
+func GetUserTokens(user string) ([]*Token, error) {
+	tokens := []*Token{}
+	err := engine.Where(`"user" = ?`, user).Desc("created_time").Find(&tokens)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
 // IsAccessTokenExpired checks if the access token is expired
 func (t *Token) IsAccessTokenExpired() bool {
 	if t.ExpiresAt == 0 {
@@ -197,3 +313,65 @@ func (t *Token) IsRefreshTokenExpired() bool {
 func (t *Token) IsRevoked() bool {
 	return t.ExpiresIn <= 0
 }
+
+// migrateTokenPlaintext is a one-time migration for databases created before tokens were
+// stored by hash only. It backfills missing hashes and drops the plaintext token columns.
+func migrateTokenPlaintext() error {
+	tables, err := engine.DBMetas()
+	if err != nil {
+		return err
+	}
+
+	plaintextColumns := []string{}
+	for _, table := range tables {
+		if table.Name != "token" {
+			continue
+		}
+		for _, column := range []string{"access_token", "refresh_token"} {
+			if table.GetColumn(column) != nil {
+				plaintextColumns = append(plaintextColumns, column)
+			}
+		}
+	}
+	if len(plaintextColumns) == 0 {
+		return nil
+	}
+
+	session := engine.NewSession()
+	defer session.Close()
+	if err = session.Begin(); err != nil {
+		return err
+	}
+
+	if len(plaintextColumns) == 2 {
+		rows, err := session.QueryString(`SELECT owner, name, access_token, refresh_token, access_token_hash, refresh_token_hash FROM "token"`)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			token := &Token{AccessToken: row["access_token"], RefreshToken: row["refresh_token"], AccessTokenHash: row["access_token_hash"], RefreshTokenHash: row["refresh_token_hash"]}
+			if token.AccessTokenHash != "" && (token.RefreshTokenHash != "" || token.RefreshToken == "") {
+				continue
+			}
+			token.PopulateHashes()
+			_, err = session.Where("owner = ? AND name = ?", row["owner"], row["name"]).
+				Cols("access_token_hash", "refresh_token_hash").
+				Update(token)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, column := range plaintextColumns {
+		if _, err = session.Exec(fmt.Sprintf(`ALTER TABLE "token" DROP COLUMN %s`, column)); err != nil {
+			return err
+		}
+	}
+
+	if err = session.Commit(); err != nil {
+		return err
+	}
+	log.Printf("[DB] Removed plaintext token columns: %v", plaintextColumns)
+	return nil
+}
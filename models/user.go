@@ -4,29 +4,54 @@
 package models
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
+	"strings"
 )
 
 type User struct {
 	Id          int64  `xorm:"pk autoincr" json:"id"`
-	Owner       string `xorm:"varchar(100) notnull index" json:"owner"`
+	Owner       string `xorm:"varchar(100) notnull index unique(owner_username)" json:"owner"`
 	CreatedTime string `xorm:"varchar(100)" json:"createdTime"`
 	UpdatedTime string `xorm:"varchar(100)" json:"updatedTime"`
 
-	Type        string            `xorm:"varchar(100)" json:"type"`
-	Password    string            `xorm:"varchar(150)" json:"password"`
-	Username    string            `xorm:"varchar(100)" json:"username"`
-	Avatar      string            `xorm:"text" json:"avatar"`
-	Email       string            `xorm:"varchar(100) unique index" json:"email"`
-	QQ          string            `xorm:"'qq' varchar(20)" json:"qq"`
-	IsRealName  bool              `json:"isRealName"`
-	RealName    string            `xorm:"text" json:"-"` // 加密存储的真实姓名，不返回给前端
-	IDCard      string            `xorm:"text" json:"-"` // 加密存储的身份证号，不返回给前端
-	CountryCode string            `xorm:"varchar(6)" json:"countryCode"`
-	IsAdmin     bool              `json:"isAdmin"`
-	IsForbidden bool              `json:"isForbidden"`
-	IsDeleted   bool              `json:"isDeleted"`
-	Properties  map[string]string `xorm:"text json" json:"properties"`
+	Type          string            `xorm:"varchar(100)" json:"type"`
+	Password      string            `xorm:"varchar(150)" json:"password"`
+	PasswordType  string            `xorm:"varchar(100)" json:"passwordType"` // 密码哈希算法，为空时按哈希格式识别
+	PasswordSalt  string            `xorm:"varchar(100)" json:"-"`            // 导入的旧版加盐哈希使用的盐
+	Username      string            `xorm:"varchar(100) unique(owner_username)" json:"username"`
+	Avatar        string            `xorm:"text" json:"avatar"`
+	Email         string            `xorm:"varchar(100) unique index" json:"email"` // 仅手机号注册的用户邮箱为空，唯一索引只包含非空邮箱
+	EmailVerified bool              `json:"emailVerified"`                          // 邮箱是否已通过验证码确认归属
+	Phone         string            `xorm:"varchar(20) unique index" json:"phone"`  // E.164 格式，如 +8613800138000，唯一索引只包含已验证的号码
+	PhoneVerified bool              `json:"phoneVerified"`
+	QQ            string            `xorm:"'qq' varchar(20)" json:"qq"`
+	IsRealName    bool              `json:"isRealName"`
+	RealName      string            `xorm:"text" json:"-"` // 加密存储的真实姓名，不返回给前端
+	IDCard        string            `xorm:"text" json:"-"` // 加密存储的身份证号，不返回给前端
+	CountryCode   string            `xorm:"varchar(6)" json:"countryCode"`
+	IsAdmin       bool              `json:"isAdmin"`
+	IsForbidden   bool              `json:"isForbidden"`
+	IsDeleted     bool              `json:"isDeleted"`
+	Properties    map[string]string `xorm:"text json" json:"properties"`
+
+	// Multi-factor authentication
+	TotpSecret       string   `xorm:"text" json:"-"` // 加密存储的 TOTP 密钥，确认绑定前 TotpEnabled 为 false
+	TotpEnabled      bool     `json:"totpEnabled"`
+	TotpLastUsedStep int64    `json:"-"`                  // 最近一次使用的 TOTP 时间步，防止验证码重放
+	RecoveryCodes    []string `xorm:"text json" json:"-"` // 恢复码的哈希，每个只能使用一次
+
+	// Password policy
+	PasswordHistory     []string `xorm:"text json" json:"-"`                      // 之前使用过的密码哈希，最新的在前，用于禁止重复使用
+	PasswordChangedTime string   `xorm:"varchar(100)" json:"passwordChangedTime"` // 最近一次设置密码的时间，为空表示未知
+
+	// Email change
+	PreviousEmail    string `xorm:"varchar(100)" json:"-"` // 最近一次修改前的邮箱，撤销链接只能恢复到这个地址
+	EmailChangedTime string `xorm:"varchar(100)" json:"-"` // 最近一次修改邮箱的时间
+
+	// Account deletion
+	DeletionScheduledTime string `xorm:"varchar(100) index" json:"deletionScheduledTime"` // 用户申请注销后计划清除数据的时间（UTC），为空表示未申请
 
 	// OAuth fields
 	SignupApplication    string `xorm:"varchar(100)" json:"signupApplication"`
@@ -90,24 +115,41 @@ func GetUserByUsername(username string) (*User, error) {
 	return nil, nil
 }
 
-func GetUserByFields(owner, field string) (*User, error) {
-	// Try to get user by email or username
-	user, err := GetUserByEmail(field)
+// GetUserByPhone returns the user with a verified phone number.
+// Unverified numbers are never used to sign in or receive codes.
+func GetUserByPhone(phone string) (*User, error) {
+	if phone == "" {
+		return nil, nil
+	}
+
+	user := User{}
+	existed, err := engine.Where("phone = ? AND phone_verified = ?", phone, true).Get(&user)
 	if err != nil {
 		return nil, err
 	}
-	if user != nil {
-		return user, nil
+
+	if existed {
+		return &user, nil
+	}
+	return nil, nil
+}
+
+// GetUserByOwnerUsername returns the user of an organization with a username, ignoring case.
+// Usernames are only unique within an organization.
+func GetUserByOwnerUsername(owner, username string) (*User, error) {
+	if owner == "" || username == "" {
+		return nil, nil
 	}
 
-	user, err = GetUserByUsername(field)
+	user := User{}
+	existed, err := engine.Where("owner = ? AND lower(username) = lower(?)", owner, username).Get(&user)
 	if err != nil {
 		return nil, err
 	}
-	if user != nil {
-		return user, nil
-	}
 
+	if existed {
+		return &user, nil
+	}
 	return nil, nil
 }
 
@@ -136,6 +178,99 @@ func UpdateUser(id int64, user *User) (bool, error) {
 	return affected != 0, nil
 }
 
+// UpdateUserMfa updates only the multi-factor authentication columns of a user
+func UpdateUserMfa(user *User) (bool, error) {
+	affected, err := engine.ID(user.Id).Cols("totp_secret", "totp_enabled", "totp_last_used_step", "recovery_codes", "updated_time").Update(user)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// UpdateUserPassword updates only the password hash columns of a user
+func UpdateUserPassword(user *User) (bool, error) {
+	affected, err := engine.ID(user.Id).Cols("password", "password_type", "password_salt").Update(user)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// UpdateUserPhone updates only the phone number columns of a user
+func UpdateUserPhone(user *User) (bool, error) {
+	affected, err := engine.ID(user.Id).Cols("phone", "phone_verified", "updated_time").Update(user)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// UpdateUserEmail updates only the email columns of a user
+func UpdateUserEmail(user *User) (bool, error) {
+	affected, err := engine.ID(user.Id).Cols("email", "email_verified", "previous_email", "email_changed_time", "updated_time").Update(user)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// UpdateUserDeletion updates only the scheduled deletion column of a user
+func UpdateUserDeletion(user *User) (bool, error) {
+	affected, err := engine.ID(user.Id).Cols("deletion_scheduled_time", "updated_time").Update(user)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// GetUsersDueForDeletion returns the users whose scheduled deletion time has passed.
+// Times are stored as UTC RFC 3339 strings, so they compare in order.
+func GetUsersDueForDeletion(now string) ([]*User, error) {
+	users := []*User{}
+	err := engine.Where("deletion_scheduled_time <> '' AND deletion_scheduled_time <= ? AND is_deleted = ?", now, false).Find(&users)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// ClaimUserDeletion takes a user whose deletion is due for purging with a conditional update: the
+// schedule is cleared and the account disabled only if the deletion is still scheduled for the
+// given time, so a deletion cancelled in the meantime or claimed by another purge is skipped
+func ClaimUserDeletion(id int64, scheduledTime string) (bool, error) {
+	affected, err := engine.Where("id = ? AND deletion_scheduled_time = ? AND is_deleted = ?", id, scheduledTime, false).
+		Cols("deletion_scheduled_time", "is_forbidden").
+		Update(&User{DeletionScheduledTime: "", IsForbidden: true})
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// UseTotpStep records the time step of an accepted TOTP code with a conditional update,
+// so the same code (or an older one) cannot be accepted twice even by concurrent requests
+func UseTotpStep(userId int64, step int64) (bool, error) {
+	affected, err := engine.Where("id = ? AND totp_last_used_step < ?", userId, step).Cols("totp_last_used_step").Update(&User{TotpLastUsedStep: step})
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// ReplaceRecoveryCodes swaps the recovery codes of a user only if they are still the given ones,
+// so a recovery code consumed by a concurrent request cannot be used twice
+func ReplaceRecoveryCodes(userId int64, current, next []string) (bool, error) {
+	currentJson, err := json.Marshal(current)
+	if err != nil {
+		return false, err
+	}
+	affected, err := engine.Where("id = ? AND recovery_codes = ?", userId, string(currentJson)).Cols("recovery_codes").Update(&User{RecoveryCodes: next})
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
 func DeleteUser(id int64) (bool, error) {
 	affected, err := engine.ID(id).Delete(&User{})
 	if err != nil {
@@ -143,3 +278,154 @@ func DeleteUser(id int64) (bool, error) {
 	}
 	return affected != 0, nil
 }
+
+// migrateDuplicateUsernames is a one-time migration for databases created before usernames were
+// unique within an organization. It runs before the unique index is created and renames all but
+// the oldest of each set of usernames that differ only in case to <username>-<id>.
+func migrateDuplicateUsernames() error {
+	exists, err := engine.IsTableExist(new(User))
+	if err != nil || !exists {
+		return err
+	}
+
+	rows, err := engine.QueryString(`SELECT id, owner, username FROM "user" ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, row := range rows {
+		key := row["owner"] + "/" + strings.ToLower(row["username"])
+		if !seen[key] {
+			seen[key] = true
+			continue
+		}
+
+		username := fmt.Sprintf("%s-%s", row["username"], row["id"])
+		if row["username"] == "" {
+			username = fmt.Sprintf("user-%s", row["id"])
+		}
+		if _, err = engine.Exec(`UPDATE "user" SET username = ? WHERE id = ?`, username, row["id"]); err != nil {
+			return err
+		}
+		seen[row["owner"]+"/"+strings.ToLower(username)] = true
+		log.Printf("[DB] Renamed duplicate username %q of user %s to %q", row["username"], row["id"], username)
+	}
+	return nil
+}
+
+// emailVerifiedMissing reports whether the user table was created before email ownership was
+// tracked, in which case backfillEmailVerified has to run once the column has been added
+func emailVerifiedMissing() (bool, error) {
+	tables, err := engine.DBMetas()
+	if err != nil {
+		return false, err
+	}
+	for _, table := range tables {
+		if table.Name == "user" {
+			return table.GetColumn("email_verified") == nil, nil
+		}
+	}
+	return false, nil
+}
+
+// backfillEmailVerified is a one-time migration for users created before email_verified existed.
+// Signing up with an email and a password required a register code, so those addresses are marked
+// verified. Users added by an administrator (no type), provisioned through SCIM (properties) or
+// created from a provider (linked identity) never proved their address and are left unverified.
+func backfillEmailVerified() error {
+	result, err := engine.Exec(`UPDATE "user" SET email_verified = ? WHERE owner = ? AND type = ? AND email <> '' AND password <> ''
+		AND (properties IS NULL OR properties IN ('', 'null', '{}'))
+		AND id NOT IN (SELECT user_id FROM user_identity)`, true, "built-in", "normal-user")
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		log.Printf("[DB] Marked the email of %d registered users as verified", affected)
+	}
+	return nil
+}
+
+// userContactIndexes are the partial unique indexes on the contact columns of users. Sync2 knows
+// them as the unique indexes of the struct tags, which cannot express a WHERE clause, so they keep
+// the names Sync2 gives those indexes and are left alone once created.
+var userContactIndexes = []struct {
+	name    string
+	column  string
+	where   string
+	columns []string // Columns the index needs, added ahead of Sync2 the way Sync2 adds them
+	release string   // Gives up the value of a duplicate
+}{
+	{
+		name:    "UQE_user_email",
+		column:  "email",
+		where:   `email <> ''`,
+		columns: []string{"email_verified BOOL"},
+		release: `UPDATE "user" SET email = '', email_verified = false WHERE id = ?`,
+	},
+	{
+		name:    "UQE_user_phone",
+		column:  "phone",
+		where:   `phone <> '' AND phone_verified = true`,
+		columns: []string{"phone VARCHAR(20)", "phone_verified BOOL"},
+		release: `UPDATE "user" SET phone_verified = false WHERE id = ?`,
+	},
+}
+
+// ensureUserContactIndexes makes sure non-empty emails and verified phone numbers are unique. Before
+// Sync2 it creates the partial indexes on existing tables, so Sync2 does not try to create full unique
+// indexes that empty emails and unverified numbers would violate; after Sync2 it replaces the full
+// indexes Sync2 creates with a new table.
+func ensureUserContactIndexes() error {
+	exists, err := engine.IsTableExist(new(User))
+	if err != nil || !exists {
+		return err
+	}
+
+	for _, index := range userContactIndexes {
+		rows, err := engine.QueryString(`SELECT indexdef FROM pg_indexes WHERE tablename = 'user' AND indexname = ?`, index.name)
+		if err != nil {
+			return err
+		}
+		if len(rows) > 0 && strings.Contains(rows[0]["indexdef"], " WHERE ") {
+			continue
+		}
+
+		for _, column := range index.columns {
+			if _, err := engine.Exec(fmt.Sprintf(`ALTER TABLE "user" ADD COLUMN IF NOT EXISTS %s`, column)); err != nil {
+				return err
+			}
+		}
+		if err := migrateDuplicateContacts(index.column, index.where, index.release); err != nil {
+			return err
+		}
+		if _, err := engine.Exec(fmt.Sprintf(`DROP INDEX IF EXISTS "%s"`, index.name)); err != nil {
+			return err
+		}
+		if _, err := engine.Exec(fmt.Sprintf(`CREATE UNIQUE INDEX "%s" ON "user" (%s) WHERE %s`, index.name, index.column, index.where)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDuplicateContacts is a one-time migration for databases created while uniqueness of emails
+// and verified phone numbers was only checked before inserts. Of each set of users sharing a value,
+// the oldest user that is not deleted keeps it; the others give it up and have to prove it again.
+func migrateDuplicateContacts(column, where, release string) error {
+	rows, err := engine.QueryString(fmt.Sprintf(`SELECT id, %s FROM "user" WHERE %s ORDER BY is_deleted, id`, column, where))
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, row := range rows {
+		if !seen[row[column]] {
+			seen[row[column]] = true
+			continue
+		}
+		if _, err = engine.Exec(release, row["id"]); err != nil {
+			return err
+		}
+		log.Printf("[DB] Released the duplicate %s %q of user %s", column, row[column], row["id"])
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package models
+
+import (
+	"fmt"
+)
+
+// UserIdentity links a local user to an account at an upstream identity provider.
+// Each upstream account (provider and subject) belongs to at most one local user.
+type UserIdentity struct {
+	Owner       string `xorm:"varchar(100) notnull pk" json:"owner"`
+	Name        string `xorm:"varchar(100) notnull pk" json:"name"`
+	CreatedTime string `xorm:"varchar(100)" json:"createdTime"`
+
+	UserId   int64  `xorm:"index" json:"userId"`
+	Provider string `xorm:"varchar(100) notnull unique(provider_subject)" json:"provider"` // Provider name
+	Subject  string `xorm:"varchar(200) notnull unique(provider_subject)" json:"subject"`  // User ID at the provider
+
+	// Profile reported by the provider at the last sign-in, for display
+	Username     string `xorm:"varchar(100)" json:"username"`
+	Email        string `xorm:"varchar(100)" json:"email"`
+	Avatar       string `xorm:"text" json:"avatar"`
+	LastUsedTime string `xorm:"varchar(100)" json:"lastUsedTime"`
+}
+
+func (i *UserIdentity) GetId() string {
+	return fmt.Sprintf("%s/%s", i.Owner, i.Name)
+}
+
+func AddUserIdentity(identity *UserIdentity) (bool, error) {
+	affected, err := engine.Insert(identity)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+func GetUserIdentity(owner, name string) (*UserIdentity, error) {
+	if owner == "" || name == "" {
+		return nil, nil
+	}
+
+	identity := UserIdentity{Owner: owner, Name: name}
+	existed, err := engine.Get(&identity)
+	if err != nil {
+		return nil, err
+	}
+
+	if existed {
+		return &identity, nil
+	}
+	return nil, nil
+}
+
+// GetUserIdentityBySubject looks up the link of an upstream account
+func GetUserIdentityBySubject(provider, subject string) (*UserIdentity, error) {
+	if provider == "" || subject == "" {
+		return nil, nil
+	}
+
+	identity := UserIdentity{Provider: provider, Subject: subject}
+	existed, err := engine.Get(&identity)
+	if err != nil {
+		return nil, err
+	}
+
+	if existed {
+		return &identity, nil
+	}
+	return nil, nil
+}
+
+// GetUserIdentities returns the upstream accounts linked to a user
+func GetUserIdentities(userId int64) ([]*UserIdentity, error) {
+	identities := []*UserIdentity{}
+	err := engine.Where("user_id = ?", userId).Asc("created_time").Find(&identities)
+	if err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+// GetUserIdentitiesByProvider returns all accounts linked through a provider
+func GetUserIdentitiesByProvider(provider string) ([]*UserIdentity, error) {
+	identities := []*UserIdentity{}
+	err := engine.Where("provider = ?", provider).Asc("created_time").Find(&identities)
+	if err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+// UpdateUserIdentityProfile records a sign-in and the profile reported by the provider
+func UpdateUserIdentityProfile(identity *UserIdentity) (bool, error) {
+	identity.LastUsedTime = GetCurrentTime()
+	affected, err := engine.Where("owner = ? AND name = ?", identity.Owner, identity.Name).Cols("username", "email", "avatar", "last_used_time").Update(identity)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// DeleteUserIdentities removes every upstream account linked to a user
+func DeleteUserIdentities(userId int64) error {
+	_, err := engine.Where("user_id = ?", userId).Delete(&UserIdentity{})
+	return err
+}
+
+func DeleteUserIdentity(owner, name string) (bool, error) {
+	affected, err := engine.Where("owner = ? AND name = ?", owner, name).Delete(&UserIdentity{})
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package models
+
+import (
+	"fmt"
+)
+
+// WebauthnCredential is a WebAuthn public key credential (passkey or security key) of a user.
+// A user may register several credentials; each can sign in without a password
+// or be used as a second factor after the password.
+type WebauthnCredential struct {
+	Owner       string `xorm:"varchar(100) notnull pk" json:"owner"`
+	Name        string `xorm:"varchar(100) notnull pk" json:"name"`
+	CreatedTime string `xorm:"varchar(100)" json:"createdTime"`
+
+	UserId       int64    `xorm:"index" json:"userId"`
+	DisplayName  string   `xorm:"varchar(100)" json:"displayName"`
+	CredentialId string   `xorm:"varchar(1400) unique" json:"credentialId"` // base64url raw credential ID
+	UserHandle   string   `xorm:"varchar(100) index" json:"-"`              // base64url user handle given to the authenticator
+	PublicKey    string   `xorm:"text" json:"-"`                            // base64url COSE public key
+	Algorithm    int      `json:"algorithm"`                                // COSE algorithm identifier
+	SignCount    int64    `json:"signCount"`
+	Aaguid       string   `xorm:"varchar(100)" json:"aaguid"`
+	Transports   []string `xorm:"text json" json:"transports"`
+
+	IsDiscoverable bool   `json:"isDiscoverable"` // Resident key, usable for passwordless sign-in without a username
+	BackupEligible bool   `json:"backupEligible"` // Synced passkey
+	BackupState    bool   `json:"backupState"`
+	LastUsedTime   string `xorm:"varchar(100)" json:"lastUsedTime"`
+}
+
+func (c *WebauthnCredential) GetId() string {
+	return fmt.Sprintf("%s/%s", c.Owner, c.Name)
+}
+
+func AddWebauthnCredential(credential *WebauthnCredential) (bool, error) {
+	affected, err := engine.Insert(credential)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+func GetWebauthnCredential(owner, name string) (*WebauthnCredential, error) {
+	if owner == "" || name == "" {
+		return nil, nil
+	}
+
+	credential := WebauthnCredential{Owner: owner, Name: name}
+	existed, err := engine.Get(&credential)
+	if err != nil {
+		return nil, err
+	}
+
+	if existed {
+		return &credential, nil
+	}
+	return nil, nil
+}
+
+// GetWebauthnCredentialByCredentialId looks up a credential by its base64url credential ID
+func GetWebauthnCredentialByCredentialId(credentialId string) (*WebauthnCredential, error) {
+	if credentialId == "" {
+		return nil, nil
+	}
+
+	credential := WebauthnCredential{CredentialId: credentialId}
+	existed, err := engine.Get(&credential)
+	if err != nil {
+		return nil, err
+	}
+
+	if existed {
+		return &credential, nil
+	}
+	return nil, nil
+}
+
+// GetUserWebauthnCredentials returns the credentials of a user, newest first
+func GetUserWebauthnCredentials(userId int64) ([]*WebauthnCredential, error) {
+	credentials := []*WebauthnCredential{}
+	err := engine.Where("user_id = ?", userId).Desc("created_time").Find(&credentials)
+	if err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// CountUserWebauthnCredentials returns how many credentials a user has registered
+func CountUserWebauthnCredentials(userId int64) (int64, error) {
+	return engine.Where("user_id = ?", userId).Count(&WebauthnCredential{})
+}
+
+// UpdateWebauthnCredentialUsage records a successful assertion. The signature counter is only
+// moved forward with a conditional update so a cloned authenticator cannot race the real one.
+func UpdateWebauthnCredentialUsage(credential *WebauthnCredential, signCount int64) (bool, error) {
+	session := engine.Where("owner = ? AND name = ?", credential.Owner, credential.Name)
+	if signCount != 0 {
+		session = session.And("sign_count < ?", signCount)
+	}
+
+	credential.SignCount = signCount
+	credential.LastUsedTime = GetCurrentTime()
+	affected, err := session.Cols("sign_count", "backup_state", "last_used_time").Update(credential)
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+func DeleteWebauthnCredential(owner, name string) (bool, error) {
+	affected, err := engine.Where("owner = ? AND name = ?", owner, name).Delete(&WebauthnCredential{})
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// DeleteUserWebauthnCredentials removes every credential of a user
+func DeleteUserWebauthnCredentials(userId int64) error {
+	_, err := engine.Where("user_id = ?", userId).Delete(&WebauthnCredential{})
+	return err
+}
@@ -6,6 +6,7 @@ package routers
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/oauth-server/oauth-server/handlers"
@@ -53,26 +54,84 @@ func RegisterRoutes(app *fiber.App) {
 	app.Get("/.well-known/openid-configuration", handlers.HandleDiscovery())
 	app.Get("/.well-known/jwks", handlers.HandleJwks())
 
+	// SCIM 2.0 用户同步端点（需要 SCIM 令牌）
+	scim := app.Group("/scim/v2", middlewares.ScimAuthMiddleware())
+	scim.Get("/ServiceProviderConfig", handlers.HandleScimServiceProviderConfig())
+	scim.Get("/Schemas", handlers.HandleScimSchemas())
+	scim.Get("/Schemas/:id", handlers.HandleScimSchemas())
+	scim.Get("/ResourceTypes", handlers.HandleScimResourceTypes())
+	scim.Get("/ResourceTypes/:id", handlers.HandleScimResourceTypes())
+	scim.Get("/Users", handlers.HandleScimGetUsers())
+	scim.Post("/Users", handlers.HandleScimCreateUser())
+	scim.Get("/Users/:id", handlers.HandleScimGetUser())
+	scim.Put("/Users/:id", handlers.HandleScimReplaceUser())
+	scim.Patch("/Users/:id", handlers.HandleScimPatchUser())
+	scim.Delete("/Users/:id", handlers.HandleScimDeleteUser())
+	scim.Get("/Groups", handlers.HandleScimGetGroups())
+	scim.Post("/Groups", handlers.HandleScimCreateGroup())
+	scim.Get("/Groups/:id", handlers.HandleScimGetGroup())
+	scim.Put("/Groups/:id", handlers.HandleScimReplaceGroup())
+	scim.Patch("/Groups/:id", handlers.HandleScimPatchGroup())
+	scim.Delete("/Groups/:id", handlers.HandleScimDeleteGroup())
+
 	// API 路由组
 	api := app.Group("/api")
 
+	// ========== 限流策略（可通过 RATE_LIMIT_<NAME> 环境变量覆盖） ==========
+	// 公开的认证接口共享按 IP 的额度，账户级别的锁定由各处理器负责
+	authLimit := middlewares.RateLimitMiddleware(middlewares.RateLimitPolicy{Name: "auth", Limit: 30, Period: time.Minute})
+	// 令牌、自省和撤销端点按客户端计数，未携带 client_id 时按 IP
+	tokenLimit := middlewares.RateLimitMiddleware(middlewares.RateLimitPolicy{Name: "token", Limit: 300, Period: time.Minute, KeyBy: middlewares.RateLimitByClient})
+	introspectLimit := middlewares.RateLimitMiddleware(middlewares.RateLimitPolicy{Name: "introspect", Limit: 600, Period: time.Minute, KeyBy: middlewares.RateLimitByClient})
+	// 动态客户端注册会创建应用
+	clientRegistrationLimit := middlewares.RateLimitMiddleware(middlewares.RateLimitPolicy{Name: "client-registration", Limit: 10, Period: time.Hour})
+	// 实名认证每次调用都会产生阿里云费用：每个用户每天 5 次，全站每小时 200 次
+	realNameUserLimit := middlewares.RateLimitMiddleware(middlewares.RateLimitPolicy{Name: "realname", Limit: 5, Period: 24 * time.Hour, KeyBy: middlewares.RateLimitByUser})
+	realNameRouteLimit := middlewares.RateLimitMiddleware(middlewares.RateLimitPolicy{Name: "realname-total", Limit: 200, Period: time.Hour, KeyBy: middlewares.RateLimitByRoute})
+	// 个人数据导出会读取账号的全部记录
+	exportLimit := middlewares.RateLimitMiddleware(middlewares.RateLimitPolicy{Name: "export", Limit: 10, Period: time.Hour, KeyBy: middlewares.RateLimitByUser})
+
 	// ========== 认证路由（公开，无需认证） ==========
-	api.Post("/auth/login", handlers.HandleLogin())
-	api.Post("/auth/register", handlers.HandleRegister())
-	api.Post("/auth/send-code", handlers.HandleSendVerificationCode())
-	api.Post("/auth/reset-password", handlers.HandleResetPassword())
+	api.Post("/auth/login", authLimit, handlers.HandleLogin())
+	api.Post("/auth/login-by-code", authLimit, handlers.HandleLoginByCode())
+	api.Post("/auth/mfa/verify", authLimit, handlers.HandleMfaVerify())
+	api.Post("/auth/webauthn/login/begin", authLimit, handlers.HandleWebauthnLoginBegin())
+	api.Post("/auth/webauthn/login/finish", authLimit, handlers.HandleWebauthnLoginFinish())
+	api.Post("/auth/register", authLimit, handlers.HandleRegister())
+	api.Post("/auth/send-code", authLimit, handlers.HandleSendVerificationCode())
+	api.Post("/auth/reset-password", authLimit, handlers.HandleResetPassword())
+	api.Post("/auth/email/revert", authLimit, handlers.HandleRevertEmailChange())
 	api.Get("/auth/application-info", handlers.HandleGetApplicationInfo())
 
+	// 第三方登录
+	api.Get("/auth/providers", handlers.HandleGetLoginProviders())
+	api.Get("/auth/provider/:name/login", handlers.HandleProviderLogin())
+	api.Get("/auth/provider/:name/callback", handlers.HandleProviderCallback())
+	api.Post("/auth/provider/finish", authLimit, handlers.HandleProviderLoginFinish())
+
+	// SAML 2.0 身份提供商
+	api.Get("/saml/metadata", handlers.HandleSamlMetadata())
+	api.Get("/saml/sso", handlers.HandleSamlSso())
+	api.Post("/saml/sso", handlers.HandleSamlSso())
+	api.Post("/saml/sso/complete", middlewares.JWTAuthMiddleware(), handlers.HandleSamlSsoComplete())
+	api.Get("/saml/slo", handlers.HandleSamlSlo())
+	api.Post("/saml/slo", handlers.HandleSamlSlo())
+	api.Post("/saml/slo/complete", middlewares.OptionalJWTAuthMiddleware(), handlers.HandleSamlSloComplete())
+
 	// ========== Token 路由（公开） ==========
-	api.Post("/oauth/token", handlers.HandleToken())
-	api.Post("/login/oauth/access_token", handlers.HandleToken()) // 兼容别名
-	api.Post("/oauth/introspect", handlers.HandleIntrospect())
-	api.Post("/login/oauth/introspect", handlers.HandleIntrospect()) // 兼容别名
-	api.Post("/oauth/revoke", handlers.HandleRevoke())
-	api.Post("/oauth/register", handlers.HandleOidcRegister())
+	api.Post("/oauth/token", tokenLimit, handlers.HandleToken())
+	api.Post("/login/oauth/access_token", tokenLimit, handlers.HandleToken()) // 兼容别名
+	api.Post("/oauth/introspect", introspectLimit, handlers.HandleIntrospect())
+	api.Post("/login/oauth/introspect", introspectLimit, handlers.HandleIntrospect()) // 兼容别名
+	api.Post("/oauth/revoke", introspectLimit, handlers.HandleRevoke())
+	api.Post("/oauth/register", clientRegistrationLimit, handlers.HandleOidcRegister())
+	api.Get("/oauth/register/:clientId", handlers.HandleGetRegisteredClient())
+	api.Put("/oauth/register/:clientId", handlers.HandleUpdateRegisteredClient())
+	api.Delete("/oauth/register/:clientId", handlers.HandleDeleteRegisteredClient())
 
 	// ========== 需要认证的路由 ==========
 	api.Post("/auth/update-profile", middlewares.JWTAuthMiddleware(), handlers.HandleUpdateProfile())
+	api.Post("/auth/logout", middlewares.JWTAuthMiddleware(), handlers.HandleLogout())
 	api.Get("/userinfo", middlewares.JWTAuthMiddleware(), handlers.HandleUserInfo())
 
 	// 用户令牌和授权管理
@@ -80,6 +139,45 @@ func RegisterRoutes(app *fiber.App) {
 	api.Post("/user/tokens/:name/revoke", middlewares.JWTAuthMiddleware(), handlers.HandleRevokeUserToken())
 	api.Get("/user/applications", middlewares.JWTAuthMiddleware(), handlers.HandleGetUserApplications())
 
+	// 两步验证（TOTP）
+	api.Get("/user/mfa", middlewares.JWTAuthMiddleware(), handlers.HandleGetMfaStatus())
+	api.Post("/user/mfa/totp/setup", middlewares.JWTAuthMiddleware(), handlers.HandleSetupTotp())
+	api.Post("/user/mfa/totp/confirm", middlewares.JWTAuthMiddleware(), handlers.HandleConfirmTotp())
+	api.Post("/user/mfa/totp/disable", middlewares.JWTAuthMiddleware(), handlers.HandleDisableTotp())
+	api.Post("/user/mfa/recovery-codes", middlewares.JWTAuthMiddleware(), handlers.HandleRegenerateRecoveryCodes())
+
+	// 通行密钥（WebAuthn）
+	api.Post("/auth/webauthn/register/begin", middlewares.JWTAuthMiddleware(), handlers.HandleWebauthnRegisterBegin())
+	api.Post("/auth/webauthn/register/finish", middlewares.JWTAuthMiddleware(), handlers.HandleWebauthnRegisterFinish())
+	api.Get("/user/webauthn/credentials", middlewares.JWTAuthMiddleware(), handlers.HandleGetWebauthnCredentials())
+	api.Post("/user/webauthn/credentials/:name/revoke", middlewares.JWTAuthMiddleware(), handlers.HandleRevokeWebauthnCredential())
+
+	// 手机号绑定
+	api.Post("/user/phone/send-code", middlewares.JWTAuthMiddleware(), handlers.HandleSendPhoneBindCode())
+	api.Post("/user/phone/verify", middlewares.JWTAuthMiddleware(), handlers.HandleVerifyPhone())
+	api.Post("/user/phone/remove", middlewares.JWTAuthMiddleware(), handlers.HandleRemovePhone())
+
+	// 更换邮箱：验证码发往新邮箱，旧邮箱收到撤销链接
+	api.Post("/user/email/send-code", middlewares.JWTAuthMiddleware(), handlers.HandleSendEmailChangeCode())
+	api.Post("/user/email/verify", middlewares.JWTAuthMiddleware(), handlers.HandleVerifyEmailChange())
+
+	// 个人数据导出和账号注销
+	api.Get("/user/export", middlewares.JWTAuthMiddleware(), exportLimit, handlers.HandleExportAccount())
+	api.Get("/user/delete", middlewares.JWTAuthMiddleware(), handlers.HandleGetAccountDeletion())
+	api.Post("/user/delete/send-code", middlewares.JWTAuthMiddleware(), authLimit, handlers.HandleSendDeleteAccountCode())
+	api.Post("/user/delete", middlewares.JWTAuthMiddleware(), authLimit, handlers.HandleDeleteAccount())
+	api.Post("/user/delete/cancel", middlewares.JWTAuthMiddleware(), handlers.HandleCancelAccountDeletion())
+
+	// 登录设备管理
+	api.Get("/user/sessions", middlewares.JWTAuthMiddleware(), handlers.HandleGetSessions())
+	api.Post("/user/sessions/revoke-all", middlewares.JWTAuthMiddleware(), handlers.HandleRevokeAllSessions())
+	api.Post("/user/sessions/:name/revoke", middlewares.JWTAuthMiddleware(), handlers.HandleRevokeSession())
+
+	// 第三方账号绑定
+	api.Get("/user/identities", middlewares.JWTAuthMiddleware(), handlers.HandleGetUserIdentities())
+	api.Post("/user/identities/:provider/link", middlewares.JWTAuthMiddleware(), handlers.HandleLinkProvider())
+	api.Post("/user/identities/:name/unlink", middlewares.JWTAuthMiddleware(), handlers.HandleUnlinkIdentity())
+
 	// ========== 管理员路由（需要 JWT 认证 + 管理员权限） ==========
 	admin := api.Group("/admin", middlewares.JWTAuthMiddleware(), middlewares.AdminAuthMiddleware())
 
@@ -91,6 +189,8 @@ func RegisterRoutes(app *fiber.App) {
 	admin.Post("/users/:id/delete", handlers.HandleDeleteUser())
 	admin.Post("/users/:id/ban", handlers.HandleBanUser())
 	admin.Post("/users/:id/unban", handlers.HandleUnbanUser())
+	admin.Post("/users/:id/unlock", handlers.HandleUnlockUser())
+	admin.Post("/users/:id/mfa/reset", handlers.HandleAdminResetMfa())
 
 	// 应用管理
 	admin.Get("/applications", handlers.HandleGetApplications())
@@ -98,6 +198,32 @@ func RegisterRoutes(app *fiber.App) {
 	admin.Get("/applications/:owner/:name", handlers.HandleGetApplication())
 	admin.Post("/applications/:owner/:name/update", handlers.HandleUpdateApplication())
 	admin.Post("/applications/:owner/:name/delete", handlers.HandleDeleteApplication())
+	admin.Post("/applications/:owner/:name/approve", handlers.HandleApproveApplication())
+	admin.Get("/applications/:owner/:name/secrets", handlers.HandleGetClientSecrets())
+	admin.Post("/applications/:owner/:name/secrets", handlers.HandleRotateClientSecret())
+	admin.Post("/applications/:owner/:name/secrets/:secret/revoke", handlers.HandleRevokeClientSecret())
+
+	// 动态客户端注册管理
+	admin.Get("/initial-access-tokens", handlers.HandleGetInitialAccessTokens())
+	admin.Post("/initial-access-tokens", handlers.HandleCreateInitialAccessToken())
+	admin.Post("/initial-access-tokens/:owner/:name/revoke", handlers.HandleRevokeInitialAccessToken())
+	admin.Post("/organizations/:owner/:name/dcr-policy", handlers.HandleUpdateDcrPolicy())
+	admin.Post("/organizations/:owner/:name/password-type", handlers.HandleUpdatePasswordType())
+	admin.Post("/organizations/:owner/:name/password-policy", handlers.HandleUpdatePasswordPolicy())
+	admin.Post("/organizations/:owner/:name/signin-identifiers", handlers.HandleUpdateSigninIdentifiers())
+
+	// SCIM 令牌管理
+	admin.Get("/scim-tokens", handlers.HandleGetScimTokens())
+	admin.Post("/scim-tokens", handlers.HandleCreateScimToken())
+	admin.Post("/scim-tokens/:owner/:name/revoke", handlers.HandleRevokeScimToken())
+
+	// 登录提供商管理
+	admin.Get("/providers", handlers.HandleGetProviders())
+	admin.Post("/providers", handlers.HandleCreateProvider())
+	admin.Post("/providers/:owner/:name/update", handlers.HandleUpdateProvider())
+	admin.Post("/providers/:owner/:name/delete", handlers.HandleDeleteProvider())
+	admin.Post("/providers/:owner/:name/test", handlers.HandleTestLdapProvider())
+	admin.Post("/providers/:owner/:name/sync", handlers.HandleSyncLdapProvider())
 
 	// Token 管理
 	admin.Get("/tokens", handlers.HandleGetTokens())
@@ -111,7 +237,7 @@ func RegisterRoutes(app *fiber.App) {
 
 	// ========== 实名认证路由 ==========
 	// 提交实名认证（需要 JWT 认证）
-	api.Post("/realname/submit", middlewares.JWTAuthMiddleware(), handlers.HandleSubmitRealName())
+	api.Post("/realname/submit", middlewares.JWTAuthMiddleware(), realNameUserLimit, realNameRouteLimit, handlers.HandleSubmitRealName())
 	api.Get("/realname/verify", middlewares.JWTAuthMiddleware(), handlers.HandleGetRealNameInfo())
 
 	// 管理员验证实名信息（需要管理员权限）
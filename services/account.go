@@ -0,0 +1,531 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// PurposeDeleteAccount is the verification code purpose for confirming an account deletion
+const PurposeDeleteAccount = "delete_account"
+
+const (
+	// defaultAccountDeletionGraceDays is how long a deletion can be cancelled unless ACCOUNT_DELETION_GRACE_DAYS is set
+	defaultAccountDeletionGraceDays = 14
+	// accountPurgeInterval is how often accounts whose grace period has ended are purged
+	accountPurgeInterval = time.Hour
+	// loginHistoryExportLimit caps the sign-ins included in a data export
+	loginHistoryExportLimit = 1000
+)
+
+var (
+	ErrReauthRequired              = errors.New("re-authentication required")
+	ErrAccountDeletionNotScheduled = errors.New("account deletion is not scheduled")
+	ErrAdminAccountDeletion        = errors.New("administrator accounts cannot be deleted")
+)
+
+// AccountDeletionGracePeriod returns how long a scheduled deletion waits before the account is purged
+func AccountDeletionGracePeriod() time.Duration {
+	days := defaultAccountDeletionGraceDays
+	if value := os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			days = parsed
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// DeleteAccountCodeTarget returns where the code confirming a deletion is sent:
+// the email address when the account has one, otherwise the phone number
+func DeleteAccountCodeTarget(user *models.User) string {
+	if user.Email != "" {
+		return user.Email
+	}
+	return user.Phone
+}
+
+// SendDeleteAccountCode sends the code confirming a deletion to the email address or phone number of a user
+func SendDeleteAccountCode(user *models.User) (string, error) {
+	if user.Email != "" {
+		return SendVerificationEmail(user.Email, PurposeDeleteAccount)
+	}
+	if user.Phone != "" {
+		return SendSmsVerificationCode(user.Phone, PurposeDeleteAccount)
+	}
+	return "", ErrReauthRequired
+}
+
+// ReauthenticateUser checks that the person asking to delete an account still holds it: the
+// current password or a code sent to the account, plus the second factor when TOTP is enabled
+func ReauthenticateUser(user *models.User, password, code, totpCode, recoveryCode string) error {
+	switch {
+	case password != "" && user.Password != "":
+		valid, err := VerifyUserPassword(user, password)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			return ErrInvalidCredentials
+		}
+	case code != "":
+		if _, err := VerifyCode(DeleteAccountCodeTarget(user), code, PurposeDeleteAccount); err != nil {
+			return err
+		}
+	default:
+		return ErrReauthRequired
+	}
+
+	if user.TotpEnabled {
+		if totpCode == "" && recoveryCode == "" {
+			return ErrReauthRequired
+		}
+		if _, err := VerifySecondFactor(user, totpCode, recoveryCode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScheduleAccountDeletion marks an account for deletion at the end of the grace period and
+// returns the time it will be purged. The account can be used and the deletion cancelled
+// until then; without a grace period it is purged at once.
+func ScheduleAccountDeletion(user *models.User) (time.Time, error) {
+	if user.IsAdmin {
+		return time.Time{}, ErrAdminAccountDeletion
+	}
+
+	now := time.Now().UTC()
+	grace := AccountDeletionGracePeriod()
+	if grace <= 0 {
+		return now, PurgeAccount(user)
+	}
+
+	purgeTime := now.Add(grace)
+	user.DeletionScheduledTime = purgeTime.Format(time.RFC3339)
+	user.UpdatedTime = now.Format(time.RFC3339)
+	if _, err := models.UpdateUserDeletion(user); err != nil {
+		return time.Time{}, err
+	}
+	log.Printf("[Account] User %d scheduled deletion for %s", user.Id, user.DeletionScheduledTime)
+	return purgeTime, nil
+}
+
+// CancelAccountDeletion keeps an account whose deletion is still in its grace period
+func CancelAccountDeletion(user *models.User) error {
+	if user.DeletionScheduledTime == "" {
+		return ErrAccountDeletionNotScheduled
+	}
+
+	user.DeletionScheduledTime = ""
+	user.UpdatedTime = time.Now().Format(time.RFC3339)
+	if _, err := models.UpdateUserDeletion(user); err != nil {
+		return err
+	}
+	log.Printf("[Account] User %d cancelled the scheduled deletion", user.Id)
+	return nil
+}
+
+// PurgeAccount revokes every token of a user, removes the data linked to the account and
+// clears the personal data of the user row, including the encrypted real name and ID card.
+// The row itself is kept as a deleted placeholder so that IDs in issued tokens and logs never
+// point to another account.
+func PurgeAccount(user *models.User) error {
+	if err := models.RevokeUserTokens(user.GetId()); err != nil {
+		return err
+	}
+	if _, err := SignOutAllSessions(user, ""); err != nil {
+		return err
+	}
+	if err := models.DeleteUserWebauthnCredentials(user.Id); err != nil {
+		return err
+	}
+	if err := models.DeleteUserIdentities(user.Id); err != nil {
+		return err
+	}
+	if err := models.DeleteUserLoginRecords(user.Id); err != nil {
+		return err
+	}
+
+	anonymizeUser(user, time.Now())
+	if _, err := models.UpdateUser(user.Id, user); err != nil {
+		return err
+	}
+	log.Printf("[Account] Purged user %d", user.Id)
+	return nil
+}
+
+// anonymizeUser clears every personal field of a user and marks the account deleted
+func anonymizeUser(user *models.User, now time.Time) {
+	user.Username = fmt.Sprintf("deleted-%d", user.Id)
+	user.Avatar = ""
+	user.Email = ""
+	user.EmailVerified = false
+	user.PreviousEmail = ""
+	user.EmailChangedTime = ""
+	user.Phone = ""
+	user.PhoneVerified = false
+	user.QQ = ""
+	user.CountryCode = ""
+	user.IsRealName = false
+	user.RealName = ""
+	user.IDCard = ""
+	user.Properties = nil
+
+	user.Password = ""
+	user.PasswordType = ""
+	user.PasswordSalt = ""
+	user.PasswordHistory = nil
+	user.PasswordChangedTime = ""
+	user.TotpSecret = ""
+	user.TotpEnabled = false
+	user.RecoveryCodes = nil
+
+	user.AccessToken = ""
+	user.OriginalToken = ""
+	user.OriginalRefreshToken = ""
+
+	user.DeletionScheduledTime = ""
+	user.IsForbidden = true
+	user.IsDeleted = true
+	user.UpdatedTime = now.Format(time.RFC3339)
+}
+
+// PurgeDueAccounts purges every account whose grace period has ended. Each account is claimed
+// first, so a deletion cancelled after the accounts were loaded is kept.
+func PurgeDueAccounts() (int, error) {
+	users, err := models.GetUsersDueForDeletion(time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, user := range users {
+		scheduledTime := user.DeletionScheduledTime
+		claimed, err := models.ClaimUserDeletion(user.Id, scheduledTime)
+		if err != nil {
+			log.Printf("[Account] Failed to claim user %d for purging: %v", user.Id, err)
+			continue
+		}
+		if !claimed {
+			// Cancelled since it was loaded, or purged by another instance
+			continue
+		}
+
+		if err := PurgeAccount(user); err != nil {
+			log.Printf("[Account] Failed to purge user %d: %v", user.Id, err)
+			// The account stays disabled and is scheduled again so the next run retries it
+			user.DeletionScheduledTime = scheduledTime
+			if _, err := models.UpdateUserDeletion(user); err != nil {
+				log.Printf("[Account] Failed to reschedule the deletion of user %d: %v", user.Id, err)
+			}
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// StartAccountPurge purges accounts whose deletion grace period has ended in the background
+func StartAccountPurge() {
+	go func() {
+		ticker := time.NewTicker(accountPurgeInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			purged, err := PurgeDueAccounts()
+			if err != nil {
+				log.Printf("[Account] Failed to load accounts due for deletion: %v", err)
+				continue
+			}
+			if purged > 0 {
+				log.Printf("[Account] Purged %d accounts", purged)
+			}
+		}
+	}()
+}
+
+// AccountExport is the personal data of a user in a portable form. Secrets, hashes and the
+// encrypted real name and ID card are left out; only the real-name status is included.
+type AccountExport struct {
+	ExportedTime string                  `json:"exportedTime"`
+	Profile      AccountExportProfile    `json:"profile"`
+	RealName     AccountExportRealName   `json:"realName"`
+	Security     AccountExportSecurity   `json:"security"`
+	Identities   []AccountExportIdentity `json:"identities"`
+	Consents     []AccountExportConsent  `json:"consents"`
+	Tokens       []AccountExportToken    `json:"tokens"`
+	LoginHistory []AccountExportLogin    `json:"loginHistory"`
+}
+
+type AccountExportProfile struct {
+	Id                    int64  `json:"id"`
+	Owner                 string `json:"owner"`
+	Username              string `json:"username"`
+	Email                 string `json:"email"`
+	EmailVerified         bool   `json:"emailVerified"`
+	Phone                 string `json:"phone"`
+	PhoneVerified         bool   `json:"phoneVerified"`
+	QQ                    string `json:"qq"`
+	Avatar                string `json:"avatar"`
+	CountryCode           string `json:"countryCode"`
+	SignupApplication     string `json:"signupApplication"`
+	CreatedTime           string `json:"createdTime"`
+	UpdatedTime           string `json:"updatedTime"`
+	DeletionScheduledTime string `json:"deletionScheduledTime,omitempty"`
+}
+
+type AccountExportRealName struct {
+	Verified bool `json:"verified"`
+}
+
+type AccountExportSecurity struct {
+	HasPassword            bool                   `json:"hasPassword"`
+	PasswordChangedTime    string                 `json:"passwordChangedTime"`
+	TotpEnabled            bool                   `json:"totpEnabled"`
+	RecoveryCodesRemaining int                    `json:"recoveryCodesRemaining"`
+	Passkeys               []AccountExportPasskey `json:"passkeys"`
+}
+
+type AccountExportPasskey struct {
+	DisplayName    string `json:"displayName"`
+	CreatedTime    string `json:"createdTime"`
+	LastUsedTime   string `json:"lastUsedTime"`
+	IsDiscoverable bool   `json:"isDiscoverable"`
+}
+
+type AccountExportIdentity struct {
+	Provider     string `json:"provider"`
+	Username     string `json:"username"`
+	Email        string `json:"email"`
+	CreatedTime  string `json:"createdTime"`
+	LastUsedTime string `json:"lastUsedTime"`
+}
+
+// AccountExportConsent is an application the user has authorized, derived from its tokens
+type AccountExportConsent struct {
+	Application     string   `json:"application"`
+	DisplayName     string   `json:"displayName"`
+	Scopes          []string `json:"scopes"`
+	FirstAuthorized string   `json:"firstAuthorized"`
+	LastAuthorized  string   `json:"lastAuthorized"`
+}
+
+type AccountExportToken struct {
+	Name        string   `json:"name"`
+	Application string   `json:"application"`
+	Scope       string   `json:"scope"`
+	Amr         []string `json:"amr"`
+	CreatedTime string   `json:"createdTime"`
+	ExpiresAt   string   `json:"expiresAt"`
+	Revoked     bool     `json:"revoked"`
+}
+
+type AccountExportLogin struct {
+	Time        string   `json:"time"`
+	Application string   `json:"application"`
+	Amr         []string `json:"amr"`
+	Ip          string   `json:"ip"`
+	UserAgent   string   `json:"userAgent"`
+}
+
+// BuildAccountExport collects the personal data of a user
+func BuildAccountExport(user *models.User) (*AccountExport, error) {
+	tokens, err := models.GetUserTokens(user.GetId())
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := models.GetUserWebauthnCredentials(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := models.GetUserIdentities(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	logins, err := models.GetUserLoginRecords(user.Id, loginHistoryExportLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	export := newAccountExport(user, time.Now())
+	for _, credential := range credentials {
+		export.Security.Passkeys = append(export.Security.Passkeys, AccountExportPasskey{
+			DisplayName:    credential.DisplayName,
+			CreatedTime:    credential.CreatedTime,
+			LastUsedTime:   credential.LastUsedTime,
+			IsDiscoverable: credential.IsDiscoverable,
+		})
+	}
+	for _, identity := range identities {
+		export.Identities = append(export.Identities, AccountExportIdentity{
+			Provider:     identity.Provider,
+			Username:     identity.Username,
+			Email:        identity.Email,
+			CreatedTime:  identity.CreatedTime,
+			LastUsedTime: identity.LastUsedTime,
+		})
+	}
+	for _, login := range logins {
+		export.LoginHistory = append(export.LoginHistory, AccountExportLogin{
+			Time:        login.CreatedTime,
+			Application: login.Application,
+			Amr:         login.Amr,
+			Ip:          login.Ip,
+			UserAgent:   login.UserAgent,
+		})
+	}
+	export.Tokens = exportTokens(tokens)
+	export.Consents = exportConsents(tokens, func(owner, name string) string {
+		application, err := models.GetApplication(owner, name)
+		if err != nil || application == nil || application.DisplayName == "" {
+			return name
+		}
+		return application.DisplayName
+	})
+	return export, nil
+}
+
+// newAccountExport fills the sections of an export that come from the user row
+func newAccountExport(user *models.User, now time.Time) *AccountExport {
+	return &AccountExport{
+		ExportedTime: now.Format(time.RFC3339),
+		Profile: AccountExportProfile{
+			Id:                    user.Id,
+			Owner:                 user.Owner,
+			Username:              user.Username,
+			Email:                 user.Email,
+			EmailVerified:         user.EmailVerified,
+			Phone:                 user.Phone,
+			PhoneVerified:         user.PhoneVerified,
+			QQ:                    user.QQ,
+			Avatar:                user.Avatar,
+			CountryCode:           user.CountryCode,
+			SignupApplication:     user.SignupApplication,
+			CreatedTime:           user.CreatedTime,
+			UpdatedTime:           user.UpdatedTime,
+			DeletionScheduledTime: user.DeletionScheduledTime,
+		},
+		RealName: AccountExportRealName{Verified: user.IsRealName},
+		Security: AccountExportSecurity{
+			HasPassword:            user.Password != "",
+			PasswordChangedTime:    user.PasswordChangedTime,
+			TotpEnabled:            user.TotpEnabled,
+			RecoveryCodesRemaining: len(user.RecoveryCodes),
+			Passkeys:               []AccountExportPasskey{},
+		},
+		Identities:   []AccountExportIdentity{},
+		Consents:     []AccountExportConsent{},
+		Tokens:       []AccountExportToken{},
+		LoginHistory: []AccountExportLogin{},
+	}
+}
+
+// exportTokens lists the grants of a user without any token value or hash
+func exportTokens(tokens []*models.Token) []AccountExportToken {
+	exported := []AccountExportToken{}
+	for _, token := range tokens {
+		expiresAt := ""
+		if token.ExpiresAt > 0 {
+			expiresAt = time.Unix(token.ExpiresAt, 0).UTC().Format(time.RFC3339)
+		}
+		exported = append(exported, AccountExportToken{
+			Name:        token.Name,
+			Application: token.Application,
+			Scope:       token.Scope,
+			Amr:         token.Amr,
+			CreatedTime: token.CreatedTime,
+			ExpiresAt:   expiresAt,
+			Revoked:     token.IsRevoked(),
+		})
+	}
+	return exported
+}
+
+// exportConsents groups the tokens of a user by application into the scopes the user granted
+func exportConsents(tokens []*models.Token, displayName func(owner, name string) string) []AccountExportConsent {
+	byApplication := map[string]*AccountExportConsent{}
+	scopes := map[string]map[string]bool{}
+	keys := []string{}
+	for _, token := range tokens {
+		key := token.Owner + "/" + token.Application
+		consent, ok := byApplication[key]
+		if !ok {
+			consent = &AccountExportConsent{
+				Application:     token.Application,
+				DisplayName:     displayName(token.Owner, token.Application),
+				FirstAuthorized: token.CreatedTime,
+				LastAuthorized:  token.CreatedTime,
+			}
+			byApplication[key] = consent
+			scopes[key] = map[string]bool{}
+			keys = append(keys, key)
+		}
+		if token.CreatedTime < consent.FirstAuthorized {
+			consent.FirstAuthorized = token.CreatedTime
+		}
+		if token.CreatedTime > consent.LastAuthorized {
+			consent.LastAuthorized = token.CreatedTime
+		}
+		for _, scope := range strings.Fields(token.Scope) {
+			scopes[key][scope] = true
+		}
+	}
+
+	sort.Strings(keys)
+	consents := []AccountExportConsent{}
+	for _, key := range keys {
+		consent := byApplication[key]
+		consent.Scopes = []string{}
+		for scope := range scopes[key] {
+			consent.Scopes = append(consent.Scopes, scope)
+		}
+		sort.Strings(consent.Scopes)
+		consents = append(consents, *consent)
+	}
+	return consents
+}
+
+// WriteAccountExportZip writes an export as a ZIP archive with one JSON file per section
+func WriteAccountExportZip(w io.Writer, export *AccountExport) error {
+	archive := zip.NewWriter(w)
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"account.json", export},
+		{"profile.json", export.Profile},
+		{"realname.json", export.RealName},
+		{"security.json", export.Security},
+		{"identities.json", export.Identities},
+		{"consents.json", export.Consents},
+		{"tokens.json", export.Tokens},
+		{"login_history.json", export.LoginHistory},
+	}
+	for _, file := range files {
+		data, err := json.MarshalIndent(file.content, "", "  ")
+		if err != nil {
+			return err
+		}
+		entry, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if _, err := entry.Write(data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
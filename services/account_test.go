@@ -0,0 +1,140 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+func exportTestUser() *models.User {
+	return &models.User{
+		Id:            7,
+		Owner:         "built-in",
+		Username:      "alice",
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		Phone:         "+8613800138000",
+		IsRealName:    true,
+		RealName:      "encrypted-real-name",
+		IDCard:        "encrypted-id-card",
+		Password:      "$2a$10$hash",
+		TotpSecret:    "encrypted-totp-secret",
+		TotpEnabled:   true,
+		RecoveryCodes: []string{"hash-1", "hash-2"},
+		Properties:    map[string]string{"note": "x"},
+	}
+}
+
+// TestAnonymizeUser tests that a purge leaves no personal data in the user row
+func TestAnonymizeUser(t *testing.T) {
+	user := exportTestUser()
+	user.DeletionScheduledTime = "2024-06-01T00:00:00Z"
+	anonymizeUser(user, time.Now())
+
+	if user.Username != "deleted-7" || !user.IsDeleted || !user.IsForbidden {
+		t.Errorf("Expected a deleted placeholder, got %+v", user)
+	}
+	if user.Email != "" || user.Phone != "" || user.RealName != "" || user.IDCard != "" || user.IsRealName {
+		t.Error("Expected contact and real-name data to be removed")
+	}
+	if user.Password != "" || user.TotpSecret != "" || user.RecoveryCodes != nil || user.Properties != nil {
+		t.Error("Expected credentials and properties to be removed")
+	}
+	if user.DeletionScheduledTime != "" {
+		t.Error("Expected the schedule to be cleared once purged")
+	}
+}
+
+// TestAccountDeletionGracePeriod tests the default and the override of the grace period
+func TestAccountDeletionGracePeriod(t *testing.T) {
+	t.Setenv("ACCOUNT_DELETION_GRACE_DAYS", "")
+	if period := AccountDeletionGracePeriod(); period != 14*24*time.Hour {
+		t.Errorf("Expected a 14 day default, got %v", period)
+	}
+	t.Setenv("ACCOUNT_DELETION_GRACE_DAYS", "0")
+	if period := AccountDeletionGracePeriod(); period != 0 {
+		t.Errorf("Expected no grace period, got %v", period)
+	}
+	t.Setenv("ACCOUNT_DELETION_GRACE_DAYS", "soon")
+	if period := AccountDeletionGracePeriod(); period != 14*24*time.Hour {
+		t.Errorf("Expected an invalid value to be ignored, got %v", period)
+	}
+}
+
+// TestExportConsents tests that tokens are grouped into one consent per application
+func TestExportConsents(t *testing.T) {
+	tokens := []*models.Token{
+		{Owner: "admin", Application: "app-b", Scope: "openid email", CreatedTime: "2024-03-01T00:00:00Z"},
+		{Owner: "admin", Application: "app-a", Scope: "openid", CreatedTime: "2024-02-01T00:00:00Z"},
+		{Owner: "admin", Application: "app-b", Scope: "openid profile", CreatedTime: "2024-01-01T00:00:00Z"},
+	}
+	consents := exportConsents(tokens, func(owner, name string) string {
+		return strings.ToUpper(name)
+	})
+
+	expected := []AccountExportConsent{
+		{Application: "app-a", DisplayName: "APP-A", Scopes: []string{"openid"}, FirstAuthorized: "2024-02-01T00:00:00Z", LastAuthorized: "2024-02-01T00:00:00Z"},
+		{Application: "app-b", DisplayName: "APP-B", Scopes: []string{"email", "openid", "profile"}, FirstAuthorized: "2024-01-01T00:00:00Z", LastAuthorized: "2024-03-01T00:00:00Z"},
+	}
+	if !reflect.DeepEqual(consents, expected) {
+		t.Errorf("Unexpected consents:\n%+v\nexpected\n%+v", consents, expected)
+	}
+}
+
+// TestWriteAccountExportZip tests the archive layout and that no secret reaches the export
+func TestWriteAccountExportZip(t *testing.T) {
+	export := newAccountExport(exportTestUser(), time.Now())
+	export.Tokens = exportTokens([]*models.Token{{
+		Name: "token_1", Application: "app-a", AccessTokenHash: "secret-hash", ExpiresIn: 0,
+	}})
+
+	var buf bytes.Buffer
+	if err := WriteAccountExportZip(&buf, export); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+
+	files := map[string]string{}
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", file.Name, err)
+		}
+		data, _ := io.ReadAll(reader)
+		reader.Close()
+		files[file.Name] = string(data)
+	}
+
+	for _, name := range []string{"account.json", "profile.json", "realname.json", "security.json", "identities.json", "consents.json", "tokens.json", "login_history.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("Expected %s in the archive", name)
+		}
+	}
+
+	var realName map[string]interface{}
+	json.Unmarshal([]byte(files["realname.json"]), &realName)
+	if !reflect.DeepEqual(realName, map[string]interface{}{"verified": true}) {
+		t.Errorf("Expected only the real-name status, got %v", realName)
+	}
+	for _, secret := range []string{"encrypted-real-name", "encrypted-id-card", "$2a$10$hash", "encrypted-totp-secret", "hash-1", "secret-hash"} {
+		if strings.Contains(files["account.json"], secret) {
+			t.Errorf("Export leaks %q", secret)
+		}
+	}
+	if !strings.Contains(files["tokens.json"], `"revoked": true`) {
+		t.Errorf("Expected the revoked token to be marked, got %s", files["tokens.json"])
+	}
+}
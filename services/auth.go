@@ -4,24 +4,16 @@
 package services
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/oauth-server/oauth-server/models"
-	"golang.org/x/crypto/bcrypt"
 )
 
-// HashPassword hashes a password using bcrypt
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(bytes), err
-}
-
-// CheckPassword checks if the provided password matches the hashed password
-func CheckPassword(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
-}
+// ErrInvalidCredentials is returned for a wrong password and for an unknown account alike
+var ErrInvalidCredentials = errors.New("invalid account or password")
 
 // ValidateEmail validates email format
 func ValidateEmail(email string) bool {
@@ -39,7 +31,7 @@ func ValidateEmail(email string) bool {
 	return atCount == 1
 }
 
-// RegisterUser registers a new user with email
+// RegisterUser registers a new user with an email address proven with a register code
 func RegisterUser(email, password, username string) (*models.User, error) {
 	// Validate email
 	if !ValidateEmail(email) {
@@ -54,27 +46,29 @@ func RegisterUser(email, password, username string) (*models.User, error) {
 	if existingUser != nil {
 		return nil, fmt.Errorf("email already registered")
 	}
-
-	// Hash password
-	hashedPassword, err := HashPassword(password)
-	if err != nil {
+	if err := CheckUsernameAvailable(consoleOrganization, username, 0); err != nil {
 		return nil, err
 	}
 
 	// Create user
 	now := time.Now().Format(time.RFC3339)
 	user := &models.User{
-		Owner:       "built-in",
-		CreatedTime: now,
-		UpdatedTime: now,
-		Type:        "normal-user",
-		Password:    hashedPassword,
-		Username:    username,
-		Email:       email,
-		IsRealName:  false, // Default to not real-name verified
-		IsAdmin:     false,
-		IsForbidden: false,
-		IsDeleted:   false,
+		Owner:         "built-in",
+		CreatedTime:   now,
+		UpdatedTime:   now,
+		Type:          "normal-user",
+		Username:      username,
+		Email:         email,
+		EmailVerified: true,  // The address was proven with an email code
+		IsRealName:    false, // Default to not real-name verified
+		IsAdmin:       false,
+		IsForbidden:   false,
+		IsDeleted:     false,
+	}
+
+	// Hash password with the organization's algorithm
+	if err := SetUserPassword(user, password); err != nil {
+		return nil, err
 	}
 
 	// Save user to database
@@ -86,20 +80,55 @@ func RegisterUser(email, password, username string) (*models.User, error) {
 	return user, nil
 }
 
-// LoginUser authenticates a user with email and password
-func LoginUser(email, password string) (*models.User, error) {
-	// Validate email
-	if !ValidateEmail(email) {
-		return nil, fmt.Errorf("invalid email format")
+// LoginUser authenticates a user with a login identifier and password. The identifier is an email,
+// username or verified phone number, as accepted by the built-in organization. Unknown identifiers,
+// deleted users and wrong passwords all fail with ErrInvalidCredentials after a password check, and
+// the account state is only reported once the password is correct, so a failed sign-in does not
+// reveal whether an account exists.
+func LoginUser(identifier, password string) (*models.User, error) {
+	user, err := FindLoginUser(consoleOrganization, identifier)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		// Directory users may sign in before their first sync
+		ldapUser, handled, err := loginLdapUser(identifier, password, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !handled {
+			verifyDummyPassword(password)
+			return nil, ErrInvalidCredentials
+		}
+		if ldapUser.IsForbidden {
+			return nil, fmt.Errorf("account is disabled")
+		}
+		return ldapUser, nil
 	}
 
-	// Get user by email
-	user, err := models.GetUserByEmail(email)
+	// Users linked to an LDAP directory are checked against it instead of the local hash
+	ldapUser, handled, err := loginLdapUser(identifier, password, user)
 	if err != nil {
 		return nil, err
 	}
-	if user == nil {
-		return nil, fmt.Errorf("invalid email or password")
+	if handled {
+		if ldapUser.IsForbidden {
+			return nil, fmt.Errorf("account is disabled")
+		}
+		return ldapUser, nil
+	}
+
+	// Check password with the stored algorithm, upgrading the hash if needed
+	valid, err := VerifyUserPassword(user, password)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		if user.Password == "" {
+			// Accounts without a password take as long to reject as any other
+			verifyDummyPassword(password)
+		}
+		return nil, ErrInvalidCredentials
 	}
 
 	// Check if user is forbidden
@@ -107,14 +136,13 @@ func LoginUser(email, password string) (*models.User, error) {
 		return nil, fmt.Errorf("account is disabled")
 	}
 
-	// Check if user is deleted
-	if user.IsDeleted {
-		return nil, fmt.Errorf("account not found")
+	// Expired passwords have to be replaced through a password reset
+	expired, err := IsPasswordExpired(user)
+	if err != nil {
+		return nil, err
 	}
-
-	// Check password
-	if !CheckPassword(password, user.Password) {
-		return nil, fmt.Errorf("invalid email or password")
+	if expired {
+		return nil, ErrPasswordExpired
 	}
 
 	return user, nil
@@ -137,13 +165,11 @@ func ResetPassword(email, newPassword string) error {
 	}
 
 	// Hash new password
-	hashedPassword, err := HashPassword(newPassword)
-	if err != nil {
+	if err := SetUserPassword(user, newPassword); err != nil {
 		return err
 	}
 
 	// Update password
-	user.Password = hashedPassword
 	user.UpdatedTime = time.Now().Format(time.RFC3339)
 
 	_, err = models.UpdateUser(user.Id, user)
@@ -153,3 +179,116 @@ func ResetPassword(email, newPassword string) error {
 
 	return nil
 }
+
+// RegisterUserByPhone registers a new user with a verified phone number and no email
+func RegisterUserByPhone(phone, password, username string) (*models.User, error) {
+	// Check if the number already belongs to a user
+	existingUser, err := models.GetUserByPhone(phone)
+	if err != nil {
+		return nil, err
+	}
+	if existingUser != nil {
+		return nil, fmt.Errorf("phone number already registered")
+	}
+	if err := CheckUsernameAvailable(consoleOrganization, username, 0); err != nil {
+		return nil, err
+	}
+
+	// Create user
+	now := time.Now().Format(time.RFC3339)
+	user := &models.User{
+		Owner:         "built-in",
+		CreatedTime:   now,
+		UpdatedTime:   now,
+		Type:          "normal-user",
+		Username:      username,
+		Phone:         phone,
+		PhoneVerified: true, // The number was proven with an SMS code
+	}
+
+	// Hash password with the organization's algorithm
+	if err := SetUserPassword(user, password); err != nil {
+		return nil, err
+	}
+
+	// Save user to database
+	_, err = models.AddUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// ResetPasswordByPhone resets the password of the user with a verified phone number
+func ResetPasswordByPhone(phone, newPassword string) error {
+	user, err := models.GetUserByPhone(phone)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user not found")
+	}
+
+	// Hash new password
+	if err := SetUserPassword(user, newPassword); err != nil {
+		return err
+	}
+
+	// Update password
+	user.UpdatedTime = time.Now().Format(time.RFC3339)
+
+	_, err = models.UpdateUser(user.Id, user)
+	return err
+}
+
+// SetUserPhone stores a phone number proven with an SMS code as the user's verified number
+func SetUserPhone(user *models.User, phone string) error {
+	existingUser, err := models.GetUserByPhone(phone)
+	if err != nil {
+		return err
+	}
+	if existingUser != nil && existingUser.Id != user.Id {
+		return fmt.Errorf("phone number already bound to another account")
+	}
+
+	user.Phone = phone
+	user.PhoneVerified = true
+	user.UpdatedTime = time.Now().Format(time.RFC3339)
+	_, err = models.UpdateUserPhone(user)
+	return err
+}
+
+// RemoveUserPhone removes the phone number of a user who can still sign in by email
+func RemoveUserPhone(user *models.User) error {
+	if user.Email == "" {
+		return fmt.Errorf("cannot remove the only sign-in identifier")
+	}
+
+	user.Phone = ""
+	user.PhoneVerified = false
+	user.UpdatedTime = time.Now().Format(time.RFC3339)
+	_, err := models.UpdateUserPhone(user)
+	return err
+}
+
+// RecordLogin adds a successful sign-in to the login history of a user.
+// The history is informational, so a failure to write it does not fail the sign-in.
+func RecordLogin(user *models.User, application string, amr []string, ip, userAgent string) {
+	if runes := []rune(userAgent); len(runes) > 500 {
+		userAgent = string(runes[:500])
+	}
+	record := &models.LoginRecord{
+		Owner:       user.Owner,
+		Name:        fmt.Sprintf("login_%s", models.GenerateRandomString(16)),
+		CreatedTime: time.Now().Format(time.RFC3339),
+		UserId:      user.Id,
+		Application: application,
+		Amr:         amr,
+		Ip:          ip,
+		UserAgent:   userAgent,
+	}
+	if _, err := models.AddLoginRecord(record); err != nil {
+		log.Printf("[Auth] Failed to record sign-in of user %d: %v", user.Id, err)
+	}
+}
@@ -0,0 +1,441 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+	"github.com/redis/go-redis/v9"
+)
+
+// Throttle scopes keep the counters of unrelated endpoints apart
+const (
+	ThrottleScopePassword = "password" // Password sign-in and the password grant
+	ThrottleScopeCode     = "code"     // Checks of one-time codes sent by email or text message
+	ThrottleScopeSendCode = "send"     // Requests for new one-time codes
+)
+
+// Reasons an attempt is rejected before it is checked
+const (
+	ThrottleReasonAccountLocked  = "account_locked"
+	ThrottleReasonIpThrottled    = "ip_throttled"
+	ThrottleReasonResendCooldown = "resend_cooldown"
+)
+
+const (
+	// AccountLockoutThreshold is the number of failures that locks an account. Every further
+	// multiple of it doubles the lockout, up to AccountLockoutMax.
+	AccountLockoutThreshold = 5
+	AccountLockoutBase      = time.Minute
+	AccountLockoutMax       = time.Hour
+	// AccountFailureWindow is how long failures count towards a lockout
+	AccountFailureWindow = 24 * time.Hour
+
+	// CaptchaFailureThreshold is the number of recent failures for the account or the client
+	// address after which a captcha has to be solved
+	CaptchaFailureThreshold = 3
+)
+
+// ThrottleLimit allows Limit events per client within a sliding window
+type ThrottleLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// throttleLimits holds the per-address and per-subnet limits of each scope. Subnets are /24 for
+// IPv4 and /64 for IPv6, so that one host rotating its addresses is still limited.
+var throttleLimits = map[string]struct{ ip, subnet ThrottleLimit }{
+	ThrottleScopePassword: {ip: ThrottleLimit{20, 15 * time.Minute}, subnet: ThrottleLimit{100, 15 * time.Minute}},
+	ThrottleScopeCode:     {ip: ThrottleLimit{10, 15 * time.Minute}, subnet: ThrottleLimit{50, 15 * time.Minute}},
+	ThrottleScopeSendCode: {ip: ThrottleLimit{10, time.Hour}, subnet: ThrottleLimit{30, time.Hour}},
+}
+
+// sendCodeTargetLimit limits the codes sent to one email address or phone number
+var sendCodeTargetLimit = ThrottleLimit{5, time.Hour}
+
+// ThrottleDecision is the outcome of checking an attempt against the brute-force limits
+type ThrottleDecision struct {
+	// RetryAfter is positive when the attempt has to be rejected without checking it
+	RetryAfter      time.Duration
+	Reason          string
+	CaptchaRequired bool
+}
+
+// Allowed reports whether the attempt may be checked
+func (d *ThrottleDecision) Allowed() bool {
+	return d.RetryAfter <= 0
+}
+
+// attempts summarizes the events of one key within a window
+type attempts struct {
+	count          int
+	oldest, latest time.Time
+}
+
+// attemptStore keeps timestamped events for sliding windows
+type attemptStore interface {
+	// hit records an event and returns the events within the window, including it
+	hit(key string, now time.Time, window time.Duration) (attempts, error)
+	// peek returns the events within the window without recording one
+	peek(key string, now time.Time, window time.Duration) (attempts, error)
+	reset(keys ...string) error
+}
+
+var memoryAttempts = newMemoryAttemptStore()
+
+// currentAttemptStore uses Redis so that limits are shared between instances, and falls back
+// to process memory when Redis is not configured or fails
+func currentAttemptStore() attemptStore {
+	if redisClient == nil {
+		return memoryAttempts
+	}
+	return &redisAttemptStore{client: redisClient, fallback: memoryAttempts}
+}
+
+// clientSubnet returns the /24 (IPv4) or /64 (IPv6) network of an address
+func clientSubnet(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+func normalizeAccount(account string) string {
+	return strings.ToLower(strings.TrimSpace(account))
+}
+
+func throttleKey(scope, kind, value string) string {
+	return fmt.Sprintf("bruteforce:%s:%s:%s", scope, kind, value)
+}
+
+// accountLockout returns how long an account stays locked after its failures
+func accountLockout(failures attempts, now time.Time) time.Duration {
+	if failures.count < AccountLockoutThreshold {
+		return 0
+	}
+	duration := AccountLockoutBase
+	for level := failures.count / AccountLockoutThreshold; level > 1 && duration < AccountLockoutMax; level-- {
+		duration *= 2
+	}
+	if duration > AccountLockoutMax {
+		duration = AccountLockoutMax
+	}
+	return failures.latest.Add(duration).Sub(now)
+}
+
+// windowRetryAfter returns how long until a full sliding window has room for another event
+func windowRetryAfter(events attempts, limit ThrottleLimit, now time.Time) time.Duration {
+	if events.count < limit.Limit {
+		return 0
+	}
+	return events.oldest.Add(limit.Window).Sub(now)
+}
+
+// CheckLoginAttempt checks whether a sign-in attempt for the account from the client address
+// may be checked, and whether it needs a captcha. Unknown accounts are counted like existing
+// ones, so the responses do not reveal which accounts exist.
+func CheckLoginAttempt(scope, account, ip string) (*ThrottleDecision, error) {
+	return checkLoginAttempt(currentAttemptStore(), scope, normalizeAccount(account), ip, time.Now())
+}
+
+func checkLoginAttempt(store attemptStore, scope, account, ip string, now time.Time) (*ThrottleDecision, error) {
+	limits := throttleLimits[scope]
+	decision := &ThrottleDecision{}
+
+	for _, check := range []struct {
+		key   string
+		limit ThrottleLimit
+	}{
+		{throttleKey(scope, "ip", ip), limits.ip},
+		{throttleKey(scope, "subnet", clientSubnet(ip)), limits.subnet},
+	} {
+		events, err := store.peek(check.key, now, check.limit.Window)
+		if err != nil {
+			return nil, err
+		}
+		if retryAfter := windowRetryAfter(events, check.limit, now); retryAfter > decision.RetryAfter {
+			decision.RetryAfter, decision.Reason = retryAfter, ThrottleReasonIpThrottled
+		}
+		if check.limit == limits.ip && events.count >= CaptchaFailureThreshold {
+			decision.CaptchaRequired = true
+		}
+	}
+
+	if account != "" {
+		failures, err := store.peek(throttleKey(scope, "account", account), now, AccountFailureWindow)
+		if err != nil {
+			return nil, err
+		}
+		if lockout := accountLockout(failures, now); lockout > decision.RetryAfter {
+			decision.RetryAfter, decision.Reason = lockout, ThrottleReasonAccountLocked
+		}
+		if failures.count >= CaptchaFailureThreshold {
+			decision.CaptchaRequired = true
+		}
+	}
+	return decision, nil
+}
+
+// RecordLoginFailure counts a failed attempt against the account and the client address and
+// returns the decision for the next attempt
+func RecordLoginFailure(scope, account, ip string) (*ThrottleDecision, error) {
+	store := currentAttemptStore()
+	account = normalizeAccount(account)
+	now := time.Now()
+	limits := throttleLimits[scope]
+
+	if _, err := store.hit(throttleKey(scope, "ip", ip), now, limits.ip.Window); err != nil {
+		return nil, err
+	}
+	if _, err := store.hit(throttleKey(scope, "subnet", clientSubnet(ip)), now, limits.subnet.Window); err != nil {
+		return nil, err
+	}
+	if account != "" {
+		failures, err := store.hit(throttleKey(scope, "account", account), now, AccountFailureWindow)
+		if err != nil {
+			return nil, err
+		}
+		if failures.count%AccountLockoutThreshold == 0 {
+			log.Printf("[Security] Account %s locked after %d failed %s attempts, last from %s", account, failures.count, scope, ip)
+		}
+	}
+	return checkLoginAttempt(store, scope, account, ip, now)
+}
+
+// UserThrottleAccount returns the account the password and second factor failures of a known
+// user are counted against, whichever identifier the sign-in was started with
+func UserThrottleAccount(userId string) string {
+	return "user:" + userId
+}
+
+// LoginThrottleAccount returns the account password sign-in failures for an identifier are
+// counted against. An identifier of an existing user resolves to the user, so its email, phone
+// number and username share one budget; other identifiers are counted as typed.
+func LoginThrottleAccount(organizationName, identifier string) (string, error) {
+	user, err := FindLoginUser(organizationName, identifier)
+	if err != nil {
+		return "", err
+	}
+	if user == nil {
+		return identifier, nil
+	}
+	return UserThrottleAccount(user.GetId()), nil
+}
+
+// ConsoleLoginThrottleAccount returns the throttle account of an identifier typed into the console sign-in
+func ConsoleLoginThrottleAccount(identifier string) (string, error) {
+	return LoginThrottleAccount(consoleOrganization, identifier)
+}
+
+// PasswordGrantThrottleAccount returns the throttle account of the username of a password grant,
+// resolved in the organization of the client
+func PasswordGrantThrottleAccount(clientId, username string) (string, error) {
+	application, err := models.GetApplicationByClientId(clientId)
+	if err != nil {
+		return "", err
+	}
+	if application == nil {
+		return username, nil
+	}
+	return LoginThrottleAccount(application.Organization, username)
+}
+
+// RecordLoginSuccess forgets the failures of an account after a sign-in completed, including any
+// second factor. The counters of the client address are kept, as they may belong to other accounts.
+func RecordLoginSuccess(scope, account string) error {
+	return currentAttemptStore().reset(throttleKey(scope, "account", normalizeAccount(account)))
+}
+
+// CheckCodeRequest records a request for a one-time code to the target and returns how long
+// the client has to wait when the target, address or subnet has asked for too many
+func CheckCodeRequest(target, ip string) (time.Duration, error) {
+	store := currentAttemptStore()
+	now := time.Now()
+	limits := throttleLimits[ThrottleScopeSendCode]
+
+	var retryAfter time.Duration
+	for _, check := range []struct {
+		key   string
+		limit ThrottleLimit
+	}{
+		{throttleKey(ThrottleScopeSendCode, "ip", ip), limits.ip},
+		{throttleKey(ThrottleScopeSendCode, "subnet", clientSubnet(ip)), limits.subnet},
+		{throttleKey(ThrottleScopeSendCode, "target", normalizeAccount(target)), sendCodeTargetLimit},
+	} {
+		events, err := store.hit(check.key, now, check.limit.Window)
+		if err != nil {
+			return 0, err
+		}
+		// The request itself is included, so the window is full only beyond the limit
+		events.count--
+		if wait := windowRetryAfter(events, check.limit, now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	return retryAfter, nil
+}
+
+// UnlockAccount clears the failure counters of an account's identifiers, including its
+// UserThrottleAccount, in every scope
+func UnlockAccount(identifiers ...string) error {
+	keys := []string{}
+	for _, identifier := range identifiers {
+		if identifier = normalizeAccount(identifier); identifier == "" {
+			continue
+		}
+		for _, scope := range []string{ThrottleScopePassword, ThrottleScopeCode} {
+			keys = append(keys, throttleKey(scope, "account", identifier))
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return currentAttemptStore().reset(keys...)
+}
+
+// memoryAttemptStore keeps events in process memory. Expired keys are swept now and then
+// while recording, so no background goroutine is needed.
+type memoryAttemptStore struct {
+	mu      sync.Mutex
+	events  map[string][]time.Time
+	windows map[string]time.Duration
+	hits    int
+}
+
+func newMemoryAttemptStore() *memoryAttemptStore {
+	return &memoryAttemptStore{events: map[string][]time.Time{}, windows: map[string]time.Duration{}}
+}
+
+// prune drops the events of a key that fell out of the window; the caller holds the lock
+func (s *memoryAttemptStore) prune(key string, now time.Time, window time.Duration) attempts {
+	events := s.events[key]
+	start := 0
+	for start < len(events) && !events[start].After(now.Add(-window)) {
+		start++
+	}
+	events = events[start:]
+	if len(events) == 0 {
+		delete(s.events, key)
+		delete(s.windows, key)
+		return attempts{}
+	}
+	s.events[key] = events
+	return attempts{count: len(events), oldest: events[0], latest: events[len(events)-1]}
+}
+
+func (s *memoryAttemptStore) hit(key string, now time.Time, window time.Duration) (attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hits++
+	if s.hits%1000 == 0 {
+		for other, otherWindow := range s.windows {
+			s.prune(other, now, otherWindow)
+		}
+	}
+
+	s.prune(key, now, window)
+	s.events[key] = append(s.events[key], now)
+	s.windows[key] = window
+	return s.prune(key, now, window), nil
+}
+
+func (s *memoryAttemptStore) peek(key string, now time.Time, window time.Duration) (attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.prune(key, now, window), nil
+}
+
+func (s *memoryAttemptStore) reset(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.events, key)
+		delete(s.windows, key)
+	}
+	return nil
+}
+
+// redisAttemptStore keeps the events of a key in a sorted set scored by time in microseconds
+type redisAttemptStore struct {
+	client   *redis.Client
+	fallback attemptStore
+}
+
+func (s *redisAttemptStore) window(ctx context.Context, pipe redis.Pipeliner, key string, now time.Time, window time.Duration) (*redis.IntCmd, *redis.ZSliceCmd, *redis.ZSliceCmd) {
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Add(-window).UnixMicro(), 10))
+	return pipe.ZCard(ctx, key), pipe.ZRangeWithScores(ctx, key, 0, 0), pipe.ZRangeWithScores(ctx, key, -1, -1)
+}
+
+func redisAttempts(count *redis.IntCmd, oldest, latest *redis.ZSliceCmd) attempts {
+	result := attempts{count: int(count.Val())}
+	if values := oldest.Val(); len(values) > 0 {
+		result.oldest = time.UnixMicro(int64(values[0].Score))
+	}
+	if values := latest.Val(); len(values) > 0 {
+		result.latest = time.UnixMicro(int64(values[0].Score))
+	}
+	return result
+}
+
+func (s *redisAttemptStore) hit(key string, now time.Time, window time.Duration) (attempts, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+	defer cancel()
+
+	var count *redis.IntCmd
+	var oldest, latest *redis.ZSliceCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, redis.Z{
+			Score:  float64(now.UnixMicro()),
+			Member: fmt.Sprintf("%d-%d", now.UnixNano(), rand.Int63()),
+		})
+		count, oldest, latest = s.window(ctx, pipe, key, now, window)
+		pipe.PExpire(ctx, key, window)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[Security] Redis unavailable for brute-force counters, using memory: %v", err)
+		return s.fallback.hit(key, now, window)
+	}
+	return redisAttempts(count, oldest, latest), nil
+}
+
+func (s *redisAttemptStore) peek(key string, now time.Time, window time.Duration) (attempts, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+	defer cancel()
+
+	var count *redis.IntCmd
+	var oldest, latest *redis.ZSliceCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		count, oldest, latest = s.window(ctx, pipe, key, now, window)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[Security] Redis unavailable for brute-force counters, using memory: %v", err)
+		return s.fallback.peek(key, now, window)
+	}
+	return redisAttempts(count, oldest, latest), nil
+}
+
+func (s *redisAttemptStore) reset(keys ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+	defer cancel()
+
+	// Counters recorded in memory while Redis was down are cleared as well
+	s.fallback.reset(keys...)
+	return s.client.Del(ctx, keys...).Err()
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestMemoryAttemptStore tests that the sliding window forgets old events
+func TestMemoryAttemptStore(t *testing.T) {
+	store := newMemoryAttemptStore()
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	window := 10 * time.Minute
+
+	for i := 0; i < 3; i++ {
+		if _, err := store.hit("key", start.Add(time.Duration(i)*time.Minute), window); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	events, _ := store.peek("key", start.Add(5*time.Minute), window)
+	if events.count != 3 || !events.oldest.Equal(start) || !events.latest.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+
+	events, _ = store.peek("key", start.Add(11*time.Minute+30*time.Second), window)
+	if events.count != 1 {
+		t.Errorf("Expected two events to have left the window, got %d", events.count)
+	}
+
+	store.reset("key")
+	if events, _ := store.peek("key", start, window); events.count != 0 {
+		t.Errorf("Expected the key to be cleared, got %d", events.count)
+	}
+}
+
+// TestAccountLockout tests that the lockout doubles with every multiple of the threshold
+func TestAccountLockout(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{AccountLockoutThreshold - 1, 0},
+		{AccountLockoutThreshold, time.Minute},
+		{2*AccountLockoutThreshold - 1, time.Minute},
+		{2 * AccountLockoutThreshold, 2 * time.Minute},
+		{3 * AccountLockoutThreshold, 4 * time.Minute},
+		{100 * AccountLockoutThreshold, AccountLockoutMax},
+	}
+	for _, tt := range tests {
+		lockout := accountLockout(attempts{count: tt.failures, latest: now}, now)
+		if lockout != tt.expected {
+			t.Errorf("%d failures: expected %v, got %v", tt.failures, tt.expected, lockout)
+		}
+	}
+
+	// The lockout runs from the last failure
+	if lockout := accountLockout(attempts{count: AccountLockoutThreshold, latest: now}, now.Add(40*time.Second)); lockout != 20*time.Second {
+		t.Errorf("Expected 20s left, got %v", lockout)
+	}
+}
+
+// TestCheckLoginAttempt tests account lockout, captcha escalation and per-address throttling
+func TestCheckLoginAttempt(t *testing.T) {
+	store := newMemoryAttemptStore()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	accountKey := throttleKey(ThrottleScopePassword, "account", "alice@example.com")
+
+	decision, _ := checkLoginAttempt(store, ThrottleScopePassword, "alice@example.com", "192.0.2.1", now)
+	if !decision.Allowed() || decision.CaptchaRequired {
+		t.Errorf("Expected a first attempt to be allowed without captcha, got %+v", decision)
+	}
+
+	for i := 0; i < CaptchaFailureThreshold; i++ {
+		store.hit(accountKey, now, AccountFailureWindow)
+	}
+	decision, _ = checkLoginAttempt(store, ThrottleScopePassword, "alice@example.com", "198.51.100.7", now)
+	if !decision.Allowed() || !decision.CaptchaRequired {
+		t.Errorf("Expected a captcha from any address after %d failures, got %+v", CaptchaFailureThreshold, decision)
+	}
+
+	for i := CaptchaFailureThreshold; i < AccountLockoutThreshold; i++ {
+		store.hit(accountKey, now, AccountFailureWindow)
+	}
+	decision, _ = checkLoginAttempt(store, ThrottleScopePassword, "alice@example.com", "198.51.100.7", now)
+	if decision.Allowed() || decision.Reason != ThrottleReasonAccountLocked || decision.RetryAfter != AccountLockoutBase {
+		t.Errorf("Expected the account to be locked, got %+v", decision)
+	}
+
+	// Another account on the same address is unaffected
+	decision, _ = checkLoginAttempt(store, ThrottleScopePassword, "bob@example.com", "198.51.100.7", now)
+	if !decision.Allowed() || decision.CaptchaRequired {
+		t.Errorf("Expected another account to be allowed, got %+v", decision)
+	}
+
+	limits := throttleLimits[ThrottleScopePassword]
+	for i := 0; i < limits.ip.Limit; i++ {
+		store.hit(throttleKey(ThrottleScopePassword, "ip", "203.0.113.9"), now, limits.ip.Window)
+	}
+	decision, _ = checkLoginAttempt(store, ThrottleScopePassword, "carol@example.com", "203.0.113.9", now.Add(time.Minute))
+	if decision.Allowed() || decision.Reason != ThrottleReasonIpThrottled || decision.RetryAfter != limits.ip.Window-time.Minute {
+		t.Errorf("Expected the address to be throttled, got %+v", decision)
+	}
+}
+
+// TestClientSubnet tests the networks addresses are grouped into
+func TestClientSubnet(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.77":                  "192.0.2.0/24",
+		"::ffff:192.0.2.77":           "192.0.2.0/24",
+		"2001:db8:1234:5678:9abc::1":  "2001:db8:1234:5678::/64",
+		"2001:db8:1234:5678:ffff::ff": "2001:db8:1234:5678::/64",
+		"not-an-ip":                   "not-an-ip",
+	}
+	for ip, expected := range tests {
+		if subnet := clientSubnet(ip); subnet != expected {
+			t.Errorf("%s: expected %s, got %s", ip, expected, subnet)
+		}
+	}
+}
+
+// TestCheckCodeRequest tests the limit of codes sent to one target
+func TestCheckCodeRequest(t *testing.T) {
+	for i := 0; i < sendCodeTargetLimit.Limit; i++ {
+		retryAfter, err := CheckCodeRequest("Limit-Test@Example.com", "192.0.2.10")
+		if err != nil || retryAfter != 0 {
+			t.Fatalf("Request %d: expected to be allowed, got %v %v", i+1, retryAfter, err)
+		}
+	}
+	retryAfter, err := CheckCodeRequest("limit-test@example.com", "198.51.100.10")
+	if err != nil || retryAfter <= 0 {
+		t.Errorf("Expected the target to be throttled, got %v %v", retryAfter, err)
+	}
+}
+
+// TestUserThrottleAccount tests that password and second factor failures of a user share one
+// lockout, which only a completed sign-in or an unlock clears
+func TestUserThrottleAccount(t *testing.T) {
+	account := UserThrottleAccount("90417")
+	defer UnlockAccount(account)
+
+	// Wrong TOTP codes after a correct password count like wrong passwords, with a new ticket each time
+	for i := 0; i < AccountLockoutThreshold; i++ {
+		if _, err := RecordLoginFailure(ThrottleScopePassword, account, fmt.Sprintf("192.0.2.%d", 10+i)); err != nil {
+			t.Fatalf("RecordLoginFailure failed: %v", err)
+		}
+	}
+	decision, err := CheckLoginAttempt(ThrottleScopePassword, account, "198.51.100.20")
+	if err != nil {
+		t.Fatalf("CheckLoginAttempt failed: %v", err)
+	}
+	if decision.Allowed() || decision.Reason != ThrottleReasonAccountLocked {
+		t.Errorf("Expected the user to be locked, got %+v", decision)
+	}
+
+	if err := UnlockAccount(account); err != nil {
+		t.Fatalf("UnlockAccount failed: %v", err)
+	}
+	if decision, _ := CheckLoginAttempt(ThrottleScopePassword, account, "198.51.100.20"); !decision.Allowed() {
+		t.Errorf("Expected the unlock to clear the user's failures, got %+v", decision)
+	}
+}
@@ -25,12 +25,16 @@ type CaptchaVerifyResponse struct {
 	Success bool `json:"success"`
 }
 
+// IsCaptchaEnabled reports whether captcha verification is turned on
+func IsCaptchaEnabled() bool {
+	return strings.ToLower(os.Getenv("CAPTCHA_ENABLED")) == "true"
+}
+
 // VerifyCaptcha verifies the captcha token with Cap.js server
 // Requirements: 4.1, 4.2, 4.3, 4.4, 4.5, 4.6
 func VerifyCaptcha(token string) (bool, error) {
 	// Check CAPTCHA_ENABLED environment variable (Requirement 4.1, 4.2)
-	enabled := os.Getenv("CAPTCHA_ENABLED")
-	if strings.ToLower(enabled) != "true" {
+	if !IsCaptchaEnabled() {
 		// If captcha is disabled or not set, always return true
 		return true, nil
 	}
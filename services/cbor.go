@@ -0,0 +1,165 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// cborMaxDepth bounds nesting so hostile input cannot exhaust the stack
+const cborMaxDepth = 16
+
+// decodeCbor decodes a single CBOR data item (RFC 8949) and returns it with the number of bytes read.
+// It covers what WebAuthn needs: integers, byte and text strings, arrays, maps, tags and simple values.
+// Maps are returned as map[interface{}]interface{} keyed by int64 or string.
+func decodeCbor(data []byte) (interface{}, int, error) {
+	return decodeCborItem(data, 0)
+}
+
+func decodeCborItem(data []byte, depth int) (interface{}, int, error) {
+	if depth > cborMaxDepth {
+		return nil, 0, fmt.Errorf("cbor: nesting too deep")
+	}
+	if len(data) == 0 {
+		return nil, 0, fmt.Errorf("cbor: unexpected end of data")
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+
+	// Simple values and floats carry their payload directly
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, 1, nil
+		case 21:
+			return true, 1, nil
+		case 22, 23:
+			return nil, 1, nil
+		case 26:
+			if len(data) < 5 {
+				return nil, 0, fmt.Errorf("cbor: unexpected end of data")
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(data[1:5]))), 5, nil
+		case 27:
+			if len(data) < 9 {
+				return nil, 0, fmt.Errorf("cbor: unexpected end of data")
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(data[1:9])), 9, nil
+		default:
+			return nil, 0, fmt.Errorf("cbor: unsupported simple value %d", info)
+		}
+	}
+
+	argument, offset, err := cborArgument(data, info)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch major {
+	case 0:
+		if argument > math.MaxInt64 {
+			return nil, 0, fmt.Errorf("cbor: integer overflow")
+		}
+		return int64(argument), offset, nil
+	case 1:
+		if argument > math.MaxInt64 {
+			return nil, 0, fmt.Errorf("cbor: integer overflow")
+		}
+		return -1 - int64(argument), offset, nil
+	case 2, 3:
+		if argument > uint64(len(data)-offset) {
+			return nil, 0, fmt.Errorf("cbor: string longer than data")
+		}
+		end := offset + int(argument)
+		if major == 2 {
+			value := make([]byte, argument)
+			copy(value, data[offset:end])
+			return value, end, nil
+		}
+		return string(data[offset:end]), end, nil
+	case 4:
+		if argument > uint64(len(data)) {
+			return nil, 0, fmt.Errorf("cbor: array longer than data")
+		}
+		items := make([]interface{}, 0, argument)
+		for i := uint64(0); i < argument; i++ {
+			item, n, err := decodeCborItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			offset += n
+		}
+		return items, offset, nil
+	case 5:
+		if argument > uint64(len(data)) {
+			return nil, 0, fmt.Errorf("cbor: map longer than data")
+		}
+		entries := make(map[interface{}]interface{}, argument)
+		for i := uint64(0); i < argument; i++ {
+			key, n, err := decodeCborItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset += n
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, fmt.Errorf("cbor: unsupported map key type %T", key)
+			}
+			if _, exists := entries[key]; exists {
+				return nil, 0, fmt.Errorf("cbor: duplicate map key %v", key)
+			}
+
+			value, n, err := decodeCborItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset += n
+			entries[key] = value
+		}
+		return entries, offset, nil
+	case 6:
+		// Tags only annotate the following item
+		item, n, err := decodeCborItem(data[offset:], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		return item, offset + n, nil
+	}
+
+	return nil, 0, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+// cborArgument reads the argument of a data item header; indefinite lengths are not supported
+func cborArgument(data []byte, info byte) (uint64, int, error) {
+	switch {
+	case info < 24:
+		return uint64(info), 1, nil
+	case info == 24:
+		if len(data) < 2 {
+			return 0, 0, fmt.Errorf("cbor: unexpected end of data")
+		}
+		return uint64(data[1]), 2, nil
+	case info == 25:
+		if len(data) < 3 {
+			return 0, 0, fmt.Errorf("cbor: unexpected end of data")
+		}
+		return uint64(binary.BigEndian.Uint16(data[1:3])), 3, nil
+	case info == 26:
+		if len(data) < 5 {
+			return 0, 0, fmt.Errorf("cbor: unexpected end of data")
+		}
+		return uint64(binary.BigEndian.Uint32(data[1:5])), 5, nil
+	case info == 27:
+		if len(data) < 9 {
+			return 0, 0, fmt.Errorf("cbor: unexpected end of data")
+		}
+		return binary.BigEndian.Uint64(data[1:9]), 9, nil
+	}
+	return 0, 0, fmt.Errorf("cbor: unsupported additional information %d", info)
+}
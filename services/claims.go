@@ -0,0 +1,277 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// ClaimRequest is an individual claim request (OpenID Connect Core 1.0 §5.5.1).
+// A nil *ClaimRequest is a request for the claim with default behaviour.
+type ClaimRequest struct {
+	Essential bool          `json:"essential,omitempty"`
+	Value     interface{}   `json:"value,omitempty"`
+	Values    []interface{} `json:"values,omitempty"`
+}
+
+// ClaimsRequest is the "claims" authorization request parameter (OpenID Connect Core 1.0 §5.5)
+type ClaimsRequest struct {
+	Userinfo map[string]*ClaimRequest `json:"userinfo,omitempty"`
+	IdToken  map[string]*ClaimRequest `json:"id_token,omitempty"`
+}
+
+// RequestedClaim describes a requested claim for the consent screen
+type RequestedClaim struct {
+	Name      string   `json:"name"`
+	Targets   []string `json:"targets"`
+	Essential bool     `json:"essential"`
+}
+
+// SupportedClaims lists the claims the server can release, used for discovery
+var SupportedClaims = []string{
+	"sub", "iss", "aud", "exp", "iat", "nonce", "amr",
+	"name", "preferred_username", "picture", "updated_at", "email", "email_verified",
+	"phone_number", "phone_number_verified",
+	"id", "username", "avatar", "qq", "is_real_name", "is_admin",
+}
+
+// ParseClaimsRequest parses the claims parameter; an empty parameter yields nil
+func ParseClaimsRequest(raw string) (*ClaimsRequest, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var claimsRequest ClaimsRequest
+	if err := json.Unmarshal([]byte(raw), &claimsRequest); err != nil {
+		return nil, fmt.Errorf("claims parameter must be a JSON object: %v", err)
+	}
+	for _, target := range []map[string]*ClaimRequest{claimsRequest.Userinfo, claimsRequest.IdToken} {
+		for name, request := range target {
+			if request != nil && request.Value != nil && len(request.Values) > 0 {
+				return nil, fmt.Errorf("claim %s must not specify both value and values", name)
+			}
+		}
+	}
+
+	return &claimsRequest, nil
+}
+
+// String serializes the claims request for storage with the grant
+func (r *ClaimsRequest) String() string {
+	if r == nil || (len(r.Userinfo) == 0 && len(r.IdToken) == 0) {
+		return ""
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// RequestedClaims lists the requested claims in a stable order for display
+func (r *ClaimsRequest) RequestedClaims() []RequestedClaim {
+	if r == nil {
+		return []RequestedClaim{}
+	}
+
+	byName := map[string]*RequestedClaim{}
+	collect := func(target string, requests map[string]*ClaimRequest) {
+		for name, request := range requests {
+			claim, ok := byName[name]
+			if !ok {
+				claim = &RequestedClaim{Name: name, Targets: []string{}}
+				byName[name] = claim
+			}
+			claim.Targets = append(claim.Targets, target)
+			if request != nil && request.Essential {
+				claim.Essential = true
+			}
+		}
+	}
+	collect("userinfo", r.Userinfo)
+	collect("id_token", r.IdToken)
+
+	claims := make([]RequestedClaim, 0, len(byName))
+	for _, claim := range byName {
+		claims = append(claims, *claim)
+	}
+	sort.Slice(claims, func(i, j int) bool { return claims[i].Name < claims[j].Name })
+	return claims
+}
+
+// CheckSubject verifies an essential "sub" value request against the authenticated user.
+// A mismatch means the request cannot be satisfied (OpenID Connect Core 1.0 §5.5.1).
+func (r *ClaimsRequest) CheckSubject(user *models.User) bool {
+	if r == nil {
+		return true
+	}
+	for _, target := range []map[string]*ClaimRequest{r.Userinfo, r.IdToken} {
+		if request := target["sub"]; request != nil && !request.matches(user.GetId()) {
+			return false
+		}
+	}
+	return true
+}
+
+// matches checks a claim value against the requested value or values
+func (c *ClaimRequest) matches(value interface{}) bool {
+	if c == nil {
+		return true
+	}
+	if c.Value != nil {
+		return claimValueEqual(c.Value, value)
+	}
+	if len(c.Values) > 0 {
+		for _, candidate := range c.Values {
+			if claimValueEqual(candidate, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// claimValueEqual compares values after a JSON round trip so numbers and strings compare like the request
+func claimValueEqual(requested, actual interface{}) bool {
+	data, err := json.Marshal(actual)
+	if err != nil {
+		return false
+	}
+	var normalized interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(requested, normalized)
+}
+
+// UserClaims returns every claim the server can release about a user
+func UserClaims(user *models.User) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub":                user.GetId(),
+		"name":               user.Username,
+		"preferred_username": user.Username,
+		"email":              user.Email,
+		"email_verified":     user.EmailVerified,
+		"updated_at":         userUpdatedAt(user),
+		"id":                 user.Id,
+		"username":           user.Username,
+		"is_real_name":       user.IsRealName,
+		"is_admin":           user.IsAdmin,
+	}
+	if user.Avatar != "" {
+		claims["picture"] = user.Avatar
+		claims["avatar"] = user.Avatar
+	}
+	if user.QQ != "" {
+		claims["qq"] = user.QQ
+	}
+	if user.Phone != "" {
+		claims["phone_number"] = user.Phone
+		claims["phone_number_verified"] = user.PhoneVerified
+	}
+	return claims
+}
+
+// userUpdatedAt returns the profile update time as seconds since the epoch
+func userUpdatedAt(user *models.User) int64 {
+	for _, value := range []string{user.UpdatedTime, user.CreatedTime} {
+		if updated, err := time.Parse(time.RFC3339, value); err == nil {
+			return updated.Unix()
+		}
+	}
+	return time.Now().Unix()
+}
+
+// protocolClaims are claims that identify the token or the subject rather than describe the user.
+// A claims request can never add, change or withhold them.
+var protocolClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "iat": true, "nbf": true, "jti": true,
+	"nonce": true, "amr": true, "sid": true, "token_use": true, "owner": true, "isAdmin": true, "id": true,
+}
+
+// ApplyRequestedClaims adds the user claims requested for a target and drops released user
+// claims whose value does not satisfy a value/values request. Protocol claims and names that
+// are not user claims are left untouched.
+func ApplyRequestedClaims(claims map[string]interface{}, user *models.User, requests map[string]*ClaimRequest) {
+	if len(requests) == 0 {
+		return
+	}
+
+	available := UserClaims(user)
+	for name, request := range requests {
+		if protocolClaims[name] {
+			continue
+		}
+		value, ok := available[name]
+		if !ok {
+			continue
+		}
+		if current, released := claims[name]; released {
+			value = current
+		}
+		if !request.matches(value) {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+}
+
+// BuildUserInfo builds the UserInfo response for the granted scope and claims request
+func BuildUserInfo(user *models.User, scope string, claimsRequest *ClaimsRequest) map[string]interface{} {
+	available := UserClaims(user)
+	userInfo := map[string]interface{}{
+		"sub": user.GetId(),
+	}
+
+	// Profile scope - 包含头像
+	if hasScope(scope, "profile") || hasScope(scope, "openid") {
+		if picture, ok := available["picture"]; ok {
+			userInfo["picture"] = picture
+		}
+	}
+
+	// Email scope - 包含邮箱信息
+	if hasScope(scope, "email") || hasScope(scope, "openid") {
+		userInfo["email"] = user.Email
+	}
+
+	// Phone scope - 包含手机号信息（未绑定手机号时不返回）
+	if hasScope(scope, "phone") {
+		for _, name := range []string{"phone_number", "phone_number_verified"} {
+			if value, ok := available[name]; ok {
+				userInfo[name] = value
+			}
+		}
+	}
+
+	// 自定义声明（始终包含）
+	for _, name := range []string{"id", "username", "qq", "avatar", "is_real_name", "is_admin"} {
+		if value, ok := available[name]; ok {
+			userInfo[name] = value
+		}
+	}
+
+	if claimsRequest != nil {
+		ApplyRequestedClaims(userInfo, user, claimsRequest.Userinfo)
+	}
+
+	return userInfo
+}
+
+// GetGrantClaimsRequest returns the claims request stored with the grant of an access token
+func GetGrantClaimsRequest(accessToken string) (*ClaimsRequest, error) {
+	token, err := models.GetTokenByAccessToken(accessToken)
+	if err != nil || token == nil {
+		return nil, err
+	}
+	return ParseClaimsRequest(token.Claims)
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"os"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// TestParseClaimsRequest tests parsing of the claims parameter
+func TestParseClaimsRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		expectNil   bool
+		expectError bool
+	}{
+		{name: "Empty", raw: "", expectNil: true},
+		{name: "Null members", raw: `{"userinfo":{"email":null},"id_token":{"email_verified":{"essential":true}}}`},
+		{name: "Value and values", raw: `{"userinfo":{"email":{"value":"a","values":["b"]}}}`, expectError: true},
+		{name: "Not JSON", raw: "email", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claimsRequest, err := ParseClaimsRequest(tt.raw)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if (claimsRequest == nil) != tt.expectNil {
+				t.Errorf("Unexpected result: %+v", claimsRequest)
+			}
+		})
+	}
+}
+
+// TestRequestedClaims tests the consent screen summary
+func TestRequestedClaims(t *testing.T) {
+	claimsRequest, err := ParseClaimsRequest(`{"userinfo":{"email":null,"qq":{"essential":true}},"id_token":{"email":{"essential":true}}}`)
+	if err != nil {
+		t.Fatalf("ParseClaimsRequest failed: %v", err)
+	}
+
+	claims := claimsRequest.RequestedClaims()
+	if len(claims) != 2 || claims[0].Name != "email" || claims[1].Name != "qq" {
+		t.Fatalf("Unexpected claims: %+v", claims)
+	}
+	if !claims[0].Essential || len(claims[0].Targets) != 2 {
+		t.Errorf("Expected essential email for both targets, got %+v", claims[0])
+	}
+
+	// The stored form round-trips
+	restored, err := ParseClaimsRequest(claimsRequest.String())
+	if err != nil || len(restored.RequestedClaims()) != 2 {
+		t.Errorf("Stored claims request did not round-trip: %v", err)
+	}
+}
+
+// TestBuildUserInfoWithClaimsRequest tests that userinfo honours requested claims
+func TestBuildUserInfoWithClaimsRequest(t *testing.T) {
+	user := &models.User{Id: 7, Username: "alice", Email: "alice@example.com", EmailVerified: true, QQ: "10001"}
+
+	t.Run("Adds requested claims", func(t *testing.T) {
+		claimsRequest, _ := ParseClaimsRequest(`{"userinfo":{"email_verified":null,"preferred_username":{"essential":true}}}`)
+		userInfo := BuildUserInfo(user, "openid", claimsRequest)
+		if userInfo["email_verified"] != true || userInfo["preferred_username"] != "alice" {
+			t.Errorf("Requested claims missing: %v", userInfo)
+		}
+	})
+
+	t.Run("Drops claims that do not match value", func(t *testing.T) {
+		claimsRequest, _ := ParseClaimsRequest(`{"userinfo":{"qq":{"value":"20002"},"username":{"values":["bob","alice"]}}}`)
+		userInfo := BuildUserInfo(user, "openid", claimsRequest)
+		if _, ok := userInfo["qq"]; ok {
+			t.Errorf("Expected qq to be withheld, got %v", userInfo["qq"])
+		}
+		if userInfo["username"] != "alice" {
+			t.Errorf("Expected username to be released, got %v", userInfo["username"])
+		}
+	})
+
+	t.Run("Without claims request", func(t *testing.T) {
+		userInfo := BuildUserInfo(user, "openid", nil)
+		if userInfo["sub"] != "7" || userInfo["email"] != "alice@example.com" {
+			t.Errorf("Unexpected userinfo: %v", userInfo)
+		}
+	})
+}
+
+// TestBuildUserInfoPhoneScope tests that phone claims are released only under the phone scope
+func TestBuildUserInfoPhoneScope(t *testing.T) {
+	user := &models.User{Id: 7, Username: "alice", Phone: "+8613800138000", PhoneVerified: true}
+
+	userInfo := BuildUserInfo(user, "openid phone", nil)
+	if userInfo["phone_number"] != "+8613800138000" || userInfo["phone_number_verified"] != true {
+		t.Errorf("Expected phone claims, got %v", userInfo)
+	}
+
+	userInfo = BuildUserInfo(user, "openid profile", nil)
+	if _, ok := userInfo["phone_number"]; ok {
+		t.Errorf("Expected phone claims to be withheld without the phone scope")
+	}
+
+	userInfo = BuildUserInfo(&models.User{Id: 8}, "openid phone", nil)
+	if _, ok := userInfo["phone_number_verified"]; ok {
+		t.Errorf("Expected no phone claims for a user without a phone number")
+	}
+}
+
+// TestCheckSubject tests sub value requests
+func TestCheckSubject(t *testing.T) {
+	user := &models.User{Id: 7}
+
+	matching, _ := ParseClaimsRequest(`{"id_token":{"sub":{"value":"7"}}}`)
+	if !matching.CheckSubject(user) {
+		t.Errorf("Expected matching sub to pass")
+	}
+
+	mismatching, _ := ParseClaimsRequest(`{"id_token":{"sub":{"value":"8"}}}`)
+	if mismatching.CheckSubject(user) {
+		t.Errorf("Expected mismatching sub to fail")
+	}
+
+	var none *ClaimsRequest
+	if !none.CheckSubject(user) {
+		t.Errorf("Expected nil claims request to pass")
+	}
+}
+
+// TestGenerateIDTokenWithClaimsRequest tests that id_token claims are honoured
+func TestGenerateIDTokenWithClaimsRequest(t *testing.T) {
+	user := &models.User{Id: 7, Username: "alice", Email: "alice@example.com", EmailVerified: true, QQ: "10001"}
+	application := &models.Application{ClientId: "client", ExpireInHours: 1}
+
+	claimsRequest, _ := ParseClaimsRequest(`{"id_token":{"is_real_name":{"essential":true},"email":{"value":"other@example.com"}}}`)
+	idToken, err := GenerateIDToken(application, user, "n-0S6_WzA2Mj", nil, "", claimsRequest)
+	if err != nil {
+		t.Fatalf("GenerateIDToken failed: %v", err)
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			secret = "default-secret-key-change-in-production"
+		}
+		return []byte(secret), nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse ID token: %v", err)
+	}
+
+	if claims["is_real_name"] != false {
+		t.Errorf("Expected requested is_real_name claim, got %v", claims["is_real_name"])
+	}
+	if _, ok := claims["email"]; ok {
+		t.Errorf("Expected email to be withheld on value mismatch")
+	}
+	if claims["nonce"] != "n-0S6_WzA2Mj" || claims["sub"] != "7" {
+		t.Errorf("Default claims missing: %v", claims)
+	}
+}
+
+// TestGenerateIDTokenIgnoresProtocolClaimRequests tests that value requests for protocol claims
+// cannot strip them from the ID token
+func TestGenerateIDTokenIgnoresProtocolClaimRequests(t *testing.T) {
+	user := &models.User{Id: 7, Owner: "built-in", Username: "alice"}
+	application := &models.Application{ClientId: "client", ExpireInHours: 1}
+
+	claimsRequest, _ := ParseClaimsRequest(`{"id_token":{` +
+		`"iss":{"value":"x"},"aud":{"value":"x"},"exp":{"value":1},"iat":{"value":1},"nbf":{"value":1},` +
+		`"jti":{"value":"x"},"nonce":{"value":"x"},"amr":{"value":"x"},"sid":{"value":"x"},` +
+		`"token_use":{"value":"access"},"owner":{"value":"x"},"isAdmin":{"value":true},"id":{"value":"x"}}}`)
+	idToken, err := GenerateIDToken(application, user, "n-0S6_WzA2Mj", []string{"pwd"}, "", claimsRequest)
+	if err != nil {
+		t.Fatalf("GenerateIDToken failed: %v", err)
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			secret = "default-secret-key-change-in-production"
+		}
+		return []byte(secret), nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse ID token: %v", err)
+	}
+
+	for _, name := range []string{"iss", "sub", "aud", "exp", "iat", "nbf", "jti", "nonce", "amr"} {
+		if _, ok := claims[name]; !ok {
+			t.Errorf("Expected %s to be kept, got %v", name, claims)
+		}
+	}
+	if claims["token_use"] != "id" || claims["nonce"] != "n-0S6_WzA2Mj" {
+		t.Errorf("Expected protocol claims to be unchanged, got %v", claims)
+	}
+	if _, ok := claims["sid"]; ok {
+		t.Errorf("Expected sid not to be added, got %v", claims["sid"])
+	}
+}
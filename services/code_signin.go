@@ -0,0 +1,136 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// PurposeLogin is the verification code purpose for passwordless email sign-in
+const PurposeLogin = "login"
+
+// AmrEmail marks a sign-in with a code or link sent to the user's email address.
+// RFC 8176 has no value for it, so a descriptive one is used like other providers do.
+const AmrEmail = "email"
+
+// loginLinkLifetime matches the lifetime of the emailed code
+const loginLinkLifetime = 10 * time.Minute
+
+var ErrLoginLinkInvalid = fmt.Errorf("the sign-in link is invalid, expired or already used")
+
+// LoginLinkClaims is the signed state of a magic sign-in link
+type LoginLinkClaims struct {
+	Email    string `json:"email"`
+	ClientId string `json:"clientId,omitempty"`
+	LinkId   string `json:"lid"`
+
+	jwt.RegisteredClaims
+}
+
+// loginLinkKey derives the link signing key from JWT_SECRET.
+// Links use their own key so they are never accepted as bearer tokens or MFA tickets.
+func loginLinkKey() []byte {
+	jwtSecret := os.Getenv("JWT_SECRET")
+	if jwtSecret == "" {
+		jwtSecret = "default-secret-key-change-in-production"
+	}
+	mac := hmac.New(sha256.New, []byte(jwtSecret))
+	mac.Write([]byte("login-link"))
+	return mac.Sum(nil)
+}
+
+// frontendOrigin returns the origin of the web frontend without a trailing slash
+func frontendOrigin() string {
+	origin := os.Getenv("ORIGIN_FRONTEND")
+	if origin == "" {
+		origin = os.Getenv("ORIGIN")
+	}
+	if origin == "" {
+		origin = "http://localhost:8080"
+	}
+	return strings.TrimRight(origin, "/")
+}
+
+// loginLinkUrl returns the frontend URL that redeems a sign-in link token
+func loginLinkUrl(token string) string {
+	return fmt.Sprintf("%s/login?login_token=%s", frontendOrigin(), url.QueryEscape(token))
+}
+
+// GenerateLoginLink signs a magic link token bound to a stored login code
+func GenerateLoginLink(email, clientId, linkId string) (string, error) {
+	now := time.Now()
+	claims := LoginLinkClaims{
+		Email:    email,
+		ClientId: clientId,
+		LinkId:   linkId,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(loginLinkLifetime)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(loginLinkKey())
+}
+
+// ParseLoginLink verifies the signature and lifetime of a magic link token
+func ParseLoginLink(token string) (*LoginLinkClaims, error) {
+	claims := &LoginLinkClaims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		return loginLinkKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !parsed.Valid || claims.Email == "" || claims.LinkId == "" {
+		return nil, ErrLoginLinkInvalid
+	}
+	return claims, nil
+}
+
+// RedeemLoginLink verifies a magic link and consumes it together with its code
+func RedeemLoginLink(token string) (*LoginLinkClaims, error) {
+	claims, err := ParseLoginLink(token)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := consumeLoginLink(claims.Email, claims.LinkId); err != nil || !ok {
+		return nil, ErrLoginLinkInvalid
+	}
+	return claims, nil
+}
+
+// SendLoginEmail sends a sign-in code and a magic link to a registered user.
+// The link carries the client the sign-in was started for.
+func SendLoginEmail(user *models.User, clientId string) (string, error) {
+	vc, err := storeVerificationCode(user.Email, PurposeLogin, models.GenerateRandomString(32))
+	if err != nil {
+		return "", err
+	}
+
+	token, err := GenerateLoginLink(user.Email, clientId, vc.LinkId)
+	if err != nil {
+		return "", err
+	}
+
+	err = SendEmailViaSMTP(user.Email, "XianlinNet ID - 登录验证码", getLoginEmailTemplate(vc.Code, loginLinkUrl(token)))
+	if err != nil {
+		log.Printf("Failed to send login email: %v", err)
+	}
+
+	// In development, return the code for testing
+	smtpEnabled, _ := strconv.ParseBool(os.Getenv("SMTP_ENABLED"))
+	if !smtpEnabled {
+		log.Printf("Verification code for %s (%s): %s", user.Email, PurposeLogin, vc.Code)
+		return vc.Code, nil
+	}
+
+	return "", nil
+}
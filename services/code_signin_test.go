@@ -0,0 +1,88 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestLoginLink tests that a magic link is signed, single use and shares its entry with the code
+func TestLoginLink(t *testing.T) {
+	email := "link@example.com"
+	vc, err := storeVerificationCode(email, PurposeLogin, "link-id")
+	if err != nil {
+		t.Fatalf("Failed to store code: %v", err)
+	}
+
+	token, err := GenerateLoginLink(email, "client", vc.LinkId)
+	if err != nil {
+		t.Fatalf("GenerateLoginLink failed: %v", err)
+	}
+
+	if _, err := ParseJwtToken(token); err == nil {
+		t.Errorf("Expected sign-in link to be rejected as a bearer token")
+	}
+	if _, err := ParseMfaTicket(token); err == nil {
+		t.Errorf("Expected sign-in link to be rejected as an MFA ticket")
+	}
+	if _, err := ParseLoginLink(token[:len(token)-2]); err != ErrLoginLinkInvalid {
+		t.Errorf("Expected tampered link to be rejected")
+	}
+
+	claims, err := RedeemLoginLink(token)
+	if err != nil {
+		t.Fatalf("RedeemLoginLink failed: %v", err)
+	}
+	if claims.Email != email || claims.ClientId != "client" {
+		t.Errorf("Unexpected link claims: %+v", claims)
+	}
+
+	if _, err := RedeemLoginLink(token); err != ErrLoginLinkInvalid {
+		t.Errorf("Expected link to be usable only once")
+	}
+	if ok, _ := VerifyCode(email, vc.Code, PurposeLogin); ok {
+		t.Errorf("Expected code to be consumed together with the link")
+	}
+}
+
+// TestLoginLinkAfterCode tests that using the code invalidates the link and a new code replaces the old link
+func TestLoginLinkAfterCode(t *testing.T) {
+	email := "code@example.com"
+	vc, _ := storeVerificationCode(email, PurposeLogin, "first")
+	first, _ := GenerateLoginLink(email, "", vc.LinkId)
+
+	next, _ := storeVerificationCode(email, PurposeLogin, "second")
+	if _, err := RedeemLoginLink(first); err != ErrLoginLinkInvalid {
+		t.Errorf("Expected link of a replaced code to be rejected")
+	}
+
+	second, _ := GenerateLoginLink(email, "", next.LinkId)
+	if ok, err := VerifyCode(email, next.Code, PurposeLogin); !ok {
+		t.Fatalf("Expected code to be valid: %v", err)
+	}
+	if _, err := RedeemLoginLink(second); err != ErrLoginLinkInvalid {
+		t.Errorf("Expected link to be rejected after its code was used")
+	}
+
+	// Codes of other purposes have no link
+	register, _ := storeVerificationCode(email, "register", "")
+	if ok, _ := consumeLoginLink(email, register.LinkId); ok {
+		t.Errorf("Expected a register code not to be redeemable as a link")
+	}
+}
+
+// TestLoginLinkUrl tests that the link points at the frontend login page
+func TestLoginLinkUrl(t *testing.T) {
+	t.Setenv("ORIGIN_FRONTEND", "https://id.example.com/")
+
+	link, err := url.Parse(loginLinkUrl("a.b+c"))
+	if err != nil {
+		t.Fatalf("Invalid link: %v", err)
+	}
+	if !strings.HasPrefix(link.String(), "https://id.example.com/login?") || link.Query().Get("login_token") != "a.b+c" {
+		t.Errorf("Unexpected link: %s", link)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"fmt"
+	"html"
 	"log"
 	"math/big"
 	"net/smtp"
@@ -15,20 +16,6 @@ import (
 	"time"
 )
 
-// EmailVerificationCode stores verification code information
-type EmailVerificationCode struct {
-	Email       string
-	Code        string
-	Purpose     string // "register", "reset_password"
-	CreatedAt   time.Time
-	ExpiresAt   time.Time
-	Attempts    int
-	MaxAttempts int
-}
-
-// In-memory storage for verification codes (in production, use Redis)
-var verificationCodes = make(map[string]*EmailVerificationCode)
-
 // GenerateVerificationCode generates a 6-digit verification code using crypto/rand
 func GenerateVerificationCode() string {
 	code := ""
@@ -144,20 +131,12 @@ func SendEmailViaSMTP(to, subject, body string) error {
 
 // SendVerificationEmail sends verification code via email
 func SendVerificationEmail(email, purpose string) (string, error) {
-	// Generate verification code
-	code := GenerateVerificationCode()
-
-	// Store verification code
-	key := fmt.Sprintf("%s:%s", email, purpose)
-	verificationCodes[key] = &EmailVerificationCode{
-		Email:       email,
-		Code:        code,
-		Purpose:     purpose,
-		CreatedAt:   time.Now(),
-		ExpiresAt:   time.Now().Add(10 * time.Minute), // 10 minutes expiration
-		Attempts:    0,
-		MaxAttempts: 5,
+	// Generate and store verification code
+	vc, err := storeVerificationCode(email, purpose, "")
+	if err != nil {
+		return "", err
 	}
+	code := vc.Code
 
 	// Prepare email content
 	var subject, body string
@@ -167,10 +146,16 @@ func SendVerificationEmail(email, purpose string) (string, error) {
 	} else if purpose == "reset_password" {
 		subject = "XianlinNet ID - 密码重置验证码"
 		body = getResetPasswordEmailTemplate(code)
+	} else if purpose == PurposeRealName {
+		subject = "XianlinNet ID - 实名认证验证码"
+		body = getRealNameEmailTemplate(code)
+	} else if purpose == PurposeDeleteAccount {
+		subject = "XianlinNet ID - 注销账号验证码"
+		body = getDeleteAccountEmailTemplate(code)
 	}
 
 	// Send email
-	err := SendEmailViaSMTP(email, subject, body)
+	err = SendEmailViaSMTP(email, subject, body)
 	if err != nil {
 		log.Printf("Failed to send verification email: %v", err)
 		// In development, still log the code
@@ -341,58 +326,411 @@ func getResetPasswordEmailTemplate(code string) string {
 `, code)
 }
 
-// VerifyCode verifies the email verification code
-func VerifyCode(email, code, purpose string) (bool, error) {
-	key := fmt.Sprintf("%s:%s", email, purpose)
-
-	vc, exists := verificationCodes[key]
-	if !exists {
-		return false, fmt.Errorf("verification code not found")
-	}
+// getDeleteAccountEmailTemplate returns the HTML template for the code that confirms an account deletion
+func getDeleteAccountEmailTemplate(code string) string {
+	return fmt.Sprintf(`
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>注销账号验证码</title>
+</head>
+<body style="margin: 0; padding: 0; font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif; background-color: #f5f7fa;">
+    <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="background-color: #f5f7fa; padding: 40px 0;">
+        <tr>
+            <td align="center">
+                <table width="600" cellpadding="0" cellspacing="0" border="0" style="background-color: #ffffff; border-radius: 12px; box-shadow: 0 4px 12px rgba(0,0,0,0.1); overflow: hidden;">
+                    <!-- Header -->
+                    <tr>
+                        <td style="background: linear-gradient(135deg, #f6339a 0%%, #ff4db3 100%%); padding: 40px 30px; text-align: center;">
+                            <h1 style="margin: 0; color: #ffffff; font-size: 28px; font-weight: 600;">XianlinNet ID</h1>
+                            <p style="margin: 10px 0 0 0; color: rgba(255,255,255,0.9); font-size: 14px;">安全、可靠的身份认证服务</p>
+                        </td>
+                    </tr>
+                    
+                    <!-- Content -->
+                    <tr>
+                        <td style="padding: 40px 30px;">
+                            <h2 style="margin: 0 0 20px 0; color: #333333; font-size: 22px; font-weight: 600;">注销账号确认</h2>
+                            <p style="margin: 0 0 30px 0; color: #666666; font-size: 15px; line-height: 1.6;">
+                                我们收到了您注销 XianlinNet ID 账号的请求。请使用以下验证码确认注销：
+                            </p>
+                            
+                            <!-- Verification Code Box -->
+                            <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="margin: 30px 0;">
+                                <tr>
+                                    <td align="center" style="background: linear-gradient(135deg, #f6339a 0%%, #ff4db3 100%%); border-radius: 8px; padding: 30px;">
+                                        <div style="font-size: 36px; font-weight: bold; color: #ffffff; letter-spacing: 8px; font-family: 'Courier New', monospace;">
+                                            %s
+                                        </div>
+                                    </td>
+                                </tr>
+                            </table>
+                            
+                            <div style="background-color: #fff3cd; border-left: 4px solid #ffc107; padding: 15px 20px; margin: 30px 0; border-radius: 4px;">
+                                <p style="margin: 0; color: #856404; font-size: 14px; line-height: 1.6;">
+                                    <strong style="color: #856404;">⚠️ 安全警告</strong><br>
+                                    • 验证码有效期为 <strong>10 分钟</strong><br>
+                                    • 如果这不是您的操作，请立即更改密码<br>
+                                    • 确认后账号将在冷静期结束时永久删除，期间可以登录并撤销注销
+                                </p>
+                            </div>
+                            
+                            <p style="margin: 30px 0 0 0; color: #999999; font-size: 13px; line-height: 1.6;">
+                                如果您没有请求重置密码，请忽略此邮件。您的密码不会被更改。
+                            </p>
+                        </td>
+                    </tr>
+                    
+                    <!-- Footer -->
+                    <tr>
+                        <td style="background-color: #f8f9fa; padding: 30px; text-align: center; border-top: 1px solid #e9ecef;">
+                            <p style="margin: 0 0 10px 0; color: #999999; font-size: 12px;">
+                                此邮件由系统自动发送，请勿直接回复
+                            </p>
+                            <p style="margin: 0; color: #999999; font-size: 12px;">
+                                &copy; 2024 XianlinNet. All rights reserved.
+                            </p>
+                        </td>
+                    </tr>
+                </table>
+            </td>
+        </tr>
+    </table>
+</body>
+</html>
+`, code)
+}
 
-	// Check if expired
-	if time.Now().After(vc.ExpiresAt) {
-		delete(verificationCodes, key)
-		return false, fmt.Errorf("verification code expired")
-	}
+// getRealNameEmailTemplate returns the HTML template for real name verification email
+func getRealNameEmailTemplate(code string) string {
+	return fmt.Sprintf(`
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>实名认证验证码</title>
+</head>
+<body style="margin: 0; padding: 0; font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif; background-color: #f5f7fa;">
+    <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="background-color: #f5f7fa; padding: 40px 0;">
+        <tr>
+            <td align="center">
+                <table width="600" cellpadding="0" cellspacing="0" border="0" style="background-color: #ffffff; border-radius: 12px; box-shadow: 0 4px 12px rgba(0,0,0,0.1); overflow: hidden;">
+                    <!-- Header -->
+                    <tr>
+                        <td style="background: linear-gradient(135deg, #f6339a 0%%, #ff4db3 100%%); padding: 40px 30px; text-align: center;">
+                            <h1 style="margin: 0; color: #ffffff; font-size: 28px; font-weight: 600;">XianlinNet ID</h1>
+                            <p style="margin: 10px 0 0 0; color: rgba(255,255,255,0.9); font-size: 14px;">安全、可靠的身份认证服务</p>
+                        </td>
+                    </tr>
+                    
+                    <!-- Content -->
+                    <tr>
+                        <td style="padding: 40px 30px;">
+                            <h2 style="margin: 0 0 20px 0; color: #333333; font-size: 22px; font-weight: 600;">实名认证验证</h2>
+                            <p style="margin: 0 0 30px 0; color: #666666; font-size: 15px; line-height: 1.6;">
+                                您正在为 XianlinNet ID 账号进行实名认证，请使用以下验证码完成验证：
+                            </p>
+                            
+                            <!-- Verification Code Box -->
+                            <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="margin: 30px 0;">
+                                <tr>
+                                    <td align="center" style="background: linear-gradient(135deg, #f6339a 0%%, #ff4db3 100%%); border-radius: 8px; padding: 30px;">
+                                        <div style="font-size: 36px; font-weight: bold; color: #ffffff; letter-spacing: 8px; font-family: 'Courier New', monospace;">
+                                            %s
+                                        </div>
+                                    </td>
+                                </tr>
+                            </table>
+                            
+                            <div style="background-color: #f8f9fa; border-left: 4px solid #f6339a; padding: 15px 20px; margin: 30px 0; border-radius: 4px;">
+                                <p style="margin: 0; color: #666666; font-size: 14px; line-height: 1.6;">
+                                    <strong style="color: #333333;">重要提示：</strong><br>
+                                    • 验证码有效期为 <strong>10 分钟</strong><br>
+                                    • 请勿将验证码告知他人<br>
+                                    • 如非本人操作，请忽略此邮件
+                                </p>
+                            </div>
+                            
+                            <p style="margin: 30px 0 0 0; color: #999999; font-size: 13px; line-height: 1.6;">
+                                如果您没有请求此验证码，可能是他人误输入了您的邮箱地址。您可以放心地忽略此邮件。
+                            </p>
+                        </td>
+                    </tr>
+                    
+                    <!-- Footer -->
+                    <tr>
+                        <td style="background-color: #f8f9fa; padding: 30px; text-align: center; border-top: 1px solid #e9ecef;">
+                            <p style="margin: 0 0 10px 0; color: #999999; font-size: 12px;">
+                                此邮件由系统自动发送，请勿直接回复
+                            </p>
+                            <p style="margin: 0; color: #999999; font-size: 12px;">
+                                &copy; 2024 XianlinNet. All rights reserved.
+                            </p>
+                        </td>
+                    </tr>
+                </table>
+            </td>
+        </tr>
+    </table>
+</body>
+</html>
+`, code)
+}
 
-	// Check attempts
-	if vc.Attempts >= vc.MaxAttempts {
-		delete(verificationCodes, key)
-		return false, fmt.Errorf("too many attempts")
-	}
+// getLoginEmailTemplate returns the HTML template for the sign-in email with a code and a magic link
+func getLoginEmailTemplate(code, link string) string {
+	return fmt.Sprintf(`
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>登录验证码</title>
+</head>
+<body style="margin: 0; padding: 0; font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif; background-color: #f5f7fa;">
+    <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="background-color: #f5f7fa; padding: 40px 0;">
+        <tr>
+            <td align="center">
+                <table width="600" cellpadding="0" cellspacing="0" border="0" style="background-color: #ffffff; border-radius: 12px; box-shadow: 0 4px 12px rgba(0,0,0,0.1); overflow: hidden;">
+                    <!-- Header -->
+                    <tr>
+                        <td style="background: linear-gradient(135deg, #f6339a 0%%, #ff4db3 100%%); padding: 40px 30px; text-align: center;">
+                            <h1 style="margin: 0; color: #ffffff; font-size: 28px; font-weight: 600;">XianlinNet ID</h1>
+                            <p style="margin: 10px 0 0 0; color: rgba(255,255,255,0.9); font-size: 14px;">安全、可靠的身份认证服务</p>
+                        </td>
+                    </tr>
+                    
+                    <!-- Content -->
+                    <tr>
+                        <td style="padding: 40px 30px;">
+                            <h2 style="margin: 0 0 20px 0; color: #333333; font-size: 22px; font-weight: 600;">登录 XianlinNet ID</h2>
+                            <p style="margin: 0 0 30px 0; color: #666666; font-size: 15px; line-height: 1.6;">
+                                请在登录页输入以下验证码，或点击下方按钮直接登录：
+                            </p>
+                            
+                            <!-- Verification Code Box -->
+                            <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="margin: 30px 0;">
+                                <tr>
+                                    <td align="center" style="background: linear-gradient(135deg, #f6339a 0%%, #ff4db3 100%%); border-radius: 8px; padding: 30px;">
+                                        <div style="font-size: 36px; font-weight: bold; color: #ffffff; letter-spacing: 8px; font-family: 'Courier New', monospace;">
+                                            %s
+                                        </div>
+                                    </td>
+                                </tr>
+                            </table>
 
-	// Increment attempts
-	vc.Attempts++
+                            <!-- Magic Link Button -->
+                            <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="margin: 0 0 30px 0;">
+                                <tr>
+                                    <td align="center">
+                                        <a href="%s" style="display: inline-block; padding: 14px 36px; background-color: #f6339a; color: #ffffff; font-size: 16px; font-weight: 600; text-decoration: none; border-radius: 8px;">一键登录</a>
+                                    </td>
+                                </tr>
+                            </table>
+                            
+                            <div style="background-color: #fff3cd; border-left: 4px solid #ffc107; padding: 15px 20px; margin: 30px 0; border-radius: 4px;">
+                                <p style="margin: 0; color: #856404; font-size: 14px; line-height: 1.6;">
+                                    <strong style="color: #856404;">⚠️ 安全警告</strong><br>
+                                    • 验证码和登录链接有效期为 <strong>10 分钟</strong>，只能使用一次<br>
+                                    • 任何人获得验证码或链接都可以登录您的账号，请勿转发此邮件<br>
+                                    • 如果这不是您的操作，请忽略此邮件
+                                </p>
+                            </div>
+                            
+                            <p style="margin: 30px 0 0 0; color: #999999; font-size: 13px; line-height: 1.6;">
+                                如果您没有请求登录，可能是他人误输入了您的邮箱地址。您可以放心地忽略此邮件。
+                            </p>
+                        </td>
+                    </tr>
+                    
+                    <!-- Footer -->
+                    <tr>
+                        <td style="background-color: #f8f9fa; padding: 30px; text-align: center; border-top: 1px solid #e9ecef;">
+                            <p style="margin: 0 0 10px 0; color: #999999; font-size: 12px;">
+                                此邮件由系统自动发送，请勿直接回复
+                            </p>
+                            <p style="margin: 0; color: #999999; font-size: 12px;">
+                                &copy; 2024 XianlinNet. All rights reserved.
+                            </p>
+                        </td>
+                    </tr>
+                </table>
+            </td>
+        </tr>
+    </table>
+</body>
+</html>
+`, code, html.EscapeString(link))
+}
 
-	// Verify code
-	if vc.Code != code {
-		return false, fmt.Errorf("invalid verification code")
-	}
+// getChangeEmailTemplate returns the HTML template for the code that confirms a new email address
+func getChangeEmailTemplate(code string) string {
+	return fmt.Sprintf(`
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>更换邮箱验证码</title>
+</head>
+<body style="margin: 0; padding: 0; font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif; background-color: #f5f7fa;">
+    <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="background-color: #f5f7fa; padding: 40px 0;">
+        <tr>
+            <td align="center">
+                <table width="600" cellpadding="0" cellspacing="0" border="0" style="background-color: #ffffff; border-radius: 12px; box-shadow: 0 4px 12px rgba(0,0,0,0.1); overflow: hidden;">
+                    <!-- Header -->
+                    <tr>
+                        <td style="background: linear-gradient(135deg, #f6339a 0%%, #ff4db3 100%%); padding: 40px 30px; text-align: center;">
+                            <h1 style="margin: 0; color: #ffffff; font-size: 28px; font-weight: 600;">XianlinNet ID</h1>
+                            <p style="margin: 10px 0 0 0; color: rgba(255,255,255,0.9); font-size: 14px;">安全、可靠的身份认证服务</p>
+                        </td>
+                    </tr>
+                    
+                    <!-- Content -->
+                    <tr>
+                        <td style="padding: 40px 30px;">
+                            <h2 style="margin: 0 0 20px 0; color: #333333; font-size: 22px; font-weight: 600;">确认新的邮箱地址</h2>
+                            <p style="margin: 0 0 30px 0; color: #666666; font-size: 15px; line-height: 1.6;">
+                                您正在将 XianlinNet ID 账号的邮箱更换为此地址，请使用以下验证码完成确认：
+                            </p>
+                            
+                            <!-- Verification Code Box -->
+                            <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="margin: 30px 0;">
+                                <tr>
+                                    <td align="center" style="background: linear-gradient(135deg, #f6339a 0%%, #ff4db3 100%%); border-radius: 8px; padding: 30px;">
+                                        <div style="font-size: 36px; font-weight: bold; color: #ffffff; letter-spacing: 8px; font-family: 'Courier New', monospace;">
+                                            %s
+                                        </div>
+                                    </td>
+                                </tr>
+                            </table>
+                            
+                            <div style="background-color: #f8f9fa; border-left: 4px solid #f6339a; padding: 15px 20px; margin: 30px 0; border-radius: 4px;">
+                                <p style="margin: 0; color: #666666; font-size: 14px; line-height: 1.6;">
+                                    <strong style="color: #333333;">重要提示：</strong><br>
+                                    • 验证码有效期为 <strong>10 分钟</strong><br>
+                                    • 请勿将验证码告知他人<br>
+                                    • 如非本人操作，请忽略此邮件，邮箱不会被更换
+                                </p>
+                            </div>
+                            
+                            <p style="margin: 30px 0 0 0; color: #999999; font-size: 13px; line-height: 1.6;">
+                                如果您没有请求此验证码，可能是他人误输入了您的邮箱地址。您可以放心地忽略此邮件。
+                            </p>
+                        </td>
+                    </tr>
+                    
+                    <!-- Footer -->
+                    <tr>
+                        <td style="background-color: #f8f9fa; padding: 30px; text-align: center; border-top: 1px solid #e9ecef;">
+                            <p style="margin: 0 0 10px 0; color: #999999; font-size: 12px;">
+                                此邮件由系统自动发送，请勿直接回复
+                            </p>
+                            <p style="margin: 0; color: #999999; font-size: 12px;">
+                                &copy; 2024 XianlinNet. All rights reserved.
+                            </p>
+                        </td>
+                    </tr>
+                </table>
+            </td>
+        </tr>
+    </table>
+</body>
+</html>
+`, code)
+}
 
-	// Code is valid, delete it
-	delete(verificationCodes, key)
-	return true, nil
+// getEmailChangedTemplate returns the HTML template that tells the previous address about an email change
+func getEmailChangedTemplate(newEmail, revertLink string) string {
+	return fmt.Sprintf(`
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>邮箱已更换</title>
+</head>
+<body style="margin: 0; padding: 0; font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif; background-color: #f5f7fa;">
+    <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="background-color: #f5f7fa; padding: 40px 0;">
+        <tr>
+            <td align="center">
+                <table width="600" cellpadding="0" cellspacing="0" border="0" style="background-color: #ffffff; border-radius: 12px; box-shadow: 0 4px 12px rgba(0,0,0,0.1); overflow: hidden;">
+                    <!-- Header -->
+                    <tr>
+                        <td style="background: linear-gradient(135deg, #f6339a 0%%, #ff4db3 100%%); padding: 40px 30px; text-align: center;">
+                            <h1 style="margin: 0; color: #ffffff; font-size: 28px; font-weight: 600;">XianlinNet ID</h1>
+                            <p style="margin: 10px 0 0 0; color: rgba(255,255,255,0.9); font-size: 14px;">安全、可靠的身份认证服务</p>
+                        </td>
+                    </tr>
+                    
+                    <!-- Content -->
+                    <tr>
+                        <td style="padding: 40px 30px;">
+                            <h2 style="margin: 0 0 20px 0; color: #333333; font-size: 22px; font-weight: 600;">账号邮箱已更换</h2>
+                            <p style="margin: 0 0 30px 0; color: #666666; font-size: 15px; line-height: 1.6;">
+                                您的 XianlinNet ID 账号邮箱已更换为 <strong>%s</strong>，此地址将不再用于登录和接收通知。
+                            </p>
+                            
+                            <!-- Revert Button -->
+                            <table width="100%%" cellpadding="0" cellspacing="0" border="0" style="margin: 30px 0;">
+                                <tr>
+                                    <td align="center">
+                                        <a href="%s" style="display: inline-block; padding: 14px 36px; background-color: #f6339a; color: #ffffff; font-size: 16px; font-weight: 600; text-decoration: none; border-radius: 8px;">这不是我的操作，恢复原邮箱</a>
+                                    </td>
+                                </tr>
+                            </table>
+                            
+                            <div style="background-color: #fff3cd; border-left: 4px solid #ffc107; padding: 15px 20px; margin: 30px 0; border-radius: 4px;">
+                                <p style="margin: 0; color: #856404; font-size: 14px; line-height: 1.6;">
+                                    <strong style="color: #856404;">⚠️ 安全警告</strong><br>
+                                    • 恢复链接有效期为 <strong>7 天</strong>，只能使用一次<br>
+                                    • 恢复后账号的所有登录会话和授权令牌都会失效<br>
+                                    • 恢复后请立即修改密码
+                                </p>
+                            </div>
+                            
+                            <p style="margin: 30px 0 0 0; color: #999999; font-size: 13px; line-height: 1.6;">
+                                如果这是您本人的操作，可以放心地忽略此邮件。
+                            </p>
+                        </td>
+                    </tr>
+                    
+                    <!-- Footer -->
+                    <tr>
+                        <td style="background-color: #f8f9fa; padding: 30px; text-align: center; border-top: 1px solid #e9ecef;">
+                            <p style="margin: 0 0 10px 0; color: #999999; font-size: 12px;">
+                                此邮件由系统自动发送，请勿直接回复
+                            </p>
+                            <p style="margin: 0; color: #999999; font-size: 12px;">
+                                &copy; 2024 XianlinNet. All rights reserved.
+                            </p>
+                        </td>
+                    </tr>
+                </table>
+            </td>
+        </tr>
+    </table>
+</body>
+</html>
+`, html.EscapeString(newEmail), html.EscapeString(revertLink))
 }
 
-// CleanupExpiredCodes removes expired verification codes
-func CleanupExpiredCodes() {
-	for key, vc := range verificationCodes {
-		if time.Now().After(vc.ExpiresAt) {
-			delete(verificationCodes, key)
-		}
+// VerifyCode verifies a code sent by email or text message and consumes it when it matches
+func VerifyCode(target, code, purpose string) (bool, error) {
+	if err := GetVerificationCodeStore().Verify(target, purpose, code); err != nil {
+		return false, err
 	}
+	return true, nil
 }
 
-// Initialize cleanup routine
-func init() {
-	// Run cleanup every 5 minutes
-	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			CleanupExpiredCodes()
-		}
-	}()
+// consumeLoginLink redeems the magic link sent with a login code. The code and the link
+// share one entry, so using either of them invalidates both.
+func consumeLoginLink(email, linkId string) (bool, error) {
+	if err := GetVerificationCodeStore().ConsumeLink(email, PurposeLogin, linkId); err != nil {
+		return false, err
+	}
+	return true, nil
 }
@@ -0,0 +1,232 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// PurposeChangeEmail is the verification code purpose for confirming a new email address
+const PurposeChangeEmail = "change_email"
+
+// emailRevertLifetime is how long the previous address can undo an email change
+const emailRevertLifetime = 7 * 24 * time.Hour
+
+var (
+	ErrEmailInvalid       = fmt.Errorf("invalid email format")
+	ErrEmailTaken         = fmt.Errorf("email already registered")
+	ErrEmailUnchanged     = fmt.Errorf("the new email is the current email")
+	ErrEmailRevertInvalid = fmt.Errorf("the revert link is invalid, expired or already used")
+)
+
+// EmailRevertClaims is the signed state of the link that undoes an email change
+type EmailRevertClaims struct {
+	PreviousEmail string `json:"previousEmail"`
+	NewEmail      string `json:"newEmail"`
+
+	jwt.RegisteredClaims
+}
+
+// emailRevertKey derives the revert link signing key from JWT_SECRET, so revert links are
+// never accepted as bearer tokens or sign-in links
+func emailRevertKey() []byte {
+	jwtSecret := os.Getenv("JWT_SECRET")
+	if jwtSecret == "" {
+		jwtSecret = "default-secret-key-change-in-production"
+	}
+	mac := hmac.New(sha256.New, []byte(jwtSecret))
+	mac.Write([]byte("email-revert"))
+	return mac.Sum(nil)
+}
+
+// emailChangeTarget binds a change code to the user who asked for it, so a code sent to an
+// address cannot be redeemed by another account
+func emailChangeTarget(userId int64, email string) string {
+	return fmt.Sprintf("%d:%s", userId, strings.ToLower(email))
+}
+
+// checkNewEmail validates a new email address for a user
+func checkNewEmail(user *models.User, email string) error {
+	if !ValidateEmail(email) {
+		return ErrEmailInvalid
+	}
+	if strings.EqualFold(email, user.Email) {
+		return ErrEmailUnchanged
+	}
+	existingUser, err := models.GetUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	if existingUser != nil && existingUser.Id != user.Id {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+// SendEmailChangeCode sends a code to the new address of a user. The email only changes once
+// the code comes back, so a typo or an address the user does not own never replaces the current one.
+func SendEmailChangeCode(user *models.User, email string) (string, error) {
+	if err := checkNewEmail(user, email); err != nil {
+		return "", err
+	}
+
+	vc, err := storeVerificationCode(emailChangeTarget(user.Id, email), PurposeChangeEmail, "")
+	if err != nil {
+		return "", err
+	}
+
+	err = SendEmailViaSMTP(email, "XianlinNet ID - 更换邮箱验证码", getChangeEmailTemplate(vc.Code))
+	if err != nil {
+		log.Printf("Failed to send email change code: %v", err)
+	}
+
+	// In development, return the code for testing
+	smtpEnabled, _ := strconv.ParseBool(os.Getenv("SMTP_ENABLED"))
+	if !smtpEnabled {
+		log.Printf("Verification code for %s (%s): %s", email, PurposeChangeEmail, vc.Code)
+		return vc.Code, nil
+	}
+
+	return "", nil
+}
+
+// ConfirmEmailChange verifies the code sent to the new address and makes it the verified email
+// of the user. The previous address is told about the change and gets a link to undo it.
+func ConfirmEmailChange(user *models.User, email, code string) error {
+	if err := checkNewEmail(user, email); err != nil {
+		return err
+	}
+	if _, err := VerifyCode(emailChangeTarget(user.Id, email), code, PurposeChangeEmail); err != nil {
+		return err
+	}
+
+	// While an earlier change can still be reverted, the address it replaced stays the one a
+	// revert restores, so changing the email twice does not lock the original owner out
+	previousEmail := user.Email
+	if user.PreviousEmail == "" || !emailChangeRevertible(user, time.Now()) {
+		user.PreviousEmail = previousEmail
+	}
+
+	now := time.Now()
+	user.Email = email
+	user.EmailVerified = true
+	user.EmailChangedTime = now.Format(time.RFC3339)
+	user.UpdatedTime = now.Format(time.RFC3339)
+	if _, err := models.UpdateUserEmail(user); err != nil {
+		return err
+	}
+
+	if previousEmail != "" {
+		notifyEmailChanged(user, previousEmail)
+	}
+	return nil
+}
+
+// emailChangeRevertible reports whether the last email change of a user can still be reverted
+func emailChangeRevertible(user *models.User, now time.Time) bool {
+	changedTime, err := time.Parse(time.RFC3339, user.EmailChangedTime)
+	if err != nil {
+		return false
+	}
+	return now.Before(changedTime.Add(emailRevertLifetime))
+}
+
+// notifyEmailChanged tells the replaced address of a user about the change and sends it the revert link
+func notifyEmailChanged(user *models.User, previousEmail string) {
+	token, err := GenerateEmailRevertLink(user)
+	if err != nil {
+		log.Printf("[Email] Failed to sign the revert link for user %d: %v", user.Id, err)
+		return
+	}
+	link := fmt.Sprintf("%s/login?email_revert_token=%s", frontendOrigin(), url.QueryEscape(token))
+	if err := SendEmailViaSMTP(previousEmail, "XianlinNet ID - 账号邮箱已更换", getEmailChangedTemplate(user.Email, link)); err != nil {
+		log.Printf("[Email] Failed to notify %s of the email change: %v", previousEmail, err)
+	}
+}
+
+// GenerateEmailRevertLink signs a token that restores the previous email of a user
+func GenerateEmailRevertLink(user *models.User) (string, error) {
+	now := time.Now()
+	claims := EmailRevertClaims{
+		PreviousEmail: user.PreviousEmail,
+		NewEmail:      user.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.GetId(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(emailRevertLifetime)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(emailRevertKey())
+}
+
+// ParseEmailRevertLink verifies the signature and lifetime of a revert link token
+func ParseEmailRevertLink(token string) (*EmailRevertClaims, error) {
+	claims := &EmailRevertClaims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		return emailRevertKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !parsed.Valid || claims.Subject == "" || claims.PreviousEmail == "" {
+		return nil, ErrEmailRevertInvalid
+	}
+	return claims, nil
+}
+
+// RevertEmailChange restores the previous email of a user from a revert link. The link only
+// works while its address is still the one a revert restores, so it can be used once. All tokens
+// and sessions of the user are revoked, since an unwanted change suggests someone else holds the account.
+func RevertEmailChange(token string) (*models.User, error) {
+	claims, err := ParseEmailRevertLink(token)
+	if err != nil {
+		return nil, err
+	}
+	userId, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, ErrEmailRevertInvalid
+	}
+
+	user, err := models.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.IsDeleted || user.PreviousEmail != claims.PreviousEmail {
+		return nil, ErrEmailRevertInvalid
+	}
+
+	existingUser, err := models.GetUserByEmail(claims.PreviousEmail)
+	if err != nil {
+		return nil, err
+	}
+	if existingUser != nil && existingUser.Id != user.Id {
+		return nil, ErrEmailTaken
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	user.Email = claims.PreviousEmail
+	user.EmailVerified = true // The link was opened from the previous address
+	user.PreviousEmail = ""
+	user.EmailChangedTime = now
+	user.UpdatedTime = now
+	if _, err := models.UpdateUserEmail(user); err != nil {
+		return nil, err
+	}
+
+	if err := models.RevokeUserTokens(user.GetId()); err != nil {
+		log.Printf("[Email] Failed to revoke tokens of user %d after an email revert: %v", user.Id, err)
+	}
+	if _, err := SignOutAllSessions(user, ""); err != nil {
+		log.Printf("[Email] Failed to sign out sessions of user %d after an email revert: %v", user.Id, err)
+	}
+	return user, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// TestEmailRevertLink tests that revert links round-trip and are not interchangeable with sign-in links
+func TestEmailRevertLink(t *testing.T) {
+	user := &models.User{Id: 42, Email: "new@example.com", PreviousEmail: "old@example.com"}
+
+	token, err := GenerateEmailRevertLink(user)
+	if err != nil {
+		t.Fatalf("Failed to sign revert link: %v", err)
+	}
+	claims, err := ParseEmailRevertLink(token)
+	if err != nil {
+		t.Fatalf("Failed to parse revert link: %v", err)
+	}
+	if claims.Subject != "42" || claims.PreviousEmail != "old@example.com" || claims.NewEmail != "new@example.com" {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	if _, err := ParseEmailRevertLink(token + "x"); err != ErrEmailRevertInvalid {
+		t.Errorf("Expected a tampered link to be rejected, got %v", err)
+	}
+
+	loginLink, _ := GenerateLoginLink("old@example.com", "", "link-id")
+	if _, err := ParseEmailRevertLink(loginLink); err != ErrEmailRevertInvalid {
+		t.Errorf("Expected a sign-in link to be rejected as a revert link, got %v", err)
+	}
+	if _, err := ParseLoginLink(token); err != ErrLoginLinkInvalid {
+		t.Errorf("Expected a revert link to be rejected as a sign-in link, got %v", err)
+	}
+}
+
+// TestEmailChangeCodeIsBoundToUser tests that a change code only confirms the address for the user who asked for it
+func TestEmailChangeCodeIsBoundToUser(t *testing.T) {
+	store := newMemoryVerificationCodeStore()
+	vc := newVerificationCode(emailChangeTarget(1, "New@Example.com"), PurposeChangeEmail, "")
+	store.Save(vc)
+
+	if err := store.Verify(emailChangeTarget(2, "new@example.com"), PurposeChangeEmail, vc.Code); err != ErrVerificationCodeNotFound {
+		t.Errorf("Expected the code to be bound to its user, got %v", err)
+	}
+	if err := store.Verify(emailChangeTarget(1, "new@example.com"), PurposeChangeEmail, vc.Code); err != nil {
+		t.Errorf("Expected the code to verify regardless of case: %v", err)
+	}
+}
+
+// TestEmailChangeRevertible tests the window in which an email change can be reverted
+func TestEmailChangeRevertible(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	user := &models.User{EmailChangedTime: now.Add(-24 * time.Hour).Format(time.RFC3339)}
+	if !emailChangeRevertible(user, now) {
+		t.Error("Expected a change made yesterday to be revertible")
+	}
+	user.EmailChangedTime = now.Add(-emailRevertLifetime - time.Minute).Format(time.RFC3339)
+	if emailChangeRevertible(user, now) {
+		t.Error("Expected a change older than the revert window to be final")
+	}
+	user.EmailChangedTime = ""
+	if emailChangeRevertible(user, now) {
+		t.Error("Expected a user without a change to have nothing to revert")
+	}
+}
+
+// TestUserClaimsEmailVerified tests that email_verified reflects the stored flag
+func TestUserClaimsEmailVerified(t *testing.T) {
+	unverified := UserClaims(&models.User{Id: 1, Email: "alice@example.com"})
+	if unverified["email_verified"] != false {
+		t.Errorf("Expected an unverified email, got %v", unverified["email_verified"])
+	}
+	verified := UserClaims(&models.User{Id: 1, Email: "alice@example.com", EmailVerified: true})
+	if verified["email_verified"] != true {
+		t.Errorf("Expected a verified email, got %v", verified["email_verified"])
+	}
+}
@@ -0,0 +1,566 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oauth-server/oauth-server/models"
+)
+
+const (
+	// JWS signing algorithms
+	SigningAlgHS256 = "HS256"
+	SigningAlgRS256 = "RS256"
+
+	// JWE key management algorithms (RFC 7518 §4)
+	JweAlgRsaOaep    = "RSA-OAEP"
+	JweAlgRsaOaep256 = "RSA-OAEP-256"
+
+	// JWE content encryption algorithms (RFC 7518 §5)
+	JweEncA128CbcHs256 = "A128CBC-HS256"
+	JweEncA256CbcHs512 = "A256CBC-HS512"
+	JweEncA128Gcm      = "A128GCM"
+	JweEncA256Gcm      = "A256GCM"
+
+	// DefaultJweEnc is used when only the alg is registered (OIDC Registration §2)
+	DefaultJweEnc = JweEncA128CbcHs256
+
+	// SigningKeyId matches the kid published by the JWKS endpoint
+	SigningKeyId = "default-key"
+
+	ClientJwksCacheExpiration = 10 * time.Minute // 客户端 JWKS 缓存 10 分钟
+)
+
+var (
+	SupportedSigningAlgs = []string{SigningAlgHS256, SigningAlgRS256}
+	SupportedJweAlgs     = []string{JweAlgRsaOaep, JweAlgRsaOaep256}
+	SupportedJweEncs     = []string{JweEncA128CbcHs256, JweEncA256CbcHs512, JweEncA128Gcm, JweEncA256Gcm}
+)
+
+// JsonWebKey is the subset of RFC 7517 members needed for RSA and EC public keys
+type JsonWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JsonWebKeySet is an RFC 7517 JWK Set
+type JsonWebKeySet struct {
+	Keys []JsonWebKey `json:"keys"`
+}
+
+type clientJwksCacheEntry struct {
+	keySet    *JsonWebKeySet
+	fetchedAt time.Time
+}
+
+var (
+	clientJwksCache   = make(map[string]*clientJwksCacheEntry)
+	clientJwksCacheMu sync.Mutex
+)
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateApplicationJoseSettings validates the signing and encryption metadata of a client
+func ValidateApplicationJoseSettings(application *models.Application) error {
+	if application.IdTokenSignedResponseAlg != "" && !containsString(SupportedSigningAlgs, application.IdTokenSignedResponseAlg) {
+		return fmt.Errorf("unsupported id_token_signed_response_alg: %s", application.IdTokenSignedResponseAlg)
+	}
+	if application.UserinfoSignedResponseAlg != "" && !containsString(SupportedSigningAlgs, application.UserinfoSignedResponseAlg) {
+		return fmt.Errorf("unsupported userinfo_signed_response_alg: %s", application.UserinfoSignedResponseAlg)
+	}
+
+	pairs := []struct {
+		name string
+		alg  string
+		enc  string
+	}{
+		{"id_token", application.IdTokenEncryptedResponseAlg, application.IdTokenEncryptedResponseEnc},
+		{"userinfo", application.UserinfoEncryptedResponseAlg, application.UserinfoEncryptedResponseEnc},
+	}
+	for _, pair := range pairs {
+		if pair.alg == "" {
+			if pair.enc != "" {
+				return fmt.Errorf("%s_encrypted_response_enc requires %s_encrypted_response_alg", pair.name, pair.name)
+			}
+			continue
+		}
+		if !containsString(SupportedJweAlgs, pair.alg) {
+			return fmt.Errorf("unsupported %s_encrypted_response_alg: %s", pair.name, pair.alg)
+		}
+		if pair.enc != "" && !containsString(SupportedJweEncs, pair.enc) {
+			return fmt.Errorf("unsupported %s_encrypted_response_enc: %s", pair.name, pair.enc)
+		}
+		if application.Jwks == "" && application.JwksUri == "" {
+			return fmt.Errorf("jwks or jwks_uri is required for %s encryption", pair.name)
+		}
+	}
+
+	if application.Jwks != "" && application.JwksUri != "" {
+		return fmt.Errorf("jwks and jwks_uri must not both be set")
+	}
+	if application.JwksUri != "" {
+		if err := validateJwksUri(application.JwksUri); err != nil {
+			return err
+		}
+	}
+	if application.Jwks != "" {
+		var keySet JsonWebKeySet
+		if err := json.Unmarshal([]byte(application.Jwks), &keySet); err != nil {
+			return fmt.Errorf("jwks is not a valid JWK Set: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// SignJwt signs the claims with the given algorithm
+// HS256 uses JWT_SECRET, RS256 uses the server RSA key published at the JWKS endpoint
+func SignJwt(claims jwt.Claims, alg string) (string, error) {
+	switch alg {
+	case "", SigningAlgHS256:
+		jwtSecret := os.Getenv("JWT_SECRET")
+		if jwtSecret == "" {
+			jwtSecret = "default-secret-key-change-in-production"
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret))
+	case SigningAlgRS256:
+		if privateKey == nil {
+			return "", fmt.Errorf("private key not initialized")
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = SigningKeyId
+		return token.SignedString(privateKey)
+	default:
+		return "", fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+}
+
+// EncodeClientResponse signs and/or encrypts an OIDC response for a client
+// With signAlg set the claims become a JWS; with encAlg set the result is wrapped in a JWE
+// (a nested JWT when both are set). Returns an empty string when neither is requested.
+func EncodeClientResponse(application *models.Application, claims jwt.Claims, signAlg, encAlg, encEnc string) (string, error) {
+	if signAlg == "" && encAlg == "" {
+		return "", nil
+	}
+
+	var payload []byte
+	contentType := ""
+	if signAlg != "" {
+		signed, err := SignJwt(claims, signAlg)
+		if err != nil {
+			return "", err
+		}
+		if encAlg == "" {
+			return signed, nil
+		}
+		payload = []byte(signed)
+		contentType = "JWT"
+	} else {
+		data, err := json.Marshal(claims)
+		if err != nil {
+			return "", err
+		}
+		payload = data
+	}
+
+	key, err := GetClientEncryptionKey(application, encAlg)
+	if err != nil {
+		return "", err
+	}
+
+	if encEnc == "" {
+		encEnc = DefaultJweEnc
+	}
+	return EncryptJwe(payload, encAlg, encEnc, key, contentType)
+}
+
+// GetClientEncryptionKey returns the RSA encryption key registered by the client (jwks or jwks_uri)
+func GetClientEncryptionKey(application *models.Application, alg string) (*JsonWebKey, error) {
+	var keySet *JsonWebKeySet
+	if application.Jwks != "" {
+		keySet = &JsonWebKeySet{}
+		if err := json.Unmarshal([]byte(application.Jwks), keySet); err != nil {
+			return nil, fmt.Errorf("invalid client jwks: %v", err)
+		}
+	} else if application.JwksUri != "" {
+		var err error
+		keySet, err = fetchClientJwks(application.JwksUri)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("client %s has no jwks or jwks_uri", application.ClientId)
+	}
+
+	for i := range keySet.Keys {
+		key := &keySet.Keys[i]
+		if key.Kty != "RSA" {
+			continue
+		}
+		if key.Use != "" && key.Use != "enc" {
+			continue
+		}
+		if key.Alg != "" && key.Alg != alg {
+			continue
+		}
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("no RSA encryption key found in client jwks")
+}
+
+// clientJwksHttpClient fetches client supplied jwks_uri documents. Anonymous registrants can set jwks_uri,
+// so the address is checked when connecting, after DNS resolution, which also covers rebinding and redirects.
+var clientJwksHttpClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: dialPublicAddressOnly}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return fmt.Errorf("too many redirects")
+		}
+		return validateJwksUri(req.URL.String())
+	},
+}
+
+// nonPublicNetworks lists the ranges not covered by the net.IP helpers used in isPublicAddress
+var nonPublicNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("198.18.0.0/15"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// isPublicAddress reports whether ip is a globally routable unicast address,
+// rejecting loopback, private, link-local (including cloud metadata endpoints) and similar ranges
+func isPublicAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublicAddressOnly refuses connections to non-public addresses
+func dialPublicAddressOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicAddress(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// validateJwksUri checks that jwks_uri is an https URL that does not name a local or private host.
+// Host names are resolved at connect time by clientJwksHttpClient, not here.
+func validateJwksUri(jwksUri string) error {
+	parsed, err := url.Parse(jwksUri)
+	if err != nil || parsed.Scheme != "https" || parsed.Hostname() == "" {
+		return fmt.Errorf("jwks_uri must be an https URL")
+	}
+	host := strings.ToLower(strings.TrimSuffix(parsed.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("jwks_uri must not point to a local or private address")
+	}
+	if ip := net.ParseIP(host); ip != nil && !isPublicAddress(ip) {
+		return fmt.Errorf("jwks_uri must not point to a local or private address")
+	}
+	return nil
+}
+
+// fetchClientJwks downloads a client JWK Set, caching it for ClientJwksCacheExpiration
+func fetchClientJwks(jwksUri string) (*JsonWebKeySet, error) {
+	clientJwksCacheMu.Lock()
+	entry, ok := clientJwksCache[jwksUri]
+	clientJwksCacheMu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < ClientJwksCacheExpiration {
+		return entry.keySet, nil
+	}
+
+	if err := validateJwksUri(jwksUri); err != nil {
+		return nil, err
+	}
+
+	resp, err := clientJwksHttpClient.Get(jwksUri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch client jwks: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch client jwks: HTTP %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client jwks: %v", err)
+	}
+
+	var keySet JsonWebKeySet
+	if err := json.Unmarshal(body, &keySet); err != nil {
+		return nil, fmt.Errorf("invalid client jwks: %v", err)
+	}
+
+	clientJwksCacheMu.Lock()
+	clientJwksCache[jwksUri] = &clientJwksCacheEntry{keySet: &keySet, fetchedAt: time.Now()}
+	clientJwksCacheMu.Unlock()
+
+	return &keySet, nil
+}
+
+// RSAPublicKey converts the JWK to an *rsa.PublicKey
+func (k *JsonWebKey) RSAPublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+
+	nBytes, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %v", err)
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %v", err)
+	}
+
+	e := 0
+	for _, b := range eBytes {
+		e = e<<8 | int(b)
+	}
+	if e == 0 {
+		return nil, fmt.Errorf("invalid exponent")
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: e}, nil
+}
+
+// ECPublicKey converts the JWK to an *ecdsa.PublicKey
+func (k *JsonWebKey) ECPublicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" {
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+	}
+
+	xBytes, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x coordinate: %v", err)
+	}
+	yBytes, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid y coordinate: %v", err)
+	}
+
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+	}
+	return key, nil
+}
+
+// EncryptJwe produces a JWE compact serialization (RFC 7516) of payload for the given key
+func EncryptJwe(payload []byte, alg, enc string, key *JsonWebKey, contentType string) (string, error) {
+	publicKey, err := key.RSAPublicKey()
+	if err != nil {
+		return "", err
+	}
+
+	cekSize, err := jweContentKeySize(enc)
+	if err != nil {
+		return "", err
+	}
+	cek := make([]byte, cekSize)
+	if _, err := rand.Read(cek); err != nil {
+		return "", err
+	}
+
+	var oaepHash hash.Hash
+	switch alg {
+	case JweAlgRsaOaep:
+		oaepHash = sha1.New()
+	case JweAlgRsaOaep256:
+		oaepHash = sha256.New()
+	default:
+		return "", fmt.Errorf("unsupported JWE alg: %s", alg)
+	}
+	encryptedKey, err := rsa.EncryptOAEP(oaepHash, rand.Reader, publicKey, cek, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt content key: %v", err)
+	}
+
+	header := map[string]string{"alg": alg, "enc": enc}
+	if key.Kid != "" {
+		header["kid"] = key.Kid
+	}
+	if contentType != "" {
+		header["cty"] = contentType
+	}
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(headerJson)
+
+	iv, ciphertext, tag, err := jweEncryptContent(enc, cek, payload, []byte(protected))
+	if err != nil {
+		return "", err
+	}
+
+	return protected + "." +
+		base64.RawURLEncoding.EncodeToString(encryptedKey) + "." +
+		base64.RawURLEncoding.EncodeToString(iv) + "." +
+		base64.RawURLEncoding.EncodeToString(ciphertext) + "." +
+		base64.RawURLEncoding.EncodeToString(tag), nil
+}
+
+// jweContentKeySize returns the CEK length in bytes for a content encryption algorithm
+func jweContentKeySize(enc string) (int, error) {
+	switch enc {
+	case JweEncA128Gcm:
+		return 16, nil
+	case JweEncA256Gcm, JweEncA128CbcHs256:
+		return 32, nil
+	case JweEncA256CbcHs512:
+		return 64, nil
+	default:
+		return 0, fmt.Errorf("unsupported JWE enc: %s", enc)
+	}
+}
+
+// jweEncryptContent encrypts plaintext with the CEK, authenticating aad
+func jweEncryptContent(enc string, cek, plaintext, aad []byte) ([]byte, []byte, []byte, error) {
+	switch enc {
+	case JweEncA128Gcm, JweEncA256Gcm:
+		block, err := aes.NewCipher(cek)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		iv := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(iv); err != nil {
+			return nil, nil, nil, err
+		}
+		sealed := gcm.Seal(nil, iv, plaintext, aad)
+		tagStart := len(sealed) - gcm.Overhead()
+		return iv, sealed[:tagStart], sealed[tagStart:], nil
+
+	case JweEncA128CbcHs256, JweEncA256CbcHs512:
+		// RFC 7518 §5.2: MAC_KEY || ENC_KEY, tag is the truncated HMAC
+		half := len(cek) / 2
+		macKey, encKey := cek[:half], cek[half:]
+
+		block, err := aes.NewCipher(encKey)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		iv := make([]byte, aes.BlockSize)
+		if _, err := rand.Read(iv); err != nil {
+			return nil, nil, nil, err
+		}
+
+		padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+		padded := make([]byte, len(plaintext)+padding)
+		copy(padded, plaintext)
+		for i := len(plaintext); i < len(padded); i++ {
+			padded[i] = byte(padding)
+		}
+		ciphertext := make([]byte, len(padded))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+		tag := jweCbcHmacTag(enc, macKey, aad, iv, ciphertext)
+		return iv, ciphertext, tag, nil
+
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported JWE enc: %s", enc)
+	}
+}
+
+// jweCbcHmacTag computes the AES_CBC_HMAC_SHA2 authentication tag (RFC 7518 §5.2.2.1)
+func jweCbcHmacTag(enc string, macKey, aad, iv, ciphertext []byte) []byte {
+	var mac hash.Hash
+	if enc == JweEncA256CbcHs512 {
+		mac = hmac.New(sha512.New, macKey)
+	} else {
+		mac = hmac.New(sha256.New, macKey)
+	}
+
+	al := make([]byte, 8)
+	binary.BigEndian.PutUint64(al, uint64(len(aad))*8)
+
+	mac.Write(aad)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	mac.Write(al)
+	return mac.Sum(nil)[:len(macKey)]
+}
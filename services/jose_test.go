@@ -0,0 +1,279 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// testJwkFromKey builds a public JWK for an RSA key
+func testJwkFromKey(key *rsa.PrivateKey, kid string) JsonWebKey {
+	return JsonWebKey{
+		Kty: "RSA",
+		Use: "enc",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// testDecryptJwe is a reference decrypter used to check EncryptJwe output
+func testDecryptJwe(t *testing.T, compact string, key *rsa.PrivateKey) (map[string]string, []byte) {
+	t.Helper()
+
+	parts := strings.Split(compact, ".")
+	if len(parts) != 5 {
+		t.Fatalf("Expected 5 JWE parts, got %d", len(parts))
+	}
+
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("Invalid base64url segment: %v", err)
+		}
+		return b
+	}
+
+	var header map[string]string
+	if err := json.Unmarshal(decode(parts[0]), &header); err != nil {
+		t.Fatalf("Invalid JWE header: %v", err)
+	}
+
+	var oaepHash hash.Hash = sha256.New()
+	if header["alg"] == JweAlgRsaOaep {
+		oaepHash = sha1.New()
+	}
+	cek, err := rsa.DecryptOAEP(oaepHash, rand.Reader, key, decode(parts[1]), nil)
+	if err != nil {
+		t.Fatalf("Failed to decrypt CEK: %v", err)
+	}
+
+	iv, ciphertext, tag := decode(parts[2]), decode(parts[3]), decode(parts[4])
+	aad := []byte(parts[0])
+
+	switch header["enc"] {
+	case JweEncA128Gcm, JweEncA256Gcm:
+		block, _ := aes.NewCipher(cek)
+		gcm, _ := cipher.NewGCM(block)
+		plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), aad)
+		if err != nil {
+			t.Fatalf("GCM authentication failed: %v", err)
+		}
+		return header, plaintext
+	default:
+		half := len(cek) / 2
+		expected := jweCbcHmacTag(header["enc"], cek[:half], aad, iv, ciphertext)
+		if subtle.ConstantTimeCompare(expected, tag) != 1 {
+			t.Fatalf("CBC-HMAC authentication failed")
+		}
+		block, _ := aes.NewCipher(cek[half:])
+		plaintext := make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+		padding := int(plaintext[len(plaintext)-1])
+		return header, plaintext[:len(plaintext)-padding]
+	}
+}
+
+// TestEncryptJweRoundTrip tests every supported alg/enc combination
+func TestEncryptJweRoundTrip(t *testing.T) {
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	jwk := testJwkFromKey(clientKey, "client-key")
+	payload := []byte(`{"sub":"1","email":"test@example.com"}`)
+
+	for _, alg := range SupportedJweAlgs {
+		for _, enc := range SupportedJweEncs {
+			t.Run(alg+"/"+enc, func(t *testing.T) {
+				compact, err := EncryptJwe(payload, alg, enc, &jwk, "JWT")
+				if err != nil {
+					t.Fatalf("EncryptJwe failed: %v", err)
+				}
+
+				header, plaintext := testDecryptJwe(t, compact, clientKey)
+				if header["alg"] != alg || header["enc"] != enc {
+					t.Errorf("Unexpected header: %v", header)
+				}
+				if header["kid"] != "client-key" || header["cty"] != "JWT" {
+					t.Errorf("Expected kid and cty in header, got %v", header)
+				}
+				if string(plaintext) != string(payload) {
+					t.Errorf("Decrypted payload mismatch. Expected: %s, Got: %s", payload, plaintext)
+				}
+			})
+		}
+	}
+}
+
+// TestEncodeClientResponseNestedJwt tests that a signed and encrypted response is a nested JWT
+func TestEncodeClientResponseNestedJwt(t *testing.T) {
+	if err := InitRSAKeys(); err != nil {
+		t.Fatalf("Failed to initialize RSA keys: %v", err)
+	}
+
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	jwksJson, _ := json.Marshal(JsonWebKeySet{Keys: []JsonWebKey{testJwkFromKey(clientKey, "k1")}})
+
+	application := &models.Application{
+		ClientId:                    "client",
+		Jwks:                        string(jwksJson),
+		IdTokenEncryptedResponseAlg: JweAlgRsaOaep256,
+	}
+
+	encoded, err := EncodeClientResponse(application, jwt.MapClaims{"sub": "42"}, SigningAlgRS256, JweAlgRsaOaep256, "")
+	if err != nil {
+		t.Fatalf("EncodeClientResponse failed: %v", err)
+	}
+
+	header, plaintext := testDecryptJwe(t, encoded, clientKey)
+	if header["enc"] != DefaultJweEnc {
+		t.Errorf("Expected default enc %s, got %s", DefaultJweEnc, header["enc"])
+	}
+
+	parsed, err := jwt.Parse(string(plaintext), func(token *jwt.Token) (interface{}, error) {
+		return publicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256"}))
+	if err != nil {
+		t.Fatalf("Inner JWS did not verify: %v", err)
+	}
+	if parsed.Header["kid"] != SigningKeyId {
+		t.Errorf("Expected kid %s, got %v", SigningKeyId, parsed.Header["kid"])
+	}
+	if sub, _ := parsed.Claims.GetSubject(); sub != "42" {
+		t.Errorf("Expected sub 42, got %s", sub)
+	}
+}
+
+// TestValidateApplicationJoseSettings tests client metadata validation
+func TestValidateApplicationJoseSettings(t *testing.T) {
+	tests := []struct {
+		name        string
+		application models.Application
+		expectError bool
+	}{
+		{
+			name:        "No settings",
+			application: models.Application{},
+			expectError: false,
+		},
+		{
+			name:        "Unsupported signing alg",
+			application: models.Application{UserinfoSignedResponseAlg: "ES256"},
+			expectError: true,
+		},
+		{
+			name:        "Encryption without keys",
+			application: models.Application{IdTokenEncryptedResponseAlg: JweAlgRsaOaep},
+			expectError: true,
+		},
+		{
+			name:        "Enc without alg",
+			application: models.Application{UserinfoEncryptedResponseEnc: JweEncA128Gcm, JwksUri: "https://client.example.com/jwks"},
+			expectError: true,
+		},
+		{
+			name: "Valid encryption settings",
+			application: models.Application{
+				IdTokenEncryptedResponseAlg: JweAlgRsaOaep,
+				IdTokenEncryptedResponseEnc: JweEncA256Gcm,
+				JwksUri:                     "https://client.example.com/jwks",
+			},
+			expectError: false,
+		},
+		{
+			name:        "Both jwks and jwks_uri",
+			application: models.Application{Jwks: `{"keys":[]}`, JwksUri: "https://client.example.com/jwks"},
+			expectError: true,
+		},
+		{
+			name:        "Plain http jwks_uri",
+			application: models.Application{JwksUri: "http://client.example.com/jwks"},
+			expectError: true,
+		},
+		{
+			name:        "Loopback jwks_uri",
+			application: models.Application{JwksUri: "https://127.0.0.1/jwks"},
+			expectError: true,
+		},
+		{
+			name:        "Localhost jwks_uri",
+			application: models.Application{JwksUri: "https://localhost:8443/jwks"},
+			expectError: true,
+		},
+		{
+			name:        "Private network jwks_uri",
+			application: models.Application{JwksUri: "https://10.0.0.5/jwks"},
+			expectError: true,
+		},
+		{
+			name:        "Metadata endpoint jwks_uri",
+			application: models.Application{JwksUri: "https://169.254.169.254/latest/meta-data"},
+			expectError: true,
+		},
+		{
+			name:        "IPv6 loopback jwks_uri",
+			application: models.Application{JwksUri: "https://[::1]/jwks"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateApplicationJoseSettings(&tt.application)
+			if tt.expectError && err == nil {
+				t.Errorf("Expected error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+// TestFetchClientJwksRefusesLocalAddress tests that jwks_uri is never fetched from a local address
+func TestFetchClientJwksRefusesLocalAddress(t *testing.T) {
+	requested := false
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+		w.Write([]byte(`{"keys":[]}`))
+	}))
+	defer server.Close()
+
+	if _, err := fetchClientJwks(server.URL + "/jwks"); err == nil {
+		t.Error("Expected fetching a loopback jwks_uri to fail")
+	}
+
+	// A host name that resolves to a local address is refused when connecting
+	if err := dialPublicAddressOnly("tcp", server.Listener.Addr().String(), nil); err == nil {
+		t.Error("Expected dialing a loopback address to fail")
+	}
+	if err := dialPublicAddressOnly("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("Expected dialing a public address to succeed, got %v", err)
+	}
+
+	if requested {
+		t.Error("Expected the local server not to be contacted")
+	}
+}
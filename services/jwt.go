@@ -4,8 +4,10 @@
 package services
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
 	"time"
 
@@ -30,6 +32,8 @@ type Claims struct {
 	Aud         []string `json:"aud"`
 	Nonce       string   `json:"nonce,omitempty"`
 	TokenUse    string   `json:"token_use"` // "access", "refresh", or "id"
+	Amr         []string `json:"amr,omitempty"`
+	SessionId   string   `json:"sid,omitempty"` // Console session of the token, only set on console tokens
 
 	// OIDC Standard Claims
 	Name              string `json:"name,omitempty"`
@@ -43,17 +47,37 @@ type Claims struct {
 	jwt.RegisteredClaims
 }
 
+// IDTokenClaims are the claims of an OIDC ID token. They describe the sign-in to a relying party and
+// leave out the console claims of Claims, such as owner and isAdmin, and ParseJwtToken rejects them,
+// so an ID token handed to a relying party can never be used as an access token.
+type IDTokenClaims struct {
+	Iss        string   `json:"iss"`
+	Sub        string   `json:"sub"`
+	Aud        []string `json:"aud"`
+	Nonce      string   `json:"nonce,omitempty"`
+	TokenUse   string   `json:"token_use"` // Always "id"
+	Amr        []string `json:"amr,omitempty"`
+	Username   string   `json:"username"`
+	Email      string   `json:"email"`
+	QQ         string   `json:"qq"`
+	IsRealName bool     `json:"isRealName"`
+
+	// OIDC Standard Claims
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Picture           string `json:"picture,omitempty"`
+	EmailVerified     bool   `json:"email_verified,omitempty"`
+	UpdatedAt         int64  `json:"updated_at,omitempty"`
+
+	jwt.RegisteredClaims
+}
+
 // GenerateIDToken generates an OIDC ID Token
-func GenerateIDToken(application *models.Application, user *models.User, nonce string, accessToken string) (string, error) {
+// Claims requested for the id_token target of the claims parameter are added to the default set
+func GenerateIDToken(application *models.Application, user *models.User, nonce string, amr []string, accessToken string, claimsRequest *ClaimsRequest) (string, error) {
 	nowTime := time.Now()
 	expireTime := nowTime.Add(time.Duration(application.ExpireInHours) * time.Hour)
 
-	// Get JWT secret from config
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "default-secret-key-change-in-production"
-	}
-
 	// Get origin from config
 	origin := os.Getenv("ORIGIN")
 	if origin == "" {
@@ -65,26 +89,22 @@ func GenerateIDToken(application *models.Application, user *models.User, nonce s
 	notBefore := nowTime.Add(-10 * time.Second)
 
 	// Create ID Token claims
-	claims := Claims{
-		Owner:             user.Owner,
-		CreatedTime:       user.CreatedTime,
-		Id:                fmt.Sprintf("%d", user.Id),
-		Type:              user.Type,
+	claims := IDTokenClaims{
 		Username:          user.Username,
 		Email:             user.Email,
 		QQ:                user.QQ,
 		IsRealName:        user.IsRealName,
-		IsAdmin:           user.IsAdmin,
 		Iss:               origin,
 		Sub:               user.GetId(),
 		Aud:               []string{application.ClientId},
 		Nonce:             nonce,
 		TokenUse:          "id",
+		Amr:               amr,
 		Name:              user.Username,
 		PreferredUsername: user.Username,
 		Picture:           user.Avatar,
-		EmailVerified:     true, // 假设邮箱已验证
-		UpdatedAt:         time.Now().Unix(),
+		EmailVerified:     user.EmailVerified,
+		UpdatedAt:         userUpdatedAt(user),
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expireTime),
 			IssuedAt:  jwt.NewNumericDate(nowTime),
@@ -93,9 +113,21 @@ func GenerateIDToken(application *models.Application, user *models.User, nonce s
 		},
 	}
 
-	// Generate ID token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	idToken, err := token.SignedString([]byte(jwtSecret))
+	// ID tokens are always signed; encrypt them as a nested JWT if the client registered a JWE alg
+	signAlg := application.IdTokenSignedResponseAlg
+	if signAlg == "" {
+		signAlg = SigningAlgHS256
+	}
+	var idTokenClaims jwt.Claims = claims
+	if claimsRequest != nil && len(claimsRequest.IdToken) > 0 {
+		mapClaims, err := toMapClaims(claims)
+		if err != nil {
+			return "", err
+		}
+		ApplyRequestedClaims(mapClaims, user, claimsRequest.IdToken)
+		idTokenClaims = mapClaims
+	}
+	idToken, err := EncodeClientResponse(application, idTokenClaims, signAlg, application.IdTokenEncryptedResponseAlg, application.IdTokenEncryptedResponseEnc)
 	if err != nil {
 		return "", err
 	}
@@ -103,11 +135,36 @@ func GenerateIDToken(application *models.Application, user *models.User, nonce s
 	return idToken, nil
 }
 
+// toMapClaims converts struct claims to a map so individual claims can be added or removed
+func toMapClaims(claims interface{}) (jwt.MapClaims, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	mapClaims := jwt.MapClaims{}
+	if err := json.Unmarshal(data, &mapClaims); err != nil {
+		return nil, err
+	}
+	return mapClaims, nil
+}
+
 // GenerateJwtToken generates access and refresh tokens
-func GenerateJwtToken(application *models.Application, user *models.User, scope, nonce, resource string) (string, string, string, error) {
+// The refresh token is empty when the application's refresh token policy does not allow one for the scope
+// amr lists the authentication methods of the sign-in and is carried by both tokens
+func GenerateJwtToken(application *models.Application, user *models.User, scope, nonce, resource string, amr []string) (string, string, string, error) {
+	return generateJwtToken(application, user, scope, nonce, resource, amr, "")
+}
+
+// GenerateSessionJwtToken generates the console tokens of a session, which carry its name as the sid
+// claim so that they stop working once the session is signed out
+func GenerateSessionJwtToken(application *models.Application, user *models.User, scope string, amr []string, sessionId string) (string, string, string, error) {
+	return generateJwtToken(application, user, scope, "", "", amr, sessionId)
+}
+
+func generateJwtToken(application *models.Application, user *models.User, scope, nonce, resource string, amr []string, sessionId string) (string, string, string, error) {
 	nowTime := time.Now()
 	expireTime := nowTime.Add(time.Duration(application.ExpireInHours) * time.Hour)
-	refreshExpireTime := nowTime.Add(time.Duration(application.RefreshExpireInHours) * time.Hour)
+	refreshExpireTime := nowTime.Add(refreshIdleDuration(application))
 
 	// Get JWT secret from config
 	jwtSecret := os.Getenv("JWT_SECRET")
@@ -145,10 +202,12 @@ func GenerateJwtToken(application *models.Application, user *models.User, scope,
 		Aud:               []string{application.ClientId},
 		Nonce:             nonce,
 		TokenUse:          "access",
+		Amr:               amr,
+		SessionId:         sessionId,
 		Name:              user.Username,
 		PreferredUsername: user.Username,
 		Picture:           user.Avatar,
-		EmailVerified:     true,
+		EmailVerified:     user.EmailVerified,
 		UpdatedAt:         time.Now().Unix(),
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expireTime),
@@ -165,6 +224,13 @@ func GenerateJwtToken(application *models.Application, user *models.User, scope,
 		return "", "", "", err
 	}
 
+	// Generate token name with nanosecond precision
+	tokenName := fmt.Sprintf("token_%d_%d", user.Id, nowTime.UnixNano())
+
+	if !ShouldIssueRefreshToken(application, scope) {
+		return accessToken, "", tokenName, nil
+	}
+
 	// Small delay to ensure different timestamp for refresh token
 	time.Sleep(1 * time.Millisecond)
 	refreshNowTime := time.Now()
@@ -194,6 +260,8 @@ func GenerateJwtToken(application *models.Application, user *models.User, scope,
 		Aud:         []string{application.ClientId},
 		Nonce:       nonce,
 		TokenUse:    "refresh",
+		Amr:         amr,
+		SessionId:   sessionId,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(refreshExpireTime),
 			IssuedAt:  jwt.NewNumericDate(refreshNowTime),
@@ -207,44 +275,90 @@ func GenerateJwtToken(application *models.Application, user *models.User, scope,
 		return "", "", "", err
 	}
 
-	// Generate token name with nanosecond precision
-	tokenName := fmt.Sprintf("token_%d_%d", user.Id, nowTime.UnixNano())
-
 	return accessToken, refreshTokenString, tokenName, nil
 }
 
-// ParseJwtToken parses and validates a JWT token
+// jwtId returns the jti claim of a token issued by this server without verifying it
+func jwtId(tokenString string) string {
+	claims := &Claims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, claims); err != nil {
+		return ""
+	}
+	return claims.ID
+}
+
+// ParseJwtToken parses and validates an access token. Refresh and ID tokens are signed with the
+// same secret and are rejected, so they cannot be used as bearer tokens.
 func ParseJwtToken(tokenString string) (*Claims, error) {
+	return parseJwtToken(tokenString, "access")
+}
+
+// ParseGrantJwtToken parses and validates an access or refresh token, for introspection and revocation
+func ParseGrantJwtToken(tokenString string) (*Claims, error) {
+	return parseJwtToken(tokenString, "access", "refresh")
+}
+
+func parseJwtToken(tokenString string, tokenUses ...string) (*Claims, error) {
+	claims := &Claims{}
+	if err := parseHmacJwt(tokenString, claims); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(tokenUses, claims.TokenUse) {
+		return nil, fmt.Errorf("unexpected token use: %q", claims.TokenUse)
+	}
+	return claims, nil
+}
+
+// ParseIDToken parses and validates an HS256 ID token issued by GenerateIDToken
+func ParseIDToken(tokenString string) (*IDTokenClaims, error) {
+	claims := &IDTokenClaims{}
+	if err := parseHmacJwt(tokenString, claims); err != nil {
+		return nil, err
+	}
+	if claims.TokenUse != "id" {
+		return nil, fmt.Errorf("unexpected token use: %q", claims.TokenUse)
+	}
+	return claims, nil
+}
+
+// parseHmacJwt verifies a token signed with JWT_SECRET and decodes its claims
+func parseHmacJwt(tokenString string, claims jwt.Claims) error {
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
 		jwtSecret = "default-secret-key-change-in-production"
 	}
 
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 		return []byte(jwtSecret), nil
 	})
-
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims, nil
+	if !token.Valid {
+		return fmt.Errorf("invalid token")
 	}
-
-	return nil, fmt.Errorf("invalid token")
+	return nil
 }
 
-// ValidateToken validates a token and returns user info
+// ValidateToken validates a token and returns user info. Besides the signature and expiry the
+// token must still be stored and not revoked, so revocation and sign-out take effect at once.
 func ValidateToken(tokenString string) (*models.User, error) {
 	claims, err := ParseJwtToken(tokenString)
 	if err != nil {
 		return nil, err
 	}
 
+	token, err := models.GetTokenByAccessToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil || token.IsRevoked() {
+		return nil, fmt.Errorf("token has been revoked")
+	}
+
 	// Get user by ID from claims
 	userId, err := strconv.ParseInt(claims.Id, 10, 64)
 	if err != nil {
@@ -0,0 +1,619 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/oauth-server/oauth-server/models"
+)
+
+const (
+	ldapTimeout = 10 * time.Second
+	// ldapSyncPageSize is the page size of directory listings, below the usual server size limits
+	ldapSyncPageSize = 500
+	// ldapSyncCheckInterval is how often providers are checked for a due scheduled sync
+	ldapSyncCheckInterval = time.Minute
+	// ldapTestSampleSize bounds the users listed by a connection test
+	ldapTestSampleSize = 5
+
+	defaultLdapUserFilter     = "(mail=%s)"
+	defaultLdapGroupAttribute = "memberOf"
+
+	// ldapDisabledProperty marks users disabled by a directory sync, so that a later
+	// sync re-enables them but never users an administrator banned
+	ldapDisabledProperty = "ldapDisabledBy"
+)
+
+// defaultLdapUserMapping maps local attributes to common LDAP attributes; "dn" maps to the entry DN
+var defaultLdapUserMapping = map[string]string{
+	"id":          "entryUUID",
+	"username":    "uid",
+	"displayName": "cn",
+	"email":       "mail",
+}
+
+var (
+	ErrLdapInvalidCredentials = fmt.Errorf("invalid directory credentials")
+	ErrLdapUserNotFound       = fmt.Errorf("the user is not in the directory")
+	ErrLdapUserAmbiguous      = fmt.Errorf("the user filter matches several directory entries")
+	ErrLdapUserNotAllowed     = fmt.Errorf("the user is not in a group allowed to sign in")
+	ErrLdapEmptyDirectory     = fmt.Errorf("the directory returned no users, sync skipped to avoid disabling everyone")
+)
+
+// LdapUser is a directory entry mapped to local attributes and roles
+type LdapUser struct {
+	ProviderUser
+	Dn      string
+	Groups  []string
+	IsAdmin bool
+	Allowed bool // The user may sign in: there is no group restriction or the user is in a mapped group
+}
+
+// LdapTestResult reports a successful connection test
+type LdapTestResult struct {
+	Users []string `json:"users"` // Usernames of the first users found
+}
+
+// LdapSyncResult counts the changes of a directory sync
+type LdapSyncResult struct {
+	Created  int `json:"created"`
+	Updated  int `json:"updated"`
+	Disabled int `json:"disabled"`
+}
+
+// ldapUserMapping returns the attribute mapping with defaults for every attribute not configured
+func ldapUserMapping(provider *models.Provider) map[string]string {
+	mapping := make(map[string]string, len(defaultLdapUserMapping)+len(provider.UserMapping))
+	for attribute, field := range defaultLdapUserMapping {
+		mapping[attribute] = field
+	}
+	for attribute, field := range provider.UserMapping {
+		if field != "" {
+			mapping[attribute] = field
+		}
+	}
+	return mapping
+}
+
+func ldapGroupAttribute(provider *models.Provider) string {
+	if provider.LdapGroupAttribute != "" {
+		return provider.LdapGroupAttribute
+	}
+	return defaultLdapGroupAttribute
+}
+
+// ldapAttributes lists the attributes read from user entries
+func ldapAttributes(provider *models.Provider) []string {
+	attributes := []string{ldapGroupAttribute(provider)}
+	for _, field := range ldapUserMapping(provider) {
+		if field != "dn" {
+			attributes = append(attributes, field)
+		}
+	}
+	return attributes
+}
+
+// ldapUserFilter returns the filter for a login; the login is escaped so it cannot change the filter
+func ldapUserFilter(provider *models.Provider, login string) string {
+	filter := provider.LdapUserFilter
+	if filter == "" {
+		filter = defaultLdapUserFilter
+	}
+	return strings.ReplaceAll(filter, "%s", ldap.EscapeFilter(login))
+}
+
+// hasLdapRole reports whether any group of the provider maps to the role
+func hasLdapRole(provider *models.Provider, role string) bool {
+	for _, groupRole := range provider.LdapGroupRoles {
+		if groupRole == role {
+			return true
+		}
+	}
+	return false
+}
+
+// mapLdapEntry maps a user entry. Directory emails are managed by the directory administrators
+// and are therefore treated as verified.
+func mapLdapEntry(provider *models.Provider, entry *ldap.Entry) *LdapUser {
+	mapping := ldapUserMapping(provider)
+	value := func(attribute string) string {
+		field := mapping[attribute]
+		if field == "dn" {
+			return entry.DN
+		}
+		if field == "" {
+			return ""
+		}
+		return entry.GetEqualFoldAttributeValue(field)
+	}
+
+	user := &LdapUser{
+		ProviderUser: ProviderUser{
+			Id:          value("id"),
+			Username:    value("username"),
+			DisplayName: value("displayName"),
+			Email:       value("email"),
+			Avatar:      value("avatar"),
+		},
+		Dn:     entry.DN,
+		Groups: entry.GetEqualFoldAttributeValues(ldapGroupAttribute(provider)),
+	}
+	// Entries without the ID attribute are identified by their DN
+	if user.Id == "" {
+		user.Id = entry.DN
+	}
+	user.EmailVerified = user.Email != ""
+
+	// Without groups mapped to the user role everyone in the directory may sign in
+	user.Allowed = !hasLdapRole(provider, models.LdapRoleUser) && !hasLdapRole(provider, models.LdapRoleAdmin)
+	for _, group := range user.Groups {
+		for groupDn, role := range provider.LdapGroupRoles {
+			if !strings.EqualFold(normalizeLdapDn(group), normalizeLdapDn(groupDn)) {
+				continue
+			}
+			user.Allowed = true
+			if role == models.LdapRoleAdmin {
+				user.IsAdmin = true
+			}
+		}
+	}
+	return user
+}
+
+// normalizeLdapDn drops spaces around the separators so that equal DNs compare equal
+func normalizeLdapDn(dn string) string {
+	if parsed, err := ldap.ParseDN(dn); err == nil {
+		return parsed.String()
+	}
+	return strings.TrimSpace(dn)
+}
+
+// dialLdap connects to the directory server, upgrading ldap:// connections with StartTLS when configured
+func dialLdap(provider *models.Provider) (*ldap.Conn, error) {
+	serverUrl, err := url.Parse(provider.HostUrl)
+	if err != nil || (serverUrl.Scheme != "ldap" && serverUrl.Scheme != "ldaps") || serverUrl.Host == "" {
+		return nil, ErrProviderNotConfigured
+	}
+
+	tlsConfig := &tls.Config{ServerName: serverUrl.Hostname(), MinVersion: tls.VersionTLS12}
+	conn, err := ldap.DialURL(provider.HostUrl,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", provider.HostUrl, err)
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if provider.LdapStartTls && serverUrl.Scheme == "ldap" {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to start TLS: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+// bindLdapServiceAccount binds with the service account, or stays anonymous without one
+func bindLdapServiceAccount(conn *ldap.Conn, provider *models.Provider) error {
+	if provider.ClientId == "" {
+		return nil
+	}
+
+	password := ""
+	if provider.ClientSecret != "" {
+		var err error
+		if password, err = DecryptData(provider.ClientSecret); err != nil {
+			return err
+		}
+	}
+	if err := conn.Bind(provider.ClientId, password); err != nil {
+		return fmt.Errorf("service account bind failed: %v", err)
+	}
+	return nil
+}
+
+// AuthenticateLdapUser checks a password against the directory. With a bind DN template the user
+// binds directly; otherwise the service account searches the user, who then binds with the password.
+func AuthenticateLdapUser(provider *models.Provider, login, password string) (*LdapUser, error) {
+	// An empty password would be an unauthenticated bind, which servers accept without checking anything
+	if login == "" || password == "" {
+		return nil, ErrLdapInvalidCredentials
+	}
+
+	conn, err := dialLdap(provider)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var entry *ldap.Entry
+	if provider.LdapBindDnTemplate != "" {
+		dn := strings.ReplaceAll(provider.LdapBindDnTemplate, "%s", ldap.EscapeDN(login))
+		if err := bindLdapUser(conn, dn, password); err != nil {
+			return nil, err
+		}
+		// The entry is read with the user's own rights
+		result, err := conn.Search(ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+			1, int(ldapTimeout.Seconds()), false, "(objectClass=*)", ldapAttributes(provider), nil))
+		if err != nil || len(result.Entries) == 0 {
+			return nil, fmt.Errorf("failed to read entry %s: %v", dn, err)
+		}
+		entry = result.Entries[0]
+	} else {
+		if err := bindLdapServiceAccount(conn, provider); err != nil {
+			return nil, err
+		}
+		result, err := conn.Search(ldap.NewSearchRequest(provider.LdapBaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+			2, int(ldapTimeout.Seconds()), false, ldapUserFilter(provider, login), ldapAttributes(provider), nil))
+		if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, fmt.Errorf("user search failed: %v", err)
+		}
+		switch {
+		case result == nil || len(result.Entries) == 0:
+			return nil, ErrLdapUserNotFound
+		case len(result.Entries) > 1:
+			return nil, ErrLdapUserAmbiguous
+		}
+		entry = result.Entries[0]
+		if err := bindLdapUser(conn, entry.DN, password); err != nil {
+			return nil, err
+		}
+	}
+
+	return mapLdapEntry(provider, entry), nil
+}
+
+// bindLdapUser binds as a user, telling wrong passwords apart from server errors
+func bindLdapUser(conn *ldap.Conn, dn, password string) error {
+	err := conn.Bind(dn, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) || ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return ErrLdapInvalidCredentials
+	}
+	return err
+}
+
+// SearchLdapUsers lists every user entry matched by the user filter with any login
+func SearchLdapUsers(provider *models.Provider) ([]*LdapUser, error) {
+	conn, err := dialLdap(provider)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := bindLdapServiceAccount(conn, provider); err != nil {
+		return nil, err
+	}
+
+	filter := provider.LdapUserFilter
+	if filter == "" {
+		filter = defaultLdapUserFilter
+	}
+	result, err := conn.SearchWithPaging(ldap.NewSearchRequest(provider.LdapBaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, strings.ReplaceAll(filter, "%s", "*"), ldapAttributes(provider), nil), ldapSyncPageSize)
+	if err != nil {
+		return nil, fmt.Errorf("user search failed: %v", err)
+	}
+
+	users := make([]*LdapUser, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		users = append(users, mapLdapEntry(provider, entry))
+	}
+	return users, nil
+}
+
+// TestLdapConnection connects and binds with the provider settings and lists the first users found
+func TestLdapConnection(provider *models.Provider) (*LdapTestResult, error) {
+	conn, err := dialLdap(provider)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := bindLdapServiceAccount(conn, provider); err != nil {
+		return nil, err
+	}
+
+	filter := provider.LdapUserFilter
+	if filter == "" {
+		filter = defaultLdapUserFilter
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(provider.LdapBaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		ldapTestSampleSize, int(ldapTimeout.Seconds()), false, strings.ReplaceAll(filter, "%s", "*"), ldapAttributes(provider), nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("user search failed: %v", err)
+	}
+
+	testResult := &LdapTestResult{Users: []string{}}
+	if result != nil {
+		for _, entry := range result.Entries {
+			user := mapLdapEntry(provider, entry)
+			if user.Username != "" {
+				testResult.Users = append(testResult.Users, user.Username)
+			} else {
+				testResult.Users = append(testResult.Users, user.Dn)
+			}
+		}
+	}
+	return testResult, nil
+}
+
+// ldapProviderOfUser returns the enabled LDAP provider the user is linked to, or nil for other users
+func ldapProviderOfUser(user *models.User) (*models.Provider, error) {
+	identities, err := models.GetUserIdentities(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, identity := range identities {
+		provider, err := models.GetProvider("admin", identity.Provider)
+		if err != nil {
+			return nil, err
+		}
+		if provider != nil && provider.IsEnabled && provider.Category == models.ProviderCategoryLdap {
+			return provider, nil
+		}
+	}
+	return nil, nil
+}
+
+// loginLdapUser checks a password sign-in against the LDAP directories. Users linked to a directory
+// are checked against it; logins unknown locally are looked up in every enabled directory and
+// provisioned on success. handled is false when the sign-in is for a local account.
+func loginLdapUser(login, password string, user *models.User) (*models.User, bool, error) {
+	if user != nil {
+		provider, err := ldapProviderOfUser(user)
+		if err != nil || provider == nil {
+			return nil, false, err
+		}
+
+		ldapUser, err := AuthenticateLdapUser(provider, login, password)
+		if err != nil {
+			if err != ErrLdapInvalidCredentials && err != ErrLdapUserNotFound {
+				log.Printf("[LDAP] Sign-in of %s through %s failed: %v", login, provider.Name, err)
+				return nil, true, fmt.Errorf("directory service unavailable")
+			}
+			return nil, true, ErrInvalidCredentials
+		}
+		return completeLdapLogin(provider, ldapUser)
+	}
+
+	providers, err := models.GetEnabledProviders("admin", models.ProviderCategoryLdap)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, provider := range providers {
+		ldapUser, err := AuthenticateLdapUser(provider, login, password)
+		switch {
+		case err == nil:
+			return completeLdapLogin(provider, ldapUser)
+		case err == ErrLdapInvalidCredentials:
+			return nil, true, ErrInvalidCredentials
+		case err != ErrLdapUserNotFound:
+			// An unreachable directory is skipped so that unknown logins fail like any other
+			log.Printf("[LDAP] Lookup of %s in %s failed: %v", login, provider.Name, err)
+		}
+	}
+	return nil, false, nil
+}
+
+func completeLdapLogin(provider *models.Provider, ldapUser *LdapUser) (*models.User, bool, error) {
+	if !ldapUser.Allowed {
+		return nil, true, fmt.Errorf("account is disabled")
+	}
+	user, _, err := syncLdapUser(provider, ldapUser)
+	if err != nil {
+		log.Printf("[LDAP] Failed to provision %s from %s: %v", ldapUser.Dn, provider.Name, err)
+		if err == ErrProviderEmailTaken {
+			return nil, true, err
+		}
+		return nil, true, fmt.Errorf("failed to provision directory account")
+	}
+	return user, true, nil
+}
+
+// syncLdapUser creates or updates the local user of a directory entry and reports whether it was created
+func syncLdapUser(provider *models.Provider, ldapUser *LdapUser) (*models.User, bool, error) {
+	identity, err := models.GetUserIdentityBySubject(provider.Name, ldapUser.Id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var user *models.User
+	if identity != nil {
+		if user, err = models.GetUserById(identity.UserId); err != nil {
+			return nil, false, err
+		}
+		if user == nil {
+			// The user was removed; the stale link is replaced by a new account
+			if _, err = models.DeleteUserIdentity(identity.Owner, identity.Name); err != nil {
+				return nil, false, err
+			}
+		} else if err = updateUserIdentity(identity, &ldapUser.ProviderUser); err != nil {
+			return nil, false, err
+		}
+	}
+
+	created := false
+	if user == nil {
+		existingUser, email, err := providerEmailMatch(provider, &ldapUser.ProviderUser)
+		if err != nil {
+			return nil, false, err
+		}
+		if existingUser != nil {
+			if _, err = models.AddUserIdentity(newUserIdentity(existingUser, provider, &ldapUser.ProviderUser)); err != nil {
+				return nil, false, err
+			}
+			user = existingUser
+		} else {
+			// Directory accounts are provisioned even when public sign-up is disabled
+			if user, err = createProviderUser(provider, &ldapUser.ProviderUser, email); err != nil {
+				return nil, false, err
+			}
+			created = true
+		}
+	}
+
+	if changed, err := applyLdapUser(provider, user, ldapUser); err != nil || !changed {
+		return user, created, err
+	}
+	user.UpdatedTime = time.Now().Format(time.RFC3339)
+	_, err = models.UpdateUser(user.Id, user)
+	return user, created, err
+}
+
+// applyLdapUser copies directory attributes and roles to the user and reports whether anything changed
+func applyLdapUser(provider *models.Provider, user *models.User, ldapUser *LdapUser) (bool, error) {
+	changed := false
+	if ldapUser.Username != "" && ldapUser.Username != user.Username {
+		// A renamed directory account keeps its username if another user of the organization has the new one
+		err := CheckUsernameAvailable(user.Owner, ldapUser.Username, user.Id)
+		if err != nil && err != ErrUsernameTaken {
+			return false, err
+		}
+		if err == nil {
+			user.Username = ldapUser.Username
+			changed = true
+		}
+	}
+	if ldapUser.Email != "" && !strings.EqualFold(ldapUser.Email, user.Email) {
+		existingUser, err := models.GetUserByEmail(ldapUser.Email)
+		if err != nil {
+			return false, err
+		}
+		if existingUser == nil || existingUser.Id == user.Id {
+			user.Email = ldapUser.Email
+			changed = true
+		}
+	}
+	// Administrator rights follow the directory only when a group maps to the admin role
+	if hasLdapRole(provider, models.LdapRoleAdmin) && user.IsAdmin != ldapUser.IsAdmin {
+		user.IsAdmin = ldapUser.IsAdmin
+		changed = true
+	}
+	if user.Properties[ldapDisabledProperty] == provider.Name {
+		delete(user.Properties, ldapDisabledProperty)
+		user.IsForbidden = false
+		changed = true
+	}
+	return changed, nil
+}
+
+var ldapSyncMu sync.Mutex
+
+// SyncLdapProvider synchronizes the directory into local users: entries are created or updated,
+// and users whose entry is gone or no longer in an allowed group are disabled and signed out
+func SyncLdapProvider(provider *models.Provider) (*LdapSyncResult, error) {
+	ldapSyncMu.Lock()
+	defer ldapSyncMu.Unlock()
+
+	ldapUsers, err := SearchLdapUsers(provider)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := models.GetUserIdentitiesByProvider(provider.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(ldapUsers) == 0 && len(identities) > 0 {
+		return nil, ErrLdapEmptyDirectory
+	}
+
+	result := &LdapSyncResult{}
+	present := make(map[string]bool, len(ldapUsers))
+	for _, ldapUser := range ldapUsers {
+		if !ldapUser.Allowed {
+			continue
+		}
+		present[ldapUser.Id] = true
+
+		_, created, err := syncLdapUser(provider, ldapUser)
+		if err != nil {
+			log.Printf("[LDAP] Failed to sync %s from %s: %v", ldapUser.Dn, provider.Name, err)
+			continue
+		}
+		if created {
+			result.Created++
+		} else {
+			result.Updated++
+		}
+	}
+
+	for _, identity := range identities {
+		if present[identity.Subject] {
+			continue
+		}
+		user, err := models.GetUserById(identity.UserId)
+		if err != nil {
+			return result, err
+		}
+		if user == nil || user.IsForbidden {
+			continue
+		}
+		if user.Properties == nil {
+			user.Properties = map[string]string{}
+		}
+		user.Properties[ldapDisabledProperty] = provider.Name
+		user.IsForbidden = true
+		user.UpdatedTime = time.Now().Format(time.RFC3339)
+		if _, err := models.UpdateUser(user.Id, user); err != nil {
+			return result, err
+		}
+		if err := SignOutUser(user); err != nil {
+			return result, err
+		}
+		result.Disabled++
+	}
+
+	provider.LdapLastSyncTime = time.Now().Format(time.RFC3339)
+	_, err = models.UpdateProviderSyncTime(provider)
+	return result, err
+}
+
+// isLdapSyncDue reports whether the scheduled sync of a provider should run now
+func isLdapSyncDue(provider *models.Provider, now time.Time) bool {
+	if provider.LdapSyncInterval <= 0 {
+		return false
+	}
+	lastSync, err := time.Parse(time.RFC3339, provider.LdapLastSyncTime)
+	if err != nil {
+		return true
+	}
+	return now.Sub(lastSync) >= time.Duration(provider.LdapSyncInterval)*time.Minute
+}
+
+// StartLdapSync runs the scheduled sync of every enabled LDAP provider in the background
+func StartLdapSync() {
+	go func() {
+		ticker := time.NewTicker(ldapSyncCheckInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			providers, err := models.GetEnabledProviders("admin", models.ProviderCategoryLdap)
+			if err != nil {
+				log.Printf("[LDAP] Failed to load providers: %v", err)
+				continue
+			}
+			for _, provider := range providers {
+				if !isLdapSyncDue(provider, time.Now()) {
+					continue
+				}
+				result, err := SyncLdapProvider(provider)
+				if err != nil {
+					log.Printf("[LDAP] Sync of %s failed: %v", provider.Name, err)
+					continue
+				}
+				log.Printf("[LDAP] Synced %s: %d created, %d updated, %d disabled", provider.Name, result.Created, result.Updated, result.Disabled)
+			}
+		}
+	}()
+}
@@ -0,0 +1,446 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/oauth-server/oauth-server/models"
+)
+
+const (
+	testLdapBaseDn          = "dc=example,dc=com"
+	testLdapServiceDn       = "cn=service,dc=example,dc=com"
+	testLdapServicePassword = "service-pass"
+	testLdapStaffGroup      = "cn=staff,ou=groups,dc=example,dc=com"
+	testLdapAdminGroup      = "cn=admins,ou=groups,dc=example,dc=com"
+)
+
+// testLdapEntry is a directory entry of the embedded server
+type testLdapEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// testLdapServer is a minimal in-process LDAP server answering simple binds and searches
+type testLdapServer struct {
+	listener net.Listener
+	entries  []*testLdapEntry
+
+	mu       sync.Mutex
+	searches int
+}
+
+func newTestLdapServer(t *testing.T) *testLdapServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &testLdapServer{
+		listener: listener,
+		entries: []*testLdapEntry{
+			{dn: testLdapServiceDn, password: testLdapServicePassword, attributes: map[string][]string{"cn": {"service"}}},
+			{dn: "uid=alice,ou=people," + testLdapBaseDn, password: "alice-pass", attributes: map[string][]string{
+				"objectClass": {"person"}, "uid": {"alice"}, "cn": {"Alice Liddell"}, "mail": {"alice@example.com"},
+				"entryUUID": {"uuid-alice"}, "memberOf": {testLdapStaffGroup, testLdapAdminGroup},
+			}},
+			{dn: "uid=bob,ou=people," + testLdapBaseDn, password: "bob-pass", attributes: map[string][]string{
+				"objectClass": {"person"}, "uid": {"bob"}, "cn": {"Bob"}, "mail": {"bob@example.com"},
+				"entryUUID": {"uuid-bob"}, "memberOf": {"cn=staff, ou=groups, dc=example, dc=com"},
+			}},
+			{dn: "uid=carol,ou=people," + testLdapBaseDn, password: "carol-pass", attributes: map[string][]string{
+				"objectClass": {"person"}, "uid": {"carol"}, "cn": {"Carol"}, "mail": {"carol@example.com"},
+			}},
+		},
+	}
+	go server.serve()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (s *testLdapServer) searchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.searches
+}
+
+func (s *testLdapServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *testLdapServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testLdapServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	boundDn := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageId := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if password == "" {
+				// Unauthenticated binds succeed without any check, like on real servers
+				code = ldap.LDAPResultSuccess
+			} else if entry := s.find(dn); entry != nil && entry.password == password {
+				code = ldap.LDAPResultSuccess
+			}
+			if code == ldap.LDAPResultSuccess {
+				boundDn = dn
+			}
+			conn.Write(testLdapMessage(messageId, testLdapResult(ldap.ApplicationBindResponse, code)).Bytes())
+		case ldap.ApplicationSearchRequest:
+			s.mu.Lock()
+			s.searches++
+			s.mu.Unlock()
+			s.search(conn, messageId, op, boundDn)
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func (s *testLdapServer) find(dn string) *testLdapEntry {
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.dn, dn) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (s *testLdapServer) search(conn net.Conn, messageId int64, op *ber.Packet, boundDn string) {
+	// Anonymous users may not search
+	if boundDn == "" {
+		conn.Write(testLdapMessage(messageId, testLdapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights)).Bytes())
+		return
+	}
+
+	base := strings.ToLower(op.Children[0].Data.String())
+	scope := op.Children[1].Value.(int64)
+	sizeLimit := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+
+	found := 0
+	for _, entry := range s.entries {
+		dn := strings.ToLower(entry.dn)
+		inScope := dn == base
+		if scope != ldap.ScopeBaseObject {
+			inScope = inScope || strings.HasSuffix(dn, ","+base)
+		}
+		if !inScope || !testLdapMatch(entry, filter) {
+			continue
+		}
+		if sizeLimit > 0 && int64(found) == sizeLimit {
+			conn.Write(testLdapMessage(messageId, testLdapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded)).Bytes())
+			return
+		}
+		found++
+
+		result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "DN"))
+		attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+		for name, values := range entry.attributes {
+			attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, value := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+			}
+			attribute.AppendChild(set)
+			attributes.AppendChild(attribute)
+		}
+		result.AppendChild(attributes)
+		conn.Write(testLdapMessage(messageId, result).Bytes())
+	}
+	conn.Write(testLdapMessage(messageId, testLdapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)).Bytes())
+}
+
+// testLdapMatch evaluates and, or, not, equality and presence filters
+func testLdapMatch(entry *testLdapEntry, filter *ber.Packet) bool {
+	values := func(name string) []string {
+		for attribute, values := range entry.attributes {
+			if strings.EqualFold(attribute, name) {
+				return values
+			}
+		}
+		return nil
+	}
+
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !testLdapMatch(entry, child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if testLdapMatch(entry, child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !testLdapMatch(entry, filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		for _, value := range values(filter.Children[0].Data.String()) {
+			if strings.EqualFold(value, filter.Children[1].Data.String()) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(values(filter.Data.String())) > 0
+	}
+	return false
+}
+
+func testLdapMessage(messageId int64, op *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "MessageID"))
+	packet.AppendChild(op)
+	return packet
+}
+
+func testLdapResult(tag ber.Tag, code int64) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return result
+}
+
+// newTestLdapProvider returns a search-then-bind provider for the embedded server
+func newTestLdapProvider(t *testing.T, server *testLdapServer) *models.Provider {
+	t.Helper()
+
+	if err := InitRSAKeys(); err != nil {
+		t.Fatalf("Failed to initialize RSA keys: %v", err)
+	}
+	secret, err := EncryptData(testLdapServicePassword)
+	if err != nil {
+		t.Fatalf("Failed to encrypt the service password: %v", err)
+	}
+	return &models.Provider{
+		Owner:        "admin",
+		Name:         "corp-ldap",
+		Category:     models.ProviderCategoryLdap,
+		HostUrl:      server.url(),
+		ClientId:     testLdapServiceDn,
+		ClientSecret: secret,
+		LdapBaseDn:   testLdapBaseDn,
+		IsEnabled:    true,
+	}
+}
+
+// TestAuthenticateLdapUserSearchBind tests search-then-bind sign-in and attribute mapping
+func TestAuthenticateLdapUserSearchBind(t *testing.T) {
+	server := newTestLdapServer(t)
+	provider := newTestLdapProvider(t, server)
+
+	user, err := AuthenticateLdapUser(provider, "Alice@example.com", "alice-pass")
+	if err != nil {
+		t.Fatalf("Expected sign-in to succeed, got %v", err)
+	}
+	if user.Id != "uuid-alice" || user.Username != "alice" || user.DisplayName != "Alice Liddell" || user.Email != "alice@example.com" {
+		t.Errorf("Unexpected mapping: %+v", user)
+	}
+	if !user.EmailVerified || user.Dn != "uid=alice,ou=people,"+testLdapBaseDn {
+		t.Errorf("Expected a verified email and the entry DN, got %+v", user)
+	}
+	if !user.Allowed || user.IsAdmin {
+		t.Errorf("Expected everyone to be allowed and no admin without group roles, got %+v", user)
+	}
+
+	if _, err := AuthenticateLdapUser(provider, "alice@example.com", "wrong"); err != ErrLdapInvalidCredentials {
+		t.Errorf("Expected ErrLdapInvalidCredentials for a wrong password, got %v", err)
+	}
+	if _, err := AuthenticateLdapUser(provider, "nobody@example.com", "alice-pass"); err != ErrLdapUserNotFound {
+		t.Errorf("Expected ErrLdapUserNotFound for an unknown user, got %v", err)
+	}
+
+	// The server accepts unauthenticated binds, so empty passwords must be refused before binding
+	searches := server.searchCount()
+	if _, err := AuthenticateLdapUser(provider, "alice@example.com", ""); err != ErrLdapInvalidCredentials {
+		t.Errorf("Expected ErrLdapInvalidCredentials for an empty password, got %v", err)
+	}
+	if server.searchCount() != searches {
+		t.Errorf("Expected no directory request for an empty password")
+	}
+}
+
+// TestAuthenticateLdapUserEscapesLogin tests that logins cannot inject filter syntax
+func TestAuthenticateLdapUserEscapesLogin(t *testing.T) {
+	server := newTestLdapServer(t)
+	provider := newTestLdapProvider(t, server)
+
+	for _, login := range []string{"*", "*)(uid=alice", "alice@example.com)(|(mail=*"} {
+		if _, err := AuthenticateLdapUser(provider, login, "alice-pass"); err != ErrLdapUserNotFound {
+			t.Errorf("Expected ErrLdapUserNotFound for %q, got %v", login, err)
+		}
+	}
+
+	// A custom filter selects the login attribute
+	provider.LdapUserFilter = "(&(objectClass=person)(uid=%s))"
+	user, err := AuthenticateLdapUser(provider, "bob", "bob-pass")
+	if err != nil || user.Email != "bob@example.com" {
+		t.Errorf("Expected sign-in by uid, got %+v, %v", user, err)
+	}
+}
+
+// TestAuthenticateLdapUserDirectBind tests sign-in through the bind DN template
+func TestAuthenticateLdapUserDirectBind(t *testing.T) {
+	server := newTestLdapServer(t)
+	provider := newTestLdapProvider(t, server)
+	// No service account is needed when users bind directly
+	provider.ClientId = ""
+	provider.ClientSecret = ""
+	provider.LdapBindDnTemplate = "uid=%s,ou=people," + testLdapBaseDn
+
+	user, err := AuthenticateLdapUser(provider, "bob", "bob-pass")
+	if err != nil {
+		t.Fatalf("Expected sign-in to succeed, got %v", err)
+	}
+	if user.Username != "bob" || user.Email != "bob@example.com" {
+		t.Errorf("Unexpected mapping: %+v", user)
+	}
+
+	if _, err := AuthenticateLdapUser(provider, "bob", "alice-pass"); err != ErrLdapInvalidCredentials {
+		t.Errorf("Expected ErrLdapInvalidCredentials, got %v", err)
+	}
+	if _, err := AuthenticateLdapUser(provider, "alice,ou=people", "alice-pass"); err != ErrLdapInvalidCredentials {
+		t.Errorf("Expected the login to be escaped in the DN, got %v", err)
+	}
+}
+
+// TestLdapGroupRoles tests that mapped groups restrict sign-in and grant the admin role
+func TestLdapGroupRoles(t *testing.T) {
+	server := newTestLdapServer(t)
+	provider := newTestLdapProvider(t, server)
+	provider.LdapGroupRoles = map[string]string{
+		testLdapStaffGroup: models.LdapRoleUser,
+		testLdapAdminGroup: models.LdapRoleAdmin,
+	}
+
+	tests := []struct {
+		login, password  string
+		allowed, isAdmin bool
+	}{
+		{"alice@example.com", "alice-pass", true, true},
+		// Bob's group DN differs only in spacing
+		{"bob@example.com", "bob-pass", true, false},
+		{"carol@example.com", "carol-pass", false, false},
+	}
+	for _, tt := range tests {
+		user, err := AuthenticateLdapUser(provider, tt.login, tt.password)
+		if err != nil {
+			t.Fatalf("Expected %s to authenticate, got %v", tt.login, err)
+		}
+		if user.Allowed != tt.allowed || user.IsAdmin != tt.isAdmin {
+			t.Errorf("%s: expected allowed %v and admin %v, got %+v", tt.login, tt.allowed, tt.isAdmin, user)
+		}
+	}
+}
+
+// TestSearchLdapUsers tests listing the directory for a sync
+func TestSearchLdapUsers(t *testing.T) {
+	server := newTestLdapServer(t)
+	provider := newTestLdapProvider(t, server)
+
+	users, err := SearchLdapUsers(provider)
+	if err != nil {
+		t.Fatalf("Expected the search to succeed, got %v", err)
+	}
+	// The service account has no mail and is not matched by the default filter
+	if len(users) != 3 {
+		t.Fatalf("Expected 3 users, got %d", len(users))
+	}
+	if users[2].Username != "carol" || users[2].Id != users[2].Dn {
+		t.Errorf("Expected entries without entryUUID to be identified by DN, got %+v", users[2])
+	}
+}
+
+// TestTestLdapConnection tests the connection check and its failures
+func TestTestLdapConnection(t *testing.T) {
+	server := newTestLdapServer(t)
+	provider := newTestLdapProvider(t, server)
+
+	result, err := TestLdapConnection(provider)
+	if err != nil {
+		t.Fatalf("Expected the connection test to succeed, got %v", err)
+	}
+	if len(result.Users) != 3 || result.Users[0] != "alice" {
+		t.Errorf("Unexpected users: %v", result.Users)
+	}
+
+	wrongSecret, _ := EncryptData("wrong")
+	provider.ClientSecret = wrongSecret
+	if _, err := TestLdapConnection(provider); err == nil {
+		t.Errorf("Expected a wrong service password to fail")
+	}
+
+	// Anonymous searches are refused by the server
+	provider.ClientId = ""
+	if _, err := TestLdapConnection(provider); err == nil {
+		t.Errorf("Expected an anonymous search to fail")
+	}
+
+	provider.HostUrl = "https://" + server.listener.Addr().String()
+	if _, err := TestLdapConnection(provider); err != ErrProviderNotConfigured {
+		t.Errorf("Expected ErrProviderNotConfigured for a non-LDAP URL, got %v", err)
+	}
+
+	server.listener.Close()
+	provider.HostUrl = server.url()
+	if _, err := TestLdapConnection(provider); err == nil {
+		t.Errorf("Expected an unreachable server to fail")
+	}
+}
+
+// TestIsLdapSyncDue tests the scheduled sync interval
+func TestIsLdapSyncDue(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		interval int
+		lastSync string
+		due      bool
+	}{
+		{0, "", false},
+		{30, "", true},
+		{30, now.Add(-10 * time.Minute).Format(time.RFC3339), false},
+		{30, now.Add(-31 * time.Minute).Format(time.RFC3339), true},
+	}
+	for _, tt := range tests {
+		provider := &models.Provider{LdapSyncInterval: tt.interval, LdapLastSyncTime: tt.lastSync}
+		if due := isLdapSyncDue(provider, now); due != tt.due {
+			t.Errorf("interval %d, last sync %q: expected due %v, got %v", tt.interval, tt.lastSync, tt.due, due)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// Authentication method references recorded in the amr claim (RFC 8176)
+const (
+	AmrPassword = "pwd"
+	AmrOtp      = "otp"
+	AmrMfa      = "mfa"
+)
+
+const (
+	totpPeriod = 30 // seconds per time step (RFC 6238)
+	totpDigits = 6
+	totpSkew   = 1 // accepted steps before and after the current one, for clock drift
+
+	recoveryCodeCount = 10
+
+	mfaTicketLifetime    = 5 * time.Minute
+	mfaTicketMaxAttempts = 5
+)
+
+var (
+	ErrMfaTicketInvalid    = fmt.Errorf("the MFA ticket is invalid or expired")
+	ErrMfaTicketUsedUp     = fmt.Errorf("the MFA ticket can no longer be used, please sign in again")
+	ErrMfaCodeInvalid      = fmt.Errorf("the verification code is invalid")
+	ErrMfaAlreadyEnabled   = fmt.Errorf("multi-factor authentication is already enabled")
+	ErrMfaNotEnabled       = fmt.Errorf("multi-factor authentication is not enabled")
+	ErrMfaSetupNotStarted  = fmt.Errorf("TOTP setup has not been started")
+	ErrMfaRecoveryNotValid = fmt.Errorf("the recovery code is invalid or has been used")
+)
+
+// GenerateTotpSecret generates a random 160-bit TOTP secret encoded as base32 without padding
+func GenerateTotpSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// TotpProvisioningUri builds the otpauth:// URI that authenticator apps read from a QR code
+func TotpProvisioningUri(account, secret string) string {
+	issuer := os.Getenv("APP_NAME")
+	if issuer == "" {
+		issuer = "OAuth Server"
+	}
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+
+	label := url.PathEscape(issuer + ":" + account)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// decodeTotpSecret decodes a base32 secret, tolerating lower case, spaces and padding
+func decodeTotpSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	secret = strings.TrimRight(secret, "=")
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+}
+
+// totpCode computes the HOTP value (RFC 4226) of a key for a time step
+func totpCode(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+// ValidateTotpCode checks a code against the steps around now and returns the matching step
+func ValidateTotpCode(secret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	key, err := decodeTotpSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeRecoveryCode ignores case, dashes and spaces so codes can be typed loosely
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+func hashRecoveryCode(code string) string {
+	hash := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(hash[:])
+}
+
+// GenerateRecoveryCodes returns a set of one-time recovery codes and their hashes
+func GenerateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(raw)
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// matchRecoveryCode returns the index of the hash matching a recovery code, -1 if none.
+// Every hash is compared so the timing does not reveal the position of a match.
+func matchRecoveryCode(hashes []string, code string) int {
+	if normalizeRecoveryCode(code) == "" {
+		return -1
+	}
+
+	hash := []byte(hashRecoveryCode(code))
+	index := -1
+	for i, candidate := range hashes {
+		if subtle.ConstantTimeCompare(hash, []byte(candidate)) == 1 {
+			index = i
+		}
+	}
+	return index
+}
+
+// verifyUserTotp checks a TOTP code of a user and consumes its time step
+func verifyUserTotp(user *models.User, code string) (bool, error) {
+	if user.TotpSecret == "" {
+		return false, nil
+	}
+	secret, err := DecryptData(user.TotpSecret)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := ValidateTotpCode(secret, code, time.Now())
+	if !ok || step <= user.TotpLastUsedStep {
+		return false, nil
+	}
+	used, err := models.UseTotpStep(user.Id, step)
+	if err != nil || !used {
+		return false, err
+	}
+	user.TotpLastUsedStep = step
+	return true, nil
+}
+
+// consumeRecoveryCode removes a recovery code of a user if it matches one
+func consumeRecoveryCode(user *models.User, code string) (bool, error) {
+	index := matchRecoveryCode(user.RecoveryCodes, code)
+	if index < 0 {
+		return false, nil
+	}
+
+	remaining := make([]string, 0, len(user.RecoveryCodes)-1)
+	remaining = append(remaining, user.RecoveryCodes[:index]...)
+	remaining = append(remaining, user.RecoveryCodes[index+1:]...)
+	consumed, err := models.ReplaceRecoveryCodes(user.Id, user.RecoveryCodes, remaining)
+	if err != nil || !consumed {
+		return false, err
+	}
+	user.RecoveryCodes = remaining
+	return true, nil
+}
+
+// VerifySecondFactor checks either a TOTP code or a recovery code of a user
+// and returns the authentication methods to add to the password
+func VerifySecondFactor(user *models.User, code, recoveryCode string) ([]string, error) {
+	if !user.TotpEnabled {
+		return nil, ErrMfaNotEnabled
+	}
+
+	if code != "" {
+		ok, err := verifyUserTotp(user, code)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrMfaCodeInvalid
+		}
+		return []string{AmrOtp, AmrMfa}, nil
+	}
+
+	ok, err := consumeRecoveryCode(user, recoveryCode)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrMfaRecoveryNotValid
+	}
+	return []string{AmrMfa}, nil
+}
+
+// SetupTotp starts TOTP enrollment by storing a new secret that is not yet enabled
+func SetupTotp(user *models.User) (string, string, error) {
+	if user.TotpEnabled {
+		return "", "", ErrMfaAlreadyEnabled
+	}
+
+	secret, err := GenerateTotpSecret()
+	if err != nil {
+		return "", "", err
+	}
+	encrypted, err := EncryptData(secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	user.TotpSecret = encrypted
+	user.TotpLastUsedStep = 0
+	user.UpdatedTime = models.GetCurrentTime()
+	if _, err = models.UpdateUserMfa(user); err != nil {
+		return "", "", err
+	}
+
+	account := user.Email
+	if account == "" {
+		account = user.Username
+	}
+	return secret, TotpProvisioningUri(account, secret), nil
+}
+
+// ConfirmTotp enables TOTP once the user proves the authenticator works
+// and returns the recovery codes, which are only shown this once
+func ConfirmTotp(user *models.User, code string) ([]string, error) {
+	if user.TotpEnabled {
+		return nil, ErrMfaAlreadyEnabled
+	}
+	if user.TotpSecret == "" {
+		return nil, ErrMfaSetupNotStarted
+	}
+
+	ok, err := verifyUserTotp(user, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrMfaCodeInvalid
+	}
+
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	user.TotpEnabled = true
+	user.RecoveryCodes = hashes
+	user.UpdatedTime = models.GetCurrentTime()
+	if _, err = models.UpdateUserMfa(user); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTotp turns off TOTP after checking a current second factor
+func DisableTotp(user *models.User, code, recoveryCode string) error {
+	if _, err := VerifySecondFactor(user, code, recoveryCode); err != nil {
+		return err
+	}
+	return clearTotp(user)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a TOTP code
+func RegenerateRecoveryCodes(user *models.User, code string) ([]string, error) {
+	if !user.TotpEnabled {
+		return nil, ErrMfaNotEnabled
+	}
+
+	ok, err := verifyUserTotp(user, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrMfaCodeInvalid
+	}
+
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	replaced, err := models.ReplaceRecoveryCodes(user.Id, user.RecoveryCodes, hashes)
+	if err != nil {
+		return nil, err
+	}
+	if !replaced {
+		return nil, fmt.Errorf("recovery codes were changed concurrently")
+	}
+	user.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// ResetMfa removes every second factor of a user, including WebAuthn credentials
+func ResetMfa(user *models.User) error {
+	if err := models.DeleteUserWebauthnCredentials(user.Id); err != nil {
+		return err
+	}
+	return clearTotp(user)
+}
+
+// clearTotp removes the TOTP secret and the recovery codes of a user
+func clearTotp(user *models.User) error {
+	user.TotpSecret = ""
+	user.TotpEnabled = false
+	user.TotpLastUsedStep = 0
+	user.RecoveryCodes = []string{}
+	user.UpdatedTime = models.GetCurrentTime()
+	_, err := models.UpdateUserMfa(user)
+	return err
+}
+
+// SecondFactorMethods returns the second factors a user has set up; a sign-in with a
+// password must be completed with one of them when the list is not empty
+func SecondFactorMethods(user *models.User) ([]string, error) {
+	methods := []string{}
+	if user.TotpEnabled {
+		methods = append(methods, "totp", "recovery_code")
+	}
+
+	count, err := models.CountUserWebauthnCredentials(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		methods = append(methods, "webauthn")
+	}
+	return methods, nil
+}
+
+// MfaTicketClaims is the MFA-pending state between the password and the second factor
+type MfaTicketClaims struct {
+	Id  string   `json:"id"`
+	Amr []string `json:"amr"`
+
+	jwt.RegisteredClaims
+}
+
+// mfaTicketKey derives the ticket signing key from JWT_SECRET.
+// Tickets use their own key so they are never accepted as bearer tokens.
+func mfaTicketKey() []byte {
+	jwtSecret := os.Getenv("JWT_SECRET")
+	if jwtSecret == "" {
+		jwtSecret = "default-secret-key-change-in-production"
+	}
+	mac := hmac.New(sha256.New, []byte(jwtSecret))
+	mac.Write([]byte("mfa-ticket"))
+	return mac.Sum(nil)
+}
+
+// GenerateMfaTicket issues a short-lived ticket for a user who passed the first factor
+func GenerateMfaTicket(user *models.User, amr []string) (string, error) {
+	now := time.Now()
+	claims := MfaTicketClaims{
+		Id:  user.GetId(),
+		Amr: amr,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaTicketLifetime)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        models.GenerateRandomString(32),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(mfaTicketKey())
+}
+
+// ParseMfaTicket verifies a ticket and returns its claims
+func ParseMfaTicket(ticket string) (*MfaTicketClaims, error) {
+	claims := &MfaTicketClaims{}
+	token, err := jwt.ParseWithClaims(ticket, claims, func(token *jwt.Token) (interface{}, error) {
+		return mfaTicketKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid || claims.ID == "" {
+		return nil, ErrMfaTicketInvalid
+	}
+	return claims, nil
+}
+
+// mfaTicketAttempts counts failed attempts per ticket in process when Redis is not configured
+var mfaTicketAttempts = struct {
+	sync.Mutex
+	entries map[string]mfaTicketAttempt
+}{entries: map[string]mfaTicketAttempt{}}
+
+type mfaTicketAttempt struct {
+	count     int
+	expiresAt time.Time
+}
+
+// countMfaTicketAttempt records an attempt for a ticket and returns the total so far.
+// A ticket is closed after a successful attempt by counting it as used up.
+func countMfaTicketAttempt(ticketId string, expiresAt time.Time, increment int) int {
+	if redisClient != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+		defer cancel()
+		key := fmt.Sprintf("mfa-ticket:%s", ticketId)
+		count, err := redisClient.IncrBy(ctx, key, int64(increment)).Result()
+		if err == nil {
+			redisClient.ExpireAt(ctx, key, expiresAt)
+			return int(count)
+		}
+	}
+
+	now := time.Now()
+	mfaTicketAttempts.Lock()
+	defer mfaTicketAttempts.Unlock()
+	for id, entry := range mfaTicketAttempts.entries {
+		if now.After(entry.expiresAt) {
+			delete(mfaTicketAttempts.entries, id)
+		}
+	}
+	entry := mfaTicketAttempts.entries[ticketId]
+	entry.count += increment
+	entry.expiresAt = expiresAt
+	mfaTicketAttempts.entries[ticketId] = entry
+	return entry.count
+}
+
+// openMfaTicket verifies a ticket, counts an attempt against it and returns its user
+func openMfaTicket(ticket string) (*MfaTicketClaims, *models.User, error) {
+	claims, err := ParseMfaTicket(ticket)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	userId, err := strconv.ParseInt(claims.Id, 10, 64)
+	if err != nil {
+		return nil, nil, ErrMfaTicketInvalid
+	}
+	user, err := models.GetUserById(userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user == nil || user.IsForbidden || user.IsDeleted {
+		return nil, nil, ErrMfaTicketInvalid
+	}
+
+	if countMfaTicketAttempt(claims.ID, claims.ExpiresAt.Time, 1) > mfaTicketMaxAttempts {
+		return nil, nil, ErrMfaTicketUsedUp
+	}
+	return claims, user, nil
+}
+
+// CompleteMfaLogin checks the second factor for an MFA ticket and returns the user
+// with the authentication methods of the whole sign-in
+func CompleteMfaLogin(ticket, code, recoveryCode string) (*models.User, []string, error) {
+	claims, user, err := openMfaTicket(ticket)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	amr, err := VerifySecondFactor(user, code, recoveryCode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Tickets are single use
+	countMfaTicketAttempt(claims.ID, claims.ExpiresAt.Time, mfaTicketMaxAttempts)
+	return user, append(claims.Amr, amr...), nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// rfc6238Secret is the SHA-1 test key of RFC 6238 Appendix B ("12345678901234567890") in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestTotpCode tests TOTP values against the RFC 6238 test vectors (last 6 digits)
+func TestTotpCode(t *testing.T) {
+	tests := []struct {
+		time     int64
+		expected string
+	}{
+		{time: 59, expected: "287082"},
+		{time: 1111111109, expected: "081804"},
+		{time: 1111111111, expected: "050471"},
+		{time: 1234567890, expected: "005924"},
+		{time: 2000000000, expected: "279037"},
+	}
+
+	key, err := decodeTotpSecret(rfc6238Secret)
+	if err != nil {
+		t.Fatalf("Failed to decode secret: %v", err)
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.time/totpPeriod); got != tt.expected {
+			t.Errorf("At %d expected %s, got %s", tt.time, tt.expected, got)
+		}
+	}
+}
+
+// TestValidateTotpCode tests the accepted clock drift window
+func TestValidateTotpCode(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	step, ok := ValidateTotpCode(rfc6238Secret, "050471", now)
+	if !ok || step != now.Unix()/totpPeriod {
+		t.Fatalf("Expected current code to be valid, got step %d ok %v", step, ok)
+	}
+
+	// The code of the previous step is still accepted
+	if _, ok := ValidateTotpCode(rfc6238Secret, "050471", now.Add(totpPeriod*time.Second)); !ok {
+		t.Errorf("Expected code within the skew window to be valid")
+	}
+	if _, ok := ValidateTotpCode(rfc6238Secret, "050471", now.Add(3*totpPeriod*time.Second)); ok {
+		t.Errorf("Expected code outside the skew window to be rejected")
+	}
+	if _, ok := ValidateTotpCode(rfc6238Secret, "05047", now); ok {
+		t.Errorf("Expected short code to be rejected")
+	}
+	if _, ok := ValidateTotpCode(strings.ToLower(rfc6238Secret), "050471", now); !ok {
+		t.Errorf("Expected lower case secret to be accepted")
+	}
+}
+
+// TestGenerateTotpSecret tests secret generation and the provisioning URI
+func TestGenerateTotpSecret(t *testing.T) {
+	secret, err := GenerateTotpSecret()
+	if err != nil {
+		t.Fatalf("GenerateTotpSecret failed: %v", err)
+	}
+	key, err := decodeTotpSecret(secret)
+	if err != nil || len(key) != 20 {
+		t.Fatalf("Expected a 160-bit base32 secret, got %q", secret)
+	}
+
+	uri, err := url.Parse(TotpProvisioningUri("alice@example.com", secret))
+	if err != nil {
+		t.Fatalf("Invalid provisioning URI: %v", err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" {
+		t.Errorf("Unexpected provisioning URI: %s", uri)
+	}
+	if !strings.HasSuffix(uri.Path, ":alice@example.com") {
+		t.Errorf("Expected account in label, got %s", uri.Path)
+	}
+	if uri.Query().Get("secret") != secret || uri.Query().Get("digits") != "6" || uri.Query().Get("period") != "30" {
+		t.Errorf("Unexpected provisioning parameters: %s", uri.RawQuery)
+	}
+}
+
+// TestRecoveryCodes tests recovery code generation and matching
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes failed: %v", err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("Expected %d codes, got %d", recoveryCodeCount, len(codes))
+	}
+
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if seen[code] {
+			t.Errorf("Duplicate recovery code %s", code)
+		}
+		seen[code] = true
+		if hashes[i] == code {
+			t.Errorf("Expected recovery codes to be stored hashed")
+		}
+	}
+
+	if got := matchRecoveryCode(hashes, codes[3]); got != 3 {
+		t.Errorf("Expected match at 3, got %d", got)
+	}
+	// Case, dashes and spaces are ignored
+	loose := strings.ToUpper(strings.ReplaceAll(codes[5], "-", " "))
+	if got := matchRecoveryCode(hashes, loose); got != 5 {
+		t.Errorf("Expected loose match at 5, got %d", got)
+	}
+	if got := matchRecoveryCode(hashes, "00000-00000"); got != -1 {
+		t.Errorf("Expected no match, got %d", got)
+	}
+	if got := matchRecoveryCode(hashes, ""); got != -1 {
+		t.Errorf("Expected empty code not to match, got %d", got)
+	}
+}
+
+// TestMfaTicket tests that MFA tickets round trip and cannot be used as access tokens
+func TestMfaTicket(t *testing.T) {
+	user := &models.User{Id: 42, Username: "alice"}
+	ticket, err := GenerateMfaTicket(user, []string{AmrPassword})
+	if err != nil {
+		t.Fatalf("GenerateMfaTicket failed: %v", err)
+	}
+
+	claims, err := ParseMfaTicket(ticket)
+	if err != nil {
+		t.Fatalf("ParseMfaTicket failed: %v", err)
+	}
+	if claims.Id != "42" || len(claims.Amr) != 1 || claims.Amr[0] != AmrPassword {
+		t.Errorf("Unexpected ticket claims: %+v", claims)
+	}
+
+	if _, err := ParseJwtToken(ticket); err == nil {
+		t.Errorf("Expected MFA ticket to be rejected as a bearer token")
+	}
+
+	application := &models.Application{ClientId: "client", ExpireInHours: 1}
+	accessToken, _, _, err := GenerateJwtToken(application, user, "openid", "", "", []string{AmrPassword})
+	if err != nil {
+		t.Fatalf("GenerateJwtToken failed: %v", err)
+	}
+	if _, err := ParseMfaTicket(accessToken); err != ErrMfaTicketInvalid {
+		t.Errorf("Expected access token to be rejected as an MFA ticket")
+	}
+	if _, err := ParseMfaTicket(ticket[:len(ticket)-2]); err != ErrMfaTicketInvalid {
+		t.Errorf("Expected tampered ticket to be rejected")
+	}
+}
+
+// TestMfaTicketAttempts tests that a ticket is closed after too many attempts
+func TestMfaTicketAttempts(t *testing.T) {
+	expiresAt := time.Now().Add(time.Minute)
+	for i := 1; i <= mfaTicketMaxAttempts; i++ {
+		if got := countMfaTicketAttempt("ticket-attempts", expiresAt, 1); got != i {
+			t.Fatalf("Expected attempt %d, got %d", i, got)
+		}
+	}
+	if countMfaTicketAttempt("ticket-attempts", expiresAt, 1) <= mfaTicketMaxAttempts {
+		t.Errorf("Expected ticket to be used up")
+	}
+
+	// A successful attempt closes the ticket
+	countMfaTicketAttempt("ticket-used", expiresAt, mfaTicketMaxAttempts)
+	if countMfaTicketAttempt("ticket-used", expiresAt, 1) <= mfaTicketMaxAttempts {
+		t.Errorf("Expected used ticket to be rejected")
+	}
+}
+
+// TestAccessTokenAmr tests that the amr claim is carried by issued tokens
+func TestAccessTokenAmr(t *testing.T) {
+	user := &models.User{Id: 1, Username: "alice"}
+	application := &models.Application{ClientId: "client", ExpireInHours: 1}
+	amr := []string{AmrPassword, AmrOtp, AmrMfa}
+
+	accessToken, _, _, err := GenerateJwtToken(application, user, "openid", "", "", amr)
+	if err != nil {
+		t.Fatalf("GenerateJwtToken failed: %v", err)
+	}
+	claims, err := ParseJwtToken(accessToken)
+	if err != nil {
+		t.Fatalf("ParseJwtToken failed: %v", err)
+	}
+	if strings.Join(claims.Amr, " ") != "pwd otp mfa" {
+		t.Errorf("Unexpected amr: %v", claims.Amr)
+	}
+}
@@ -13,7 +13,6 @@ import (
 	"time"
 
 	"github.com/oauth-server/oauth-server/models"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -95,6 +94,14 @@ func CheckOAuthLogin(clientId, responseType, redirectUri, scope, state string) (
 		return "Invalid client_id", nil, nil
 	}
 
+	if application.IsSaml() {
+		return "The application is a SAML service provider", nil, nil
+	}
+
+	if application.IsPending() {
+		return "The client registration is pending approval", nil, nil
+	}
+
 	if !application.IsRedirectUriValid(redirectUri) {
 		return fmt.Sprintf("Redirect URI: %s doesn't exist in the allowed Redirect URI list", redirectUri), application, nil
 	}
@@ -103,7 +110,9 @@ func CheckOAuthLogin(clientId, responseType, redirectUri, scope, state string) (
 }
 
 // GetOAuthCode generates OAuth authorization code
-func GetOAuthCode(userId, clientId, responseType, redirectUri, scope, state, nonce, challenge, resource string) (*CodeResponse, error) {
+// amr lists the authentication methods of the user's session and is recorded with the grant;
+// sessionId is the console session the user approved the request in, which the grant is attached to
+func GetOAuthCode(userId, clientId, responseType, redirectUri, scope, state, nonce, challenge, resource, claims string, amr []string, sessionId string) (*CodeResponse, error) {
 	// Parse userId to int64
 	userIdInt, err := strconv.ParseInt(userId, 10, 64)
 	if err != nil {
@@ -152,10 +161,19 @@ func GetOAuthCode(userId, clientId, responseType, redirectUri, scope, state, non
 		}, nil
 	}
 
-	// Generate JWT tokens
-	accessToken, refreshToken, tokenName, err := GenerateJwtToken(application, user, scope, nonce, resource)
+	// Validate claims parameter (OIDC Core §5.5)
+	claimsRequest, err := ParseClaimsRequest(claims)
 	if err != nil {
-		return nil, err
+		return &CodeResponse{
+			Message: err.Error(),
+			Code:    "",
+		}, nil
+	}
+	if !claimsRequest.CheckSubject(user) {
+		return &CodeResponse{
+			Message: "The requested sub claim does not match the signed in user",
+			Code:    "",
+		}, nil
 	}
 
 	if challenge == "null" {
@@ -165,38 +183,35 @@ func GetOAuthCode(userId, clientId, responseType, redirectUri, scope, state, non
 	// Generate token family ID for refresh token rotation tracking
 	tokenFamily := models.GenerateRandomString(32)
 
-	// Calculate expiration timestamps
-	now := time.Now()
-	accessExpiresAt := now.Add(time.Duration(application.ExpireInHours) * time.Hour).Unix()
-	refreshExpiresAt := now.Add(time.Duration(application.RefreshExpireInHours) * time.Hour).Unix()
-
-	// Create token record
+	// Create the grant record; tokens are minted when the code is redeemed since
+	// only their hashes are stored
 	token := &models.Token{
-		Owner:            application.Owner,
-		Name:             tokenName,
-		CreatedTime:      models.GetCurrentTime(),
-		Application:      application.Name,
-		Organization:     user.Owner,
-		User:             fmt.Sprintf("%d", user.Id),
-		Code:             models.GenerateRandomString(32),
-		AccessToken:      accessToken,
-		RefreshToken:     refreshToken,
-		ExpiresIn:        int(application.ExpireInHours * 3600),
-		ExpiresAt:        accessExpiresAt,
-		RefreshExpiresAt: refreshExpiresAt,
-		Scope:            scope,
-		TokenType:        "Bearer",
-		CodeChallenge:    challenge,
-		CodeIsUsed:       false,
-		CodeExpireIn:     time.Now().Add(time.Minute * 5).Unix(),
-		Resource:         resource,
-		TokenFamily:      tokenFamily,
+		Owner:         application.Owner,
+		Name:          fmt.Sprintf("token_%d_%d", user.Id, time.Now().UnixNano()),
+		CreatedTime:   models.GetCurrentTime(),
+		Application:   application.Name,
+		Organization:  user.Owner,
+		User:          fmt.Sprintf("%d", user.Id),
+		Code:          models.GenerateRandomString(32),
+		ExpiresIn:     int(application.ExpireInHours * 3600),
+		Scope:         scope,
+		TokenType:     "Bearer",
+		CodeChallenge: challenge,
+		CodeIsUsed:    false,
+		CodeExpireIn:  time.Now().Add(time.Minute * 5).Unix(),
+		Resource:      resource,
+		Claims:        claimsRequest.String(),
+		Nonce:         nonce,
+		Amr:           amr,
+		TokenFamily:   tokenFamily,
+		Session:       sessionId,
 	}
 
 	_, err = models.AddToken(token)
 	if err != nil {
 		return nil, err
 	}
+	AttachSessionApplication(user.Owner, sessionId, application.GetId())
 
 	return &CodeResponse{
 		Message: "",
@@ -218,6 +233,20 @@ func GetOAuthToken(grantType, clientId, clientSecret, code, verifier, scope, use
 		}, nil
 	}
 
+	if application.IsPending() {
+		return &TokenError{
+			Error:            InvalidClient,
+			ErrorDescription: "client registration is pending approval",
+		}, nil
+	}
+
+	if application.IsSaml() {
+		return &TokenError{
+			Error:            InvalidClient,
+			ErrorDescription: "the application is a SAML service provider",
+		}, nil
+	}
+
 	// Check if grant type is allowed
 	if !models.IsGrantTypeValid(grantType, application.GrantTypes) {
 		return &TokenError{
@@ -259,11 +288,12 @@ func GetOAuthToken(grantType, clientId, clientSecret, code, verifier, scope, use
 		return tokenError, nil
 	}
 
-	// Mark code as used
-	token.CodeIsUsed = true
-	_, err = models.UpdateTokenByCode(token.Code, token)
+	idToken, err := getIdToken(application, token)
 	if err != nil {
-		return nil, err
+		return &TokenError{
+			Error:            EndpointError,
+			ErrorDescription: fmt.Sprintf("generate id token error: %s", err.Error()),
+		}, nil
 	}
 
 	return &TokenResponse{
@@ -272,10 +302,39 @@ func GetOAuthToken(grantType, clientId, clientSecret, code, verifier, scope, use
 		ExpiresIn:    token.ExpiresIn,
 		RefreshToken: token.RefreshToken,
 		Scope:        token.Scope,
-		IdToken:      token.AccessToken, // For OIDC compatibility
+		IdToken:      idToken,
 	}, nil
 }
 
+// getIdToken returns the id_token for a token response
+// Requests without the openid scope (or without a real user) keep the legacy behaviour of echoing the access token
+func getIdToken(application *models.Application, token *models.Token) (string, error) {
+	if !hasScope(token.Scope, "openid") {
+		return token.AccessToken, nil
+	}
+
+	userId, err := strconv.ParseInt(token.User, 10, 64)
+	if err != nil || userId == 0 {
+		return token.AccessToken, nil
+	}
+
+	user, err := models.GetUserById(userId)
+	if err != nil {
+		return "", err
+	}
+	if user == nil {
+		return token.AccessToken, nil
+	}
+
+	// Claims requested at authorization time are stored with the grant
+	claimsRequest, err := ParseClaimsRequest(token.Claims)
+	if err != nil {
+		return "", err
+	}
+
+	return GenerateIDToken(application, user, token.Nonce, token.Amr, token.AccessToken, claimsRequest)
+}
+
 // GetAuthorizationCodeToken handles authorization code flow
 func GetAuthorizationCodeToken(application *models.Application, clientSecret, code, verifier, resource string) (*models.Token, *TokenError, error) {
 	if code == "" {
@@ -298,14 +357,11 @@ func GetAuthorizationCodeToken(application *models.Application, clientSecret, co
 	}
 
 	if token.CodeIsUsed {
-		return nil, &TokenError{
-			Error:            InvalidGrant,
-			ErrorDescription: "authorization code has been used",
-		}, nil
+		return nil, replayedAuthorizationCode(token), nil
 	}
 
 	// OAuth 2.1: Public clients (no secret) MUST use PKCE
-	isPublicClient := application.ClientSecret == "" || clientSecret == ""
+	isPublicClient := clientSecret == ""
 	if isPublicClient && token.CodeChallenge == "" {
 		return nil, &TokenError{
 			Error:            InvalidRequest,
@@ -340,13 +396,12 @@ func GetAuthorizationCodeToken(application *models.Application, clientSecret, co
 	}
 
 	// Verify client secret (can be empty if PKCE is used)
-	if application.ClientSecret != clientSecret {
-		if token.CodeChallenge == "" {
-			return nil, &TokenError{
-				Error:            InvalidClient,
-				ErrorDescription: "client_secret is invalid",
-			}, nil
-		} else if clientSecret != "" {
+	if !isPublicClient {
+		valid, err := models.VerifyClientSecret(application, clientSecret)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !valid {
 			return nil, &TokenError{
 				Error:            InvalidClient,
 				ErrorDescription: "client_secret is invalid",
@@ -379,41 +434,178 @@ func GetAuthorizationCodeToken(application *models.Application, clientSecret, co
 		}, nil
 	}
 
+	// Redeem the code with a single compare-and-set so only one concurrent request can win
+	redeemed, err := models.RedeemTokenCode(token.Code)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !redeemed {
+		return nil, replayedAuthorizationCode(token), nil
+	}
+	token.CodeIsUsed = true
+
+	tokenError, err := issueAuthorizationCodeTokens(application, token)
+	if err != nil || tokenError != nil {
+		return nil, tokenError, err
+	}
+
 	return token, nil, nil
 }
 
-// GetPasswordToken handles password grant flow
+// issueAuthorizationCodeTokens mints the tokens of a redeemed authorization code and stores their hashes
+func issueAuthorizationCodeTokens(application *models.Application, token *models.Token) (*TokenError, error) {
+	userId, err := strconv.ParseInt(token.User, 10, 64)
+	if err != nil {
+		return &TokenError{
+			Error:            InvalidGrant,
+			ErrorDescription: "invalid user ID in token",
+		}, nil
+	}
+
+	user, err := models.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.IsForbidden {
+		return &TokenError{
+			Error:            InvalidGrant,
+			ErrorDescription: "the user is forbidden to sign in",
+		}, nil
+	}
+
+	accessToken, refreshToken, _, err := GenerateJwtToken(application, user, token.Scope, token.Nonce, token.Resource, token.Amr)
+	if err != nil {
+		return &TokenError{
+			Error:            EndpointError,
+			ErrorDescription: fmt.Sprintf("generate jwt token error: %s", err.Error()),
+		}, nil
+	}
+
+	// Calculate expiration timestamps
+	now := time.Now()
+	token.AccessToken = accessToken
+	token.RefreshToken = refreshToken
+	token.Jti = jwtId(accessToken)
+	token.ExpiresAt = now.Add(time.Duration(application.ExpireInHours) * time.Hour).Unix()
+	if refreshToken != "" {
+		token.RefreshAbsoluteExpiresAt = refreshAbsoluteExpiry(application, now)
+		token.RefreshExpiresAt = refreshExpiry(application, now, token.RefreshAbsoluteExpiresAt)
+	}
+
+	if _, err = models.SetTokenCredentials(token); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// replayedAuthorizationCode revokes every token issued from a code that is presented again (RFC 6749 §4.1.2)
+func replayedAuthorizationCode(token *models.Token) *TokenError {
+	if err := models.RevokeTokenFamily(token.TokenFamily); err != nil {
+		return &TokenError{
+			Error:            EndpointError,
+			ErrorDescription: fmt.Sprintf("revoke tokens error: %s", err.Error()),
+		}
+	}
+
+	return &TokenError{
+		Error:            InvalidGrant,
+		ErrorDescription: "authorization code has been used",
+	}
+}
+
+// InvalidCredentialsDescription is the password grant error for a wrong password and an unknown
+// user alike, which the token endpoint counts towards the account lockout
+const InvalidCredentialsDescription = "invalid username or password"
+
+// GetPasswordToken handles password grant flow. The username is resolved like the login field of
+// the console, using the identifier types the application's organization accepts, and directory
+// users are authenticated against LDAP.
 func GetPasswordToken(application *models.Application, username, password, scope string) (*models.Token, *TokenError, error) {
-	user, err := models.GetUserByFields(application.Organization, username)
+	user, err := FindLoginUser(application.Organization, username)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	// Users linked to an LDAP directory are checked against it like console sign-ins. Logins unknown
+	// locally are looked up in the directories only for the organization they are provisioned into.
+	handled := false
+	if user != nil || application.Organization == consoleOrganization {
+		var ldapUser *models.User
+		ldapUser, handled, err = loginLdapUser(username, password, user)
+		if err == ErrInvalidCredentials {
+			return nil, &TokenError{
+				Error:            InvalidGrant,
+				ErrorDescription: InvalidCredentialsDescription,
+			}, nil
+		}
+		if err != nil {
+			return nil, &TokenError{
+				Error:            InvalidGrant,
+				ErrorDescription: err.Error(),
+			}, nil
+		}
+		if handled {
+			user = ldapUser
+		}
+	}
+
 	if user == nil {
+		verifyDummyPassword(password)
 		return nil, &TokenError{
 			Error:            InvalidGrant,
-			ErrorDescription: "invalid username or password",
+			ErrorDescription: InvalidCredentialsDescription,
 		}, nil
 	}
 
-	// Verify password (using bcrypt)
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
-	if err != nil {
+	if !handled {
+		// Verify password with the stored algorithm, upgrading the hash if needed
+		valid, err := VerifyUserPassword(user, password)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !valid {
+			return nil, &TokenError{
+				Error:            InvalidGrant,
+				ErrorDescription: InvalidCredentialsDescription,
+			}, nil
+		}
+	}
+
+	if user.IsForbidden {
 		return nil, &TokenError{
 			Error:            InvalidGrant,
-			ErrorDescription: "invalid username or password",
+			ErrorDescription: "the user is forbidden to sign in",
 		}, nil
 	}
 
-	if user.IsForbidden {
+	// Directory passwords expire in the directory, not by the local policy
+	if !handled {
+		expired, err := IsPasswordExpired(user)
+		if err != nil {
+			return nil, nil, err
+		}
+		if expired {
+			return nil, &TokenError{
+				Error:            InvalidGrant,
+				ErrorDescription: "the password has expired and must be reset",
+			}, nil
+		}
+	}
+
+	// The password grant has no step for a second factor
+	methods, err := SecondFactorMethods(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(methods) > 0 {
 		return nil, &TokenError{
 			Error:            InvalidGrant,
-			ErrorDescription: "the user is forbidden to sign in",
+			ErrorDescription: "multi-factor authentication is required for this user",
 		}, nil
 	}
 
 	// Generate JWT tokens
-	accessToken, refreshToken, tokenName, err := GenerateJwtToken(application, user, scope, "", "")
+	accessToken, refreshToken, tokenName, err := GenerateJwtToken(application, user, scope, "", "", []string{AmrPassword})
 	if err != nil {
 		return nil, &TokenError{
 			Error:            EndpointError,
@@ -427,25 +619,32 @@ func GetPasswordToken(application *models.Application, username, password, scope
 	// Calculate expiration timestamps
 	now := time.Now()
 	accessExpiresAt := now.Add(time.Duration(application.ExpireInHours) * time.Hour).Unix()
-	refreshExpiresAt := now.Add(time.Duration(application.RefreshExpireInHours) * time.Hour).Unix()
+	refreshAbsoluteExpiresAt, refreshExpiresAt := int64(0), int64(0)
+	if refreshToken != "" {
+		refreshAbsoluteExpiresAt = refreshAbsoluteExpiry(application, now)
+		refreshExpiresAt = refreshExpiry(application, now, refreshAbsoluteExpiresAt)
+	}
 
 	token := &models.Token{
-		Owner:            application.Owner,
-		Name:             tokenName,
-		CreatedTime:      models.GetCurrentTime(),
-		Application:      application.Name,
-		Organization:     user.Owner,
-		User:             fmt.Sprintf("%d", user.Id),
-		Code:             models.GenerateRandomString(32),
-		AccessToken:      accessToken,
-		RefreshToken:     refreshToken,
-		ExpiresIn:        int(application.ExpireInHours * 3600),
-		ExpiresAt:        accessExpiresAt,
-		RefreshExpiresAt: refreshExpiresAt,
-		Scope:            scope,
-		TokenType:        "Bearer",
-		CodeIsUsed:       true,
-		TokenFamily:      tokenFamily,
+		Owner:                    application.Owner,
+		Name:                     tokenName,
+		CreatedTime:              models.GetCurrentTime(),
+		Application:              application.Name,
+		Organization:             user.Owner,
+		User:                     fmt.Sprintf("%d", user.Id),
+		Code:                     models.GenerateRandomString(32),
+		AccessToken:              accessToken,
+		RefreshToken:             refreshToken,
+		Jti:                      jwtId(accessToken),
+		ExpiresIn:                int(application.ExpireInHours * 3600),
+		ExpiresAt:                accessExpiresAt,
+		RefreshExpiresAt:         refreshExpiresAt,
+		RefreshAbsoluteExpiresAt: refreshAbsoluteExpiresAt,
+		Scope:                    scope,
+		TokenType:                "Bearer",
+		CodeIsUsed:               true,
+		Amr:                      []string{AmrPassword},
+		TokenFamily:              tokenFamily,
 	}
 
 	_, err = models.AddToken(token)
@@ -456,9 +655,25 @@ func GetPasswordToken(application *models.Application, username, password, scope
 	return token, nil, nil
 }
 
+// AuthenticateClient checks the client_id and client_secret of a confidential client
+func AuthenticateClient(clientId, clientSecret string) (bool, error) {
+	if clientId == "" || clientSecret == "" {
+		return false, nil
+	}
+	application, err := models.GetApplicationByClientId(clientId)
+	if err != nil || application == nil {
+		return false, err
+	}
+	return models.VerifyClientSecret(application, clientSecret)
+}
+
 // GetClientCredentialsToken handles client credentials flow
 func GetClientCredentialsToken(application *models.Application, clientSecret, scope string) (*models.Token, *TokenError, error) {
-	if application.ClientSecret != clientSecret {
+	valid, err := models.VerifyClientSecret(application, clientSecret)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !valid {
 		return nil, &TokenError{
 			Error:            InvalidClient,
 			ErrorDescription: "client_secret is invalid",
@@ -472,7 +687,7 @@ func GetClientCredentialsToken(application *models.Application, clientSecret, sc
 		Type:  "application",
 	}
 
-	accessToken, _, tokenName, err := GenerateJwtToken(application, nullUser, scope, "", "")
+	accessToken, _, tokenName, err := GenerateJwtToken(application, nullUser, scope, "", "", nil)
 	if err != nil {
 		return nil, &TokenError{
 			Error:            EndpointError,
@@ -493,6 +708,7 @@ func GetClientCredentialsToken(application *models.Application, clientSecret, sc
 		User:         "0", // Service account
 		Code:         models.GenerateRandomString(32),
 		AccessToken:  accessToken,
+		Jti:          jwtId(accessToken),
 		ExpiresIn:    int(application.ExpireInHours * 3600),
 		ExpiresAt:    accessExpiresAt,
 		Scope:        scope,
@@ -522,13 +738,26 @@ func RefreshToken(refreshToken, scope, clientId, clientSecret string) (interface
 		}, nil
 	}
 
-	if clientSecret != "" && application.ClientSecret != clientSecret {
+	if application.IsPending() {
 		return &TokenError{
 			Error:            InvalidClient,
-			ErrorDescription: "client_secret is invalid",
+			ErrorDescription: "client registration is pending approval",
 		}, nil
 	}
 
+	if clientSecret != "" {
+		valid, err := models.VerifyClientSecret(application, clientSecret)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			return &TokenError{
+				Error:            InvalidClient,
+				ErrorDescription: "client_secret is invalid",
+			}, nil
+		}
+	}
+
 	// Get token by refresh token
 	token, err := models.GetTokenByRefreshToken(refreshToken)
 	if err != nil || token == nil {
@@ -556,14 +785,7 @@ func RefreshToken(refreshToken, scope, clientId, clientSecret string) (interface
 
 	// OAuth 2.1: Detect refresh token reuse
 	if token.RefreshTokenUsed {
-		// Token reuse detected! Revoke entire token family
-		if token.TokenFamily != "" {
-			models.RevokeTokenFamily(token.TokenFamily)
-		}
-		return &TokenError{
-			Error:            InvalidGrant,
-			ErrorDescription: "refresh token reuse detected - all tokens revoked",
-		}, nil
+		return reusedRefreshToken(application, token)
 	}
 
 	// Get user by ID from token
@@ -599,15 +821,8 @@ func RefreshToken(refreshToken, scope, clientId, clientSecret string) (interface
 		scope = token.Scope
 	}
 
-	// Mark old token as used (before generating new one)
-	token.RefreshTokenUsed = true
-	_, err = models.UpdateToken(token.Owner, token.Name, token)
-	if err != nil {
-		return nil, err
-	}
-
 	// Generate new tokens
-	newAccessToken, newRefreshToken, tokenName, err := GenerateJwtToken(application, user, scope, "", "")
+	newAccessToken, newRefreshToken, tokenName, err := GenerateJwtToken(application, user, scope, "", "", token.Amr)
 	if err != nil {
 		return &TokenError{
 			Error:            EndpointError,
@@ -616,43 +831,130 @@ func RefreshToken(refreshToken, scope, clientId, clientSecret string) (interface
 	}
 
 	// Calculate expiration timestamps
+	// The sliding expiry never extends past the absolute expiry of the token family
 	now := time.Now()
 	accessExpiresAt := now.Add(time.Duration(application.ExpireInHours) * time.Hour).Unix()
-	refreshExpiresAt := now.Add(time.Duration(application.RefreshExpireInHours) * time.Hour).Unix()
+	refreshExpiresAt := int64(0)
+	if newRefreshToken != "" {
+		refreshExpiresAt = refreshExpiry(application, now, token.RefreshAbsoluteExpiresAt)
+	}
 
 	newToken := &models.Token{
-		Owner:            application.Owner,
-		Name:             tokenName,
-		CreatedTime:      models.GetCurrentTime(),
-		Application:      application.Name,
-		Organization:     user.Owner,
-		User:             fmt.Sprintf("%d", user.Id),
-		Code:             models.GenerateRandomString(32),
-		AccessToken:      newAccessToken,
-		RefreshToken:     newRefreshToken,
-		ExpiresIn:        int(application.ExpireInHours * 3600),
-		ExpiresAt:        accessExpiresAt,
-		RefreshExpiresAt: refreshExpiresAt,
-		Scope:            scope,
-		TokenType:        "Bearer",
-		TokenFamily:      token.TokenFamily, // Preserve token family
+		Owner:                    application.Owner,
+		Name:                     tokenName,
+		CreatedTime:              models.GetCurrentTime(),
+		Application:              application.Name,
+		Organization:             user.Owner,
+		User:                     fmt.Sprintf("%d", user.Id),
+		Code:                     models.GenerateRandomString(32),
+		AccessToken:              newAccessToken,
+		RefreshToken:             newRefreshToken,
+		Jti:                      jwtId(newAccessToken),
+		ExpiresIn:                int(application.ExpireInHours * 3600),
+		ExpiresAt:                accessExpiresAt,
+		RefreshExpiresAt:         refreshExpiresAt,
+		RefreshAbsoluteExpiresAt: token.RefreshAbsoluteExpiresAt,
+		Scope:                    scope,
+		TokenType:                "Bearer",
+		Claims:                   token.Claims,
+		Amr:                      token.Amr,         // Refreshing is not a new authentication
+		TokenFamily:              token.TokenFamily, // Preserve token family
+		Session:                  token.Session,
+	}
+
+	// The response is cached before the rotation is decided, so a concurrent request that loses
+	// the race already finds the winner's successor
+	response, err := refreshTokenResponse(application, newToken)
+	if err != nil {
+		return nil, err
+	}
+	tokenResponse, ok := response.(*TokenResponse)
+	if !ok {
+		return response, nil
 	}
+	cacheRefreshSuccessor(application, token.RefreshTokenHash, newToken.Name, tokenResponse)
 
+	// Store the successor first, then mark the old token as rotated with a single
+	// conditional update so concurrent requests cannot both rotate it
 	_, err = models.AddToken(newToken)
 	if err != nil {
 		return nil, err
 	}
 
+	rotated, err := models.MarkRefreshTokenUsed(token.Owner, token.Name, newToken.Name, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	if !rotated {
+		// Another request won the race: drop our successor and treat this as a reuse
+		if _, err = models.DeleteToken(newToken.Owner, newToken.Name); err != nil {
+			return nil, err
+		}
+		token, err = models.GetToken(token.Owner, token.Name)
+		if err != nil {
+			return nil, err
+		}
+		if token == nil {
+			return &TokenError{
+				Error:            InvalidGrant,
+				ErrorDescription: "refresh token is invalid or revoked",
+			}, nil
+		}
+		return reusedRefreshToken(application, token)
+	}
+
 	// Clear old token from cache
 	DeleteCachedToken(token.AccessTokenHash)
+	return response, nil
+}
+
+// reusedRefreshToken handles a refresh token that was already rotated.
+// Inside the grace window the same successor is returned; otherwise the family is revoked.
+func reusedRefreshToken(application *models.Application, token *models.Token) (interface{}, error) {
+	if isWithinReuseGrace(application, token, time.Now()) {
+		successor, err := models.GetToken(token.Owner, token.RefreshedTo)
+		if err != nil {
+			return nil, err
+		}
+		if successor != nil && !successor.IsRevoked() {
+			if response := getRefreshSuccessor(token.RefreshTokenHash, token.RefreshedTo); response != nil {
+				return response, nil
+			}
+			// The successor response is no longer available; reject without treating it as theft
+			return &TokenError{
+				Error:            InvalidGrant,
+				ErrorDescription: "refresh token has already been rotated",
+			}, nil
+		}
+	}
+
+	// Token reuse detected! Revoke entire token family
+	if token.TokenFamily != "" {
+		models.RevokeTokenFamily(token.TokenFamily)
+	}
+	return &TokenError{
+		Error:            InvalidGrant,
+		ErrorDescription: "refresh token reuse detected - all tokens revoked",
+	}, nil
+}
+
+// refreshTokenResponse builds the token response for a refreshed token
+func refreshTokenResponse(application *models.Application, token *models.Token) (interface{}, error) {
+	idToken, err := getIdToken(application, token)
+	if err != nil {
+		return &TokenError{
+			Error:            EndpointError,
+			ErrorDescription: fmt.Sprintf("generate id token error: %s", err.Error()),
+		}, nil
+	}
 
 	return &TokenResponse{
-		AccessToken:  newToken.AccessToken,
-		TokenType:    newToken.TokenType,
-		ExpiresIn:    newToken.ExpiresIn,
-		RefreshToken: newToken.RefreshToken,
-		Scope:        newToken.Scope,
-		IdToken:      newToken.AccessToken,
+		AccessToken:  token.AccessToken,
+		TokenType:    token.TokenType,
+		ExpiresIn:    token.ExpiresIn,
+		RefreshToken: token.RefreshToken,
+		Scope:        token.Scope,
+		IdToken:      idToken,
 	}, nil
 }
 
@@ -688,34 +990,30 @@ func ValidateScope(requestedScope, existingScope string) (bool, string) {
 	return true, requestedScope
 }
 
-// verifyPassword verifies a password against its hash and salt
-func verifyPassword(hashedPassword, plainPassword, salt string) bool {
-	if plainPassword == "" {
-		return false
-	}
-
-	// If no hash exists, reject (security: don't allow empty passwords)
-	if hashedPassword == "" {
-		return false
+// hasScope checks whether a space-delimited scope string contains the given scope
+func hasScope(scopes, scope string) bool {
+	for _, s := range strings.Split(scopes, " ") {
+		if s == scope {
+			return true
+		}
 	}
+	return false
+}
 
-	// For bcrypt hashes (starts with $2a$, $2b$, or $2y$)
-	if len(hashedPassword) >= 4 && hashedPassword[0] == '$' && hashedPassword[3] == '$' {
-		// This is a bcrypt hash - would need golang.org/x/crypto/bcrypt
-		// For now, do a simple comparison (TEMPORARY - should use bcrypt)
-		return hashedPassword == plainPassword
+// IsGrantTokenRevoked reports whether an access or refresh token is no longer stored or was
+// revoked, e.g. through token revocation or signing out the session it was issued through
+func IsGrantTokenRevoked(token string, tokenUse string) (bool, error) {
+	var dbToken *models.Token
+	var err error
+	if tokenUse == "refresh" {
+		dbToken, err = models.GetTokenByRefreshToken(token)
+	} else {
+		dbToken, err = models.GetTokenByAccessToken(token)
 	}
-
-	// For salted SHA256 (legacy support)
-	if salt != "" {
-		saltedPassword := plainPassword + salt
-		hash := sha256.Sum256([]byte(saltedPassword))
-		computed := fmt.Sprintf("%x", hash)
-		return computed == hashedPassword
+	if err != nil {
+		return false, err
 	}
-
-	// Direct comparison (INSECURE - only for testing)
-	return hashedPassword == plainPassword
+	return dbToken == nil || dbToken.IsRevoked(), nil
 }
 
 // RevokeToken revokes a token (access or refresh token)
@@ -4,66 +4,438 @@
 package services
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/oauth-server/oauth-server/models"
 )
 
-// CreateOidcClient 创建新的 OIDC 客户端应用
+// Client registration errors (RFC 7591 §3.2.2, RFC 6750 §3.1)
+const (
+	InvalidRedirectUri          = "invalid_redirect_uri"
+	InvalidClientMetadata       = "invalid_client_metadata"
+	InvalidSoftwareStatement    = "invalid_software_statement"
+	UnapprovedSoftwareStatement = "unapproved_software_statement"
+	InvalidToken                = "invalid_token"
+	AccessDenied                = "access_denied"
+)
+
+// Dynamically registered clients are created in the built-in organization
+// unless an initial access token names another one
+const (
+	DcrApplicationOwner  = "built-in"
+	DcrOrganizationOwner = "admin"
+	DcrOrganizationName  = "built-in"
+)
+
+var (
+	SupportedDcrGrantTypes    = []string{"authorization_code", "refresh_token", "client_credentials"}
+	SupportedDcrResponseTypes = []string{"code", "token", "id_token", "code token", "code id_token", "token id_token", "code token id_token"}
+	SupportedDcrAuthMethods   = []string{"client_secret_basic", "client_secret_post", "none"}
+)
+
+// ClientMetadata 客户端元数据 (RFC 7591 §2, OpenID Connect Registration 1.0 §2)
+type ClientMetadata struct {
+	ClientId                string          `json:"client_id,omitempty"`
+	ClientSecret            string          `json:"client_secret,omitempty"`
+	ClientName              string          `json:"client_name"`
+	RedirectUris            []string        `json:"redirect_uris"`
+	GrantTypes              []string        `json:"grant_types"`
+	ResponseTypes           []string        `json:"response_types"`
+	Scope                   string          `json:"scope"`
+	TokenEndpointAuthMethod string          `json:"token_endpoint_auth_method"`
+	LogoUri                 string          `json:"logo_uri"`
+	ClientUri               string          `json:"client_uri"`
+	Contacts                []string        `json:"contacts"`
+	SoftwareId              string          `json:"software_id"`
+	SoftwareVersion         string          `json:"software_version"`
+	SoftwareStatement       string          `json:"software_statement"`
+	Jwks                    json.RawMessage `json:"jwks,omitempty"`
+	JwksUri                 string          `json:"jwks_uri"`
+
+	IdTokenSignedResponseAlg     string `json:"id_token_signed_response_alg"`
+	IdTokenEncryptedResponseAlg  string `json:"id_token_encrypted_response_alg"`
+	IdTokenEncryptedResponseEnc  string `json:"id_token_encrypted_response_enc"`
+	UserinfoSignedResponseAlg    string `json:"userinfo_signed_response_alg"`
+	UserinfoEncryptedResponseAlg string `json:"userinfo_encrypted_response_alg"`
+	UserinfoEncryptedResponseEnc string `json:"userinfo_encrypted_response_enc"`
+}
+
+// ClientRegistration is the result of a successful registration.
+// ClientSecret and RegistrationAccessToken are only available at this point.
+type ClientRegistration struct {
+	Application             *models.Application
+	ClientSecret            string
+	RegistrationAccessToken string
+}
+
+// applyDefaults fills in the RFC 7591 defaults for omitted metadata
+func (m *ClientMetadata) applyDefaults() {
+	if len(m.GrantTypes) == 0 {
+		m.GrantTypes = []string{"authorization_code"}
+	}
+	if len(m.ResponseTypes) == 0 {
+		m.ResponseTypes = []string{"code"}
+	}
+	if m.Scope == "" {
+		m.Scope = "openid profile email"
+	}
+	if m.TokenEndpointAuthMethod == "" {
+		m.TokenEndpointAuthMethod = "client_secret_basic"
+	}
+}
+
+// validate checks the metadata values this server is able to honour
+func (m *ClientMetadata) validate() *TokenError {
+	if m.ClientName == "" {
+		return &TokenError{Error: InvalidClientMetadata, ErrorDescription: "client_name is required"}
+	}
+
+	for _, grantType := range m.GrantTypes {
+		if !containsString(SupportedDcrGrantTypes, grantType) {
+			return &TokenError{Error: InvalidClientMetadata, ErrorDescription: fmt.Sprintf("unsupported grant_type: %s", grantType)}
+		}
+	}
+	for _, responseType := range m.ResponseTypes {
+		if !containsString(SupportedDcrResponseTypes, responseType) {
+			return &TokenError{Error: InvalidClientMetadata, ErrorDescription: fmt.Sprintf("unsupported response_type: %s", responseType)}
+		}
+	}
+	if !containsString(SupportedDcrAuthMethods, m.TokenEndpointAuthMethod) {
+		return &TokenError{Error: InvalidClientMetadata, ErrorDescription: fmt.Sprintf("unsupported token_endpoint_auth_method: %s", m.TokenEndpointAuthMethod)}
+	}
+	if m.TokenEndpointAuthMethod == "none" && containsString(m.GrantTypes, "client_credentials") {
+		return &TokenError{Error: InvalidClientMetadata, ErrorDescription: "client_credentials requires a confidential client"}
+	}
+
+	needsRedirect := containsString(m.GrantTypes, "authorization_code")
+	if needsRedirect && len(m.RedirectUris) == 0 {
+		return &TokenError{Error: InvalidRedirectUri, ErrorDescription: "redirect_uris is required"}
+	}
+	for _, redirectUri := range m.RedirectUris {
+		parsed, err := url.Parse(redirectUri)
+		if err != nil || !parsed.IsAbs() || parsed.Host == "" || parsed.Fragment != "" {
+			return &TokenError{Error: InvalidRedirectUri, ErrorDescription: fmt.Sprintf("invalid redirect_uri: %s", redirectUri)}
+		}
+	}
+
+	return nil
+}
+
+// applyTo copies the metadata onto an application
+func (m *ClientMetadata) applyTo(application *models.Application) {
+	application.DisplayName = m.ClientName
+	application.Logo = m.LogoUri
+	application.HomepageUrl = m.ClientUri
+	application.Description = fmt.Sprintf("OIDC client: %s", m.ClientName)
+	application.RedirectUris = m.RedirectUris
+	application.GrantTypes = m.GrantTypes
+	application.ResponseTypes = m.ResponseTypes
+	application.Scopes = strings.Split(m.Scope, " ")
+	application.TokenEndpointAuthMethod = m.TokenEndpointAuthMethod
+	application.Contacts = m.Contacts
+	application.SoftwareId = m.SoftwareId
+	application.SoftwareVersion = m.SoftwareVersion
+	application.Jwks = string(m.Jwks)
+	application.JwksUri = m.JwksUri
+	application.IdTokenSignedResponseAlg = m.IdTokenSignedResponseAlg
+	application.IdTokenEncryptedResponseAlg = m.IdTokenEncryptedResponseAlg
+	application.IdTokenEncryptedResponseEnc = m.IdTokenEncryptedResponseEnc
+	application.UserinfoSignedResponseAlg = m.UserinfoSignedResponseAlg
+	application.UserinfoEncryptedResponseAlg = m.UserinfoEncryptedResponseAlg
+	application.UserinfoEncryptedResponseEnc = m.UserinfoEncryptedResponseEnc
+}
+
+// prepareClientMetadata applies the software statement, defaults and validation
+func prepareClientMetadata(metadata *ClientMetadata, organization *models.Organization) *TokenError {
+	if metadata.SoftwareStatement != "" {
+		claims, tokenError := VerifySoftwareStatement(metadata.SoftwareStatement, organization)
+		if tokenError != nil {
+			return tokenError
+		}
+		// Values in the software statement take precedence (RFC 7591 §2.3)
+		if tokenError = applySoftwareStatement(metadata, claims); tokenError != nil {
+			return tokenError
+		}
+	} else if organization.DcrRequireSoftwareStatement {
+		return &TokenError{Error: InvalidSoftwareStatement, ErrorDescription: "software_statement is required"}
+	}
+
+	metadata.applyDefaults()
+	return metadata.validate()
+}
+
+// VerifySoftwareStatement verifies a software statement against the organization's trusted issuer keys
+func VerifySoftwareStatement(statement string, organization *models.Organization) (jwt.MapClaims, *TokenError) {
+	if organization.DcrSoftwareStatementJwks == "" {
+		return nil, &TokenError{Error: UnapprovedSoftwareStatement, ErrorDescription: "no software statement issuers are trusted"}
+	}
+
+	var keySet JsonWebKeySet
+	if err := json.Unmarshal([]byte(organization.DcrSoftwareStatementJwks), &keySet); err != nil {
+		return nil, &TokenError{Error: UnapprovedSoftwareStatement, ErrorDescription: "trusted issuer keys are misconfigured"}
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(statement, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		for _, key := range keySet.Keys {
+			if key.Kty != "RSA" || (kid != "" && key.Kid != kid) {
+				continue
+			}
+			return key.RSAPublicKey()
+		}
+		return nil, fmt.Errorf("no trusted key matches kid %q", kid)
+	}, jwt.WithValidMethods([]string{SigningAlgRS256}))
+	if err != nil {
+		return nil, &TokenError{Error: InvalidSoftwareStatement, ErrorDescription: err.Error()}
+	}
+
+	if issuer, _ := claims.GetIssuer(); issuer == "" {
+		return nil, &TokenError{Error: InvalidSoftwareStatement, ErrorDescription: "software statement must contain iss"}
+	}
+
+	return claims, nil
+}
+
+// applySoftwareStatement overrides request metadata with the statement claims
+func applySoftwareStatement(metadata *ClientMetadata, claims jwt.MapClaims) *TokenError {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return &TokenError{Error: InvalidSoftwareStatement, ErrorDescription: err.Error()}
+	}
+
+	statement := metadata.SoftwareStatement
+	clientId, clientSecret := metadata.ClientId, metadata.ClientSecret
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return &TokenError{Error: InvalidSoftwareStatement, ErrorDescription: fmt.Sprintf("invalid client metadata in software statement: %v", err)}
+	}
+	metadata.SoftwareStatement = statement
+	metadata.ClientId, metadata.ClientSecret = clientId, clientSecret
+	return nil
+}
+
+// RegisterOidcClient 根据组织的 DcrPolicy 注册新的 OIDC 客户端
 // Requirements: 7.4
-func CreateOidcClient(
-	clientName string,
-	redirectUris []string,
-	grantTypes []string,
-	responseTypes []string,
-	scope string,
-	tokenEndpointAuthMethod string,
-	logoUri string,
-) (string, string, error) {
-	// 生成 client_id 和 client_secret
-	clientId := models.GenerateClientId()
-	clientSecret := models.GenerateClientSecret()
-
-	// 确定是否为公开客户端（不需要 client_secret）
-	isPublicClient := tokenEndpointAuthMethod == "none"
-	if isPublicClient {
-		clientSecret = "" // 公开客户端不需要 secret
-	}
-
-	// 创建 Application 对象
+func RegisterOidcClient(metadata *ClientMetadata, initialAccessToken string) (*ClientRegistration, *TokenError, error) {
+	var iat *models.InitialAccessToken
+	organizationName := DcrOrganizationName
+	if initialAccessToken != "" {
+		var err error
+		iat, err = models.GetInitialAccessTokenByToken(initialAccessToken)
+		if err != nil {
+			return nil, nil, err
+		}
+		if iat == nil || !iat.IsUsable() {
+			return nil, &TokenError{Error: InvalidToken, ErrorDescription: "initial access token is invalid or expired"}, nil
+		}
+		organizationName = iat.Organization
+	}
+
+	organization, err := models.GetOrganization(DcrOrganizationOwner, organizationName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if organization == nil {
+		return nil, nil, fmt.Errorf("organization %s does not exist", organizationName)
+	}
+
+	registrationStatus := ""
+	switch organization.DcrPolicy {
+	case models.DcrPolicyClosed:
+		return nil, &TokenError{Error: AccessDenied, ErrorDescription: "client registration is disabled"}, nil
+	case models.DcrPolicyTokenRequired:
+		if iat == nil {
+			return nil, &TokenError{Error: InvalidToken, ErrorDescription: "an initial access token is required"}, nil
+		}
+	case models.DcrPolicyAdminApproval:
+		// An initial access token issued by an admin counts as prior approval
+		if iat == nil {
+			registrationStatus = models.RegistrationStatusPending
+		}
+	}
+
+	if tokenError := prepareClientMetadata(metadata, organization); tokenError != nil {
+		return nil, tokenError, nil
+	}
+
 	application := &models.Application{
-		Owner:                "built-in",
-		Name:                 fmt.Sprintf("oidc-%s", clientId),
+		Owner:                DcrApplicationOwner,
 		CreatedTime:          models.GetCurrentTime(),
-		DisplayName:          clientName,
-		Logo:                 logoUri,
-		HomepageUrl:          "",
-		Description:          fmt.Sprintf("OIDC client: %s", clientName),
-		Organization:         "built-in",
-		ClientId:             clientId,
-		ClientSecret:         clientSecret,
-		RedirectUris:         redirectUris,
+		Organization:         organization.Name,
+		ClientId:             models.GenerateClientId(),
 		TokenFormat:          "JWT",
 		ExpireInHours:        1,
 		RefreshExpireInHours: 168, // 7 days
-		GrantTypes:           grantTypes,
 		Tags:                 []string{"oidc"},
 		EnablePassword:       true,
-		EnableSignUp:         false,
-		EnableCodeSignin:     false,
-		Cert:                 "",
-		Scopes:               strings.Split(scope, " "),
+		RegistrationStatus:   registrationStatus,
+	}
+	application.Name = fmt.Sprintf("oidc-%s", application.ClientId)
+	metadata.applyTo(application)
+
+	if err := ValidateApplicationJoseSettings(application); err != nil {
+		return nil, &TokenError{Error: InvalidClientMetadata, ErrorDescription: err.Error()}, nil
 	}
 
-	// 保存到数据库
-	_, err := models.AddApplication(application)
+	// 公开客户端不需要 client_secret
+	registration := &ClientRegistration{Application: application}
+	if application.TokenEndpointAuthMethod != "none" {
+		registration.ClientSecret = models.GenerateClientSecret()
+	}
+	application.ClientSecret = registration.ClientSecret
+	registration.RegistrationAccessToken = models.GenerateClientSecret()
+	application.SetRegistrationAccessToken(registration.RegistrationAccessToken)
+
+	if _, err := models.AddApplication(application); err != nil {
+		return nil, nil, fmt.Errorf("failed to create application: %w", err)
+	}
+
+	// The initial access token is only spent once the client exists, a failed insert must not burn it.
+	// If another registration used up the token in the meantime, the new client is removed again.
+	if iat != nil {
+		consumed, err := models.ConsumeInitialAccessToken(iat)
+		if err != nil || !consumed {
+			if _, deleteErr := models.DeleteApplication(application.Owner, application.Name); deleteErr != nil {
+				log.Printf("[OIDC] Failed to remove client %s after rejecting its initial access token: %v", application.ClientId, deleteErr)
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if !consumed {
+			return nil, &TokenError{Error: InvalidToken, ErrorDescription: "initial access token is invalid or expired"}, nil
+		}
+	}
+
+	return registration, nil, nil
+}
+
+// GetRegisteredClient authenticates a client configuration request (RFC 7592 §2)
+func GetRegisteredClient(clientId, registrationAccessToken string) (*models.Application, *TokenError, error) {
+	application, err := models.GetApplicationByClientId(clientId)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create application: %w", err)
+		return nil, nil, err
+	}
+
+	// Unknown clients and bad tokens are indistinguishable to the caller
+	if application == nil || !application.CheckRegistrationAccessToken(registrationAccessToken) {
+		return nil, &TokenError{Error: InvalidToken, ErrorDescription: "registration access token is invalid"}, nil
+	}
+
+	return application, nil, nil
+}
+
+// UpdateRegisteredClient replaces the client metadata (RFC 7592 §2.2)
+func UpdateRegisteredClient(application *models.Application, metadata *ClientMetadata) (*TokenError, error) {
+	if metadata.ClientId != application.ClientId {
+		return &TokenError{Error: InvalidClientMetadata, ErrorDescription: "client_id does not match"}, nil
+	}
+	if metadata.ClientSecret != "" {
+		valid, err := models.VerifyClientSecret(application, metadata.ClientSecret)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			return &TokenError{Error: InvalidClientMetadata, ErrorDescription: "client_secret does not match"}, nil
+		}
+	}
+
+	organization, err := models.GetOrganization(DcrOrganizationOwner, application.Organization)
+	if err != nil {
+		return nil, err
+	}
+	if organization == nil {
+		return nil, fmt.Errorf("organization %s does not exist", application.Organization)
+	}
+
+	if tokenError := prepareClientMetadata(metadata, organization); tokenError != nil {
+		return tokenError, nil
+	}
+	if (metadata.TokenEndpointAuthMethod == "none") != (application.TokenEndpointAuthMethod == "none") {
+		return &TokenError{Error: InvalidClientMetadata, ErrorDescription: "token_endpoint_auth_method cannot switch between public and confidential"}, nil
+	}
+
+	updated := *application
+	metadata.applyTo(&updated)
+	if err := ValidateApplicationJoseSettings(&updated); err != nil {
+		return &TokenError{Error: InvalidClientMetadata, ErrorDescription: err.Error()}, nil
+	}
+
+	if _, err := models.UpdateApplication(application.Owner, application.Name, &updated); err != nil {
+		return nil, err
+	}
+	*application = updated
+	return nil, nil
+}
+
+// DeleteRegisteredClient deprovisions a client and revokes its tokens (RFC 7592 §2.3)
+func DeleteRegisteredClient(application *models.Application) error {
+	if err := models.RevokeApplicationTokens(application.Name); err != nil {
+		return err
+	}
+	_, err := models.DeleteApplication(application.Owner, application.Name)
+	return err
+}
+
+// ClientInformationResponse builds the client information response (RFC 7591 §3.2.1, RFC 7592 §3)
+func ClientInformationResponse(application *models.Application, clientSecret, registrationAccessToken, registrationClientUri string) map[string]interface{} {
+	response := map[string]interface{}{
+		"client_id":                  application.ClientId,
+		"client_name":                application.DisplayName,
+		"redirect_uris":              application.RedirectUris,
+		"grant_types":                application.GrantTypes,
+		"response_types":             application.ResponseTypes,
+		"scope":                      strings.Join(application.Scopes, " "),
+		"token_endpoint_auth_method": application.TokenEndpointAuthMethod,
+		"registration_client_uri":    registrationClientUri,
+	}
+
+	if createdTime, err := time.Parse(time.RFC3339, application.CreatedTime); err == nil {
+		response["client_id_issued_at"] = createdTime.Unix()
+	}
+	if clientSecret != "" && application.TokenEndpointAuthMethod != "none" {
+		response["client_secret"] = clientSecret
+		response["client_secret_expires_at"] = 0 // 不过期
+	}
+	if registrationAccessToken != "" {
+		response["registration_access_token"] = registrationAccessToken
+	}
+
+	optional := map[string]string{
+		"logo_uri":                        application.Logo,
+		"client_uri":                      application.HomepageUrl,
+		"software_id":                     application.SoftwareId,
+		"software_version":                application.SoftwareVersion,
+		"jwks_uri":                        application.JwksUri,
+		"id_token_signed_response_alg":    application.IdTokenSignedResponseAlg,
+		"id_token_encrypted_response_alg": application.IdTokenEncryptedResponseAlg,
+		"id_token_encrypted_response_enc": application.IdTokenEncryptedResponseEnc,
+		"userinfo_signed_response_alg":    application.UserinfoSignedResponseAlg,
+		"userinfo_encrypted_response_alg": application.UserinfoEncryptedResponseAlg,
+		"userinfo_encrypted_response_enc": application.UserinfoEncryptedResponseEnc,
+	}
+	for key, value := range optional {
+		if value != "" {
+			response[key] = value
+		}
+	}
+	if application.Jwks != "" {
+		response["jwks"] = json.RawMessage(application.Jwks)
+	}
+	if len(application.Contacts) > 0 {
+		response["contacts"] = application.Contacts
+	}
+	if application.IsPending() {
+		response["registration_status"] = application.RegistrationStatus
 	}
 
-	return clientId, clientSecret, nil
+	return response
 }
 
 // GetCurrentTimestamp 返回当前时间戳（秒）
@@ -0,0 +1,193 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// testSoftwareStatement signs software statement claims with the given key
+func testSoftwareStatement(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign software statement: %v", err)
+	}
+	return signed
+}
+
+// TestClientMetadataValidate tests registration metadata validation
+func TestClientMetadataValidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		metadata      ClientMetadata
+		expectedError string
+	}{
+		{
+			name:          "Valid defaults",
+			metadata:      ClientMetadata{ClientName: "app", RedirectUris: []string{"https://app.example.com/cb"}},
+			expectedError: "",
+		},
+		{
+			name:          "Missing client_name",
+			metadata:      ClientMetadata{RedirectUris: []string{"https://app.example.com/cb"}},
+			expectedError: InvalidClientMetadata,
+		},
+		{
+			name:          "Missing redirect_uris for authorization_code",
+			metadata:      ClientMetadata{ClientName: "app"},
+			expectedError: InvalidRedirectUri,
+		},
+		{
+			name:          "Relative redirect_uri",
+			metadata:      ClientMetadata{ClientName: "app", RedirectUris: []string{"/cb"}},
+			expectedError: InvalidRedirectUri,
+		},
+		{
+			name:          "Redirect_uri with fragment",
+			metadata:      ClientMetadata{ClientName: "app", RedirectUris: []string{"https://app.example.com/cb#x"}},
+			expectedError: InvalidRedirectUri,
+		},
+		{
+			name:          "Password grant is not registrable",
+			metadata:      ClientMetadata{ClientName: "app", RedirectUris: []string{"https://app.example.com/cb"}, GrantTypes: []string{"password"}},
+			expectedError: InvalidClientMetadata,
+		},
+		{
+			name:          "Client credentials without redirect_uris",
+			metadata:      ClientMetadata{ClientName: "svc", GrantTypes: []string{"client_credentials"}},
+			expectedError: "",
+		},
+		{
+			name:          "Public client with client_credentials",
+			metadata:      ClientMetadata{ClientName: "svc", GrantTypes: []string{"client_credentials"}, TokenEndpointAuthMethod: "none"},
+			expectedError: InvalidClientMetadata,
+		},
+		{
+			name:          "Unsupported auth method",
+			metadata:      ClientMetadata{ClientName: "app", RedirectUris: []string{"https://app.example.com/cb"}, TokenEndpointAuthMethod: "private_key_jwt"},
+			expectedError: InvalidClientMetadata,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.metadata.applyDefaults()
+			tokenError := tt.metadata.validate()
+			if tt.expectedError == "" {
+				if tokenError != nil {
+					t.Errorf("Expected no error, got %v", tokenError)
+				}
+				return
+			}
+			if tokenError == nil || tokenError.Error != tt.expectedError {
+				t.Errorf("Expected %s, got %v", tt.expectedError, tokenError)
+			}
+		})
+	}
+}
+
+// TestPrepareClientMetadataSoftwareStatement tests software statement verification and precedence
+func TestPrepareClientMetadataSoftwareStatement(t *testing.T) {
+	issuerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	jwksJson, _ := json.Marshal(JsonWebKeySet{Keys: []JsonWebKey{testJwkFromKey(issuerKey, "issuer")}})
+
+	organization := &models.Organization{DcrSoftwareStatementJwks: string(jwksJson)}
+	statementClaims := jwt.MapClaims{
+		"iss":           "https://software.example.com",
+		"software_id":   "4NRB1-0XZABZI9E6-5SM3R",
+		"client_name":   "Statement Name",
+		"redirect_uris": []string{"https://statement.example.com/cb"},
+	}
+
+	t.Run("Statement overrides request metadata", func(t *testing.T) {
+		metadata := &ClientMetadata{
+			ClientName:        "Request Name",
+			RedirectUris:      []string{"https://request.example.com/cb"},
+			Scope:             "openid",
+			SoftwareStatement: testSoftwareStatement(t, issuerKey, "issuer", statementClaims),
+		}
+		if tokenError := prepareClientMetadata(metadata, organization); tokenError != nil {
+			t.Fatalf("Expected no error, got %v", tokenError)
+		}
+		if metadata.ClientName != "Statement Name" || metadata.RedirectUris[0] != "https://statement.example.com/cb" {
+			t.Errorf("Statement values did not take precedence: %+v", metadata)
+		}
+		if metadata.SoftwareId != "4NRB1-0XZABZI9E6-5SM3R" || metadata.Scope != "openid" {
+			t.Errorf("Unexpected merged metadata: %+v", metadata)
+		}
+	})
+
+	t.Run("Untrusted signer", func(t *testing.T) {
+		metadata := &ClientMetadata{SoftwareStatement: testSoftwareStatement(t, otherKey, "issuer", statementClaims)}
+		tokenError := prepareClientMetadata(metadata, organization)
+		if tokenError == nil || tokenError.Error != InvalidSoftwareStatement {
+			t.Errorf("Expected %s, got %v", InvalidSoftwareStatement, tokenError)
+		}
+	})
+
+	t.Run("No trusted issuers", func(t *testing.T) {
+		metadata := &ClientMetadata{SoftwareStatement: testSoftwareStatement(t, issuerKey, "issuer", statementClaims)}
+		tokenError := prepareClientMetadata(metadata, &models.Organization{})
+		if tokenError == nil || tokenError.Error != UnapprovedSoftwareStatement {
+			t.Errorf("Expected %s, got %v", UnapprovedSoftwareStatement, tokenError)
+		}
+	})
+
+	t.Run("Statement required", func(t *testing.T) {
+		required := &models.Organization{DcrSoftwareStatementJwks: string(jwksJson), DcrRequireSoftwareStatement: true}
+		metadata := &ClientMetadata{ClientName: "app", RedirectUris: []string{"https://app.example.com/cb"}}
+		tokenError := prepareClientMetadata(metadata, required)
+		if tokenError == nil || tokenError.Error != InvalidSoftwareStatement {
+			t.Errorf("Expected %s, got %v", InvalidSoftwareStatement, tokenError)
+		}
+	})
+}
+
+// TestClientInformationResponse tests the registration response fields
+func TestClientInformationResponse(t *testing.T) {
+	application := &models.Application{
+		ClientId:                "client",
+		DisplayName:             "app",
+		CreatedTime:             "2024-01-01T00:00:00Z",
+		Scopes:                  []string{"openid", "profile"},
+		TokenEndpointAuthMethod: "none",
+		RegistrationStatus:      models.RegistrationStatusPending,
+	}
+	application.SetRegistrationAccessToken("rat")
+
+	response := ClientInformationResponse(application, "secret", "rat", "https://sso.example.com/api/oauth/register/client")
+	if _, ok := response["client_secret"]; ok {
+		t.Errorf("Public clients must not receive a client_secret")
+	}
+	if response["registration_access_token"] != "rat" || response["registration_client_uri"] != "https://sso.example.com/api/oauth/register/client" {
+		t.Errorf("Missing RFC 7592 fields: %v", response)
+	}
+	if response["scope"] != "openid profile" || response["client_id_issued_at"] != int64(1704067200) {
+		t.Errorf("Unexpected response: %v", response)
+	}
+	if response["registration_status"] != models.RegistrationStatusPending {
+		t.Errorf("Expected pending registration status, got %v", response["registration_status"])
+	}
+
+	if !application.CheckRegistrationAccessToken("rat") || application.CheckRegistrationAccessToken("other") {
+		t.Errorf("Registration access token check failed")
+	}
+}
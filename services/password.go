@@ -0,0 +1,372 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Password hashing algorithms, stored in Organization.PasswordType and User.PasswordType
+const (
+	PasswordTypeBcrypt   = "bcrypt"
+	PasswordTypeArgon2id = "argon2id"
+	PasswordTypePbkdf2   = "pbkdf2-sha256"
+	// PasswordTypeSha256Salt is hex(SHA-256(password + salt)), only accepted for imported users
+	PasswordTypeSha256Salt = "sha256-salt"
+)
+
+// DefaultPasswordType is used when an organization has no valid password type configured
+const DefaultPasswordType = PasswordTypeBcrypt
+
+// PasswordHasher hashes and verifies passwords with one algorithm
+type PasswordHasher interface {
+	// Hash returns the encoded hash of a password. The salt is only used by
+	// algorithms that do not generate and embed their own.
+	Hash(password, salt string) (string, error)
+	// Verify checks a password against an encoded hash in constant time
+	Verify(password, hash, salt string) bool
+	// NeedsRehash reports whether a hash was made with weaker parameters than the hasher uses now
+	NeedsRehash(hash string) bool
+}
+
+// passwordHashers is the registry of supported algorithms, keyed by password type
+var passwordHashers = map[string]PasswordHasher{
+	PasswordTypeBcrypt:     &bcryptHasher{cost: bcrypt.DefaultCost},
+	PasswordTypeArgon2id:   &argon2idHasher{memory: 19 * 1024, time: 2, threads: 1, keyLength: 32},
+	PasswordTypePbkdf2:     &pbkdf2Hasher{iterations: 600000, keyLength: 32},
+	PasswordTypeSha256Salt: &sha256SaltHasher{},
+}
+
+// legacyPasswordTypes can verify existing hashes but are never used for new ones
+var legacyPasswordTypes = map[string]bool{
+	PasswordTypeSha256Salt: true,
+}
+
+// GetPasswordHasher returns the hasher of a password type, or nil if it is not supported
+func GetPasswordHasher(passwordType string) PasswordHasher {
+	return passwordHashers[passwordType]
+}
+
+// IsValidPasswordType checks whether new passwords can be hashed with a password type
+func IsValidPasswordType(passwordType string) bool {
+	return passwordHashers[passwordType] != nil && !legacyPasswordTypes[passwordType]
+}
+
+// OrganizationPasswordType returns the algorithm new passwords of an organization are hashed with
+func OrganizationPasswordType(organization *models.Organization) string {
+	if organization == nil || !IsValidPasswordType(organization.PasswordType) {
+		return DefaultPasswordType
+	}
+	return organization.PasswordType
+}
+
+// DetectPasswordType guesses the algorithm of a hash stored without a password type,
+// such as the bcrypt hashes written before the type was recorded
+func DetectPasswordType(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return PasswordTypeBcrypt
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return PasswordTypeArgon2id
+	case strings.HasPrefix(hash, "$pbkdf2-sha256$"):
+		return PasswordTypePbkdf2
+	case len(hash) == sha256.Size*2 && isHex(hash):
+		return PasswordTypeSha256Salt
+	}
+	return ""
+}
+
+func isHex(value string) bool {
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+// CheckPassword checks a password against a hash whose algorithm is detected from its format
+func CheckPassword(password, hash string) bool {
+	return VerifyPasswordHash(password, hash, "", "")
+}
+
+// VerifyPasswordHash checks a password against a hash made with the given algorithm. An empty
+// password type is detected from the hash. Empty passwords and unknown algorithms never match.
+func VerifyPasswordHash(password, hash, passwordType, salt string) bool {
+	if password == "" || hash == "" {
+		return false
+	}
+	if passwordType == "" {
+		passwordType = DetectPasswordType(hash)
+	}
+	hasher := GetPasswordHasher(passwordType)
+	if hasher == nil {
+		return false
+	}
+	return hasher.Verify(password, hash, salt)
+}
+
+// dummyPasswordHash is checked when no user matches a sign-in, so that an unknown identifier
+// takes about as long to reject as a wrong password
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := passwordHashers[PasswordTypeBcrypt].Hash(models.GenerateRandomString(16), "")
+	if err != nil {
+		log.Printf("[Password] Failed to create the dummy password hash: %v", err)
+	}
+	return hash
+})
+
+// verifyDummyPassword spends the time of a password check for a sign-in without a user
+func verifyDummyPassword(password string) {
+	VerifyPasswordHash(password, dummyPasswordHash(), PasswordTypeBcrypt, "")
+}
+
+// hashUserPassword stores a new password hash of the given type on the user without saving it
+func hashUserPassword(user *models.User, password, passwordType string) error {
+	hasher := GetPasswordHasher(passwordType)
+	if hasher == nil {
+		return fmt.Errorf("unsupported password type: %s", passwordType)
+	}
+	hash, err := hasher.Hash(password, "")
+	if err != nil {
+		return err
+	}
+	user.Password = hash
+	user.PasswordType = passwordType
+	user.PasswordSalt = ""
+	return nil
+}
+
+// SetUserPassword checks a new password against the policy of the user's organization and hashes it
+// with the organization's algorithm, keeping the previous hash in the password history. Policy
+// violations are returned as a *PasswordPolicyError. The user is not saved.
+func SetUserPassword(user *models.User, password string) error {
+	organization, err := organizationOfUser(user)
+	if err != nil {
+		return err
+	}
+	policy := OrganizationPasswordPolicy(organization)
+	if err := checkPasswordPolicy(policy, user, password); err != nil {
+		return err
+	}
+
+	rememberPassword(user, policy.HistorySize)
+	if err := hashUserPassword(user, password, OrganizationPasswordType(organization)); err != nil {
+		return err
+	}
+	user.PasswordChangedTime = time.Now().Format(time.RFC3339)
+	return nil
+}
+
+// VerifyUserPassword checks a password against the user's stored hash. After a successful check,
+// a hash made with another algorithm or weaker parameters than the organization's is replaced,
+// so imported and older hashes are upgraded as users sign in.
+func VerifyUserPassword(user *models.User, password string) (bool, error) {
+	organization, err := organizationOfUser(user)
+	if err != nil {
+		return false, err
+	}
+
+	// Imported hashes may rely on the organization-wide salt
+	salt := user.PasswordSalt
+	if salt == "" && organization != nil {
+		salt = organization.PasswordSalt
+	}
+	if !VerifyPasswordHash(password, user.Password, user.PasswordType, salt) {
+		return false, nil
+	}
+
+	passwordType := OrganizationPasswordType(organization)
+	if passwordNeedsRehash(user, passwordType) {
+		if err := hashUserPassword(user, password, passwordType); err != nil {
+			log.Printf("[Password] Failed to rehash password of user %d: %v", user.Id, err)
+			return true, nil
+		}
+		if _, err := models.UpdateUserPassword(user); err != nil {
+			log.Printf("[Password] Failed to save rehashed password of user %d: %v", user.Id, err)
+		}
+	}
+	return true, nil
+}
+
+// passwordNeedsRehash reports whether the user's hash differs from what the target algorithm would produce
+func passwordNeedsRehash(user *models.User, passwordType string) bool {
+	currentType := user.PasswordType
+	if currentType == "" {
+		currentType = DetectPasswordType(user.Password)
+	}
+	if currentType != passwordType {
+		return true
+	}
+	return GetPasswordHasher(passwordType).NeedsRehash(user.Password)
+}
+
+// randomSalt returns a random salt for algorithms that embed it in the hash
+func randomSalt(length int) ([]byte, error) {
+	salt := make([]byte, length)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// bcryptHasher hashes passwords with bcrypt, which embeds the cost and salt in the hash
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) Hash(password, salt string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(hash), err
+}
+
+func (h *bcryptHasher) Verify(password, hash, salt string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (h *bcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < h.cost
+}
+
+// argon2idHasher hashes passwords with Argon2id in the PHC string format:
+// $argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<salt>$<key>
+type argon2idHasher struct {
+	memory    uint32
+	time      uint32
+	threads   uint8
+	keyLength uint32
+}
+
+type argon2idHash struct {
+	memory, time uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+func parseArgon2idHash(hash string) (*argon2idHash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != PasswordTypeArgon2id {
+		return nil, fmt.Errorf("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version")
+	}
+	parsed := &argon2idHash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parsed.memory, &parsed.time, &parsed.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters")
+	}
+	var err error
+	if parsed.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, err
+	}
+	if parsed.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, err
+	}
+	if parsed.time == 0 || parsed.threads == 0 || len(parsed.key) == 0 {
+		return nil, fmt.Errorf("invalid argon2id parameters")
+	}
+	return parsed, nil
+}
+
+func (h *argon2idHasher) Hash(password, salt string) (string, error) {
+	saltBytes, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), saltBytes, h.time, h.memory, h.threads, h.keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(saltBytes), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *argon2idHasher) Verify(password, hash, salt string) bool {
+	parsed, err := parseArgon2idHash(hash)
+	if err != nil {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), parsed.salt, parsed.time, parsed.memory, parsed.threads, uint32(len(parsed.key)))
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1
+}
+
+func (h *argon2idHasher) NeedsRehash(hash string) bool {
+	parsed, err := parseArgon2idHash(hash)
+	return err != nil || parsed.memory < h.memory || parsed.time < h.time || uint32(len(parsed.key)) < h.keyLength
+}
+
+// pbkdf2Hasher hashes passwords with PBKDF2-HMAC-SHA256:
+// $pbkdf2-sha256$i=<iterations>$<salt>$<key>
+type pbkdf2Hasher struct {
+	iterations int
+	keyLength  int
+}
+
+func parsePbkdf2Hash(hash string) (iterations int, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[1] != PasswordTypePbkdf2 {
+		return 0, nil, nil, fmt.Errorf("invalid pbkdf2 hash")
+	}
+	if _, err = fmt.Sscanf(parts[2], "i=%d", &iterations); err != nil || iterations <= 0 {
+		return 0, nil, nil, fmt.Errorf("invalid pbkdf2 iterations")
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		return 0, nil, nil, err
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(key) == 0 {
+		return 0, nil, nil, fmt.Errorf("invalid pbkdf2 key")
+	}
+	return iterations, salt, key, nil
+}
+
+func (h *pbkdf2Hasher) Hash(password, salt string) (string, error) {
+	saltBytes, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), saltBytes, h.iterations, h.keyLength, sha256.New)
+	return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", h.iterations,
+		base64.RawStdEncoding.EncodeToString(saltBytes), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *pbkdf2Hasher) Verify(password, hash, salt string) bool {
+	iterations, saltBytes, key, err := parsePbkdf2Hash(hash)
+	if err != nil {
+		return false
+	}
+	computed := pbkdf2.Key([]byte(password), saltBytes, iterations, len(key), sha256.New)
+	return subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+func (h *pbkdf2Hasher) NeedsRehash(hash string) bool {
+	iterations, _, key, err := parsePbkdf2Hash(hash)
+	return err != nil || iterations < h.iterations || len(key) < h.keyLength
+}
+
+// sha256SaltHasher verifies hex(SHA-256(password + salt)) hashes of imported users. It is too
+// fast to resist offline guessing, so such hashes are always replaced after the next sign-in.
+type sha256SaltHasher struct{}
+
+func (h *sha256SaltHasher) Hash(password, salt string) (string, error) {
+	sum := sha256.Sum256([]byte(password + salt))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (h *sha256SaltHasher) Verify(password, hash, salt string) bool {
+	computed, _ := h.Hash(password, salt)
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(strings.ToLower(hash))) == 1
+}
+
+func (h *sha256SaltHasher) NeedsRehash(hash string) bool {
+	return true
+}
@@ -0,0 +1,365 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// Character classes a password policy can require
+const (
+	PasswordClassLower  = "lower"
+	PasswordClassUpper  = "upper"
+	PasswordClassDigit  = "digit"
+	PasswordClassSymbol = "symbol"
+)
+
+// Codes of password policy violations, returned to clients for localized messages
+const (
+	PasswordViolationTooShort      = "too_short"
+	PasswordViolationTooLong       = "too_long"
+	PasswordViolationMissingClass  = "missing_class"
+	PasswordViolationUserAttribute = "user_attribute"
+	PasswordViolationReused        = "reused"
+	PasswordViolationBreached      = "breached"
+)
+
+const (
+	// DefaultPasswordMinLength applies to every organization; policies can only raise it
+	DefaultPasswordMinLength = 6
+	// PasswordMaxLength bounds the work of hashing; bcrypt only uses the first 72 bytes
+	PasswordMaxLength       = 128
+	bcryptPasswordMaxLength = 72
+	// minUserAttributeLength avoids rejecting passwords for containing very short usernames
+	minUserAttributeLength = 3
+)
+
+// ErrPasswordExpired is returned on sign-in when the password is older than the organization allows
+var ErrPasswordExpired = errors.New("password has expired")
+
+// PasswordViolation is one rule of the password policy a candidate password breaks
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   string `json:"param,omitempty"` // The limit, class or attribute the rule refers to
+}
+
+// PasswordPolicyError is returned when a new password breaks the organization's policy
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return "password does not meet the policy: " + strings.Join(messages, "; ")
+}
+
+// PasswordPolicy holds the rules new passwords of an organization are checked against
+type PasswordPolicy struct {
+	MinLength            int
+	MaxLength            int // In bytes
+	CharClasses          []string
+	ForbidUserAttributes bool
+	HistorySize          int
+	MaxAge               time.Duration
+	CheckBreached        bool
+}
+
+// IsValidPasswordClass checks whether a character class is known
+func IsValidPasswordClass(class string) bool {
+	switch class {
+	case PasswordClassLower, PasswordClassUpper, PasswordClassDigit, PasswordClassSymbol:
+		return true
+	}
+	return false
+}
+
+// OrganizationPasswordPolicy returns the password policy of an organization, with defaults when unset
+func OrganizationPasswordPolicy(organization *models.Organization) PasswordPolicy {
+	policy := PasswordPolicy{MinLength: DefaultPasswordMinLength, MaxLength: PasswordMaxLength}
+	if organization == nil {
+		policy.MaxLength = bcryptPasswordMaxLength
+		return policy
+	}
+
+	if organization.PasswordMinLength > policy.MinLength {
+		policy.MinLength = organization.PasswordMinLength
+	}
+	if OrganizationPasswordType(organization) == PasswordTypeBcrypt {
+		policy.MaxLength = bcryptPasswordMaxLength
+	}
+	policy.CharClasses = organization.PasswordCharClasses
+	policy.ForbidUserAttributes = organization.PasswordForbidUserAttributes
+	policy.HistorySize = organization.PasswordHistorySize
+	policy.MaxAge = time.Duration(organization.PasswordMaxAgeDays) * 24 * time.Hour
+	policy.CheckBreached = organization.PasswordCheckBreached
+	return policy
+}
+
+// Check returns the rules a candidate password for the user breaks. The history and the breached
+// password list are only consulted when the cheaper rules pass.
+func (p PasswordPolicy) Check(user *models.User, password string) ([]PasswordViolation, error) {
+	violations := []PasswordViolation{}
+
+	if length := len([]rune(password)); length < p.MinLength {
+		violations = append(violations, PasswordViolation{
+			Code:    PasswordViolationTooShort,
+			Message: fmt.Sprintf("password must be at least %d characters", p.MinLength),
+			Param:   fmt.Sprintf("%d", p.MinLength),
+		})
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		violations = append(violations, PasswordViolation{
+			Code:    PasswordViolationTooLong,
+			Message: fmt.Sprintf("password must be at most %d bytes", p.MaxLength),
+			Param:   fmt.Sprintf("%d", p.MaxLength),
+		})
+	}
+
+	for _, class := range p.CharClasses {
+		if !hasPasswordClass(password, class) {
+			violations = append(violations, PasswordViolation{
+				Code:    PasswordViolationMissingClass,
+				Message: fmt.Sprintf("password must contain a %s character", class),
+				Param:   class,
+			})
+		}
+	}
+
+	if p.ForbidUserAttributes && user != nil {
+		if attribute := passwordUserAttribute(user, password); attribute != "" {
+			violations = append(violations, PasswordViolation{
+				Code:    PasswordViolationUserAttribute,
+				Message: fmt.Sprintf("password must not contain your %s", attribute),
+				Param:   attribute,
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		return violations, nil
+	}
+
+	if p.HistorySize > 0 && user != nil && passwordInHistory(user, password, p.HistorySize) {
+		violations = append(violations, PasswordViolation{
+			Code:    PasswordViolationReused,
+			Message: fmt.Sprintf("password must differ from the last %d passwords", p.HistorySize),
+			Param:   fmt.Sprintf("%d", p.HistorySize),
+		})
+	}
+
+	if p.CheckBreached {
+		breached, err := IsBreachedPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			violations = append(violations, PasswordViolation{
+				Code:    PasswordViolationBreached,
+				Message: "password has appeared in a data breach",
+			})
+		}
+	}
+	return violations, nil
+}
+
+// IsExpired checks whether the user's password is older than the policy allows. Passwords with an
+// unknown change time never expire.
+func (p PasswordPolicy) IsExpired(user *models.User, now time.Time) bool {
+	if p.MaxAge <= 0 || user.PasswordChangedTime == "" {
+		return false
+	}
+	changedTime, err := time.Parse(time.RFC3339, user.PasswordChangedTime)
+	if err != nil {
+		return false
+	}
+	return now.After(changedTime.Add(p.MaxAge))
+}
+
+func hasPasswordClass(password, class string) bool {
+	for _, c := range password {
+		switch class {
+		case PasswordClassLower:
+			if unicode.IsLower(c) {
+				return true
+			}
+		case PasswordClassUpper:
+			if unicode.IsUpper(c) {
+				return true
+			}
+		case PasswordClassDigit:
+			if unicode.IsDigit(c) {
+				return true
+			}
+		case PasswordClassSymbol:
+			if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !unicode.IsSpace(c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// passwordUserAttribute returns the name of a user attribute contained in the password, ignoring case
+func passwordUserAttribute(user *models.User, password string) string {
+	password = strings.ToLower(password)
+	contains := func(value string) bool {
+		value = strings.ToLower(value)
+		return len([]rune(value)) >= minUserAttributeLength && strings.Contains(password, value)
+	}
+
+	if contains(user.Username) {
+		return "username"
+	}
+	if localPart, _, found := strings.Cut(user.Email, "@"); found && contains(localPart) {
+		return "email"
+	}
+	// The national number is what users tend to reuse, so compare the last digits
+	if phone := strings.TrimPrefix(user.Phone, "+"); len(phone) >= 8 && contains(phone[len(phone)-8:]) {
+		return "phone"
+	}
+	return ""
+}
+
+// passwordInHistory checks the password against the current hash and the previous ones
+// within the history size
+func passwordInHistory(user *models.User, password string, size int) bool {
+	if VerifyPasswordHash(password, user.Password, user.PasswordType, user.PasswordSalt) {
+		return true
+	}
+	for i, hash := range user.PasswordHistory {
+		if i >= size-1 {
+			break
+		}
+		if VerifyPasswordHash(password, hash, "", "") {
+			return true
+		}
+	}
+	return false
+}
+
+// rememberPassword moves the current hash into the history, keeping as many entries as the
+// policy needs besides the current password
+func rememberPassword(user *models.User, size int) {
+	history := []string{}
+	if size > 1 {
+		// Legacy hashes depend on a salt that is not kept with them
+		if user.Password != "" && DetectPasswordType(user.Password) != PasswordTypeSha256Salt {
+			history = append(history, user.Password)
+		}
+		history = append(history, user.PasswordHistory...)
+		if len(history) > size-1 {
+			history = history[:size-1]
+		}
+	}
+	user.PasswordHistory = history
+}
+
+// IsBreachedPassword looks the password up in the breached password list in BREACHED_PASSWORDS_DIR.
+// The list uses the k-anonymity range format: one file per first five hex digits of the SHA-1 hash,
+// named like "5BAA6" or "5BAA6.txt", with "SUFFIX:COUNT" lines. Without the directory no password
+// is reported, and a missing range file means no breached password has that prefix.
+func IsBreachedPassword(password string) (bool, error) {
+	dir := os.Getenv("BREACHED_PASSWORDS_DIR")
+	if dir == "" {
+		return false, nil
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	var file *os.File
+	var err error
+	for _, name := range []string{prefix, prefix + ".txt", strings.ToLower(prefix), strings.ToLower(prefix) + ".txt"} {
+		file, err = os.Open(filepath.Join(dir, name))
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	if file == nil {
+		return false, nil
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		entry, count, _ := strings.Cut(line, ":")
+		if strings.EqualFold(entry, suffix) && strings.TrimSpace(count) != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// CheckPasswordBaseline checks the rules every organization's policy includes. It needs no
+// database access, so handlers can reject obviously unsuitable passwords first.
+func CheckPasswordBaseline(password string) error {
+	return checkPasswordPolicy(PasswordPolicy{MinLength: DefaultPasswordMinLength, MaxLength: PasswordMaxLength}, nil, password)
+}
+
+// organizationOfUser loads the organization a user belongs to
+func organizationOfUser(user *models.User) (*models.Organization, error) {
+	return models.GetOrganization("admin", user.Owner)
+}
+
+// ValidateUserPassword checks a new password against the policy of the user's organization
+// without changing the user. It returns a *PasswordPolicyError listing the broken rules.
+func ValidateUserPassword(user *models.User, password string) error {
+	organization, err := organizationOfUser(user)
+	if err != nil {
+		return err
+	}
+	return checkPasswordPolicy(OrganizationPasswordPolicy(organization), user, password)
+}
+
+// ValidatePasswordRules checks a new password only against the rules of the user's organization that do
+// not depend on the user. It runs before someone resetting a password has proven control of the
+// account, so the answer reveals nothing about the current or earlier passwords; reuse and user
+// attribute rules are checked when the password is set.
+func ValidatePasswordRules(user *models.User, password string) error {
+	organization, err := organizationOfUser(user)
+	if err != nil {
+		return err
+	}
+	return checkPasswordPolicy(OrganizationPasswordPolicy(organization), nil, password)
+}
+
+func checkPasswordPolicy(policy PasswordPolicy, user *models.User, password string) error {
+	violations, err := policy.Check(user, password)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// IsPasswordExpired checks whether the user has to choose a new password before signing in
+func IsPasswordExpired(user *models.User) (bool, error) {
+	organization, err := organizationOfUser(user)
+	if err != nil {
+		return false, err
+	}
+	return OrganizationPasswordPolicy(organization).IsExpired(user, time.Now()), nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func violationCodes(violations []PasswordViolation) string {
+	codes := []string{}
+	for _, violation := range violations {
+		codes = append(codes, violation.Code+"("+violation.Param+")")
+	}
+	return strings.Join(codes, ",")
+}
+
+// TestPasswordPolicyCheck tests the rules that need no stored hashes
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:            10,
+		MaxLength:            72,
+		CharClasses:          []string{PasswordClassLower, PasswordClassUpper, PasswordClassDigit, PasswordClassSymbol},
+		ForbidUserAttributes: true,
+	}
+	user := &models.User{Username: "alice", Email: "a.liddell@example.com", Phone: "+8613800138000"}
+
+	tests := []struct {
+		password string
+		expected string
+	}{
+		{"Tr0ub4dor&3x", ""},
+		{"Sh0rt!", "too_short(10)"},
+		{"alllowercase", "missing_class(upper),missing_class(digit),missing_class(symbol)"},
+		{"ÄÖÜäöü1234!", ""},
+		{strings.Repeat("Aa1!", 19), "too_long(72)"},
+		{"My-Alice-2024", "user_attribute(username)"},
+		{"A.Liddell#2024", "user_attribute(email)"},
+		{"Pw!13800138000", "user_attribute(phone)"},
+	}
+	for _, tt := range tests {
+		violations, err := policy.Check(user, tt.password)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if codes := violationCodes(violations); codes != tt.expected {
+			t.Errorf("%s: expected [%s], got [%s]", tt.password, tt.expected, codes)
+		}
+	}
+
+	// Short attributes would reject too many passwords
+	violations, _ := policy.Check(&models.User{Username: "al"}, "Always-Al1ve")
+	if len(violations) != 0 {
+		t.Errorf("Expected a two-letter username to be ignored, got %s", violationCodes(violations))
+	}
+}
+
+// TestCheckPasswordBaseline tests the rules applied before the organization is known
+func TestCheckPasswordBaseline(t *testing.T) {
+	if err := CheckPasswordBaseline("123456"); err != nil {
+		t.Errorf("Expected six characters to pass, got %v", err)
+	}
+	err := CheckPasswordBaseline("12345")
+	policyErr, ok := err.(*PasswordPolicyError)
+	if !ok || len(policyErr.Violations) != 1 || policyErr.Violations[0].Code != PasswordViolationTooShort {
+		t.Errorf("Expected a too_short violation, got %v", err)
+	}
+	if err := CheckPasswordBaseline(strings.Repeat("a", PasswordMaxLength+1)); err == nil {
+		t.Errorf("Expected an overlong password to be rejected")
+	}
+}
+
+// TestOrganizationPasswordPolicy tests defaults and the limits derived from the organization
+func TestOrganizationPasswordPolicy(t *testing.T) {
+	policy := OrganizationPasswordPolicy(nil)
+	if policy.MinLength != DefaultPasswordMinLength || policy.MaxLength != 72 {
+		t.Errorf("Unexpected default policy: %+v", policy)
+	}
+
+	policy = OrganizationPasswordPolicy(&models.Organization{PasswordMinLength: 4, PasswordType: PasswordTypeArgon2id, PasswordMaxAgeDays: 90})
+	if policy.MinLength != DefaultPasswordMinLength {
+		t.Errorf("Expected the minimum length not to go below the default, got %d", policy.MinLength)
+	}
+	if policy.MaxLength != PasswordMaxLength || policy.MaxAge != 90*24*time.Hour {
+		t.Errorf("Unexpected policy: %+v", policy)
+	}
+
+	policy = OrganizationPasswordPolicy(&models.Organization{PasswordMinLength: 12})
+	if policy.MinLength != 12 {
+		t.Errorf("Expected a minimum length of 12, got %d", policy.MinLength)
+	}
+}
+
+// TestPasswordHistory tests that recent passwords cannot be reused and the history is trimmed
+func TestPasswordHistory(t *testing.T) {
+	hash := func(password string) string {
+		h, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		return string(h)
+	}
+	user := &models.User{
+		Password:        hash("current-pass"),
+		PasswordHistory: []string{hash("previous-1"), hash("previous-2"), hash("previous-3")},
+	}
+	policy := PasswordPolicy{MinLength: 6, HistorySize: 3}
+
+	for _, tt := range []struct {
+		password string
+		reused   bool
+	}{
+		{"current-pass", true},
+		{"previous-1", true},
+		{"previous-2", true},
+		{"previous-3", false},
+		{"brand-new-pass", false},
+	} {
+		violations, err := policy.Check(user, tt.password)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reused := violationCodes(violations) == "reused(3)"; reused != tt.reused {
+			t.Errorf("%s: expected reused %v, got [%s]", tt.password, tt.reused, violationCodes(violations))
+		}
+	}
+
+	// Without a user only the rules that do not depend on the account are checked
+	if violations, err := policy.Check(nil, "current-pass"); err != nil || len(violations) != 0 {
+		t.Errorf("Expected no violations without a user, got [%s] (%v)", violationCodes(violations), err)
+	}
+
+	current := user.Password
+	rememberPassword(user, 3)
+	if len(user.PasswordHistory) != 2 || user.PasswordHistory[0] != current {
+		t.Errorf("Expected the current hash first and two entries, got %d", len(user.PasswordHistory))
+	}
+
+	rememberPassword(user, 0)
+	if len(user.PasswordHistory) != 0 {
+		t.Errorf("Expected the history to be cleared without a policy")
+	}
+}
+
+// TestIsBreachedPassword tests lookups in k-anonymity range files
+func TestIsBreachedPassword(t *testing.T) {
+	dir := t.TempDir()
+	// SHA-1("password") = 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	if err := os.WriteFile(filepath.Join(dir, "5BAA6.txt"), []byte("003D68EB55068C33ACE09247EE4C639306B:3\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\r\n"), 0644); err != nil {
+		t.Fatalf("Failed to write range file: %v", err)
+	}
+	// SHA-1("123456") = 7C4A8D09CA3762AF61E59520943DC26494F8941B
+	if err := os.WriteFile(filepath.Join(dir, "7c4a8"), []byte("d09ca3762af61e59520943dc26494f8941b:0\n"), 0644); err != nil {
+		t.Fatalf("Failed to write range file: %v", err)
+	}
+
+	t.Setenv("BREACHED_PASSWORDS_DIR", "")
+	if breached, err := IsBreachedPassword("password"); err != nil || breached {
+		t.Errorf("Expected no lookup without a directory, got %v %v", breached, err)
+	}
+
+	t.Setenv("BREACHED_PASSWORDS_DIR", dir)
+	for _, tt := range []struct {
+		password string
+		breached bool
+	}{
+		{"password", true},
+		{"123456", false}, // Padding entries have a count of zero
+		{"correct horse battery staple", false},
+	} {
+		breached, err := IsBreachedPassword(tt.password)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if breached != tt.breached {
+			t.Errorf("%s: expected breached %v, got %v", tt.password, tt.breached, breached)
+		}
+	}
+
+	violations, err := PasswordPolicy{MinLength: 6, CheckBreached: true}.Check(nil, "password")
+	if err != nil || violationCodes(violations) != "breached()" {
+		t.Errorf("Expected a breached violation, got [%s] %v", violationCodes(violations), err)
+	}
+}
+
+// TestPasswordPolicyIsExpired tests the maximum password age
+func TestPasswordPolicyIsExpired(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	policy := PasswordPolicy{MaxAge: 30 * 24 * time.Hour}
+
+	for _, tt := range []struct {
+		changedTime string
+		policy      PasswordPolicy
+		expired     bool
+	}{
+		{"2024-05-15T00:00:00Z", policy, false},
+		{"2024-04-01T00:00:00Z", policy, true},
+		{"2024-04-01T00:00:00Z", PasswordPolicy{}, false},
+		{"", policy, false},
+	} {
+		user := &models.User{PasswordChangedTime: tt.changedTime}
+		if expired := tt.policy.IsExpired(user, now); expired != tt.expired {
+			t.Errorf("%q: expected expired %v, got %v", tt.changedTime, tt.expired, expired)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/oauth-server/oauth-server/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestPasswordHashers tests that every registered algorithm verifies its own hashes
+func TestPasswordHashers(t *testing.T) {
+	for _, passwordType := range []string{PasswordTypeBcrypt, PasswordTypeArgon2id, PasswordTypePbkdf2, PasswordTypeSha256Salt} {
+		t.Run(passwordType, func(t *testing.T) {
+			hasher := GetPasswordHasher(passwordType)
+			hash, err := hasher.Hash("correct horse", "pepper")
+			if err != nil {
+				t.Fatalf("Failed to hash: %v", err)
+			}
+
+			if DetectPasswordType(hash) != passwordType {
+				t.Errorf("Expected %s to be detected from %s", passwordType, hash)
+			}
+			if !VerifyPasswordHash("correct horse", hash, passwordType, "pepper") {
+				t.Errorf("Expected the password to match")
+			}
+			if VerifyPasswordHash("wrong horse", hash, passwordType, "pepper") {
+				t.Errorf("Expected a wrong password not to match")
+			}
+			if VerifyPasswordHash("", hash, passwordType, "pepper") {
+				t.Errorf("Expected an empty password not to match")
+			}
+		})
+	}
+}
+
+// TestVerifyPasswordHashRejectsPlaintext tests that a stored plaintext or unknown value never matches
+func TestVerifyPasswordHashRejectsPlaintext(t *testing.T) {
+	if VerifyPasswordHash("secret", "secret", "", "") {
+		t.Errorf("Expected plaintext comparison to be rejected")
+	}
+	if VerifyPasswordHash("secret", "secret", "plain", "") {
+		t.Errorf("Expected an unknown password type to be rejected")
+	}
+
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if VerifyPasswordHash(string(bcryptHash), string(bcryptHash), "", "") {
+		t.Errorf("Expected the hash itself not to be accepted as the password")
+	}
+	if !CheckPassword("secret", string(bcryptHash)) {
+		t.Errorf("Expected a bcrypt hash without a recorded type to be detected")
+	}
+}
+
+// TestVerifyPasswordHashTampered tests that malformed hashes are rejected
+func TestVerifyPasswordHashTampered(t *testing.T) {
+	hash, err := GetPasswordHasher(PasswordTypeArgon2id).Hash("secret", "")
+	if err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+	for _, tampered := range []string{
+		strings.Replace(hash, "v=19", "v=16", 1),
+		strings.Replace(hash, "t=2", "t=0", 1),
+		hash[:strings.LastIndex(hash, "$")],
+		hash + "!",
+	} {
+		if VerifyPasswordHash("secret", tampered, PasswordTypeArgon2id, "") {
+			t.Errorf("Expected %s to be rejected", tampered)
+		}
+	}
+
+	if VerifyPasswordHash("secret", "$pbkdf2-sha256$i=0$c2FsdA$a2V5", PasswordTypePbkdf2, "") {
+		t.Errorf("Expected zero iterations to be rejected")
+	}
+}
+
+// TestLegacySha256Salt tests the salted SHA-256 format of imported users
+func TestLegacySha256Salt(t *testing.T) {
+	// hex(SHA-256("password" + "salt"))
+	hash := "7a37b85c8918eac19a9089c0fa5a2ab4dce3f90528dcdeec108b23ddf3607b99"
+	if !VerifyPasswordHash("password", hash, PasswordTypeSha256Salt, "salt") {
+		t.Errorf("Expected the imported hash to match")
+	}
+	if !VerifyPasswordHash("password", strings.ToUpper(hash), "", "salt") {
+		t.Errorf("Expected an upper-case hash without a recorded type to match")
+	}
+	if VerifyPasswordHash("password", hash, PasswordTypeSha256Salt, "other") {
+		t.Errorf("Expected a different salt not to match")
+	}
+	if IsValidPasswordType(PasswordTypeSha256Salt) {
+		t.Errorf("Expected the legacy type not to be used for new passwords")
+	}
+}
+
+// TestPasswordRehash tests when a verified hash is upgraded to the organization's algorithm
+func TestPasswordRehash(t *testing.T) {
+	weakBcrypt, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	weakArgon2id, _ := (&argon2idHasher{memory: 1024, time: 1, threads: 1, keyLength: 32}).Hash("secret", "")
+	weakPbkdf2, _ := (&pbkdf2Hasher{iterations: 1000, keyLength: 32}).Hash("secret", "")
+	argon2idHash, _ := GetPasswordHasher(PasswordTypeArgon2id).Hash("secret", "")
+
+	tests := []struct {
+		name         string
+		user         *models.User
+		passwordType string
+		rehash       bool
+	}{
+		{"current argon2id", &models.User{Password: argon2idHash, PasswordType: PasswordTypeArgon2id}, PasswordTypeArgon2id, false},
+		{"untyped argon2id", &models.User{Password: argon2idHash}, PasswordTypeArgon2id, false},
+		{"weaker argon2id", &models.User{Password: weakArgon2id, PasswordType: PasswordTypeArgon2id}, PasswordTypeArgon2id, true},
+		{"weaker pbkdf2", &models.User{Password: weakPbkdf2, PasswordType: PasswordTypePbkdf2}, PasswordTypePbkdf2, true},
+		{"weaker bcrypt", &models.User{Password: string(weakBcrypt)}, PasswordTypeBcrypt, true},
+		{"other algorithm", &models.User{Password: argon2idHash, PasswordType: PasswordTypeArgon2id}, PasswordTypeBcrypt, true},
+		{"legacy", &models.User{Password: strings.Repeat("a", 64), PasswordType: PasswordTypeSha256Salt}, PasswordTypeBcrypt, true},
+	}
+	for _, tt := range tests {
+		if rehash := passwordNeedsRehash(tt.user, tt.passwordType); rehash != tt.rehash {
+			t.Errorf("%s: expected rehash %v, got %v", tt.name, tt.rehash, rehash)
+		}
+	}
+
+	user := &models.User{Password: "7a37b85c8918eac19a9089c0fa5a2ab4dce3f90528dcdeec108b23ddf3607b99", PasswordType: PasswordTypeSha256Salt, PasswordSalt: "salt"}
+	if err := hashUserPassword(user, "password", PasswordTypeArgon2id); err != nil {
+		t.Fatalf("Failed to rehash: %v", err)
+	}
+	if user.PasswordType != PasswordTypeArgon2id || user.PasswordSalt != "" || !VerifyPasswordHash("password", user.Password, user.PasswordType, "") {
+		t.Errorf("Unexpected rehashed user: %+v", user)
+	}
+}
+
+// TestOrganizationPasswordType tests the fallback for unset or unsupported organization settings
+func TestOrganizationPasswordType(t *testing.T) {
+	tests := []struct {
+		organization *models.Organization
+		expected     string
+	}{
+		{nil, PasswordTypeBcrypt},
+		{&models.Organization{}, PasswordTypeBcrypt},
+		{&models.Organization{PasswordType: "plain"}, PasswordTypeBcrypt},
+		{&models.Organization{PasswordType: PasswordTypeSha256Salt}, PasswordTypeBcrypt},
+		{&models.Organization{PasswordType: PasswordTypeArgon2id}, PasswordTypeArgon2id},
+		{&models.Organization{PasswordType: PasswordTypePbkdf2}, PasswordTypePbkdf2},
+	}
+	for _, tt := range tests {
+		if passwordType := OrganizationPasswordType(tt.organization); passwordType != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, passwordType)
+		}
+	}
+}
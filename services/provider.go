@@ -0,0 +1,789 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// AmrFederated marks a sign-in delegated to an upstream identity provider.
+// RFC 8176 has no value for it, so a descriptive one is used like other providers do.
+const AmrFederated = "fed"
+
+// providerSessionTimeout bounds the time between leaving for the provider and coming back
+const providerSessionTimeout = 10 * time.Minute
+
+const (
+	providerPurposeLogin  = "login"
+	providerPurposeLink   = "link"
+	providerPurposeResult = "result"
+)
+
+var (
+	ErrProviderNotConfigured  = fmt.Errorf("the provider is not configured")
+	ErrProviderStateInvalid   = fmt.Errorf("the sign-in state is invalid or expired")
+	ErrProviderUserInvalid    = fmt.Errorf("the provider did not return a user id")
+	ErrProviderSignupDisabled = fmt.Errorf("sign-up is disabled")
+	ErrProviderEmailTaken     = fmt.Errorf("an account with this email already exists, sign in and link the provider first")
+	ErrProviderIdentityLinked = fmt.Errorf("the upstream account is already linked to another user")
+)
+
+// providerPreset holds the endpoints and attribute mapping of a well-known provider type
+type providerPreset struct {
+	AuthUrl     string
+	TokenUrl    string
+	UserInfoUrl string
+	Scopes      string
+	UserMapping map[string]string
+	DisablePkce bool // The provider rejects or ignores PKCE parameters
+}
+
+// providerPresets are applied to providers of these types for every empty setting
+var providerPresets = map[string]providerPreset{
+	"GitHub": {
+		AuthUrl:     "https://github.com/login/oauth/authorize",
+		TokenUrl:    "https://github.com/login/oauth/access_token",
+		UserInfoUrl: "https://api.github.com/user",
+		Scopes:      "read:user user:email",
+		UserMapping: map[string]string{
+			"id": "id", "username": "login", "displayName": "name",
+			"email": "email", "emailVerified": "email_verified", "avatar": "avatar_url",
+		},
+	},
+	"Google": {
+		AuthUrl:     "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenUrl:    "https://oauth2.googleapis.com/token",
+		UserInfoUrl: "https://openidconnect.googleapis.com/v1/userinfo",
+		Scopes:      "openid email profile",
+		UserMapping: map[string]string{
+			"id": "sub", "username": "name", "displayName": "name",
+			"email": "email", "emailVerified": "email_verified", "avatar": "picture",
+		},
+	},
+	"QQ": {
+		AuthUrl:     "https://graph.qq.com/oauth2.0/authorize",
+		TokenUrl:    "https://graph.qq.com/oauth2.0/token",
+		UserInfoUrl: "https://graph.qq.com/user/get_user_info",
+		Scopes:      "get_user_info",
+		UserMapping: map[string]string{
+			"id": "openid", "username": "nickname", "displayName": "nickname", "avatar": "figureurl_qq_2",
+		},
+		DisablePkce: true,
+	},
+	"WeChat": {
+		AuthUrl:     "https://open.weixin.qq.com/connect/qrconnect",
+		TokenUrl:    "https://api.weixin.qq.com/sns/oauth2/access_token",
+		UserInfoUrl: "https://api.weixin.qq.com/sns/userinfo",
+		Scopes:      "snsapi_login",
+		UserMapping: map[string]string{
+			"id": "openid", "username": "nickname", "displayName": "nickname", "avatar": "headimgurl",
+		},
+		DisablePkce: true,
+	},
+}
+
+// Endpoints that are not configurable because no other provider uses them
+var (
+	githubEmailsUrl = "https://api.github.com/user/emails"
+	qqOpenIdUrl     = "https://graph.qq.com/oauth2.0/me"
+)
+
+// defaultUserMapping maps the attributes of providers without a preset to standard OIDC claims
+var defaultUserMapping = map[string]string{
+	"id": "sub", "username": "preferred_username", "displayName": "name",
+	"email": "email", "emailVerified": "email_verified", "avatar": "picture",
+}
+
+// ProviderUser is the upstream account after attribute mapping
+type ProviderUser struct {
+	Id            string `json:"id"`
+	Username      string `json:"username"`
+	DisplayName   string `json:"displayName"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	Avatar        string `json:"avatar"`
+}
+
+// withProviderPreset returns a copy of the provider with preset values for every empty setting.
+// Explicit mapping entries override the preset mapping attribute by attribute.
+func withProviderPreset(provider *models.Provider) (*models.Provider, bool) {
+	resolved := *provider
+	preset, ok := providerPresets[provider.Type]
+	if !ok {
+		preset = providerPreset{UserMapping: defaultUserMapping}
+	}
+
+	if resolved.AuthUrl == "" {
+		resolved.AuthUrl = preset.AuthUrl
+	}
+	if resolved.TokenUrl == "" {
+		resolved.TokenUrl = preset.TokenUrl
+	}
+	if resolved.UserInfoUrl == "" {
+		resolved.UserInfoUrl = preset.UserInfoUrl
+	}
+	if resolved.Scopes == "" {
+		resolved.Scopes = preset.Scopes
+	}
+
+	resolved.UserMapping = map[string]string{}
+	for attribute, field := range preset.UserMapping {
+		resolved.UserMapping[attribute] = field
+	}
+	for attribute, field := range provider.UserMapping {
+		if field != "" {
+			resolved.UserMapping[attribute] = field
+		}
+	}
+
+	return &resolved, !preset.DisablePkce
+}
+
+// providerSession is the server-side state of a provider sign-in, keyed by the OAuth state
+// while at the provider and by a one-time ticket once the frontend picks up the result
+type providerSession struct {
+	Purpose   string `json:"purpose"`
+	Provider  string `json:"provider"`
+	Verifier  string `json:"verifier,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	UserId    int64  `json:"userId,omitempty"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// providerSessions holds sign-in state in process when Redis is not configured
+var providerSessions = struct {
+	sync.Mutex
+	entries map[string]*providerSession
+}{entries: map[string]*providerSession{}}
+
+func saveProviderSession(session *providerSession) (string, error) {
+	sessionId := models.GenerateRandomString(32)
+	session.ExpiresAt = time.Now().Add(providerSessionTimeout).Unix()
+
+	if redisClient != nil {
+		data, err := json.Marshal(session)
+		if err != nil {
+			return "", err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+		defer cancel()
+		if redisClient.Set(ctx, fmt.Sprintf("provider:%s", sessionId), data, providerSessionTimeout).Err() == nil {
+			return sessionId, nil
+		}
+	}
+
+	now := time.Now().Unix()
+	providerSessions.Lock()
+	defer providerSessions.Unlock()
+	for id, entry := range providerSessions.entries {
+		if now > entry.ExpiresAt {
+			delete(providerSessions.entries, id)
+		}
+	}
+	providerSessions.entries[sessionId] = session
+	return sessionId, nil
+}
+
+// takeProviderSession returns and removes a session, so each state and ticket is used only once
+func takeProviderSession(sessionId string, purposes ...string) (*providerSession, error) {
+	if sessionId == "" {
+		return nil, ErrProviderStateInvalid
+	}
+
+	var session *providerSession
+	if redisClient != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+		defer cancel()
+		data, err := redisClient.GetDel(ctx, fmt.Sprintf("provider:%s", sessionId)).Bytes()
+		if err == nil {
+			session = &providerSession{}
+			if json.Unmarshal(data, session) != nil {
+				session = nil
+			}
+		}
+	}
+
+	if session == nil {
+		providerSessions.Lock()
+		session = providerSessions.entries[sessionId]
+		delete(providerSessions.entries, sessionId)
+		providerSessions.Unlock()
+	}
+
+	if session == nil || !containsString(purposes, session.Purpose) || time.Now().Unix() > session.ExpiresAt {
+		return nil, ErrProviderStateInvalid
+	}
+	return session, nil
+}
+
+// ProviderCallbackUrl returns the redirect URI registered at the provider
+func ProviderCallbackUrl(provider *models.Provider) string {
+	origin := os.Getenv("ORIGIN")
+	if origin == "" {
+		origin = "http://localhost:8080"
+	}
+	return fmt.Sprintf("%s/api/auth/provider/%s/callback", strings.TrimRight(origin, "/"), url.PathEscape(provider.Name))
+}
+
+// ProviderFrontendUrl returns a frontend page URL for the result of a provider sign-in
+func ProviderFrontendUrl(path string, query url.Values) string {
+	if len(query) == 0 {
+		return frontendOrigin() + path
+	}
+	return fmt.Sprintf("%s%s?%s", frontendOrigin(), path, query.Encode())
+}
+
+// BeginProviderLogin returns the provider authorization URL for a sign-in, or for linking
+// the upstream account to the given user when userId is not zero
+func BeginProviderLogin(provider *models.Provider, userId int64) (string, error) {
+	resolved, pkce := withProviderPreset(provider)
+	session := &providerSession{Purpose: providerPurposeLogin, Provider: provider.Name}
+	if provider.Category == models.ProviderCategoryOidc {
+		if _, err := withOidcDiscovery(resolved); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrProviderNotConfigured, err)
+		}
+		session.Nonce = models.GenerateRandomString(32)
+	}
+	if resolved.AuthUrl == "" || resolved.TokenUrl == "" || resolved.ClientId == "" {
+		return "", ErrProviderNotConfigured
+	}
+
+	if userId != 0 {
+		session.Purpose = providerPurposeLink
+		session.UserId = userId
+	}
+
+	challenge := ""
+	if pkce {
+		session.Verifier = models.GenerateRandomString(64)
+		digest := sha256.Sum256([]byte(session.Verifier))
+		challenge = base64.RawURLEncoding.EncodeToString(digest[:])
+	}
+
+	state, err := saveProviderSession(session)
+	if err != nil {
+		return "", err
+	}
+	return providerAuthUrl(resolved, state, challenge, session.Nonce)
+}
+
+// providerAuthUrl builds the authorization request to the provider
+func providerAuthUrl(provider *models.Provider, state, challenge, nonce string) (string, error) {
+	authUrl, err := url.Parse(provider.AuthUrl)
+	if err != nil {
+		return "", ErrProviderNotConfigured
+	}
+
+	query := authUrl.Query()
+	if provider.Type == "WeChat" {
+		query.Set("appid", provider.ClientId)
+	} else {
+		query.Set("client_id", provider.ClientId)
+	}
+	query.Set("redirect_uri", ProviderCallbackUrl(provider))
+	query.Set("response_type", "code")
+	if provider.Scopes != "" {
+		query.Set("scope", provider.Scopes)
+	}
+	query.Set("state", state)
+	if challenge != "" {
+		query.Set("code_challenge", challenge)
+		query.Set("code_challenge_method", "S256")
+	}
+	if nonce != "" {
+		query.Set("nonce", nonce)
+	}
+	authUrl.RawQuery = query.Encode()
+
+	// WeChat only accepts the request with this fragment
+	if provider.Type == "WeChat" {
+		authUrl.Fragment = "wechat_redirect"
+	}
+	return authUrl.String(), nil
+}
+
+// FinishProviderLogin redeems the authorization code returned to the callback, fetches the
+// upstream account and resolves the local user. The state is single use. The returned flag
+// tells whether the sign-in was started to link the account to a signed-in user.
+func FinishProviderLogin(provider *models.Provider, state, code string) (*models.User, bool, error) {
+	session, err := takeProviderSession(state, providerPurposeLogin, providerPurposeLink)
+	if err != nil {
+		return nil, false, err
+	}
+	link := session.Purpose == providerPurposeLink
+	if session.Provider != provider.Name || code == "" {
+		return nil, link, ErrProviderStateInvalid
+	}
+
+	resolved, _ := withProviderPreset(provider)
+	var discovery *OidcDiscovery
+	if provider.Category == models.ProviderCategoryOidc {
+		if discovery, err = withOidcDiscovery(resolved); err != nil {
+			return nil, link, fmt.Errorf("%w: %v", ErrProviderNotConfigured, err)
+		}
+	}
+
+	clientSecret := ""
+	if resolved.ClientSecret != "" {
+		if clientSecret, err = DecryptData(resolved.ClientSecret); err != nil {
+			return nil, link, ErrProviderNotConfigured
+		}
+	}
+
+	token, err := exchangeProviderCode(resolved, clientSecret, code, session.Verifier)
+	if err != nil {
+		return nil, link, err
+	}
+
+	var info map[string]interface{}
+	if discovery != nil {
+		info, err = fetchOidcUserInfo(resolved, discovery, token, session.Nonce)
+	} else {
+		info, err = fetchProviderUserInfo(resolved, token)
+	}
+	if err != nil {
+		return nil, link, err
+	}
+
+	upstream := mapProviderUser(resolved.UserMapping, info)
+	if upstream.Id == "" {
+		return nil, link, ErrProviderUserInvalid
+	}
+
+	user, err := resolveProviderUser(provider, session, upstream)
+	return user, link, err
+}
+
+// exchangeProviderCode exchanges the authorization code for the provider's token response
+func exchangeProviderCode(provider *models.Provider, clientSecret, code, verifier string) (map[string]interface{}, error) {
+	params := url.Values{}
+	params.Set("grant_type", "authorization_code")
+	params.Set("code", code)
+
+	var req *http.Request
+	var err error
+	switch provider.Type {
+	case "WeChat":
+		params.Set("appid", provider.ClientId)
+		params.Set("secret", clientSecret)
+		req, err = http.NewRequest(http.MethodGet, withQuery(provider.TokenUrl, params), nil)
+	case "QQ":
+		params.Set("client_id", provider.ClientId)
+		params.Set("client_secret", clientSecret)
+		params.Set("redirect_uri", ProviderCallbackUrl(provider))
+		params.Set("fmt", "json")
+		req, err = http.NewRequest(http.MethodGet, withQuery(provider.TokenUrl, params), nil)
+	default:
+		params.Set("redirect_uri", ProviderCallbackUrl(provider))
+		params.Set("client_id", provider.ClientId)
+		params.Set("client_secret", clientSecret)
+		if verifier != "" {
+			params.Set("code_verifier", verifier)
+		}
+		req, err = http.NewRequest(http.MethodPost, provider.TokenUrl, strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return nil, ErrProviderNotConfigured
+	}
+
+	token, err := providerJsonObject(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %v", err)
+	}
+	if claimString(token["access_token"]) == "" {
+		return nil, fmt.Errorf("token request failed: no access token in response")
+	}
+	return token, nil
+}
+
+// fetchProviderUserInfo fetches the upstream account with the access token
+func fetchProviderUserInfo(provider *models.Provider, token map[string]interface{}) (map[string]interface{}, error) {
+	accessToken := claimString(token["access_token"])
+
+	switch provider.Type {
+	case "WeChat":
+		params := url.Values{"access_token": {accessToken}, "openid": {claimString(token["openid"])}}
+		req, err := http.NewRequest(http.MethodGet, withQuery(provider.UserInfoUrl, params), nil)
+		if err != nil {
+			return nil, ErrProviderNotConfigured
+		}
+		return providerJsonObject(req)
+
+	case "QQ":
+		// QQ returns the account ID from a separate endpoint
+		req, err := http.NewRequest(http.MethodGet, withQuery(qqOpenIdUrl, url.Values{"access_token": {accessToken}, "fmt": {"json"}}), nil)
+		if err != nil {
+			return nil, err
+		}
+		me, err := providerJsonObject(req)
+		if err != nil {
+			return nil, err
+		}
+		openId := claimString(me["openid"])
+
+		params := url.Values{"access_token": {accessToken}, "oauth_consumer_key": {provider.ClientId}, "openid": {openId}}
+		req, err = http.NewRequest(http.MethodGet, withQuery(provider.UserInfoUrl, params), nil)
+		if err != nil {
+			return nil, ErrProviderNotConfigured
+		}
+		info, err := providerJsonObject(req)
+		if err != nil {
+			return nil, err
+		}
+		if ret := claimString(info["ret"]); ret != "" && ret != "0" {
+			return nil, fmt.Errorf("provider returned error %s: %s", ret, claimString(info["msg"]))
+		}
+		info["openid"] = openId
+		return info, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, provider.UserInfoUrl, nil)
+	if err != nil {
+		return nil, ErrProviderNotConfigured
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	info, err := providerJsonObject(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The GitHub profile only shows a public email, which need not be verified
+	if provider.Type == "GitHub" {
+		delete(info, "email")
+		if email := githubPrimaryEmail(accessToken); email != "" {
+			info["email"] = email
+			info["email_verified"] = true
+		}
+	}
+	return info, nil
+}
+
+// githubPrimaryEmail returns the primary email of a GitHub account if it is verified
+func githubPrimaryEmail(accessToken string) string {
+	req, err := http.NewRequest(http.MethodGet, githubEmailsUrl, nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	body, err := providerJson(req)
+	if err != nil {
+		return ""
+	}
+	emails, _ := body.([]interface{})
+	for _, entry := range emails {
+		email, _ := entry.(map[string]interface{})
+		if email["primary"] == true && email["verified"] == true {
+			return claimString(email["email"])
+		}
+	}
+	return ""
+}
+
+// providerJson sends a request to the provider and decodes the JSON response
+func providerJson(req *http.Request) (interface{}, error) {
+	req.Header.Set("Accept", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("provider returned status %d", resp.StatusCode)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	var body interface{}
+	if err := decoder.Decode(&body); err != nil {
+		return nil, fmt.Errorf("provider returned invalid JSON: %v", err)
+	}
+	return body, nil
+}
+
+// providerJsonObject decodes a JSON object response and surfaces OAuth and WeChat style errors
+func providerJsonObject(req *http.Request) (map[string]interface{}, error) {
+	body, err := providerJson(req)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := body.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("provider returned unexpected JSON")
+	}
+
+	if message := claimString(object["error"]); message != "" {
+		return nil, fmt.Errorf("provider returned error %s: %s", message, claimString(object["error_description"]))
+	}
+	if code := claimString(object["errcode"]); code != "" && code != "0" {
+		return nil, fmt.Errorf("provider returned error %s: %s", code, claimString(object["errmsg"]))
+	}
+	return object, nil
+}
+
+// withQuery appends parameters to a URL that may already have a query
+func withQuery(rawUrl string, params url.Values) string {
+	if strings.Contains(rawUrl, "?") {
+		return rawUrl + "&" + params.Encode()
+	}
+	return rawUrl + "?" + params.Encode()
+}
+
+// mapProviderUser applies the attribute mapping to the upstream userinfo
+func mapProviderUser(mapping map[string]string, info map[string]interface{}) *ProviderUser {
+	value := func(attribute string) string {
+		if field := mapping[attribute]; field != "" {
+			return claimString(lookupClaim(info, field))
+		}
+		return ""
+	}
+
+	user := &ProviderUser{
+		Id:          value("id"),
+		Username:    value("username"),
+		DisplayName: value("displayName"),
+		Email:       value("email"),
+		Avatar:      value("avatar"),
+	}
+	user.EmailVerified = user.Email != "" && value("emailVerified") == "true"
+	return user
+}
+
+// lookupClaim resolves a dotted path such as "data.user.id" in a JSON object
+func lookupClaim(info map[string]interface{}, path string) interface{} {
+	var current interface{} = info
+	for _, key := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = object[key]
+	}
+	return current
+}
+
+// claimString converts a JSON value to a string; numeric IDs keep all their digits
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// providerOrganization returns the organization new users of the provider are provisioned into
+func providerOrganization(provider *models.Provider) string {
+	if provider.Organization != "" {
+		return provider.Organization
+	}
+	return "built-in"
+}
+
+// resolveProviderUser finds, links or creates the local user for an upstream account.
+// Whether a sign-in attaches to an existing account with the same verified email is decided by
+// the provider's EmailLinking rule; by default the owner has to sign in and link first.
+func resolveProviderUser(provider *models.Provider, session *providerSession, upstream *ProviderUser) (*models.User, error) {
+	identity, err := models.GetUserIdentityBySubject(provider.Name, upstream.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Purpose == providerPurposeLink {
+		user, err := models.GetUserById(session.UserId)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			return nil, ErrProviderStateInvalid
+		}
+		if identity != nil && identity.UserId != user.Id {
+			return nil, ErrProviderIdentityLinked
+		}
+		if identity == nil {
+			_, err = models.AddUserIdentity(newUserIdentity(user, provider, upstream))
+			return user, err
+		}
+		return user, updateUserIdentity(identity, upstream)
+	}
+
+	if identity != nil {
+		user, err := models.GetUserById(identity.UserId)
+		if err != nil {
+			return nil, err
+		}
+		if user != nil {
+			return user, updateUserIdentity(identity, upstream)
+		}
+		// The user was removed; the stale link is replaced by a new account
+		if _, err = models.DeleteUserIdentity(identity.Owner, identity.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	existingUser, email, err := providerEmailMatch(provider, upstream)
+	if err != nil {
+		return nil, err
+	}
+	if existingUser != nil {
+		_, err = models.AddUserIdentity(newUserIdentity(existingUser, provider, upstream))
+		return existingUser, err
+	}
+
+	organization, err := models.GetOrganization("admin", providerOrganization(provider))
+	if err != nil {
+		return nil, err
+	}
+	if organization != nil && !organization.EnableSignUp {
+		return nil, ErrProviderSignupDisabled
+	}
+
+	return createProviderUser(provider, upstream, email)
+}
+
+// providerEmailMatch applies the EmailLinking rule to an upstream account that has no link yet.
+// It returns the existing user to link to, or the email to copy to a new account; only a
+// verified email is copied or used to find an existing account.
+func providerEmailMatch(provider *models.Provider, upstream *ProviderUser) (*models.User, string, error) {
+	if !upstream.EmailVerified {
+		return nil, "", nil
+	}
+
+	existingUser, err := models.GetUserByEmail(upstream.Email)
+	if err != nil {
+		return nil, "", err
+	}
+	if existingUser == nil {
+		return nil, upstream.Email, nil
+	}
+
+	switch provider.EmailLinking {
+	case models.ProviderEmailLinkingLink:
+		// Administrators and accounts of other organizations are never taken over this way
+		if existingUser.IsAdmin || existingUser.Owner != providerOrganization(provider) {
+			return nil, "", ErrProviderEmailTaken
+		}
+		return existingUser, "", nil
+	case models.ProviderEmailLinkingIgnore:
+		return nil, "", nil
+	default:
+		return nil, "", ErrProviderEmailTaken
+	}
+}
+
+// createProviderUser creates a local user for an upstream account and links the two
+func createProviderUser(provider *models.Provider, upstream *ProviderUser, email string) (*models.User, error) {
+	username := upstream.Username
+	if username == "" {
+		username = upstream.DisplayName
+	}
+	if username == "" {
+		username = fmt.Sprintf("%s_%s", strings.ToLower(provider.Type), upstream.Id)
+	}
+	if runes := []rune(username); len(runes) > 50 {
+		username = string(runes[:50])
+	}
+	owner := providerOrganization(provider)
+	username, err := availableUsername(owner, username)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	user := &models.User{
+		Owner:         owner,
+		CreatedTime:   now,
+		UpdatedTime:   now,
+		Type:          "normal-user",
+		Username:      username,
+		Email:         email,
+		EmailVerified: email != "", // Only an email the provider verified is copied
+		Avatar:        upstream.Avatar,
+	}
+	if _, err := models.AddUser(user); err != nil {
+		return nil, err
+	}
+
+	_, err = models.AddUserIdentity(newUserIdentity(user, provider, upstream))
+	return user, err
+}
+
+func newUserIdentity(user *models.User, provider *models.Provider, upstream *ProviderUser) *models.UserIdentity {
+	now := models.GetCurrentTime()
+	return &models.UserIdentity{
+		Owner:        user.Owner,
+		Name:         fmt.Sprintf("identity_%s", models.GenerateRandomString(16)),
+		CreatedTime:  now,
+		UserId:       user.Id,
+		Provider:     provider.Name,
+		Subject:      upstream.Id,
+		Username:     upstream.Username,
+		Email:        upstream.Email,
+		Avatar:       upstream.Avatar,
+		LastUsedTime: now,
+	}
+}
+
+func updateUserIdentity(identity *models.UserIdentity, upstream *ProviderUser) error {
+	identity.Username = upstream.Username
+	identity.Email = upstream.Email
+	identity.Avatar = upstream.Avatar
+	_, err := models.UpdateUserIdentityProfile(identity)
+	return err
+}
+
+// CreateProviderLoginTicket stores the result of a provider sign-in under a one-time ticket
+// that the frontend exchanges for tokens, so tokens never appear in a redirect URL
+func CreateProviderLoginTicket(user *models.User, provider *models.Provider) (string, error) {
+	return saveProviderSession(&providerSession{
+		Purpose:  providerPurposeResult,
+		Provider: provider.Name,
+		UserId:   user.Id,
+	})
+}
+
+// RedeemProviderLoginTicket returns the user of a provider sign-in ticket and consumes the ticket
+func RedeemProviderLoginTicket(ticket string) (*models.User, error) {
+	session, err := takeProviderSession(ticket, providerPurposeResult)
+	if err != nil {
+		return nil, err
+	}
+	user, err := models.GetUserById(session.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrProviderStateInvalid
+	}
+	return user, nil
+}
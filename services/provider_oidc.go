@@ -0,0 +1,273 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oauth-server/oauth-server/models"
+)
+
+const (
+	// OidcDiscoveryCacheExpiration bounds how long an upstream discovery document and JWKS are reused
+	OidcDiscoveryCacheExpiration = time.Hour
+	// oidcJwksRefreshInterval limits refetching the JWKS for an unknown kid, which happens after key rotation
+	oidcJwksRefreshInterval = time.Minute
+	// oidcClockSkew is the leeway for exp, iat and nbf of upstream ID tokens
+	oidcClockSkew = time.Minute
+
+	defaultOidcScopes = "openid email profile"
+)
+
+var ErrIdTokenInvalid = fmt.Errorf("the provider returned an invalid id token")
+
+// oidcSigningMethods are the ID token algorithms accepted from upstream providers.
+// HS256 is not accepted because it would make the client secret a verification key.
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// OidcDiscovery is the subset of OpenID Provider Metadata used for federation
+type OidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcProviderCacheEntry struct {
+	discovery     *OidcDiscovery
+	fetchedAt     time.Time
+	keySet        *JsonWebKeySet
+	keysFetchedAt time.Time
+}
+
+var (
+	oidcProviderCache   = make(map[string]*oidcProviderCacheEntry)
+	oidcProviderCacheMu sync.Mutex
+)
+
+// normalizeIssuer drops a trailing slash so that configured and published issuers compare equal
+func normalizeIssuer(issuer string) string {
+	return strings.TrimRight(strings.TrimSpace(issuer), "/")
+}
+
+// GetOidcDiscovery returns the discovery document of an issuer, caching it for OidcDiscoveryCacheExpiration
+func GetOidcDiscovery(issuer string) (*OidcDiscovery, error) {
+	issuer = normalizeIssuer(issuer)
+	if issuer == "" {
+		return nil, ErrProviderNotConfigured
+	}
+
+	oidcProviderCacheMu.Lock()
+	entry, ok := oidcProviderCache[issuer]
+	oidcProviderCacheMu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < OidcDiscoveryCacheExpiration {
+		return entry.discovery, nil
+	}
+
+	var discovery OidcDiscovery
+	if err := getProviderJson(issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("failed to fetch discovery document: %v", err)
+	}
+	// The published issuer must be the one configured (OIDC Discovery §4.3)
+	if normalizeIssuer(discovery.Issuer) != issuer {
+		return nil, fmt.Errorf("discovery document issuer %q does not match %q", discovery.Issuer, issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksUri == "" {
+		return nil, fmt.Errorf("discovery document is missing required endpoints")
+	}
+
+	oidcProviderCacheMu.Lock()
+	oidcProviderCache[issuer] = &oidcProviderCacheEntry{discovery: &discovery, fetchedAt: time.Now()}
+	oidcProviderCacheMu.Unlock()
+
+	return &discovery, nil
+}
+
+// getOidcSigningKey returns the issuer key for a kid. The cached JWKS is refetched when it expired
+// or, at most once per oidcJwksRefreshInterval, when the kid is unknown.
+func getOidcSigningKey(discovery *OidcDiscovery, kid string) (*JsonWebKey, error) {
+	issuer := normalizeIssuer(discovery.Issuer)
+
+	oidcProviderCacheMu.Lock()
+	entry, ok := oidcProviderCache[issuer]
+	if !ok {
+		entry = &oidcProviderCacheEntry{discovery: discovery, fetchedAt: time.Now()}
+		oidcProviderCache[issuer] = entry
+	}
+	keySet := entry.keySet
+	expired := keySet == nil || time.Since(entry.keysFetchedAt) >= OidcDiscoveryCacheExpiration
+	oidcProviderCacheMu.Unlock()
+
+	if !expired {
+		if key := findSigningKey(keySet, kid); key != nil {
+			return key, nil
+		}
+		oidcProviderCacheMu.Lock()
+		canRefresh := time.Since(entry.keysFetchedAt) >= oidcJwksRefreshInterval
+		oidcProviderCacheMu.Unlock()
+		if !canRefresh {
+			return nil, fmt.Errorf("no signing key matches kid %q", kid)
+		}
+	}
+
+	keySet = &JsonWebKeySet{}
+	if err := getProviderJson(discovery.JwksUri, keySet); err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks: %v", err)
+	}
+
+	oidcProviderCacheMu.Lock()
+	entry.keySet = keySet
+	entry.keysFetchedAt = time.Now()
+	oidcProviderCacheMu.Unlock()
+
+	if key := findSigningKey(keySet, kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no signing key matches kid %q", kid)
+}
+
+// findSigningKey returns the signature key with the kid, or the only signature key when kid is empty
+func findSigningKey(keySet *JsonWebKeySet, kid string) *JsonWebKey {
+	var match *JsonWebKey
+	for i := range keySet.Keys {
+		key := &keySet.Keys[i]
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if kid != "" {
+			if key.Kid == kid {
+				return key
+			}
+			continue
+		}
+		if match != nil {
+			return nil
+		}
+		match = key
+	}
+	return match
+}
+
+// withOidcDiscovery fills the empty endpoints and scopes of an OIDC provider from its discovery document
+func withOidcDiscovery(provider *models.Provider) (*OidcDiscovery, error) {
+	discovery, err := GetOidcDiscovery(provider.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if provider.AuthUrl == "" {
+		provider.AuthUrl = discovery.AuthorizationEndpoint
+	}
+	if provider.TokenUrl == "" {
+		provider.TokenUrl = discovery.TokenEndpoint
+	}
+	if provider.UserInfoUrl == "" {
+		provider.UserInfoUrl = discovery.UserinfoEndpoint
+	}
+	if provider.Scopes == "" {
+		provider.Scopes = defaultOidcScopes
+	}
+	return discovery, nil
+}
+
+// verifyIdToken validates an upstream ID token (OIDC Core §3.1.3.7): the signature against the
+// issuer JWKS, iss, aud and azp against the client, exp and iat, and the nonce of the sign-in
+func verifyIdToken(provider *models.Provider, discovery *OidcDiscovery, rawIdToken, nonce string) (jwt.MapClaims, error) {
+	if rawIdToken == "" {
+		return nil, fmt.Errorf("%w: no id_token in token response", ErrIdTokenInvalid)
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawIdToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := getOidcSigningKey(discovery, kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.Alg != "" && key.Alg != token.Method.Alg() {
+			return nil, fmt.Errorf("key %q is not for %s", key.Kid, token.Method.Alg())
+		}
+		if key.Kty == "EC" {
+			return key.ECPublicKey()
+		}
+		return key.RSAPublicKey()
+	},
+		jwt.WithValidMethods(oidcSigningMethods),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(provider.ClientId),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(oidcClockSkew),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIdTokenInvalid, err)
+	}
+
+	// With several audiences the token must be issued to this client
+	audience, _ := claims.GetAudience()
+	if azp, _ := claims["azp"].(string); (len(audience) > 1 || azp != "") && azp != provider.ClientId {
+		return nil, fmt.Errorf("%w: azp does not match the client", ErrIdTokenInvalid)
+	}
+	if claimNonce, _ := claims["nonce"].(string); claimNonce == "" || claimNonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrIdTokenInvalid)
+	}
+	if subject, _ := claims.GetSubject(); subject == "" {
+		return nil, fmt.Errorf("%w: no sub claim", ErrIdTokenInvalid)
+	}
+	return claims, nil
+}
+
+// fetchOidcUserInfo verifies the ID token and adds userinfo claims it does not contain.
+// Userinfo is ignored when its sub differs from the ID token (OIDC Core §5.3.2).
+func fetchOidcUserInfo(provider *models.Provider, discovery *OidcDiscovery, token map[string]interface{}, nonce string) (map[string]interface{}, error) {
+	rawIdToken, _ := token["id_token"].(string)
+	claims, err := verifyIdToken(provider, discovery, rawIdToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	info := map[string]interface{}(claims)
+	if provider.UserInfoUrl == "" {
+		return info, nil
+	}
+
+	userInfo, err := fetchProviderUserInfo(provider, token)
+	if err != nil || claimString(userInfo["sub"]) != claimString(info["sub"]) {
+		return info, nil
+	}
+	for name, value := range userInfo {
+		if _, ok := info[name]; !ok {
+			info[name] = value
+		}
+	}
+	return info, nil
+}
+
+// getProviderJson fetches a JSON document from a provider into v
+func getProviderJson(rawUrl string, v interface{}) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(rawUrl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,304 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// mockOidcProvider serves discovery, JWKS, token and userinfo endpoints of an upstream issuer
+type mockOidcProvider struct {
+	server        *httptest.Server
+	rsaKey        *rsa.PrivateKey
+	ecKey         *ecdsa.PrivateKey
+	keys          []JsonWebKey
+	idToken       string
+	discoveryHits int32
+	jwksHits      int32
+}
+
+func newMockOidcProvider(t *testing.T) *mockOidcProvider {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+
+	m := &mockOidcProvider{rsaKey: rsaKey, ecKey: ecKey}
+	m.keys = []JsonWebKey{
+		{
+			Kty: "RSA", Use: "sig", Kid: "rsa-1", Alg: "RS256",
+			N: base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		},
+		{
+			Kty: "EC", Use: "sig", Kid: "ec-1", Crv: "P-256",
+			X: base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+			Y: base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+	}
+
+	m.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			atomic.AddInt32(&m.discoveryHits, 1)
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 m.server.URL,
+				"authorization_endpoint": m.server.URL + "/authorize",
+				"token_endpoint":         m.server.URL + "/token",
+				"userinfo_endpoint":      m.server.URL + "/userinfo",
+				"jwks_uri":               m.server.URL + "/jwks",
+			})
+		case "/jwks":
+			atomic.AddInt32(&m.jwksHits, 1)
+			json.NewEncoder(w).Encode(JsonWebKeySet{Keys: m.keys})
+		case "/token":
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "upstream-token", "token_type": "Bearer", "id_token": m.idToken})
+		case "/userinfo":
+			json.NewEncoder(w).Encode(map[string]interface{}{"sub": "partner-user", "preferred_username": "carol", "email": "other@example.com"})
+		}
+	}))
+	t.Cleanup(m.server.Close)
+	t.Cleanup(func() {
+		oidcProviderCacheMu.Lock()
+		delete(oidcProviderCache, m.server.URL)
+		oidcProviderCacheMu.Unlock()
+	})
+	return m
+}
+
+// sign issues an ID token with the claims, overriding the defaults of a valid token
+func (m *mockOidcProvider) sign(t *testing.T, method jwt.SigningMethod, kid string, overrides jwt.MapClaims) string {
+	t.Helper()
+	claims := jwt.MapClaims{
+		"iss":            m.server.URL,
+		"sub":            "partner-user",
+		"aud":            "partner-client",
+		"exp":            time.Now().Add(5 * time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          "the-nonce",
+		"email":          "carol@partner.example.com",
+		"email_verified": true,
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	var key interface{} = m.rsaKey
+	switch method.(type) {
+	case *jwt.SigningMethodECDSA:
+		key = m.ecKey
+	case *jwt.SigningMethodHMAC:
+		key = []byte("client-secret")
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign id token: %v", err)
+	}
+	return signed
+}
+
+func (m *mockOidcProvider) provider() *models.Provider {
+	return &models.Provider{
+		Name: "partner", Category: models.ProviderCategoryOidc, Type: "OIDC",
+		ClientId: "partner-client", Issuer: m.server.URL + "/",
+	}
+}
+
+// TestOidcDiscovery tests that discovery is cached and must publish the configured issuer
+func TestOidcDiscovery(t *testing.T) {
+	m := newMockOidcProvider(t)
+
+	provider := m.provider()
+	discovery, err := withOidcDiscovery(provider)
+	if err != nil {
+		t.Fatalf("withOidcDiscovery failed: %v", err)
+	}
+	if provider.AuthUrl != m.server.URL+"/authorize" || provider.Scopes != defaultOidcScopes || discovery.JwksUri != m.server.URL+"/jwks" {
+		t.Errorf("Unexpected resolved provider: %+v", provider)
+	}
+
+	if _, err := GetOidcDiscovery(m.server.URL); err != nil {
+		t.Fatalf("GetOidcDiscovery failed: %v", err)
+	}
+	if hits := atomic.LoadInt32(&m.discoveryHits); hits != 1 {
+		t.Errorf("Expected discovery to be fetched once, got %d", hits)
+	}
+
+	// An issuer that publishes a different issuer value is rejected
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer": "https://evil.example.com", "authorization_endpoint": "a", "token_endpoint": "t", "jwks_uri": "j",
+		})
+	}))
+	defer other.Close()
+	if _, err := GetOidcDiscovery(other.URL); err == nil {
+		t.Errorf("Expected mismatched issuer to be rejected")
+	}
+}
+
+// TestVerifyIdToken tests the signature, issuer, audience, expiry and nonce checks
+func TestVerifyIdToken(t *testing.T) {
+	m := newMockOidcProvider(t)
+	provider := m.provider()
+	discovery, err := withOidcDiscovery(provider)
+	if err != nil {
+		t.Fatalf("withOidcDiscovery failed: %v", err)
+	}
+
+	claims, err := verifyIdToken(provider, discovery, m.sign(t, jwt.SigningMethodRS256, "rsa-1", nil), "the-nonce")
+	if err != nil {
+		t.Fatalf("Expected valid RS256 token, got %v", err)
+	}
+	if claims["sub"] != "partner-user" {
+		t.Errorf("Unexpected claims: %v", claims)
+	}
+	if _, err := verifyIdToken(provider, discovery, m.sign(t, jwt.SigningMethodES256, "ec-1", nil), "the-nonce"); err != nil {
+		t.Errorf("Expected valid ES256 token, got %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		nonce  string
+		reason string
+	}{
+		{"wrong nonce", m.sign(t, jwt.SigningMethodRS256, "rsa-1", nil), "other-nonce", "nonce"},
+		{"missing nonce", m.sign(t, jwt.SigningMethodRS256, "rsa-1", jwt.MapClaims{"nonce": nil}), "the-nonce", "nonce"},
+		{"wrong audience", m.sign(t, jwt.SigningMethodRS256, "rsa-1", jwt.MapClaims{"aud": "another-client"}), "the-nonce", "aud"},
+		{"foreign azp", m.sign(t, jwt.SigningMethodRS256, "rsa-1", jwt.MapClaims{"aud": []string{"partner-client", "api"}, "azp": "api"}), "the-nonce", "azp"},
+		{"multiple audiences without azp", m.sign(t, jwt.SigningMethodRS256, "rsa-1", jwt.MapClaims{"aud": []string{"partner-client", "api"}}), "the-nonce", "azp"},
+		{"wrong issuer", m.sign(t, jwt.SigningMethodRS256, "rsa-1", jwt.MapClaims{"iss": "https://evil.example.com"}), "the-nonce", "iss"},
+		{"expired", m.sign(t, jwt.SigningMethodRS256, "rsa-1", jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), "the-nonce", "exp"},
+		{"no expiry", m.sign(t, jwt.SigningMethodRS256, "rsa-1", jwt.MapClaims{"exp": nil}), "the-nonce", "exp"},
+		{"symmetric algorithm", m.sign(t, jwt.SigningMethodHS256, "rsa-1", nil), "the-nonce", "alg"},
+		{"key of another algorithm", m.sign(t, jwt.SigningMethodRS512, "rsa-1", nil), "the-nonce", "alg"},
+		{"tampered", m.sign(t, jwt.SigningMethodRS256, "rsa-1", nil) + "x", "the-nonce", "signature"},
+		{"empty", "", "the-nonce", "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verifyIdToken(provider, discovery, tt.token, tt.nonce)
+			if !errors.Is(err, ErrIdTokenInvalid) {
+				t.Errorf("Expected %s to be rejected, got %v", tt.reason, err)
+			}
+		})
+	}
+}
+
+// TestOidcKeyRotation tests that an unknown kid refetches the JWKS, but not more than once per interval
+func TestOidcKeyRotation(t *testing.T) {
+	m := newMockOidcProvider(t)
+	provider := m.provider()
+	discovery, err := withOidcDiscovery(provider)
+	if err != nil {
+		t.Fatalf("withOidcDiscovery failed: %v", err)
+	}
+	if _, err := verifyIdToken(provider, discovery, m.sign(t, jwt.SigningMethodRS256, "rsa-1", nil), "the-nonce"); err != nil {
+		t.Fatalf("verifyIdToken failed: %v", err)
+	}
+
+	// The issuer rotates to a new kid
+	m.keys[0].Kid = "rsa-2"
+	token := m.sign(t, jwt.SigningMethodRS256, "rsa-2", nil)
+	if _, err := verifyIdToken(provider, discovery, token, "the-nonce"); err == nil {
+		t.Errorf("Expected the JWKS not to be refetched within the refresh interval")
+	}
+
+	oidcProviderCacheMu.Lock()
+	oidcProviderCache[m.server.URL].keysFetchedAt = time.Now().Add(-2 * oidcJwksRefreshInterval)
+	oidcProviderCacheMu.Unlock()
+	if _, err := verifyIdToken(provider, discovery, token, "the-nonce"); err != nil {
+		t.Errorf("Expected the rotated key to be fetched, got %v", err)
+	}
+	if hits := atomic.LoadInt32(&m.jwksHits); hits != 2 {
+		t.Errorf("Expected 2 JWKS fetches, got %d", hits)
+	}
+}
+
+// TestOidcProviderLogin tests the nonce round trip and that ID token claims take precedence over userinfo
+func TestOidcProviderLogin(t *testing.T) {
+	m := newMockOidcProvider(t)
+	provider := m.provider()
+
+	authUrl, err := BeginProviderLogin(provider, 0)
+	if err != nil {
+		t.Fatalf("BeginProviderLogin failed: %v", err)
+	}
+	parsed, _ := url.Parse(authUrl)
+	query := parsed.Query()
+	if query.Get("nonce") == "" || query.Get("scope") != defaultOidcScopes || parsed.Path != "/authorize" {
+		t.Fatalf("Unexpected authorization request: %s", authUrl)
+	}
+
+	session, err := takeProviderSession(query.Get("state"), providerPurposeLogin)
+	if err != nil {
+		t.Fatalf("State not found: %v", err)
+	}
+	if session.Nonce != query.Get("nonce") {
+		t.Errorf("Expected the nonce to be kept in the session")
+	}
+
+	m.idToken = m.sign(t, jwt.SigningMethodRS256, "rsa-1", jwt.MapClaims{"nonce": session.Nonce})
+	resolved, _ := withProviderPreset(provider)
+	discovery, err := withOidcDiscovery(resolved)
+	if err != nil {
+		t.Fatalf("withOidcDiscovery failed: %v", err)
+	}
+	token, err := exchangeProviderCode(resolved, "", "code", session.Verifier)
+	if err != nil {
+		t.Fatalf("exchangeProviderCode failed: %v", err)
+	}
+	info, err := fetchOidcUserInfo(resolved, discovery, token, session.Nonce)
+	if err != nil {
+		t.Fatalf("fetchOidcUserInfo failed: %v", err)
+	}
+
+	user := mapProviderUser(resolved.UserMapping, info)
+	if user.Id != "partner-user" || user.Username != "carol" || user.Email != "carol@partner.example.com" || !user.EmailVerified {
+		t.Errorf("Unexpected upstream user: %+v", user)
+	}
+
+	// A replayed ID token from another sign-in is rejected
+	if _, err := fetchOidcUserInfo(resolved, discovery, token, "another-nonce"); !errors.Is(err, ErrIdTokenInvalid) {
+		t.Errorf("Expected replayed id token to be rejected, got %v", err)
+	}
+}
+
+// TestProviderOrganization tests the organization new users are provisioned into
+func TestProviderOrganization(t *testing.T) {
+	if got := providerOrganization(&models.Provider{}); got != "built-in" {
+		t.Errorf("Expected built-in, got %s", got)
+	}
+	if got := providerOrganization(&models.Provider{Organization: "partner"}); got != "partner" {
+		t.Errorf("Expected partner, got %s", got)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// TestWithProviderPreset tests that presets fill empty settings and mapping entries can be overridden
+func TestWithProviderPreset(t *testing.T) {
+	github := &models.Provider{Name: "github", Type: "GitHub", UserMapping: map[string]string{"username": "name"}}
+	resolved, pkce := withProviderPreset(github)
+	if resolved.AuthUrl != "https://github.com/login/oauth/authorize" || resolved.Scopes == "" || !pkce {
+		t.Errorf("Expected GitHub preset, got %+v (pkce %v)", resolved, pkce)
+	}
+	if resolved.UserMapping["username"] != "name" || resolved.UserMapping["id"] != "id" {
+		t.Errorf("Unexpected mapping: %v", resolved.UserMapping)
+	}
+	if github.AuthUrl != "" || len(github.UserMapping) != 1 {
+		t.Errorf("Expected the stored provider to be left unchanged")
+	}
+
+	if _, pkce := withProviderPreset(&models.Provider{Type: "WeChat"}); pkce {
+		t.Errorf("Expected PKCE to be disabled for WeChat")
+	}
+
+	custom, pkce := withProviderPreset(&models.Provider{Type: "Custom", AuthUrl: "https://idp.example.com/authorize"})
+	if custom.UserMapping["id"] != "sub" || custom.AuthUrl != "https://idp.example.com/authorize" || !pkce {
+		t.Errorf("Expected standard claims mapping for a custom provider, got %+v", custom)
+	}
+}
+
+// TestProviderAuthUrl tests the authorization request sent to providers
+func TestProviderAuthUrl(t *testing.T) {
+	t.Setenv("ORIGIN", "https://id.example.com")
+
+	provider := &models.Provider{Name: "google", Type: "Google", ClientId: "client"}
+	authUrl, err := BeginProviderLogin(provider, 0)
+	if err != nil {
+		t.Fatalf("BeginProviderLogin failed: %v", err)
+	}
+	parsed, _ := url.Parse(authUrl)
+	query := parsed.Query()
+	if query.Get("client_id") != "client" || query.Get("response_type") != "code" || query.Get("scope") != "openid email profile" {
+		t.Errorf("Unexpected authorization request: %s", authUrl)
+	}
+	if query.Get("redirect_uri") != "https://id.example.com/api/auth/provider/google/callback" {
+		t.Errorf("Unexpected redirect_uri: %s", query.Get("redirect_uri"))
+	}
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" || query.Get("state") == "" {
+		t.Errorf("Expected state and PKCE parameters: %s", authUrl)
+	}
+
+	wechat := &models.Provider{Name: "wechat", Type: "WeChat", ClientId: "wx-app"}
+	authUrl, err = BeginProviderLogin(wechat, 0)
+	if err != nil {
+		t.Fatalf("BeginProviderLogin failed: %v", err)
+	}
+	parsed, _ = url.Parse(authUrl)
+	if parsed.Query().Get("appid") != "wx-app" || parsed.Fragment != "wechat_redirect" || parsed.Query().Get("code_challenge") != "" {
+		t.Errorf("Unexpected WeChat authorization request: %s", authUrl)
+	}
+
+	if _, err := BeginProviderLogin(&models.Provider{Name: "empty", Type: "Custom"}, 0); err != ErrProviderNotConfigured {
+		t.Errorf("Expected unconfigured provider to be rejected, got %v", err)
+	}
+}
+
+// TestProviderSession tests that the state is single use and bound to its purpose
+func TestProviderSession(t *testing.T) {
+	state, err := saveProviderSession(&providerSession{Purpose: providerPurposeLogin, Provider: "github"})
+	if err != nil {
+		t.Fatalf("saveProviderSession failed: %v", err)
+	}
+	if _, err := takeProviderSession(state, providerPurposeResult); err != ErrProviderStateInvalid {
+		t.Errorf("Expected state to be rejected as a login ticket")
+	}
+
+	state, _ = saveProviderSession(&providerSession{Purpose: providerPurposeLogin, Provider: "github"})
+	if _, err := takeProviderSession(state, providerPurposeLogin); err != nil {
+		t.Fatalf("takeProviderSession failed: %v", err)
+	}
+	if _, err := takeProviderSession(state, providerPurposeLogin); err != ErrProviderStateInvalid {
+		t.Errorf("Expected state to be usable only once")
+	}
+}
+
+// TestProviderCodeExchange tests the token and userinfo requests against a mock provider
+func TestProviderCodeExchange(t *testing.T) {
+	var challenge string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			r.ParseForm()
+			digest := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if r.PostForm.Get("code") != "the-code" || r.PostForm.Get("client_secret") != "secret" ||
+				base64.RawURLEncoding.EncodeToString(digest[:]) != challenge {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "upstream-token", "token_type": "Bearer"})
+		case "/userinfo":
+			if r.Header.Get("Authorization") != "Bearer upstream-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"data":{"uid":12345678901234567,"nick":"alice","mail":"alice@example.com","verified":true}}`))
+		}
+	}))
+	defer server.Close()
+
+	provider := &models.Provider{
+		Name: "custom", Type: "Custom", ClientId: "client",
+		AuthUrl: server.URL + "/authorize", TokenUrl: server.URL + "/token", UserInfoUrl: server.URL + "/userinfo",
+		UserMapping: map[string]string{"id": "data.uid", "username": "data.nick", "email": "data.mail", "emailVerified": "data.verified"},
+	}
+	authUrl, err := BeginProviderLogin(provider, 0)
+	if err != nil {
+		t.Fatalf("BeginProviderLogin failed: %v", err)
+	}
+	parsed, _ := url.Parse(authUrl)
+	challenge = parsed.Query().Get("code_challenge")
+
+	session, err := takeProviderSession(parsed.Query().Get("state"), providerPurposeLogin)
+	if err != nil {
+		t.Fatalf("State not found: %v", err)
+	}
+	resolved, _ := withProviderPreset(provider)
+
+	if _, err := exchangeProviderCode(resolved, "secret", "the-code", "wrong-verifier"); err == nil {
+		t.Errorf("Expected exchange with a wrong verifier to fail")
+	}
+
+	token, err := exchangeProviderCode(resolved, "secret", "the-code", session.Verifier)
+	if err != nil {
+		t.Fatalf("exchangeProviderCode failed: %v", err)
+	}
+	info, err := fetchProviderUserInfo(resolved, token)
+	if err != nil {
+		t.Fatalf("fetchProviderUserInfo failed: %v", err)
+	}
+
+	user := mapProviderUser(resolved.UserMapping, info)
+	if user.Id != "12345678901234567" || user.Username != "alice" || user.Email != "alice@example.com" || !user.EmailVerified {
+		t.Errorf("Unexpected upstream user: %+v", user)
+	}
+}
+
+// TestGithubPrimaryEmail tests that only a verified primary GitHub email is used
+func TestGithubPrimaryEmail(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user":
+			w.Write([]byte(`{"id":1,"login":"octocat","email":"public@example.com"}`))
+		case "/user/emails":
+			w.Write([]byte(`[{"email":"old@example.com","primary":false,"verified":true},{"email":"octo@example.com","primary":true,"verified":true}]`))
+		}
+	}))
+	defer server.Close()
+
+	original := githubEmailsUrl
+	githubEmailsUrl = server.URL + "/user/emails"
+	defer func() { githubEmailsUrl = original }()
+
+	resolved, _ := withProviderPreset(&models.Provider{Type: "GitHub", UserInfoUrl: server.URL + "/user"})
+	info, err := fetchProviderUserInfo(resolved, map[string]interface{}{"access_token": "token"})
+	if err != nil {
+		t.Fatalf("fetchProviderUserInfo failed: %v", err)
+	}
+
+	user := mapProviderUser(resolved.UserMapping, info)
+	if user.Id != "1" || user.Username != "octocat" || user.Email != "octo@example.com" || !user.EmailVerified {
+		t.Errorf("Unexpected GitHub user: %+v", user)
+	}
+}
+
+// TestProviderErrorResponse tests that OAuth and WeChat style errors are surfaced
+func TestProviderErrorResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"errcode":40029,"errmsg":"invalid code"}`))
+	}))
+	defer server.Close()
+
+	resolved, _ := withProviderPreset(&models.Provider{Type: "WeChat", TokenUrl: server.URL})
+	_, err := exchangeProviderCode(resolved, "secret", "code", "")
+	if err == nil || !strings.Contains(err.Error(), "40029") {
+		t.Errorf("Expected WeChat error to be reported, got %v", err)
+	}
+}
+
+// TestMapProviderUser tests attribute mapping edge cases
+func TestMapProviderUser(t *testing.T) {
+	info := map[string]interface{}{"sub": "abc", "email": "bob@example.com", "email_verified": "false"}
+	user := mapProviderUser(defaultUserMapping, info)
+	if user.Id != "abc" || user.EmailVerified {
+		t.Errorf("Unexpected user: %+v", user)
+	}
+
+	if got := lookupClaim(info, "missing.path"); got != nil {
+		t.Errorf("Expected nil for a missing path, got %v", got)
+	}
+	if got := claimString(json.Number("42")); got != "42" {
+		t.Errorf("Expected 42, got %q", got)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"context"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimitResult is the state of a token bucket after taking a token from it
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next token is available when the request was rejected
+	RetryAfter time.Duration
+}
+
+// bucketStore keeps token buckets holding up to burst tokens, refilled evenly over period
+type bucketStore interface {
+	take(key string, burst int, period time.Duration, now time.Time) (float64, bool, error)
+}
+
+var memoryBuckets = newMemoryBucketStore()
+
+// TakeRateLimitToken takes a token from the bucket of a key. Buckets hold up to burst tokens
+// and refill at burst tokens per period, so short bursts are allowed while the average rate
+// stays bounded. Buckets live in Redis when it is configured, so that instances share them,
+// and in process memory otherwise or while Redis fails.
+func TakeRateLimitToken(key string, burst int, period time.Duration) (*RateLimitResult, error) {
+	var store bucketStore = memoryBuckets
+	if redisClient != nil {
+		store = &redisBucketStore{client: redisClient, fallback: memoryBuckets}
+	}
+	return takeRateLimitToken(store, key, burst, period, time.Now())
+}
+
+func takeRateLimitToken(store bucketStore, key string, burst int, period time.Duration, now time.Time) (*RateLimitResult, error) {
+	tokens, allowed, err := store.take("ratelimit:bucket:"+key, burst, period, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Time to refill one token
+	interval := period / time.Duration(burst)
+	result := &RateLimitResult{
+		Allowed:   allowed,
+		Limit:     burst,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(burst) - tokens) * float64(interval)),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) * float64(interval))
+	}
+	return result, nil
+}
+
+// refillBucket returns the tokens of a bucket after the time since its last update
+func refillBucket(tokens float64, updated, now time.Time, burst int, period time.Duration) float64 {
+	elapsed := now.Sub(updated)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(float64(burst), tokens+float64(burst)*elapsed.Seconds()/period.Seconds())
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	period  time.Duration
+}
+
+// memoryBucketStore keeps buckets in process memory. Buckets that have refilled are swept now
+// and then while taking tokens, as a full bucket is the same as a missing one.
+type memoryBucketStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	takes   int
+}
+
+func newMemoryBucketStore() *memoryBucketStore {
+	return &memoryBucketStore{buckets: map[string]*memoryBucket{}}
+}
+
+func (s *memoryBucketStore) take(key string, burst int, period time.Duration, now time.Time) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.takes++
+	if s.takes%1000 == 0 {
+		for other, bucket := range s.buckets {
+			if now.Sub(bucket.updated) >= bucket.period {
+				delete(s.buckets, other)
+			}
+		}
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(burst), updated: now}
+		s.buckets[key] = bucket
+	}
+	bucket.tokens = refillBucket(bucket.tokens, bucket.updated, now, burst, period)
+	bucket.updated = now
+	bucket.period = period
+
+	if bucket.tokens < 1 {
+		return bucket.tokens, false, nil
+	}
+	bucket.tokens--
+	return bucket.tokens, true, nil
+}
+
+// takeBucketScript refills and takes from a bucket atomically. Tokens are returned as a string,
+// as Redis would truncate a Lua number to an integer.
+var takeBucketScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or burst
+local updated = tonumber(state[2]) or now
+if now > updated then
+  tokens = math.min(burst, tokens + burst * (now - updated) / period)
+end
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(math.max(now, updated)))
+redis.call('PEXPIRE', KEYS[1], math.ceil(period / 1000))
+return {allowed, tostring(tokens)}
+`)
+
+// redisBucketStore keeps buckets in Redis hashes, with times in microseconds
+type redisBucketStore struct {
+	client   *redis.Client
+	fallback bucketStore
+}
+
+func (s *redisBucketStore) take(key string, burst int, period time.Duration, now time.Time) (float64, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+	defer cancel()
+
+	values, err := takeBucketScript.Run(ctx, s.client, []string{key}, burst, period.Microseconds(), now.UnixMicro()).Slice()
+	if err == nil && len(values) == 2 {
+		allowed, _ := values[0].(int64)
+		text, _ := values[1].(string)
+		var tokens float64
+		if tokens, err = strconv.ParseFloat(text, 64); err == nil {
+			return tokens, allowed == 1, nil
+		}
+	}
+	log.Printf("[RateLimit] Redis unavailable for rate limits, using memory: %v", err)
+	return s.fallback.take(key, burst, period, now)
+}
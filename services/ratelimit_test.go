@@ -0,0 +1,48 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTakeRateLimitToken tests bursts, refills and the reported reset times
+func TestTakeRateLimitToken(t *testing.T) {
+	store := newMemoryBucketStore()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		result, err := takeRateLimitToken(store, "key", 3, time.Minute, now)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !result.Allowed || result.Remaining != 2-i {
+			t.Errorf("Request %d: unexpected result %+v", i+1, result)
+		}
+	}
+
+	result, _ := takeRateLimitToken(store, "key", 3, time.Minute, now)
+	if result.Allowed || result.RetryAfter != 20*time.Second || result.Reset != time.Minute {
+		t.Errorf("Expected the empty bucket to reject for 20s, got %+v", result)
+	}
+
+	// One token is refilled every 20 seconds
+	result, _ = takeRateLimitToken(store, "key", 3, time.Minute, now.Add(30*time.Second))
+	if !result.Allowed || result.Remaining != 0 || result.Reset != 50*time.Second {
+		t.Errorf("Expected one refilled token, got %+v", result)
+	}
+
+	// Other keys have their own buckets
+	result, _ = takeRateLimitToken(store, "other", 3, time.Minute, now)
+	if !result.Allowed || result.Remaining != 2 {
+		t.Errorf("Expected a fresh bucket, got %+v", result)
+	}
+
+	// Refills never exceed the burst
+	result, _ = takeRateLimitToken(store, "key", 3, time.Minute, now.Add(time.Hour))
+	if !result.Allowed || result.Remaining != 2 {
+		t.Errorf("Expected a full bucket, got %+v", result)
+	}
+}
@@ -4,10 +4,10 @@
 package services
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -422,7 +422,11 @@ func checkRealNameDuplicate(currentUserId int64, name, idcard string) (bool, err
 	return false, nil
 }
 
-// GetDecryptedRealName 获取解密后的真实姓名（仅供管理员使用）
+// PurposeRealName is the purpose of codes confirming the contact details of a real name verification
+const PurposeRealName = "realname"
+
+// SendVerificationCodeForRealName 发送实名认证验证码
+// 验证码与登录、注册验证码共用存储，短信按 E.164 手机号、邮件按邮箱地址保存
 func SendVerificationCodeForRealName(target, codeType string) error {
 	// 检查是否启用实名认证
 	enabled, _ := strconv.ParseBool(os.Getenv("VERIFY_API_ENABLED"))
@@ -430,65 +434,23 @@ func SendVerificationCodeForRealName(target, codeType string) error {
 		return fmt.Errorf("real name verification is disabled")
 	}
 
-	// 获取 API 地址
-	apiUrl := os.Getenv("VERIFY_API_URL")
-	if apiUrl == "" {
-		apiUrl = "http://localhost:3000"
-	}
-
-	// 构建请求
-	var url string
-	var reqBody map[string]string
-
-	if codeType == "sms" {
-		url = fmt.Sprintf("%s/api/sms", apiUrl)
-		reqBody = map[string]string{"phone": target}
-	} else if codeType == "email" {
-		url = fmt.Sprintf("%s/api/email", apiUrl)
-		reqBody = map[string]string{"email": target}
-	} else {
+	var code string
+	var err error
+	switch codeType {
+	case "sms":
+		code, err = SendSmsVerificationCode(target, PurposeRealName)
+	case "email":
+		code, err = SendVerificationEmail(target, PurposeRealName)
+	default:
 		return fmt.Errorf("invalid code type: %s", codeType)
 	}
-
-	// 序列化请求体
-	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
 		return err
 	}
-
-	// 创建 HTTP 客户端
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
-	// 发送 POST 请求
-	resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to call verification API: %v", err)
+	if code != "" {
+		// 开发环境下记录验证码
+		log.Printf("Real name verification code sent to %s: %s", target, code)
 	}
-	defer resp.Body.Close()
-
-	// 读取响应
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read response: %v", err)
-	}
-
-	// 解析响应
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return fmt.Errorf("failed to parse response: %v", err)
-	}
-
-	// 检查是否成功
-	if success, ok := result["success"].(bool); !ok || !success {
-		message := "发送失败"
-		if msg, ok := result["message"].(string); ok {
-			message = msg
-		}
-		return fmt.Errorf(message)
-	}
-
 	return nil
 }
 
@@ -500,61 +462,10 @@ func VerifyCodeForRealName(target, code, codeType string) (bool, error) {
 		return false, fmt.Errorf("real name verification is disabled")
 	}
 
-	// 获取 API 地址
-	apiUrl := os.Getenv("VERIFY_API_URL")
-	if apiUrl == "" {
-		apiUrl = "http://localhost:3000"
-	}
-
-	// 构建请求
-	url := fmt.Sprintf("%s/api/verify", apiUrl)
-	reqBody := make(map[string]string)
-	reqBody["code"] = code
-
-	if codeType == "sms" {
-		reqBody["phone"] = target
-	} else if codeType == "email" {
-		reqBody["email"] = target
-	} else {
+	if codeType != "sms" && codeType != "email" {
 		return false, fmt.Errorf("invalid code type: %s", codeType)
 	}
-
-	// 序列化请求体
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return false, err
-	}
-
-	// 创建 HTTP 客户端
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
-	// 发送 POST 请求
-	resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return false, fmt.Errorf("failed to call verification API: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// 读取响应
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return false, fmt.Errorf("failed to read response: %v", err)
-	}
-
-	// 解析响应
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return false, fmt.Errorf("failed to parse response: %v", err)
-	}
-
-	// 检查是否成功
-	if success, ok := result["success"].(bool); ok && success {
-		return true, nil
-	}
-
-	return false, nil
+	return VerifyCode(target, code, PurposeRealName)
 }
 
 // GetDecryptedRealName 获取解密后的真实姓名（仅供管理员使用）
@@ -0,0 +1,150 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// ShouldIssueRefreshToken decides whether a grant gets a refresh token.
+// By default refresh tokens are only issued when offline_access was granted.
+func ShouldIssueRefreshToken(application *models.Application, scope string) bool {
+	switch application.RefreshTokenPolicy {
+	case models.RefreshTokenPolicyAlways:
+		return true
+	case models.RefreshTokenPolicyNever:
+		return false
+	default:
+		return hasScope(scope, "offline_access")
+	}
+}
+
+// ValidateRefreshTokenPolicy checks the refresh token settings of an application
+func ValidateRefreshTokenPolicy(application *models.Application) error {
+	switch application.RefreshTokenPolicy {
+	case "", models.RefreshTokenPolicyOfflineAccess, models.RefreshTokenPolicyAlways, models.RefreshTokenPolicyNever:
+	default:
+		return fmt.Errorf("unsupported refresh token policy: %s", application.RefreshTokenPolicy)
+	}
+	if application.RefreshIdleHours < 0 || application.RefreshAbsoluteHours < 0 || application.RefreshReuseGraceSeconds < 0 {
+		return fmt.Errorf("refresh token lifetimes must not be negative")
+	}
+	return nil
+}
+
+// refreshIdleDuration returns the sliding lifetime of a single refresh token
+func refreshIdleDuration(application *models.Application) time.Duration {
+	hours := application.RefreshIdleHours
+	if hours <= 0 {
+		hours = application.RefreshExpireInHours
+	}
+	return time.Duration(hours * float64(time.Hour))
+}
+
+// refreshAbsoluteExpiry returns the absolute expiry of a new token family, 0 if uncapped
+func refreshAbsoluteExpiry(application *models.Application, now time.Time) int64 {
+	if application.RefreshAbsoluteHours <= 0 {
+		return 0
+	}
+	return now.Add(time.Duration(application.RefreshAbsoluteHours * float64(time.Hour))).Unix()
+}
+
+// refreshExpiry returns the idle expiry of a refresh token, capped by the family's absolute expiry
+func refreshExpiry(application *models.Application, now time.Time, absoluteExpiresAt int64) int64 {
+	expiresAt := now.Add(refreshIdleDuration(application)).Unix()
+	if absoluteExpiresAt != 0 && expiresAt > absoluteExpiresAt {
+		return absoluteExpiresAt
+	}
+	return expiresAt
+}
+
+// isWithinReuseGrace reports whether a rotated refresh token is replayed inside the grace window
+func isWithinReuseGrace(application *models.Application, token *models.Token, now time.Time) bool {
+	if application.RefreshReuseGraceSeconds <= 0 || token.RefreshedTo == "" {
+		return false
+	}
+	return now.Unix()-token.RefreshedAt <= int64(application.RefreshReuseGraceSeconds)
+}
+
+// refreshSuccessor is a rotation response kept for the reuse grace window
+type refreshSuccessor struct {
+	response  *TokenResponse
+	expiresAt time.Time
+}
+
+// refreshSuccessors holds rotation responses in process when Redis is not configured.
+// Token plaintext only lives here for the grace window and is never written to the database.
+var refreshSuccessors = struct {
+	sync.Mutex
+	entries map[string]refreshSuccessor
+}{entries: map[string]refreshSuccessor{}}
+
+// refreshSuccessorKey identifies the rotation of a refresh token into one successor. Concurrent
+// rotations cache their responses before only one of them wins, so the key names the successor.
+func refreshSuccessorKey(refreshTokenHash, successor string) string {
+	return fmt.Sprintf("%s/%s", refreshTokenHash, successor)
+}
+
+// cacheRefreshSuccessor remembers the response of a rotation so a replay of the old
+// refresh token inside the grace window gets the same successor
+func cacheRefreshSuccessor(application *models.Application, refreshTokenHash, successor string, response *TokenResponse) {
+	if application.RefreshReuseGraceSeconds <= 0 || refreshTokenHash == "" {
+		return
+	}
+	ttl := time.Duration(application.RefreshReuseGraceSeconds) * time.Second
+	key := refreshSuccessorKey(refreshTokenHash, successor)
+
+	if redisClient != nil {
+		data, err := json.Marshal(response)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+		defer cancel()
+		if redisClient.Set(ctx, fmt.Sprintf("refresh-grace:%s", key), data, ttl).Err() == nil {
+			return
+		}
+	}
+
+	now := time.Now()
+	refreshSuccessors.Lock()
+	defer refreshSuccessors.Unlock()
+	for key, entry := range refreshSuccessors.entries {
+		if now.After(entry.expiresAt) {
+			delete(refreshSuccessors.entries, key)
+		}
+	}
+	refreshSuccessors.entries[key] = refreshSuccessor{response: response, expiresAt: now.Add(ttl)}
+}
+
+// getRefreshSuccessor returns the cached response of the rotation of a refresh token into the
+// successor, nil if expired
+func getRefreshSuccessor(refreshTokenHash, successor string) *TokenResponse {
+	key := refreshSuccessorKey(refreshTokenHash, successor)
+	if redisClient != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+		defer cancel()
+		data, err := redisClient.Get(ctx, fmt.Sprintf("refresh-grace:%s", key)).Bytes()
+		if err == nil {
+			var response TokenResponse
+			if json.Unmarshal(data, &response) == nil {
+				return &response
+			}
+		}
+	}
+
+	refreshSuccessors.Lock()
+	defer refreshSuccessors.Unlock()
+	entry, ok := refreshSuccessors.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil
+	}
+	return entry.response
+}
@@ -0,0 +1,164 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// TestShouldIssueRefreshToken tests the refresh token issuance policy
+func TestShouldIssueRefreshToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		scope    string
+		expected bool
+	}{
+		{name: "Default without offline_access", policy: "", scope: "openid profile", expected: false},
+		{name: "Default with offline_access", policy: "", scope: "openid offline_access", expected: true},
+		{name: "Explicit offline_access", policy: models.RefreshTokenPolicyOfflineAccess, scope: "openid", expected: false},
+		{name: "Always", policy: models.RefreshTokenPolicyAlways, scope: "openid", expected: true},
+		{name: "Never", policy: models.RefreshTokenPolicyNever, scope: "openid offline_access", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := &models.Application{RefreshTokenPolicy: tt.policy}
+			if got := ShouldIssueRefreshToken(application, tt.scope); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestGenerateJwtTokenRefreshPolicy tests that refresh tokens are only minted when allowed
+func TestGenerateJwtTokenRefreshPolicy(t *testing.T) {
+	user := &models.User{Id: 1, Username: "alice"}
+	application := &models.Application{ClientId: "client", ExpireInHours: 1, RefreshExpireInHours: 24}
+
+	_, refreshToken, _, err := GenerateJwtToken(application, user, "openid profile", "", "", nil)
+	if err != nil {
+		t.Fatalf("GenerateJwtToken failed: %v", err)
+	}
+	if refreshToken != "" {
+		t.Errorf("Expected no refresh token without offline_access")
+	}
+
+	_, refreshToken, _, err = GenerateJwtToken(application, user, "openid offline_access", "", "", nil)
+	if err != nil {
+		t.Fatalf("GenerateJwtToken failed: %v", err)
+	}
+	if refreshToken == "" {
+		t.Errorf("Expected a refresh token with offline_access")
+	}
+}
+
+// TestRefreshExpiry tests the sliding lifetime capped by the absolute lifetime
+func TestRefreshExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	application := &models.Application{RefreshExpireInHours: 720, RefreshIdleHours: 24, RefreshAbsoluteHours: 48}
+
+	absolute := refreshAbsoluteExpiry(application, now)
+	if absolute != now.Add(48*time.Hour).Unix() {
+		t.Fatalf("Unexpected absolute expiry: %d", absolute)
+	}
+
+	if got := refreshExpiry(application, now, absolute); got != now.Add(24*time.Hour).Unix() {
+		t.Errorf("Expected idle expiry, got %d", got)
+	}
+
+	later := now.Add(36 * time.Hour)
+	if got := refreshExpiry(application, later, absolute); got != absolute {
+		t.Errorf("Expected expiry capped at the absolute lifetime, got %d", got)
+	}
+
+	// Without an idle setting the per-token lifetime falls back to RefreshExpireInHours
+	uncapped := &models.Application{RefreshExpireInHours: 2}
+	if got := refreshExpiry(uncapped, now, refreshAbsoluteExpiry(uncapped, now)); got != now.Add(2*time.Hour).Unix() {
+		t.Errorf("Expected fallback expiry, got %d", got)
+	}
+}
+
+// TestIsWithinReuseGrace tests the refresh token reuse grace window
+func TestIsWithinReuseGrace(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	token := &models.Token{RefreshTokenUsed: true, RefreshedTo: "token_1_2", RefreshedAt: now.Unix() - 5}
+
+	if isWithinReuseGrace(&models.Application{}, token, now) {
+		t.Errorf("Expected no grace window when disabled")
+	}
+	if !isWithinReuseGrace(&models.Application{RefreshReuseGraceSeconds: 10}, token, now) {
+		t.Errorf("Expected reuse within the grace window")
+	}
+	if isWithinReuseGrace(&models.Application{RefreshReuseGraceSeconds: 3}, token, now) {
+		t.Errorf("Expected reuse after the grace window to be rejected")
+	}
+}
+
+// TestValidateRefreshTokenPolicy tests refresh token settings validation
+func TestValidateRefreshTokenPolicy(t *testing.T) {
+	if err := ValidateRefreshTokenPolicy(&models.Application{RefreshTokenPolicy: models.RefreshTokenPolicyAlways}); err != nil {
+		t.Errorf("Expected valid policy, got %v", err)
+	}
+	if err := ValidateRefreshTokenPolicy(&models.Application{RefreshTokenPolicy: "sometimes"}); err == nil {
+		t.Errorf("Expected error for unknown policy")
+	}
+	if err := ValidateRefreshTokenPolicy(&models.Application{RefreshReuseGraceSeconds: -1}); err == nil {
+		t.Errorf("Expected error for negative grace window")
+	}
+}
+
+// TestRefreshSuccessorCache tests that rotation responses are kept only for the grace window
+// and only returned for the successor that won the rotation
+func TestRefreshSuccessorCache(t *testing.T) {
+	response := &TokenResponse{AccessToken: "access", RefreshToken: "refresh", TokenType: "Bearer"}
+
+	cacheRefreshSuccessor(&models.Application{}, "hash-disabled", "token-1", response)
+	if getRefreshSuccessor("hash-disabled", "token-1") != nil {
+		t.Errorf("Expected no cached response without a grace window")
+	}
+
+	cacheRefreshSuccessor(&models.Application{RefreshReuseGraceSeconds: 30}, "hash-enabled", "token-1", response)
+	cached := getRefreshSuccessor("hash-enabled", "token-1")
+	if cached == nil || cached.RefreshToken != "refresh" {
+		t.Fatalf("Expected cached successor, got %+v", cached)
+	}
+	if getRefreshSuccessor("hash-enabled", "token-2") != nil {
+		t.Errorf("Expected no response for a successor that lost the rotation")
+	}
+
+	refreshSuccessors.Lock()
+	refreshSuccessors.entries[refreshSuccessorKey("hash-enabled", "token-1")] = refreshSuccessor{response: response, expiresAt: time.Now().Add(-time.Second)}
+	refreshSuccessors.Unlock()
+	if getRefreshSuccessor("hash-enabled", "token-1") != nil {
+		t.Errorf("Expected expired successor to be dropped")
+	}
+}
+
+// TestMaskTokenHash tests masked token identifiers
+func TestMaskTokenHash(t *testing.T) {
+	user := &models.User{Id: 1, Username: "alice"}
+	application := &models.Application{ClientId: "client", ExpireInHours: 1}
+	accessToken, _, _, err := GenerateJwtToken(application, user, "openid", "", "", nil)
+	if err != nil {
+		t.Fatalf("GenerateJwtToken failed: %v", err)
+	}
+
+	token := &models.Token{AccessToken: accessToken, Jti: jwtId(accessToken)}
+	token.PopulateHashes()
+	if token.Jti == "" {
+		t.Errorf("Expected jti to be extracted from the access token")
+	}
+
+	masked := token.MaskedAccessToken()
+	if len(masked) != 14 || masked[:6] != token.AccessTokenHash[:6] {
+		t.Errorf("Unexpected masked identifier: %s", masked)
+	}
+	if token.MaskedRefreshToken() != "" {
+		t.Errorf("Expected empty identifier without a refresh token")
+	}
+}
@@ -0,0 +1,588 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// SAML bindings (SAML Bindings §3.4, §3.5)
+const (
+	SamlBindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	SamlBindingPost     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+)
+
+// NameID formats (SAML Core §8.3)
+const (
+	SamlNameIdUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	SamlNameIdEmail       = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	SamlNameIdPersistent  = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	SamlNameIdTransient   = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+)
+
+const (
+	samlVersion                    = "2.0"
+	samlStatusSuccess              = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlStatusRequester            = "urn:oasis:names:tc:SAML:2.0:status:Requester"
+	samlStatusInvalidNameIdPolicy  = "urn:oasis:names:tc:SAML:2.0:status:InvalidNameIDPolicy"
+	samlConfirmationBearer         = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlAuthnContextPassword       = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	samlAttrNameFormatBasic        = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+	samlAssertionLifetime          = 5 * time.Minute
+	samlSessionLifetime            = 8 * time.Hour
+	samlClockSkew                  = 3 * time.Minute
+	samlMessageSizeLimit           = 1 << 20
+	samlTimeFormat                 = "2006-01-02T15:04:05Z"
+	samlProtocolSupportEnumeration = "urn:oasis:names:tc:SAML:2.0:protocol"
+)
+
+var (
+	SupportedSamlNameIdFormats = []string{SamlNameIdEmail, SamlNameIdPersistent, SamlNameIdTransient, SamlNameIdUnspecified}
+	SupportedSamlUserFields    = []string{"id", "owner", "username", "email", "phone", "avatar", "qq", "isAdmin", "isRealName"}
+
+	// defaultSamlAttributes is released when a service provider has no attribute mapping
+	defaultSamlAttributes = map[string]string{"email": "email", "username": "username", "phone": "phone"}
+)
+
+var (
+	ErrSamlRequestInvalid     = fmt.Errorf("the SAML request is invalid")
+	ErrSamlUnknownSp          = fmt.Errorf("the service provider is not registered")
+	ErrSamlAcsUrlMismatch     = fmt.Errorf("the assertion consumer service URL is not registered")
+	ErrSamlSloNotConfigured   = fmt.Errorf("the service provider has no single logout URL")
+	ErrSamlNameIdNotAvailable = fmt.Errorf("the user has no value for the requested NameID format")
+)
+
+// SamlAuthnRequest is a validated sign-in request of a service provider.
+// RequestId is empty for an IdP-initiated sign-in.
+type SamlAuthnRequest struct {
+	Application  *models.Application
+	RequestId    string
+	AcsUrl       string
+	NameIdFormat string
+	ForceAuthn   bool
+}
+
+// SamlLogoutRequest is a validated logout request of a service provider
+type SamlLogoutRequest struct {
+	Application  *models.Application
+	RequestId    string
+	NameId       string
+	NameIdFormat string
+	Binding      string
+}
+
+// SamlMessage is a signed message for the browser to deliver to a service provider.
+// With the POST binding the browser submits SAMLResponse and RelayState to Url in a form;
+// with the Redirect binding Url already carries the message and its signature.
+type SamlMessage struct {
+	Binding      string `json:"binding"`
+	Url          string `json:"url"`
+	SAMLResponse string `json:"samlResponse,omitempty"`
+	RelayState   string `json:"relayState,omitempty"`
+}
+
+type samlAuthnRequestXml struct {
+	XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string   `xml:"ID,attr"`
+	Version                     string   `xml:"Version,attr"`
+	Destination                 string   `xml:"Destination,attr"`
+	AssertionConsumerServiceURL string   `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding             string   `xml:"ProtocolBinding,attr"`
+	ForceAuthn                  string   `xml:"ForceAuthn,attr"`
+	Issuer                      string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	NameIdPolicy                *struct {
+		Format string `xml:"Format,attr"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+}
+
+type samlLogoutRequestXml struct {
+	XMLName     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutRequest"`
+	ID          string   `xml:"ID,attr"`
+	Version     string   `xml:"Version,attr"`
+	Destination string   `xml:"Destination,attr"`
+	Issuer      string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	NameId      struct {
+		Format string `xml:"Format,attr"`
+		Value  string `xml:",chardata"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+}
+
+// samlIdpUrl returns an absolute URL of the IdP endpoints
+func samlIdpUrl(path string) string {
+	origin := os.Getenv("ORIGIN")
+	if origin == "" {
+		origin = "http://localhost:8080"
+	}
+	return strings.TrimRight(origin, "/") + path
+}
+
+// SamlIdpEntityId is the entity ID of this identity provider, which is also its metadata URL
+func SamlIdpEntityId() string {
+	return samlIdpUrl("/api/saml/metadata")
+}
+
+func samlSsoUrl() string {
+	return samlIdpUrl("/api/saml/sso")
+}
+
+func samlSloUrl() string {
+	return samlIdpUrl("/api/saml/slo")
+}
+
+// samlId returns a message ID; IDs must not start with a digit (xs:ID)
+func samlId() string {
+	buf := make([]byte, 20)
+	rand.Read(buf)
+	return "_" + hex.EncodeToString(buf)
+}
+
+func samlTime(t time.Time) string {
+	return t.UTC().Format(samlTimeFormat)
+}
+
+// DecodeSamlMessage decodes a SAMLRequest parameter; messages of the Redirect binding are also deflated
+func DecodeSamlMessage(encoded string, deflated bool) ([]byte, error) {
+	encoded = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\n' || r == '\r' || r == '\t' {
+			return -1
+		}
+		return r
+	}, encoded)
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSamlRequestInvalid, err)
+	}
+	if !deflated {
+		return data, nil
+	}
+
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	inflated, err := io.ReadAll(io.LimitReader(reader, samlMessageSizeLimit))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSamlRequestInvalid, err)
+	}
+	return inflated, nil
+}
+
+// EncodeSamlRedirectMessage deflates and encodes a message for the Redirect binding
+func EncodeSamlRedirectMessage(message []byte) (string, error) {
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// samlServiceProvider returns the SAML service provider registered with the entity ID
+func samlServiceProvider(entityId string) (*models.Application, error) {
+	application, err := models.GetApplicationBySamlEntityId(strings.TrimSpace(entityId))
+	if err != nil {
+		return nil, err
+	}
+	if application == nil || !application.IsSaml() {
+		return nil, ErrSamlUnknownSp
+	}
+	return application, nil
+}
+
+// ParseSamlAuthnRequest validates a decoded AuthnRequest against the registered service provider.
+// Responses are only ever sent to the registered ACS URL with the POST binding.
+func ParseSamlAuthnRequest(data []byte) (*SamlAuthnRequest, error) {
+	var message samlAuthnRequestXml
+	if err := xml.Unmarshal(data, &message); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSamlRequestInvalid, err)
+	}
+	if message.Version != samlVersion || message.ID == "" {
+		return nil, fmt.Errorf("%w: unsupported version or missing ID", ErrSamlRequestInvalid)
+	}
+	if message.Destination != "" && message.Destination != samlSsoUrl() {
+		return nil, fmt.Errorf("%w: destination %s is not this endpoint", ErrSamlRequestInvalid, message.Destination)
+	}
+	if message.ProtocolBinding != "" && message.ProtocolBinding != SamlBindingPost {
+		return nil, fmt.Errorf("%w: only the HTTP-POST response binding is supported", ErrSamlRequestInvalid)
+	}
+
+	application, err := samlServiceProvider(message.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	if message.AssertionConsumerServiceURL != "" && message.AssertionConsumerServiceURL != application.SamlAcsUrl {
+		return nil, ErrSamlAcsUrlMismatch
+	}
+
+	request := &SamlAuthnRequest{
+		Application:  application,
+		RequestId:    message.ID,
+		AcsUrl:       application.SamlAcsUrl,
+		NameIdFormat: samlNameIdFormat(application),
+	}
+	request.ForceAuthn, _ = strconv.ParseBool(message.ForceAuthn)
+	if message.NameIdPolicy != nil && message.NameIdPolicy.Format != "" && message.NameIdPolicy.Format != SamlNameIdUnspecified {
+		request.NameIdFormat = message.NameIdPolicy.Format
+	}
+	return request, nil
+}
+
+// NewSamlIdpInitiatedRequest starts an unsolicited sign-in to a service provider
+func NewSamlIdpInitiatedRequest(entityId string) (*SamlAuthnRequest, error) {
+	application, err := samlServiceProvider(entityId)
+	if err != nil {
+		return nil, err
+	}
+	return &SamlAuthnRequest{
+		Application:  application,
+		AcsUrl:       application.SamlAcsUrl,
+		NameIdFormat: samlNameIdFormat(application),
+	}, nil
+}
+
+// samlNameIdFormat returns the configured NameID format of a service provider
+func samlNameIdFormat(application *models.Application) string {
+	if application.SamlNameIdFormat != "" {
+		return application.SamlNameIdFormat
+	}
+	return SamlNameIdEmail
+}
+
+// samlNameId returns the NameID of the user in the format. Persistent NameIDs are the
+// user ID, the same subject OIDC clients receive; unspecified uses the username. Email
+// NameIDs are only available for a verified address.
+func samlNameId(user *models.User, format string) (string, error) {
+	var value string
+	switch format {
+	case SamlNameIdEmail:
+		// Service providers key accounts on the NameID, so only a proven address is released
+		if user.EmailVerified {
+			value = user.Email
+		}
+	case SamlNameIdPersistent:
+		value = strconv.FormatInt(user.Id, 10)
+	case SamlNameIdTransient:
+		value = samlId()
+	case SamlNameIdUnspecified:
+		value = user.Username
+	}
+	if value == "" {
+		return "", ErrSamlNameIdNotAvailable
+	}
+	return value, nil
+}
+
+// SamlUserField returns a user field released as a SAML attribute
+func SamlUserField(user *models.User, field string) string {
+	switch field {
+	case "id":
+		return strconv.FormatInt(user.Id, 10)
+	case "owner":
+		return user.Owner
+	case "username":
+		return user.Username
+	case "email":
+		if user.EmailVerified {
+			return user.Email
+		}
+	case "phone":
+		if user.PhoneVerified {
+			return user.Phone
+		}
+	case "avatar":
+		return user.Avatar
+	case "qq":
+		return user.QQ
+	case "isAdmin":
+		return strconv.FormatBool(user.IsAdmin)
+	case "isRealName":
+		return strconv.FormatBool(user.IsRealName)
+	}
+	return ""
+}
+
+// BuildSamlResponse returns the signed Response to an AuthnRequest for the signed-in user.
+// Both the Response and its Assertion are signed with the server key.
+func BuildSamlResponse(request *SamlAuthnRequest, user *models.User, relayState string) (*SamlMessage, error) {
+	now := time.Now()
+	response := samlResponseElement("samlp:Response", request.RequestId, request.AcsUrl, now)
+
+	nameId, err := samlNameId(user, request.NameIdFormat)
+	if err != nil {
+		response.add(samlStatus(samlStatusRequester, samlStatusInvalidNameIdPolicy))
+	} else {
+		assertion := samlAssertion(request, user, nameId, now)
+		if err := signXmlElement(assertion); err != nil {
+			return nil, err
+		}
+		response.add(samlStatus(samlStatusSuccess, ""), assertion)
+	}
+
+	if err := signXmlElement(response); err != nil {
+		return nil, err
+	}
+	return &SamlMessage{
+		Binding:      SamlBindingPost,
+		Url:          request.AcsUrl,
+		SAMLResponse: base64.StdEncoding.EncodeToString([]byte(response.Canonical())),
+		RelayState:   relayState,
+	}, nil
+}
+
+// samlResponseElement returns a status response with the common attributes and Issuer
+func samlResponseElement(name, inResponseTo, destination string, now time.Time) *xmlElement {
+	response := newXmlElement(name,
+		"ID", samlId(),
+		"Version", samlVersion,
+		"IssueInstant", samlTime(now),
+		"Destination", destination,
+	)
+	if inResponseTo != "" {
+		response.Attrs["InResponseTo"] = inResponseTo
+	}
+	return response.add(newXmlElement("saml:Issuer").text(SamlIdpEntityId()))
+}
+
+func samlStatus(code, subCode string) *xmlElement {
+	statusCode := newXmlElement("samlp:StatusCode", "Value", code)
+	if subCode != "" {
+		statusCode.add(newXmlElement("samlp:StatusCode", "Value", subCode))
+	}
+	return newXmlElement("samlp:Status").add(statusCode)
+}
+
+func samlAssertion(request *SamlAuthnRequest, user *models.User, nameId string, now time.Time) *xmlElement {
+	expires := samlTime(now.Add(samlAssertionLifetime))
+
+	confirmationData := newXmlElement("saml:SubjectConfirmationData",
+		"NotOnOrAfter", expires,
+		"Recipient", request.AcsUrl,
+	)
+	if request.RequestId != "" {
+		confirmationData.Attrs["InResponseTo"] = request.RequestId
+	}
+
+	assertion := newXmlElement("saml:Assertion",
+		"ID", samlId(),
+		"Version", samlVersion,
+		"IssueInstant", samlTime(now),
+	).add(
+		newXmlElement("saml:Issuer").text(SamlIdpEntityId()),
+		newXmlElement("saml:Subject").add(
+			newXmlElement("saml:NameID", "Format", request.NameIdFormat).text(nameId),
+			newXmlElement("saml:SubjectConfirmation", "Method", samlConfirmationBearer).add(confirmationData),
+		),
+		newXmlElement("saml:Conditions",
+			"NotBefore", samlTime(now.Add(-samlClockSkew)),
+			"NotOnOrAfter", expires,
+		).add(
+			newXmlElement("saml:AudienceRestriction").add(
+				newXmlElement("saml:Audience").text(request.Application.SamlEntityId),
+			),
+		),
+		newXmlElement("saml:AuthnStatement",
+			"AuthnInstant", samlTime(now),
+			"SessionIndex", samlId(),
+			"SessionNotOnOrAfter", samlTime(now.Add(samlSessionLifetime)),
+		).add(
+			newXmlElement("saml:AuthnContext").add(
+				newXmlElement("saml:AuthnContextClassRef").text(samlAuthnContextPassword),
+			),
+		),
+	)
+
+	if attributes := samlAttributes(request.Application, user); attributes != nil {
+		assertion.add(attributes)
+	}
+	return assertion
+}
+
+// samlAttributes returns the AttributeStatement for the mapping of the service provider, or nil when empty
+func samlAttributes(application *models.Application, user *models.User) *xmlElement {
+	mapping := application.SamlAttributes
+	if len(mapping) == 0 {
+		mapping = defaultSamlAttributes
+	}
+
+	names := make([]string, 0, len(mapping))
+	for name := range mapping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	statement := newXmlElement("saml:AttributeStatement")
+	for _, name := range names {
+		value := SamlUserField(user, mapping[name])
+		if value == "" {
+			continue
+		}
+		statement.add(newXmlElement("saml:Attribute", "Name", name, "NameFormat", samlAttrNameFormatBasic).add(
+			newXmlElement("saml:AttributeValue").text(value),
+		))
+	}
+	if len(statement.Children) == 0 {
+		return nil
+	}
+	return statement
+}
+
+// ParseSamlLogoutRequest validates a decoded LogoutRequest of a service provider that has a single
+// logout URL. The response is sent with the binding the request arrived with.
+func ParseSamlLogoutRequest(data []byte, binding string) (*SamlLogoutRequest, error) {
+	if binding != SamlBindingRedirect && binding != SamlBindingPost {
+		return nil, fmt.Errorf("%w: unsupported binding", ErrSamlRequestInvalid)
+	}
+
+	var message samlLogoutRequestXml
+	if err := xml.Unmarshal(data, &message); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSamlRequestInvalid, err)
+	}
+	if message.Version != samlVersion || message.ID == "" {
+		return nil, fmt.Errorf("%w: unsupported version or missing ID", ErrSamlRequestInvalid)
+	}
+	if message.Destination != "" && message.Destination != samlSloUrl() {
+		return nil, fmt.Errorf("%w: destination %s is not this endpoint", ErrSamlRequestInvalid, message.Destination)
+	}
+
+	application, err := samlServiceProvider(message.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	if application.SamlSloUrl == "" {
+		return nil, ErrSamlSloNotConfigured
+	}
+
+	nameIdFormat := message.NameId.Format
+	if nameIdFormat == "" {
+		nameIdFormat = samlNameIdFormat(application)
+	}
+	return &SamlLogoutRequest{
+		Application:  application,
+		RequestId:    message.ID,
+		NameId:       strings.TrimSpace(message.NameId.Value),
+		NameIdFormat: nameIdFormat,
+		Binding:      binding,
+	}, nil
+}
+
+// SignOutSamlSession signs out the session of the browser that delivers a LogoutRequest, given by the
+// user and sid of its console token, when the session signed in to the service provider and the user
+// is the principal of the request. LogoutRequests are not signed, so a NameID alone never ends a
+// session. Transient NameIDs are not stored, for them the attached service provider has to suffice.
+func SignOutSamlSession(request *SamlLogoutRequest, userId int64, sessionName string) (bool, error) {
+	if userId == 0 || sessionName == "" || request.NameId == "" {
+		return false, nil
+	}
+	user, err := models.GetUserById(userId)
+	if err != nil || user == nil {
+		return false, err
+	}
+	if request.NameIdFormat != SamlNameIdTransient {
+		if nameId, err := samlNameId(user, request.NameIdFormat); err != nil || nameId != request.NameId {
+			return false, nil
+		}
+	}
+
+	session, err := models.GetSession(user.Owner, sessionName)
+	if err != nil {
+		return false, err
+	}
+	if session == nil || session.UserId != user.Id || !slices.Contains(session.Applications, request.Application.GetId()) {
+		return false, nil
+	}
+	if err := SignOutSession(user, sessionName); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// BuildSamlLogoutResponse returns the signed LogoutResponse, sent with the binding of the request
+func BuildSamlLogoutResponse(request *SamlLogoutRequest, relayState string) (*SamlMessage, error) {
+	destination := request.Application.SamlSloUrl
+	response := samlResponseElement("samlp:LogoutResponse", request.RequestId, destination, time.Now())
+	response.add(samlStatus(samlStatusSuccess, ""))
+
+	if request.Binding == SamlBindingRedirect {
+		// The Redirect binding signs the query string instead of the XML
+		encoded, err := EncodeSamlRedirectMessage([]byte(response.Canonical()))
+		if err != nil {
+			return nil, err
+		}
+		query, err := signRedirectQuery("SAMLResponse", encoded, relayState)
+		if err != nil {
+			return nil, err
+		}
+		separator := "?"
+		if strings.Contains(destination, "?") {
+			separator = "&"
+		}
+		return &SamlMessage{Binding: SamlBindingRedirect, Url: destination + separator + query}, nil
+	}
+
+	if err := signXmlElement(response); err != nil {
+		return nil, err
+	}
+	return &SamlMessage{
+		Binding:      SamlBindingPost,
+		Url:          destination,
+		SAMLResponse: base64.StdEncoding.EncodeToString([]byte(response.Canonical())),
+		RelayState:   relayState,
+	}, nil
+}
+
+// BuildSamlMetadata returns the signed IdP metadata with the signing certificate and endpoints
+func BuildSamlMetadata() (string, error) {
+	certificate, err := GetSamlCertificate()
+	if err != nil {
+		return "", err
+	}
+
+	descriptor := newXmlElement("md:IDPSSODescriptor",
+		"WantAuthnRequestsSigned", "false",
+		"protocolSupportEnumeration", samlProtocolSupportEnumeration,
+	).add(
+		newXmlElement("md:KeyDescriptor", "use", "signing").add(samlKeyInfo(certificate)),
+		newXmlElement("md:SingleLogoutService", "Binding", SamlBindingRedirect, "Location", samlSloUrl()),
+		newXmlElement("md:SingleLogoutService", "Binding", SamlBindingPost, "Location", samlSloUrl()),
+	)
+	for _, format := range SupportedSamlNameIdFormats {
+		descriptor.add(newXmlElement("md:NameIDFormat").text(format))
+	}
+	descriptor.add(
+		newXmlElement("md:SingleSignOnService", "Binding", SamlBindingRedirect, "Location", samlSsoUrl()),
+		newXmlElement("md:SingleSignOnService", "Binding", SamlBindingPost, "Location", samlSsoUrl()),
+	)
+
+	entity := newXmlElement("md:EntityDescriptor",
+		"ID", samlId(),
+		"entityID", SamlIdpEntityId(),
+	).add(descriptor)
+	if err := signXmlElement(entity); err != nil {
+		return "", err
+	}
+	return xml.Header + entity.Canonical(), nil
+}
@@ -0,0 +1,376 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// between returns the text between the first start and the following end, including both when inclusive
+func between(t *testing.T, document, start, end string, inclusive bool) string {
+	t.Helper()
+	i := strings.Index(document, start)
+	if i < 0 {
+		t.Fatalf("%s not found in %s", start, document)
+	}
+	j := strings.Index(document[i:], end)
+	if j < 0 {
+		t.Fatalf("%s not found after %s", end, start)
+	}
+	if inclusive {
+		return document[i : i+j+len(end)]
+	}
+	return document[i+len(start) : i+j]
+}
+
+// verifySamlSignature checks the enveloped signature of the element starting with start against
+// the server key, recomputing the digest over the element without its signature
+func verifySamlSignature(t *testing.T, document, start, end string) {
+	t.Helper()
+	element := between(t, document, start, end, true)
+	signature := between(t, element, "<ds:Signature", "</ds:Signature>", true)
+	unsigned := strings.Replace(element, signature, "", 1)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	if got := between(t, signature, "<ds:DigestValue>", "</ds:DigestValue>", false); got != base64.StdEncoding.EncodeToString(digest[:]) {
+		t.Fatalf("Digest mismatch for %s", start)
+	}
+
+	// Exclusive c14n of SignedInfo alone declares the ds namespace it inherits in the document
+	signedInfo := between(t, signature, "<ds:SignedInfo>", "</ds:SignedInfo>", true)
+	signedInfo = strings.Replace(signedInfo, "<ds:SignedInfo>", `<ds:SignedInfo xmlns:ds="`+xmlNsDsig+`">`, 1)
+	signedInfoDigest := sha256.Sum256([]byte(signedInfo))
+
+	value, err := base64.StdEncoding.DecodeString(between(t, signature, "<ds:SignatureValue>", "</ds:SignatureValue>", false))
+	if err != nil {
+		t.Fatalf("Invalid signature value: %v", err)
+	}
+
+	der, err := base64.StdEncoding.DecodeString(between(t, signature, "<ds:X509Certificate>", "</ds:X509Certificate>", false))
+	if err != nil {
+		t.Fatalf("Invalid certificate: %v", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	key, ok := certificate.PublicKey.(*rsa.PublicKey)
+	if !ok || !key.Equal(publicKey) {
+		t.Fatal("Certificate is not for the server key")
+	}
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, signedInfoDigest[:], value); err != nil {
+		t.Fatalf("Signature of %s did not verify: %v", start, err)
+	}
+}
+
+func testSamlApplication() *models.Application {
+	return &models.Application{
+		Owner:        "built-in",
+		Name:         "wiki",
+		Category:     models.ApplicationCategorySaml,
+		SamlEntityId: "https://wiki.example.com/saml",
+		SamlAcsUrl:   "https://wiki.example.com/saml/acs",
+		SamlSloUrl:   "https://wiki.example.com/saml/slo",
+		SamlAttributes: map[string]string{
+			"mail":  "email",
+			"admin": "isAdmin",
+			"tel":   "phone",
+		},
+	}
+}
+
+// TestXmlCanonical tests namespace placement, attribute order and escaping of exclusive c14n
+func TestXmlCanonical(t *testing.T) {
+	element := newXmlElement("samlp:Response", "Version", "2.0", "ID", "_1").add(
+		newXmlElement("saml:Issuer").text("a&b<c>"),
+		newXmlElement("samlp:Status").add(
+			newXmlElement("samlp:StatusCode", "Value", `x"y`),
+		),
+		newXmlElement("saml:Assertion").add(newXmlElement("saml:Subject")),
+	)
+
+	want := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1" Version="2.0">` +
+		`<saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">a&amp;b&lt;c&gt;</saml:Issuer>` +
+		`<samlp:Status><samlp:StatusCode Value="x&quot;y"></samlp:StatusCode></samlp:Status>` +
+		`<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"><saml:Subject></saml:Subject></saml:Assertion>` +
+		`</samlp:Response>`
+	if got := element.Canonical(); got != want {
+		t.Errorf("Canonical form mismatch\n got: %s\nwant: %s", got, want)
+	}
+}
+
+// TestBuildSamlResponse tests that the response and assertion are signed and carry the mapped user
+func TestBuildSamlResponse(t *testing.T) {
+	if err := InitRSAKeys(); err != nil {
+		t.Fatalf("Failed to initialize RSA keys: %v", err)
+	}
+
+	application := testSamlApplication()
+	user := &models.User{Id: 42, Username: "alice", Email: "alice@example.com", EmailVerified: true, Phone: "+8613800000000"}
+	request := &SamlAuthnRequest{
+		Application:  application,
+		RequestId:    "_request1",
+		AcsUrl:       application.SamlAcsUrl,
+		NameIdFormat: SamlNameIdPersistent,
+	}
+
+	message, err := BuildSamlResponse(request, user, "state-1")
+	if err != nil {
+		t.Fatalf("BuildSamlResponse failed: %v", err)
+	}
+	if message.Url != application.SamlAcsUrl || message.RelayState != "state-1" || message.Binding != SamlBindingPost {
+		t.Errorf("Unexpected message destination: %+v", message)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(message.SAMLResponse)
+	if err != nil {
+		t.Fatalf("Invalid SAMLResponse encoding: %v", err)
+	}
+	document := string(data)
+	verifySamlSignature(t, document, "<samlp:Response", "</samlp:Response>")
+	verifySamlSignature(t, document, "<saml:Assertion", "</saml:Assertion>")
+
+	var response struct {
+		InResponseTo string `xml:"InResponseTo,attr"`
+		Destination  string `xml:"Destination,attr"`
+		Status       struct {
+			StatusCode struct {
+				Value string `xml:"Value,attr"`
+			} `xml:"StatusCode"`
+		} `xml:"Status"`
+		Assertion struct {
+			Subject struct {
+				NameID struct {
+					Format string `xml:"Format,attr"`
+					Value  string `xml:",chardata"`
+				} `xml:"NameID"`
+				SubjectConfirmation struct {
+					Data struct {
+						InResponseTo string `xml:"InResponseTo,attr"`
+						Recipient    string `xml:"Recipient,attr"`
+					} `xml:"SubjectConfirmationData"`
+				} `xml:"SubjectConfirmation"`
+			} `xml:"Subject"`
+			Audience   string `xml:"Conditions>AudienceRestriction>Audience"`
+			Attributes []struct {
+				Name  string `xml:"Name,attr"`
+				Value string `xml:"AttributeValue"`
+			} `xml:"AttributeStatement>Attribute"`
+		} `xml:"Assertion"`
+	}
+	if err := xml.Unmarshal(data, &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	if response.InResponseTo != "_request1" || response.Destination != application.SamlAcsUrl {
+		t.Errorf("Unexpected response attributes: %s %s", response.InResponseTo, response.Destination)
+	}
+	if response.Status.StatusCode.Value != samlStatusSuccess {
+		t.Errorf("Expected success status, got %s", response.Status.StatusCode.Value)
+	}
+	subject := response.Assertion.Subject
+	if subject.NameID.Value != "42" || subject.NameID.Format != SamlNameIdPersistent {
+		t.Errorf("Expected persistent NameID 42, got %s (%s)", subject.NameID.Value, subject.NameID.Format)
+	}
+	if subject.SubjectConfirmation.Data.InResponseTo != "_request1" || subject.SubjectConfirmation.Data.Recipient != application.SamlAcsUrl {
+		t.Errorf("Unexpected subject confirmation: %+v", subject.SubjectConfirmation.Data)
+	}
+	if response.Assertion.Audience != application.SamlEntityId {
+		t.Errorf("Expected audience %s, got %s", application.SamlEntityId, response.Assertion.Audience)
+	}
+
+	// Attributes are sorted by name; an unverified phone is not released
+	attributes := response.Assertion.Attributes
+	if len(attributes) != 2 || attributes[0].Name != "admin" || attributes[0].Value != "false" ||
+		attributes[1].Name != "mail" || attributes[1].Value != "alice@example.com" {
+		t.Errorf("Unexpected attributes: %+v", attributes)
+	}
+}
+
+// TestBuildSamlResponseNameIdUnavailable tests that a missing NameID value yields an error status without assertion
+func TestBuildSamlResponseNameIdUnavailable(t *testing.T) {
+	if err := InitRSAKeys(); err != nil {
+		t.Fatalf("Failed to initialize RSA keys: %v", err)
+	}
+
+	application := testSamlApplication()
+	request := &SamlAuthnRequest{Application: application, AcsUrl: application.SamlAcsUrl, NameIdFormat: SamlNameIdEmail}
+	// Without an email, or with one that was never verified, there is no email NameID
+	for _, user := range []*models.User{
+		{Id: 7, Username: "bob"},
+		{Id: 8, Username: "carol", Email: "carol@example.com"},
+	} {
+		message, err := BuildSamlResponse(request, user, "")
+		if err != nil {
+			t.Fatalf("BuildSamlResponse failed: %v", err)
+		}
+
+		data, _ := base64.StdEncoding.DecodeString(message.SAMLResponse)
+		document := string(data)
+		verifySamlSignature(t, document, "<samlp:Response", "</samlp:Response>")
+		if strings.Contains(document, "<saml:Assertion") || strings.Contains(document, "carol@example.com") {
+			t.Errorf("%s: expected no assertion", user.Username)
+		}
+		if !strings.Contains(document, samlStatusInvalidNameIdPolicy) {
+			t.Errorf("%s: expected InvalidNameIDPolicy status", user.Username)
+		}
+		if strings.Contains(document, "InResponseTo") {
+			t.Error("IdP-initiated responses must not have InResponseTo")
+		}
+	}
+}
+
+// TestParseSamlAuthnRequestRejects tests request checks made before the service provider lookup
+func TestParseSamlAuthnRequestRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{"malformed", `<samlp:AuthnRequest`},
+		{"wrong element", `<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1" Version="2.0"/>`},
+		{"wrong version", `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1" Version="1.1"/>`},
+		{"missing ID", `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" Version="2.0"/>`},
+		{"other destination", `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1" Version="2.0" Destination="https://other.example.com/sso"/>`},
+		{"artifact binding", `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1" Version="2.0" ProtocolBinding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"/>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseSamlAuthnRequest([]byte(tt.request)); !errors.Is(err, ErrSamlRequestInvalid) {
+				t.Errorf("Expected ErrSamlRequestInvalid, got %v", err)
+			}
+		})
+	}
+}
+
+// TestSamlRedirectEncoding tests the deflate and base64 round trip of the Redirect binding
+func TestSamlRedirectEncoding(t *testing.T) {
+	message := []byte(`<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1" Version="2.0"/>`)
+	encoded, err := EncodeSamlRedirectMessage(message)
+	if err != nil {
+		t.Fatalf("EncodeSamlRedirectMessage failed: %v", err)
+	}
+
+	decoded, err := DecodeSamlMessage(encoded, true)
+	if err != nil || string(decoded) != string(message) {
+		t.Errorf("Round trip mismatch: %s, %v", decoded, err)
+	}
+	if _, err := DecodeSamlMessage("not base64!", false); !errors.Is(err, ErrSamlRequestInvalid) {
+		t.Errorf("Expected ErrSamlRequestInvalid, got %v", err)
+	}
+}
+
+// TestBuildSamlLogoutResponse tests both bindings of the logout response
+func TestBuildSamlLogoutResponse(t *testing.T) {
+	if err := InitRSAKeys(); err != nil {
+		t.Fatalf("Failed to initialize RSA keys: %v", err)
+	}
+	application := testSamlApplication()
+
+	message, err := BuildSamlLogoutResponse(&SamlLogoutRequest{Application: application, RequestId: "_logout1", Binding: SamlBindingPost}, "rs")
+	if err != nil {
+		t.Fatalf("BuildSamlLogoutResponse failed: %v", err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(message.SAMLResponse)
+	verifySamlSignature(t, string(data), "<samlp:LogoutResponse", "</samlp:LogoutResponse>")
+	if message.Url != application.SamlSloUrl || !strings.Contains(string(data), `InResponseTo="_logout1"`) {
+		t.Errorf("Unexpected logout response: %s", data)
+	}
+
+	message, err = BuildSamlLogoutResponse(&SamlLogoutRequest{Application: application, RequestId: "_logout2", Binding: SamlBindingRedirect}, "rs")
+	if err != nil {
+		t.Fatalf("BuildSamlLogoutResponse failed: %v", err)
+	}
+	if message.Binding != SamlBindingRedirect || message.SAMLResponse != "" {
+		t.Errorf("Expected a redirect message, got %+v", message)
+	}
+
+	// The signature covers the query up to SigAlg in the order it was sent
+	rawQuery := strings.SplitN(message.Url, "?", 2)[1]
+	signedPart := rawQuery[:strings.Index(rawQuery, "&Signature=")]
+	query, _ := url.ParseQuery(rawQuery)
+	signature, _ := base64.StdEncoding.DecodeString(query.Get("Signature"))
+	digest := sha256.Sum256([]byte(signedPart))
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("Redirect signature did not verify: %v", err)
+	}
+	if query.Get("SigAlg") != xmlDsigRsaSha256 || query.Get("RelayState") != "rs" {
+		t.Errorf("Unexpected query: %s", rawQuery)
+	}
+
+	data, err = DecodeSamlMessage(query.Get("SAMLResponse"), true)
+	if err != nil || !strings.Contains(string(data), `InResponseTo="_logout2"`) {
+		t.Errorf("Unexpected redirect logout response: %s, %v", data, err)
+	}
+}
+
+// TestSamlLogoutRequestNameId tests that the NameID of a LogoutRequest is read with its format,
+// and that a request without the browser's console session signs nothing out
+func TestSamlLogoutRequestNameId(t *testing.T) {
+	data := `<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_logout1" Version="2.0">
+		<saml:Issuer>https://wiki.example.com</saml:Issuer>
+		<saml:NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent">42</saml:NameID>
+	</samlp:LogoutRequest>`
+	var message samlLogoutRequestXml
+	if err := xml.Unmarshal([]byte(data), &message); err != nil {
+		t.Fatalf("Failed to parse LogoutRequest: %v", err)
+	}
+	if message.NameId.Value != "42" || message.NameId.Format != SamlNameIdPersistent {
+		t.Errorf("Expected persistent NameID 42, got %q (%q)", message.NameId.Value, message.NameId.Format)
+	}
+
+	// Without the console session of the browser the NameID alone signs nothing out
+	request := &SamlLogoutRequest{Application: testSamlApplication(), NameId: "alice@example.com", NameIdFormat: SamlNameIdEmail}
+	if signedOut, err := SignOutSamlSession(request, 0, ""); err != nil || signedOut {
+		t.Errorf("Expected no session to be signed out, got %v (%v)", signedOut, err)
+	}
+}
+
+// TestBuildSamlMetadata tests the signed metadata endpoints and signing key
+func TestBuildSamlMetadata(t *testing.T) {
+	if err := InitRSAKeys(); err != nil {
+		t.Fatalf("Failed to initialize RSA keys: %v", err)
+	}
+	t.Setenv("ORIGIN", "https://id.example.com")
+
+	metadata, err := BuildSamlMetadata()
+	if err != nil {
+		t.Fatalf("BuildSamlMetadata failed: %v", err)
+	}
+	verifySamlSignature(t, metadata, "<md:EntityDescriptor", "</md:EntityDescriptor>")
+
+	var entity struct {
+		EntityId   string `xml:"entityID,attr"`
+		Descriptor struct {
+			SingleSignOn []struct {
+				Binding  string `xml:"Binding,attr"`
+				Location string `xml:"Location,attr"`
+			} `xml:"SingleSignOnService"`
+			NameIdFormats []string `xml:"NameIDFormat"`
+		} `xml:"IDPSSODescriptor"`
+	}
+	if err := xml.Unmarshal([]byte(metadata), &entity); err != nil {
+		t.Fatalf("Failed to parse metadata: %v", err)
+	}
+	if entity.EntityId != "https://id.example.com/api/saml/metadata" {
+		t.Errorf("Unexpected entity ID %s", entity.EntityId)
+	}
+	if len(entity.Descriptor.SingleSignOn) != 2 || entity.Descriptor.SingleSignOn[0].Location != "https://id.example.com/api/saml/sso" {
+		t.Errorf("Unexpected SSO services: %+v", entity.Descriptor.SingleSignOn)
+	}
+	if len(entity.Descriptor.NameIdFormats) != len(SupportedSamlNameIdFormats) {
+		t.Errorf("Unexpected NameID formats: %v", entity.Descriptor.NameIdFormats)
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XML namespaces used in SAML messages and metadata
+const (
+	samlNsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlNsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlNsMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	xmlNsDsig       = "http://www.w3.org/2000/09/xmldsig#"
+
+	xmlDsigExcC14n     = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	xmlDsigEnveloped   = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	xmlDsigRsaSha256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	xmlDsigSha256      = "http://www.w3.org/2001/04/xmlenc#sha256"
+	samlCertificateTTL = 10 * 365 * 24 * time.Hour
+)
+
+// SamlCertificateFile holds the self-signed certificate for the server RSA key published in IdP metadata
+const SamlCertificateFile = "keys/saml-cert.pem"
+
+// samlPrefixes maps the prefixes used in generated documents to their namespaces
+var samlPrefixes = map[string]string{
+	"saml":  samlNsAssertion,
+	"samlp": samlNsProtocol,
+	"md":    samlNsMetadata,
+	"ds":    xmlNsDsig,
+}
+
+// xmlElement is a minimal XML tree for documents the server generates and signs.
+// Names are "prefix:local"; every prefix must be in samlPrefixes.
+type xmlElement struct {
+	Name     string
+	Attrs    map[string]string
+	Children []*xmlElement
+	Text     string
+}
+
+func newXmlElement(name string, attrs ...string) *xmlElement {
+	element := &xmlElement{Name: name, Attrs: map[string]string{}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		element.Attrs[attrs[i]] = attrs[i+1]
+	}
+	return element
+}
+
+// add appends children and returns the element for chaining
+func (e *xmlElement) add(children ...*xmlElement) *xmlElement {
+	e.Children = append(e.Children, children...)
+	return e
+}
+
+// text sets the character content and returns the element for chaining
+func (e *xmlElement) text(value string) *xmlElement {
+	e.Text = value
+	return e
+}
+
+func xmlPrefix(name string) string {
+	if i := strings.Index(name, ":"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// Canonical serializes the element with Exclusive XML Canonicalization 1.0 without comments.
+// Generated documents are already in canonical form, so the same output is used on the wire.
+func (e *xmlElement) Canonical() string {
+	var builder strings.Builder
+	e.writeCanonical(&builder, map[string]string{})
+	return builder.String()
+}
+
+func (e *xmlElement) writeCanonical(builder *strings.Builder, rendered map[string]string) {
+	// Exclusive c14n declares a namespace where it is visibly used and not already in scope of the output
+	used := []string{xmlPrefix(e.Name)}
+	for name := range e.Attrs {
+		if prefix := xmlPrefix(name); prefix != "" {
+			used = append(used, prefix)
+		}
+	}
+	declared := map[string]string{}
+	for _, prefix := range used {
+		if prefix == "" {
+			continue
+		}
+		if uri := samlPrefixes[prefix]; rendered[prefix] != uri {
+			declared[prefix] = uri
+		}
+	}
+
+	builder.WriteString("<" + e.Name)
+
+	prefixes := make([]string, 0, len(declared))
+	for prefix := range declared {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		builder.WriteString(fmt.Sprintf(` xmlns:%s="%s"`, prefix, escapeXmlAttr(declared[prefix])))
+	}
+
+	// Attributes sort by namespace URI then local name; unqualified attributes have no namespace
+	names := make([]string, 0, len(e.Attrs))
+	for name := range e.Attrs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		left, right := samlPrefixes[xmlPrefix(names[i])], samlPrefixes[xmlPrefix(names[j])]
+		if left != right {
+			return left < right
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		builder.WriteString(fmt.Sprintf(` %s="%s"`, name, escapeXmlAttr(e.Attrs[name])))
+	}
+	builder.WriteString(">")
+
+	if len(declared) > 0 {
+		scope := make(map[string]string, len(rendered)+len(declared))
+		for prefix, uri := range rendered {
+			scope[prefix] = uri
+		}
+		for prefix, uri := range declared {
+			scope[prefix] = uri
+		}
+		rendered = scope
+	}
+
+	builder.WriteString(escapeXmlText(e.Text))
+	for _, child := range e.Children {
+		child.writeCanonical(builder, rendered)
+	}
+	builder.WriteString("</" + e.Name + ">")
+}
+
+func escapeXmlText(value string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;").Replace(value)
+}
+
+func escapeXmlAttr(value string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;").Replace(value)
+}
+
+// signXmlElement adds an enveloped XML signature over the element, referenced by its ID attribute.
+// The signature is inserted after the Issuer child as the SAML schemas require.
+func signXmlElement(element *xmlElement) error {
+	if privateKey == nil {
+		return fmt.Errorf("private key not initialized")
+	}
+	certificate, err := GetSamlCertificate()
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256([]byte(element.Canonical()))
+	signedInfo := newXmlElement("ds:SignedInfo").add(
+		newXmlElement("ds:CanonicalizationMethod", "Algorithm", xmlDsigExcC14n),
+		newXmlElement("ds:SignatureMethod", "Algorithm", xmlDsigRsaSha256),
+		newXmlElement("ds:Reference", "URI", "#"+element.Attrs["ID"]).add(
+			newXmlElement("ds:Transforms").add(
+				newXmlElement("ds:Transform", "Algorithm", xmlDsigEnveloped),
+				newXmlElement("ds:Transform", "Algorithm", xmlDsigExcC14n),
+			),
+			newXmlElement("ds:DigestMethod", "Algorithm", xmlDsigSha256),
+			newXmlElement("ds:DigestValue").text(base64.StdEncoding.EncodeToString(digest[:])),
+		),
+	)
+
+	signedInfoDigest := sha256.Sum256([]byte(signedInfo.Canonical()))
+	signatureValue, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, signedInfoDigest[:])
+	if err != nil {
+		return err
+	}
+
+	signature := newXmlElement("ds:Signature").add(
+		signedInfo,
+		newXmlElement("ds:SignatureValue").text(base64.StdEncoding.EncodeToString(signatureValue)),
+		samlKeyInfo(certificate),
+	)
+
+	position := 0
+	for i, child := range element.Children {
+		if strings.HasSuffix(child.Name, ":Issuer") {
+			position = i + 1
+			break
+		}
+	}
+	children := append([]*xmlElement{}, element.Children[:position]...)
+	children = append(children, signature)
+	element.Children = append(children, element.Children[position:]...)
+	return nil
+}
+
+// samlKeyInfo returns the KeyInfo carrying the signing certificate
+func samlKeyInfo(certificate []byte) *xmlElement {
+	return newXmlElement("ds:KeyInfo").add(
+		newXmlElement("ds:X509Data").add(
+			newXmlElement("ds:X509Certificate").text(base64.StdEncoding.EncodeToString(certificate)),
+		),
+	)
+}
+
+// signRedirectQuery signs a message for the HTTP-Redirect binding (SAML Bindings §3.4.4.1):
+// the signature covers the URL-encoded SAMLRequest or SAMLResponse, RelayState and SigAlg in that order
+func signRedirectQuery(messageParam, encodedMessage, relayState string) (string, error) {
+	if privateKey == nil {
+		return "", fmt.Errorf("private key not initialized")
+	}
+
+	query := messageParam + "=" + url.QueryEscape(encodedMessage)
+	if relayState != "" {
+		query += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	query += "&SigAlg=" + url.QueryEscape(xmlDsigRsaSha256)
+
+	digest := sha256.Sum256([]byte(query))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return query + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+var (
+	samlCertificate   []byte
+	samlCertificateMu sync.Mutex
+)
+
+// GetSamlCertificate returns the DER certificate of the server RSA key. It is self-signed and stored in
+// SamlCertificateFile; a new one is created when the file is missing, expiring or for another key.
+func GetSamlCertificate() ([]byte, error) {
+	samlCertificateMu.Lock()
+	defer samlCertificateMu.Unlock()
+
+	if privateKey == nil {
+		return nil, fmt.Errorf("private key not initialized")
+	}
+	if samlCertificate != nil {
+		return samlCertificate, nil
+	}
+
+	if data, err := os.ReadFile(SamlCertificateFile); err == nil {
+		if block, _ := pem.Decode(data); block != nil {
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err == nil && time.Until(certificate.NotAfter) > 30*24*time.Hour {
+				if key, ok := certificate.PublicKey.(*rsa.PublicKey); ok && key.Equal(&privateKey.PublicKey) {
+					samlCertificate = block.Bytes
+					return samlCertificate, nil
+				}
+			}
+		}
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "XianlinNet ID SAML Signing"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(samlCertificateTTL),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create saml certificate: %v", err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+	if err := os.WriteFile(SamlCertificateFile, data, 0644); err != nil {
+		// The certificate still works for this process; metadata changes on the next start
+		fmt.Printf("[SAML] Failed to save certificate: %v\n", err)
+	}
+	samlCertificate = certificate
+	return samlCertificate, nil
+}
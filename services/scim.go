@@ -0,0 +1,714 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// SCIM resource schemas (RFC 7643)
+const (
+	ScimSchemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	ScimSchemaGroup                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	ScimSchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	ScimSchemaResourceType          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	ScimSchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+)
+
+// SCIM error types (RFC 7644 §3.12)
+const (
+	ScimTypeInvalidFilter = "invalidFilter"
+	ScimTypeInvalidPath   = "invalidPath"
+	ScimTypeInvalidSyntax = "invalidSyntax"
+	ScimTypeInvalidValue  = "invalidValue"
+	ScimTypeNoTarget      = "noTarget"
+	ScimTypeUniqueness    = "uniqueness"
+	ScimTypeMutability    = "mutability"
+)
+
+const (
+	// ScimMaxResults caps the page size of list responses
+	ScimMaxResults = 200
+	// ScimDefaultCount is the page size when the client does not ask for one
+	ScimDefaultCount = 100
+)
+
+// User attributes without a column are stored in User.Properties
+const (
+	scimExternalIdProperty  = "scimExternalId"
+	scimDisplayNameProperty = "displayName"
+	scimGivenNameProperty   = "givenName"
+	scimFamilyNameProperty  = "familyName"
+)
+
+// scimMultiValued lists the multi-valued attributes, which PATCH add appends to
+var scimMultiValued = map[string]bool{"emails": true, "phonenumbers": true, "groups": true, "members": true, "schemas": true}
+
+var ErrScimTokenInvalid = fmt.Errorf("the SCIM token is invalid, revoked or expired")
+
+// ScimError is a SCIM protocol error with its HTTP status and SCIM error type
+type ScimError struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+func (e *ScimError) Error() string {
+	return e.Detail
+}
+
+func NewScimError(status int, scimType, format string, args ...interface{}) *ScimError {
+	return &ScimError{Status: status, ScimType: scimType, Detail: fmt.Sprintf(format, args...)}
+}
+
+// AuthenticateScimToken checks a SCIM bearer token and returns the organization it manages
+func AuthenticateScimToken(token string) (string, error) {
+	scimToken, err := models.GetScimTokenByToken(token)
+	if err != nil {
+		return "", err
+	}
+	if scimToken == nil || !scimToken.IsUsable() {
+		return "", ErrScimTokenInvalid
+	}
+
+	organization, err := models.GetOrganization("admin", scimToken.Organization)
+	if err != nil {
+		return "", err
+	}
+	if organization == nil {
+		return "", ErrScimTokenInvalid
+	}
+	return organization.Name, nil
+}
+
+// ScimUrl returns the absolute URL of a SCIM endpoint, used for resource locations
+func ScimUrl(path string) string {
+	origin := os.Getenv("ORIGIN")
+	if origin == "" {
+		origin = "http://localhost:8080"
+	}
+	return strings.TrimRight(origin, "/") + "/scim/v2" + path
+}
+
+// scimMeta builds the meta attribute; the version is filled in by withScimVersion
+func scimMeta(resourceType, location, created, lastModified string) map[string]interface{} {
+	if lastModified == "" {
+		lastModified = created
+	}
+	return map[string]interface{}{
+		"resourceType": resourceType,
+		"created":      created,
+		"lastModified": lastModified,
+		"location":     location,
+	}
+}
+
+// withScimVersion sets meta.version to a weak ETag derived from the resource content, so that
+// any change of a returned attribute changes the version
+func withScimVersion(resource map[string]interface{}) map[string]interface{} {
+	meta, _ := resource["meta"].(map[string]interface{})
+	delete(resource, "meta")
+	// Maps are marshaled with sorted keys, so equal resources give equal versions
+	data, _ := json.Marshal(resource)
+	sum := sha256.Sum256(data)
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+	meta["version"] = fmt.Sprintf(`W/"%s"`, hex.EncodeToString(sum[:8]))
+	resource["meta"] = meta
+	return resource
+}
+
+// ScimVersion returns the version (ETag) of a rendered resource
+func ScimVersion(resource map[string]interface{}) string {
+	meta, _ := resource["meta"].(map[string]interface{})
+	version, _ := meta["version"].(string)
+	return version
+}
+
+// ScimUserResource renders a user with the groups of its organization that list it as a member
+func ScimUserResource(user *models.User, groups []*models.Group) map[string]interface{} {
+	id := user.GetId()
+	resource := map[string]interface{}{
+		"schemas":  []interface{}{ScimSchemaUser},
+		"id":       id,
+		"userName": user.Username,
+		"active":   !user.IsForbidden,
+		"meta":     scimMeta("User", ScimUrl("/Users/"+id), user.CreatedTime, user.UpdatedTime),
+	}
+
+	if externalId := user.Properties[scimExternalIdProperty]; externalId != "" {
+		resource["externalId"] = externalId
+	}
+	if displayName := user.Properties[scimDisplayNameProperty]; displayName != "" {
+		resource["displayName"] = displayName
+	}
+	givenName, familyName := user.Properties[scimGivenNameProperty], user.Properties[scimFamilyNameProperty]
+	if givenName != "" || familyName != "" {
+		name := map[string]interface{}{"formatted": strings.TrimSpace(givenName + " " + familyName)}
+		if givenName != "" {
+			name["givenName"] = givenName
+		}
+		if familyName != "" {
+			name["familyName"] = familyName
+		}
+		resource["name"] = name
+	}
+
+	if user.Email != "" {
+		resource["emails"] = []interface{}{
+			map[string]interface{}{"value": user.Email, "type": "work", "primary": true},
+		}
+	}
+	if user.Phone != "" {
+		resource["phoneNumbers"] = []interface{}{
+			map[string]interface{}{"value": user.Phone, "type": "mobile", "primary": true},
+		}
+	}
+
+	memberOf := []interface{}{}
+	for _, group := range groups {
+		if group.HasMember(id) {
+			memberOf = append(memberOf, map[string]interface{}{
+				"value":   group.Name,
+				"display": group.DisplayName,
+				"$ref":    ScimUrl("/Groups/" + group.Name),
+				"type":    "direct",
+			})
+		}
+	}
+	if len(memberOf) > 0 {
+		resource["groups"] = memberOf
+	}
+
+	return withScimVersion(resource)
+}
+
+// ScimGroupResource renders a group; members missing from users are left out
+func ScimGroupResource(group *models.Group, users map[string]*models.User) map[string]interface{} {
+	resource := map[string]interface{}{
+		"schemas":     []interface{}{ScimSchemaGroup},
+		"id":          group.Name,
+		"displayName": group.DisplayName,
+		"meta":        scimMeta("Group", ScimUrl("/Groups/"+group.Name), group.CreatedTime, group.UpdatedTime),
+	}
+	if group.ExternalId != "" {
+		resource["externalId"] = group.ExternalId
+	}
+
+	members := []interface{}{}
+	for _, userId := range group.Members {
+		user, ok := users[userId]
+		if !ok {
+			continue
+		}
+		members = append(members, map[string]interface{}{
+			"value":   userId,
+			"display": user.Username,
+			"$ref":    ScimUrl("/Users/" + userId),
+			"type":    "User",
+		})
+	}
+	if len(members) > 0 {
+		resource["members"] = members
+	}
+
+	return withScimVersion(resource)
+}
+
+// scimString reads an optional string attribute
+func scimString(resource map[string]interface{}, name string) (string, error) {
+	value, _ := scimLookup(resource, name)
+	switch typed := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return strings.TrimSpace(typed), nil
+	}
+	return "", NewScimError(http.StatusBadRequest, ScimTypeInvalidValue, "%s must be a string", name)
+}
+
+// scimBool reads a boolean attribute, also accepting the "True"/"False" strings some clients send
+func scimBool(value interface{}, name string) (bool, error) {
+	switch typed := value.(type) {
+	case bool:
+		return typed, nil
+	case string:
+		switch strings.ToLower(typed) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+	}
+	return false, NewScimError(http.StatusBadRequest, ScimTypeInvalidValue, "%s must be a boolean", name)
+}
+
+// scimPrimaryValue returns the value of the primary element of a multi-valued attribute, or of the first one
+func scimPrimaryValue(resource map[string]interface{}, name string) (string, error) {
+	value, _ := scimLookup(resource, name)
+	if value == nil {
+		return "", nil
+	}
+	if _, ok := value.([]interface{}); !ok {
+		return "", NewScimError(http.StatusBadRequest, ScimTypeInvalidValue, "%s must be an array", name)
+	}
+
+	elements := scimElements(resource, name)
+	for _, element := range elements {
+		if primary, _ := scimLookup(element, "primary"); primary == true {
+			return scimString(element, "value")
+		}
+	}
+	if len(elements) > 0 {
+		return scimString(elements[0], "value")
+	}
+	return "", nil
+}
+
+func setScimProperty(user *models.User, key, value string) {
+	if value == "" {
+		delete(user.Properties, key)
+		return
+	}
+	if user.Properties == nil {
+		user.Properties = map[string]string{}
+	}
+	user.Properties[key] = value
+}
+
+// ApplyScimUser copies the writable attributes of a SCIM user to the local user. Absent attributes
+// are cleared, as a PUT replaces the whole resource; active is kept when absent. The password is
+// write-only and only set when present, hashed with the given password type. Uniqueness is checked
+// by the caller.
+func ApplyScimUser(user *models.User, resource map[string]interface{}, passwordType string) error {
+	userName, err := scimString(resource, "userName")
+	if err != nil {
+		return err
+	}
+	if userName == "" {
+		return NewScimError(http.StatusBadRequest, ScimTypeInvalidValue, "userName is required")
+	}
+	if len([]rune(userName)) > 100 {
+		return NewScimError(http.StatusBadRequest, ScimTypeInvalidValue, "userName is too long")
+	}
+
+	email, err := scimPrimaryValue(resource, "emails")
+	if err != nil {
+		return err
+	}
+	if email != "" && !ValidateEmail(email) {
+		return NewScimError(http.StatusBadRequest, ScimTypeInvalidValue, "invalid email %q", email)
+	}
+
+	phone, err := scimPrimaryValue(resource, "phoneNumbers")
+	if err != nil {
+		return err
+	}
+	if phone != "" {
+		if phone, err = NormalizePhone(phone); err != nil {
+			return NewScimError(http.StatusBadRequest, ScimTypeInvalidValue, "invalid phone number")
+		}
+	}
+
+	properties := map[string]string{}
+	for _, attribute := range []struct{ key, name string }{
+		{scimExternalIdProperty, "externalId"},
+		{scimDisplayNameProperty, "displayName"},
+	} {
+		if properties[attribute.key], err = scimString(resource, attribute.name); err != nil {
+			return err
+		}
+	}
+	if name, _ := scimLookup(resource, "name"); name != nil {
+		nameValue, ok := name.(map[string]interface{})
+		if !ok {
+			return NewScimError(http.StatusBadRequest, ScimTypeInvalidValue, "name must be an object")
+		}
+		if properties[scimGivenNameProperty], err = scimString(nameValue, "givenName"); err != nil {
+			return err
+		}
+		if properties[scimFamilyNameProperty], err = scimString(nameValue, "familyName"); err != nil {
+			return err
+		}
+	}
+
+	active := !user.IsForbidden
+	if value, _ := scimLookup(resource, "active"); value != nil {
+		if active, err = scimBool(value, "active"); err != nil {
+			return err
+		}
+	}
+
+	password, err := scimString(resource, "password")
+	if err != nil {
+		return err
+	}
+	if password != "" {
+		if err := hashUserPassword(user, password, passwordType); err != nil {
+			return err
+		}
+	}
+
+	user.Username = userName
+	if email = strings.ToLower(email); email != user.Email {
+		// Addresses from the provisioning client have not been verified by a code either
+		user.Email = email
+		user.EmailVerified = false
+	}
+	if phone != user.Phone {
+		// Numbers from the provisioning client have not been verified by SMS
+		user.Phone = phone
+		user.PhoneVerified = false
+	}
+	for _, key := range []string{scimExternalIdProperty, scimDisplayNameProperty, scimGivenNameProperty, scimFamilyNameProperty} {
+		setScimProperty(user, key, properties[key])
+	}
+	user.IsForbidden = !active
+	return nil
+}
+
+// ApplyScimGroup copies the attributes of a SCIM group to the local group; members must be users of
+// the organization
+func ApplyScimGroup(group *models.Group, resource map[string]interface{}, users map[string]*models.User) error {
+	displayName, err := scimString(resource, "displayName")
+	if err != nil {
+		return err
+	}
+	if displayName == "" {
+		return NewScimError(http.StatusBadRequest, ScimTypeInvalidValue, "displayName is required")
+	}
+	externalId, err := scimString(resource, "externalId")
+	if err != nil {
+		return err
+	}
+
+	if value, _ := scimLookup(resource, "members"); value != nil {
+		if _, ok := value.([]interface{}); !ok {
+			return NewScimError(http.StatusBadRequest, ScimTypeInvalidValue, "members must be an array")
+		}
+	}
+	members := []string{}
+	seen := map[string]bool{}
+	for _, member := range scimElements(resource, "members") {
+		userId, err := scimString(member, "value")
+		if err != nil {
+			return err
+		}
+		if _, ok := users[userId]; !ok {
+			return NewScimError(http.StatusBadRequest, ScimTypeInvalidValue, "member %q is not a user of this organization", userId)
+		}
+		if !seen[userId] {
+			seen[userId] = true
+			members = append(members, userId)
+		}
+	}
+
+	group.DisplayName = displayName
+	group.ExternalId = externalId
+	group.Members = members
+	return nil
+}
+
+// ApplyScimPatch applies one PATCH operation to a rendered resource (RFC 7644 §3.5.2); the caller
+// then writes the result back with ApplyScimUser or ApplyScimGroup
+func ApplyScimPatch(resource map[string]interface{}, op, path string, value interface{}) error {
+	op = strings.ToLower(op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return NewScimError(http.StatusBadRequest, ScimTypeInvalidSyntax, "unknown operation %q", op)
+	}
+
+	if path == "" {
+		if op == "remove" {
+			return NewScimError(http.StatusBadRequest, ScimTypeNoTarget, "remove requires a path")
+		}
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			return NewScimError(http.StatusBadRequest, ScimTypeInvalidValue, "the value of an operation without path must be an object")
+		}
+		// Keys are attribute paths themselves, so that {"name.givenName": "Ann"} works as well
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			patchPath, err := parseScimPatchPath(key)
+			if err != nil {
+				return err
+			}
+			if err := applyScimPatchPath(resource, patchPath, op, values[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	patchPath, err := parseScimPatchPath(path)
+	if err != nil {
+		return err
+	}
+	return applyScimPatchPath(resource, patchPath, op, value)
+}
+
+func applyScimPatchPath(resource map[string]interface{}, path *scimPatchPath, op string, value interface{}) error {
+	switch strings.ToLower(path.attr) {
+	case "id", "meta", "schemas", "groups":
+		return NewScimError(http.StatusBadRequest, ScimTypeMutability, "%s is read-only", path.attr)
+	}
+
+	current, key := scimLookup(resource, path.attr)
+	if key == "" {
+		key = path.attr
+	}
+	if path.filter != nil {
+		return applyScimPatchFilter(resource, key, current, path, op, value)
+	}
+
+	switch op {
+	case "remove":
+		if path.subAttr != "" {
+			for _, element := range scimElements(resource, key) {
+				if _, subKey := scimLookup(element, path.subAttr); subKey != "" {
+					delete(element, subKey)
+				}
+			}
+			return nil
+		}
+		// Some clients name the elements to remove in the value, such as members by their value
+		if removed, ok := value.([]interface{}); ok {
+			if items, ok := current.([]interface{}); ok {
+				resource[key] = scimRemoveValues(items, removed)
+				return nil
+			}
+		}
+		delete(resource, key)
+		return nil
+	case "add", "replace":
+		if path.subAttr != "" {
+			element, ok := current.(map[string]interface{})
+			if !ok {
+				if current != nil {
+					return NewScimError(http.StatusBadRequest, ScimTypeInvalidPath, "%s has no sub-attributes", path.attr)
+				}
+				element = map[string]interface{}{}
+				resource[key] = element
+			}
+			setScimValue(element, path.subAttr, value)
+			return nil
+		}
+
+		if scimMultiValued[strings.ToLower(path.attr)] {
+			values, ok := value.([]interface{})
+			if !ok {
+				values = []interface{}{value}
+			}
+			items, _ := current.([]interface{})
+			if op == "replace" {
+				items = nil
+			}
+			if scimHasPrimary(values) {
+				// Only one element may be primary
+				for _, element := range scimElements(resource, key) {
+					if _, primaryKey := scimLookup(element, "primary"); primaryKey != "" {
+						element[primaryKey] = false
+					}
+				}
+			}
+			resource[key] = scimAppendValues(items, values)
+			return nil
+		}
+
+		// Sub-attributes of complex attributes that are not given are kept
+		if values, ok := value.(map[string]interface{}); ok {
+			if element, ok := current.(map[string]interface{}); ok {
+				for subKey, subValue := range values {
+					setScimValue(element, subKey, subValue)
+				}
+				return nil
+			}
+		}
+		resource[key] = value
+	}
+	return nil
+}
+
+// applyScimPatchFilter applies an operation to the elements of a multi-valued attribute matching the path filter
+func applyScimPatchFilter(resource map[string]interface{}, key string, current interface{}, path *scimPatchPath, op string, value interface{}) error {
+	items, _ := current.([]interface{})
+	result := make([]interface{}, 0, len(items))
+	matched := false
+	for _, item := range items {
+		element, ok := item.(map[string]interface{})
+		if !ok || !path.filter.Match(element) {
+			result = append(result, item)
+			continue
+		}
+		matched = true
+
+		switch {
+		case op == "remove" && path.subAttr == "":
+			continue
+		case op == "remove":
+			if _, subKey := scimLookup(element, path.subAttr); subKey != "" {
+				delete(element, subKey)
+			}
+		case path.subAttr != "":
+			setScimValue(element, path.subAttr, value)
+		default:
+			values, ok := value.(map[string]interface{})
+			if !ok {
+				return NewScimError(http.StatusBadRequest, ScimTypeInvalidValue, "the value for %s must be an object", path.attr)
+			}
+			for subKey, subValue := range values {
+				setScimValue(element, subKey, subValue)
+			}
+		}
+		result = append(result, element)
+	}
+
+	if !matched && op != "remove" {
+		// emails[type eq "work"].value on a user without a work email adds one
+		compare, ok := path.filter.(*scimCompareFilter)
+		if !ok || compare.op != "eq" || compare.path.subAttr != "" || path.subAttr == "" || compare.value == nil {
+			return NewScimError(http.StatusBadRequest, ScimTypeNoTarget, "no value of %s matches the filter", path.attr)
+		}
+		result = append(result, map[string]interface{}{compare.path.attr: compare.value, path.subAttr: value})
+	}
+	resource[key] = result
+	return nil
+}
+
+func setScimValue(element map[string]interface{}, name string, value interface{}) {
+	if _, key := scimLookup(element, name); key != "" {
+		element[key] = value
+		return
+	}
+	element[name] = value
+}
+
+// scimValueKey identifies an element of a multi-valued attribute by its value sub-attribute
+func scimValueKey(item interface{}) string {
+	if element, ok := item.(map[string]interface{}); ok {
+		if value, _ := scimLookup(element, "value"); value != nil {
+			return strings.ToLower(fmt.Sprint(value))
+		}
+	}
+	data, _ := json.Marshal(item)
+	return string(data)
+}
+
+func scimHasPrimary(values []interface{}) bool {
+	for _, value := range values {
+		if element, ok := value.(map[string]interface{}); ok {
+			if primary, _ := scimLookup(element, "primary"); primary == true {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scimAppendValues adds values to a multi-valued attribute, skipping elements already present
+func scimAppendValues(items, values []interface{}) []interface{} {
+	seen := map[string]bool{}
+	for _, item := range items {
+		seen[scimValueKey(item)] = true
+	}
+	for _, value := range values {
+		if key := scimValueKey(value); !seen[key] {
+			seen[key] = true
+			items = append(items, value)
+		}
+	}
+	return items
+}
+
+func scimRemoveValues(items, values []interface{}) []interface{} {
+	removed := map[string]bool{}
+	for _, value := range values {
+		removed[scimValueKey(value)] = true
+	}
+	result := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		if !removed[scimValueKey(item)] {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// ProjectScimResource applies the attributes and excludedAttributes parameters (comma-separated
+// top-level attribute names); schemas, id and meta are always returned
+func ProjectScimResource(resource map[string]interface{}, attributes, excludedAttributes string) map[string]interface{} {
+	parse := func(list string) map[string]bool {
+		names := map[string]bool{}
+		for _, name := range strings.Split(list, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names[strings.ToLower(parseScimAttrPath(name).attr)] = true
+			}
+		}
+		return names
+	}
+	included, excluded := parse(attributes), parse(excludedAttributes)
+	if len(included) == 0 && len(excluded) == 0 {
+		return resource
+	}
+
+	projected := map[string]interface{}{}
+	for key, value := range resource {
+		name := strings.ToLower(key)
+		always := name == "schemas" || name == "id" || name == "meta"
+		if always || (len(included) == 0 || included[name]) && !excluded[name] {
+			projected[key] = value
+		}
+	}
+	return projected
+}
+
+// FilterScimResources returns the resources matching a filter, all of them for an empty filter
+func FilterScimResources(resources []map[string]interface{}, filter string) ([]map[string]interface{}, error) {
+	if strings.TrimSpace(filter) == "" {
+		return resources, nil
+	}
+	parsed, err := ParseScimFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := []map[string]interface{}{}
+	for _, resource := range resources {
+		if parsed.Match(resource) {
+			matched = append(matched, resource)
+		}
+	}
+	return matched, nil
+}
+
+// PageScimResources returns the page of resources starting at the 1-based startIndex
+func PageScimResources(resources []map[string]interface{}, startIndex, count int) []map[string]interface{} {
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	if count < 0 {
+		count = 0
+	}
+	if startIndex > len(resources) {
+		return []map[string]interface{}{}
+	}
+	end := startIndex - 1 + count
+	if end > len(resources) {
+		end = len(resources)
+	}
+	return resources[startIndex-1 : end]
+}
@@ -0,0 +1,520 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ScimFilter is a parsed SCIM filter expression (RFC 7644 §3.4.2.2), evaluated against
+// the JSON representation of a resource
+type ScimFilter interface {
+	Match(resource map[string]interface{}) bool
+}
+
+type scimAndFilter struct{ left, right ScimFilter }
+
+func (f *scimAndFilter) Match(resource map[string]interface{}) bool {
+	return f.left.Match(resource) && f.right.Match(resource)
+}
+
+type scimOrFilter struct{ left, right ScimFilter }
+
+func (f *scimOrFilter) Match(resource map[string]interface{}) bool {
+	return f.left.Match(resource) || f.right.Match(resource)
+}
+
+type scimNotFilter struct{ filter ScimFilter }
+
+func (f *scimNotFilter) Match(resource map[string]interface{}) bool {
+	return !f.filter.Match(resource)
+}
+
+// scimAttrPath is an attribute with an optional sub-attribute, such as name.givenName
+type scimAttrPath struct {
+	attr    string
+	subAttr string
+}
+
+// scimCompareFilter compares an attribute with a value, or tests its presence with the "pr" operator
+type scimCompareFilter struct {
+	path  scimAttrPath
+	op    string
+	value interface{}
+}
+
+func (f *scimCompareFilter) Match(resource map[string]interface{}) bool {
+	values := scimPathValues(resource, f.path)
+	switch {
+	case f.op == "pr":
+		for _, value := range values {
+			if !isScimEmpty(value) {
+				return true
+			}
+		}
+		return false
+	case f.value == nil:
+		// Comparing with null tests whether the attribute is absent
+		return (len(values) == 0) == (f.op == "eq")
+	case f.op == "ne":
+		for _, value := range values {
+			if scimCompare(value, "eq", f.value) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Multi-valued attributes match when any value matches
+	for _, value := range values {
+		if scimCompare(value, f.op, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// scimValuePathFilter matches resources with an element of a multi-valued attribute matching
+// the inner filter, such as emails[type eq "work"]
+type scimValuePathFilter struct {
+	attr   string
+	filter ScimFilter
+}
+
+func (f *scimValuePathFilter) Match(resource map[string]interface{}) bool {
+	for _, element := range scimElements(resource, f.attr) {
+		if f.filter.Match(element) {
+			return true
+		}
+	}
+	return false
+}
+
+var scimCompareOperators = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true,
+}
+
+const (
+	scimTokenWord = iota
+	scimTokenString
+	scimTokenOpen
+	scimTokenClose
+	scimTokenOpenBracket
+	scimTokenCloseBracket
+)
+
+type scimFilterToken struct {
+	kind int
+	text string
+}
+
+// tokenizeScimFilter splits a filter into words, quoted strings, parentheses and brackets
+func tokenizeScimFilter(filter string) ([]scimFilterToken, error) {
+	tokens := []scimFilterToken{}
+	for i := 0; i < len(filter); {
+		c := filter[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, scimFilterToken{kind: scimTokenOpen, text: "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, scimFilterToken{kind: scimTokenClose, text: ")"})
+			i++
+		case c == '[':
+			tokens = append(tokens, scimFilterToken{kind: scimTokenOpenBracket, text: "["})
+			i++
+		case c == ']':
+			tokens = append(tokens, scimFilterToken{kind: scimTokenCloseBracket, text: "]"})
+			i++
+		case c == '"':
+			// Strings are JSON strings, so they may contain escaped quotes
+			end := i + 1
+			for ; end < len(filter) && filter[end] != '"'; end++ {
+				if filter[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(filter) {
+				return nil, scimInvalidFilter("unterminated string")
+			}
+			value, err := strconv.Unquote(filter[i : end+1])
+			if err != nil {
+				return nil, scimInvalidFilter("invalid string %s", filter[i:end+1])
+			}
+			tokens = append(tokens, scimFilterToken{kind: scimTokenString, text: value})
+			i = end + 1
+		default:
+			end := i
+			for end < len(filter) && !strings.ContainsRune(" \t\n\r()[]\"", rune(filter[end])) {
+				end++
+			}
+			tokens = append(tokens, scimFilterToken{kind: scimTokenWord, text: filter[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type scimFilterParser struct {
+	tokens []scimFilterToken
+	pos    int
+}
+
+func (p *scimFilterParser) peek() *scimFilterToken {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *scimFilterParser) next() *scimFilterToken {
+	token := p.peek()
+	if token != nil {
+		p.pos++
+	}
+	return token
+}
+
+// isKeyword checks whether the next token is the given case-insensitive keyword
+func (p *scimFilterParser) isKeyword(keyword string) bool {
+	token := p.peek()
+	return token != nil && token.kind == scimTokenWord && strings.EqualFold(token.text, keyword)
+}
+
+func (p *scimFilterParser) parseOr() (ScimFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimOrFilter{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseAnd() (ScimFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimAndFilter{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseUnary() (ScimFilter, error) {
+	if p.isKeyword("not") {
+		p.next()
+		if token := p.peek(); token == nil || token.kind != scimTokenOpen {
+			return nil, scimInvalidFilter("expected ( after not")
+		}
+		filter, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &scimNotFilter{filter: filter}, nil
+	}
+
+	token := p.next()
+	if token == nil {
+		return nil, scimInvalidFilter("unexpected end of filter")
+	}
+	if token.kind == scimTokenOpen {
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing == nil || closing.kind != scimTokenClose {
+			return nil, scimInvalidFilter("missing )")
+		}
+		return filter, nil
+	}
+	if token.kind != scimTokenWord {
+		return nil, scimInvalidFilter("expected an attribute, got %q", token.text)
+	}
+
+	if open := p.peek(); open != nil && open.kind == scimTokenOpenBracket {
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing == nil || closing.kind != scimTokenCloseBracket {
+			return nil, scimInvalidFilter("missing ]")
+		}
+		return &scimValuePathFilter{attr: parseScimAttrPath(token.text).attr, filter: inner}, nil
+	}
+	return p.parseComparison(parseScimAttrPath(token.text))
+}
+
+func (p *scimFilterParser) parseComparison(path scimAttrPath) (ScimFilter, error) {
+	token := p.next()
+	if token == nil || token.kind != scimTokenWord {
+		return nil, scimInvalidFilter("expected an operator after %s", path.attr)
+	}
+	op := strings.ToLower(token.text)
+	if op == "pr" {
+		return &scimCompareFilter{path: path, op: op}, nil
+	}
+	if !scimCompareOperators[op] {
+		return nil, scimInvalidFilter("unknown operator %q", token.text)
+	}
+
+	token = p.next()
+	if token == nil {
+		return nil, scimInvalidFilter("expected a value after %s", op)
+	}
+	filter := &scimCompareFilter{path: path, op: op}
+	switch {
+	case token.kind == scimTokenString:
+		filter.value = token.text
+	case token.kind != scimTokenWord:
+		return nil, scimInvalidFilter("expected a value after %s", op)
+	case strings.EqualFold(token.text, "true"), strings.EqualFold(token.text, "false"):
+		filter.value = strings.EqualFold(token.text, "true")
+	case strings.EqualFold(token.text, "null"):
+		if op != "eq" && op != "ne" {
+			return nil, scimInvalidFilter("null can only be compared with eq or ne")
+		}
+	default:
+		number, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, scimInvalidFilter("invalid value %q", token.text)
+		}
+		filter.value = number
+	}
+	return filter, nil
+}
+
+// ParseScimFilter parses the filter query parameter of a list request
+func ParseScimFilter(filter string) (ScimFilter, error) {
+	tokens, err := tokenizeScimFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, scimInvalidFilter("empty filter")
+	}
+
+	parser := &scimFilterParser{tokens: tokens}
+	parsed, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token != nil {
+		return nil, scimInvalidFilter("unexpected %q", token.text)
+	}
+	return parsed, nil
+}
+
+// scimPatchPath is the target of a PATCH operation: an attribute, optionally narrowed to the
+// elements matching a filter, and an optional sub-attribute, such as members[value eq "1"]
+// or emails[type eq "work"].value
+type scimPatchPath struct {
+	attr    string
+	subAttr string
+	filter  ScimFilter
+}
+
+// parseScimPatchPath parses the path of a PATCH operation (RFC 7644 §3.5.2)
+func parseScimPatchPath(path string) (*scimPatchPath, error) {
+	tokens, err := tokenizeScimFilter(path)
+	if err != nil || len(tokens) == 0 || tokens[0].kind != scimTokenWord {
+		return nil, scimInvalidPath(path)
+	}
+
+	attrPath := parseScimAttrPath(tokens[0].text)
+	patchPath := &scimPatchPath{attr: attrPath.attr, subAttr: attrPath.subAttr}
+	if len(tokens) == 1 {
+		return patchPath, nil
+	}
+	if patchPath.subAttr != "" || tokens[1].kind != scimTokenOpenBracket {
+		return nil, scimInvalidPath(path)
+	}
+
+	// The filter ends at the matching bracket, which may be followed by .subAttr
+	end := len(tokens) - 1
+	if tokens[end].kind == scimTokenWord && strings.HasPrefix(tokens[end].text, ".") {
+		patchPath.subAttr = tokens[end].text[1:]
+		end--
+	}
+	if end < 3 || tokens[end].kind != scimTokenCloseBracket {
+		return nil, scimInvalidPath(path)
+	}
+
+	parser := &scimFilterParser{tokens: tokens[2:end]}
+	if patchPath.filter, err = parser.parseOr(); err != nil {
+		return nil, err
+	}
+	if parser.peek() != nil {
+		return nil, scimInvalidPath(path)
+	}
+	return patchPath, nil
+}
+
+// parseScimAttrPath splits an attribute path, dropping the schema URN of fully qualified names
+func parseScimAttrPath(path string) scimAttrPath {
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		path = path[strings.LastIndex(path, ":")+1:]
+	}
+	attr, subAttr, _ := strings.Cut(path, ".")
+	return scimAttrPath{attr: attr, subAttr: subAttr}
+}
+
+// scimLookup returns the value of a case-insensitive attribute name and the key it is stored under
+func scimLookup(resource map[string]interface{}, name string) (interface{}, string) {
+	if value, ok := resource[name]; ok {
+		return value, name
+	}
+	for key, value := range resource {
+		if strings.EqualFold(key, name) {
+			return value, key
+		}
+	}
+	return nil, ""
+}
+
+// scimElements returns the complex values of an attribute, for both single and multi-valued attributes
+func scimElements(resource map[string]interface{}, attr string) []map[string]interface{} {
+	value, _ := scimLookup(resource, attr)
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{typed}
+	case []interface{}:
+		elements := make([]map[string]interface{}, 0, len(typed))
+		for _, item := range typed {
+			if element, ok := item.(map[string]interface{}); ok {
+				elements = append(elements, element)
+			}
+		}
+		return elements
+	}
+	return nil
+}
+
+// scimPathValues returns the values at an attribute path, flattening multi-valued attributes.
+// A multi-valued complex attribute without sub-attribute compares its "value" sub-attribute.
+func scimPathValues(resource map[string]interface{}, path scimAttrPath) []interface{} {
+	value, _ := scimLookup(resource, path.attr)
+	if value == nil {
+		return nil
+	}
+
+	subAttr := path.subAttr
+	items, multiValued := value.([]interface{})
+	if !multiValued {
+		items = []interface{}{value}
+	} else if subAttr == "" {
+		subAttr = "value"
+	}
+
+	values := []interface{}{}
+	for _, item := range items {
+		if subAttr == "" {
+			values = append(values, item)
+			continue
+		}
+		element, ok := item.(map[string]interface{})
+		if !ok {
+			if multiValued && path.subAttr == "" {
+				values = append(values, item)
+			}
+			continue
+		}
+		if subValue, _ := scimLookup(element, subAttr); subValue != nil {
+			values = append(values, subValue)
+		}
+	}
+	return values
+}
+
+func isScimEmpty(value interface{}) bool {
+	switch typed := value.(type) {
+	case nil:
+		return true
+	case string:
+		return typed == ""
+	case []interface{}:
+		return len(typed) == 0
+	case map[string]interface{}:
+		return len(typed) == 0
+	}
+	return false
+}
+
+// scimCompare applies a comparison operator. Strings compare case-insensitively, which is
+// how the attributes of this server are defined (caseExact false).
+func scimCompare(actual interface{}, op string, expected interface{}) bool {
+	switch expectedValue := expected.(type) {
+	case string:
+		actualValue, ok := actual.(string)
+		if !ok {
+			return false
+		}
+		a, e := strings.ToLower(actualValue), strings.ToLower(expectedValue)
+		switch op {
+		case "eq":
+			return a == e
+		case "co":
+			return strings.Contains(a, e)
+		case "sw":
+			return strings.HasPrefix(a, e)
+		case "ew":
+			return strings.HasSuffix(a, e)
+		case "gt":
+			return a > e
+		case "ge":
+			return a >= e
+		case "lt":
+			return a < e
+		case "le":
+			return a <= e
+		}
+	case bool:
+		actualValue, ok := actual.(bool)
+		return ok && op == "eq" && actualValue == expectedValue
+	case float64:
+		actualValue, ok := actual.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return actualValue == expectedValue
+		case "gt":
+			return actualValue > expectedValue
+		case "ge":
+			return actualValue >= expectedValue
+		case "lt":
+			return actualValue < expectedValue
+		case "le":
+			return actualValue <= expectedValue
+		}
+	}
+	return false
+}
+
+func scimInvalidFilter(format string, args ...interface{}) *ScimError {
+	return NewScimError(http.StatusBadRequest, ScimTypeInvalidFilter, "invalid filter: "+format, args...)
+}
+
+func scimInvalidPath(path string) *ScimError {
+	return NewScimError(http.StatusBadRequest, ScimTypeInvalidPath, "invalid path %q", path)
+}
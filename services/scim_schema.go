@@ -0,0 +1,134 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+// scimAttribute describes an attribute in the Schemas discovery endpoint (RFC 7643 §7)
+func scimAttribute(name, attributeType string, multiValued, required bool, mutability, uniqueness string, subAttributes ...map[string]interface{}) map[string]interface{} {
+	attribute := map[string]interface{}{
+		"name":        name,
+		"type":        attributeType,
+		"multiValued": multiValued,
+		"required":    required,
+		"caseExact":   false,
+		"mutability":  mutability,
+		"returned":    "default",
+		"uniqueness":  uniqueness,
+	}
+	if mutability == "writeOnly" {
+		attribute["returned"] = "never"
+	}
+	if len(subAttributes) > 0 {
+		attribute["subAttributes"] = subAttributes
+	}
+	return attribute
+}
+
+// scimMultiValuedAttribute describes a multi-valued attribute with value, type and primary sub-attributes
+func scimMultiValuedAttribute(name, mutability string, extra ...map[string]interface{}) map[string]interface{} {
+	subAttributes := append([]map[string]interface{}{
+		scimAttribute("value", "string", false, false, mutability, "none"),
+		scimAttribute("type", "string", false, false, mutability, "none"),
+		scimAttribute("primary", "boolean", false, false, mutability, "none"),
+	}, extra...)
+	return scimAttribute(name, "complex", true, false, mutability, "none", subAttributes...)
+}
+
+func scimSchemaResource(id, name, description string, attributes ...map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"schemas":     []interface{}{ScimSchemaSchema},
+		"id":          id,
+		"name":        name,
+		"description": description,
+		"attributes":  attributes,
+		"meta": map[string]interface{}{
+			"resourceType": "Schema",
+			"location":     ScimUrl("/Schemas/" + id),
+		},
+	}
+}
+
+// ScimSchemas lists the schemas of the supported resources with the attributes this server stores
+func ScimSchemas() []map[string]interface{} {
+	reference := scimAttribute("$ref", "reference", false, false, "readOnly", "none")
+	display := scimAttribute("display", "string", false, false, "readOnly", "none")
+
+	return []map[string]interface{}{
+		scimSchemaResource(ScimSchemaUser, "User", "User Account",
+			scimAttribute("userName", "string", false, true, "readWrite", "server"),
+			scimAttribute("externalId", "string", false, false, "readWrite", "none"),
+			scimAttribute("displayName", "string", false, false, "readWrite", "none"),
+			scimAttribute("name", "complex", false, false, "readWrite", "none",
+				scimAttribute("formatted", "string", false, false, "readOnly", "none"),
+				scimAttribute("givenName", "string", false, false, "readWrite", "none"),
+				scimAttribute("familyName", "string", false, false, "readWrite", "none"),
+			),
+			scimAttribute("active", "boolean", false, false, "readWrite", "none"),
+			scimAttribute("password", "string", false, false, "writeOnly", "none"),
+			scimMultiValuedAttribute("emails", "readWrite"),
+			scimMultiValuedAttribute("phoneNumbers", "readWrite"),
+			scimMultiValuedAttribute("groups", "readOnly", reference, display),
+		),
+		scimSchemaResource(ScimSchemaGroup, "Group", "Group",
+			scimAttribute("displayName", "string", false, true, "readWrite", "none"),
+			scimAttribute("externalId", "string", false, false, "readWrite", "none"),
+			scimAttribute("members", "complex", true, false, "readWrite", "none",
+				scimAttribute("value", "string", false, false, "immutable", "none"),
+				scimAttribute("type", "string", false, false, "immutable", "none"),
+				reference,
+				display,
+			),
+		),
+	}
+}
+
+// ScimResourceTypes lists the resource types served under /scim/v2
+func ScimResourceTypes() []map[string]interface{} {
+	resourceType := func(id, endpoint, schema string) map[string]interface{} {
+		return map[string]interface{}{
+			"schemas":     []interface{}{ScimSchemaResourceType},
+			"id":          id,
+			"name":        id,
+			"endpoint":    endpoint,
+			"description": id,
+			"schema":      schema,
+			"meta": map[string]interface{}{
+				"resourceType": "ResourceType",
+				"location":     ScimUrl("/ResourceTypes/" + id),
+			},
+		}
+	}
+	return []map[string]interface{}{
+		resourceType("User", "/Users", ScimSchemaUser),
+		resourceType("Group", "/Groups", ScimSchemaGroup),
+	}
+}
+
+// ScimServiceProviderConfig describes the supported SCIM features
+func ScimServiceProviderConfig() map[string]interface{} {
+	supported := func(value bool) map[string]interface{} {
+		return map[string]interface{}{"supported": value}
+	}
+	return map[string]interface{}{
+		"schemas":          []interface{}{ScimSchemaServiceProviderConfig},
+		"documentationUri": "https://datatracker.ietf.org/doc/html/rfc7644",
+		"patch":            supported(true),
+		"bulk":             map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":           map[string]interface{}{"supported": true, "maxResults": ScimMaxResults},
+		"changePassword":   supported(true),
+		"sort":             supported(false),
+		"etag":             supported(true),
+		"authenticationSchemes": []interface{}{
+			map[string]interface{}{
+				"type":        "oauthbearertoken",
+				"name":        "Bearer Token",
+				"description": "SCIM token issued by an administrator for one organization",
+				"primary":     true,
+			},
+		},
+		"meta": map[string]interface{}{
+			"resourceType": "ServiceProviderConfig",
+			"location":     ScimUrl("/ServiceProviderConfig"),
+		},
+	}
+}
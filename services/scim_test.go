@@ -0,0 +1,318 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+func testScimUser() *models.User {
+	return &models.User{
+		Id:          42,
+		Owner:       "built-in",
+		CreatedTime: "2024-01-01T00:00:00Z",
+		Username:    "alice",
+		Email:       "alice@example.com",
+		Phone:       "+8613800138000",
+		Properties: map[string]string{
+			scimExternalIdProperty:  "E1001",
+			scimGivenNameProperty:   "Alice",
+			scimFamilyNameProperty:  "Liddell",
+			scimDisplayNameProperty: "Alice Liddell",
+		},
+	}
+}
+
+// scimJsonResource parses a JSON resource as it would arrive in a request
+func scimJsonResource(t *testing.T, data string) map[string]interface{} {
+	t.Helper()
+	var resource map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &resource); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	return resource
+}
+
+// TestScimFilter tests filter parsing and evaluation against a rendered user
+func TestScimFilter(t *testing.T) {
+	groups := []*models.Group{{Owner: "built-in", Name: "g1", DisplayName: "Staff", Members: []string{"42"}}}
+	resource := ScimUserResource(testScimUser(), groups)
+
+	tests := []struct {
+		filter string
+		match  bool
+	}{
+		{`userName eq "alice"`, true},
+		{`userName eq "ALICE"`, true},
+		{`userName eq "bob"`, false},
+		{`userName ne "bob"`, true},
+		{`userName sw "al" and active eq true`, true},
+		{`userName sw "al" and active eq false`, false},
+		{`userName eq "bob" or externalId eq "E1001"`, true},
+		{`not (userName eq "alice")`, false},
+		{`name.familyName co "ddel"`, true},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "alice"`, true},
+		{`emails.value ew "@example.com"`, true},
+		{`emails eq "alice@example.com"`, true},
+		{`emails[type eq "work" and value co "alice"]`, true},
+		{`emails[type eq "home"]`, false},
+		{`groups.display eq "Staff"`, true},
+		{`phoneNumbers pr`, true},
+		{`title pr`, false},
+		{`title eq null`, true},
+		{`meta.created lt "2025-01-01"`, true},
+		{`(userName eq "bob" or userName eq "alice") and not (active eq false)`, true},
+	}
+	for _, tt := range tests {
+		filter, err := ParseScimFilter(tt.filter)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.filter, err)
+			continue
+		}
+		if match := filter.Match(resource); match != tt.match {
+			t.Errorf("%s: expected %v, got %v", tt.filter, tt.match, match)
+		}
+	}
+}
+
+// TestParseScimFilterInvalid tests that malformed filters are rejected with invalidFilter
+func TestParseScimFilterInvalid(t *testing.T) {
+	for _, filter := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName like "a"`,
+		`userName eq "alice`,
+		`(userName eq "alice"`,
+		`emails[type eq "work"`,
+		`userName eq "a" extra`,
+		`userName gt null`,
+		`not userName eq "a"`,
+	} {
+		_, err := ParseScimFilter(filter)
+		scimErr, ok := err.(*ScimError)
+		if !ok || scimErr.Status != http.StatusBadRequest || scimErr.ScimType != ScimTypeInvalidFilter {
+			t.Errorf("%q: expected an invalidFilter error, got %v", filter, err)
+		}
+	}
+}
+
+// TestScimUserRoundTrip tests that a rendered user applies back unchanged and the version is stable
+func TestScimUserRoundTrip(t *testing.T) {
+	user := testScimUser()
+	resource := ScimUserResource(user, nil)
+	if resource["id"] != "42" || resource["active"] != true {
+		t.Errorf("Unexpected resource: %v", resource)
+	}
+	if name := resource["name"].(map[string]interface{}); name["formatted"] != "Alice Liddell" {
+		t.Errorf("Unexpected name: %v", name)
+	}
+
+	copied := testScimUser()
+	if err := ApplyScimUser(copied, resource, PasswordTypeBcrypt); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ScimVersion(ScimUserResource(copied, nil)) != ScimVersion(resource) {
+		t.Errorf("Expected the same version after a round trip")
+	}
+
+	copied.IsForbidden = true
+	if ScimVersion(ScimUserResource(copied, nil)) == ScimVersion(resource) {
+		t.Errorf("Expected the version to change with the content")
+	}
+}
+
+// TestApplyScimUser tests creation attributes and validation
+func TestApplyScimUser(t *testing.T) {
+	user := &models.User{}
+	err := ApplyScimUser(user, scimJsonResource(t, `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "bob",
+		"externalId": "E2002",
+		"name": {"givenName": "Bob", "familyName": "Smith"},
+		"emails": [{"value": "bob.home@example.com", "type": "home"}, {"value": "Bob@Example.com", "type": "work", "primary": true}],
+		"phoneNumbers": [{"value": "138 0013 8001"}],
+		"active": "False",
+		"password": "s3cret-pass"
+	}`), PasswordTypeArgon2id)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if user.Username != "bob" || user.Email != "bob@example.com" || user.Phone != "+8613800138001" || user.PhoneVerified {
+		t.Errorf("Unexpected user: %+v", user)
+	}
+	if !user.IsForbidden || user.Properties[scimExternalIdProperty] != "E2002" || user.Properties[scimFamilyNameProperty] != "Smith" {
+		t.Errorf("Unexpected state or properties: %+v", user)
+	}
+	if user.PasswordType != PasswordTypeArgon2id || !CheckPassword("s3cret-pass", user.Password) {
+		t.Errorf("Expected the password to be hashed with argon2id")
+	}
+
+	verified := &models.User{Email: "bob@example.com", EmailVerified: true}
+	if err := ApplyScimUser(verified, scimJsonResource(t, `{"userName": "bob", "emails": [{"value": "BOB@example.com"}]}`), PasswordTypeBcrypt); err != nil || !verified.EmailVerified {
+		t.Errorf("Expected an unchanged email to stay verified, got %v", err)
+	}
+	if err := ApplyScimUser(verified, scimJsonResource(t, `{"userName": "bob", "emails": [{"value": "bob@example.org"}]}`), PasswordTypeBcrypt); err != nil || verified.EmailVerified {
+		t.Errorf("Expected a changed email to be unverified, got %v", err)
+	}
+
+	for _, data := range []string{
+		`{}`,
+		`{"userName": 42}`,
+		`{"userName": "bob", "emails": [{"value": "not-an-email"}]}`,
+		`{"userName": "bob", "emails": {"value": "bob@example.com"}}`,
+		`{"userName": "bob", "active": "maybe"}`,
+	} {
+		err := ApplyScimUser(&models.User{}, scimJsonResource(t, data), PasswordTypeBcrypt)
+		if scimErr, ok := err.(*ScimError); !ok || scimErr.ScimType != ScimTypeInvalidValue {
+			t.Errorf("%s: expected an invalidValue error, got %v", data, err)
+		}
+	}
+}
+
+// TestApplyScimPatchUser tests PATCH operations in the forms sent by common provisioning clients
+func TestApplyScimPatchUser(t *testing.T) {
+	user := testScimUser()
+	resource := ScimUserResource(user, nil)
+
+	operations := []struct {
+		op, path string
+		value    string
+	}{
+		{"Replace", "active", `"False"`},
+		{"replace", `emails[type eq "work"].value`, `"alice.l@example.com"`},
+		{"add", "", `{"name.givenName": "Alicia", "displayName": "Alicia L"}`},
+		{"remove", "externalId", `null`},
+		{"add", `phoneNumbers[type eq "work"].value`, `"+8613800138009"`},
+	}
+	for _, operation := range operations {
+		var value interface{}
+		if err := json.Unmarshal([]byte(operation.value), &value); err != nil {
+			t.Fatalf("Invalid JSON: %v", err)
+		}
+		if err := ApplyScimPatch(resource, operation.op, operation.path, value); err != nil {
+			t.Fatalf("%s %s: unexpected error %v", operation.op, operation.path, err)
+		}
+	}
+	if err := ApplyScimUser(user, resource, PasswordTypeBcrypt); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !user.IsForbidden || user.Email != "alice.l@example.com" {
+		t.Errorf("Unexpected user: %+v", user)
+	}
+	if user.Properties[scimGivenNameProperty] != "Alicia" || user.Properties[scimFamilyNameProperty] != "Liddell" {
+		t.Errorf("Expected other name parts to be kept, got %v", user.Properties)
+	}
+	if _, ok := user.Properties[scimExternalIdProperty]; ok {
+		t.Errorf("Expected externalId to be removed")
+	}
+	// The added work number is not primary, so the mobile number stays
+	if user.Phone != "+8613800138000" {
+		t.Errorf("Expected the primary phone to be kept, got %s", user.Phone)
+	}
+
+	for _, tt := range []struct {
+		op, path string
+		value    interface{}
+		scimType string
+	}{
+		{"move", "active", true, ScimTypeInvalidSyntax},
+		{"remove", "", nil, ScimTypeNoTarget},
+		{"replace", "", "alice", ScimTypeInvalidValue},
+		{"replace", "id", "1", ScimTypeMutability},
+		{"replace", `emails[type eq "work"`, "x", ScimTypeInvalidPath},
+		{"replace", `emails[type eq "home"]`, map[string]interface{}{"value": "x"}, ScimTypeNoTarget},
+	} {
+		err := ApplyScimPatch(resource, tt.op, tt.path, tt.value)
+		if scimErr, ok := err.(*ScimError); !ok || scimErr.ScimType != tt.scimType {
+			t.Errorf("%s %s: expected %s, got %v", tt.op, tt.path, tt.scimType, err)
+		}
+	}
+}
+
+// TestApplyScimPatchGroup tests adding and removing group members
+func TestApplyScimPatchGroup(t *testing.T) {
+	users := map[string]*models.User{
+		"1": {Id: 1, Username: "alice"},
+		"2": {Id: 2, Username: "bob"},
+		"3": {Id: 3, Username: "carol"},
+	}
+	group := &models.Group{Owner: "built-in", Name: "g1", DisplayName: "Staff", Members: []string{"1"}}
+	resource := ScimGroupResource(group, users)
+
+	patch := func(op, path, value string) {
+		t.Helper()
+		var parsed interface{}
+		if value != "" {
+			if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+				t.Fatalf("Invalid JSON: %v", err)
+			}
+		}
+		if err := ApplyScimPatch(resource, op, path, parsed); err != nil {
+			t.Fatalf("%s %s: unexpected error %v", op, path, err)
+		}
+	}
+	patch("add", "members", `[{"value": "2"}, {"value": "3"}, {"value": "1"}]`)
+	patch("remove", `members[value eq "3"]`, "")
+	patch("remove", `members[value eq "9"]`, "")
+	patch("remove", "members", `[{"value": "1"}]`)
+	patch("replace", "", `{"displayName": "Employees"}`)
+
+	if err := ApplyScimGroup(group, resource, users); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if group.DisplayName != "Employees" || len(group.Members) != 1 || group.Members[0] != "2" {
+		t.Errorf("Unexpected group: %+v", group)
+	}
+
+	patch("add", "members", `{"value": "7"}`)
+	err := ApplyScimGroup(group, resource, users)
+	if scimErr, ok := err.(*ScimError); !ok || scimErr.ScimType != ScimTypeInvalidValue {
+		t.Errorf("Expected an unknown member to be rejected, got %v", err)
+	}
+}
+
+// TestScimListHelpers tests pagination and attribute projection
+func TestScimListHelpers(t *testing.T) {
+	resources := []map[string]interface{}{}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		resources = append(resources, map[string]interface{}{"id": name, "userName": name, "active": true})
+	}
+
+	for _, tt := range []struct {
+		startIndex, count int
+		first             string
+		length            int
+	}{
+		{1, 2, "a", 2},
+		{4, 10, "d", 2},
+		{0, 1, "a", 1},
+		{6, 10, "", 0},
+		{2, 0, "", 0},
+	} {
+		page := PageScimResources(resources, tt.startIndex, tt.count)
+		if len(page) != tt.length || (tt.length > 0 && page[0]["id"] != tt.first) {
+			t.Errorf("startIndex %d count %d: unexpected page %v", tt.startIndex, tt.count, page)
+		}
+	}
+
+	matched, err := FilterScimResources(resources, `userName gt "b"`)
+	if err != nil || len(matched) != 3 {
+		t.Errorf("Expected 3 matches, got %d (%v)", len(matched), err)
+	}
+
+	projected := ProjectScimResource(resources[0], "userName", "")
+	if len(projected) != 2 || projected["userName"] != "a" {
+		t.Errorf("Unexpected projection: %v", projected)
+	}
+	projected = ProjectScimResource(resources[0], "", "active, id")
+	if _, ok := projected["active"]; ok || projected["id"] != "a" {
+		t.Errorf("Expected active to be excluded and id to be kept: %v", projected)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// sessionTouchInterval limits how often requests of the same session update its last seen time
+const sessionTouchInterval = time.Minute
+
+// ErrSessionNotFound is returned for a session that does not exist, belongs to another user or is signed out
+var ErrSessionNotFound = errors.New("session not found")
+
+// StartSession records a console sign-in from the client with the given address and User-Agent.
+// The session ends with the console token issued for it.
+func StartSession(user *models.User, application *models.Application, amr []string, ip, userAgent string) (*models.Session, error) {
+	if runes := []rune(userAgent); len(runes) > 500 {
+		userAgent = string(runes[:500])
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		Owner:        user.Owner,
+		Name:         fmt.Sprintf("session_%s", models.GenerateRandomString(24)),
+		CreatedTime:  now.Format(time.RFC3339),
+		UserId:       user.Id,
+		Device:       ParseDeviceName(userAgent),
+		UserAgent:    userAgent,
+		Ip:           ip,
+		LastSeenTime: now.Format(time.RFC3339),
+		ExpiresAt:    now.Add(time.Duration(application.ExpireInHours) * time.Hour).Unix(),
+		Amr:          amr,
+		Applications: []string{application.GetId()},
+	}
+	if _, err := models.AddSession(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// CheckSession reports whether the session named by the sid claim of a console token is still signed
+// in, and records the request as the latest activity of the session
+func CheckSession(owner, name, ip string) (bool, error) {
+	session, err := models.GetSession(owner, name)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if session == nil || session.RevokedTime != "" || now.Unix() > session.ExpiresAt {
+		return false, nil
+	}
+
+	lastSeen, err := time.Parse(time.RFC3339, session.LastSeenTime)
+	if err != nil || now.Sub(lastSeen) >= sessionTouchInterval || session.Ip != ip {
+		session.Ip = ip
+		session.LastSeenTime = now.Format(time.RFC3339)
+		if _, err := models.UpdateSessionActivity(session); err != nil {
+			log.Printf("[Session] Failed to update activity of session %s: %v", session.GetId(), err)
+		}
+	}
+	return true, nil
+}
+
+// AttachSessionApplication records that the user signed in to an application, given by its
+// owner/name ID, through a session. It is best effort: the sign-in to the application goes ahead
+// if the session cannot be updated.
+func AttachSessionApplication(owner, name, application string) {
+	if name == "" {
+		return
+	}
+	session, err := models.GetSession(owner, name)
+	if err == nil && session != nil && !slices.Contains(session.Applications, application) {
+		session.Applications = append(session.Applications, application)
+		_, err = models.UpdateSessionApplications(session)
+	}
+	if err != nil {
+		log.Printf("[Session] Failed to attach %s to session %s/%s: %v", application, owner, name, err)
+	}
+}
+
+// GetUserSessions returns the sessions of a user that are still signed in, most recently used first
+func GetUserSessions(user *models.User) ([]*models.Session, error) {
+	sessions, err := models.GetUserSessions(user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	active := []*models.Session{}
+	for _, session := range sessions {
+		if session.ExpiresAt >= now {
+			active = append(active, session)
+		}
+	}
+	return active, nil
+}
+
+// SignOutSession signs out one session of a user. Its console token stops working and the token
+// families of every grant issued through it are revoked.
+func SignOutSession(user *models.User, name string) error {
+	session, err := models.GetSession(user.Owner, name)
+	if err != nil {
+		return err
+	}
+	if session == nil || session.UserId != user.Id || session.RevokedTime != "" {
+		return ErrSessionNotFound
+	}
+	return signOutSession(session)
+}
+
+// SignOutUser revokes every token issued to a user and signs out all sessions, for accounts that
+// are disabled or deleted by an administrator or a provisioning source
+func SignOutUser(user *models.User) error {
+	if err := models.RevokeUserTokens(user.GetId()); err != nil {
+		return err
+	}
+	_, err := SignOutAllSessions(user, "")
+	return err
+}
+
+// SignOutAllSessions signs out every session of a user except the one named keep, which may be empty,
+// and returns the number of sessions signed out. Expired sessions are included, since grants issued
+// through them can outlive the console token.
+func SignOutAllSessions(user *models.User, keep string) (int, error) {
+	sessions, err := models.GetUserSessions(user.Id)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, session := range sessions {
+		if session.Name == keep {
+			continue
+		}
+		if err := signOutSession(session); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func signOutSession(session *models.Session) error {
+	session.RevokedTime = time.Now().Format(time.RFC3339)
+	if _, err := models.RevokeSession(session); err != nil {
+		return err
+	}
+	return models.RevokeSessionTokens(session.Name)
+}
+
+var (
+	userAgentVersion  = regexp.MustCompile(`(Edg|EdgA|EdgiOS|OPR|Firefox|FxiOS|CriOS|Chrome|Version|MicroMessenger)/([0-9]+)`)
+	userAgentBrowsers = []struct{ token, name string }{
+		{"MicroMessenger", "WeChat"},
+		{"Edg", "Edge"},
+		{"EdgA", "Edge"},
+		{"EdgiOS", "Edge"},
+		{"OPR", "Opera"},
+		{"FxiOS", "Firefox"},
+		{"Firefox", "Firefox"},
+		{"CriOS", "Chrome"},
+		{"Chrome", "Chrome"},
+	}
+	userAgentSystems = []struct{ token, name string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"CrOS", "ChromeOS"},
+		{"Windows", "Windows"},
+		{"Macintosh", "macOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+// ParseDeviceName returns a short description of the client of a User-Agent, such as
+// "Chrome 126 on Windows". Clients that are not recognised are described by the product token.
+func ParseDeviceName(userAgent string) string {
+	if strings.TrimSpace(userAgent) == "" {
+		return "Unknown device"
+	}
+
+	versions := map[string]string{}
+	for _, match := range userAgentVersion.FindAllStringSubmatch(userAgent, -1) {
+		if _, ok := versions[match[1]]; !ok {
+			versions[match[1]] = match[2]
+		}
+	}
+
+	browser := ""
+	for _, candidate := range userAgentBrowsers {
+		if version, ok := versions[candidate.token]; ok {
+			browser = candidate.name + " " + version
+			break
+		}
+	}
+	if browser == "" && strings.Contains(userAgent, "Safari/") {
+		browser = "Safari"
+		if version, ok := versions["Version"]; ok {
+			browser += " " + version
+		}
+	}
+
+	system := ""
+	for _, candidate := range userAgentSystems {
+		if strings.Contains(userAgent, candidate.token) {
+			system = candidate.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+
+	// Command line tools and libraries, e.g. "curl/8.4.0"
+	product, _, _ := strings.Cut(userAgent, " ")
+	if runes := []rune(product); len(runes) > 100 {
+		product = string(runes[:100])
+	}
+	return product
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// Identifier types an organization can accept in the login field of password sign-in
+const (
+	SigninIdentifierEmail    = "email"
+	SigninIdentifierUsername = "username"
+	SigninIdentifierPhone    = "phone"
+)
+
+// consoleOrganization is the organization of the built-in application the console signs in to
+const consoleOrganization = "built-in"
+
+// ErrUsernameTaken is returned when another user of the organization already has a username
+var ErrUsernameTaken = errors.New("username already taken")
+
+// signinIdentifierOrder is the order identifier types are tried in. Usernames come last, so a
+// username that looks like an email or phone number cannot shadow another user's address.
+var signinIdentifierOrder = []string{SigninIdentifierEmail, SigninIdentifierPhone, SigninIdentifierUsername}
+
+// IsValidSigninIdentifier checks whether an identifier type is known
+func IsValidSigninIdentifier(identifier string) bool {
+	return slices.Contains(signinIdentifierOrder, identifier)
+}
+
+// OrganizationSigninIdentifiers returns the identifier types an organization accepts, in the order
+// they are tried. Organizations without a setting accept all of them.
+func OrganizationSigninIdentifiers(organization *models.Organization) []string {
+	if organization == nil || len(organization.SigninIdentifiers) == 0 {
+		return signinIdentifierOrder
+	}
+
+	identifiers := []string{}
+	for _, identifier := range signinIdentifierOrder {
+		if slices.Contains(organization.SigninIdentifiers, identifier) {
+			identifiers = append(identifiers, identifier)
+		}
+	}
+	return identifiers
+}
+
+// FindLoginUser resolves the login field of a password sign-in to a user, trying only the identifier
+// types the organization accepts. Emails and verified phone numbers are unique across organizations,
+// while usernames are looked up within the organization. Deleted users are never returned.
+func FindLoginUser(organizationName, identifier string) (*models.User, error) {
+	identifier = strings.TrimSpace(identifier)
+	if identifier == "" {
+		return nil, nil
+	}
+
+	organization, err := models.GetOrganization("admin", organizationName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kind := range OrganizationSigninIdentifiers(organization) {
+		var user *models.User
+		switch kind {
+		case SigninIdentifierEmail:
+			if !ValidateEmail(identifier) {
+				continue
+			}
+			user, err = models.GetUserByEmail(identifier)
+		case SigninIdentifierPhone:
+			phone, phoneErr := NormalizePhone(identifier)
+			if phoneErr != nil {
+				continue
+			}
+			user, err = models.GetUserByPhone(phone)
+		case SigninIdentifierUsername:
+			user, err = models.GetUserByOwnerUsername(organizationName, identifier)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if user != nil && !user.IsDeleted {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+// CheckUsernameAvailable returns ErrUsernameTaken when a user of the organization other than userId
+// has the username, ignoring case. Deleted users keep their username until they are purged.
+func CheckUsernameAvailable(owner, username string, userId int64) error {
+	existingUser, err := models.GetUserByOwnerUsername(owner, username)
+	if err != nil {
+		return err
+	}
+	if existingUser != nil && existingUser.Id != userId {
+		return ErrUsernameTaken
+	}
+	return nil
+}
+
+// availableUsername returns the username, or the username with the lowest free numeric suffix,
+// for accounts provisioned from an upstream provider that cannot be asked for another name
+func availableUsername(owner, username string) (string, error) {
+	candidate := username
+	for i := 2; ; i++ {
+		err := CheckUsernameAvailable(owner, candidate, 0)
+		if err == nil {
+			return candidate, nil
+		}
+		if err != ErrUsernameTaken {
+			return "", err
+		}
+		if i > 100 {
+			return "", err
+		}
+
+		suffix := fmt.Sprintf("-%d", i)
+		base := []rune(username)
+		if len(base)+len(suffix) > 50 {
+			base = base[:50-len(suffix)]
+		}
+		candidate = string(base) + suffix
+	}
+}
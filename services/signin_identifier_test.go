@@ -0,0 +1,42 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// TestOrganizationSigninIdentifiers tests the default and the order in which identifier types are tried
+func TestOrganizationSigninIdentifiers(t *testing.T) {
+	all := []string{SigninIdentifierEmail, SigninIdentifierPhone, SigninIdentifierUsername}
+	if identifiers := OrganizationSigninIdentifiers(nil); !reflect.DeepEqual(identifiers, all) {
+		t.Errorf("Expected all identifiers without an organization, got %v", identifiers)
+	}
+	if identifiers := OrganizationSigninIdentifiers(&models.Organization{}); !reflect.DeepEqual(identifiers, all) {
+		t.Errorf("Expected all identifiers without a setting, got %v", identifiers)
+	}
+
+	organization := &models.Organization{SigninIdentifiers: []string{SigninIdentifierUsername, SigninIdentifierEmail}}
+	expected := []string{SigninIdentifierEmail, SigninIdentifierUsername}
+	if identifiers := OrganizationSigninIdentifiers(organization); !reflect.DeepEqual(identifiers, expected) {
+		t.Errorf("Expected usernames to be tried after emails, got %v", identifiers)
+	}
+}
+
+// TestIsValidSigninIdentifier tests the accepted identifier types
+func TestIsValidSigninIdentifier(t *testing.T) {
+	for _, identifier := range []string{"email", "username", "phone"} {
+		if !IsValidSigninIdentifier(identifier) {
+			t.Errorf("Expected %q to be valid", identifier)
+		}
+	}
+	for _, identifier := range []string{"", "qq", "Email"} {
+		if IsValidSigninIdentifier(identifier) {
+			t.Errorf("Expected %q to be invalid", identifier)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestNormalizePhone tests conversion of phone numbers to E.164
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		valid    bool
+	}{
+		{"E.164", "+8613800138000", "+8613800138000", true},
+		{"Default country code", "138 0013 8000", "+8613800138000", true},
+		{"International prefix", "0044 20 7946 0958", "+442079460958", true},
+		{"Separators", "+1 (415) 555-2671", "+14155552671", true},
+		{"Empty", "", "", false},
+		{"Letters", "+86abc", "", false},
+		{"Too short", "+8612", "", false},
+		{"Too long", "+1234567890123456", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			phone, err := NormalizePhone(tt.input)
+			if (err == nil) != tt.valid {
+				t.Fatalf("Expected valid=%v, got error %v", tt.valid, err)
+			}
+			if phone != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, phone)
+			}
+		})
+	}
+
+	t.Setenv("SMS_DEFAULT_COUNTRY_CODE", "+1")
+	if phone, _ := NormalizePhone("4155552671"); phone != "+14155552671" {
+		t.Errorf("Expected configured country code, got %q", phone)
+	}
+}
+
+// TestSendSmsVerificationCode tests that codes go through the development outbox and verify by phone
+func TestSendSmsVerificationCode(t *testing.T) {
+	outbox := filepath.Join(t.TempDir(), "sms.log")
+	t.Setenv("SMS_PROVIDER", "")
+	t.Setenv("SMS_OUTBOX_FILE", outbox)
+
+	phone := "+8613800138000"
+	code, err := SendSmsVerificationCode(phone, PurposeLogin)
+	if err != nil {
+		t.Fatalf("SendSmsVerificationCode failed: %v", err)
+	}
+	if len(code) != 6 {
+		t.Fatalf("Expected the code to be returned by the development provider, got %q", code)
+	}
+
+	data, err := os.ReadFile(outbox)
+	if err != nil {
+		t.Fatalf("Failed to read outbox: %v", err)
+	}
+	if !strings.Contains(string(data), phone) || !strings.Contains(string(data), code) {
+		t.Errorf("Expected outbox to contain the message, got %q", data)
+	}
+
+	if ok, _ := VerifyCode(phone, code, "register"); ok {
+		t.Errorf("Expected code to be bound to its purpose")
+	}
+	if ok, err := VerifyCode(phone, code, PurposeLogin); !ok {
+		t.Errorf("Expected code to verify: %v", err)
+	}
+}
+
+// TestGetSmsProvider tests provider selection
+func TestGetSmsProvider(t *testing.T) {
+	t.Setenv("SMS_PROVIDER", "http")
+	t.Setenv("SMS_HTTP_URL", "")
+	if _, ok := GetSmsProvider().(*logSmsProvider); !ok {
+		t.Errorf("Expected fallback to log provider without a gateway URL")
+	}
+
+	t.Setenv("SMS_HTTP_URL", "https://sms.example.com/send")
+	if _, ok := GetSmsProvider().(*httpSmsProvider); !ok {
+		t.Errorf("Expected http provider")
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// VerificationCodeExpiration is how long a code stays valid
+	VerificationCodeExpiration = 10 * time.Minute
+	// VerificationCodeMaxAttempts is the number of wrong guesses a code allows before it is dropped
+	VerificationCodeMaxAttempts = 5
+	// VerificationCodeResendCooldown is the minimum time between two codes for one target and purpose
+	VerificationCodeResendCooldown = time.Minute
+)
+
+var (
+	ErrVerificationCodeNotFound        = errors.New("verification code not found or expired")
+	ErrVerificationCodeInvalid         = errors.New("invalid verification code")
+	ErrVerificationCodeTooManyAttempts = errors.New("too many attempts")
+	ErrVerificationLinkInvalid         = errors.New("invalid sign-in link")
+)
+
+// VerificationCode is a one-time code sent to an email address or phone number
+type VerificationCode struct {
+	Target      string // Email address or E.164 phone number
+	Purpose     string // "register", "reset_password", "login", "bind_phone", "change_email", "delete_account" or "realname"
+	Code        string
+	LinkId      string // Identifies the magic link sent with a login code
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	Attempts    int
+	MaxAttempts int
+}
+
+// VerificationCodeStore keeps one pending code per target and purpose. Implementations count
+// attempts atomically, so concurrent guesses cannot exceed the limit, and drop codes once they
+// expire, are used, or run out of attempts.
+type VerificationCodeStore interface {
+	// Save stores a code, replacing any earlier code of the same target and purpose
+	Save(vc *VerificationCode) error
+	// Verify checks a code and consumes it when it matches
+	Verify(target, purpose, code string) error
+	// ConsumeLink redeems the magic link of a code, consuming the code as well
+	ConsumeLink(target, purpose, linkId string) error
+	// StartCooldown starts the resend cooldown of a target and purpose. When a cooldown is
+	// already running it returns the time left and leaves it unchanged.
+	StartCooldown(target, purpose string, cooldown time.Duration) (time.Duration, error)
+}
+
+var memoryVerificationCodes = newMemoryVerificationCodeStore()
+
+// GetVerificationCodeStore returns the Redis store when Redis is configured, so that codes are
+// shared between instances, and the in-process store otherwise
+func GetVerificationCodeStore() VerificationCodeStore {
+	if redisClient == nil {
+		return memoryVerificationCodes
+	}
+	return &redisVerificationCodeStore{client: redisClient}
+}
+
+// newVerificationCode creates a fresh code for a target and purpose
+func newVerificationCode(target, purpose, linkId string) *VerificationCode {
+	now := time.Now()
+	return &VerificationCode{
+		Target:      target,
+		Purpose:     purpose,
+		Code:        GenerateVerificationCode(),
+		LinkId:      linkId,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(VerificationCodeExpiration),
+		MaxAttempts: VerificationCodeMaxAttempts,
+	}
+}
+
+// storeVerificationCode creates and saves a new code, replacing any earlier one
+func storeVerificationCode(target, purpose, linkId string) (*VerificationCode, error) {
+	vc := newVerificationCode(target, purpose, linkId)
+	if err := GetVerificationCodeStore().Save(vc); err != nil {
+		return nil, err
+	}
+	return vc, nil
+}
+
+// StartVerificationCodeCooldown starts the resend cooldown before a code is sent and returns the
+// time left when the previous code was sent too recently. Call it whether or not a code will be
+// sent, so that the responses do not reveal which accounts exist.
+func StartVerificationCodeCooldown(target, purpose string) (time.Duration, error) {
+	return GetVerificationCodeStore().StartCooldown(target, purpose, VerificationCodeResendCooldown)
+}
+
+func verificationCodeKey(target, purpose string) string {
+	return fmt.Sprintf("verification:%s:%s", purpose, target)
+}
+
+// memoryVerificationCodeStore keeps codes in process memory. Expired entries are swept while
+// saving, so no background goroutine is needed.
+type memoryVerificationCodeStore struct {
+	mu        sync.Mutex
+	codes     map[string]*VerificationCode
+	cooldowns map[string]time.Time
+}
+
+func newMemoryVerificationCodeStore() *memoryVerificationCodeStore {
+	return &memoryVerificationCodeStore{codes: map[string]*VerificationCode{}, cooldowns: map[string]time.Time{}}
+}
+
+// sweep drops expired codes and cooldowns; the caller holds the lock
+func (s *memoryVerificationCodeStore) sweep(now time.Time) {
+	for key, vc := range s.codes {
+		if now.After(vc.ExpiresAt) {
+			delete(s.codes, key)
+		}
+	}
+	for key, until := range s.cooldowns {
+		if !now.Before(until) {
+			delete(s.cooldowns, key)
+		}
+	}
+}
+
+// pending returns the unexpired code of a key; the caller holds the lock
+func (s *memoryVerificationCodeStore) pending(key string, now time.Time) *VerificationCode {
+	vc, ok := s.codes[key]
+	if !ok {
+		return nil
+	}
+	if now.After(vc.ExpiresAt) {
+		delete(s.codes, key)
+		return nil
+	}
+	return vc
+}
+
+func (s *memoryVerificationCodeStore) Save(vc *VerificationCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(time.Now())
+	stored := *vc
+	s.codes[verificationCodeKey(vc.Target, vc.Purpose)] = &stored
+	return nil
+}
+
+func (s *memoryVerificationCodeStore) Verify(target, purpose, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := verificationCodeKey(target, purpose)
+	vc := s.pending(key, time.Now())
+	if vc == nil {
+		return ErrVerificationCodeNotFound
+	}
+	if vc.Attempts >= vc.MaxAttempts {
+		delete(s.codes, key)
+		return ErrVerificationCodeTooManyAttempts
+	}
+	if subtle.ConstantTimeCompare([]byte(vc.Code), []byte(code)) != 1 {
+		vc.Attempts++
+		return ErrVerificationCodeInvalid
+	}
+	delete(s.codes, key)
+	return nil
+}
+
+func (s *memoryVerificationCodeStore) ConsumeLink(target, purpose, linkId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := verificationCodeKey(target, purpose)
+	vc := s.pending(key, time.Now())
+	if vc == nil || vc.LinkId == "" {
+		return ErrVerificationCodeNotFound
+	}
+	if subtle.ConstantTimeCompare([]byte(vc.LinkId), []byte(linkId)) != 1 {
+		return ErrVerificationLinkInvalid
+	}
+	delete(s.codes, key)
+	return nil
+}
+
+func (s *memoryVerificationCodeStore) StartCooldown(target, purpose string, cooldown time.Duration) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	key := verificationCodeKey(target, purpose)
+	if until, ok := s.cooldowns[key]; ok && now.Before(until) {
+		return until.Sub(now), nil
+	}
+	s.cooldowns[key] = now.Add(cooldown)
+	return 0, nil
+}
+
+// verifyCodeScript checks a code and counts the attempt in one step
+var verifyCodeScript = redis.NewScript(`
+local state = redis.call('HMGET', KEYS[1], 'code', 'attempts', 'max_attempts')
+if not state[1] then
+  return 'not_found'
+end
+if tonumber(state[2]) >= tonumber(state[3]) then
+  redis.call('DEL', KEYS[1])
+  return 'too_many_attempts'
+end
+if state[1] ~= ARGV[1] then
+  redis.call('HINCRBY', KEYS[1], 'attempts', 1)
+  return 'invalid'
+end
+redis.call('DEL', KEYS[1])
+return 'ok'
+`)
+
+// consumeLinkScript redeems a magic link and deletes its code in one step
+var consumeLinkScript = redis.NewScript(`
+local linkId = redis.call('HGET', KEYS[1], 'link_id')
+if not linkId or linkId == '' then
+  return 'not_found'
+end
+if linkId ~= ARGV[1] then
+  return 'invalid'
+end
+redis.call('DEL', KEYS[1])
+return 'ok'
+`)
+
+// redisVerificationCodeStore keeps each code in a hash that expires with the code
+type redisVerificationCodeStore struct {
+	client *redis.Client
+}
+
+func (s *redisVerificationCodeStore) Save(vc *VerificationCode) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+	defer cancel()
+
+	key := verificationCodeKey(vc.Target, vc.Purpose)
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key,
+			"code", vc.Code,
+			"link_id", vc.LinkId,
+			"created_at", strconv.FormatInt(vc.CreatedAt.Unix(), 10),
+			"attempts", vc.Attempts,
+			"max_attempts", vc.MaxAttempts,
+		)
+		pipe.PExpireAt(ctx, key, vc.ExpiresAt)
+		return nil
+	})
+	return err
+}
+
+func (s *redisVerificationCodeStore) Verify(target, purpose, code string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+	defer cancel()
+
+	result, err := verifyCodeScript.Run(ctx, s.client, []string{verificationCodeKey(target, purpose)}, code).Text()
+	if err != nil {
+		return err
+	}
+	switch result {
+	case "ok":
+		return nil
+	case "not_found":
+		return ErrVerificationCodeNotFound
+	case "too_many_attempts":
+		return ErrVerificationCodeTooManyAttempts
+	default:
+		return ErrVerificationCodeInvalid
+	}
+}
+
+func (s *redisVerificationCodeStore) ConsumeLink(target, purpose, linkId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+	defer cancel()
+
+	result, err := consumeLinkScript.Run(ctx, s.client, []string{verificationCodeKey(target, purpose)}, linkId).Text()
+	if err != nil {
+		return err
+	}
+	switch result {
+	case "ok":
+		return nil
+	case "not_found":
+		return ErrVerificationCodeNotFound
+	default:
+		return ErrVerificationLinkInvalid
+	}
+}
+
+func (s *redisVerificationCodeStore) StartCooldown(target, purpose string, cooldown time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+	defer cancel()
+
+	key := verificationCodeKey(target, purpose) + ":cooldown"
+	started, err := s.client.SetNX(ctx, key, 1, cooldown).Result()
+	if err != nil || started {
+		return 0, err
+	}
+	remaining, err := s.client.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if remaining < 0 {
+		// The key expired between the two commands
+		return 0, nil
+	}
+	return remaining, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMemoryVerificationCodeStore tests consumption, attempt limits and expiry
+func TestMemoryVerificationCodeStore(t *testing.T) {
+	store := newMemoryVerificationCodeStore()
+	vc := newVerificationCode("user@example.com", "register", "")
+	store.Save(vc)
+
+	if err := store.Verify("user@example.com", "reset_password", vc.Code); err != ErrVerificationCodeNotFound {
+		t.Errorf("Expected the code to be bound to its purpose, got %v", err)
+	}
+	if err := store.Verify("user@example.com", "register", vc.Code); err != nil {
+		t.Fatalf("Expected the code to verify: %v", err)
+	}
+	if err := store.Verify("user@example.com", "register", vc.Code); err != ErrVerificationCodeNotFound {
+		t.Errorf("Expected the code to be single use, got %v", err)
+	}
+
+	vc = newVerificationCode("user@example.com", "register", "")
+	store.Save(vc)
+	for i := 0; i < VerificationCodeMaxAttempts; i++ {
+		if err := store.Verify("user@example.com", "register", "wrong"); err != ErrVerificationCodeInvalid {
+			t.Fatalf("Attempt %d: expected an invalid code, got %v", i+1, err)
+		}
+	}
+	if err := store.Verify("user@example.com", "register", vc.Code); err != ErrVerificationCodeTooManyAttempts {
+		t.Errorf("Expected the code to be dropped after %d attempts, got %v", VerificationCodeMaxAttempts, err)
+	}
+
+	vc = newVerificationCode("user@example.com", "register", "")
+	vc.ExpiresAt = time.Now().Add(-time.Second)
+	store.Save(vc)
+	if err := store.Verify("user@example.com", "register", vc.Code); err != ErrVerificationCodeNotFound {
+		t.Errorf("Expected an expired code to be rejected, got %v", err)
+	}
+}
+
+// TestMemoryVerificationCodeStoreConcurrentAttempts tests that parallel guesses cannot exceed the limit
+func TestMemoryVerificationCodeStoreConcurrentAttempts(t *testing.T) {
+	store := newMemoryVerificationCodeStore()
+	store.Save(newVerificationCode("+8613800138000", PurposeLogin, ""))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	invalid := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if store.Verify("+8613800138000", PurposeLogin, "wrong") == ErrVerificationCodeInvalid {
+				mu.Lock()
+				invalid++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if invalid != VerificationCodeMaxAttempts {
+		t.Errorf("Expected exactly %d checked guesses, got %d", VerificationCodeMaxAttempts, invalid)
+	}
+}
+
+// TestVerificationCodeCooldown tests that a resend waits for the cooldown of its target and purpose
+func TestVerificationCodeCooldown(t *testing.T) {
+	store := newMemoryVerificationCodeStore()
+
+	if remaining, _ := store.StartCooldown("user@example.com", "register", time.Minute); remaining != 0 {
+		t.Errorf("Expected the first code to be sent, got %v", remaining)
+	}
+	remaining, _ := store.StartCooldown("user@example.com", "register", time.Minute)
+	if remaining <= 0 || remaining > time.Minute {
+		t.Errorf("Expected a running cooldown, got %v", remaining)
+	}
+	if remaining, _ := store.StartCooldown("user@example.com", "reset_password", time.Minute); remaining != 0 {
+		t.Errorf("Expected other purposes to have their own cooldown, got %v", remaining)
+	}
+
+	store.StartCooldown("other@example.com", "register", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if remaining, _ := store.StartCooldown("other@example.com", "register", time.Minute); remaining != 0 {
+		t.Errorf("Expected the cooldown to end, got %v", remaining)
+	}
+}
@@ -0,0 +1,819 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oauth-server/oauth-server/models"
+)
+
+// Authentication method references for WebAuthn sign-ins (RFC 8176)
+const (
+	AmrHardwareKey = "hwk"
+	AmrUser        = "user"
+)
+
+// COSE algorithm identifiers accepted for credentials
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// Authenticator data flags (WebAuthn §6.1)
+const (
+	authenticatorFlagUserPresent    = 0x01
+	authenticatorFlagUserVerified   = 0x04
+	authenticatorFlagBackupEligible = 0x08
+	authenticatorFlagBackupState    = 0x10
+	authenticatorFlagAttested       = 0x40
+)
+
+const (
+	webauthnCeremonyRegister = "register"
+	webauthnCeremonyLogin    = "login"
+
+	webauthnTimeout = 5 * time.Minute
+)
+
+var (
+	ErrWebauthnSessionInvalid    = fmt.Errorf("the WebAuthn session is invalid or expired")
+	ErrWebauthnCredentialInvalid = fmt.Errorf("the WebAuthn response could not be verified")
+	ErrWebauthnCredentialExists  = fmt.Errorf("the credential is already registered")
+	ErrWebauthnCredentialUnknown = fmt.Errorf("the credential is not registered")
+	ErrWebauthnCounterRegressed  = fmt.Errorf("the authenticator signature counter went backwards, the credential may be cloned")
+)
+
+var webauthnBase64 = base64.RawURLEncoding
+
+// WebauthnRelyingParty is the relying party the credentials are scoped to
+type WebauthnRelyingParty struct {
+	Id      string
+	Name    string
+	Origins []string
+}
+
+// GetWebauthnRelyingParty reads the relying party from WEBAUTHN_RP_ID and WEBAUTHN_ORIGINS,
+// falling back to the host of ORIGIN_FRONTEND / ORIGIN
+func GetWebauthnRelyingParty() WebauthnRelyingParty {
+	origins := []string{}
+	if configured := os.Getenv("WEBAUTHN_ORIGINS"); configured != "" {
+		for _, origin := range strings.Split(configured, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				origins = append(origins, strings.TrimRight(origin, "/"))
+			}
+		}
+	} else {
+		for _, key := range []string{"ORIGIN_FRONTEND", "ORIGIN"} {
+			if origin := os.Getenv(key); origin != "" {
+				origins = append(origins, strings.TrimRight(origin, "/"))
+			}
+		}
+		if len(origins) == 0 {
+			origins = append(origins, "http://localhost:8080")
+		}
+	}
+
+	rpId := os.Getenv("WEBAUTHN_RP_ID")
+	if rpId == "" {
+		if parsed, err := url.Parse(origins[0]); err == nil {
+			rpId = parsed.Hostname()
+		}
+	}
+
+	name := os.Getenv("APP_NAME")
+	if name == "" {
+		name = "OAuth Server"
+	}
+
+	return WebauthnRelyingParty{Id: rpId, Name: name, Origins: origins}
+}
+
+// PublicKeyCredentialDescriptor identifies a credential in ceremony options
+type PublicKeyCredentialDescriptor struct {
+	Type       string   `json:"type"`
+	Id         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// PublicKeyCredentialCreationOptions are passed to navigator.credentials.create();
+// binary members are base64url encoded
+type PublicKeyCredentialCreationOptions struct {
+	Challenge string `json:"challenge"`
+	Rp        struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		Id          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams []struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	} `json:"pubKeyCredParams"`
+	Timeout                int64                           `json:"timeout"`
+	ExcludeCredentials     []PublicKeyCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey        string `json:"residentKey"`
+		RequireResidentKey bool   `json:"requireResidentKey"`
+		UserVerification   string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// PublicKeyCredentialRequestOptions are passed to navigator.credentials.get()
+type PublicKeyCredentialRequestOptions struct {
+	Challenge        string                          `json:"challenge"`
+	RpId             string                          `json:"rpId"`
+	Timeout          int64                           `json:"timeout"`
+	AllowCredentials []PublicKeyCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                          `json:"userVerification"`
+}
+
+// WebauthnCredentialResponse is a PublicKeyCredential serialized by the browser, binary members base64url encoded
+type WebauthnCredentialResponse struct {
+	Id       string `json:"id"`
+	RawId    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject,omitempty"`
+		Transports        []string `json:"transports,omitempty"`
+		AuthenticatorData string   `json:"authenticatorData,omitempty"`
+		Signature         string   `json:"signature,omitempty"`
+		UserHandle        string   `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// WebauthnRegistrationRequest finishes a registration ceremony
+type WebauthnRegistrationRequest struct {
+	SessionId   string                     `json:"sessionId"`
+	DisplayName string                     `json:"displayName"`
+	Credential  WebauthnCredentialResponse `json:"credential"`
+}
+
+// WebauthnLoginRequest starts or finishes an assertion ceremony.
+// Without email or ticket the ceremony is passwordless with a discoverable credential;
+// with an MFA ticket the passkey is the second factor after the password.
+type WebauthnLoginRequest struct {
+	SessionId  string                      `json:"sessionId,omitempty"`
+	Email      string                      `json:"email,omitempty"`
+	MfaTicket  string                      `json:"mfaTicket,omitempty"`
+	Credential *WebauthnCredentialResponse `json:"credential,omitempty"`
+}
+
+// webauthnSession is the server side state of a ceremony between begin and finish
+type webauthnSession struct {
+	Ceremony           string   `json:"ceremony"`
+	Challenge          string   `json:"challenge"`
+	UserId             int64    `json:"userId"`
+	UserHandle         string   `json:"userHandle"`
+	UserVerification   string   `json:"userVerification"`
+	AllowedCredentials []string `json:"allowedCredentials"`
+	SecondFactor       bool     `json:"secondFactor"`
+	TicketAmr          []string `json:"ticketAmr"`
+	ExpiresAt          int64    `json:"expiresAt"`
+}
+
+// webauthnSessions holds ceremony state in process when Redis is not configured
+var webauthnSessions = struct {
+	sync.Mutex
+	entries map[string]*webauthnSession
+}{entries: map[string]*webauthnSession{}}
+
+func saveWebauthnSession(session *webauthnSession) (string, error) {
+	sessionId := models.GenerateRandomString(32)
+	session.ExpiresAt = time.Now().Add(webauthnTimeout).Unix()
+
+	if redisClient != nil {
+		data, err := json.Marshal(session)
+		if err != nil {
+			return "", err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+		defer cancel()
+		if redisClient.Set(ctx, fmt.Sprintf("webauthn:%s", sessionId), data, webauthnTimeout).Err() == nil {
+			return sessionId, nil
+		}
+	}
+
+	now := time.Now().Unix()
+	webauthnSessions.Lock()
+	defer webauthnSessions.Unlock()
+	for id, entry := range webauthnSessions.entries {
+		if now > entry.ExpiresAt {
+			delete(webauthnSessions.entries, id)
+		}
+	}
+	webauthnSessions.entries[sessionId] = session
+	return sessionId, nil
+}
+
+// takeWebauthnSession returns and removes a ceremony, so each challenge is answered only once
+func takeWebauthnSession(sessionId, ceremony string) (*webauthnSession, error) {
+	if sessionId == "" {
+		return nil, ErrWebauthnSessionInvalid
+	}
+
+	var session *webauthnSession
+	if redisClient != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+		defer cancel()
+		data, err := redisClient.GetDel(ctx, fmt.Sprintf("webauthn:%s", sessionId)).Bytes()
+		if err == nil {
+			session = &webauthnSession{}
+			if json.Unmarshal(data, session) != nil {
+				session = nil
+			}
+		}
+	}
+
+	if session == nil {
+		webauthnSessions.Lock()
+		session = webauthnSessions.entries[sessionId]
+		delete(webauthnSessions.entries, sessionId)
+		webauthnSessions.Unlock()
+	}
+
+	if session == nil || session.Ceremony != ceremony || time.Now().Unix() > session.ExpiresAt {
+		return nil, ErrWebauthnSessionInvalid
+	}
+	return session, nil
+}
+
+func newWebauthnChallenge() (string, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+	return webauthnBase64.EncodeToString(challenge), nil
+}
+
+// decodeWebauthnBase64 accepts base64url with or without padding, as browsers and libraries differ
+func decodeWebauthnBase64(value string) ([]byte, error) {
+	return webauthnBase64.DecodeString(strings.TrimRight(value, "="))
+}
+
+func credentialDescriptors(credentials []*models.WebauthnCredential) []PublicKeyCredentialDescriptor {
+	descriptors := []PublicKeyCredentialDescriptor{}
+	for _, credential := range credentials {
+		descriptors = append(descriptors, PublicKeyCredentialDescriptor{
+			Type:       "public-key",
+			Id:         credential.CredentialId,
+			Transports: credential.Transports,
+		})
+	}
+	return descriptors
+}
+
+// webauthnUserHandle returns the opaque user handle of a user, shared by all of their credentials.
+// It is random rather than derived from the user so it reveals nothing about the account.
+func webauthnUserHandle(credentials []*models.WebauthnCredential) (string, error) {
+	for _, credential := range credentials {
+		if credential.UserHandle != "" {
+			return credential.UserHandle, nil
+		}
+	}
+
+	handle := make([]byte, 32)
+	if _, err := rand.Read(handle); err != nil {
+		return "", err
+	}
+	return webauthnBase64.EncodeToString(handle), nil
+}
+
+// BeginWebauthnRegistration creates the options for registering a new credential for a user
+func BeginWebauthnRegistration(user *models.User) (string, *PublicKeyCredentialCreationOptions, error) {
+	credentials, err := models.GetUserWebauthnCredentials(user.Id)
+	if err != nil {
+		return "", nil, err
+	}
+	userHandle, err := webauthnUserHandle(credentials)
+	if err != nil {
+		return "", nil, err
+	}
+	challenge, err := newWebauthnChallenge()
+	if err != nil {
+		return "", nil, err
+	}
+
+	rp := GetWebauthnRelyingParty()
+	options := &PublicKeyCredentialCreationOptions{
+		Challenge:          challenge,
+		Timeout:            webauthnTimeout.Milliseconds(),
+		ExcludeCredentials: credentialDescriptors(credentials),
+		Attestation:        "none",
+	}
+	options.Rp.Id = rp.Id
+	options.Rp.Name = rp.Name
+	options.User.Id = userHandle
+	options.User.Name = user.Email
+	options.User.DisplayName = user.Username
+	for _, alg := range []int{coseAlgES256, coseAlgEdDSA, coseAlgRS256} {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, struct {
+			Type string `json:"type"`
+			Alg  int    `json:"alg"`
+		}{Type: "public-key", Alg: alg})
+	}
+	// Prefer discoverable credentials so the passkey can sign in without a username
+	options.AuthenticatorSelection.ResidentKey = "preferred"
+	options.AuthenticatorSelection.UserVerification = "preferred"
+
+	sessionId, err := saveWebauthnSession(&webauthnSession{
+		Ceremony:         webauthnCeremonyRegister,
+		Challenge:        challenge,
+		UserId:           user.Id,
+		UserHandle:       userHandle,
+		UserVerification: "preferred",
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return sessionId, options, nil
+}
+
+// FinishWebauthnRegistration verifies an attestation response and stores the new credential
+func FinishWebauthnRegistration(user *models.User, request *WebauthnRegistrationRequest) (*models.WebauthnCredential, error) {
+	session, err := takeWebauthnSession(request.SessionId, webauthnCeremonyRegister)
+	if err != nil {
+		return nil, err
+	}
+	if session.UserId != user.Id {
+		return nil, ErrWebauthnSessionInvalid
+	}
+
+	rp := GetWebauthnRelyingParty()
+	response := &request.Credential.Response
+	if _, err = verifyClientData(response.ClientDataJSON, "webauthn.create", session.Challenge, rp); err != nil {
+		return nil, err
+	}
+
+	attestationObject, err := decodeWebauthnBase64(response.AttestationObject)
+	if err != nil {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+	decoded, _, err := decodeCbor(attestationObject)
+	if err != nil {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+	// Attestation statements are not verified: the ceremony asks for "none" conveyance
+	// and the server does not restrict which authenticator models may be used
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkAuthenticatorData(authData, rp, session.UserVerification); err != nil {
+		return nil, err
+	}
+	if authData.Flags&authenticatorFlagAttested == 0 || len(authData.CredentialId) == 0 {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+
+	credentialId := webauthnBase64.EncodeToString(authData.CredentialId)
+	if rawId, err := decodeWebauthnBase64(request.Credential.RawId); err != nil || !bytes.Equal(rawId, authData.CredentialId) {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+
+	existing, err := models.GetWebauthnCredentialByCredentialId(credentialId)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, ErrWebauthnCredentialExists
+	}
+
+	displayName := strings.TrimSpace(request.DisplayName)
+	if displayName == "" {
+		displayName = "Passkey"
+	}
+	if len(displayName) > 100 {
+		displayName = displayName[:100]
+	}
+
+	credential := &models.WebauthnCredential{
+		Owner:        user.Owner,
+		Name:         fmt.Sprintf("webauthn_%s", models.GenerateRandomString(16)),
+		CreatedTime:  models.GetCurrentTime(),
+		UserId:       user.Id,
+		DisplayName:  displayName,
+		CredentialId: credentialId,
+		UserHandle:   session.UserHandle,
+		PublicKey:    webauthnBase64.EncodeToString(authData.PublicKey),
+		Algorithm:    authData.Algorithm,
+		SignCount:    int64(authData.SignCount),
+		Aaguid:       formatAaguid(authData.Aaguid),
+		Transports:   response.Transports,
+		// credProps is not requested, so backup eligibility is the best signal of a discoverable passkey
+		IsDiscoverable: authData.Flags&authenticatorFlagBackupEligible != 0,
+		BackupEligible: authData.Flags&authenticatorFlagBackupEligible != 0,
+		BackupState:    authData.Flags&authenticatorFlagBackupState != 0,
+	}
+	if credential.Transports == nil {
+		credential.Transports = []string{}
+	}
+
+	if _, err = models.AddWebauthnCredential(credential); err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+// BeginWebauthnLogin starts a passwordless sign-in. With a user the allowed credentials are listed;
+// without one the authenticator offers its discoverable credentials.
+func BeginWebauthnLogin(user *models.User) (string, *PublicKeyCredentialRequestOptions, error) {
+	return beginWebauthnLogin(user, false, nil)
+}
+
+// beginWebauthnLogin creates assertion options; ticketAmr carries the methods of the
+// first factor when the passkey is the second factor after a password
+func beginWebauthnLogin(user *models.User, secondFactor bool, ticketAmr []string) (string, *PublicKeyCredentialRequestOptions, error) {
+	challenge, err := newWebauthnChallenge()
+	if err != nil {
+		return "", nil, err
+	}
+
+	rp := GetWebauthnRelyingParty()
+	options := &PublicKeyCredentialRequestOptions{
+		Challenge:        challenge,
+		RpId:             rp.Id,
+		Timeout:          webauthnTimeout.Milliseconds(),
+		AllowCredentials: []PublicKeyCredentialDescriptor{},
+		UserVerification: "required",
+	}
+	session := &webauthnSession{
+		Ceremony:         webauthnCeremonyLogin,
+		Challenge:        challenge,
+		UserVerification: "required",
+		SecondFactor:     secondFactor,
+		TicketAmr:        ticketAmr,
+	}
+
+	if user != nil {
+		credentials, err := models.GetUserWebauthnCredentials(user.Id)
+		if err != nil {
+			return "", nil, err
+		}
+		options.AllowCredentials = credentialDescriptors(credentials)
+		session.UserId = user.Id
+		for _, credential := range credentials {
+			session.AllowedCredentials = append(session.AllowedCredentials, credential.CredentialId)
+		}
+	}
+
+	// As a second factor presence is enough, the password already stands for knowledge
+	if secondFactor {
+		options.UserVerification = "preferred"
+		session.UserVerification = "preferred"
+	}
+
+	sessionId, err := saveWebauthnSession(session)
+	if err != nil {
+		return "", nil, err
+	}
+	return sessionId, options, nil
+}
+
+// FinishWebauthnLogin verifies an assertion and returns the signed in user with the
+// authentication methods of the sign-in
+func FinishWebauthnLogin(request *WebauthnLoginRequest) (*models.User, []string, error) {
+	session, err := takeWebauthnSession(request.SessionId, webauthnCeremonyLogin)
+	if err != nil {
+		return nil, nil, err
+	}
+	if request.Credential == nil {
+		return nil, nil, ErrWebauthnCredentialInvalid
+	}
+
+	rawId, err := decodeWebauthnBase64(request.Credential.RawId)
+	if err != nil || len(rawId) == 0 {
+		return nil, nil, ErrWebauthnCredentialInvalid
+	}
+	credentialId := webauthnBase64.EncodeToString(rawId)
+
+	credential, err := models.GetWebauthnCredentialByCredentialId(credentialId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if credential == nil {
+		return nil, nil, ErrWebauthnCredentialUnknown
+	}
+
+	response := &request.Credential.Response
+	if session.UserId != 0 {
+		if credential.UserId != session.UserId || !containsString(session.AllowedCredentials, credentialId) {
+			return nil, nil, ErrWebauthnCredentialUnknown
+		}
+	} else if response.UserHandle == "" {
+		// Discoverable credentials identify the user through the user handle (WebAuthn §7.2 step 6)
+		return nil, nil, ErrWebauthnCredentialUnknown
+	}
+	if response.UserHandle != "" {
+		userHandle, err := decodeWebauthnBase64(response.UserHandle)
+		if err != nil || webauthnBase64.EncodeToString(userHandle) != credential.UserHandle {
+			return nil, nil, ErrWebauthnCredentialUnknown
+		}
+	}
+
+	rp := GetWebauthnRelyingParty()
+	clientDataJSON, err := verifyClientData(response.ClientDataJSON, "webauthn.get", session.Challenge, rp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rawAuthData, err := decodeWebauthnBase64(response.AuthenticatorData)
+	if err != nil {
+		return nil, nil, ErrWebauthnCredentialInvalid
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = checkAuthenticatorData(authData, rp, session.UserVerification); err != nil {
+		return nil, nil, err
+	}
+
+	signature, err := decodeWebauthnBase64(response.Signature)
+	if err != nil {
+		return nil, nil, ErrWebauthnCredentialInvalid
+	}
+	publicKey, err := decodeWebauthnBase64(credential.PublicKey)
+	if err != nil {
+		return nil, nil, ErrWebauthnCredentialInvalid
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err = verifyCoseSignature(publicKey, signed, signature); err != nil {
+		return nil, nil, ErrWebauthnCredentialInvalid
+	}
+
+	// A counter that does not increase means the credential may have been cloned (WebAuthn §6.1.1)
+	signCount := int64(authData.SignCount)
+	if credential.SignCount != 0 && signCount <= credential.SignCount {
+		return nil, nil, ErrWebauthnCounterRegressed
+	}
+	credential.BackupState = authData.Flags&authenticatorFlagBackupState != 0
+	updated, err := models.UpdateWebauthnCredentialUsage(credential, signCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !updated {
+		return nil, nil, ErrWebauthnCounterRegressed
+	}
+
+	user, err := models.GetUserById(credential.UserId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user == nil || user.IsDeleted {
+		return nil, nil, ErrWebauthnCredentialUnknown
+	}
+	if user.IsForbidden {
+		return nil, nil, fmt.Errorf("account is disabled")
+	}
+
+	amr := append([]string{}, session.TicketAmr...)
+	amr = append(amr, AmrHardwareKey)
+	if authData.Flags&authenticatorFlagUserVerified != 0 {
+		amr = append(amr, AmrUser)
+	}
+	// A user-verifying passkey is possession plus a PIN or biometric, and after a password it is a second factor
+	if session.SecondFactor || authData.Flags&authenticatorFlagUserVerified != 0 {
+		amr = append(amr, AmrMfa)
+	}
+	return user, amr, nil
+}
+
+// BeginWebauthnMfaLogin starts a passkey second factor for an MFA ticket
+func BeginWebauthnMfaLogin(ticket string) (string, *PublicKeyCredentialRequestOptions, error) {
+	claims, user, err := openMfaTicket(ticket)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The ticket is spent here; the single-use WebAuthn session carries the sign-in from now on
+	countMfaTicketAttempt(claims.ID, claims.ExpiresAt.Time, mfaTicketMaxAttempts)
+	return beginWebauthnLogin(user, true, claims.Amr)
+}
+
+// verifyClientData checks the collected client data and returns its raw bytes
+func verifyClientData(encoded, ceremonyType, challenge string, rp WebauthnRelyingParty) ([]byte, error) {
+	raw, err := decodeWebauthnBase64(encoded)
+	if err != nil {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+
+	var clientData struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}
+	if err = json.Unmarshal(raw, &clientData); err != nil {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+
+	if clientData.Type != ceremonyType || clientData.CrossOrigin {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimRight(clientData.Challenge, "=")), []byte(challenge)) != 1 {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+	if !containsString(rp.Origins, strings.TrimRight(clientData.Origin, "/")) {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+	return raw, nil
+}
+
+// authenticatorData is the parsed authenticator data of a WebAuthn response
+type authenticatorData struct {
+	RpIdHash     []byte
+	Flags        byte
+	SignCount    uint32
+	Aaguid       []byte
+	CredentialId []byte
+	PublicKey    []byte // COSE_Key as encoded by the authenticator
+	Algorithm    int
+}
+
+// parseAuthenticatorData parses authenticator data (WebAuthn §6.1)
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+
+	authData := &authenticatorData{
+		RpIdHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if authData.Flags&authenticatorFlagAttested == 0 {
+		return authData, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+	authData.Aaguid = rest[:16]
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength == 0 || idLength > 1023 || len(rest) < idLength {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+	authData.CredentialId = rest[:idLength]
+	rest = rest[idLength:]
+
+	decoded, n, err := decodeCbor(rest)
+	if err != nil {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+	coseKey, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+	algorithm, ok := coseKey[int64(3)].(int64)
+	if !ok {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+	if _, err = parseCosePublicKey(rest[:n]); err != nil {
+		return nil, err
+	}
+	authData.PublicKey = rest[:n]
+	authData.Algorithm = int(algorithm)
+	return authData, nil
+}
+
+// checkAuthenticatorData checks the relying party hash and the user presence / verification flags
+func checkAuthenticatorData(authData *authenticatorData, rp WebauthnRelyingParty, userVerification string) error {
+	rpIdHash := sha256.Sum256([]byte(rp.Id))
+	if subtle.ConstantTimeCompare(authData.RpIdHash, rpIdHash[:]) != 1 {
+		return ErrWebauthnCredentialInvalid
+	}
+	if authData.Flags&authenticatorFlagUserPresent == 0 {
+		return ErrWebauthnCredentialInvalid
+	}
+	if userVerification == "required" && authData.Flags&authenticatorFlagUserVerified == 0 {
+		return ErrWebauthnCredentialInvalid
+	}
+	return nil
+}
+
+// coseKeyBytes reads a byte string member of a COSE key
+func coseKeyBytes(coseKey map[interface{}]interface{}, label int64) ([]byte, bool) {
+	value, ok := coseKey[label].([]byte)
+	return value, ok
+}
+
+// parseCosePublicKey converts a COSE_Key (RFC 9053) into a Go public key.
+// Only the algorithms offered in pubKeyCredParams are accepted.
+func parseCosePublicKey(data []byte) (interface{}, error) {
+	decoded, _, err := decodeCbor(data)
+	if err != nil {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+	coseKey, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebauthnCredentialInvalid
+	}
+	kty, _ := coseKey[int64(1)].(int64)
+	alg, _ := coseKey[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := coseKey[int64(-1)].(int64)
+		x, okX := coseKeyBytes(coseKey, -2)
+		y, okY := coseKeyBytes(coseKey, -3)
+		if crv != 1 || !okX || !okY || len(x) != 32 || len(y) != 32 {
+			return nil, ErrWebauthnCredentialInvalid
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, ErrWebauthnCredentialInvalid
+		}
+		return publicKey, nil
+	case kty == 1 && alg == coseAlgEdDSA:
+		crv, _ := coseKey[int64(-1)].(int64)
+		x, ok := coseKeyBytes(coseKey, -2)
+		if crv != 6 || !ok || len(x) != ed25519.PublicKeySize {
+			return nil, ErrWebauthnCredentialInvalid
+		}
+		return ed25519.PublicKey(x), nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, okN := coseKeyBytes(coseKey, -1)
+		e, okE := coseKeyBytes(coseKey, -2)
+		if !okN || !okE || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, ErrWebauthnCredentialInvalid
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, ErrWebauthnCredentialInvalid
+}
+
+// verifyCoseSignature verifies an assertion signature with a stored COSE public key
+func verifyCoseSignature(coseKey, signed, signature []byte) error {
+	publicKey, err := parseCosePublicKey(coseKey)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(signed)
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return ErrWebauthnCredentialInvalid
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, signed, signature) {
+			return ErrWebauthnCredentialInvalid
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return ErrWebauthnCredentialInvalid
+		}
+	default:
+		return ErrWebauthnCredentialInvalid
+	}
+	return nil
+}
+
+// formatAaguid formats an authenticator model identifier as a UUID
+func formatAaguid(aaguid []byte) string {
+	if len(aaguid) != 16 {
+		return ""
+	}
+	value := hex.EncodeToString(aaguid)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", value[0:8], value[8:12], value[12:16], value[16:20], value[20:])
+}
@@ -0,0 +1,282 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package services
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+// TestDecodeCbor tests the CBOR decoder against RFC 8949 Appendix A examples
+func TestDecodeCbor(t *testing.T) {
+	tests := []struct {
+		hex      string
+		expected interface{}
+	}{
+		{hex: "00", expected: int64(0)},
+		{hex: "17", expected: int64(23)},
+		{hex: "1818", expected: int64(24)},
+		{hex: "1903e8", expected: int64(1000)},
+		{hex: "20", expected: int64(-1)},
+		{hex: "3903e7", expected: int64(-1000)},
+		{hex: "6449455446", expected: "IETF"},
+		{hex: "f5", expected: true},
+		{hex: "f6", expected: nil},
+	}
+
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.hex)
+		got, n, err := decodeCbor(data)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.hex, err)
+			continue
+		}
+		if got != tt.expected || n != len(data) {
+			t.Errorf("%s: expected %v, got %v (%d bytes)", tt.hex, tt.expected, got, n)
+		}
+	}
+
+	// {1: 2, "a": h'0102', "b": [3]} followed by a trailing byte
+	data, _ := hex.DecodeString("a301026161420102616281" + "03" + "ff")
+	got, n, err := decodeCbor(data)
+	if err != nil {
+		t.Fatalf("Failed to decode map: %v", err)
+	}
+	if n != len(data)-1 {
+		t.Errorf("Expected %d bytes read, got %d", len(data)-1, n)
+	}
+	entries := got.(map[interface{}]interface{})
+	if entries[int64(1)] != int64(2) || !bytes.Equal(entries["a"].([]byte), []byte{1, 2}) || entries["b"].([]interface{})[0] != int64(3) {
+		t.Errorf("Unexpected map: %v", entries)
+	}
+
+	for _, invalid := range []string{"", "19", "62ff", "a20101" + "0102", "9f", "f9"} {
+		data, _ := hex.DecodeString(invalid)
+		if _, _, err := decodeCbor(data); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+
+	// Deep nesting is rejected
+	if _, _, err := decodeCbor(bytes.Repeat([]byte{0x81}, 100)); err == nil {
+		t.Errorf("Expected deeply nested input to be rejected")
+	}
+}
+
+// cborHeader encodes a CBOR data item header for the test encoder
+func cborHeader(major byte, argument int) []byte {
+	switch {
+	case argument < 24:
+		return []byte{major<<5 | byte(argument)}
+	case argument < 256:
+		return []byte{major<<5 | 24, byte(argument)}
+	default:
+		return []byte{major<<5 | 25, byte(argument >> 8), byte(argument)}
+	}
+}
+
+func cborInt(value int) []byte {
+	if value < 0 {
+		return cborHeader(1, -1-value)
+	}
+	return cborHeader(0, value)
+}
+
+func cborBytes(value []byte) []byte {
+	return append(cborHeader(2, len(value)), value...)
+}
+
+// testEs256CoseKey encodes a P-256 public key as a COSE_Key
+func testEs256CoseKey(publicKey *ecdsa.PublicKey) []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	publicKey.X.FillBytes(x)
+	publicKey.Y.FillBytes(y)
+
+	key := cborHeader(5, 5)
+	key = append(key, cborInt(1)...)
+	key = append(key, cborInt(2)...)
+	key = append(key, cborInt(3)...)
+	key = append(key, cborInt(coseAlgES256)...)
+	key = append(key, cborInt(-1)...)
+	key = append(key, cborInt(1)...)
+	key = append(key, cborInt(-2)...)
+	key = append(key, cborBytes(x)...)
+	key = append(key, cborInt(-3)...)
+	key = append(key, cborBytes(y)...)
+	return key
+}
+
+// testAuthenticatorData builds authenticator data, with attested credential data when credentialId is set
+func testAuthenticatorData(rpId string, flags byte, signCount uint32, credentialId, coseKey []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	data := append([]byte{}, rpIdHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, signCount)
+	if credentialId != nil {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(credentialId)))
+		data = append(data, credentialId...)
+		data = append(data, coseKey...)
+	}
+	return data
+}
+
+func testClientData(t *testing.T, ceremonyType, challenge, origin string) string {
+	data, err := json.Marshal(map[string]interface{}{
+		"type":      ceremonyType,
+		"challenge": challenge,
+		"origin":    origin,
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode client data: %v", err)
+	}
+	return webauthnBase64.EncodeToString(data)
+}
+
+// TestParseAuthenticatorData tests attested credential data parsing and the flag checks
+func TestParseAuthenticatorData(t *testing.T) {
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	coseKey := testEs256CoseKey(&privateKey.PublicKey)
+	credentialId := []byte("credential-id")
+	rp := WebauthnRelyingParty{Id: "example.com", Origins: []string{"https://example.com"}}
+
+	// Extensions after the key must not be read as part of it
+	raw := testAuthenticatorData(rp.Id, authenticatorFlagUserPresent|authenticatorFlagAttested, 7, credentialId, coseKey)
+	authData, err := parseAuthenticatorData(append(raw, 0xa0))
+	if err != nil {
+		t.Fatalf("parseAuthenticatorData failed: %v", err)
+	}
+	if !bytes.Equal(authData.CredentialId, credentialId) || !bytes.Equal(authData.PublicKey, coseKey) {
+		t.Errorf("Unexpected attested credential data")
+	}
+	if authData.SignCount != 7 || authData.Algorithm != coseAlgES256 {
+		t.Errorf("Unexpected sign count %d or algorithm %d", authData.SignCount, authData.Algorithm)
+	}
+
+	if err := checkAuthenticatorData(authData, rp, "preferred"); err != nil {
+		t.Errorf("Expected authenticator data to be accepted: %v", err)
+	}
+	if err := checkAuthenticatorData(authData, rp, "required"); err == nil {
+		t.Errorf("Expected missing user verification to be rejected")
+	}
+	if err := checkAuthenticatorData(authData, WebauthnRelyingParty{Id: "evil.example"}, "preferred"); err == nil {
+		t.Errorf("Expected another relying party to be rejected")
+	}
+
+	notPresent, _ := parseAuthenticatorData(testAuthenticatorData(rp.Id, 0, 0, nil, nil))
+	if err := checkAuthenticatorData(notPresent, rp, "discouraged"); err == nil {
+		t.Errorf("Expected missing user presence to be rejected")
+	}
+
+	if _, err := parseAuthenticatorData(raw[:len(raw)-10]); err == nil {
+		t.Errorf("Expected truncated authenticator data to be rejected")
+	}
+}
+
+// TestVerifyClientData tests the ceremony type, challenge and origin checks
+func TestVerifyClientData(t *testing.T) {
+	rp := WebauthnRelyingParty{Id: "example.com", Origins: []string{"https://example.com"}}
+
+	if _, err := verifyClientData(testClientData(t, "webauthn.get", "abc", "https://example.com"), "webauthn.get", "abc", rp); err != nil {
+		t.Errorf("Expected client data to be accepted: %v", err)
+	}
+	if _, err := verifyClientData(testClientData(t, "webauthn.create", "abc", "https://example.com"), "webauthn.get", "abc", rp); err == nil {
+		t.Errorf("Expected another ceremony type to be rejected")
+	}
+	if _, err := verifyClientData(testClientData(t, "webauthn.get", "xyz", "https://example.com"), "webauthn.get", "abc", rp); err == nil {
+		t.Errorf("Expected another challenge to be rejected")
+	}
+	if _, err := verifyClientData(testClientData(t, "webauthn.get", "abc", "https://evil.example"), "webauthn.get", "abc", rp); err == nil {
+		t.Errorf("Expected another origin to be rejected")
+	}
+}
+
+// TestVerifyCoseSignature tests assertion signatures with ES256 and EdDSA keys
+func TestVerifyCoseSignature(t *testing.T) {
+	signed := []byte("authenticator data and client data hash")
+
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	digest := sha256.Sum256(signed)
+	signature, _ := ecdsa.SignASN1(rand.Reader, privateKey, digest[:])
+	coseKey := testEs256CoseKey(&privateKey.PublicKey)
+	if err := verifyCoseSignature(coseKey, signed, signature); err != nil {
+		t.Errorf("Expected ES256 signature to be valid: %v", err)
+	}
+	if err := verifyCoseSignature(coseKey, append(signed, 0), signature); err == nil {
+		t.Errorf("Expected ES256 signature over other data to be rejected")
+	}
+
+	publicKey, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edCoseKey := cborHeader(5, 4)
+	edCoseKey = append(edCoseKey, cborInt(1)...)
+	edCoseKey = append(edCoseKey, cborInt(1)...)
+	edCoseKey = append(edCoseKey, cborInt(3)...)
+	edCoseKey = append(edCoseKey, cborInt(coseAlgEdDSA)...)
+	edCoseKey = append(edCoseKey, cborInt(-1)...)
+	edCoseKey = append(edCoseKey, cborInt(6)...)
+	edCoseKey = append(edCoseKey, cborInt(-2)...)
+	edCoseKey = append(edCoseKey, cborBytes(publicKey)...)
+	if err := verifyCoseSignature(edCoseKey, signed, ed25519.Sign(edKey, signed)); err != nil {
+		t.Errorf("Expected EdDSA signature to be valid: %v", err)
+	}
+
+	// A point that is not on the curve is rejected
+	invalid := bytes.Replace(coseKey, coseKey[len(coseKey)-32:], make([]byte, 32), 1)
+	if _, err := parseCosePublicKey(invalid); err == nil {
+		t.Errorf("Expected invalid EC point to be rejected")
+	}
+}
+
+// TestWebauthnSession tests that a ceremony can only be finished once and only as the same ceremony
+func TestWebauthnSession(t *testing.T) {
+	sessionId, err := saveWebauthnSession(&webauthnSession{Ceremony: webauthnCeremonyLogin, Challenge: "abc"})
+	if err != nil {
+		t.Fatalf("saveWebauthnSession failed: %v", err)
+	}
+
+	if _, err := takeWebauthnSession(sessionId, webauthnCeremonyRegister); err != ErrWebauthnSessionInvalid {
+		t.Errorf("Expected a login session to be rejected for registration")
+	}
+
+	sessionId, _ = saveWebauthnSession(&webauthnSession{Ceremony: webauthnCeremonyLogin, Challenge: "abc", SecondFactor: true})
+	session, err := takeWebauthnSession(sessionId, webauthnCeremonyLogin)
+	if err != nil || session.Challenge != "abc" || !session.SecondFactor {
+		t.Fatalf("Unexpected session %+v: %v", session, err)
+	}
+	if _, err := takeWebauthnSession(sessionId, webauthnCeremonyLogin); err != ErrWebauthnSessionInvalid {
+		t.Errorf("Expected a session to be usable only once")
+	}
+}
+
+// TestGetWebauthnRelyingParty tests the relying party defaults
+func TestGetWebauthnRelyingParty(t *testing.T) {
+	t.Setenv("WEBAUTHN_RP_ID", "")
+	t.Setenv("WEBAUTHN_ORIGINS", "")
+	t.Setenv("ORIGIN_FRONTEND", "https://login.example.com/")
+	t.Setenv("ORIGIN", "https://api.example.com")
+
+	rp := GetWebauthnRelyingParty()
+	if rp.Id != "login.example.com" {
+		t.Errorf("Expected relying party ID from the frontend origin, got %s", rp.Id)
+	}
+	if len(rp.Origins) != 2 || rp.Origins[0] != "https://login.example.com" {
+		t.Errorf("Unexpected origins: %v", rp.Origins)
+	}
+
+	t.Setenv("WEBAUTHN_RP_ID", "example.com")
+	t.Setenv("WEBAUTHN_ORIGINS", "https://a.example.com, https://b.example.com")
+	rp = GetWebauthnRelyingParty()
+	if rp.Id != "example.com" || len(rp.Origins) != 2 || rp.Origins[1] != "https://b.example.com" {
+		t.Errorf("Unexpected configured relying party: %+v", rp)
+	}
+}
@@ -26,4 +26,112 @@ type CreateApplicationRequest struct {
 	RedirectUris []string `json:"redirectUris,omitempty"`
 	GrantTypes   []string `json:"grantTypes,omitempty"`
 	Scopes       []string `json:"scopes,omitempty"`
+
+	// 是否允许邮箱验证码 / 一键登录链接登录
+	EnableCodeSignin *bool `json:"enableCodeSignin,omitempty"`
+
+	// 应用类别及 SAML 服务提供商配置
+	Category         string            `json:"category,omitempty"` // OAuth（默认）或 SAML
+	SamlEntityId     string            `json:"samlEntityId,omitempty"`
+	SamlAcsUrl       string            `json:"samlAcsUrl,omitempty"`
+	SamlSloUrl       *string           `json:"samlSloUrl,omitempty"`
+	SamlNameIdFormat string            `json:"samlNameIdFormat,omitempty"`
+	SamlAttributes   map[string]string `json:"samlAttributes,omitempty"`
+
+	// Refresh Token 策略，更新时未设置的字段保持不变，0 表示使用默认有效期/不限制
+	RefreshTokenPolicy       string   `json:"refreshTokenPolicy,omitempty"` // offline_access（默认）、always、never
+	RefreshIdleHours         *float64 `json:"refreshIdleHours,omitempty"`
+	RefreshAbsoluteHours     *float64 `json:"refreshAbsoluteHours,omitempty"`
+	RefreshReuseGraceSeconds *int     `json:"refreshReuseGraceSeconds,omitempty"`
+
+	// OIDC 响应签名/加密配置，更新时未设置的字段保持不变，空字符串表示清除
+	Jwks                         *string `json:"jwks,omitempty"`
+	JwksUri                      *string `json:"jwksUri,omitempty"`
+	IdTokenSignedResponseAlg     *string `json:"idTokenSignedResponseAlg,omitempty"`
+	IdTokenEncryptedResponseAlg  *string `json:"idTokenEncryptedResponseAlg,omitempty"`
+	IdTokenEncryptedResponseEnc  *string `json:"idTokenEncryptedResponseEnc,omitempty"`
+	UserinfoSignedResponseAlg    *string `json:"userinfoSignedResponseAlg,omitempty"`
+	UserinfoEncryptedResponseAlg *string `json:"userinfoEncryptedResponseAlg,omitempty"`
+	UserinfoEncryptedResponseEnc *string `json:"userinfoEncryptedResponseEnc,omitempty"`
+}
+
+// CreateInitialAccessTokenRequest 创建动态客户端注册初始访问令牌请求
+type CreateInitialAccessTokenRequest struct {
+	Organization   string  `json:"organization,omitempty"`
+	Description    string  `json:"description,omitempty"`
+	ExpiresInHours float64 `json:"expiresInHours,omitempty"` // 0 表示不过期
+	MaxUses        int     `json:"maxUses,omitempty"`        // 0 表示不限次数
+}
+
+// CreateScimTokenRequest 创建 SCIM 令牌请求
+type CreateScimTokenRequest struct {
+	Organization   string  `json:"organization,omitempty"` // 默认 built-in
+	Description    string  `json:"description,omitempty"`
+	ExpiresInHours float64 `json:"expiresInHours,omitempty"` // 0 表示不过期
+}
+
+// RotateClientSecretRequest 签发新 Client Secret 请求
+type RotateClientSecretRequest struct {
+	ExpiresInHours         float64  `json:"expiresInHours,omitempty"`         // 新密钥有效期，0 表示不过期
+	PreviousExpiresInHours *float64 `json:"previousExpiresInHours,omitempty"` // 现有密钥的剩余有效期，未设置时保持不变
+}
+
+// UpdateDcrPolicyRequest 更新组织动态客户端注册策略请求
+type UpdateDcrPolicyRequest struct {
+	DcrPolicy                   string  `json:"dcrPolicy"`
+	DcrRequireSoftwareStatement *bool   `json:"dcrRequireSoftwareStatement,omitempty"`
+	DcrSoftwareStatementJwks    *string `json:"dcrSoftwareStatementJwks,omitempty"`
+}
+
+// UpdatePasswordTypeRequest 设置组织的密码哈希算法请求
+// 新密码和用户登录后升级的哈希使用 PasswordType；PasswordSalt 仅用于校验导入的旧版加盐 SHA-256 哈希
+type UpdatePasswordTypeRequest struct {
+	PasswordType string  `json:"passwordType"`
+	PasswordSalt *string `json:"passwordSalt,omitempty"`
+}
+
+// UpdatePasswordPolicyRequest 设置组织的密码策略请求，所有字段一并替换
+type UpdatePasswordPolicyRequest struct {
+	PasswordMinLength            int      `json:"passwordMinLength"`            // 0 表示使用默认最小长度，不能低于默认值
+	PasswordCharClasses          []string `json:"passwordCharClasses"`          // 必须包含的字符类别：lower、upper、digit、symbol
+	PasswordForbidUserAttributes bool     `json:"passwordForbidUserAttributes"` // 禁止包含用户名、邮箱或手机号
+	PasswordHistorySize          int      `json:"passwordHistorySize"`          // 不能与最近几次的密码相同，0 表示不限制
+	PasswordMaxAgeDays           int      `json:"passwordMaxAgeDays"`           // 密码有效天数，0 表示不过期
+	PasswordCheckBreached        bool     `json:"passwordCheckBreached"`        // 检查本地泄露密码库
+}
+
+// UpdateSigninIdentifiersRequest 设置组织密码登录可用的账号类型请求
+type UpdateSigninIdentifiersRequest struct {
+	SigninIdentifiers []string `json:"signinIdentifiers"` // email、username、phone，为空表示全部可用
+}
+
+// ProviderRequest 创建或更新登录提供商请求
+// Type 为 GitHub、Google、QQ、WeChat 时未填写的端点、Scope 和属性映射使用内置预设，
+// Category 为 OIDC 时只需填写 Issuer，为 LDAP 时填写服务器地址和目录设置
+type ProviderRequest struct {
+	Name         string            `json:"name"`
+	DisplayName  string            `json:"displayName,omitempty"`
+	Category     string            `json:"category,omitempty"` // 默认 OAuth
+	Type         string            `json:"type"`
+	ClientId     string            `json:"clientId"`
+	ClientSecret string            `json:"clientSecret,omitempty"` // 更新时留空表示不修改
+	AuthUrl      string            `json:"authUrl,omitempty"`
+	TokenUrl     string            `json:"tokenUrl,omitempty"`
+	UserInfoUrl  string            `json:"userInfoUrl,omitempty"`
+	Scopes       string            `json:"scopes,omitempty"`
+	UserMapping  map[string]string `json:"userMapping,omitempty"` // id、username、displayName、email、emailVerified、avatar
+	IsEnabled    *bool             `json:"isEnabled,omitempty"`
+	Issuer       string            `json:"issuer,omitempty"`       // Category 为 OIDC 时必填，端点通过 discovery 获取
+	Organization string            `json:"organization,omitempty"` // 新用户所属组织，默认 built-in
+	EmailLinking string            `json:"emailLinking,omitempty"` // 已验证邮箱与现有账号相同时：reject（默认）、link 或 ignore
+
+	// Category 为 LDAP 时使用：ClientId 和 ClientSecret 为服务账号的 DN 和密码，留空时匿名搜索
+	HostUrl            string            `json:"hostUrl,omitempty"` // ldap:// 或 ldaps:// 服务器地址
+	LdapBaseDn         string            `json:"ldapBaseDn,omitempty"`
+	LdapUserFilter     string            `json:"ldapUserFilter,omitempty"`     // %s 为登录邮箱，默认 (mail=%s)
+	LdapBindDnTemplate string            `json:"ldapBindDnTemplate,omitempty"` // 设置后用户直接绑定，如 uid=%s,ou=people,dc=example,dc=com
+	LdapStartTls       bool              `json:"ldapStartTls,omitempty"`
+	LdapGroupAttribute string            `json:"ldapGroupAttribute,omitempty"` // 默认 memberOf
+	LdapGroupRoles     map[string]string `json:"ldapGroupRoles,omitempty"`     // 组 DN -> user 或 admin，设置后只有这些组的成员可以登录
+	LdapSyncInterval   int               `json:"ldapSyncInterval,omitempty"`   // 自动同步间隔（分钟），0 表示不自动同步
 }
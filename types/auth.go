@@ -1,8 +1,11 @@
 package types
 
 // LoginRequest 登录请求
+// Identifier 可以是邮箱、用户名或已验证的手机号，可用的类型由组织的 signinIdentifiers 决定；
+// Email 为兼容旧客户端保留，Identifier 为空时使用
 type LoginRequest struct {
-	Email        string `json:"email" validate:"required,email"`
+	Identifier   string `json:"identifier,omitempty"`
+	Email        string `json:"email,omitempty"`
 	Password     string `json:"password" validate:"required,min=6"`
 	CaptchaToken string `json:"captchaToken,omitempty"`
 }
@@ -16,22 +19,107 @@ type LoginResponse struct {
 	User         UserInfo `json:"user"`
 }
 
+// CodeLoginRequest 验证码登录请求，Email+Code、Phone+Code 与 LoginToken（一键登录链接）三选一
+type CodeLoginRequest struct {
+	Email        string `json:"email,omitempty"`
+	Phone        string `json:"phone,omitempty"`
+	Code         string `json:"code,omitempty"`
+	LoginToken   string `json:"loginToken,omitempty"`
+	ClientId     string `json:"clientId,omitempty"`
+	CaptchaToken string `json:"captchaToken,omitempty"`
+}
+
+// MfaChallengeResponse 需要第二步验证时的登录响应
+// 客户端凭 MfaTicket 调用 /api/auth/mfa/verify 换取令牌
+type MfaChallengeResponse struct {
+	MfaRequired bool     `json:"mfaRequired"`
+	MfaTicket   string   `json:"mfaTicket"`
+	Methods     []string `json:"methods"`
+}
+
+// MfaVerifyRequest 登录第二步验证请求，Code 与 RecoveryCode 二选一
+type MfaVerifyRequest struct {
+	MfaTicket    string `json:"mfaTicket" validate:"required"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+}
+
+// TotpCodeRequest 携带 TOTP 验证码或恢复码的请求
+type TotpCodeRequest struct {
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+}
+
 // RegisterRequest 注册请求
 type RegisterRequest struct {
 	Username         string `json:"username" validate:"required,min=3,max=50"`
 	Password         string `json:"password" validate:"required,min=6"`
-	Email            string `json:"email" validate:"required,email"`
+	Email            string `json:"email" validate:"omitempty,email"`
+	Phone            string `json:"phone,omitempty"` // 使用手机号注册时填写，与邮箱二选一
 	VerificationCode string `json:"verificationCode" validate:"required"`
 }
 
 // UserInfo 用户信息
 type UserInfo struct {
-	ID          int64  `json:"id"`
-	Email       string `json:"email"`
-	Username    string `json:"username"`
-	IsAdmin     bool   `json:"isAdmin"`
-	IsRealName  bool   `json:"isRealName,omitempty"`
-	IsForbidden bool   `json:"isForbidden"`
-	QQ          string `json:"qq,omitempty"`
-	Avatar      string `json:"avatar,omitempty"`
+	ID            int64  `json:"id"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	Username      string `json:"username"`
+	IsAdmin       bool   `json:"isAdmin"`
+	IsRealName    bool   `json:"isRealName,omitempty"`
+	IsForbidden   bool   `json:"isForbidden"`
+	QQ            string `json:"qq,omitempty"`
+	Avatar        string `json:"avatar,omitempty"`
+	Phone         string `json:"phone,omitempty"`
+}
+
+// PhoneBindRequest 绑定手机号请求，发送验证码时只需填写 Phone
+type PhoneBindRequest struct {
+	Phone string `json:"phone"`
+	Code  string `json:"code,omitempty"`
+}
+
+// EmailChangeRequest 更换邮箱请求，发送验证码时只需填写 Email
+type EmailChangeRequest struct {
+	Email string `json:"email"`
+	Code  string `json:"code,omitempty"`
+}
+
+// EmailRevertRequest 使用旧邮箱收到的撤销链接恢复原邮箱
+type EmailRevertRequest struct {
+	Token string `json:"token"`
+}
+
+// DeleteAccountRequest 注销账号请求，需提供当前密码或发送到账号的验证码，启用两步验证时还需 TOTP 验证码或恢复码
+type DeleteAccountRequest struct {
+	Password     string `json:"password,omitempty"`
+	Code         string `json:"code,omitempty"`
+	TotpCode     string `json:"totpCode,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+}
+
+// RevokeAllSessionsRequest 退出所有设备请求，exceptCurrent 为 true 时保留当前会话
+type RevokeAllSessionsRequest struct {
+	ExceptCurrent bool `json:"exceptCurrent"`
+}
+
+// ProviderLoginRequest 第三方登录回调后使用一次性票据换取令牌
+type ProviderLoginRequest struct {
+	Ticket string `json:"ticket"`
+}
+
+// SamlSsoRequest 前端确认登录后为 SAML 服务提供商签发断言
+// SAMLRequest 为 SP 发起的登录请求（HTTP-Redirect 绑定时为压缩编码），为空时按 EntityId 发起 IdP 登录
+type SamlSsoRequest struct {
+	SAMLRequest string `json:"samlRequest,omitempty"`
+	Binding     string `json:"binding,omitempty"`
+	RelayState  string `json:"relayState,omitempty"`
+	EntityId    string `json:"entityId,omitempty"`
+}
+
+// SamlSloRequest 为 SAML 服务提供商签发注销响应，同时登出当前浏览器的会话
+type SamlSloRequest struct {
+	SAMLRequest string `json:"samlRequest"`
+	Binding     string `json:"binding,omitempty"`
+	RelayState  string `json:"relayState,omitempty"`
 }
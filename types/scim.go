@@ -0,0 +1,53 @@
+// Copyright 2024 OAuth Server Authors.
+// Licensed under the Apache License, Version 2.0
+
+package types
+
+import "strconv"
+
+// SCIM 协议消息的 schema（RFC 7644 §3）
+const (
+	ScimSchemaListResponse = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	ScimSchemaPatchOp      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ScimSchemaError        = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// ScimErrorResponse SCIM 错误响应，status 为字符串形式的 HTTP 状态码
+type ScimErrorResponse struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// NewScimErrorResponse 创建 SCIM 错误响应
+func NewScimErrorResponse(status int, scimType, detail string) ScimErrorResponse {
+	return ScimErrorResponse{
+		Schemas:  []string{ScimSchemaError},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	}
+}
+
+// ScimListResponse SCIM 列表响应，startIndex 从 1 开始
+type ScimListResponse struct {
+	Schemas      []string                 `json:"schemas"`
+	TotalResults int                      `json:"totalResults"`
+	StartIndex   int                      `json:"startIndex"`
+	ItemsPerPage int                      `json:"itemsPerPage"`
+	Resources    []map[string]interface{} `json:"Resources"`
+}
+
+// ScimPatchOperation SCIM PATCH 中的一个操作，op 为 add、replace 或 remove（不区分大小写）
+type ScimPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// ScimPatchRequest SCIM PATCH 请求
+type ScimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []ScimPatchOperation `json:"Operations"`
+}
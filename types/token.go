@@ -9,6 +9,7 @@ type TokenRequest struct {
 	ClientSecret string `json:"client_secret,omitempty" form:"client_secret"`
 	RefreshToken string `json:"refresh_token,omitempty" form:"refresh_token"`
 	Username     string `json:"username,omitempty" form:"username"`
+	Identifier   string `json:"identifier,omitempty" form:"identifier"` // password 模式下 username 的别名
 	Password     string `json:"password,omitempty" form:"password"`
 	Scope        string `json:"scope,omitempty" form:"scope"`
 }